@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/l2tp"
+	"golang.org/x/sys/unix"
+)
+
+// controlServer implements a simple management interface for kl2tpd
+// over a unix domain socket.
+//
+// Clients send newline-delimited commands, and receive a single line
+// JSON response for each command:
+//
+//	list-tunnels
+//	list-sessions <tunnel>
+//	show-stats <tunnel> [session]
+//	show-health [tunnel]
+//	restart-tunnel <tunnel>
+//	version
+//	shutdown
+//
+// Failed commands receive a response with the "error" field set.
+// For show-stats, a session whose statistics can't be read is reported
+// with its own "error" field set, alongside the other sessions.
+type controlServer struct {
+	app      *application
+	logger   log.Logger
+	path     string
+	listener net.Listener
+	connLock sync.Mutex
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+type controlTunnelInfo struct {
+	Name     string `json:"name"`
+	Sessions int    `json:"sessions"`
+}
+
+type controlSessionInfo struct {
+	Name string `json:"name"`
+}
+
+type controlSessionStats struct {
+	Tunnel    string `json:"tunnel"`
+	Session   string `json:"session"`
+	TxPackets uint64 `json:"tx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxErrors  uint64 `json:"tx_errors"`
+	RxPackets uint64 `json:"rx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxErrors  uint64 `json:"rx_errors"`
+	// Error is set if the session's statistics couldn't be read,
+	// e.g. because the session is still being established
+	Error string `json:"error,omitempty"`
+}
+
+type controlTunnelHealth struct {
+	Tunnel        string `json:"tunnel"`
+	State         string `json:"state"`
+	LastRoundTrip string `json:"last_round_trip,omitempty"`
+}
+
+type controlVersionInfo struct {
+	Version          string   `json:"version"`
+	DataPlanes       []string `json:"data_planes"`
+	ProtocolVersions []int    `json:"protocol_versions"`
+	EncapTypes       []string `json:"encap_types"`
+}
+
+type controlResponse struct {
+	Error    string                `json:"error,omitempty"`
+	Tunnels  []controlTunnelInfo   `json:"tunnels,omitempty"`
+	Sessions []controlSessionInfo  `json:"sessions,omitempty"`
+	Stats    []controlSessionStats `json:"stats,omitempty"`
+	Health   []controlTunnelHealth `json:"health,omitempty"`
+	Version  *controlVersionInfo   `json:"version,omitempty"`
+}
+
+func newControlVersionInfo() *controlVersionInfo {
+	caps := l2tp.Capabilities()
+	info := &controlVersionInfo{
+		Version:    l2tp.Version(),
+		DataPlanes: caps.DataPlanes,
+	}
+	for _, v := range caps.ProtocolVersions {
+		info.ProtocolVersions = append(info.ProtocolVersions, int(v))
+	}
+	for _, e := range caps.EncapTypes {
+		info.EncapTypes = append(info.EncapTypes, e.String())
+	}
+	return info
+}
+
+func newControlTunnelHealth(tunl l2tp.Tunnel) controlTunnelHealth {
+	h := tunl.Health()
+	info := controlTunnelHealth{
+		Tunnel: tunl.Name(),
+		State:  h.State.String(),
+	}
+	if !h.LastRoundTrip.IsZero() {
+		info.LastRoundTrip = h.LastRoundTrip.Format(time.RFC3339Nano)
+	}
+	return info
+}
+
+func newControlServer(app *application, path string) (*controlServer, error) {
+	// Don't take the socket away from another running instance
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %v is in use by another process", path)
+	}
+
+	// Remove any stale socket left behind by a previous instance,
+	// taking care not to remove anything other than a socket
+	fi, err := os.Lstat(path)
+	if err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("control socket path %v exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove stale control socket %v: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to stat control socket %v: %v", path, err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket %v: %v", path, err)
+	}
+
+	cs := &controlServer{
+		app:      app,
+		logger:   log.With(app.logger, "component", "control"),
+		path:     path,
+		listener: listener,
+		conns:    make(map[net.Conn]bool),
+	}
+
+	cs.wg.Add(1)
+	go cs.serve()
+
+	return cs, nil
+}
+
+func (cs *controlServer) serve() {
+	defer cs.wg.Done()
+	for {
+		conn, err := cs.listener.Accept()
+		if err != nil {
+			// The listener is closed on shutdown
+			return
+		}
+		cs.connLock.Lock()
+		cs.conns[conn] = true
+		cs.connLock.Unlock()
+
+		cs.wg.Add(1)
+		go cs.handleConn(conn)
+	}
+}
+
+func (cs *controlServer) handleConn(conn net.Conn) {
+	defer cs.wg.Done()
+	defer func() {
+		cs.connLock.Lock()
+		delete(cs.conns, conn)
+		cs.connLock.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		level.Debug(cs.logger).Log("message", "control command", "command", args[0])
+		rsp := cs.handleCommand(args[0], args[1:])
+		if err := encoder.Encode(rsp); err != nil {
+			return
+		}
+	}
+}
+
+func (cs *controlServer) findTunnel(name string) (l2tp.Tunnel, error) {
+	if tunl, ok := cs.app.findTunnel(name); ok {
+		return tunl, nil
+	}
+	return nil, fmt.Errorf("no tunnel %q", name)
+}
+
+func (cs *controlServer) handleCommand(cmd string, args []string) *controlResponse {
+	switch cmd {
+	case "list-tunnels":
+		if len(args) != 0 {
+			break
+		}
+		rsp := &controlResponse{Tunnels: []controlTunnelInfo{}}
+		for _, tunl := range cs.app.l2tpCtx.ListTunnels() {
+			rsp.Tunnels = append(rsp.Tunnels, controlTunnelInfo{
+				Name:     tunl.Name(),
+				Sessions: len(tunl.ListSessions()),
+			})
+		}
+		return rsp
+
+	case "list-sessions":
+		if len(args) != 1 {
+			break
+		}
+		tunl, err := cs.findTunnel(args[0])
+		if err != nil {
+			return &controlResponse{Error: err.Error()}
+		}
+		rsp := &controlResponse{Sessions: []controlSessionInfo{}}
+		for _, s := range tunl.ListSessions() {
+			rsp.Sessions = append(rsp.Sessions, controlSessionInfo{Name: s.Name()})
+		}
+		return rsp
+
+	case "show-stats":
+		if len(args) != 1 && len(args) != 2 {
+			break
+		}
+		tunl, err := cs.findTunnel(args[0])
+		if err != nil {
+			return &controlResponse{Error: err.Error()}
+		}
+		var sessions []l2tp.Session
+		if len(args) == 2 {
+			s, ok := tunl.FindSessionByName(args[1])
+			if !ok {
+				return &controlResponse{Error: fmt.Sprintf("no session %q in tunnel %q", args[1], args[0])}
+			}
+			sessions = append(sessions, s)
+		} else {
+			sessions = tunl.ListSessions()
+		}
+		rsp := &controlResponse{Stats: []controlSessionStats{}}
+		for _, s := range sessions {
+			stats, err := s.GetStatistics()
+			if err != nil {
+				rsp.Stats = append(rsp.Stats, controlSessionStats{
+					Tunnel:  tunl.Name(),
+					Session: s.Name(),
+					Error:   err.Error(),
+				})
+				continue
+			}
+			rsp.Stats = append(rsp.Stats, controlSessionStats{
+				Tunnel:    tunl.Name(),
+				Session:   s.Name(),
+				TxPackets: stats.TxPackets,
+				TxBytes:   stats.TxBytes,
+				TxErrors:  stats.TxErrors,
+				RxPackets: stats.RxPackets,
+				RxBytes:   stats.RxBytes,
+				RxErrors:  stats.RxErrors,
+			})
+		}
+		return rsp
+
+	case "show-health":
+		if len(args) > 1 {
+			break
+		}
+		var tunnels []l2tp.Tunnel
+		if len(args) == 1 {
+			tunl, err := cs.findTunnel(args[0])
+			if err != nil {
+				return &controlResponse{Error: err.Error()}
+			}
+			tunnels = append(tunnels, tunl)
+		} else {
+			tunnels = cs.app.l2tpCtx.ListTunnels()
+		}
+		rsp := &controlResponse{Health: []controlTunnelHealth{}}
+		for _, tunl := range tunnels {
+			rsp.Health = append(rsp.Health, newControlTunnelHealth(tunl))
+		}
+		return rsp
+
+	case "restart-tunnel":
+		if len(args) != 1 {
+			break
+		}
+		level.Info(cs.logger).Log("message", "tunnel restart requested via control socket", "tunnel_name", args[0])
+		if err := cs.app.restartTunnel(args[0]); err != nil {
+			return &controlResponse{Error: err.Error()}
+		}
+		return &controlResponse{}
+
+	case "version":
+		if len(args) != 0 {
+			break
+		}
+		return &controlResponse{Version: newControlVersionInfo()}
+
+	case "shutdown":
+		if len(args) != 0 {
+			break
+		}
+		level.Info(cs.logger).Log("message", "shutdown requested via control socket")
+		go func() {
+			cs.app.sigChan <- unix.SIGTERM
+		}()
+		return &controlResponse{}
+
+	default:
+		return &controlResponse{Error: fmt.Sprintf("unrecognised command %q", cmd)}
+	}
+	return &controlResponse{Error: fmt.Sprintf("bad arguments for command %q", cmd)}
+}
+
+// close shuts down the listener and any open client connections,
+// and waits for the server goroutines to exit.
+func (cs *controlServer) close() {
+	cs.listener.Close()
+
+	cs.connLock.Lock()
+	for conn := range cs.conns {
+		conn.Close()
+	}
+	cs.connLock.Unlock()
+
+	cs.wg.Wait()
+
+	os.Remove(cs.path)
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/katalix/go-l2tp/config"
+	"github.com/katalix/go-l2tp/l2tp"
+	"golang.org/x/sys/unix"
+)
+
+func TestControlServer(t *testing.T) {
+	app, err := newApplication(newKl2tpdConfig(), false, true)
+	if err != nil {
+		t.Fatalf("newApplication: %v", err)
+	}
+	defer app.l2tpCtx.Close()
+
+	tunl, err := app.l2tpCtx.NewStaticTunnel("t1", &l2tp.TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      l2tp.ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        l2tp.EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel: %v", err)
+	}
+	_, err = tunl.NewSession("s1", &l2tp.SessionConfig{
+		SessionID:     100,
+		PeerSessionID: 200,
+		Pseudowire:    l2tp.PseudowireTypeEth,
+	})
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "kl2tpd.sock")
+	ctl, err := newControlServer(app, path)
+	if err != nil {
+		t.Fatalf("newControlServer: %v", err)
+	}
+	defer ctl.close()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("net.Dial(%v): %v", path, err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	cases := []struct {
+		cmd  string
+		want controlResponse
+	}{
+		{
+			cmd: "list-tunnels",
+			want: controlResponse{
+				Tunnels: []controlTunnelInfo{{Name: "t1", Sessions: 1}},
+			},
+		},
+		{
+			cmd: "list-sessions t1",
+			want: controlResponse{
+				Sessions: []controlSessionInfo{{Name: "s1"}},
+			},
+		},
+		{
+			cmd: "show-stats t1 s1",
+			want: controlResponse{
+				Stats: []controlSessionStats{{Tunnel: "t1", Session: "s1"}},
+			},
+		},
+		{
+			cmd: "show-stats t1",
+			want: controlResponse{
+				Stats: []controlSessionStats{{Tunnel: "t1", Session: "s1"}},
+			},
+		},
+		{
+			cmd: "show-health",
+			want: controlResponse{
+				Health: []controlTunnelHealth{{Tunnel: "t1", State: "up"}},
+			},
+		},
+		{
+			cmd: "show-health t1",
+			want: controlResponse{
+				Health: []controlTunnelHealth{{Tunnel: "t1", State: "up"}},
+			},
+		},
+		{
+			cmd:  "show-health t2",
+			want: controlResponse{Error: `no tunnel "t2"`},
+		},
+		{
+			cmd:  "list-sessions t2",
+			want: controlResponse{Error: `no tunnel "t2"`},
+		},
+		{
+			cmd:  "show-stats t1 s2",
+			want: controlResponse{Error: `no session "s2" in tunnel "t1"`},
+		},
+		{
+			cmd:  "list-sessions",
+			want: controlResponse{Error: `bad arguments for command "list-sessions"`},
+		},
+		{
+			cmd:  "frobnicate",
+			want: controlResponse{Error: `unrecognised command "frobnicate"`},
+		},
+		{
+			cmd:  "version",
+			want: controlResponse{Version: newControlVersionInfo()},
+		},
+		{
+			cmd:  "version 2",
+			want: controlResponse{Error: `bad arguments for command "version"`},
+		},
+		{
+			cmd:  "shutdown",
+			want: controlResponse{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.cmd, func(t *testing.T) {
+			_, err := fmt.Fprintf(conn, "%s\n", c.cmd)
+			if err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			var got controlResponse
+			err = json.Unmarshal(line, &got)
+			if err != nil {
+				t.Fatalf("json.Unmarshal(%q): %v", line, err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("expect %+v, got %+v", c.want, got)
+			}
+		})
+	}
+
+	select {
+	case sig := <-app.sigChan:
+		if sig != unix.SIGTERM {
+			t.Errorf("expected SIGTERM on shutdown, got %v", sig)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("shutdown command didn't signal the application")
+	}
+}
+
+// statsErrorDataPlane wraps the mock data plane, failing statistics
+// queries for one session.
+type statsErrorDataPlane struct {
+	*l2tp.MockDataPlane
+	failSessionID l2tp.ControlConnID
+}
+
+type statsErrorSessionDataPlane struct {
+	l2tp.SessionDataPlane
+}
+
+func (dp *statsErrorDataPlane) NewSession(tunnelID, peerTunnelID l2tp.ControlConnID, scfg *l2tp.SessionConfig) (l2tp.SessionDataPlane, error) {
+	sdp, err := dp.MockDataPlane.NewSession(tunnelID, peerTunnelID, scfg)
+	if err != nil || scfg.SessionID != dp.failSessionID {
+		return sdp, err
+	}
+	return &statsErrorSessionDataPlane{sdp}, nil
+}
+
+func (sdp *statsErrorSessionDataPlane) GetStatistics() (*l2tp.SessionDataPlaneStatistics, error) {
+	return nil, fmt.Errorf("statistics unavailable")
+}
+
+func TestControlServerStatsError(t *testing.T) {
+	dp := &statsErrorDataPlane{MockDataPlane: l2tp.NewMockDataPlane(), failSessionID: 101}
+	app, err := newApplicationWithDataPlane(newKl2tpdConfig(), false, dp)
+	if err != nil {
+		t.Fatalf("newApplicationWithDataPlane: %v", err)
+	}
+	defer app.l2tpCtx.Close()
+
+	tunl, err := app.l2tpCtx.NewStaticTunnel("t1", &l2tp.TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      l2tp.ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        l2tp.EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel: %v", err)
+	}
+	for i, name := range []string{"s1", "s2"} {
+		_, err = tunl.NewSession(name, &l2tp.SessionConfig{
+			SessionID:     l2tp.ControlConnID(100 + i),
+			PeerSessionID: l2tp.ControlConnID(200 + i),
+			Pseudowire:    l2tp.PseudowireTypeEth,
+		})
+		if err != nil {
+			t.Fatalf("NewSession(%v): %v", name, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "kl2tpd.sock")
+	ctl, err := newControlServer(app, path)
+	if err != nil {
+		t.Fatalf("newControlServer: %v", err)
+	}
+	defer ctl.close()
+
+	// The session whose statistics can't be read doesn't prevent the
+	// others being reported
+	rsp := ctl.handleCommand("show-stats", []string{"t1"})
+	sort.Slice(rsp.Stats, func(i, j int) bool { return rsp.Stats[i].Session < rsp.Stats[j].Session })
+	want := &controlResponse{
+		Stats: []controlSessionStats{
+			{Tunnel: "t1", Session: "s1"},
+			{Tunnel: "t1", Session: "s2", Error: "statistics unavailable"},
+		},
+	}
+	if !reflect.DeepEqual(rsp, want) {
+		t.Errorf("show-stats: expect %+v, got %+v", want, rsp)
+	}
+}
+
+func TestControlServerSocketPath(t *testing.T) {
+	app, err := newApplication(newKl2tpdConfig(), false, true)
+	if err != nil {
+		t.Fatalf("newApplication: %v", err)
+	}
+	defer app.l2tpCtx.Close()
+
+	dir := t.TempDir()
+
+	// A socket in use by another instance must be left alone
+	path := filepath.Join(dir, "kl2tpd.sock")
+	ctl, err := newControlServer(app, path)
+	if err != nil {
+		t.Fatalf("newControlServer: %v", err)
+	}
+	defer ctl.close()
+	if _, err = newControlServer(app, path); err == nil {
+		t.Errorf("newControlServer(%v): expected error for socket in use", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("net.Dial(%v): %v", path, err)
+	}
+	conn.Close()
+
+	// A stale socket is replaced
+	stale := filepath.Join(dir, "stale.sock")
+	listener, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatalf("net.Listen(%v): %v", stale, err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	ctl2, err := newControlServer(app, stale)
+	if err != nil {
+		t.Fatalf("newControlServer(%v): %v", stale, err)
+	}
+	ctl2.close()
+
+	// Anything other than a socket is not removed
+	file := filepath.Join(dir, "file")
+	err = os.WriteFile(file, []byte("data"), 0600)
+	if err != nil {
+		t.Fatalf("os.WriteFile(%v): %v", file, err)
+	}
+	if _, err = newControlServer(app, file); err == nil {
+		t.Errorf("newControlServer(%v): expected error for non-socket path", file)
+	}
+	if _, err = os.Stat(file); err != nil {
+		t.Errorf("non-socket path removed: %v", err)
+	}
+}
+
+func TestControlServerRestartTunnel(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	// The LNS accepts the tunnel, but ignores the ICRQ for its session,
+	// so no pseudowire is instantiated.
+	lnsCtx, err := l2tp.NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer lnsCtx.Close()
+
+	l, err := lnsCtx.NewTunnelListener("lns", &l2tp.TunnelConfig{
+		Local:          "127.0.0.1:5020",
+		Version:        l2tp.ProtocolVersion2,
+		Encap:          l2tp.EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewTunnelListener: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	cfg := newKl2tpdConfig()
+	cfg.config, err = config.LoadStringWithCustomParser(`[tunnel.t1]
+		peer = "127.0.0.1:5020"
+		local = "127.0.0.1:0"
+		version = "l2tpv2"
+		encap = "udp"
+
+		[tunnel.t1.session.s1]
+		pseudowire = "ppp"`, cfg)
+	if err != nil {
+		t.Fatalf("LoadStringWithCustomParser: %v", err)
+	}
+
+	dp := l2tp.NewMockDataPlane()
+	app, err := newApplicationWithDataPlane(cfg, false, dp)
+	if err != nil {
+		t.Fatalf("newApplicationWithDataPlane: %v", err)
+	}
+	defer app.l2tpCtx.Close()
+
+	events := make(chan string, 10)
+	app.l2tpCtx.RegisterEventHandler(app)
+	app.l2tpCtx.RegisterEventHandler(l2tp.EventHandlerFunc(func(event interface{}) {
+		switch ev := event.(type) {
+		case *l2tp.TunnelUpEvent:
+			events <- "up " + ev.TunnelName
+		case *l2tp.TunnelDownEvent:
+			events <- "down " + ev.TunnelName
+		}
+	}))
+	expectEvent := func(want string) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("expected event %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event %q", want)
+		}
+	}
+
+	err = app.newTunnel(&cfg.config.Tunnels[0])
+	if err != nil {
+		t.Fatalf("newTunnel: %v", err)
+	}
+	expectEvent("up t1")
+	oldTunl, ok := app.findTunnel("t1")
+	if !ok {
+		t.Fatalf("no tunnel t1")
+	}
+
+	path := filepath.Join(t.TempDir(), "kl2tpd.sock")
+	ctl, err := newControlServer(app, path)
+	if err != nil {
+		t.Fatalf("newControlServer: %v", err)
+	}
+	defer ctl.close()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("net.Dial(%v): %v", path, err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	command := func(cmd string) controlResponse {
+		t.Helper()
+		_, err := fmt.Fprintf(conn, "%s\n", cmd)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		var rsp controlResponse
+		err = json.Unmarshal(line, &rsp)
+		if err != nil {
+			t.Fatalf("json.Unmarshal(%q): %v", line, err)
+		}
+		return rsp
+	}
+
+	if rsp := command("restart-tunnel t1"); !reflect.DeepEqual(rsp, controlResponse{}) {
+		t.Fatalf("restart-tunnel t1: expect success, got %+v", rsp)
+	}
+	expectEvent("down t1")
+	expectEvent("up t1")
+
+	newTunl, ok := app.findTunnel("t1")
+	if !ok {
+		t.Fatalf("no tunnel t1 after restart")
+	}
+	if newTunl == oldTunl {
+		t.Errorf("expected tunnel t1 to be recreated")
+	}
+	if _, ok := newTunl.FindSessionByName("s1"); !ok {
+		t.Errorf("expected session s1 to be recreated")
+	}
+
+	var ops []l2tp.MockDataPlaneOp
+	for _, call := range dp.Calls() {
+		if call.Op == l2tp.MockOpNewTunnel || call.Op == l2tp.MockOpTunnelDown {
+			ops = append(ops, call.Op)
+		}
+	}
+	wantOps := []l2tp.MockDataPlaneOp{l2tp.MockOpNewTunnel, l2tp.MockOpTunnelDown, l2tp.MockOpNewTunnel}
+	if !reflect.DeepEqual(ops, wantOps) {
+		t.Errorf("expected data plane operations %v, got %v", wantOps, ops)
+	}
+
+	want := controlResponse{Error: `no tunnel "t2" in configuration`}
+	if rsp := command("restart-tunnel t2"); !reflect.DeepEqual(rsp, want) {
+		t.Errorf("restart-tunnel t2: expect %+v, got %+v", want, rsp)
+	}
+	want = controlResponse{Error: `bad arguments for command "restart-tunnel"`}
+	if rsp := command("restart-tunnel"); !reflect.DeepEqual(rsp, want) {
+		t.Errorf("restart-tunnel: expect %+v, got %+v", want, rsp)
+	}
+}
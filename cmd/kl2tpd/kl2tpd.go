@@ -20,6 +20,24 @@ either be whitespace or newline delimited, and should call out pppd command line
 as described in the pppd manpage.  kl2tpd augments the arguments from the command file
 with arguments specific to the establishment of the PPPoL2TP session using the pppd
 pppol2tp plugin.
+
+kl2tpd also accepts a daemon table in the configuration file, which provides
+defaults for settings otherwise given on the command line:
+
+	[daemon]
+	# log_level is "info" or "debug", c.f. -verbose
+	log_level = "info"
+	# null_dataplane disables the kernel data plane, c.f. -null
+	null_dataplane = false
+	# socket is the control socket path, or empty to disable, c.f. -socket
+	socket = "/run/kl2tpd.sock"
+	# metrics_addr is the Prometheus metrics listener address, or empty
+	# to disable, c.f. -metrics-addr
+	metrics_addr = ""
+
+Command line flags take precedence over the values in the daemon table.
+Daemon settings are applied at startup only, and are not changed by a
+configuration reload.
 */
 package main
 
@@ -27,9 +45,12 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	stdlog "log"
 	"os"
 	"os/signal"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 
@@ -44,8 +65,27 @@ type sessionPPPArgs struct {
 	pppdArgs []string
 }
 
+// daemonConfig holds the settings from the configuration file's daemon
+// table.  Fields are nil if not set in the file.
+type daemonConfig struct {
+	verbose       *bool
+	nullDataPlane *bool
+	socketPath    *string
+	metricsAddr   *string
+}
+
+// daemonSettings holds the daemon settings in effect, derived from
+// command line flags and the daemon table.
+type daemonSettings struct {
+	verbose       bool
+	nullDataPlane bool
+	socketPath    string
+	metricsAddr   string
+}
+
 type kl2tpdConfig struct {
 	config *config.Config
+	daemon daemonConfig
 	// pppArgs[tunnel_name][session_name]
 	pppArgs map[string]map[string]*sessionPPPArgs
 }
@@ -62,15 +102,27 @@ type pseudowire interface {
 }
 
 type application struct {
-	cfg     *kl2tpdConfig
-	logger  log.Logger
-	l2tpCtx *l2tp.Context
+	cfg          *kl2tpdConfig
+	cfgLock      sync.Mutex
+	reloadConfig func() (*kl2tpdConfig, error)
+	socketPath   string
+	ctl          *controlServer
+	metricsAddr  string
+	metrics      *metricsServer
+	logger       log.Logger
+	l2tpCtx      *l2tp.Context
 	// sessionPW[tunnel_name][session_name]
-	sessionPW      map[string]map[string]pseudowire
+	sessionPW map[string]map[string]pseudowire
+	// pwLock guards sessionPW, which is modified by l2tp event
+	// handlers as well as by the run loop
+	pwLock         sync.Mutex
 	sigChan        chan os.Signal
 	pwCompleteChan chan pseudowire
 	closeChan      chan interface{}
 	wg             sync.WaitGroup
+	// tunnelLock serialises the closing and recreation of tunnels
+	// by configuration reloads and tunnel restarts
+	tunnelLock sync.Mutex
 }
 
 func newKl2tpdConfig() (cfg *kl2tpdConfig) {
@@ -108,10 +160,78 @@ func (cfg *kl2tpdConfig) setSessionPPPdArgs(tunnelName, sessionName string, args
 	cfg.pppArgs[tunnelName][sessionName].pppdArgs = args
 }
 
+func (cfg *kl2tpdConfig) parseDaemonConfig(value interface{}) error {
+	table, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("daemon must be a table, e.g. '[daemon]'")
+	}
+	for k, v := range table {
+		switch k {
+		case "log_level":
+			logLevel, err := config.AsString(v)
+			if err != nil {
+				return fmt.Errorf("failed to parse daemon log_level parameter: %v", err)
+			}
+			var verbose bool
+			switch logLevel {
+			case "info":
+				verbose = false
+			case "debug":
+				verbose = true
+			default:
+				return fmt.Errorf("expect 'info' or 'debug' for daemon log_level parameter, got %q", logLevel)
+			}
+			cfg.daemon.verbose = &verbose
+		case "null_dataplane":
+			null, err := config.AsBool(v)
+			if err != nil {
+				return fmt.Errorf("failed to parse daemon null_dataplane parameter: %v", err)
+			}
+			cfg.daemon.nullDataPlane = &null
+		case "socket":
+			path, err := config.AsString(v)
+			if err != nil {
+				return fmt.Errorf("failed to parse daemon socket parameter: %v", err)
+			}
+			cfg.daemon.socketPath = &path
+		case "metrics_addr":
+			addr, err := config.AsString(v)
+			if err != nil {
+				return fmt.Errorf("failed to parse daemon metrics_addr parameter: %v", err)
+			}
+			cfg.daemon.metricsAddr = &addr
+		default:
+			return fmt.Errorf("unrecognised daemon parameter %v", k)
+		}
+	}
+	return nil
+}
+
 func (cfg *kl2tpdConfig) ParseParameter(key string, value interface{}) error {
+	switch key {
+	case "daemon":
+		return cfg.parseDaemonConfig(value)
+	}
 	return fmt.Errorf("unrecognised parameter %v", key)
 }
 
+// apply overrides settings with the values from the daemon table, other
+// than those named in flagsSet which were given on the command line.
+func (dc *daemonConfig) apply(settings *daemonSettings, flagsSet map[string]bool) {
+	if dc.verbose != nil && !flagsSet["verbose"] {
+		settings.verbose = *dc.verbose
+	}
+	if dc.nullDataPlane != nil && !flagsSet["null"] {
+		settings.nullDataPlane = *dc.nullDataPlane
+	}
+	if dc.socketPath != nil && !flagsSet["socket"] {
+		settings.socketPath = *dc.socketPath
+	}
+	if dc.metricsAddr != nil && !flagsSet["metrics-addr"] {
+		settings.metricsAddr = *dc.metricsAddr
+	}
+}
+
 func (cfg *kl2tpdConfig) ParseTunnelParameter(tunnel *config.NamedTunnel, key string, value interface{}) error {
 	return fmt.Errorf("unrecognised parameter %v", key)
 }
@@ -119,9 +239,9 @@ func (cfg *kl2tpdConfig) ParseTunnelParameter(tunnel *config.NamedTunnel, key st
 func (cfg *kl2tpdConfig) ParseSessionParameter(tunnel *config.NamedTunnel, session *config.NamedSession, key string, value interface{}) error {
 	switch key {
 	case "pppd_args":
-		path, ok := value.(string)
-		if !ok {
-			return fmt.Errorf("failed to parse pppd_args parameter for session %s as a string", session.Name)
+		path, err := config.AsString(value)
+		if err != nil {
+			return fmt.Errorf("failed to parse pppd_args parameter for session %s: %v", session.Name, err)
 		}
 		args, err := cfg.readPPPdArgsFile(path)
 		if err != nil {
@@ -134,6 +254,14 @@ func (cfg *kl2tpdConfig) ParseSessionParameter(tunnel *config.NamedTunnel, sessi
 }
 
 func newApplication(cfg *kl2tpdConfig, verbose, nullDataplane bool) (app *application, err error) {
+	dataplane := l2tp.LinuxNetlinkDataPlane
+	if nullDataplane {
+		dataplane = nil
+	}
+	return newApplicationWithDataPlane(cfg, verbose, dataplane)
+}
+
+func newApplicationWithDataPlane(cfg *kl2tpdConfig, verbose bool, dataplane l2tp.DataPlane) (app *application, err error) {
 
 	app = &application{
 		cfg:            cfg,
@@ -143,7 +271,7 @@ func newApplication(cfg *kl2tpdConfig, verbose, nullDataplane bool) (app *applic
 		closeChan:      make(chan interface{}),
 	}
 
-	signal.Notify(app.sigChan, unix.SIGINT, unix.SIGTERM)
+	signal.Notify(app.sigChan, unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
 
 	logger := log.NewLogfmtLogger(os.Stderr)
 	if verbose {
@@ -152,11 +280,6 @@ func newApplication(cfg *kl2tpdConfig, verbose, nullDataplane bool) (app *applic
 		app.logger = level.NewFilter(logger, level.AllowInfo())
 	}
 
-	dataplane := l2tp.LinuxNetlinkDataPlane
-	if nullDataplane {
-		dataplane = nil
-	}
-
 	app.l2tpCtx, err = l2tp.NewContext(dataplane, logger)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create L2TP context: %v", err)
@@ -166,6 +289,8 @@ func newApplication(cfg *kl2tpdConfig, verbose, nullDataplane bool) (app *applic
 }
 
 func (app *application) getSessionPPPArgs(tunnelName, sessionName string) (args *sessionPPPArgs) {
+	app.cfgLock.Lock()
+	defer app.cfgLock.Unlock()
 	_, ok := app.cfg.pppArgs[tunnelName]
 	if !ok {
 		goto fail
@@ -184,11 +309,14 @@ fail:
 }
 
 func (app *application) instantiatePPPPseudowire(ev *l2tp.SessionUpEvent) (pw pseudowire) {
+	pppArgs := app.getSessionPPPArgs(ev.TunnelName, ev.SessionName)
+
 	pppd, err := newPPPDaemon(ev.Session,
 		ev.TunnelConfig.TunnelID,
 		ev.SessionConfig.SessionID,
 		ev.TunnelConfig.PeerTunnelID,
-		ev.SessionConfig.PeerSessionID)
+		ev.SessionConfig.PeerSessionID,
+		pppArgs.pppdArgs)
 	if err != nil {
 		level.Error(app.logger).Log(
 			"message", "failed to create pppol2tp instance",
@@ -196,9 +324,6 @@ func (app *application) instantiatePPPPseudowire(ev *l2tp.SessionUpEvent) (pw ps
 		return nil
 	}
 
-	pppArgs := app.getSessionPPPArgs(ev.TunnelName, ev.SessionName)
-	pppd.cmd.Args = append(pppd.cmd.Args, pppArgs.pppdArgs...)
-
 	err = pppd.cmd.Start()
 	if err != nil {
 		level.Error(app.logger).Log(
@@ -206,21 +331,21 @@ func (app *application) instantiatePPPPseudowire(ev *l2tp.SessionUpEvent) (pw ps
 			"error", err,
 			"error_message", pppdExitCodeString(err),
 			"stderr", pppd.stderrBuf.String())
+		pppd.file.Close()
 		return nil
 	}
 
-	app.sessionPW[ev.TunnelName][ev.SessionName] = pppd
-
 	app.wg.Add(1)
 	go func() {
 		defer app.wg.Done()
-		err = pppd.cmd.Wait()
+		err := pppd.cmd.Wait()
 		if err != nil {
 			level.Error(app.logger).Log(
 				"message", "pppd exited with an error code",
 				"error", err,
 				"error_message", pppdExitCodeString(err))
 		}
+		pppd.file.Close()
 		app.pwCompleteChan <- pppd
 	}()
 	return pppd
@@ -260,12 +385,26 @@ func (app *application) instantiatePseudowire(ev *l2tp.SessionUpEvent) (pw pseud
 func (app *application) HandleEvent(event interface{}) {
 	switch ev := event.(type) {
 	case *l2tp.TunnelUpEvent:
+		app.pwLock.Lock()
 		if _, ok := app.sessionPW[ev.TunnelName]; !ok {
 			app.sessionPW[ev.TunnelName] = make(map[string]pseudowire)
 		}
+		app.pwLock.Unlock()
 
 	case *l2tp.TunnelDownEvent:
+		if ev.Error != nil {
+			level.Error(app.logger).Log(
+				"message", "tunnel down",
+				"tunnel_name", ev.TunnelName,
+				"error", ev.Error)
+		} else {
+			level.Info(app.logger).Log(
+				"message", "tunnel down",
+				"tunnel_name", ev.TunnelName)
+		}
+		app.pwLock.Lock()
 		delete(app.sessionPW, ev.TunnelName)
+		app.pwLock.Unlock()
 
 	case *l2tp.SessionUpEvent:
 
@@ -278,8 +417,16 @@ func (app *application) HandleEvent(event interface{}) {
 			"peer_tunnel_id", ev.TunnelConfig.PeerTunnelID,
 			"peer_session_id", ev.SessionConfig.PeerSessionID)
 
-		app.sessionPW[ev.TunnelName][ev.SessionName] = app.instantiatePseudowire(ev)
-		if app.sessionPW[ev.TunnelName][ev.SessionName] == nil {
+		// Hold the lock while the pseudowire starts so that it is
+		// registered before pseudowireComplete can be called for it
+		app.pwLock.Lock()
+		if _, ok := app.sessionPW[ev.TunnelName]; !ok {
+			app.sessionPW[ev.TunnelName] = make(map[string]pseudowire)
+		}
+		pw := app.instantiatePseudowire(ev)
+		app.sessionPW[ev.TunnelName][ev.SessionName] = pw
+		app.pwLock.Unlock()
+		if pw == nil {
 			app.closeSession(ev.Session)
 		}
 
@@ -295,10 +442,13 @@ func (app *application) HandleEvent(event interface{}) {
 			"peer_tunnel_id", ev.TunnelConfig.PeerTunnelID,
 			"peer_session_id", ev.SessionConfig.PeerSessionID)
 
-		if app.sessionPW[ev.TunnelName][ev.SessionName] != nil {
+		app.pwLock.Lock()
+		pw := app.sessionPW[ev.TunnelName][ev.SessionName]
+		delete(app.sessionPW[ev.TunnelName], ev.SessionName)
+		app.pwLock.Unlock()
+		if pw != nil {
 			level.Info(app.logger).Log("message", "killing pseudowire")
-			app.sessionPW[ev.TunnelName][ev.SessionName].close()
-			delete(app.sessionPW[ev.TunnelName], ev.SessionName)
+			pw.close()
 		}
 	}
 }
@@ -311,47 +461,345 @@ func (app *application) closeSession(s l2tp.Session) {
 	}()
 }
 
-func (app *application) run() int {
+func (app *application) isActivePseudowire(pw pseudowire) bool {
+	app.pwLock.Lock()
+	defer app.pwLock.Unlock()
+	for _, sessions := range app.sessionPW {
+		for _, p := range sessions {
+			if p == pw {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	// Listen for L2TP events
-	app.l2tpCtx.RegisterEventHandler(app)
+// pseudowireComplete handles the termination of a pseudowire instance,
+// e.g. due to pppd exiting.  The pseudowire's session is closed and the
+// pseudowire unregistered.
+func (app *application) pseudowireComplete(pw pseudowire) {
+	level.Info(app.logger).Log("message", "pseudowire terminated")
+	var active bool
+	app.pwLock.Lock()
+	for _, sessions := range app.sessionPW {
+		for name, p := range sessions {
+			if p == pw {
+				delete(sessions, name)
+				active = true
+			}
+		}
+	}
+	app.pwLock.Unlock()
+	// If the pseudowire is no longer registered the session has
+	// already gone down, e.g. due to a configuration reload.
+	if !active {
+		return
+	}
+	app.closeSession(pw.getSession())
+}
 
-	// Instantiate tunnels and sessions from the config file
-	for _, tcfg := range app.cfg.config.Tunnels {
+func (app *application) findTunnel(name string) (l2tp.Tunnel, bool) {
+	for _, tunl := range app.l2tpCtx.ListTunnels() {
+		if tunl.Name() == name {
+			return tunl, true
+		}
+	}
+	return nil, false
+}
 
-		// Only support l2tpv2/ppp
-		if tcfg.Config.Version != l2tp.ProtocolVersion2 {
-			level.Error(app.logger).Log(
-				"message", "unsupported tunnel protocol version",
-				"version", tcfg.Config.Version)
-			return 1
+func (app *application) newTunnel(tcfg *config.NamedTunnel) error {
+
+	// Only support l2tpv2/ppp
+	if tcfg.Config.Version != l2tp.ProtocolVersion2 {
+		return fmt.Errorf("unsupported tunnel protocol version %v", tcfg.Config.Version)
+	}
+
+	tunl, err := app.l2tpCtx.NewDynamicTunnel(tcfg.Name, tcfg.Config)
+	if err != nil {
+		return fmt.Errorf("failed to create tunnel %v: %v", tcfg.Name, err)
+	}
+
+	for _, scfg := range tcfg.Sessions {
+		_, err := tunl.NewSession(scfg.Name, scfg.Config)
+		if err != nil {
+			return fmt.Errorf("failed to create session %v: %v", scfg.Name, err)
+		}
+	}
+	return nil
+}
+
+// restartTunnel closes the named tunnel, and recreates it along with
+// its sessions from the current configuration.
+func (app *application) restartTunnel(name string) error {
+	app.tunnelLock.Lock()
+	defer app.tunnelLock.Unlock()
+
+	var tcfg config.NamedTunnel
+	app.cfgLock.Lock()
+	cfg, ok := app.cfg.config, false
+	if cfg != nil {
+		var found *config.NamedTunnel
+		if found, ok = findNamedTunnel(cfg, name); ok {
+			tcfg = *found
+		}
+	}
+	app.cfgLock.Unlock()
+	if !ok {
+		return fmt.Errorf("no tunnel %q in configuration", name)
+	}
+
+	if tunl, ok := app.findTunnel(name); ok {
+		level.Info(app.logger).Log("message", "restart: closing tunnel", "tunnel_name", name)
+		tunl.Close()
+	}
+
+	level.Info(app.logger).Log("message", "restart: creating tunnel", "tunnel_name", name)
+	return app.newTunnel(&tcfg)
+}
+
+// configDiff describes the changes required to move the running
+// set of tunnels and sessions from one configuration to another.
+// Tunnels or sessions whose configuration has changed are both removed
+// and added.
+type configDiff struct {
+	// Names of tunnels to close.
+	removedTunnels []string
+	// Tunnels to create, along with all their sessions.
+	addedTunnels []config.NamedTunnel
+	// removedSessions[tunnel_name] lists sessions to close in tunnels
+	// which are otherwise unchanged.
+	removedSessions map[string][]string
+	// addedSessions[tunnel_name] lists sessions to create in tunnels
+	// which are otherwise unchanged.
+	addedSessions map[string][]config.NamedSession
+}
+
+func findNamedTunnel(cfg *config.Config, name string) (*config.NamedTunnel, bool) {
+	for i := range cfg.Tunnels {
+		if cfg.Tunnels[i].Name == name {
+			return &cfg.Tunnels[i], true
+		}
+	}
+	return nil, false
+}
+
+func findNamedSession(tcfg *config.NamedTunnel, name string) (*config.NamedSession, bool) {
+	for i := range tcfg.Sessions {
+		if tcfg.Sessions[i].Name == name {
+			return &tcfg.Sessions[i], true
+		}
+	}
+	return nil, false
+}
+
+func (cfg *kl2tpdConfig) sessionPPPArgs(tunnelName, sessionName string) *sessionPPPArgs {
+	if sessions, ok := cfg.pppArgs[tunnelName]; ok {
+		return sessions[sessionName]
+	}
+	return nil
+}
+
+func diffConfig(oldCfg, newCfg *kl2tpdConfig) *configDiff {
+	diff := &configDiff{
+		removedSessions: make(map[string][]string),
+		addedSessions:   make(map[string][]config.NamedSession),
+	}
+
+	for _, ot := range oldCfg.config.Tunnels {
+		nt, ok := findNamedTunnel(newCfg.config, ot.Name)
+		if !ok || !reflect.DeepEqual(ot.Config, nt.Config) {
+			diff.removedTunnels = append(diff.removedTunnels, ot.Name)
+			continue
 		}
 
-		tunl, err := app.l2tpCtx.NewDynamicTunnel(tcfg.Name, tcfg.Config)
+		for _, osess := range ot.Sessions {
+			nsess, ok := findNamedSession(nt, osess.Name)
+			if !ok ||
+				!reflect.DeepEqual(osess.Config, nsess.Config) ||
+				!reflect.DeepEqual(oldCfg.sessionPPPArgs(ot.Name, osess.Name),
+					newCfg.sessionPPPArgs(nt.Name, nsess.Name)) {
+				diff.removedSessions[ot.Name] = append(diff.removedSessions[ot.Name], osess.Name)
+			}
+		}
+		for _, nsess := range nt.Sessions {
+			osess, ok := findNamedSession(&ot, nsess.Name)
+			if !ok ||
+				!reflect.DeepEqual(osess.Config, nsess.Config) ||
+				!reflect.DeepEqual(oldCfg.sessionPPPArgs(ot.Name, osess.Name),
+					newCfg.sessionPPPArgs(nt.Name, nsess.Name)) {
+				diff.addedSessions[nt.Name] = append(diff.addedSessions[nt.Name], nsess)
+			}
+		}
+	}
+
+	for _, nt := range newCfg.config.Tunnels {
+		ot, ok := findNamedTunnel(oldCfg.config, nt.Name)
+		if !ok || !reflect.DeepEqual(ot.Config, nt.Config) {
+			diff.addedTunnels = append(diff.addedTunnels, nt)
+		}
+	}
+
+	sort.Strings(diff.removedTunnels)
+	sort.Slice(diff.addedTunnels, func(i, j int) bool {
+		return diff.addedTunnels[i].Name < diff.addedTunnels[j].Name
+	})
+	for _, sessions := range diff.removedSessions {
+		sort.Strings(sessions)
+	}
+	for _, sessions := range diff.addedSessions {
+		sort.Slice(sessions, func(i, j int) bool {
+			return sessions[i].Name < sessions[j].Name
+		})
+	}
+
+	return diff
+}
+
+func (app *application) reload() {
+	if app.reloadConfig == nil {
+		level.Error(app.logger).Log("message", "configuration reload not supported")
+		return
+	}
+
+	newCfg, err := app.reloadConfig()
+	if err != nil {
+		level.Error(app.logger).Log(
+			"message", "failed to reload configuration, keeping current configuration",
+			"error", err)
+		return
+	}
+
+	app.tunnelLock.Lock()
+	defer app.tunnelLock.Unlock()
+
+	app.cfgLock.Lock()
+	oldCfg := app.cfg
+	app.cfg = newCfg
+	app.cfgLock.Unlock()
+
+	diff := diffConfig(oldCfg, newCfg)
+
+	for _, name := range diff.removedTunnels {
+		if tunl, ok := app.findTunnel(name); ok {
+			level.Info(app.logger).Log("message", "reload: closing tunnel", "tunnel_name", name)
+			tunl.Close()
+		}
+	}
+
+	for tname, snames := range diff.removedSessions {
+		tunl, ok := app.findTunnel(tname)
+		if !ok {
+			continue
+		}
+		for _, sname := range snames {
+			if s, ok := tunl.FindSessionByName(sname); ok {
+				level.Info(app.logger).Log(
+					"message", "reload: closing session",
+					"tunnel_name", tname,
+					"session_name", sname)
+				s.Close()
+			}
+		}
+	}
+
+	for i := range diff.addedTunnels {
+		level.Info(app.logger).Log("message", "reload: creating tunnel", "tunnel_name", diff.addedTunnels[i].Name)
+		err := app.newTunnel(&diff.addedTunnels[i])
 		if err != nil {
 			level.Error(app.logger).Log(
-				"message", "failed to create tunnel",
-				"tunnel_name", tcfg.Name,
+				"message", "reload: failed to create tunnel",
+				"tunnel_name", diff.addedTunnels[i].Name,
 				"error", err)
-			return 1
 		}
+	}
 
-		for _, scfg := range tcfg.Sessions {
+	for tname, sessions := range diff.addedSessions {
+		tunl, ok := app.findTunnel(tname)
+		if !ok {
+			level.Error(app.logger).Log(
+				"message", "reload: no tunnel for new sessions",
+				"tunnel_name", tname)
+			continue
+		}
+		for _, scfg := range sessions {
+			level.Info(app.logger).Log(
+				"message", "reload: creating session",
+				"tunnel_name", tname,
+				"session_name", scfg.Name)
 			_, err := tunl.NewSession(scfg.Name, scfg.Config)
 			if err != nil {
 				level.Error(app.logger).Log(
-					"message", "failed to create session",
+					"message", "reload: failed to create session",
+					"tunnel_name", tname,
 					"session_name", scfg.Name,
 					"error", err)
-				return 1
 			}
 		}
 	}
 
+	level.Info(app.logger).Log("message", "configuration reloaded")
+}
+
+func (app *application) run() int {
+
+	caps := l2tp.Capabilities()
+	level.Info(app.logger).Log(
+		"message", "starting",
+		"version", l2tp.Version(),
+		"data_planes", strings.Join(caps.DataPlanes, ","))
+
+	// Listen for L2TP events
+	app.l2tpCtx.RegisterEventHandler(app)
+
+	// Instantiate tunnels and sessions from the config file
+	for i := range app.cfg.config.Tunnels {
+		err := app.newTunnel(&app.cfg.config.Tunnels[i])
+		if err != nil {
+			level.Error(app.logger).Log(
+				"message", "failed to instantiate configuration",
+				"tunnel_name", app.cfg.config.Tunnels[i].Name,
+				"error", err)
+			return 1
+		}
+	}
+
+	// Start the management interface
+	if app.socketPath != "" {
+		ctl, err := newControlServer(app, app.socketPath)
+		if err != nil {
+			level.Error(app.logger).Log(
+				"message", "failed to start control socket",
+				"error", err)
+		} else {
+			app.ctl = ctl
+			defer app.ctl.close()
+		}
+	}
+
+	// Start the metrics exporter
+	if app.metricsAddr != "" {
+		ms, err := newMetricsServer(app, app.metricsAddr)
+		if err != nil {
+			level.Error(app.logger).Log(
+				"message", "failed to start metrics server",
+				"error", err)
+		} else {
+			app.metrics = ms
+			defer app.metrics.close()
+		}
+	}
+
 	var shutdown bool
 	for {
 		select {
-		case <-app.sigChan:
+		case sig := <-app.sigChan:
+			if sig == unix.SIGHUP {
+				if !shutdown {
+					level.Info(app.logger).Log("message", "received SIGHUP, reloading configuration")
+					app.reload()
+				}
+				continue
+			}
 			if !shutdown {
 				level.Info(app.logger).Log("message", "received signal, shutting down")
 				shutdown = true
@@ -368,9 +816,8 @@ func (app *application) run() int {
 			if !ok {
 				close(app.closeChan)
 			}
-			level.Info(app.logger).Log("message", "pseudowire terminated")
 			if !shutdown {
-				app.closeSession(pw.getSession())
+				app.pseudowireComplete(pw)
 			}
 		case <-app.closeChan:
 			return 0
@@ -378,23 +825,142 @@ func (app *application) run() int {
 	}
 }
 
-func main() {
+// checkConfig validates cfg without instantiating any tunnels or
+// sessions, and writes a summary of what would be created to w.
+func checkConfig(cfg *config.Config, w io.Writer) error {
+	var nsessions int
+	tids := make(map[l2tp.ControlConnID]string)
+
+	// Sort by name for a stable summary
+	tunnels := append([]config.NamedTunnel{}, cfg.Tunnels...)
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Name < tunnels[j].Name })
+
+	for _, tcfg := range tunnels {
+		// Only support l2tpv2/ppp
+		if tcfg.Config.Version != l2tp.ProtocolVersion2 {
+			return fmt.Errorf("tunnel %v: unsupported tunnel protocol version %v",
+				tcfg.Name, tcfg.Config.Version)
+		}
+		err := l2tp.ValidateTunnelConfig(l2tp.TunnelTypeDynamic, tcfg.Config)
+		if err != nil {
+			return fmt.Errorf("tunnel %v: %v", tcfg.Name, err)
+		}
+		if tid := tcfg.Config.TunnelID; tid != 0 {
+			if other, ok := tids[tid]; ok {
+				return fmt.Errorf("tunnel %v: %v %v (tunnel %v)", tcfg.Name, l2tp.ErrTunnelIDExists, tid, other)
+			}
+			tids[tid] = tcfg.Name
+		}
+		fmt.Fprintf(w, "tunnel %v: peer %v, %v encapsulation\n",
+			tcfg.Name, tcfg.Config.Peer, tcfg.Config.Encap)
+
+		sessions := append([]config.NamedSession{}, tcfg.Sessions...)
+		sort.Slice(sessions, func(i, j int) bool { return sessions[i].Name < sessions[j].Name })
+
+		sids := make(map[l2tp.ControlConnID]string)
+		for _, scfg := range sessions {
+			err := l2tp.ValidateSessionConfig(l2tp.TunnelTypeDynamic, tcfg.Config, scfg.Config)
+			if err != nil {
+				return fmt.Errorf("tunnel %v session %v: %v", tcfg.Name, scfg.Name, err)
+			}
+			var pwname string
+			switch scfg.Config.Pseudowire {
+			case l2tp.PseudowireTypePPP:
+				pwname = "ppp"
+			case l2tp.PseudowireTypePPPAC:
+				pwname = "pppac"
+			default:
+				return fmt.Errorf("tunnel %v session %v: unsupported pseudowire type %v",
+					tcfg.Name, scfg.Name, scfg.Config.Pseudowire)
+			}
+			if sid := scfg.Config.SessionID; sid != 0 {
+				if other, ok := sids[sid]; ok {
+					return fmt.Errorf("tunnel %v session %v: %v %v (session %v)",
+						tcfg.Name, scfg.Name, l2tp.ErrSessionIDExists, sid, other)
+				}
+				sids[sid] = scfg.Name
+			}
+			fmt.Fprintf(w, "  session %v: %v pseudowire\n", scfg.Name, pwname)
+			nsessions++
+		}
+	}
+
+	fmt.Fprintf(w, "configuration OK: %v tunnel(s), %v session(s)\n", len(tunnels), nsessions)
+	return nil
+}
+
+func loadConfig(path, dir string) (*kl2tpdConfig, error) {
 	mycfg := newKl2tpdConfig()
-	cfgPathPtr := flag.String("config", "/etc/kl2tpd/kl2tpd.toml", "specify configuration file path")
+
+	var cfg *config.Config
+	var err error
+	if dir != "" {
+		cfg, err = config.LoadDirectoryWithCustomParser(dir, mycfg)
+	} else if path == "-" {
+		cfg, err = config.LoadWithCustomParser(os.Stdin, mycfg)
+	} else {
+		cfg, err = config.LoadFileWithCustomParser(path, mycfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mycfg.config = cfg
+	return mycfg, nil
+}
+
+func main() {
+	cfgPathPtr := flag.String("config", "/etc/kl2tpd/kl2tpd.toml", "specify configuration file path (\"-\" to read from stdin)")
+	cfgDirPtr := flag.String("confdir", "", "specify configuration directory path (mutually exclusive with -config)")
 	verbosePtr := flag.Bool("verbose", false, "toggle verbose log output")
 	nullDataPlanePtr := flag.Bool("null", false, "toggle null data plane")
+	socketPathPtr := flag.String("socket", "/run/kl2tpd.sock", "specify control socket path (empty to disable)")
+	metricsAddrPtr := flag.String("metrics-addr", "", "specify address for the Prometheus metrics HTTP listener (empty to disable)")
+	checkPtr := flag.Bool("check", false, "validate configuration and exit without creating tunnels")
 	flag.Parse()
 
-	config, err := config.LoadFileWithCustomParser(*cfgPathPtr, mycfg)
+	flagsSet := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		flagsSet[f.Name] = true
+	})
+	if *cfgDirPtr != "" && flagsSet["config"] {
+		stdlog.Fatalf("-config and -confdir are mutually exclusive")
+	}
+
+	mycfg, err := loadConfig(*cfgPathPtr, *cfgDirPtr)
 	if err != nil {
 		stdlog.Fatalf("failed to load configuration: %v", err)
 	}
-	mycfg.config = config
 
-	app, err := newApplication(mycfg, *verbosePtr, *nullDataPlanePtr)
+	if *checkPtr {
+		err = checkConfig(mycfg.config, os.Stdout)
+		if err != nil {
+			stdlog.Fatalf("invalid configuration: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	settings := daemonSettings{
+		verbose:       *verbosePtr,
+		nullDataPlane: *nullDataPlanePtr,
+		socketPath:    *socketPathPtr,
+		metricsAddr:   *metricsAddrPtr,
+	}
+	mycfg.daemon.apply(&settings, flagsSet)
+
+	app, err := newApplication(mycfg, settings.verbose, settings.nullDataPlane)
 	if err != nil {
 		stdlog.Fatalf("failed to instantiate application: %v", err)
 	}
 
+	app.socketPath = settings.socketPath
+	app.metricsAddr = settings.metricsAddr
+	app.reloadConfig = func() (*kl2tpdConfig, error) {
+		if *cfgPathPtr == "-" && *cfgDirPtr == "" {
+			return nil, fmt.Errorf("configuration read from stdin cannot be reloaded")
+		}
+		return loadConfig(*cfgPathPtr, *cfgDirPtr)
+	}
+
 	os.Exit(app.run())
 }
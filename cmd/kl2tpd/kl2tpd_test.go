@@ -83,3 +83,380 @@ func TestConfigParser(t *testing.T) {
 
 	os.Remove(pppdArgsPath)
 }
+
+func TestDaemonConfig(t *testing.T) {
+	defaults := daemonSettings{
+		socketPath: "/run/kl2tpd.sock",
+	}
+	cases := []struct {
+		name       string
+		in         string
+		flags      daemonSettings
+		flagsSet   map[string]bool
+		expectFail bool
+		out        daemonSettings
+	}{
+		{
+			name:  "no daemon table",
+			in:    ``,
+			flags: defaults,
+			out:   defaults,
+		},
+		{
+			name: "daemon table",
+			in: `[daemon]
+				 log_level = "debug"
+				 null_dataplane = true
+				 socket = "/tmp/kl2tpd.sock"
+				 metrics_addr = "127.0.0.1:9101"`,
+			flags: defaults,
+			out: daemonSettings{
+				verbose:       true,
+				nullDataPlane: true,
+				socketPath:    "/tmp/kl2tpd.sock",
+				metricsAddr:   "127.0.0.1:9101",
+			},
+		},
+		{
+			name: "flags override daemon table",
+			in: `[daemon]
+				 log_level = "debug"
+				 null_dataplane = true
+				 socket = "/tmp/kl2tpd.sock"
+				 metrics_addr = "127.0.0.1:9101"`,
+			flags: daemonSettings{
+				socketPath:  "",
+				metricsAddr: "127.0.0.1:9102",
+			},
+			flagsSet: map[string]bool{
+				"verbose":      true,
+				"socket":       true,
+				"metrics-addr": true,
+			},
+			out: daemonSettings{
+				nullDataPlane: true,
+				metricsAddr:   "127.0.0.1:9102",
+			},
+		},
+		{
+			name: "partial daemon table",
+			in: `[daemon]
+				 metrics_addr = "127.0.0.1:9101"`,
+			flags: defaults,
+			out: daemonSettings{
+				socketPath:  "/run/kl2tpd.sock",
+				metricsAddr: "127.0.0.1:9101",
+			},
+		},
+		{
+			name: "bad log level",
+			in: `[daemon]
+				 log_level = "chatty"`,
+			expectFail: true,
+		},
+		{
+			name: "unknown parameter",
+			in: `[daemon]
+				 pidfile = "/run/kl2tpd.pid"`,
+			expectFail: true,
+		},
+		{
+			name:       "not a table",
+			in:         `daemon = true`,
+			expectFail: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := newKl2tpdConfig()
+			_, err := config.LoadStringWithCustomParser(c.in, cfg)
+			if c.expectFail {
+				if err == nil {
+					t.Fatalf("LoadStringWithCustomParser: expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadStringWithCustomParser: %v", err)
+			}
+			settings := c.flags
+			cfg.daemon.apply(&settings, c.flagsSet)
+			if !reflect.DeepEqual(settings, c.out) {
+				t.Errorf("expect %+v, got %+v", c.out, settings)
+			}
+		})
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	type diffNames struct {
+		removedTunnels  []string
+		addedTunnels    []string
+		removedSessions map[string][]string
+		addedSessions   map[string][]string
+	}
+	base := `[tunnel.t1]
+		 peer = "127.0.0.1:9000"
+		 version = "l2tpv2"
+
+		 [tunnel.t1.session.s1]
+		 pseudowire = "ppp"
+
+		 [tunnel.t1.session.s2]
+		 pseudowire = "ppp"
+
+		 [tunnel.t2]
+		 peer = "127.0.0.1:9001"
+		 version = "l2tpv2"
+		 `
+	cases := []struct {
+		name     string
+		old, new string
+		want     diffNames
+	}{
+		{
+			name: "unchanged",
+			old:  base,
+			new:  base,
+			want: diffNames{
+				removedSessions: map[string][]string{},
+				addedSessions:   map[string][]string{},
+			},
+		},
+		{
+			name: "add and remove tunnels",
+			old:  base,
+			new: `[tunnel.t1]
+				 peer = "127.0.0.1:9000"
+				 version = "l2tpv2"
+
+				 [tunnel.t1.session.s1]
+				 pseudowire = "ppp"
+
+				 [tunnel.t1.session.s2]
+				 pseudowire = "ppp"
+
+				 [tunnel.t3]
+				 peer = "127.0.0.1:9002"
+				 version = "l2tpv2"
+				 `,
+			want: diffNames{
+				removedTunnels:  []string{"t2"},
+				addedTunnels:    []string{"t3"},
+				removedSessions: map[string][]string{},
+				addedSessions:   map[string][]string{},
+			},
+		},
+		{
+			name: "modify tunnel",
+			old:  base,
+			new: `[tunnel.t1]
+				 peer = "127.0.0.1:9000"
+				 version = "l2tpv2"
+
+				 [tunnel.t1.session.s1]
+				 pseudowire = "ppp"
+
+				 [tunnel.t1.session.s2]
+				 pseudowire = "ppp"
+
+				 [tunnel.t2]
+				 peer = "127.0.0.1:9001"
+				 version = "l2tpv2"
+				 hello_timeout = 1000
+				 `,
+			want: diffNames{
+				removedTunnels:  []string{"t2"},
+				addedTunnels:    []string{"t2"},
+				removedSessions: map[string][]string{},
+				addedSessions:   map[string][]string{},
+			},
+		},
+		{
+			name: "add, remove and modify sessions",
+			old:  base,
+			new: `[tunnel.t1]
+				 peer = "127.0.0.1:9000"
+				 version = "l2tpv2"
+
+				 [tunnel.t1.session.s2]
+				 pseudowire = "ppp"
+				 seqnum = true
+
+				 [tunnel.t1.session.s3]
+				 pseudowire = "ppp"
+
+				 [tunnel.t2]
+				 peer = "127.0.0.1:9001"
+				 version = "l2tpv2"
+				 `,
+			want: diffNames{
+				removedSessions: map[string][]string{"t1": {"s1", "s2"}},
+				addedSessions:   map[string][]string{"t1": {"s2", "s3"}},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			oldCfg := newKl2tpdConfig()
+			cfg, err := config.LoadStringWithCustomParser(c.old, oldCfg)
+			if err != nil {
+				t.Fatalf("LoadStringWithCustomParser(old): %v", err)
+			}
+			oldCfg.config = cfg
+
+			newCfg := newKl2tpdConfig()
+			cfg, err = config.LoadStringWithCustomParser(c.new, newCfg)
+			if err != nil {
+				t.Fatalf("LoadStringWithCustomParser(new): %v", err)
+			}
+			newCfg.config = cfg
+
+			diff := diffConfig(oldCfg, newCfg)
+
+			got := diffNames{
+				removedTunnels:  diff.removedTunnels,
+				removedSessions: diff.removedSessions,
+				addedSessions:   make(map[string][]string),
+			}
+			for _, tcfg := range diff.addedTunnels {
+				got.addedTunnels = append(got.addedTunnels, tcfg.Name)
+			}
+			for tname, sessions := range diff.addedSessions {
+				for _, scfg := range sessions {
+					got.addedSessions[tname] = append(got.addedSessions[tname], scfg.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("expect %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	cases := []struct {
+		name       string
+		in         string
+		expectFail bool
+		expectOut  []string
+	}{
+		{
+			name: "valid",
+			in: `[tunnel.t1]
+				 peer = "127.0.0.1:9000"
+				 version = "l2tpv2"
+				 encap = "udp"
+
+				 [tunnel.t1.session.s1]
+				 pseudowire = "ppp"
+
+				 [tunnel.t1.session.s2]
+				 pseudowire = "pppac"
+
+				 [tunnel.t2]
+				 peer = "127.0.0.1:9001"
+				 version = "l2tpv2"
+				 encap = "udp"
+				 tid = 42
+				 `,
+			expectOut: []string{
+				"tunnel t1: peer 127.0.0.1:9000, UDP encapsulation",
+				"  session s1: ppp pseudowire",
+				"  session s2: pppac pseudowire",
+				"tunnel t2: peer 127.0.0.1:9001, UDP encapsulation",
+				"configuration OK: 2 tunnel(s), 2 session(s)",
+			},
+		},
+		{
+			name: "unsupported version",
+			in: `[tunnel.t1]
+				 peer = "127.0.0.1:9000"
+				 version = "l2tpv3"
+				 encap = "udp"
+				 `,
+			expectFail: true,
+		},
+		{
+			name: "missing peer",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 encap = "udp"
+				 `,
+			expectFail: true,
+		},
+		{
+			name: "bad peer address",
+			in: `[tunnel.t1]
+				 peer = "127.0.0.1:99999"
+				 version = "l2tpv2"
+				 encap = "udp"
+				 `,
+			expectFail: true,
+		},
+		{
+			name: "duplicate tunnel ID",
+			in: `[tunnel.t1]
+				 peer = "127.0.0.1:9000"
+				 version = "l2tpv2"
+				 tid = 42
+
+				 [tunnel.t2]
+				 peer = "127.0.0.1:9001"
+				 version = "l2tpv2"
+				 tid = 42
+				 `,
+			expectFail: true,
+		},
+		{
+			name: "duplicate session ID",
+			in: `[tunnel.t1]
+				 peer = "127.0.0.1:9000"
+				 version = "l2tpv2"
+
+				 [tunnel.t1.session.s1]
+				 pseudowire = "ppp"
+				 sid = 10
+
+				 [tunnel.t1.session.s2]
+				 pseudowire = "ppp"
+				 sid = 10
+				 `,
+			expectFail: true,
+		},
+		{
+			name: "ethernet pseudowire",
+			in: `[tunnel.t1]
+				 peer = "127.0.0.1:9000"
+				 version = "l2tpv2"
+
+				 [tunnel.t1.session.s1]
+				 pseudowire = "eth"
+				 `,
+			expectFail: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := config.LoadStringWithCustomParser(c.in, newKl2tpdConfig())
+			if err != nil {
+				t.Fatalf("LoadStringWithCustomParser: %v", err)
+			}
+			var out strings.Builder
+			err = checkConfig(cfg, &out)
+			if c.expectFail {
+				if err == nil {
+					t.Fatalf("checkConfig(): expected error, got output %q", out.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkConfig(): %v", err)
+			}
+			expect := strings.Join(c.expectOut, "\n") + "\n"
+			if out.String() != expect {
+				t.Errorf("expected output %q, got %q", expect, out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// metricsServer exports kl2tpd metrics over HTTP in the Prometheus
+// text exposition format.
+//
+// Tunnel and session counts and tunnel statistics are read from the
+// L2TP context when the metrics are scraped.  The tunnel statistics are
+// running totals maintained by each tunnel, so per-tunnel counters
+// don't decrease when sessions close.  Tunnel and session up/down
+// transitions and control message retransmit failures are counted using
+// L2TP events.
+type metricsServer struct {
+	app      *application
+	logger   log.Logger
+	listener net.Listener
+	server   *http.Server
+	wg       sync.WaitGroup
+
+	lock                sync.Mutex
+	tunnelUp            uint64
+	tunnelDown          uint64
+	sessionUp           uint64
+	sessionDown         uint64
+	retransmitExhausted map[string]uint64
+}
+
+// metricsTunnelStats holds the statistics of a tunnel at a scrape.
+type metricsTunnelStats struct {
+	name     string
+	sessions int
+	stats    l2tp.TunnelStatistics
+}
+
+func newMetricsServer(app *application, addr string) (*metricsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on metrics address %v: %v", addr, err)
+	}
+
+	ms := &metricsServer{
+		app:                 app,
+		logger:              log.With(app.logger, "component", "metrics"),
+		listener:            listener,
+		retransmitExhausted: make(map[string]uint64),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", ms)
+	ms.server = &http.Server{Handler: mux}
+
+	app.l2tpCtx.RegisterEventHandler(ms)
+
+	ms.wg.Add(1)
+	go func() {
+		defer ms.wg.Done()
+		err := ms.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			level.Error(ms.logger).Log(
+				"message", "metrics server failed",
+				"error", err)
+		}
+	}()
+
+	return ms, nil
+}
+
+// HandleEvent counts L2TP events for export as metrics.
+func (ms *metricsServer) HandleEvent(event interface{}) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	switch ev := event.(type) {
+	case *l2tp.TunnelUpEvent:
+		ms.tunnelUp++
+	case *l2tp.TunnelDownEvent:
+		ms.tunnelDown++
+	case *l2tp.SessionUpEvent:
+		ms.sessionUp++
+	case *l2tp.SessionDownEvent:
+		ms.sessionDown++
+	case *l2tp.ControlMessageRetransmitExhaustedEvent:
+		ms.retransmitExhausted[ev.TunnelName]++
+	}
+}
+
+func (ms *metricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+
+	var tunnels []metricsTunnelStats
+	var nsessions int
+	for _, tunl := range ms.app.l2tpCtx.ListTunnels() {
+		ts := metricsTunnelStats{
+			name:     tunl.Name(),
+			sessions: len(tunl.ListSessions()),
+			stats:    tunl.Statistics(),
+		}
+		nsessions += ts.sessions
+		tunnels = append(tunnels, ts)
+	}
+
+	writeMetric(&b, "kl2tpd_tunnels", "gauge", "Number of tunnels currently instantiated.")
+	writeSample(&b, "kl2tpd_tunnels", "", uint64(len(tunnels)))
+	writeMetric(&b, "kl2tpd_sessions", "gauge", "Number of sessions currently instantiated.")
+	writeSample(&b, "kl2tpd_sessions", "", uint64(nsessions))
+
+	perTunnel := []struct {
+		name, help string
+		value      func(ts *metricsTunnelStats) uint64
+	}{
+		{
+			"kl2tpd_tunnel_sessions", "Number of sessions currently instantiated in the tunnel.",
+			func(ts *metricsTunnelStats) uint64 { return uint64(ts.sessions) },
+		},
+		{
+			"kl2tpd_tunnel_tx_packets_total", "Data packets transmitted by the tunnel's sessions.",
+			func(ts *metricsTunnelStats) uint64 { return ts.stats.Data.TxPackets },
+		},
+		{
+			"kl2tpd_tunnel_tx_bytes_total", "Data bytes transmitted by the tunnel's sessions.",
+			func(ts *metricsTunnelStats) uint64 { return ts.stats.Data.TxBytes },
+		},
+		{
+			"kl2tpd_tunnel_tx_errors_total", "Data transmit errors for the tunnel's sessions.",
+			func(ts *metricsTunnelStats) uint64 { return ts.stats.Data.TxErrors },
+		},
+		{
+			"kl2tpd_tunnel_rx_packets_total", "Data packets received by the tunnel's sessions.",
+			func(ts *metricsTunnelStats) uint64 { return ts.stats.Data.RxPackets },
+		},
+		{
+			"kl2tpd_tunnel_rx_bytes_total", "Data bytes received by the tunnel's sessions.",
+			func(ts *metricsTunnelStats) uint64 { return ts.stats.Data.RxBytes },
+		},
+		{
+			"kl2tpd_tunnel_rx_errors_total", "Data receive errors for the tunnel's sessions.",
+			func(ts *metricsTunnelStats) uint64 { return ts.stats.Data.RxErrors },
+		},
+		{
+			"kl2tpd_tunnel_control_retransmits_total", "Control messages retransmitted by the tunnel.",
+			func(ts *metricsTunnelStats) uint64 { return ts.stats.ControlRetransmits },
+		},
+	}
+	for _, m := range perTunnel {
+		mtype := "gauge"
+		if strings.HasSuffix(m.name, "_total") {
+			mtype = "counter"
+		}
+		writeMetric(&b, m.name, mtype, m.help)
+		for i := range tunnels {
+			writeSample(&b, m.name, tunnelLabel(tunnels[i].name), m.value(&tunnels[i]))
+		}
+	}
+
+	ms.lock.Lock()
+	events := []struct {
+		name, help string
+		value      uint64
+	}{
+		{"kl2tpd_tunnel_up_total", "Tunnels which have been established.", ms.tunnelUp},
+		{"kl2tpd_tunnel_down_total", "Tunnels which have been torn down.", ms.tunnelDown},
+		{"kl2tpd_session_up_total", "Sessions which have been established.", ms.sessionUp},
+		{"kl2tpd_session_down_total", "Sessions which have been torn down.", ms.sessionDown},
+	}
+	for _, m := range events {
+		writeMetric(&b, m.name, "counter", m.help)
+		writeSample(&b, m.name, "", m.value)
+	}
+	writeMetric(&b, "kl2tpd_control_retransmit_exhausted_total", "counter",
+		"Control messages which were not acknowledged by the peer after all retransmits.")
+	names := make([]string, 0, len(ms.retransmitExhausted))
+	for name := range ms.retransmitExhausted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeSample(&b, "kl2tpd_control_retransmit_exhausted_total", tunnelLabel(name), ms.retransmitExhausted[name])
+	}
+	ms.lock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+func writeMetric(b *bytes.Buffer, name, mtype, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, mtype)
+}
+
+func writeSample(b *bytes.Buffer, name, labels string, value uint64) {
+	fmt.Fprintf(b, "%s%s %d\n", name, labels, value)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func tunnelLabel(name string) string {
+	return `{tunnel="` + labelValueEscaper.Replace(name) + `"}`
+}
+
+// close unregisters the server's event handler, shuts down the HTTP
+// server, and waits for it to exit.
+func (ms *metricsServer) close() {
+	ms.app.l2tpCtx.UnregisterEventHandler(ms)
+	ms.server.Close()
+	ms.wg.Wait()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+func TestMetricsServer(t *testing.T) {
+	dp := l2tp.NewMockDataPlane()
+	app, err := newApplicationWithDataPlane(newKl2tpdConfig(), false, dp)
+	if err != nil {
+		t.Fatalf("newApplication: %v", err)
+	}
+	defer app.l2tpCtx.Close()
+
+	tunl, err := app.l2tpCtx.NewStaticTunnel("t1", &l2tp.TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      l2tp.ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        l2tp.EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel: %v", err)
+	}
+	sessions := []l2tp.Session{}
+	for i, name := range []string{"s1", "s2"} {
+		sid := l2tp.ControlConnID(100 + i)
+		dp.SetSessionStatistics(sid, &l2tp.SessionDataPlaneStatistics{
+			TxPackets: 10,
+			TxBytes:   1000,
+		})
+		s, err := tunl.NewSession(name, &l2tp.SessionConfig{
+			SessionID:     sid,
+			PeerSessionID: sid + 100,
+			Pseudowire:    l2tp.PseudowireTypeEth,
+		})
+		if err != nil {
+			t.Fatalf("NewSession: %v", err)
+		}
+		sessions = append(sessions, s)
+	}
+
+	ms, err := newMetricsServer(app, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("newMetricsServer: %v", err)
+	}
+	defer ms.close()
+
+	ms.HandleEvent(&l2tp.TunnelUpEvent{TunnelName: "t1"})
+	ms.HandleEvent(&l2tp.ControlMessageRetransmitExhaustedEvent{TunnelName: "t\"2"})
+
+	scrape := func() string {
+		rsp, err := http.Get("http://" + ms.listener.Addr().String() + "/metrics")
+		if err != nil {
+			t.Fatalf("http.Get: %v", err)
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %v, got %v", http.StatusOK, rsp.StatusCode)
+		}
+		b, err := io.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		return string(b)
+	}
+
+	out := scrape()
+	for _, expect := range []string{
+		"# TYPE kl2tpd_tunnels gauge\n",
+		"kl2tpd_tunnels 1\n",
+		"kl2tpd_sessions 2\n",
+		`kl2tpd_tunnel_sessions{tunnel="t1"} 2` + "\n",
+		"# TYPE kl2tpd_tunnel_tx_bytes_total counter\n",
+		`kl2tpd_tunnel_tx_bytes_total{tunnel="t1"} 2000` + "\n",
+		`kl2tpd_tunnel_tx_packets_total{tunnel="t1"} 20` + "\n",
+		`kl2tpd_tunnel_rx_bytes_total{tunnel="t1"} 0` + "\n",
+		`kl2tpd_tunnel_rx_packets_total{tunnel="t1"} 0` + "\n",
+		"# TYPE kl2tpd_tunnel_control_retransmits_total counter\n",
+		`kl2tpd_tunnel_control_retransmits_total{tunnel="t1"} 0` + "\n",
+		"kl2tpd_tunnel_up_total 1\n",
+		"kl2tpd_tunnel_down_total 0\n",
+		"kl2tpd_session_up_total 0\n",
+		"kl2tpd_session_down_total 0\n",
+		`kl2tpd_control_retransmit_exhausted_total{tunnel="t\"2"} 1` + "\n",
+	} {
+		if !strings.Contains(out, expect) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", expect, out)
+		}
+	}
+
+	// Per-tunnel counters must not decrease when a session closes
+	sessions[1].Close()
+	out = scrape()
+	for _, expect := range []string{
+		`kl2tpd_tunnel_sessions{tunnel="t1"} 1` + "\n",
+		`kl2tpd_tunnel_tx_bytes_total{tunnel="t1"} 2000` + "\n",
+		`kl2tpd_tunnel_tx_packets_total{tunnel="t1"} 20` + "\n",
+	} {
+		if !strings.Contains(out, expect) {
+			t.Errorf("after session close, expected metrics to contain %q, got:\n%s", expect, out)
+		}
+	}
+}
@@ -11,6 +11,14 @@ import (
 
 var _ pseudowire = (*pppDaemon)(nil)
 
+// pppdPath is the path to the pppd binary.
+// It is a variable to allow tests to substitute a fake pppd.
+var pppdPath = "/usr/sbin/pppd"
+
+// newPPPoL2TPSocket creates the PPPoL2TP socket passed to pppd.
+// It is a variable to allow tests to run without the kernel PPPoL2TP driver.
+var newPPPoL2TPSocket = socketPPPoL2TPv4
+
 type pppDaemon struct {
 	session   l2tp.Session
 	fd        int
@@ -67,22 +75,32 @@ func pppdExitCodeString(err error) string {
 	return err.Error()
 }
 
-func newPPPDaemon(session l2tp.Session, tunnelID, sessionID, peerTunnelID, peerSessionID l2tp.ControlConnID) (*pppDaemon, error) {
+// pppdArgv builds the pppd argument list for a PPPoL2TP session.
+// The pppol2tp plugin arguments are followed by any additional
+// arguments from the session configuration.
+func pppdArgv(tunnelID, sessionID l2tp.ControlConnID, args []string) []string {
+	argv := []string{
+		pppdPath,
+		"plugin", "pppol2tp.so",
+		"pppol2tp", "3",
+		"pppol2tp_tunnel_id", fmt.Sprintf("%v", tunnelID),
+		"pppol2tp_session_id", fmt.Sprintf("%v", sessionID),
+		"nodetach",
+	}
+	return append(argv, args...)
+}
+
+func newPPPDaemon(session l2tp.Session, tunnelID, sessionID, peerTunnelID, peerSessionID l2tp.ControlConnID, args []string) (*pppDaemon, error) {
 
-	fd, err := socketPPPoL2TPv4(tunnelID, sessionID, peerTunnelID, peerSessionID)
+	fd, err := newPPPoL2TPSocket(tunnelID, sessionID, peerTunnelID, peerSessionID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create PPPoL2TP socket: %v", err)
 	}
 
 	var stdout, stderr bytes.Buffer
 	file := os.NewFile(uintptr(fd), "pppol2tp")
-	cmd := exec.Command(
-		"/usr/sbin/pppd",
-		"plugin", "pppol2tp.so",
-		"pppol2tp", "3",
-		"pppol2tp_tunnel_id", fmt.Sprintf("%v", tunnelID),
-		"pppol2tp_session_id", fmt.Sprintf("%v", sessionID),
-		"nodetach")
+	argv := pppdArgv(tunnelID, sessionID, args)
+	cmd := exec.Command(argv[0], argv[1:]...)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	cmd.ExtraFiles = append(cmd.ExtraFiles, file)
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katalix/go-l2tp/config"
+	"github.com/katalix/go-l2tp/l2tp"
+	"golang.org/x/sys/unix"
+)
+
+func TestPPPDArgv(t *testing.T) {
+	got := pppdArgv(42, 99, []string{"noauth", "10.42.0.1:10.42.0.2"})
+	want := []string{
+		pppdPath,
+		"plugin", "pppol2tp.so",
+		"pppol2tp", "3",
+		"pppol2tp_tunnel_id", "42",
+		"pppol2tp_session_id", "99",
+		"nodetach",
+		"noauth", "10.42.0.1:10.42.0.2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expect %v, got %v", want, got)
+	}
+}
+
+// writeFakePPPD writes a shell script which records its arguments to
+// argsPath, and then either exits immediately or waits to be signalled.
+func writeFakePPPD(t *testing.T, dir, argsPath string, exitImmediately bool) string {
+	action := "exec sleep 10"
+	if exitImmediately {
+		action = "exit 0"
+	}
+	path := filepath.Join(dir, "pppd")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s.tmp\nmv %s.tmp %s\n%s\n",
+		argsPath, argsPath, argsPath, action)
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("os.WriteFile(%v): %v", path, err)
+	}
+	return path
+}
+
+func waitForFile(t *testing.T, path string) string {
+	for i := 0; i < 100; i++ {
+		b, err := os.ReadFile(path)
+		if err == nil {
+			return strings.TrimSpace(string(b))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %v", path)
+	return ""
+}
+
+func TestPPPDLifecycle(t *testing.T) {
+	// Use an ordinary socket in place of the PPPoL2TP socket, since the
+	// fake pppd doesn't use it
+	defer func(orig func(tid, sid, ptid, psid l2tp.ControlConnID) (int, error)) {
+		newPPPoL2TPSocket = orig
+	}(newPPPoL2TPSocket)
+	newPPPoL2TPSocket = func(tid, sid, ptid, psid l2tp.ControlConnID) (int, error) {
+		return unix.Socket(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	}
+	defer func(orig string) { pppdPath = orig }(pppdPath)
+
+	cases := []struct {
+		name            string
+		exitImmediately bool
+	}{
+		{name: "session close", exitImmediately: false},
+		{name: "pppd exit", exitImmediately: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			argsPath := filepath.Join(dir, "args")
+			pppdPath = writeFakePPPD(t, dir, argsPath, c.exitImmediately)
+
+			pppdArgsPath := filepath.Join(dir, "pppd.args")
+			if err := os.WriteFile(pppdArgsPath, []byte("noauth\nlcp-echo-interval 5"), 0644); err != nil {
+				t.Fatalf("os.WriteFile(%v): %v", pppdArgsPath, err)
+			}
+
+			cfg := newKl2tpdConfig()
+			c2, err := config.LoadStringWithCustomParser(fmt.Sprintf(`[tunnel.t1]
+				 [tunnel.t1.session.s1]
+				 pppd_args = "%s"`, pppdArgsPath), cfg)
+			if err != nil {
+				t.Fatalf("LoadStringWithCustomParser(): %v", err)
+			}
+			cfg.config = c2
+
+			app, err := newApplication(cfg, false, true)
+			if err != nil {
+				t.Fatalf("newApplication(): %v", err)
+			}
+			defer app.l2tpCtx.Close()
+			app.l2tpCtx.RegisterEventHandler(app)
+
+			tunl, err := app.l2tpCtx.NewQuiescentTunnel("t1", &l2tp.TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "127.0.0.1:5000",
+				Version:      l2tp.ProtocolVersion2,
+				TunnelID:     42,
+				PeerTunnelID: 420,
+				Encap:        l2tp.EncapTypeUDP,
+			})
+			if err != nil {
+				t.Fatalf("NewQuiescentTunnel(): %v", err)
+			}
+			_, err = tunl.NewSession("s1", &l2tp.SessionConfig{
+				SessionID:     99,
+				PeerSessionID: 990,
+				Pseudowire:    l2tp.PseudowireTypePPP,
+			})
+			if err != nil {
+				t.Fatalf("NewSession(): %v", err)
+			}
+
+			expect := "plugin pppol2tp.so pppol2tp 3 pppol2tp_tunnel_id 42 " +
+				"pppol2tp_session_id 99 nodetach noauth lcp-echo-interval 5"
+			if got := waitForFile(t, argsPath); got != expect {
+				t.Errorf("pppd args: expect %q, got %q", expect, got)
+			}
+
+			var pw pseudowire
+			if c.exitImmediately {
+				// pppd exiting should close the session
+				select {
+				case pw = <-app.pwCompleteChan:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out waiting for pppd to exit")
+				}
+				app.pseudowireComplete(pw)
+				app.wg.Wait()
+				if sessions := tunl.ListSessions(); len(sessions) != 0 {
+					t.Errorf("expected session to be closed, got %v", sessions)
+				}
+			} else {
+				// Closing the session should terminate pppd
+				s, _ := tunl.FindSessionByName("s1")
+				s.Close()
+				select {
+				case pw = <-app.pwCompleteChan:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out waiting for pppd to exit")
+				}
+				app.wg.Wait()
+			}
+
+			if app.isActivePseudowire(pw) {
+				t.Errorf("pseudowire still registered after termination")
+			}
+		})
+	}
+}
@@ -122,15 +122,15 @@ func (runner *kl2tpdRunner) spawn(sessionID pppoe.PPPoESessionID,
 	   these expressions may need to be updated accordingly!
 	*/
 	d.logRegexp[kl2tpdTunnelCreated] = regexp.MustCompile(
-		"^.*new dynamic tunnel.* tunnel_id=([0-9]+)")
+		"^.* tunnel_id=([0-9]+) version=[^ ]+ message=\"new dynamic tunnel\"")
 	d.logRegexp[kl2tpdSessionCreated] = regexp.MustCompile(
-		"^.*new dynamic session.* session_id=([0-9]+)")
+		"^.* session_id=([0-9]+) message=\"new dynamic session\"")
 	d.logRegexp[kl2tpdSessionEstablished] = regexp.MustCompile(
-		"^.*session_name=s1 message=\"data plane established\"")
+		"^.*session_name=s1 session_id=[0-9]+ message=\"data plane established\"")
 	d.logRegexp[kl2tpdSessionDestroyed] = regexp.MustCompile(
-		"^.*session_name=s1 message=close")
+		"^.*session_name=s1 session_id=[0-9]+ message=close")
 	d.logRegexp[kl2tpdTunnelDestroyed] = regexp.MustCompile(
-		"^.*tunnel_name=t1 message=close")
+		"^.*tunnel_name=t1 tunnel_id=[0-9]+ version=[^ ]+ message=close")
 	d.logRegexp[kl2tpdErrorMessage] = regexp.MustCompile(
 		"^.*level=error")
 
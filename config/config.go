@@ -8,15 +8,39 @@ Tunnel and session instances are called out in the configuration file
 using named TOML tables.  Each tunnel or session instance table contains
 configuration parameters for that instance as key:value pairs.
 
+Parameters specifying a duration may be given either as an integer number
+of milliseconds, or as a string in the format accepted by time.ParseDuration,
+for example "7.5s" or "250ms".
+
 	# This is a tunnel instance named "t1"
 	[tunnel.t1]
 
 	# local specifies the local address that the tunnel should
-	# bind its socket to
+	# bind its socket to.
+	# For UDP encapsulation the port may be omitted, in which case
+	# local_port applies.  IP encapsulation has no ports, and an address
+	# including a port is rejected.
 	local = "127.0.0.1:5000"
 
+	# local_port specifies the local UDP port that the tunnel should
+	# bind its socket to if local is unset, or doesn't include a port.
+	# It has no effect for IP-encapsulated tunnels.
+	# The default is 1701.  Only one tunnel may bind to a given local
+	# address and port unless reuse_port is set, so tunnels which leave
+	# local unset must each have a distinct local_port, or set reuse_port.
+	local_port = 1701
+
+	# preferred_source pins the local IP address the tunnel sends from
+	# on hosts with several addresses.  It is used if local is unset or
+	# gives a wildcard address, such as ":1701", to set only the port.
+	# It cannot be combined with a local address naming a host.
+	# preferred_source = "2001:db8::1"
+
 	# peer specifies the address of the peer that the tunnel should
-	# connect its socket to
+	# connect its socket to.
+	# For UDP encapsulation the port may be omitted, in which case the
+	# default is 1701.  IP encapsulation has no ports, and an address
+	# including a port is rejected.
 	peer = "127.0.0.1:5001"
 
 	# version specifies the version of the L2TP specification the
@@ -29,6 +53,14 @@ configuration parameters for that instance as key:value pairs.
 	# L2TPv2 tunnels are UDP only.
 	encap = "udp"
 
+	# address_family constrains the address family used when resolving
+	# the local and peer addresses.  This allows a tunnel to consistently
+	# use one family when a host name resolves to both IPv4 and IPv6
+	# addresses, but only one family is routable.
+	# Supported values are "ip4", "ip6", and "any".
+	# By default either family may be used, with IPv4 preferred.
+	address_family = "ip6"
+
 	# tid specifies the local tunnel ID of the tunnel.
 	# Tunnel IDs must be unique for the host.
 	# L2TPv2 tunnel IDs are 16 bit, and may be in the range 1 - 65535.
@@ -47,9 +79,17 @@ configuration parameters for that instance as key:value pairs.
 	# tunnel may have "in flight" (i.e. pending an ACK from the peer) at
 	# any one time.  Tuning the window size can allow high-volume L2TP servers
 	# to improve performance.  Generally it won't be necessary to change
-	# this from the default value of 4.
+	# this from the default value of 4.  The minimum window size is 1.
+	# tx_window_size is accepted as an alias for window_size.
 	window_size = 10 # control messages
 
+	# stop_and_wait, if set, limits the L2TP reliable transport algorithm
+	# to a single control message in flight at any one time.  This is a
+	# compatibility option for peers which mishandle the control channel
+	# sliding window.  It may not be combined with a window size greater
+	# than 1.
+	stop_and_wait = false
+
 	# hello_timeout if set enables L2TP keep-alive (HELLO) messages.
 	# A hello message is sent N milliseconds after the last control
 	# message was sent or received.  It allows for early detection of
@@ -63,25 +103,195 @@ configuration parameters for that instance as key:value pairs.
 	# By default a starting retry timeout of 1000ms is used.
 	retry_timeout = 1500 # milliseconds
 
+	# ack_timeout if set tweaks how long the reliable transport algorithm
+	# waits before explicitly acknowledging a received control message.
+	# Most control messages are implicitly acknowledged by control protocol
+	# responses, so this is mainly relevant on lossy links.
+	# By default an ack timeout of 100ms is used.
+	ack_timeout = 250 # milliseconds
+
 	# max_retries sets how many times a given control message may be
 	# retried before the transport considers the message transmission to
 	# have failed.
 	# It may be useful to tune this value on unreliable network connections
 	# to avoid suprious tunnel failure, or conversely to allow for quicker
 	# tunnel failure detection on reliable links.
-	# The default is 3 retries.
+	# The default is 3 retries, and the maximum is 10 retries.
+	# max_retransmit is accepted as an alias for max_retries.
 	max_retries 5
 
+	# control_read_timeout, if set, limits how long the tunnel waits to
+	# receive a control packet from the peer.  If nothing is received
+	# within the timeout the tunnel is torn down.  It should be used
+	# together with hello_timeout and set comfortably larger than it.
+	# This parameter is not supported for static tunnels.
+	# By default control packet reads do not time out.
+	control_read_timeout = 60000 # milliseconds
+
+	# control_write_timeout, if set, limits how long the tunnel waits to
+	# write a control packet to the tunnel socket.
+	# This parameter is not supported for static tunnels.
+	# By default control packet writes do not time out.
+	control_write_timeout = 1000 # milliseconds
+
+	# establish_timeout, if set, limits how long a dynamic tunnel may take
+	# to establish the control connection with the peer.  If the tunnel
+	# isn't established within the timeout it is torn down.
+	# This parameter is not supported for static or quiescent tunnels.
+	# By default the tunnel waits until its control message retransmits
+	# are exhausted.
+	establish_timeout = 10000 # milliseconds
+
+	# persist, if set, causes a dynamic tunnel which fails to be
+	# re-created automatically, along with its sessions.  Successive
+	# attempts are made with an exponential backoff between reconnect_min
+	# and reconnect_max.  A tunnel closed cleanly by the peer is not
+	# re-created.
+	# This parameter is supported for dynamic tunnels only.
+	persist = true
+
+	# reconnect_min and reconnect_max bound the backoff between attempts
+	# to re-create a persistent tunnel.  The defaults are 1000ms and
+	# 60000ms respectively.
+	reconnect_min = 1000 # milliseconds
+	reconnect_max = 60000 # milliseconds
+
+	# resolve_interval, if set, causes the peer host name of a persistent
+	# tunnel to be periodically re-resolved.  If the peer address changes
+	# the tunnel is re-created using the new address.
+	# This parameter requires persist to be set.
+	resolve_interval = 300000 # milliseconds
+
 	# host_name sets the host name the tunnel will advertise in the
 	# Host Name AVP per RFC2661.
 	# If unset the host's name will be queried and the returned value used.
 	host_name "basilbrush.local"
 
+	# router_id sets the router ID the tunnel will advertise in the
+	# Router ID AVP per RFC3931.  It is commonly set to an IPv4 address
+	# of the host, expressed as an integer.
+	# This parameter only applies to L2TPv3 tunnels.
+	# By default the tunnel ID is advertised as the router ID.
+	router_id = 0xc0000201
+
 	# framing_caps sets the framing capabilites the tunnel will advertise
 	# in the Framing Capabilites AVP per RFC2661.
 	# The default is to advertise both sync and async framing.
 	framing_caps = ["sync","async"]
 
+	# bearer_caps sets the bearer capabilities the tunnel will advertise
+	# in the Bearer Capabilities AVP per RFC2661.
+	# Supported values are "digital" and "analog".
+	# By default no Bearer Capabilities AVP is sent.
+	bearer_caps = ["digital","analog"]
+
+	# debug sets the kernel debug logging flags for the tunnel data plane.
+	# Supported flags are "control" (userspace/kernelspace API interactions),
+	# "data" (data messages), "seq" (data sequence numbers), and "state"
+	# (verbose tunnel and session state logging).
+	# Kernel logging may be viewed using dmesg, syslog, or the systemd journal.
+	# By default no kernel debug logging is enabled.
+	debug = ["control","state"]
+
+	# secret sets the shared secret used for hiding AVPs per RFC2661
+	# section 4.3.  If set, sensitive AVPs in transmitted control messages
+	# are hidden, and hidden AVPs in received control messages can be decoded.
+	# AVP hiding is currently supported for L2TPv2 tunnels only.
+	# By default no AVPs are hidden.
+	secret = "sesame"
+
+	# secret_file reads the shared secret from the named file when the
+	# configuration is loaded, avoiding the need to store the secret in
+	# the configuration file itself.  Leading and trailing whitespace is
+	# removed from the file content.
+	# secret_env reads the shared secret from the named environment
+	# variable when the configuration is loaded.
+	# Only one of secret, secret_file, and secret_env may be specified.
+	# secret_file = "/run/secrets/t1"
+	# secret_env = "T1_SECRET"
+
+	# udp_checksum enables or disables UDP checksums for UDP-encapsulated
+	# tunnels.  Disabling checksums for IPv6 tunnels configures the tunnel
+	# to transmit and accept packets with a zero UDP checksum.
+	# If unset the tunnel socket's default behaviour is used: for dynamic
+	# and quiescent tunnels this means checksums are enabled, while static
+	# tunnels default to checksums being disabled for IPv4 and enabled
+	# for IPv6.
+	udp_checksum = true
+
+	# pmtudisc controls path MTU discovery for the tunnel socket.
+	# Supported values are "dont" (never set the IPv4 Don't Fragment bit,
+	# fragmenting packets locally as necessary), "want" (perform path MTU
+	# discovery, but fragment packets exceeding the path MTU locally), and
+	# "do" (perform path MTU discovery, dropping packets exceeding the
+	# path MTU).  Since the kernel data plane shares the tunnel socket, the
+	# setting applies to data packets as well as control packets.
+	# This parameter is not supported for static tunnels.
+	# By default the system's ip_no_pmtu_disc setting applies.
+	pmtudisc = "do"
+
+	# device binds the tunnel socket to the named network interface using
+	# SO_BINDTODEVICE, which is useful on multi-homed or VRF hosts.
+	# Binding to a device may require the CAP_NET_RAW capability.
+	# This parameter is not supported for static tunnels.
+	device = "eth0"
+
+	# device_index binds the tunnel socket to the network interface with
+	# the given index using SO_BINDTOIFINDEX, as an alternative to device.
+	# device and device_index cannot both be set.
+	# This parameter is not supported for static tunnels.
+	device_index = 2
+
+	# ipv6_flowlabel, if set, specifies the IPv6 flow label to use for
+	# packets sent by IPv6 tunnels.  A consistent flow label allows routers
+	# using ECMP to keep the tunnel's packets on a single path.
+	# Flow labels may be in the range 1 - 1048575 (0xfffff).
+	# By default no flow label is set.
+	ipv6_flowlabel = 0x12345
+
+	# reuse_port, if set, allows the tunnel socket to bind to a local
+	# address and port which other sockets are already bound to.  This
+	# allows multiple tunnels to use port 1701 as their local port.
+	# Any process running as the same user may then bind to the port and
+	# receive a share of the tunnel's traffic until the tunnel socket is
+	# connected to its peer, so this should only be used where such
+	# processes are trusted.
+	# This parameter is not supported for static tunnels.
+	# By default port reuse is disabled.
+	reuse_port = true
+
+	# socket_priority, if set, specifies the SO_PRIORITY value for the
+	# tunnel socket, allowing traffic control to classify the tunnel's
+	# packets.  A priority matching a tc class ID, e.g. 0x10001 for class
+	# 1:1, classifies packets directly into that class.  Data packets use
+	# the priority as well as control packets.
+	# Priorities above 6 require the CAP_NET_ADMIN capability.
+	# This parameter is not supported for static tunnels.
+	# By default the socket priority is 0.
+	socket_priority = 0x10001
+
+	# capture_file, if set, names a file to which all control packets sent
+	# and received by the tunnel are written in pcap format, for diagnosing
+	# interoperability problems.  The file is truncated when the tunnel
+	# is created.
+	# This parameter is not supported for static tunnels.
+	capture_file = "/tmp/t1.pcap"
+
+	# max_sessions, if set, limits the number of sessions the tunnel
+	# may have at any one time.
+	# By default the number of sessions is not limited.
+	max_sessions = 64
+
+	# This is a session template for tunnel "t1".
+	# Its parameters provide defaults for every session instance in the
+	# tunnel, which may override individual parameters as required.
+	# Templates are useful when a tunnel carries many similar sessions.
+	# Parameters which must be unique to each session, namely sid, psid
+	# and interface_name, cannot be set in the template.
+	[tunnel.t1.session_template]
+	pseudowire = "eth"
+	seqnum = true
+
 	# This is a session instance called "s1" within parent tunnel "t1".
 	# Session instances are always created inside a parent tunnel.
 	[tunnel.t1.session.s1]
@@ -124,21 +334,79 @@ configuration parameters for that instance as key:value pairs.
 	# By default no peer cookie is set.
 	peer_cookie = [ 0x74, 0x2e, 0x28, 0xa8 ]
 
+	# cookie_check_interval, if set, specifies how often in milliseconds
+	# to poll the session statistics for received data packets discarded
+	# due to a cookie mismatch.  A warning is logged when the number of
+	# discarded packets increases.
+	# It applies to L2TPv3 sessions only.
+	# By default the statistics are not polled.
+	cookie_check_interval = 10000
+
 	# interface_name, if set, specifies the network interface name to be
 	# used for the session instance.
 	# By default the Linux kernel autogenerates an interface name specific to
 	# the pseudowire type, e.g. "l2tpeth0", "ppp0".
 	# Setting the interface name can be useful when you need to be certain
 	# of the interface name a given session will use.
+	# Interface names may be up to 15 characters long, and may not contain
+	# '/', ':', or whitespace.
 	# By default the kernel autogenerates an interface name.
 	interface_name = "l2tpeth42"
 
+	# mtu, if set, specifies the MTU of the session network interface.
+	# It applies to Ethernet pseudowires only.
+	# By default the kernel chooses the MTU based on the tunnel
+	# encapsulation overhead.
+	mtu = 1400
+
+	# bridge, if set, specifies the name of a bridge interface which the
+	# session network interface is attached to once it is created.
+	# The interface is detached from the bridge when the session is
+	# torn down.
+	# It applies to Ethernet pseudowires only.
+	# By default the session interface is not attached to a bridge.
+	bridge = "br0"
+
+	# admin_up, if set, brings the session network interface
+	# administratively up once it is created.
+	# It applies to Ethernet pseudowires only.
+	# By default the interface is left down.
+	admin_up = true
+
+	# address, if set, specifies an IP address and prefix length in CIDR
+	# notation to assign to the session network interface.
+	# The address is removed along with the interface when the session
+	# is torn down.
+	# It applies to Ethernet pseudowires only.
+	# By default no address is assigned.
+	address = "192.0.2.1/32"
+
+	# peer_address, if set, specifies the IP address of the remote end of
+	# a point-to-point link.  The address set by the address parameter is
+	# then assigned as the local end of the link.
+	# It applies to Ethernet pseudowires only, and requires address to
+	# be set.
+	peer_address = "192.0.2.2"
+
+	# drain_timeout, if set, specifies how long in milliseconds to allow
+	# packets queued on the session network interface to drain when the
+	# session is torn down.  The interface is brought down, the drain
+	# timeout allowed to elapse, and then the session is deleted.
+	# It applies to Ethernet pseudowires only.
+	# By default the session is deleted immediately.
+	drain_timeout = 250
+
 	# l2spec_type specifies the L2TPv3 Layer 2 specific sublayer field to
 	# be used in data packet headers as per RFC3931 section 3.2.2.
 	# Currently supported values are "none" and "default".
+	# It applies to L2TPv3 sessions only.
 	# By default no Layer 2 specific sublayer is used.
 	l2spec_type = "default"
 
+	# debug sets the kernel debug logging flags for the session data plane.
+	# The supported flags are as described for the tunnel debug parameter.
+	debug = ["data","seq"]
+
 	# pppoe_session_id specifies the assigned PPPoE session ID for the session.
 	# Per RFC2516, the PPPoE session ID is in the range 1 - 65535
 	# This parameter only applies to pppac pseudowires.
@@ -147,21 +415,86 @@ configuration parameters for that instance as key:value pairs.
 	# pppoe_peer_mac specifies the MAC address of the PPPoE peer for the session.
 	# This parameter only applies to pppac pseudowires.
 	pppoe_peer_mac = [ 0x02, 0x42, 0x94, 0xd1, 0x4e, 0x9a ]
+
+	# call_direction specifies how a session in a dynamic L2TPv2 tunnel
+	# is established.  Supported values are "incoming", which uses the
+	# ICRQ/ICRP/ICCN incoming call exchange, and "outgoing", which uses
+	# the OCRQ/OCRP/OCCN outgoing call exchange.
+	# By default sessions are established as incoming calls.
+	call_direction = "outgoing"
+
+	# called_number specifies the number the peer should dial for an
+	# outgoing call.  It is sent to the peer in the Called Number AVP.
+	# This parameter only applies to outgoing calls.
+	called_number = "5551234"
+
+	# bearer_type specifies the bearer type of the call, which is sent in
+	# the Bearer Type AVP of the ICRQ or OCRQ message per RFC2661.
+	# Supported values are "digital" and "analog".
+	# This parameter only applies to L2TPv2 sessions.
+	# By default no Bearer Type AVP is sent for incoming calls, and outgoing
+	# calls permit both digital and analog bearers.
+	bearer_type = ["analog"]
+
+	# minimum_bps and maximum_bps specify the lowest and highest line speeds
+	# in bits per second acceptable for an outgoing call, which are sent in
+	# the Minimum BPS and Maximum BPS AVPs of the OCRQ message per RFC2661.
+	# These parameters only apply to L2TPv2 sessions.
+	# By default any line speed is acceptable.
+	minimum_bps = 9600
+	maximum_bps = 64000
+
+	# framing_type specifies the framing type of the call, which is sent in
+	# the Framing Type AVP of the OCRQ, OCCN and ICCN messages per RFC2661.
+	# Supported values are "sync" and "async".
+	# This parameter only applies to L2TPv2 sessions.
+	# By default both synchronous and asynchronous framing are reported.
+	framing_type = ["sync"]
+
+	# physical_channel_id specifies the physical channel ID of the call,
+	# which is sent in the Physical Channel ID AVP of the ICRQ message.
+	# By default no Physical Channel ID AVP is sent.
+	physical_channel_id = 17
+
+	# remote_end_id identifies the pseudowire to the peer, and is sent in
+	# the Remote End ID AVP of the ICRQ message per RFC3931.
+	# This parameter only applies to L2TPv3 sessions.
+	# By default an empty Remote End ID AVP is sent.
+	remote_end_id = "pw-0042"
+
+	# tx_connect_speed and rx_connect_speed specify the transmit and
+	# receive connect speeds of the call in bits per second, which are
+	# sent in the connect speed AVPs of the ICCN message.  By default
+	# an L2TPv2 ICCN message reports a connect speed of zero, and no
+	# other connect speed AVPs are sent.
+	tx_connect_speed = 56000
+	rx_connect_speed = 33600
 */
 package config
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/katalix/go-l2tp/l2tp"
 	"github.com/pelletier/go-toml"
 )
 
+// maxRetriesLimit bounds the number of control message retransmits.
+// The reliable transport uses an exponential backoff between retries,
+// so large values lead to very long delays before tunnel failure is detected.
+const maxRetriesLimit = 10
+
 // Config contains L2TP configuration for tunnel and session instances.
 type Config struct {
 	// The entire tree as a map as parsed from the TOML representation.
-	// Apps may access this tree to handle their own config tables.
+	// Apps may access this tree to handle their own config tables,
+	// e.g. using Get and the As* conversion functions.
 	Map map[string]interface{}
 	// All the tunnels defined in the configuration.
 	Tunnels []NamedTunnel
@@ -283,11 +616,82 @@ func toString(v interface{}) (string, error) {
 	return "", fmt.Errorf("supplied value could not be parsed as a string")
 }
 
+// toSecretFile reads a secret from the file named by v.  Leading and
+// trailing whitespace, including the trailing newline most editors add,
+// is removed.  Errors name the file only, never its content.
+func toSecretFile(v interface{}) (string, error) {
+	path, err := toString(v)
+	if err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %v", err)
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", fmt.Errorf("secret file %v is empty", path)
+	}
+	return secret, nil
+}
+
+// toSecretEnv reads a secret from the environment variable named by v.
+func toSecretEnv(v interface{}) (string, error) {
+	name, err := toString(v)
+	if err != nil {
+		return "", err
+	}
+	secret, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %v is not set", name)
+	}
+	if secret == "" {
+		return "", fmt.Errorf("environment variable %v is empty", name)
+	}
+	return secret, nil
+}
+
+func toInterfaceName(v interface{}) (string, error) {
+	s, err := toString(v)
+	if err != nil {
+		return "", err
+	}
+	return s, l2tp.ValidateInterfaceName(s)
+}
+
+// toDurationMs accepts either an integer number of milliseconds, or a
+// duration string as parsed by time.ParseDuration.
 func toDurationMs(v interface{}) (time.Duration, error) {
+	if s, ok := v.(string); ok {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+		if d < 0 {
+			return 0, fmt.Errorf("duration %v must not be negative", s)
+		}
+		return d, nil
+	}
 	u, err := toUint32(v)
 	return time.Duration(u) * time.Millisecond, err
 }
 
+func toWindowSize(v interface{}) (uint16, error) {
+	u, err := toUint16(v)
+	if err == nil && u < 1 {
+		return 0, fmt.Errorf("window size must be at least 1")
+	}
+	return u, err
+}
+
+func toMaxRetries(v interface{}) (uint, error) {
+	u, err := toUint16(v)
+	if err == nil && u > maxRetriesLimit {
+		return 0, fmt.Errorf("value %v out of range: maximum is %v", u, maxRetriesLimit)
+	}
+	return uint(u), err
+}
+
 func toVersion(v interface{}) (l2tp.ProtocolVersion, error) {
 	s, err := toString(v)
 	if err == nil {
@@ -330,6 +734,89 @@ func toFramingCaps(v interface{}) (l2tp.FramingCapability, error) {
 	return fc, nil
 }
 
+func toBearerCaps(v interface{}) (l2tp.BearerCapability, error) {
+	var bc l2tp.BearerCapability
+
+	// First ensure that the supplied value is actually an array
+	caps, ok := v.([]interface{})
+	if !ok {
+		return 0, fmt.Errorf("expected array value")
+	}
+
+	for _, c := range caps {
+		cs, err := toString(c)
+		if err != nil {
+			return 0, err
+		}
+		switch cs {
+		case "digital":
+			bc |= l2tp.BearerCapDigital
+		case "analog":
+			bc |= l2tp.BearerCapAnalog
+		default:
+			return 0, fmt.Errorf("expect 'digital' or 'analog'")
+		}
+	}
+	return bc, nil
+}
+
+func toDebugFlags(v interface{}) (l2tp.DebugFlags, error) {
+	var df l2tp.DebugFlags
+
+	// First ensure that the supplied value is actually an array
+	flags, ok := v.([]interface{})
+	if !ok {
+		return 0, fmt.Errorf("expected array value")
+	}
+
+	for _, f := range flags {
+		fs, err := toString(f)
+		if err != nil {
+			return 0, err
+		}
+		switch fs {
+		case "control":
+			df |= l2tp.DebugFlagsControl
+		case "data":
+			df |= l2tp.DebugFlagsData
+		case "seq":
+			df |= l2tp.DebugFlagsSeq
+		case "state":
+			df |= l2tp.DebugFlagsDebug
+		default:
+			return 0, fmt.Errorf("expect 'control', 'data', 'seq', or 'state'")
+		}
+	}
+	return df, nil
+}
+
+func toUDPChecksum(v interface{}) (l2tp.UDPChecksumMode, error) {
+	b, err := toBool(v)
+	if err != nil {
+		return l2tp.UDPChecksumDefault, err
+	}
+	if b {
+		return l2tp.UDPChecksumEnabled, nil
+	}
+	return l2tp.UDPChecksumDisabled, nil
+}
+
+func toPMTUDiscMode(v interface{}) (l2tp.PMTUDiscMode, error) {
+	s, err := toString(v)
+	if err == nil {
+		switch s {
+		case "dont":
+			return l2tp.PMTUDiscDont, nil
+		case "want":
+			return l2tp.PMTUDiscWant, nil
+		case "do":
+			return l2tp.PMTUDiscDo, nil
+		}
+		return 0, fmt.Errorf("expect 'dont', 'want', or 'do'")
+	}
+	return l2tp.PMTUDiscDefault, err
+}
+
 func toEncapType(v interface{}) (l2tp.EncapType, error) {
 	s, err := toString(v)
 	if err == nil {
@@ -344,6 +831,22 @@ func toEncapType(v interface{}) (l2tp.EncapType, error) {
 	return 0, err
 }
 
+func toAddressFamily(v interface{}) (l2tp.AddressFamily, error) {
+	s, err := toString(v)
+	if err == nil {
+		switch s {
+		case "any":
+			return l2tp.AddressFamilyAny, nil
+		case "ip4":
+			return l2tp.AddressFamilyIPv4, nil
+		case "ip6":
+			return l2tp.AddressFamilyIPv6, nil
+		}
+		return 0, fmt.Errorf("expect 'ip4', 'ip6' or 'any'")
+	}
+	return 0, err
+}
+
 func toPseudowireType(v interface{}) (l2tp.PseudowireType, error) {
 	s, err := toString(v)
 	if err == nil {
@@ -374,6 +877,20 @@ func toL2SpecType(v interface{}) (l2tp.L2SpecType, error) {
 	return l2tp.L2SpecTypeNone, err
 }
 
+func toCallDirection(v interface{}) (l2tp.CallDirection, error) {
+	s, err := toString(v)
+	if err == nil {
+		switch s {
+		case "incoming":
+			return l2tp.CallDirectionIncoming, nil
+		case "outgoing":
+			return l2tp.CallDirectionOutgoing, nil
+		}
+		return 0, fmt.Errorf("expect 'incoming' or 'outgoing'")
+	}
+	return l2tp.CallDirectionIncoming, err
+}
+
 func toCCID(v interface{}) (l2tp.ControlConnID, error) {
 	u, err := toUint32(v)
 	return l2tp.ControlConnID(u), err
@@ -400,6 +917,79 @@ func toBytes(v interface{}) ([]byte, error) {
 	return out, nil
 }
 
+// RFC3931 section 4.1 permits cookies of either 4 or 8 bytes.
+func toCookie(v interface{}) ([]byte, error) {
+	cookie, err := toBytes(v)
+	if err != nil {
+		return nil, err
+	}
+	switch len(cookie) {
+	case 0, 4, 8:
+		return cookie, nil
+	}
+	return nil, fmt.Errorf("cookie length %v invalid: must be 0, 4, or 8 bytes", len(cookie))
+}
+
+// AsBool converts a value from the Config Map to a bool.
+func AsBool(v interface{}) (bool, error) {
+	return toBool(v)
+}
+
+// AsUint16 converts a value from the Config Map to a uint16,
+// checking that the value is within range.
+func AsUint16(v interface{}) (uint16, error) {
+	return toUint16(v)
+}
+
+// AsUint32 converts a value from the Config Map to a uint32,
+// checking that the value is within range.
+func AsUint32(v interface{}) (uint32, error) {
+	return toUint32(v)
+}
+
+// AsString converts a value from the Config Map to a string.
+func AsString(v interface{}) (string, error) {
+	return toString(v)
+}
+
+// AsBytes converts a TOML array of numbers from the Config Map
+// to a byte slice, checking that each number is within range.
+func AsBytes(v interface{}) ([]byte, error) {
+	return toBytes(v)
+}
+
+// AsDuration converts a value from the Config Map specifying either a
+// number of milliseconds, or a duration string as accepted by
+// time.ParseDuration, to a time.Duration.
+func AsDuration(v interface{}) (time.Duration, error) {
+	return toDurationMs(v)
+}
+
+// Get looks up a value in the Config Map by its dotted path,
+// e.g. "myapp.listen.port" for the port key in the TOML table
+// [myapp.listen].
+//
+// The value returned may be converted using the As* functions.
+// Keys which themselves contain dots cannot be looked up using Get.
+func (cfg *Config) Get(path string) (interface{}, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty config path")
+	}
+	var v interface{} = cfg.Map
+	keys := strings.Split(path, ".")
+	for i, key := range keys {
+		table, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v is not a table", strings.Join(keys[:i], "."))
+		}
+		v, ok = table[key]
+		if !ok {
+			return nil, fmt.Errorf("%v not found", strings.Join(keys[:i+1], "."))
+		}
+	}
+	return v, nil
+}
+
 func (cfg *Config) newSessionConfig(tunnel *NamedTunnel, name string, scfg map[string]interface{}) (*NamedSession, error) {
 	ns := &NamedSession{
 		Name:   name,
@@ -419,15 +1009,55 @@ func (cfg *Config) newSessionConfig(tunnel *NamedTunnel, name string, scfg map[s
 		case "reorder_timeout":
 			ns.Config.ReorderTimeout, err = toDurationMs(v)
 		case "cookie":
-			ns.Config.Cookie, err = toBytes(v)
+			ns.Config.Cookie, err = toCookie(v)
 		case "peer_cookie":
-			ns.Config.PeerCookie, err = toBytes(v)
+			ns.Config.PeerCookie, err = toCookie(v)
+		case "cookie_check_interval":
+			ns.Config.CookieCheckInterval, err = toDurationMs(v)
 		case "interface_name":
-			ns.Config.InterfaceName, err = toString(v)
+			ns.Config.InterfaceName, err = toInterfaceName(v)
+		case "mtu":
+			var mtu uint16
+			mtu, err = toUint16(v)
+			ns.Config.MTU = int(mtu)
+		case "bridge":
+			ns.Config.Bridge, err = toString(v)
+		case "admin_up":
+			ns.Config.AdminUp, err = toBool(v)
+		case "address":
+			ns.Config.Address, err = toString(v)
+		case "peer_address":
+			ns.Config.PeerAddress, err = toString(v)
+		case "drain_timeout":
+			ns.Config.DrainTimeout, err = toDurationMs(v)
 		case "l2spec_type":
 			ns.Config.L2SpecType, err = toL2SpecType(v)
+		case "debug":
+			ns.Config.DebugFlags, err = toDebugFlags(v)
 		case "pppoe_session_id":
 			ns.Config.PPPoESessionId, err = toUint16(v)
+		case "call_direction":
+			ns.Config.CallDirection, err = toCallDirection(v)
+		case "called_number":
+			ns.Config.CalledNumber, err = toString(v)
+		case "bearer_type":
+			ns.Config.BearerType, err = toBearerCaps(v)
+		case "minimum_bps":
+			ns.Config.MinimumBPS, err = toUint32(v)
+		case "maximum_bps":
+			ns.Config.MaximumBPS, err = toUint32(v)
+		case "framing_type":
+			ns.Config.FramingType, err = toFramingCaps(v)
+		case "physical_channel_id":
+			ns.Config.PhysicalChannelID, err = toUint32(v)
+		case "remote_end_id":
+			var id string
+			id, err = toString(v)
+			ns.Config.RemoteEndID = []byte(id)
+		case "tx_connect_speed":
+			ns.Config.TxConnectSpeed, err = toUint32(v)
+		case "rx_connect_speed":
+			ns.Config.RxConnectSpeed, err = toUint32(v)
 		case "pppoe_peer_mac":
 			mac, err := toBytes(v)
 			if err == nil {
@@ -447,7 +1077,37 @@ func (cfg *Config) newSessionConfig(tunnel *NamedTunnel, name string, scfg map[s
 	return ns, nil
 }
 
-func (cfg *Config) loadSessions(tunnel *NamedTunnel, v interface{}) ([]NamedSession, error) {
+// sessionTemplateUniqueKeys lists session parameters which identify a
+// session, and so cannot be shared by sessions using a template.
+var sessionTemplateUniqueKeys = []string{"sid", "psid", "interface_name"}
+
+func toSessionTemplate(v interface{}) (map[string]interface{}, error) {
+	template, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("session template must be a table, e.g. '[tunnel.mytunnel.session_template]'")
+	}
+	for _, k := range sessionTemplateUniqueKeys {
+		if _, ok := template[k]; ok {
+			return nil, fmt.Errorf("%v must be unique to each session and cannot be templated", k)
+		}
+	}
+	return template, nil
+}
+
+// mergeSessionTemplate returns the session parameters in smap laid over
+// the defaults in template.
+func mergeSessionTemplate(template, smap map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(template)+len(smap))
+	for k, v := range template {
+		merged[k] = v
+	}
+	for k, v := range smap {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (cfg *Config) loadSessions(tunnel *NamedTunnel, template map[string]interface{}, v interface{}) ([]NamedSession, error) {
 	var out []NamedSession
 	sessions, ok := v.(map[string]interface{})
 	if !ok {
@@ -458,6 +1118,9 @@ func (cfg *Config) loadSessions(tunnel *NamedTunnel, v interface{}) ([]NamedSess
 		if !ok {
 			return nil, fmt.Errorf("session instances must be named, e.g. '[tunnel.mytunnel.session.mysession]'")
 		}
+		if template != nil {
+			smap = mergeSessionTemplate(template, smap)
+		}
 		scfg, err := cfg.newSessionConfig(tunnel, name, smap)
 		if err != nil {
 			return nil, fmt.Errorf("session %v: %v", name, err)
@@ -474,37 +1137,105 @@ func (cfg *Config) newTunnelConfig(name string, tcfg map[string]interface{}) (*N
 			FramingCaps: l2tp.FramingCapSync | l2tp.FramingCapAsync,
 		},
 	}
+	var sessions interface{}
+	var template map[string]interface{}
+	var secretKeys []string
 	for k, v := range tcfg {
 		var err error
 		switch k {
 		case "local":
 			nt.Config.Local, err = toString(v)
+		case "local_port":
+			nt.Config.LocalPort, err = toUint16(v)
+		case "preferred_source":
+			nt.Config.PreferredSource, err = toString(v)
 		case "peer":
 			nt.Config.Peer, err = toString(v)
 		case "encap":
 			nt.Config.Encap, err = toEncapType(v)
+		case "address_family":
+			nt.Config.AddressFamily, err = toAddressFamily(v)
 		case "version":
 			nt.Config.Version, err = toVersion(v)
 		case "tid":
 			nt.Config.TunnelID, err = toCCID(v)
 		case "ptid":
 			nt.Config.PeerTunnelID, err = toCCID(v)
-		case "window_size":
-			nt.Config.WindowSize, err = toUint16(v)
+		case "window_size", "tx_window_size":
+			nt.Config.WindowSize, err = toWindowSize(v)
+		case "stop_and_wait":
+			nt.Config.StopAndWait, err = toBool(v)
 		case "hello_timeout":
 			nt.Config.HelloTimeout, err = toDurationMs(v)
+		case "control_read_timeout":
+			nt.Config.ControlReadTimeout, err = toDurationMs(v)
+		case "control_write_timeout":
+			nt.Config.ControlWriteTimeout, err = toDurationMs(v)
+		case "establish_timeout":
+			nt.Config.EstablishTimeout, err = toDurationMs(v)
+		case "persist":
+			nt.Config.Persist, err = toBool(v)
+		case "reconnect_min":
+			nt.Config.ReconnectMin, err = toDurationMs(v)
+		case "reconnect_max":
+			nt.Config.ReconnectMax, err = toDurationMs(v)
+		case "resolve_interval":
+			nt.Config.ResolveInterval, err = toDurationMs(v)
 		case "retry_timeout":
 			nt.Config.RetryTimeout, err = toDurationMs(v)
-		case "max_retries":
-			if u, err := toUint16(v); err == nil {
-				nt.Config.MaxRetries = uint(u)
-			}
+		case "ack_timeout":
+			nt.Config.AckTimeout, err = toDurationMs(v)
+		case "max_retries", "max_retransmit":
+			nt.Config.MaxRetries, err = toMaxRetries(v)
 		case "host_name":
 			nt.Config.HostName, err = toString(v)
+		case "router_id":
+			nt.Config.RouterID, err = toUint32(v)
 		case "framing_caps":
 			nt.Config.FramingCaps, err = toFramingCaps(v)
+		case "bearer_caps":
+			nt.Config.BearerCaps, err = toBearerCaps(v)
+		case "debug":
+			nt.Config.DebugFlags, err = toDebugFlags(v)
+		case "secret":
+			nt.Config.Secret, err = toString(v)
+			secretKeys = append(secretKeys, k)
+		case "secret_file":
+			nt.Config.Secret, err = toSecretFile(v)
+			secretKeys = append(secretKeys, k)
+		case "secret_env":
+			nt.Config.Secret, err = toSecretEnv(v)
+			secretKeys = append(secretKeys, k)
+		case "udp_checksum":
+			nt.Config.UDPChecksum, err = toUDPChecksum(v)
+		case "pmtudisc":
+			nt.Config.PMTUDisc, err = toPMTUDiscMode(v)
+		case "device":
+			nt.Config.Device, err = toString(v)
+		case "device_index":
+			var index uint32
+			index, err = toUint32(v)
+			nt.Config.DeviceIndex = int(index)
+		case "ipv6_flowlabel":
+			nt.Config.IPv6FlowLabel, err = toUint32(v)
+		case "reuse_port":
+			nt.Config.ReusePort, err = toBool(v)
+		case "socket_priority":
+			var prio uint32
+			prio, err = toUint32(v)
+			nt.Config.SocketPriority = int(prio)
+		case "capture_file":
+			nt.Config.CaptureFile, err = toString(v)
+		case "max_sessions":
+			var max uint32
+			max, err = toUint32(v)
+			nt.Config.MaxSessions = int(max)
 		case "session":
-			nt.Sessions, err = cfg.loadSessions(nt, v)
+			// Sessions are loaded once the session template, which
+			// may appear in any order, is known.
+			sessions = v
+		case "session_template":
+			template, err = toSessionTemplate(v)
 		default:
 			err = cfg.customParser.ParseTunnelParameter(nt, k, v)
 		}
@@ -512,6 +1243,45 @@ func (cfg *Config) newTunnelConfig(name string, tcfg map[string]interface{}) (*N
 			return nil, fmt.Errorf("failed to process %v: %v", k, err)
 		}
 	}
+
+	if sessions != nil {
+		var err error
+		nt.Sessions, err = cfg.loadSessions(nt, template, sessions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process session: %v", err)
+		}
+	}
+
+	// The secret may be specified inline or by reference, but not both.
+	if len(secretKeys) > 1 {
+		sort.Strings(secretKeys)
+		return nil, fmt.Errorf("only one of %v may be specified", strings.Join(secretKeys, ", "))
+	}
+
+	// AVP hiding is currently implemented for L2TPv2 only.
+	if nt.Config.Secret != "" && nt.Config.Version != l2tp.ProtocolVersion2 {
+		return nil, fmt.Errorf("secret is only supported for L2TPv2 tunnels")
+	}
+
+	// Cookies are an L2TPv3 feature.  Since TOML keys are processed in
+	// no particular order, this can only be checked once the whole tunnel
+	// table has been parsed.
+	if nt.Config.Version != l2tp.ProtocolVersion3 {
+		for _, ns := range nt.Sessions {
+			if len(ns.Config.Cookie) > 0 || len(ns.Config.PeerCookie) > 0 {
+				return nil, fmt.Errorf("session %v: cookies are only supported for L2TPv3 sessions", ns.Name)
+			}
+		}
+	}
+
+	// Outgoing calls are an L2TPv2 feature.
+	if nt.Config.Version != l2tp.ProtocolVersion2 {
+		for _, ns := range nt.Sessions {
+			if ns.Config.CallDirection != l2tp.CallDirectionIncoming {
+				return nil, fmt.Errorf("session %v: outgoing calls are only supported for L2TPv2 sessions", ns.Name)
+			}
+		}
+	}
 	return nt, nil
 }
 
@@ -561,20 +1331,89 @@ func newConfig(tree *toml.Tree, customParser ConfigParser) (*Config, error) {
 	return cfg, nil
 }
 
+func newConfigFromReader(r io.Reader, customParser ConfigParser) (*Config, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	tree, err := toml.LoadBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config: %v", err)
+	}
+	return newConfig(tree, customParser)
+}
+
 func newConfigFromFile(path string, customParser ConfigParser) (*Config, error) {
-	tree, err := toml.LoadFile(path)
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load config file: %v", err)
 	}
-	return newConfig(tree, customParser)
+	defer file.Close()
+	return newConfigFromReader(file, customParser)
 }
 
 func newConfigFromString(content string, customParser ConfigParser) (*Config, error) {
-	tree, err := toml.Load(content)
+	return newConfigFromReader(strings.NewReader(content), customParser)
+}
+
+func newConfigFromDirectory(path string, customParser ConfigParser) (*Config, error) {
+	files, err := filepath.Glob(filepath.Join(path, "*.toml"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to load config string: %v", err)
+		return nil, fmt.Errorf("failed to list config directory: %v", err)
 	}
-	return newConfig(tree, customParser)
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no configuration files found in %v", path)
+	}
+
+	merged := &Config{
+		Map:          make(map[string]interface{}),
+		customParser: customParser,
+	}
+	tunnelFiles := make(map[string]string)
+	mergedTunnels := make(map[string]interface{})
+
+	// filepath.Glob returns files in lexical order, which defines
+	// the precedence of non-tunnel keys across files.
+	for _, file := range files {
+		cfg, err := newConfigFromFile(file, customParser)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", file, err)
+		}
+		for _, t := range cfg.Tunnels {
+			if prev, ok := tunnelFiles[t.Name]; ok {
+				return nil, fmt.Errorf("%v: tunnel %v already defined in %v", file, t.Name, prev)
+			}
+			tunnelFiles[t.Name] = file
+		}
+		merged.Tunnels = append(merged.Tunnels, cfg.Tunnels...)
+		for k, v := range cfg.Map {
+			if k == "tunnel" {
+				for name, tmap := range v.(map[string]interface{}) {
+					mergedTunnels[name] = tmap
+				}
+			} else {
+				merged.Map[k] = v
+			}
+		}
+	}
+
+	if len(mergedTunnels) > 0 {
+		merged.Map["tunnel"] = mergedTunnels
+	}
+
+	return merged, nil
+}
+
+// Load loads configuration from the specified reader, which is read
+// until EOF.
+func Load(r io.Reader) (*Config, error) {
+	return newConfigFromReader(r, &nilCustomParser{})
+}
+
+// LoadWithCustomParser loads configuration from the specified reader,
+// calling the ConfigParser interface for unrecognised key/value pairs.
+func LoadWithCustomParser(r io.Reader, customParser ConfigParser) (*Config, error) {
+	return newConfigFromReader(r, customParser)
 }
 
 // LoadFile loads configuration from the specified file.
@@ -598,3 +1437,24 @@ func LoadFileWithCustomParser(path string, customParser ConfigParser) (*Config,
 func LoadStringWithCustomParser(content string, customParser ConfigParser) (*Config, error) {
 	return newConfigFromString(content, customParser)
 }
+
+// LoadDirectory loads configuration from all the files in the specified
+// directory with a ".toml" extension.
+//
+// Files are parsed in lexical order of their names.  Tunnel tables from
+// all files are merged: it is an error for the same tunnel name to be
+// defined in more than one file.  Other top-level keys in the Config Map
+// are also merged, with keys from later files overriding those from
+// earlier files.
+func LoadDirectory(path string) (*Config, error) {
+	return newConfigFromDirectory(path, &nilCustomParser{})
+}
+
+// LoadDirectoryWithCustomParser loads configuration from all the files in
+// the specified directory with a ".toml" extension, calling the ConfigParser
+// interface for unrecognised key/value pairs.
+//
+// Files are merged as described for LoadDirectory.
+func LoadDirectoryWithCustomParser(path string, customParser ConfigParser) (*Config, error) {
+	return newConfigFromDirectory(path, customParser)
+}
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -19,11 +23,16 @@ func TestGetTunnels(t *testing.T) {
 			in: `[tunnel.t1]
 				 encap = "ip"
 				 version = "l2tpv3"
-				 peer = "82.9.90.101:1701"
+				 peer = "82.9.90.101"
 				 tid = 412
 				 ptid = 8192
 				 framing_caps = ["sync"]
 				 host_name = "blackhole.local"
+				 router_id = 0xc0000201
+				 udp_checksum = true
+				 device = "eth0"
+				 pmtudisc = "do"
+				 preferred_source = "192.0.2.7"
 
 				 [tunnel.t2]
 				 encap = "udp"
@@ -34,31 +43,68 @@ func TestGetTunnels(t *testing.T) {
 				 retry_timeout = 250
 				 max_retries = 2
 				 framing_caps = ["sync","async"]
+				 bearer_caps = ["analog"]
+				 secret = "sesame"
+				 udp_checksum = false
+				 capture_file = "/tmp/t2.pcap"
+				 local = "192.0.2.1"
+				 local_port = 1702
+				 ipv6_flowlabel = 0x12345
+				 reuse_port = true
+				 socket_priority = 0x10001
+				 device_index = 2
+				 establish_timeout = 5000
+				 persist = true
+				 reconnect_min = 500
+				 reconnect_max = 30000
+				 resolve_interval = 60000
+				 max_sessions = 16
 				 `,
 			want: []NamedTunnel{
 				{
 					Name: "t1",
 					Config: &l2tp.TunnelConfig{
-						Encap:        l2tp.EncapTypeIP,
-						Version:      l2tp.ProtocolVersion3,
-						Peer:         "82.9.90.101:1701",
-						TunnelID:     412,
-						PeerTunnelID: 8192,
-						FramingCaps:  l2tp.FramingCapSync,
-						HostName:     "blackhole.local",
+						Encap:           l2tp.EncapTypeIP,
+						Version:         l2tp.ProtocolVersion3,
+						Peer:            "82.9.90.101",
+						TunnelID:        412,
+						PeerTunnelID:    8192,
+						FramingCaps:     l2tp.FramingCapSync,
+						HostName:        "blackhole.local",
+						RouterID:        0xc0000201,
+						UDPChecksum:     l2tp.UDPChecksumEnabled,
+						Device:          "eth0",
+						PMTUDisc:        l2tp.PMTUDiscDo,
+						PreferredSource: "192.0.2.7",
 					},
 				},
 				{
 					Name: "t2",
 					Config: &l2tp.TunnelConfig{
-						Encap:        l2tp.EncapTypeUDP,
-						Version:      l2tp.ProtocolVersion2,
-						Peer:         "[2001:0000:1234:0000:0000:C1C0:ABCD:0876]:6543",
-						HelloTimeout: 250 * time.Millisecond,
-						WindowSize:   10,
-						RetryTimeout: 250 * time.Millisecond,
-						MaxRetries:   2,
-						FramingCaps:  l2tp.FramingCapSync | l2tp.FramingCapAsync,
+						Encap:            l2tp.EncapTypeUDP,
+						Version:          l2tp.ProtocolVersion2,
+						Peer:             "[2001:0000:1234:0000:0000:C1C0:ABCD:0876]:6543",
+						HelloTimeout:     250 * time.Millisecond,
+						WindowSize:       10,
+						RetryTimeout:     250 * time.Millisecond,
+						MaxRetries:       2,
+						FramingCaps:      l2tp.FramingCapSync | l2tp.FramingCapAsync,
+						BearerCaps:       l2tp.BearerCapAnalog,
+						Secret:           "sesame",
+						UDPChecksum:      l2tp.UDPChecksumDisabled,
+						CaptureFile:      "/tmp/t2.pcap",
+						Local:            "192.0.2.1",
+						LocalPort:        1702,
+						IPv6FlowLabel:    0x12345,
+						ReusePort:        true,
+						SocketPriority:   0x10001,
+						DeviceIndex:      2,
+						EstablishTimeout: 5 * time.Second,
+						Persist:          true,
+						ReconnectMin:     500 * time.Millisecond,
+						ReconnectMax:     30 * time.Second,
+						ResolveInterval:  time.Minute,
+						MaxSessions:      16,
 					},
 				},
 			},
@@ -67,15 +113,23 @@ func TestGetTunnels(t *testing.T) {
 			in: `[tunnel.t1]
 				 encap = "ip"
 				 version = "l2tpv3"
-				 peer = "127.0.0.1:5001"
+				 peer = "127.0.0.1"
 
 				 [tunnel.t1.session.s1]
 				 pseudowire = "eth"
 				 cookie = [ 0x34, 0x04, 0xa9, 0xbe ]
 				 peer_cookie = [ 0x80, 0x12, 0xff, 0x5b ]
+				 cookie_check_interval = 5000
 				 seqnum = true
 				 reorder_timeout = 1500
 				 l2spec_type = "none"
+				 mtu = 1400
+				 bridge = "br0"
+				 admin_up = true
+				 address = "192.0.2.1/32"
+				 peer_address = "192.0.2.2"
+				 drain_timeout = 250
+				 remote_end_id = "pw-0042"
 
 				 [tunnel.t1.session.s2]
 				 pseudowire = "ppp"
@@ -95,19 +149,27 @@ func TestGetTunnels(t *testing.T) {
 					Config: &l2tp.TunnelConfig{
 						Encap:       l2tp.EncapTypeIP,
 						Version:     l2tp.ProtocolVersion3,
-						Peer:        "127.0.0.1:5001",
+						Peer:        "127.0.0.1",
 						FramingCaps: l2tp.FramingCapSync | l2tp.FramingCapAsync,
 					},
 					Sessions: []NamedSession{
 						{
 							Name: "s1",
 							Config: &l2tp.SessionConfig{
-								Pseudowire:     l2tp.PseudowireTypeEth,
-								Cookie:         []byte{0x34, 0x04, 0xa9, 0xbe},
-								PeerCookie:     []byte{0x80, 0x12, 0xff, 0x5b},
-								SeqNum:         true,
-								ReorderTimeout: time.Millisecond * 1500,
-								L2SpecType:     l2tp.L2SpecTypeNone,
+								Pseudowire:          l2tp.PseudowireTypeEth,
+								Cookie:              []byte{0x34, 0x04, 0xa9, 0xbe},
+								PeerCookie:          []byte{0x80, 0x12, 0xff, 0x5b},
+								CookieCheckInterval: 5 * time.Second,
+								SeqNum:              true,
+								ReorderTimeout:      time.Millisecond * 1500,
+								L2SpecType:          l2tp.L2SpecTypeNone,
+								MTU:                 1400,
+								Bridge:              "br0",
+								AdminUp:             true,
+								Address:             "192.0.2.1/32",
+								PeerAddress:         "192.0.2.2",
+								DrainTimeout:        250 * time.Millisecond,
+								RemoteEndID:         []byte("pw-0042"),
 							},
 						},
 						{
@@ -132,6 +194,62 @@ func TestGetTunnels(t *testing.T) {
 				},
 			},
 		},
+		{
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 peer = "127.0.0.1:1701"
+
+				 [tunnel.t1.session.s1]
+				 pseudowire = "ppp"
+				 call_direction = "incoming"
+
+				 [tunnel.t1.session.s2]
+				 pseudowire = "ppp"
+				 call_direction = "outgoing"
+				 called_number = "5551234"
+				 bearer_type = ["digital"]
+				 minimum_bps = 9600
+				 maximum_bps = 64000
+				 framing_type = ["sync"]
+				 physical_channel_id = 17
+				 tx_connect_speed = 56000
+				 rx_connect_speed = 33600
+				`,
+			want: []NamedTunnel{
+				{
+					Name: "t1",
+					Config: &l2tp.TunnelConfig{
+						Version:     l2tp.ProtocolVersion2,
+						Peer:        "127.0.0.1:1701",
+						FramingCaps: l2tp.FramingCapSync | l2tp.FramingCapAsync,
+					},
+					Sessions: []NamedSession{
+						{
+							Name: "s1",
+							Config: &l2tp.SessionConfig{
+								Pseudowire:    l2tp.PseudowireTypePPP,
+								CallDirection: l2tp.CallDirectionIncoming,
+							},
+						},
+						{
+							Name: "s2",
+							Config: &l2tp.SessionConfig{
+								Pseudowire:        l2tp.PseudowireTypePPP,
+								CallDirection:     l2tp.CallDirectionOutgoing,
+								CalledNumber:      "5551234",
+								BearerType:        l2tp.BearerCapDigital,
+								MinimumBPS:        9600,
+								MaximumBPS:        64000,
+								FramingType:       l2tp.FramingCapSync,
+								PhysicalChannelID: 17,
+								TxConnectSpeed:    56000,
+								RxConnectSpeed:    33600,
+							},
+						},
+					},
+				},
+			},
+		},
 	}
 	for _, c := range cases {
 		cfg, err := LoadString(c.in)
@@ -156,6 +274,210 @@ func TestGetTunnels(t *testing.T) {
 	}
 }
 
+func TestTransportConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want l2tp.TunnelConfig
+	}{
+		{
+			name: "defaults",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"`,
+			want: l2tp.TunnelConfig{
+				Version:     l2tp.ProtocolVersion2,
+				FramingCaps: l2tp.FramingCapSync | l2tp.FramingCapAsync,
+			},
+		},
+		{
+			name: "all set",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 tx_window_size = 1
+				 stop_and_wait = true
+				 ack_timeout = 350
+				 max_retransmit = 10`,
+			want: l2tp.TunnelConfig{
+				Version:     l2tp.ProtocolVersion2,
+				FramingCaps: l2tp.FramingCapSync | l2tp.FramingCapAsync,
+				WindowSize:  1,
+				StopAndWait: true,
+				AckTimeout:  350 * time.Millisecond,
+				MaxRetries:  10,
+			},
+		},
+		{
+			name: "max_retries",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 max_retries = 7`,
+			want: l2tp.TunnelConfig{
+				Version:     l2tp.ProtocolVersion2,
+				FramingCaps: l2tp.FramingCapSync | l2tp.FramingCapAsync,
+				MaxRetries:  7,
+			},
+		},
+		{
+			name: "control_timeouts",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 hello_timeout = 10000
+				 control_read_timeout = 30000
+				 control_write_timeout = 500`,
+			want: l2tp.TunnelConfig{
+				Version:             l2tp.ProtocolVersion2,
+				FramingCaps:         l2tp.FramingCapSync | l2tp.FramingCapAsync,
+				HelloTimeout:        10 * time.Second,
+				ControlReadTimeout:  30 * time.Second,
+				ControlWriteTimeout: 500 * time.Millisecond,
+			},
+		},
+		{
+			name: "address_family",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 address_family = "ip6"`,
+			want: l2tp.TunnelConfig{
+				Version:       l2tp.ProtocolVersion2,
+				FramingCaps:   l2tp.FramingCapSync | l2tp.FramingCapAsync,
+				AddressFamily: l2tp.AddressFamilyIPv6,
+			},
+		},
+		{
+			name: "duration strings",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 hello_timeout = "5s"
+				 ack_timeout = "200ms"
+				 retry_timeout = 200`,
+			want: l2tp.TunnelConfig{
+				Version:      l2tp.ProtocolVersion2,
+				FramingCaps:  l2tp.FramingCapSync | l2tp.FramingCapAsync,
+				HelloTimeout: 5 * time.Second,
+				AckTimeout:   200 * time.Millisecond,
+				RetryTimeout: 200 * time.Millisecond,
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := LoadString(c.in)
+			if err != nil {
+				t.Fatalf("LoadString(%v): %v", c.in, err)
+			}
+			got, err := cfg.findTunnelByName("t1")
+			if err != nil {
+				t.Fatalf("missing tunnel: %v", err)
+			}
+			if !reflect.DeepEqual(*got.Config, c.want) {
+				t.Errorf("got %v, want %v", *got.Config, c.want)
+			}
+		})
+	}
+}
+
+func TestCookies(t *testing.T) {
+	cases := []struct {
+		name               string
+		cookie, peerCookie []byte
+		in                 string
+	}{
+		{
+			name: "none",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 [tunnel.t1.session.s1]
+				 cookie = []`,
+			cookie: []byte{},
+		},
+		{
+			name: "4 byte",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 [tunnel.t1.session.s1]
+				 cookie = [ 0x34, 0x04, 0xa9, 0xbe ]
+				 peer_cookie = [ 0x80, 0x12, 0xff, 0x5b ]`,
+			cookie:     []byte{0x34, 0x04, 0xa9, 0xbe},
+			peerCookie: []byte{0x80, 0x12, 0xff, 0x5b},
+		},
+		{
+			name: "8 byte",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 [tunnel.t1.session.s1]
+				 cookie = [ 0x12, 0xe9, 0x54, 0x0f, 0xe2, 0x68, 0x72, 0xbc ]
+				 peer_cookie = [ 0x74, 0x2e, 0x28, 0xa8, 0x00, 0x01, 0x02, 0x03 ]`,
+			cookie:     []byte{0x12, 0xe9, 0x54, 0x0f, 0xe2, 0x68, 0x72, 0xbc},
+			peerCookie: []byte{0x74, 0x2e, 0x28, 0xa8, 0x00, 0x01, 0x02, 0x03},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := LoadString(c.in)
+			if err != nil {
+				t.Fatalf("LoadString(%v): %v", c.in, err)
+			}
+			tunl, err := cfg.findTunnelByName("t1")
+			if err != nil {
+				t.Fatalf("missing tunnel: %v", err)
+			}
+			sess, err := tunl.findSessionByName("s1")
+			if err != nil {
+				t.Fatalf("missing session: %v", err)
+			}
+			if !reflect.DeepEqual(sess.Config.Cookie, c.cookie) {
+				t.Errorf("cookie: got %v, want %v", sess.Config.Cookie, c.cookie)
+			}
+			if !reflect.DeepEqual(sess.Config.PeerCookie, c.peerCookie) {
+				t.Errorf("peer cookie: got %v, want %v", sess.Config.PeerCookie, c.peerCookie)
+			}
+		})
+	}
+}
+
+func TestDebugFlags(t *testing.T) {
+	cases := []struct {
+		flags string
+		want  l2tp.DebugFlags
+	}{
+		{flags: `[]`, want: 0},
+		{flags: `["control"]`, want: l2tp.DebugFlagsControl},
+		{flags: `["data"]`, want: l2tp.DebugFlagsData},
+		{flags: `["seq"]`, want: l2tp.DebugFlagsSeq},
+		{flags: `["state"]`, want: l2tp.DebugFlagsDebug},
+		{
+			flags: `["control", "data", "seq", "state"]`,
+			want:  l2tp.DebugFlagsControl | l2tp.DebugFlagsData | l2tp.DebugFlagsSeq | l2tp.DebugFlagsDebug,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.flags, func(t *testing.T) {
+			in := fmt.Sprintf(`[tunnel.t1]
+					   debug = %s
+					   [tunnel.t1.session.s1]
+					   debug = %s`, c.flags, c.flags)
+			cfg, err := LoadString(in)
+			if err != nil {
+				t.Fatalf("LoadString(%v): %v", in, err)
+			}
+			tunl, err := cfg.findTunnelByName("t1")
+			if err != nil {
+				t.Fatalf("missing tunnel: %v", err)
+			}
+			if tunl.Config.DebugFlags != c.want {
+				t.Errorf("tunnel debug flags: got %v, want %v", tunl.Config.DebugFlags, c.want)
+			}
+			sess, err := tunl.findSessionByName("s1")
+			if err != nil {
+				t.Fatalf("missing session: %v", err)
+			}
+			if sess.Config.DebugFlags != c.want {
+				t.Errorf("session debug flags: got %v, want %v", sess.Config.DebugFlags, c.want)
+			}
+		})
+	}
+}
+
 func (c *Config) findTunnelByName(name string) (*NamedTunnel, error) {
 	for _, t := range c.Tunnels {
 		if t.Name == name {
@@ -236,6 +558,12 @@ func TestBadConfig(t *testing.T) {
 				 framing_caps = [ "bizzle" ]`,
 			estr: "expect 'sync' or 'async'",
 		},
+		{
+			name: "Bad value (unrecognised BearerCap)",
+			in: `[tunnel.t1]
+				 bearer_caps = [ "carrier pigeon" ]`,
+			estr: "expect 'digital' or 'analog'",
+		},
 		{
 			name: "Bad value (range exceeded)",
 			in: `[tunnel.t1]
@@ -249,6 +577,134 @@ func TestBadConfig(t *testing.T) {
 				 cookie = [ 0x1e, 0xf0, 0x1fe, 0x24 ]`,
 			estr: "out of range",
 		},
+		{
+			name: "Bad value (local_port range exceeded)",
+			in: `[tunnel.t1]
+				 local_port = 65536`,
+			estr: "out of range",
+		},
+		{
+			name: "Bad value (tx_window_size zero)",
+			in: `[tunnel.t1]
+				 tx_window_size = 0`,
+			estr: "window size must be at least 1",
+		},
+		{
+			name: "Bad value (window_size zero)",
+			in: `[tunnel.t1]
+				 window_size = 0`,
+			estr: "window size must be at least 1",
+		},
+		{
+			name: "Bad value (max_retransmit range exceeded)",
+			in: `[tunnel.t1]
+				 max_retransmit = 11`,
+			estr: "out of range",
+		},
+		{
+			name: "Bad value (max_retries range exceeded)",
+			in: `[tunnel.t1]
+				 max_retries = 100`,
+			estr: "out of range",
+		},
+		{
+			name: "Bad value (ack_timeout negative)",
+			in: `[tunnel.t1]
+				 ack_timeout = -1`,
+			estr: "out of range",
+		},
+		{
+			name: "Bad value (address_family)",
+			in: `[tunnel.t1]
+				 address_family = "ipx"`,
+			estr: "expect 'ip4', 'ip6' or 'any'",
+		},
+		{
+			name: "Bad value (ack_timeout invalid duration string)",
+			in: `[tunnel.t1]
+				 ack_timeout = "5 seconds"`,
+			estr: "unknown unit",
+		},
+		{
+			name: "Bad value (reorder_timeout negative duration string)",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 [tunnel.t1.session.s1]
+				 reorder_timeout = "-200ms"`,
+			estr: "must not be negative",
+		},
+		{
+			name: "Bad value (cookie length)",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 [tunnel.t1.session.s1]
+				 cookie = [ 0x1e, 0xf0, 0x1f, 0x24, 0x99 ]`,
+			estr: "failed to process cookie: cookie length 5 invalid",
+		},
+		{
+			name: "Bad value (peer_cookie length)",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 [tunnel.t1.session.s1]
+				 peer_cookie = [ 0x1e, 0xf0 ]`,
+			estr: "failed to process peer_cookie: cookie length 2 invalid",
+		},
+		{
+			name: "Bad value (cookie for L2TPv2)",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 [tunnel.t1.session.s1]
+				 cookie = [ 0x1e, 0xf0, 0x1f, 0x24 ]`,
+			estr: "cookies are only supported for L2TPv3 sessions",
+		},
+		{
+			name: "Bad value (call_direction)",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 [tunnel.t1.session.s1]
+				 call_direction = "sideways"`,
+			estr: "failed to process call_direction: expect 'incoming' or 'outgoing'",
+		},
+		{
+			name: "Bad value (outgoing call for L2TPv3)",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 [tunnel.t1.session.s1]
+				 call_direction = "outgoing"`,
+			estr: "outgoing calls are only supported for L2TPv2 sessions",
+		},
+		{
+			name: "Bad type (udp_checksum)",
+			in: `[tunnel.t1]
+				 udp_checksum = "yes"`,
+			estr: "could not be parsed as a bool",
+		},
+		{
+			name: "Bad value (secret for L2TPv3 tunnel)",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 secret = "sesame"`,
+			estr: "secret is only supported for L2TPv2 tunnels",
+		},
+		{
+			name: "Bad value (unrecognised tunnel debug flag)",
+			in: `[tunnel.t1]
+				 debug = [ "control", "everything" ]`,
+			estr: "expect 'control', 'data', 'seq', or 'state'",
+		},
+		{
+			name: "Bad value (unrecognised session debug flag)",
+			in: `[tunnel.t1]
+				 [tunnel.t1.session.s1]
+				 debug = [ "verbose" ]`,
+			estr: "expect 'control', 'data', 'seq', or 'state'",
+		},
+		{
+			name: "Bad type (debug not array)",
+			in: `[tunnel.t1]
+				 debug = "control"`,
+			estr: "expected array value",
+		},
 		{
 			name: "Malformed (no tunnel name)",
 			in:   `[tunnel]`,
@@ -287,6 +743,52 @@ func TestBadConfig(t *testing.T) {
 				 whizz = 42`,
 			estr: "unrecognised parameter",
 		},
+		{
+			name: "Bad value (interface name too long)",
+			in: `[tunnel.t1]
+				 [tunnel.t1.session.s1]
+				 interface_name = "l2tpeth012345678"`,
+			estr: "is longer than 15 characters",
+		},
+		{
+			name: "Bad value (interface name invalid character)",
+			in: `[tunnel.t1]
+				 [tunnel.t1.session.s1]
+				 interface_name = "l2tp/eth0"`,
+			estr: "contains invalid character",
+		},
+		{
+			name: "Malformed (session template not a table)",
+			in: `[tunnel.t1]
+				 session_template = 42`,
+			estr: "session template must be a table",
+		},
+		{
+			name: "Bad value (session ID in session template)",
+			in: `[tunnel.t1]
+				 [tunnel.t1.session_template]
+				 sid = 42`,
+			estr: "cannot be templated",
+		},
+		{
+			name: "Bad value (session template cookie in L2TPv2 tunnel)",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 [tunnel.t1.session_template]
+				 cookie = [ 0x12, 0xe9, 0x54, 0x0f ]
+				 [tunnel.t1.session.s1]
+				 pseudowire = "ppp"`,
+			estr: "cookies are only supported for L2TPv3 sessions",
+		},
+		{
+			name: "Bad value (session override fails per-session check)",
+			in: `[tunnel.t1]
+				 [tunnel.t1.session_template]
+				 pseudowire = "eth"
+				 [tunnel.t1.session.s1]
+				 pseudowire = "banana"`,
+			estr: "session s1",
+		},
 	}
 
 	for _, tt := range cases {
@@ -301,3 +803,446 @@ func TestBadConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestSessionTemplate(t *testing.T) {
+	cases := []struct {
+		name                string
+		templated, expanded string
+	}{
+		{
+			name: "defaults",
+			templated: `[tunnel.t1]
+				 version = "l2tpv3"
+				 [tunnel.t1.session_template]
+				 pseudowire = "eth"
+				 seqnum = true
+				 cookie = [ 0x12, 0xe9, 0x54, 0x0f ]
+				 [tunnel.t1.session.s1]
+				 sid = 1
+				 psid = 1001
+				 [tunnel.t1.session.s2]
+				 sid = 2
+				 psid = 1002`,
+			expanded: `[tunnel.t1]
+				 version = "l2tpv3"
+				 [tunnel.t1.session.s1]
+				 sid = 1
+				 psid = 1001
+				 pseudowire = "eth"
+				 seqnum = true
+				 cookie = [ 0x12, 0xe9, 0x54, 0x0f ]
+				 [tunnel.t1.session.s2]
+				 sid = 2
+				 psid = 1002
+				 pseudowire = "eth"
+				 seqnum = true
+				 cookie = [ 0x12, 0xe9, 0x54, 0x0f ]`,
+		},
+		{
+			name: "overrides",
+			templated: `[tunnel.t1]
+				 version = "l2tpv2"
+				 [tunnel.t1.session.s1]
+				 sid = 1
+				 [tunnel.t1.session.s2]
+				 sid = 2
+				 pseudowire = "pppac"
+				 seqnum = false
+				 [tunnel.t1.session_template]
+				 pseudowire = "ppp"
+				 seqnum = true`,
+			expanded: `[tunnel.t1]
+				 version = "l2tpv2"
+				 [tunnel.t1.session.s1]
+				 sid = 1
+				 pseudowire = "ppp"
+				 seqnum = true
+				 [tunnel.t1.session.s2]
+				 sid = 2
+				 pseudowire = "pppac"
+				 seqnum = false`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			templated, err := LoadString(c.templated)
+			if err != nil {
+				t.Fatalf("LoadString(%v): %v", c.templated, err)
+			}
+			expanded, err := LoadString(c.expanded)
+			if err != nil {
+				t.Fatalf("LoadString(%v): %v", c.expanded, err)
+			}
+			got_t, err := templated.findTunnelByName("t1")
+			if err != nil {
+				t.Fatalf("missing tunnel: %v", err)
+			}
+			want_t, err := expanded.findTunnelByName("t1")
+			if err != nil {
+				t.Fatalf("missing tunnel: %v", err)
+			}
+			if len(got_t.Sessions) != len(want_t.Sessions) {
+				t.Fatalf("got %v sessions, want %v", len(got_t.Sessions), len(want_t.Sessions))
+			}
+			for _, want_s := range want_t.Sessions {
+				got_s, err := got_t.findSessionByName(want_s.Name)
+				if err != nil {
+					t.Fatalf("missing session: %v", err)
+				}
+				if !reflect.DeepEqual(got_s, &want_s) {
+					t.Errorf("got %v, want %v", got_s.Config, want_s.Config)
+				}
+			}
+		})
+	}
+}
+
+type testAppParser struct {
+	nilCustomParser
+}
+
+func (tp *testAppParser) ParseParameter(key string, value interface{}) error {
+	return nil
+}
+
+func TestLoadDirectory(t *testing.T) {
+	cases := []struct {
+		name    string
+		files   map[string]string
+		tunnels []string
+		app     interface{}
+		estr    string
+	}{
+		{
+			name: "Merge tunnels",
+			files: map[string]string{
+				"a.toml": `app = "a"
+					   [tunnel.t1]
+					   version = "l2tpv2"`,
+				"b.toml": `app = "b"
+					   [tunnel.t2]
+					   version = "l2tpv3"
+					   [tunnel.t3]
+					   version = "l2tpv3"`,
+				"c.conf": `[tunnel.t4]
+					   version = "l2tpv3"`,
+			},
+			tunnels: []string{"t1", "t2", "t3"},
+			app:     "b",
+		},
+		{
+			name: "Duplicate tunnel",
+			files: map[string]string{
+				"a.toml": `[tunnel.t1]
+					   version = "l2tpv2"`,
+				"b.toml": `[tunnel.t1]
+					   version = "l2tpv3"`,
+			},
+			estr: "tunnel t1 already defined",
+		},
+		{
+			name: "Bad file",
+			files: map[string]string{
+				"a.toml": `[tunnel.t1]
+					   version = "l2tpv2"`,
+				"b.toml": `[tunnel.t2]
+					   version = "l2tpv4"`,
+			},
+			estr: "b.toml",
+		},
+		{
+			name: "No files",
+			files: map[string]string{
+				"a.conf": `[tunnel.t1]
+					   version = "l2tpv2"`,
+			},
+			estr: "no configuration files found",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range c.files {
+				err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+				if err != nil {
+					t.Fatalf("failed to write %v: %v", name, err)
+				}
+			}
+			cfg, err := LoadDirectoryWithCustomParser(dir, &testAppParser{})
+			if c.estr != "" {
+				if err == nil {
+					t.Fatalf("LoadDirectory(%v) succeeded when we expected an error", dir)
+				}
+				if !strings.Contains(err.Error(), c.estr) {
+					t.Fatalf("LoadDirectory(%v): error %q doesn't contain expected substring %q", dir, err, c.estr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadDirectory(%v): %v", dir, err)
+			}
+			if len(cfg.Tunnels) != len(c.tunnels) {
+				t.Fatalf("expected %d tunnels, got %d", len(c.tunnels), len(cfg.Tunnels))
+			}
+			tmap, ok := cfg.Map["tunnel"].(map[string]interface{})
+			if !ok || len(tmap) != len(c.tunnels) {
+				t.Fatalf("bad tunnel map %v", cfg.Map["tunnel"])
+			}
+			for _, name := range c.tunnels {
+				if _, err := cfg.findTunnelByName(name); err != nil {
+					t.Errorf("missing tunnel: %v", err)
+				}
+				if _, ok := tmap[name]; !ok {
+					t.Errorf("missing tunnel %v in map", name)
+				}
+			}
+			if cfg.Map["app"] != c.app {
+				t.Errorf("expected app %v, got %v", c.app, cfg.Map["app"])
+			}
+		})
+	}
+}
+
+func TestSecretSources(t *testing.T) {
+	dir := t.TempDir()
+	secretPath := filepath.Join(dir, "secret")
+	err := os.WriteFile(secretPath, []byte("  sesame\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write secret file: %v", err)
+	}
+	emptyPath := filepath.Join(dir, "empty")
+	err = os.WriteFile(emptyPath, []byte("\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write empty secret file: %v", err)
+	}
+	t.Setenv("TEST_L2TP_SECRET", "opensesame")
+	t.Setenv("TEST_L2TP_EMPTY_SECRET", "")
+
+	cases := []struct {
+		name   string
+		in     string
+		secret string
+		estr   string
+	}{
+		{
+			name: "File",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 secret_file = "` + secretPath + `"`,
+			secret: "sesame",
+		},
+		{
+			name: "Environment",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 secret_env = "TEST_L2TP_SECRET"`,
+			secret: "opensesame",
+		},
+		{
+			name: "Missing file",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 secret_file = "` + filepath.Join(dir, "missing") + `"`,
+			estr: "failed to read secret file",
+		},
+		{
+			name: "Empty file",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 secret_file = "` + emptyPath + `"`,
+			estr: "is empty",
+		},
+		{
+			name: "Unset environment variable",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 secret_env = "TEST_L2TP_UNSET_SECRET"`,
+			estr: "environment variable TEST_L2TP_UNSET_SECRET is not set",
+		},
+		{
+			name: "Empty environment variable",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 secret_env = "TEST_L2TP_EMPTY_SECRET"`,
+			estr: "environment variable TEST_L2TP_EMPTY_SECRET is empty",
+		},
+		{
+			name: "Inline and file",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 secret = "sesame"
+				 secret_file = "` + secretPath + `"`,
+			estr: "only one of secret, secret_file may be specified",
+		},
+		{
+			name: "File and environment",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 secret_env = "TEST_L2TP_SECRET"
+				 secret_file = "` + secretPath + `"`,
+			estr: "only one of secret_env, secret_file may be specified",
+		},
+		{
+			name: "L2TPv3",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 secret_env = "TEST_L2TP_SECRET"`,
+			estr: "secret is only supported for L2TPv2 tunnels",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := LoadString(c.in)
+			if c.estr != "" {
+				if err == nil {
+					t.Fatalf("LoadString(%v) succeeded when we expected an error", c.in)
+				}
+				if !strings.Contains(err.Error(), c.estr) {
+					t.Fatalf("LoadString(%v): error %q doesn't contain expected substring %q", c.in, err, c.estr)
+				}
+				if strings.Contains(err.Error(), "sesame") {
+					t.Fatalf("LoadString(%v): error %q discloses the secret", c.in, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadString(%v): %v", c.in, err)
+			}
+			if len(cfg.Tunnels) != 1 {
+				t.Fatalf("expected 1 tunnel, got %d", len(cfg.Tunnels))
+			}
+			if got := cfg.Tunnels[0].Config.Secret; got != c.secret {
+				t.Errorf("expected secret %q, got %q", c.secret, got)
+			}
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	cfg, err := LoadStringWithCustomParser(`
+		[app]
+		name = "myapp"
+		debug = true
+		[app.listen]
+		port = 8080
+		timeout = 250
+		key = [ 0x1, 0x2, 0x3 ]
+		big = 0x10000
+
+		[tunnel.t1]
+		version = "l2tpv3"
+		`, &testAppParser{})
+	if err != nil {
+		t.Fatalf("LoadStringWithCustomParser(): %v", err)
+	}
+
+	get := func(path string) interface{} {
+		v, err := cfg.Get(path)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", path, err)
+		}
+		return v
+	}
+
+	if s, err := AsString(get("app.name")); err != nil || s != "myapp" {
+		t.Errorf("app.name: got %q, %v", s, err)
+	}
+	if b, err := AsBool(get("app.debug")); err != nil || !b {
+		t.Errorf("app.debug: got %v, %v", b, err)
+	}
+	if u, err := AsUint16(get("app.listen.port")); err != nil || u != 8080 {
+		t.Errorf("app.listen.port: got %v, %v", u, err)
+	}
+	if u, err := AsUint32(get("app.listen.big")); err != nil || u != 0x10000 {
+		t.Errorf("app.listen.big: got %v, %v", u, err)
+	}
+	if d, err := AsDuration(get("app.listen.timeout")); err != nil || d != 250*time.Millisecond {
+		t.Errorf("app.listen.timeout: got %v, %v", d, err)
+	}
+	if b, err := AsBytes(get("app.listen.key")); err != nil || !reflect.DeepEqual(b, []byte{1, 2, 3}) {
+		t.Errorf("app.listen.key: got %v, %v", b, err)
+	}
+	if s, err := AsString(get("tunnel.t1.version")); err != nil || s != "l2tpv3" {
+		t.Errorf("tunnel.t1.version: got %q, %v", s, err)
+	}
+	if _, ok := get("app.listen").(map[string]interface{}); !ok {
+		t.Errorf("app.listen: expected table")
+	}
+
+	badPaths := []struct {
+		path, estr string
+	}{
+		{"", "empty config path"},
+		{"nosuch", "nosuch not found"},
+		{"app.nosuch", "app.nosuch not found"},
+		{"app.listen.port.x", "app.listen.port is not a table"},
+		{"app..port", "app. not found"},
+	}
+	for _, c := range badPaths {
+		_, err := cfg.Get(c.path)
+		if err == nil {
+			t.Errorf("Get(%q) succeeded when we expected an error", c.path)
+		} else if !strings.Contains(err.Error(), c.estr) {
+			t.Errorf("Get(%q): error %q doesn't contain expected substring %q", c.path, err, c.estr)
+		}
+	}
+
+	mismatches := []struct {
+		name string
+		fn   func() error
+	}{
+		{"string as uint16", func() error { _, err := AsUint16(get("app.name")); return err }},
+		{"uint32 out of range for uint16", func() error { _, err := AsUint16(get("app.listen.big")); return err }},
+		{"number as string", func() error { _, err := AsString(get("app.listen.port")); return err }},
+		{"number as bool", func() error { _, err := AsBool(get("app.listen.port")); return err }},
+		{"number as bytes", func() error { _, err := AsBytes(get("app.listen.port")); return err }},
+		{"table as duration", func() error { _, err := AsDuration(get("app.listen")); return err }},
+	}
+	for _, c := range mismatches {
+		if err := c.fn(); err == nil {
+			t.Errorf("%s: conversion succeeded when we expected an error", c.name)
+		}
+	}
+}
+
+func TestLoadReader(t *testing.T) {
+	content := `[tunnel.t1]
+		    version = "l2tpv3"
+		    peer = "127.0.0.1:5000"
+		    [tunnel.t1.session.s1]
+		    pseudowire = "eth"`
+	cases := []struct {
+		name string
+		r    io.Reader
+	}{
+		{"strings.Reader", strings.NewReader(content)},
+		{"bytes.Buffer", bytes.NewBufferString(content)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := Load(c.r)
+			if err != nil {
+				t.Fatalf("Load(): %v", err)
+			}
+			tunl, err := cfg.findTunnelByName("t1")
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if tunl.Config.Version != l2tp.ProtocolVersion3 || tunl.Config.Peer != "127.0.0.1:5000" {
+				t.Errorf("unexpected tunnel config %+v", tunl.Config)
+			}
+			if len(tunl.Sessions) != 1 || tunl.Sessions[0].Config.Pseudowire != l2tp.PseudowireTypeEth {
+				t.Errorf("unexpected sessions %+v", tunl.Sessions)
+			}
+		})
+	}
+
+	_, err := Load(strings.NewReader("[tunnel.t1"))
+	if err == nil {
+		t.Errorf("Load() of malformed config succeeded when we expected an error")
+	}
+	_, err = LoadWithCustomParser(strings.NewReader(`app = "x"`), &testAppParser{})
+	if err != nil {
+		t.Errorf("LoadWithCustomParser(): %v", err)
+	}
+}
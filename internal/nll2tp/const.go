@@ -137,6 +137,10 @@ const (
 	AttrRxErrors = 8
 	// AttrStatsPad as declared in nll2tp/l2tp.h:148
 	AttrStatsPad = 9
+	// AttrRxCookieDiscards as declared in nll2tp/l2tp.h:149
+	AttrRxCookieDiscards = 10
+	// AttrRxInvalid as declared in nll2tp/l2tp.h:150
+	AttrRxInvalid = 11
 )
 
 // L2tpPwtype as declared in nll2tp/l2tp.h:154
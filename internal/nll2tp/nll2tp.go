@@ -1,13 +1,16 @@
 package nll2tp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/mdlayher/genetlink"
 	"github.com/mdlayher/netlink"
 	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
 )
 
 // L2tpProtocolVersion describes the RFC version of the tunnel:
@@ -46,6 +49,17 @@ type TunnelConfig struct {
 	Encap L2tpEncapType
 	// DebugFlags specifies the kernel debugging flags to use for the tunnel instance.
 	DebugFlags L2tpDebugFlags
+	// UDPCsum enables UDP checksums for IPv4 UDP-encapsulated tunnels.
+	// It only applies to tunnels whose socket is created by the kernel.
+	UDPCsum bool
+	// UDPZeroCsum6Tx enables transmission of zero UDP checksums for
+	// IPv6 UDP-encapsulated tunnels.
+	// It only applies to tunnels whose socket is created by the kernel.
+	UDPZeroCsum6Tx bool
+	// UDPZeroCsum6Rx enables receipt of zero UDP checksums for
+	// IPv6 UDP-encapsulated tunnels.
+	// It only applies to tunnels whose socket is created by the kernel.
+	UDPZeroCsum6Rx bool
 }
 
 // SessionConfig encapsulates genetlink parameters for L2TP session commands.
@@ -70,6 +84,8 @@ type SessionConfig struct {
 	IsLNS bool
 	// ReorderTimeout sets the maximum amount of time, in milliseconds, to hold a data packet
 	// in the reorder queue when sequence numbers are enabled.
+	// The kernel converts the value to jiffies itself (c.f. nla_get_msecs), so no
+	// conversion based on the clock tick rate is required here.
 	ReorderTimeout uint64
 	// LocalCookie sets the RFC3931 cookie for the session.
 	// Transmitted data packets will include the cookie.
@@ -113,6 +129,9 @@ type SessionStatistics struct {
 	// RxOOSCount is the number of packets the session has received out of sequence if data packet
 	// reordering is enabled.
 	RxOOSCount uint64
+	// RxCookieDiscardCount is the number of packets the session has discarded due to a cookie
+	// mismatch.
+	RxCookieDiscardCount uint64
 }
 
 // SessionInfo encapsulates dataplane session information provided by the kernel.
@@ -125,6 +144,8 @@ type SessionInfo struct {
 	Sid L2tpSessionID
 	// Psid is the peer's L2TP ID for the session.
 	Psid L2tpSessionID
+	// PseudowireType is the type of traffic carried by the session.
+	PseudowireType L2tpPwtype
 	// IfName is the assigned interface name for this session.
 	IfName string
 	// LocalCookie is the RFC3931 cookie for the session.
@@ -143,14 +164,46 @@ type SessionInfo struct {
 	// ReorderTimeout is the maximum amount of time to hold a data packet in the reorder
 	// queue when sequence numbers are enabled.  This number is defined in milliseconds.
 	ReorderTimeout uint64
+	// DebugFlags is the kernel debugging flags for the session instance.
+	DebugFlags L2tpDebugFlags
 	// Statistics is the current dataplane tx/rx stats.
 	Statistics SessionStatistics
 }
 
+// TunnelInfo encapsulates dataplane tunnel information provided by the kernel.
+type TunnelInfo struct {
+	// Tid is the host's L2TP ID for the tunnel.
+	Tid L2tpTunnelID
+	// Ptid is the peer's L2TP ID for the tunnel.
+	Ptid L2tpTunnelID
+	// Version is the tunnel protocol version (L2TPv2 or L2TPv3).
+	Version L2tpProtocolVersion
+	// Encap is the tunnel encapsulation type.
+	Encap L2tpEncapType
+	// DebugFlags is the kernel debugging flags for the tunnel instance.
+	DebugFlags L2tpDebugFlags
+	// UDPCsum is true if UDP checksums are enabled for an IPv4
+	// UDP-encapsulated tunnel.
+	UDPCsum bool
+	// UDPZeroCsum6Tx is true if zero UDP checksums are transmitted for
+	// an IPv6 UDP-encapsulated tunnel.
+	UDPZeroCsum6Tx bool
+	// UDPZeroCsum6Rx is true if zero UDP checksums are accepted for
+	// an IPv6 UDP-encapsulated tunnel.
+	UDPZeroCsum6Rx bool
+	// LocalAddr and PeerAddr are the IPv4 or IPv6 addresses of the
+	// tunnel socket.  They are nil if the kernel didn't report them.
+	LocalAddr, PeerAddr []byte
+	// LocalPort and PeerPort are the UDP ports of the tunnel socket.
+	// They are zero for IP-encapsulated tunnels.
+	LocalPort, PeerPort uint16
+}
+
 type msgRequest struct {
-	msg    genetlink.Message
-	family uint16
-	flags  netlink.HeaderFlags
+	msg     genetlink.Message
+	family  uint16
+	flags   netlink.HeaderFlags
+	rspChan chan *msgResponse
 }
 
 type msgResponse struct {
@@ -158,39 +211,106 @@ type msgResponse struct {
 	err error
 }
 
+// genlConn is the subset of the genetlink connection API used by Conn.
+type genlConn interface {
+	Execute(m genetlink.Message, family uint16, flags netlink.HeaderFlags) ([]genetlink.Message, error)
+	Close() error
+}
+
 // Conn represents the genetlink L2TP connection to the kernel.
 type Conn struct {
 	genlFamily genetlink.Family
-	c          *genetlink.Conn
+	c          genlConn
 	reqChan    chan *msgRequest
-	rspChan    chan *msgResponse
+	timeout    time.Duration
 	wg         sync.WaitGroup
 }
 
+// DialOptions specifies optional settings for the genetlink L2TP
+// connection to the kernel.
+type DialOptions struct {
+	// ReadBufferSize sets the size in bytes of the netlink socket
+	// receive buffer.  If zero the system default is used.
+	//
+	// A larger buffer reduces the likelihood of netlink messages being
+	// dropped when the kernel is managing many tunnels, at the cost of
+	// increased kernel memory use per connection.
+	//
+	// If the process has CAP_NET_ADMIN the buffer size is set using
+	// SO_RCVBUFFORCE.  Otherwise SO_RCVBUF is used, in which case the
+	// size is silently capped by the net.core.rmem_max sysctl.
+	ReadBufferSize int
+}
+
 // Dial creates a new genetlink L2TP connection to the kernel.
 func Dial() (*Conn, error) {
+	return DialWithOptions(nil)
+}
+
+// DialWithOptions creates a new genetlink L2TP connection to the kernel
+// using the options provided.  If opts is nil, default settings are used.
+func DialWithOptions(opts *DialOptions) (*Conn, error) {
 	c, err := genetlink.Dial(nil)
 	if err != nil {
 		return nil, err
 	}
 
+	if opts != nil && opts.ReadBufferSize > 0 {
+		err = setReadBuffer(c, opts.ReadBufferSize)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to set netlink read buffer size: %v", err)
+		}
+	}
+
 	id, err := c.GetFamily(GenlName)
 	if err != nil {
 		c.Close()
 		return nil, err
 	}
 
+	return newConn(id, c), nil
+}
+
+func setReadBuffer(c *genetlink.Conn, bytes int) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, bytes)
+	})
+	if err == nil && serr == nil {
+		return nil
+	}
+
+	// SO_RCVBUFFORCE requires CAP_NET_ADMIN: fall back to SO_RCVBUF
+	return c.SetReadBuffer(bytes)
+}
+
+func newConn(family genetlink.Family, c genlConn) *Conn {
 	conn := &Conn{
-		genlFamily: id,
+		genlFamily: family,
 		c:          c,
 		reqChan:    make(chan *msgRequest),
-		rspChan:    make(chan *msgResponse),
 	}
 
 	conn.wg.Add(1)
 	go runConn(conn, &conn.wg)
 
-	return conn, nil
+	return conn
+}
+
+// SetRequestTimeout bounds the time the Conn will wait for the kernel
+// to process each request.  Requests which time out are abandoned and
+// return an error.  A timeout of zero, which is the default, waits
+// indefinitely.
+//
+// SetRequestTimeout should be called before the Conn is used.
+func (c *Conn) SetRequestTimeout(timeout time.Duration) {
+	c.timeout = timeout
 }
 
 // Close connection, releasing associated resources
@@ -316,6 +436,32 @@ func (c *Conn) DeleteTunnel(config *TunnelConfig) error {
 	return err
 }
 
+// ModifyTunnel modifies a tunnel instance in the kernel.
+// Only the debug flags of a tunnel may be modified: all other tunnel
+// configuration fields apart from the tunnel ID are ignored.
+func (c *Conn) ModifyTunnel(config *TunnelConfig) error {
+	attr, err := tunnelModifyAttr(config)
+	if err != nil {
+		return err
+	}
+
+	b, err := netlink.MarshalAttributes(attr)
+	if err != nil {
+		return err
+	}
+
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: CmdTunnelModify,
+			Version: c.genlFamily.Version,
+		},
+		Data: b,
+	}
+
+	_, err = c.execute(req, c.genlFamily.ID, netlink.Request|netlink.Acknowledge)
+	return err
+}
+
 // CreateSession creates a session instance in the kernel.
 // The parent tunnel instance referenced by the tunnel IDs in
 // the session configuration must already exist in the kernel.
@@ -342,6 +488,33 @@ func (c *Conn) CreateSession(config *SessionConfig) error {
 	return err
 }
 
+// ModifySession modifies a session instance in the kernel.
+// Only the data packet sequencing, LNS mode, reorder timeout, and debug
+// flags of a session may be modified: all other session configuration
+// fields apart from the tunnel and session IDs are ignored.
+func (c *Conn) ModifySession(config *SessionConfig) error {
+	attr, err := sessionModifyAttr(config)
+	if err != nil {
+		return err
+	}
+
+	b, err := netlink.MarshalAttributes(attr)
+	if err != nil {
+		return err
+	}
+
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: CmdSessionModify,
+			Version: c.genlFamily.Version,
+		},
+		Data: b,
+	}
+
+	_, err = c.execute(req, c.genlFamily.ID, netlink.Request|netlink.Acknowledge)
+	return err
+}
+
 // DeleteSession deletes a session instance from the kernel.
 func (c *Conn) DeleteSession(config *SessionConfig) error {
 	if config == nil {
@@ -393,6 +566,8 @@ func (stats *SessionStatistics) decode(ad *netlink.AttributeDecoder) error {
 			stats.RxSeqDiscardCount = ad.Uint64()
 		case AttrRxOosPackets:
 			stats.RxOOSCount = ad.Uint64()
+		case AttrRxCookieDiscards:
+			stats.RxCookieDiscardCount = ad.Uint64()
 		}
 	}
 	return nil
@@ -416,6 +591,8 @@ func sessionInfo_decode(data []byte) (*SessionInfo, error) {
 			info.Sid = L2tpSessionID(ad.Uint32())
 		case AttrPeerSessionId:
 			info.Psid = L2tpSessionID(ad.Uint32())
+		case AttrPwType:
+			info.PseudowireType = L2tpPwtype(ad.Uint16())
 		case AttrIfname:
 			info.IfName = ad.String()
 		case AttrCookie:
@@ -432,6 +609,8 @@ func sessionInfo_decode(data []byte) (*SessionInfo, error) {
 			info.UsingIPSec = ad.Uint8() != 0
 		case AttrRecvTimeout:
 			info.ReorderTimeout = ad.Uint64()
+		case AttrDebug:
+			info.DebugFlags = L2tpDebugFlags(ad.Uint32())
 		case AttrStats:
 			ad.Nested(info.Statistics.decode)
 		}
@@ -477,23 +656,112 @@ func (c *Conn) GetSessionInfo(config *SessionConfig) (*SessionInfo, error) {
 		return nil, err
 	}
 
-	info := SessionInfo{}
 	for _, rsp := range msgs {
 		if rsp.Header.Command != CmdSessionGet {
 			continue
 		}
+		return sessionInfo_decode(rsp.Data)
+	}
+	return nil, errors.New("no session information in kernel response")
+}
+
+func tunnelInfo_decode(data []byte) (*TunnelInfo, error) {
+
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attribute decoder: %v", err)
+	}
+
+	var info TunnelInfo
+	for ad.Next() {
+		switch ad.Type() {
+		case AttrConnId:
+			info.Tid = L2tpTunnelID(ad.Uint32())
+		case AttrPeerConnId:
+			info.Ptid = L2tpTunnelID(ad.Uint32())
+		case AttrProtoVersion:
+			info.Version = L2tpProtocolVersion(ad.Uint8())
+		case AttrEncapType:
+			info.Encap = L2tpEncapType(ad.Uint16())
+		case AttrDebug:
+			info.DebugFlags = L2tpDebugFlags(ad.Uint32())
+		case AttrUdpCsum:
+			info.UDPCsum = ad.Uint8() != 0
+		case AttrUdpZeroCsum6Tx:
+			info.UDPZeroCsum6Tx = true
+		case AttrUdpZeroCsum6Rx:
+			info.UDPZeroCsum6Rx = true
+		case AttrUdpSport:
+			info.LocalPort = ad.Uint16()
+		case AttrUdpDport:
+			info.PeerPort = ad.Uint16()
+		case AttrIpSaddr, AttrIp6Saddr:
+			info.LocalAddr = ad.Bytes()
+		case AttrIpDaddr, AttrIp6Daddr:
+			info.PeerAddr = ad.Bytes()
+		}
+	}
+
+	if err = ad.Err(); err != nil {
+		return nil, fmt.Errorf("failed to decode attributes: %v", err)
+	}
+
+	return &info, nil
+}
+
+// DumpTunnels retrieves dataplane information for all the tunnel
+// instances in the kernel.
+func (c *Conn) DumpTunnels() ([]*TunnelInfo, error) {
+	msgs, err := c.dump(CmdTunnelGet)
+	if err != nil {
+		return nil, err
+	}
 
-		attributes, err := netlink.UnmarshalAttributes(rsp.Data)
+	tunnels := []*TunnelInfo{}
+	for _, rsp := range msgs {
+		if rsp.Header.Command != CmdTunnelGet {
+			continue
+		}
+		info, err := tunnelInfo_decode(rsp.Data)
 		if err != nil {
 			return nil, err
 		}
+		tunnels = append(tunnels, info)
+	}
+	return tunnels, nil
+}
 
-		for _, a := range attributes {
-			switch a.Type {
-			}
+// DumpSessions retrieves dataplane information for all the session
+// instances in the kernel.
+func (c *Conn) DumpSessions() ([]*SessionInfo, error) {
+	msgs, err := c.dump(CmdSessionGet)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []*SessionInfo{}
+	for _, rsp := range msgs {
+		if rsp.Header.Command != CmdSessionGet {
+			continue
 		}
+		info, err := sessionInfo_decode(rsp.Data)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, info)
 	}
-	return &info, nil
+	return sessions, nil
+}
+
+func (c *Conn) dump(cmd uint8) ([]genetlink.Message, error) {
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: cmd,
+			Version: c.genlFamily.Version,
+		},
+	}
+
+	return c.execute(req, c.genlFamily.ID, netlink.Request|netlink.Dump)
 }
 
 func (c *Conn) createTunnel(attr []netlink.Attribute) error {
@@ -515,18 +783,37 @@ func (c *Conn) createTunnel(attr []netlink.Attribute) error {
 }
 
 func (c *Conn) execute(msg genetlink.Message, family uint16, flags netlink.HeaderFlags) ([]genetlink.Message, error) {
-	c.reqChan <- &msgRequest{
-		msg:    msg,
-		family: family,
-		flags:  flags,
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	return c.executeContext(ctx, msg, family, flags)
+}
+
+func (c *Conn) executeContext(ctx context.Context, msg genetlink.Message, family uint16, flags netlink.HeaderFlags) ([]genetlink.Message, error) {
+	// The response channel is buffered so that runConn never blocks
+	// sending the response to a request which has been abandoned.
+	req := &msgRequest{
+		msg:     msg,
+		family:  family,
+		flags:   flags,
+		rspChan: make(chan *msgResponse, 1),
 	}
 
-	rsp, ok := <-c.rspChan
-	if !ok {
-		return nil, errors.New("netlink connection closed")
+	select {
+	case c.reqChan <- req:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("netlink request not sent: %v", ctx.Err())
 	}
 
-	return rsp.msg, rsp.err
+	select {
+	case rsp := <-req.rspChan:
+		return rsp.msg, rsp.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("netlink request abandoned: %v", ctx.Err())
+	}
 }
 
 func tunnelCreateAttr(config *TunnelConfig) ([]netlink.Attribute, error) {
@@ -561,7 +848,7 @@ func tunnelCreateAttr(config *TunnelConfig) ([]netlink.Attribute, error) {
 		}
 	}
 
-	return []netlink.Attribute{
+	attr := []netlink.Attribute{
 		{
 			Type: AttrConnId,
 			Data: nlenc.Uint32Bytes(uint32(config.Tid)),
@@ -582,7 +869,31 @@ func tunnelCreateAttr(config *TunnelConfig) ([]netlink.Attribute, error) {
 			Type: AttrDebug,
 			Data: nlenc.Uint32Bytes(uint32(config.DebugFlags)),
 		},
-	}, nil
+	}
+
+	// Checksum attributes are only meaningful for UDP encapsulation.
+	// The IPv6 zero checksum attributes are flags: the kernel checks
+	// for their presence only.
+	if config.Encap == EncaptypeUdp {
+		if config.UDPCsum {
+			attr = append(attr, netlink.Attribute{
+				Type: AttrUdpCsum,
+				Data: nlenc.Uint8Bytes(1),
+			})
+		}
+		if config.UDPZeroCsum6Tx {
+			attr = append(attr, netlink.Attribute{
+				Type: AttrUdpZeroCsum6Tx,
+			})
+		}
+		if config.UDPZeroCsum6Rx {
+			attr = append(attr, netlink.Attribute{
+				Type: AttrUdpZeroCsum6Rx,
+			})
+		}
+	}
+
+	return attr, nil
 }
 
 func sessionCreateAttr(config *SessionConfig) ([]netlink.Attribute, error) {
@@ -688,7 +999,7 @@ func sessionCreateAttr(config *SessionConfig) ([]netlink.Attribute, error) {
 
 	if len(config.PeerCookie) > 0 {
 		attr = append(attr, netlink.Attribute{
-			Type: AttrCookie,
+			Type: AttrPeerCookie,
 			Data: config.PeerCookie,
 		})
 	}
@@ -700,34 +1011,125 @@ func sessionCreateAttr(config *SessionConfig) ([]netlink.Attribute, error) {
 		})
 	}
 
+	if config.DebugFlags != 0 {
+		attr = append(attr, netlink.Attribute{
+			Type: AttrDebug,
+			Data: nlenc.Uint32Bytes(uint32(config.DebugFlags)),
+		})
+	}
+
+	// The kernel requires the sublayer length to match the sublayer type,
+	// so derive it from the type rather than letting the two disagree.
+	l2SpecLen, err := l2SpecLen(config.L2SpecType)
+	if err != nil {
+		return nil, err
+	}
+
 	attr = append(attr, netlink.Attribute{
 		Type: AttrL2specType,
 		Data: nlenc.Uint8Bytes(uint8(config.L2SpecType)),
+	}, netlink.Attribute{
+		Type: AttrL2specLen,
+		Data: nlenc.Uint8Bytes(l2SpecLen),
 	})
 
-	switch config.L2SpecType {
+	return attr, nil
+}
+
+// l2SpecLen returns the length in bytes of the Layer 2 specific sublayer
+// of the specified type.
+func l2SpecLen(l2SpecType L2tpL2specType) (uint8, error) {
+	switch l2SpecType {
 	case L2spectypeNone:
-		attr = append(attr, netlink.Attribute{
-			Type: AttrL2specLen,
-			Data: nlenc.Uint8Bytes(0),
-		})
+		return 0, nil
 	case L2spectypeDefault:
-		attr = append(attr, netlink.Attribute{
-			Type: AttrL2specLen,
-			Data: nlenc.Uint8Bytes(4),
-		})
-	default:
-		return nil, fmt.Errorf("unhandled L2 Spec Type %v", config.L2SpecType)
+		return 4, nil
 	}
+	return 0, fmt.Errorf("unhandled L2 Spec Type %v", l2SpecType)
+}
 
-	return attr, nil
+func tunnelModifyAttr(config *TunnelConfig) ([]netlink.Attribute, error) {
+
+	// Sanity checks
+	if config == nil {
+		return nil, errors.New("invalid nil tunnel config")
+	}
+	if config.Tid == 0 {
+		return nil, errors.New("tunnel config must have a non-zero tunnel ID")
+	}
+
+	// The debug flags are always included so they can be cleared.
+	return []netlink.Attribute{
+		{
+			Type: AttrConnId,
+			Data: nlenc.Uint32Bytes(uint32(config.Tid)),
+		},
+		{
+			Type: AttrDebug,
+			Data: nlenc.Uint32Bytes(uint32(config.DebugFlags)),
+		},
+	}, nil
+}
+
+func boolToUint8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sessionModifyAttr(config *SessionConfig) ([]netlink.Attribute, error) {
+
+	// Sanity checks
+	if config == nil {
+		return nil, errors.New("invalid nil session config")
+	}
+	if config.Tid == 0 {
+		return nil, errors.New("session config must have a non-zero parent tunnel ID")
+	}
+	if config.Sid == 0 {
+		return nil, errors.New("session config must have a non-zero session ID")
+	}
+
+	// Unlike session creation, all the mutable attributes are always
+	// included so that previously enabled options can be disabled.
+	return []netlink.Attribute{
+		{
+			Type: AttrConnId,
+			Data: nlenc.Uint32Bytes(uint32(config.Tid)),
+		},
+		{
+			Type: AttrSessionId,
+			Data: nlenc.Uint32Bytes(uint32(config.Sid)),
+		},
+		{
+			Type: AttrSendSeq,
+			Data: nlenc.Uint8Bytes(boolToUint8(config.SendSeq)),
+		},
+		{
+			Type: AttrRecvSeq,
+			Data: nlenc.Uint8Bytes(boolToUint8(config.RecvSeq)),
+		},
+		{
+			Type: AttrLnsMode,
+			Data: nlenc.Uint8Bytes(boolToUint8(config.IsLNS)),
+		},
+		{
+			Type: AttrRecvTimeout,
+			Data: nlenc.Uint64Bytes(config.ReorderTimeout),
+		},
+		{
+			Type: AttrDebug,
+			Data: nlenc.Uint32Bytes(uint32(config.DebugFlags)),
+		},
+	}, nil
 }
 
 func runConn(c *Conn, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for req := range c.reqChan {
 		m, err := c.c.Execute(req.msg, req.family, req.flags)
-		c.rspChan <- &msgResponse{
+		req.rspChan <- &msgResponse{
 			msg: m,
 			err: err,
 		}
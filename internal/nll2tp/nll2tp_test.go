@@ -0,0 +1,591 @@
+package nll2tp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestTunnelCreateAttrChecksum(t *testing.T) {
+	cases := []struct {
+		name   string
+		config TunnelConfig
+		expect map[uint16]bool
+	}{
+		{
+			name: "default",
+			config: TunnelConfig{
+				Tid: 1, Ptid: 2, Version: ProtocolVersion3, Encap: EncaptypeUdp,
+			},
+			expect: map[uint16]bool{},
+		},
+		{
+			name: "IPv4 checksum",
+			config: TunnelConfig{
+				Tid: 1, Ptid: 2, Version: ProtocolVersion3, Encap: EncaptypeUdp,
+				UDPCsum: true,
+			},
+			expect: map[uint16]bool{AttrUdpCsum: true},
+		},
+		{
+			name: "IPv6 zero checksum",
+			config: TunnelConfig{
+				Tid: 1, Ptid: 2, Version: ProtocolVersion2, Encap: EncaptypeUdp,
+				UDPZeroCsum6Tx: true,
+				UDPZeroCsum6Rx: true,
+			},
+			expect: map[uint16]bool{AttrUdpZeroCsum6Tx: true, AttrUdpZeroCsum6Rx: true},
+		},
+		{
+			name: "IP encap",
+			config: TunnelConfig{
+				Tid: 1, Ptid: 2, Version: ProtocolVersion3, Encap: EncaptypeIp,
+				UDPCsum:        true,
+				UDPZeroCsum6Tx: true,
+				UDPZeroCsum6Rx: true,
+			},
+			expect: map[uint16]bool{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			attr, err := tunnelCreateAttr(&c.config)
+			if err != nil {
+				t.Fatalf("tunnelCreateAttr(%+v): %v", c.config, err)
+			}
+			b, err := netlink.MarshalAttributes(attr)
+			if err != nil {
+				t.Fatalf("netlink.MarshalAttributes(): %v", err)
+			}
+			ad, err := netlink.NewAttributeDecoder(b)
+			if err != nil {
+				t.Fatalf("netlink.NewAttributeDecoder(): %v", err)
+			}
+
+			got := make(map[uint16]bool)
+			for ad.Next() {
+				switch ad.Type() {
+				case AttrUdpCsum:
+					if v := ad.Uint8(); v != 1 {
+						t.Errorf("expected AttrUdpCsum value 1, got %v", v)
+					}
+					got[ad.Type()] = true
+				case AttrUdpZeroCsum6Tx, AttrUdpZeroCsum6Rx:
+					if n := len(ad.Bytes()); n != 0 {
+						t.Errorf("expected flag attribute %v to have no data, got %v bytes", ad.Type(), n)
+					}
+					got[ad.Type()] = true
+				}
+			}
+			if err := ad.Err(); err != nil {
+				t.Fatalf("attribute decode: %v", err)
+			}
+
+			if len(got) != len(c.expect) {
+				t.Errorf("expected checksum attributes %v, got %v", c.expect, got)
+			}
+			for typ := range c.expect {
+				if !got[typ] {
+					t.Errorf("missing attribute %v", typ)
+				}
+			}
+		})
+	}
+}
+
+func TestTunnelModifyAttr(t *testing.T) {
+	for _, flags := range []L2tpDebugFlags{0, MsgControl | MsgSeq} {
+		attr, err := tunnelModifyAttr(&TunnelConfig{Tid: 42, Ptid: 24, DebugFlags: flags})
+		if err != nil {
+			t.Fatalf("tunnelModifyAttr(): %v", err)
+		}
+		b, err := netlink.MarshalAttributes(attr)
+		if err != nil {
+			t.Fatalf("netlink.MarshalAttributes(): %v", err)
+		}
+		ad, err := netlink.NewAttributeDecoder(b)
+		if err != nil {
+			t.Fatalf("netlink.NewAttributeDecoder(): %v", err)
+		}
+
+		got := make(map[uint16]uint32)
+		for ad.Next() {
+			got[ad.Type()] = ad.Uint32()
+		}
+		if err := ad.Err(); err != nil {
+			t.Fatalf("attribute decode: %v", err)
+		}
+
+		expect := map[uint16]uint32{AttrConnId: 42, AttrDebug: uint32(flags)}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("expected attributes %v, got %v", expect, got)
+		}
+	}
+
+	for _, bad := range []*TunnelConfig{nil, {Ptid: 24}} {
+		if _, err := tunnelModifyAttr(bad); err == nil {
+			t.Errorf("tunnelModifyAttr(%+v): expected error", bad)
+		}
+	}
+}
+
+func TestSessionModifyAttr(t *testing.T) {
+	cases := []struct {
+		name   string
+		config SessionConfig
+		expect map[uint16]uint64
+	}{
+		{
+			name: "sequencing enabled",
+			config: SessionConfig{
+				Tid: 1, Sid: 2,
+				SendSeq: true, RecvSeq: true, IsLNS: true,
+				ReorderTimeout: 1500,
+				DebugFlags:     MsgData | MsgSeq,
+			},
+			expect: map[uint16]uint64{
+				AttrConnId:      1,
+				AttrSessionId:   2,
+				AttrSendSeq:     1,
+				AttrRecvSeq:     1,
+				AttrLnsMode:     1,
+				AttrRecvTimeout: 1500,
+				AttrDebug:       uint64(MsgData | MsgSeq),
+			},
+		},
+		{
+			name: "sequencing disabled",
+			config: SessionConfig{
+				Tid: 1, Sid: 2,
+			},
+			expect: map[uint16]uint64{
+				AttrConnId:      1,
+				AttrSessionId:   2,
+				AttrSendSeq:     0,
+				AttrRecvSeq:     0,
+				AttrLnsMode:     0,
+				AttrRecvTimeout: 0,
+				AttrDebug:       0,
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			attr, err := sessionModifyAttr(&c.config)
+			if err != nil {
+				t.Fatalf("sessionModifyAttr(%+v): %v", c.config, err)
+			}
+			b, err := netlink.MarshalAttributes(attr)
+			if err != nil {
+				t.Fatalf("netlink.MarshalAttributes(): %v", err)
+			}
+			ad, err := netlink.NewAttributeDecoder(b)
+			if err != nil {
+				t.Fatalf("netlink.NewAttributeDecoder(): %v", err)
+			}
+
+			got := make(map[uint16]uint64)
+			for ad.Next() {
+				switch ad.Type() {
+				case AttrConnId, AttrSessionId, AttrDebug:
+					got[ad.Type()] = uint64(ad.Uint32())
+				case AttrSendSeq, AttrRecvSeq, AttrLnsMode:
+					got[ad.Type()] = uint64(ad.Uint8())
+				case AttrRecvTimeout:
+					got[ad.Type()] = ad.Uint64()
+				default:
+					t.Errorf("unexpected attribute %v", ad.Type())
+				}
+			}
+			if err := ad.Err(); err != nil {
+				t.Fatalf("attribute decode: %v", err)
+			}
+
+			if len(got) != len(c.expect) {
+				t.Errorf("expected attributes %v, got %v", c.expect, got)
+			}
+			for typ, v := range c.expect {
+				if gv, ok := got[typ]; !ok || gv != v {
+					t.Errorf("attribute %v: expected %v, got %v (present: %v)", typ, v, gv, ok)
+				}
+			}
+		})
+	}
+
+	for _, bad := range []*SessionConfig{nil, {Sid: 2}, {Tid: 1}} {
+		if _, err := sessionModifyAttr(bad); err == nil {
+			t.Errorf("sessionModifyAttr(%+v): expected error", bad)
+		}
+	}
+}
+
+func TestSessionCreateAttrL2Spec(t *testing.T) {
+	cases := []struct {
+		l2SpecType L2tpL2specType
+		expectLen  uint8
+	}{
+		{l2SpecType: L2spectypeNone, expectLen: 0},
+		{l2SpecType: L2spectypeDefault, expectLen: 4},
+	}
+	for _, c := range cases {
+		attr, err := sessionCreateAttr(&SessionConfig{
+			Tid: 1, Ptid: 2, Sid: 3, Psid: 4,
+			PseudowireType: PwtypeEth,
+			L2SpecType:     c.l2SpecType,
+		})
+		if err != nil {
+			t.Fatalf("sessionCreateAttr(L2SpecType %v): %v", c.l2SpecType, err)
+		}
+		b, err := netlink.MarshalAttributes(attr)
+		if err != nil {
+			t.Fatalf("netlink.MarshalAttributes(): %v", err)
+		}
+		ad, err := netlink.NewAttributeDecoder(b)
+		if err != nil {
+			t.Fatalf("netlink.NewAttributeDecoder(): %v", err)
+		}
+
+		got := make(map[uint16]uint8)
+		for ad.Next() {
+			switch ad.Type() {
+			case AttrL2specType, AttrL2specLen:
+				got[ad.Type()] = ad.Uint8()
+			}
+		}
+		if err := ad.Err(); err != nil {
+			t.Fatalf("attribute decode: %v", err)
+		}
+
+		expect := map[uint16]uint8{
+			AttrL2specType: uint8(c.l2SpecType),
+			AttrL2specLen:  c.expectLen,
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("L2SpecType %v: expected attributes %v, got %v", c.l2SpecType, expect, got)
+		}
+	}
+
+	_, err := sessionCreateAttr(&SessionConfig{
+		Tid: 1, Ptid: 2, Sid: 3, Psid: 4,
+		PseudowireType: PwtypeEth,
+		L2SpecType:     L2spectypeDefault + 1,
+	})
+	if err == nil {
+		t.Errorf("sessionCreateAttr(): expected error for unknown L2SpecType")
+	}
+}
+
+func TestSessionCreateAttrCookies(t *testing.T) {
+	attr, err := sessionCreateAttr(&SessionConfig{
+		Tid: 1, Ptid: 2, Sid: 3, Psid: 4,
+		PseudowireType: PwtypeEth,
+		LocalCookie:    []byte{0x01, 0x02, 0x03, 0x04},
+		PeerCookie:     []byte{0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c},
+	})
+	if err != nil {
+		t.Fatalf("sessionCreateAttr(): %v", err)
+	}
+
+	got := make(map[uint16][]byte)
+	for _, a := range attr {
+		if a.Type == AttrCookie || a.Type == AttrPeerCookie {
+			if _, ok := got[a.Type]; ok {
+				t.Errorf("duplicate cookie attribute %v", a.Type)
+			}
+			got[a.Type] = a.Data
+		}
+	}
+	expect := map[uint16][]byte{
+		AttrCookie:     {0x01, 0x02, 0x03, 0x04},
+		AttrPeerCookie: {0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected cookie attributes %v, got %v", expect, got)
+	}
+}
+
+// testSlowConn is a genlConn whose requests block until released.
+type testSlowConn struct {
+	release chan bool
+}
+
+func (tc *testSlowConn) Execute(m genetlink.Message, family uint16, flags netlink.HeaderFlags) ([]genetlink.Message, error) {
+	<-tc.release
+	return nil, nil
+}
+
+func (tc *testSlowConn) Close() error {
+	return nil
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tc := &testSlowConn{release: make(chan bool)}
+	c := newConn(genetlink.Family{}, tc)
+	c.SetRequestTimeout(50 * time.Millisecond)
+
+	err := c.DeleteSession(&SessionConfig{Tid: 1, Sid: 2})
+	if err == nil {
+		t.Fatalf("DeleteSession(): expected timeout error")
+	}
+
+	// Once the stalled request completes the connection should
+	// continue to process requests normally.
+	close(tc.release)
+	err = c.DeleteSession(&SessionConfig{Tid: 1, Sid: 2})
+	if err != nil {
+		t.Errorf("DeleteSession(): %v", err)
+	}
+
+	c.Close()
+}
+
+func TestSetReadBuffer(t *testing.T) {
+	c, err := genetlink.Dial(nil)
+	if err != nil {
+		t.Skipf("genetlink.Dial(): %v", err)
+	}
+	defer c.Close()
+
+	// Pick a size under the default net.core.rmem_max so that the
+	// SO_RCVBUF fallback is honoured without CAP_NET_ADMIN.
+	const size = 128 * 1024
+
+	err = setReadBuffer(c, size)
+	if err != nil {
+		t.Fatalf("setReadBuffer(%v): %v", size, err)
+	}
+
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn(): %v", err)
+	}
+	var got int
+	var gerr error
+	err = rc.Control(func(fd uintptr) {
+		got, gerr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	})
+	if err != nil || gerr != nil {
+		t.Fatalf("failed to read SO_RCVBUF: %v, %v", err, gerr)
+	}
+
+	// The kernel doubles the requested value to allow for bookkeeping overhead
+	if got != 2*size {
+		t.Errorf("expected SO_RCVBUF %v, got %v", 2*size, got)
+	}
+}
+
+// testSessionGetConn is a genlConn which responds to requests with a
+// canned set of messages, recording the most recent request.
+type testSessionGetConn struct {
+	rsp   []genetlink.Message
+	req   genetlink.Message
+	flags netlink.HeaderFlags
+}
+
+func (tc *testSessionGetConn) Execute(m genetlink.Message, family uint16, flags netlink.HeaderFlags) ([]genetlink.Message, error) {
+	tc.req = m
+	tc.flags = flags
+	return tc.rsp, nil
+}
+
+func (tc *testSessionGetConn) Close() error {
+	return nil
+}
+
+func TestGetSessionInfo(t *testing.T) {
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint32(AttrConnId, 1)
+	ae.Uint32(AttrPeerConnId, 2)
+	ae.Uint32(AttrSessionId, 3)
+	ae.Uint32(AttrPeerSessionId, 4)
+	ae.String(AttrIfname, "l2tpeth0")
+	ae.Nested(AttrStats, func(nae *netlink.AttributeEncoder) error {
+		nae.Uint64(AttrRxPackets, 10)
+		nae.Uint64(AttrTxBytes, 2000)
+		return nil
+	})
+	b, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode attributes: %v", err)
+	}
+
+	tc := &testSessionGetConn{
+		rsp: []genetlink.Message{
+			{Header: genetlink.Header{Command: CmdSessionGet}, Data: b},
+		},
+	}
+	c := newConn(genetlink.Family{}, tc)
+	defer c.Close()
+
+	info, err := c.GetSessionInfo(&SessionConfig{Tid: 1, Sid: 3})
+	if err != nil {
+		t.Fatalf("GetSessionInfo(): %v", err)
+	}
+	if info.Tid != 1 || info.Ptid != 2 || info.Sid != 3 || info.Psid != 4 {
+		t.Errorf("expected IDs 1/2/3/4, got %v/%v/%v/%v", info.Tid, info.Ptid, info.Sid, info.Psid)
+	}
+	if info.IfName != "l2tpeth0" {
+		t.Errorf("expected interface name l2tpeth0, got %q", info.IfName)
+	}
+	if info.Statistics.RxPacketCount != 10 || info.Statistics.TxBytes != 2000 {
+		t.Errorf("expected rx packets 10, tx bytes 2000, got %v, %v",
+			info.Statistics.RxPacketCount, info.Statistics.TxBytes)
+	}
+
+	// A response without session information is an error
+	tc.rsp = []genetlink.Message{{Header: genetlink.Header{Command: CmdSessionCreate}}}
+	if _, err = c.GetSessionInfo(&SessionConfig{Tid: 1, Sid: 3}); err == nil {
+		t.Errorf("GetSessionInfo(): expected error for response without session information")
+	}
+}
+
+func TestDumpTunnels(t *testing.T) {
+	encode := func(f func(ae *netlink.AttributeEncoder)) []byte {
+		ae := netlink.NewAttributeEncoder()
+		f(ae)
+		b, err := ae.Encode()
+		if err != nil {
+			t.Fatalf("failed to encode attributes: %v", err)
+		}
+		return b
+	}
+
+	udp4 := encode(func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(AttrConnId, 1)
+		ae.Uint32(AttrPeerConnId, 2)
+		ae.Uint8(AttrProtoVersion, ProtocolVersion3)
+		ae.Uint16(AttrEncapType, EncaptypeUdp)
+		ae.Uint32(AttrDebug, uint32(MsgControl))
+		ae.Uint8(AttrUdpCsum, 1)
+		ae.Uint16(AttrUdpSport, 1701)
+		ae.Uint16(AttrUdpDport, 1702)
+		ae.Bytes(AttrIpSaddr, []byte{127, 0, 0, 1})
+		ae.Bytes(AttrIpDaddr, []byte{127, 0, 0, 2})
+	})
+	ip6 := encode(func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(AttrConnId, 3)
+		ae.Uint32(AttrPeerConnId, 4)
+		ae.Uint8(AttrProtoVersion, ProtocolVersion3)
+		ae.Uint16(AttrEncapType, EncaptypeIp)
+		ae.Bytes(AttrIp6Saddr, []byte{15: 1})
+		ae.Bytes(AttrIp6Daddr, []byte{15: 2})
+	})
+
+	tc := &testSessionGetConn{
+		rsp: []genetlink.Message{
+			{Header: genetlink.Header{Command: CmdTunnelGet}, Data: udp4},
+			{Header: genetlink.Header{Command: CmdTunnelGet}, Data: ip6},
+		},
+	}
+	c := newConn(genetlink.Family{}, tc)
+	defer c.Close()
+
+	tunnels, err := c.DumpTunnels()
+	if err != nil {
+		t.Fatalf("DumpTunnels(): %v", err)
+	}
+	if tc.req.Header.Command != CmdTunnelGet {
+		t.Errorf("expected command %v, got %v", CmdTunnelGet, tc.req.Header.Command)
+	}
+	if tc.flags&netlink.Dump != netlink.Dump {
+		t.Errorf("expected dump request, got flags %v", tc.flags)
+	}
+
+	expect := []*TunnelInfo{
+		{
+			Tid:        1,
+			Ptid:       2,
+			Version:    ProtocolVersion3,
+			Encap:      EncaptypeUdp,
+			DebugFlags: MsgControl,
+			UDPCsum:    true,
+			LocalAddr:  []byte{127, 0, 0, 1},
+			PeerAddr:   []byte{127, 0, 0, 2},
+			LocalPort:  1701,
+			PeerPort:   1702,
+		},
+		{
+			Tid:       3,
+			Ptid:      4,
+			Version:   ProtocolVersion3,
+			Encap:     EncaptypeIp,
+			LocalAddr: []byte{15: 1},
+			PeerAddr:  []byte{15: 2},
+		},
+	}
+	if !reflect.DeepEqual(tunnels, expect) {
+		t.Errorf("expected tunnels %+v, got %+v", expect, tunnels)
+	}
+
+	// An empty dump is not an error
+	tc.rsp = nil
+	tunnels, err = c.DumpTunnels()
+	if err != nil {
+		t.Fatalf("DumpTunnels(): %v", err)
+	}
+	if len(tunnels) != 0 {
+		t.Errorf("expected no tunnels, got %v", len(tunnels))
+	}
+}
+
+func TestDumpSessions(t *testing.T) {
+	var msgs []genetlink.Message
+	for _, sid := range []uint32{10, 11} {
+		ae := netlink.NewAttributeEncoder()
+		ae.Uint32(AttrConnId, 1)
+		ae.Uint32(AttrPeerConnId, 2)
+		ae.Uint32(AttrSessionId, sid)
+		ae.Uint32(AttrPeerSessionId, sid+10)
+		ae.Uint16(AttrPwType, uint16(PwtypeEth))
+		ae.Uint32(AttrDebug, uint32(MsgData))
+		ae.Bytes(AttrCookie, []byte{1, 2, 3, 4})
+		ae.Uint8(AttrSendSeq, 1)
+		ae.Uint8(AttrRecvSeq, 1)
+		ae.Uint64(AttrRecvTimeout, 250)
+		b, err := ae.Encode()
+		if err != nil {
+			t.Fatalf("failed to encode attributes: %v", err)
+		}
+		msgs = append(msgs, genetlink.Message{Header: genetlink.Header{Command: CmdSessionGet}, Data: b})
+	}
+
+	tc := &testSessionGetConn{rsp: msgs}
+	c := newConn(genetlink.Family{}, tc)
+	defer c.Close()
+
+	sessions, err := c.DumpSessions()
+	if err != nil {
+		t.Fatalf("DumpSessions(): %v", err)
+	}
+	if tc.req.Header.Command != CmdSessionGet {
+		t.Errorf("expected command %v, got %v", CmdSessionGet, tc.req.Header.Command)
+	}
+	if tc.flags&netlink.Dump != netlink.Dump {
+		t.Errorf("expected dump request, got flags %v", tc.flags)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %v", len(sessions))
+	}
+	for i, info := range sessions {
+		sid := L2tpSessionID(10 + i)
+		if info.Tid != 1 || info.Ptid != 2 || info.Sid != sid || info.Psid != sid+10 {
+			t.Errorf("expected IDs 1/2/%v/%v, got %v/%v/%v/%v",
+				sid, sid+10, info.Tid, info.Ptid, info.Sid, info.Psid)
+		}
+		if info.PseudowireType != PwtypeEth || info.DebugFlags != MsgData {
+			t.Errorf("expected pseudowire %v, debug flags %v, got %v, %v",
+				PwtypeEth, MsgData, info.PseudowireType, info.DebugFlags)
+		}
+		if !info.SendSeq || !info.RecvSeq || info.ReorderTimeout != 250 {
+			t.Errorf("expected sequencing with reorder timeout 250, got %v/%v/%v",
+				info.SendSeq, info.RecvSeq, info.ReorderTimeout)
+		}
+		if !reflect.DeepEqual(info.LocalCookie, []byte{1, 2, 3, 4}) {
+			t.Errorf("expected cookie 01020304, got %x", info.LocalCookie)
+		}
+	}
+}
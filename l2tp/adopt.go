@@ -0,0 +1,260 @@
+package l2tp
+
+import (
+	"fmt"
+
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+// TunnelState describes a tunnel instance which is already present in
+// the data plane, along with the sessions it contains.
+//
+// TunnelState is obtained using Context.ExportTunnels, and may be passed
+// to Context.AdoptTunnel to take ownership of the tunnel.
+type TunnelState struct {
+	// Name is the name to give the tunnel on adoption.  ExportTunnels
+	// names each tunnel after its tunnel ID, e.g. "tunnel42", but the
+	// name may be changed prior to adoption.
+	Name string
+	// Config is the tunnel configuration reported by the data plane.
+	// Only settings which the data plane reports are populated.
+	Config *TunnelConfig
+	// Sessions are the sessions present in the tunnel.
+	Sessions []*SessionState
+}
+
+// SessionState describes a session instance which is already present in
+// the data plane.
+type SessionState struct {
+	// Name is the name to give the session on adoption.  ExportTunnels
+	// names each session after its session ID, e.g. "session42", but
+	// the name may be changed prior to adoption.
+	Name string
+	// Config is the session configuration reported by the data plane.
+	// Only settings which the data plane reports are populated.
+	Config *SessionConfig
+}
+
+// adoptingDataPlane is implemented by data planes which can enumerate
+// the tunnel and session instances already present, and take ownership
+// of them without recreating them.
+type adoptingDataPlane interface {
+	exportTunnels() ([]*TunnelState, error)
+	adoptTunnel(tcfg *TunnelConfig) (TunnelDataPlane, error)
+	adoptSession(tunnelID, peerTunnelID ControlConnID, scfg *SessionConfig) (SessionDataPlane, error)
+}
+
+// ExportTunnels enumerates the tunnel and session instances present in
+// the data plane which are not owned by the Context.
+//
+// This allows a process to take over the tunnels of another, e.g. so
+// that kl2tpd may be upgraded without tearing down the tunnels it
+// manages.  Use AdoptTunnel to take ownership of the tunnels returned.
+//
+// ExportTunnels is supported by LinuxNetlinkDataPlane, which obtains
+// the tunnel and session instances in the kernel using a netlink dump.
+// ErrAdoptionNotSupported is returned for other data planes.
+func (ctx *Context) ExportTunnels() ([]*TunnelState, error) {
+	adp, ok := ctx.dp.(adoptingDataPlane)
+	if !ok {
+		return nil, ErrAdoptionNotSupported
+	}
+
+	states, err := adp.exportTunnels()
+	if err != nil {
+		return nil, err
+	}
+
+	unowned := []*TunnelState{}
+	for _, state := range states {
+		if _, ok := ctx.findTunnelByID(state.Config.TunnelID); !ok {
+			unowned = append(unowned, state)
+		}
+	}
+	return unowned, nil
+}
+
+// AdoptTunnel takes ownership of a tunnel instance, and the sessions it
+// contains, which is already present in the data plane.
+//
+// The data plane instances are not recreated, so traffic carried by the
+// tunnel is not interrupted by adoption.  If adoption fails the data
+// plane instances are left untouched.
+//
+// Adopted tunnels run no control protocol, and behave as static tunnels
+// once adopted: closing the tunnel or its sessions tears down the data
+// plane instances.  A SessionUpEvent is raised for each adopted session,
+// but data plane hooks are not called since the data plane instances
+// already exist.
+//
+// The Linux kernel destroys tunnels whose socket was created in
+// userspace when that socket is closed.  Such tunnels can only be
+// adopted while the process owning the socket keeps it open.
+//
+// ErrAdoptionNotSupported is returned for data planes which don't
+// support ExportTunnels.
+func (ctx *Context) AdoptTunnel(state *TunnelState) (tunl Tunnel, err error) {
+
+	// Must have state
+	if state == nil || state.Config == nil {
+		return nil, fmt.Errorf("invalid nil tunnel state")
+	}
+
+	adp, ok := ctx.dp.(adoptingDataPlane)
+	if !ok {
+		return nil, ErrAdoptionNotSupported
+	}
+
+	// Duplicate the configuration so we don't modify the user's copy
+	myCfg := *state.Config
+
+	if myCfg.TunnelID == 0 || myCfg.PeerTunnelID == 0 {
+		return nil, fmt.Errorf("adopted tunnel must have non-zero tunnel and peer tunnel IDs")
+	}
+
+	// Check session state up front, so that a failure doesn't leave
+	// the tunnel partially adopted
+	names := make(map[string]bool)
+	for _, ss := range state.Sessions {
+		if ss == nil || ss.Config == nil {
+			return nil, fmt.Errorf("invalid nil session state")
+		}
+		if names[ss.Name] {
+			return nil, fmt.Errorf("%w %q", ErrSessionNameExists, ss.Name)
+		}
+		names[ss.Name] = true
+		err = validateSessionConfig(&myCfg, ss.Config, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx.waitCreate()
+
+	// Must not have name clashes
+	if _, ok := ctx.findTunnelByName(state.Name); ok {
+		return nil, fmt.Errorf("%w %q", ErrTunnelNameExists, state.Name)
+	}
+
+	// Must not have TID clashes
+	_, err = ctx.reserveTid(myCfg.TunnelID, myCfg.Version)
+	if err != nil {
+		return nil, err
+	}
+	defer ctx.releaseTidOnError(myCfg.TunnelID, &err)
+
+	// The data plane may not report the tunnel addresses
+	var sal, sap unix.Sockaddr
+	if myCfg.Local != "" && myCfg.Peer != "" {
+		sal, sap, err = newTunnelAddressPair(&myCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialise tunnel addresses: %w", err)
+		}
+
+		// Must not exceed the limit on tunnels to the peer
+		err = ctx.reserveTunnelPeer(myCfg.TunnelID, sap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t, err := newAdoptedTunnel(state.Name, ctx, adp, sal, &myCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []*staticSession{}
+	for _, ss := range state.Sessions {
+		var s *staticSession
+		s, err = t.adoptSession(adp, ss.Name, ss.Config)
+		if err != nil {
+			for _, s := range sessions {
+				t.unlinkSession(s)
+			}
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	ctx.linkTunnel(t)
+	tunl = t
+
+	for _, s := range sessions {
+		s.parent.handleUserEvent(&SessionUpEvent{
+			TunnelName:    t.getName(),
+			Tunnel:        t,
+			TunnelConfig:  t.getCfg(),
+			SessionName:   s.getName(),
+			Session:       s,
+			SessionConfig: s.cfg,
+			InterfaceName: s.ifname,
+		})
+	}
+
+	return
+}
+
+func newAdoptedTunnel(name string, parent *Context, adp adoptingDataPlane, sal unix.Sockaddr, cfg *TunnelConfig) (st *staticTunnel, err error) {
+	st = &staticTunnel{
+		baseTunnel: newBaseTunnel(
+			parent.logger,
+			name,
+			parent,
+			cfg),
+		sal: sal,
+	}
+
+	st.dp, err = adp.adoptTunnel(st.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to adopt tunnel data plane: %v", err)
+	}
+
+	level.Info(st.logger).Log(
+		"message", "adopted tunnel",
+		"encap", cfg.Encap,
+		"local", cfg.Local,
+		"peer", cfg.Peer,
+		"peer_tunnel_id", cfg.PeerTunnelID)
+
+	return
+}
+
+func (st *staticTunnel) adoptSession(adp adoptingDataPlane, name string, cfg *SessionConfig) (ss *staticSession, err error) {
+
+	// Must not have session ID clashes
+	_, err = st.reserveSid(cfg.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer st.releaseSidOnError(cfg.SessionID, &err)
+
+	// Duplicate the configuration so we don't modify the user's copy
+	myCfg := *cfg
+	ss = &staticSession{
+		baseSession: newBaseSession(
+			st.getLogger(),
+			name,
+			st,
+			&myCfg),
+	}
+
+	ss.dp, err = adp.adoptSession(st.cfg.TunnelID, st.cfg.PeerTunnelID, ss.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to adopt session data plane: %v", err)
+	}
+
+	ss.ifname, err = ss.dp.GetInterfaceName()
+	if err != nil {
+		return nil, err
+	}
+
+	st.linkSession(ss)
+
+	level.Info(ss.logger).Log(
+		"message", "adopted session",
+		"peer_session_id", ss.cfg.PeerSessionID,
+		"pseudowire", ss.cfg.Pseudowire)
+
+	return
+}
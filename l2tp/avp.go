@@ -2,6 +2,7 @@ package l2tp
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -93,6 +94,11 @@ const (
 	// AVPs falling into this category are typically those with currently
 	// reserved IDs as per the RFCs.
 	avpDataTypeIllegal avpDataType = iota
+	// avpDataTypeUnrecognised represents an AVP of a type this
+	// implementation doesn't recognise.  Only unrecognised AVPs with the
+	// mandatory bit set are retained when parsing a message, since these
+	// require the receiver to terminate the tunnel or session.
+	avpDataTypeUnrecognised avpDataType = iota
 	// avpDataTypeMax is a sentinel value for test purposes
 	avpDataTypeMax avpDataType = iota
 )
@@ -133,7 +139,7 @@ var avpInfoTable = [...]avpInfo{
 	{avpType: avpTypeProxyAuthID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeProxyAuthResponse, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeCallErrors, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeUnimplemented}, // TODO
-	{avpType: avpTypeAccm, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeUnimplemented},       // TODO
+	{avpType: avpTypeAccm, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes},
 	{avpType: avpTypeRandomVector, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes},
 	{avpType: avpTypePrivGroupID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeString},
 	{avpType: avpTypeRxConnectSpeed, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
@@ -160,7 +166,7 @@ var avpInfoTable = [...]avpInfo{
 	{avpType: avpTypeMessageDigest, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeRouterID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeAssignedConnID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
-	{avpType: avpTypePseudowireCaps, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUnimplemented},
+	{avpType: avpTypePseudowireCaps, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeLocalSessionID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeRemoteSessionID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeAssignedCookie, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
@@ -609,6 +615,8 @@ func (t avpDataType) String() string {
 		return "unimplemented AVP data type"
 	case avpDataTypeIllegal:
 		return "illegal AVP"
+	case avpDataTypeUnrecognised:
+		return "unrecognised AVP"
 	}
 	return "Unrecognised AVP data type"
 }
@@ -655,7 +663,7 @@ func (p avpPayload) String() string {
 		str.WriteString(s)
 	case avpDataTypeBytes:
 		str.WriteString(fmt.Sprintf("%s", p.data))
-	case avpDataTypeEmpty, avpDataTypeUnimplemented, avpDataTypeIllegal:
+	case avpDataTypeEmpty, avpDataTypeUnimplemented, avpDataTypeIllegal, avpDataTypeUnrecognised:
 		str.WriteString("")
 	}
 
@@ -729,12 +737,30 @@ func (avp *avp) totalLen() int {
 	return avp.header.totalLen()
 }
 
+// findUnrecognisedMandatoryAvp returns the first AVP in avps which has
+// the mandatory bit set but isn't recognised, or nil if there are none.
+// RFC2661 section 4.1 and RFC3931 section 5.2 require the tunnel or
+// session associated with a message carrying such an AVP to be terminated.
+func findUnrecognisedMandatoryAvp(avps []avp) *avp {
+	for i := range avps {
+		if avps[i].payload.dataType == avpDataTypeUnrecognised && avps[i].isMandatory() {
+			return &avps[i]
+		}
+	}
+	return nil
+}
+
 func getAVPInfo(avpType avpType, VendorID avpVendorID) (*avpInfo, error) {
 	for _, info := range avpInfoTable {
 		if info.avpType == avpType && info.VendorID == VendorID {
 			return &info, nil
 		}
 	}
+	// Vendor AVPs registered by the application are carried as bytes,
+	// and decoded using the registered codec.
+	if _, ok := lookupVendorAVP(VendorID, avpType); ok {
+		return &avpInfo{avpType: avpType, VendorID: VendorID, dataType: avpDataTypeBytes}, nil
+	}
 	return nil, errors.New("unrecognised AVP type")
 }
 
@@ -742,32 +768,43 @@ func getAVPInfo(avpType avpType, VendorID avpVendorID) (*avpInfo, error) {
 // into an array of AVP instances.
 func parseAVPBuffer(b []byte) (avps []avp, err error) {
 	r := bytes.NewReader(b)
-	for r.Len() >= avpHeaderLen {
+	for r.Len() > 0 {
 		var h avpHeader
 		var info *avpInfo
 		var cursor int64
 
+		// Trailing bytes which can't hold a header indicate truncation
+		if r.Len() < avpHeaderLen {
+			return nil, fmt.Errorf("malformed AVP buffer: %v trailing bytes are too short for an AVP header", r.Len())
+		}
+
 		// Read the AVP header in
 		if err := binary.Read(r, binary.BigEndian, &h); err != nil {
 			return nil, err
 		}
 
+		// Bounds check the AVP
+		if h.dataLen() < 0 {
+			return nil, errors.New("malformed AVP buffer: current AVP length is less than AVP header length")
+		}
+		if h.dataLen() > r.Len() {
+			return nil, errors.New("malformed AVP buffer: current AVP length exceeds buffer length")
+		}
+
 		// Look up the AVP
+		dataType := avpDataTypeUnrecognised
 		info, err := getAVPInfo(h.AvpType, h.VendorID)
-		if err != nil {
-			if h.isMandatory() {
-				return nil, fmt.Errorf("failed to parse mandatory AVP: %v", err)
-			}
+		if err == nil {
+			dataType = info.dataType
+		} else if !h.isMandatory() {
 			// RFC2661 section 4.1 says unrecognised AVPs without the
 			// mandatory bit set MUST be ignored
+			if _, err := r.Seek(int64(h.dataLen()), io.SeekCurrent); err != nil {
+				return nil, errors.New("malformed AVP buffer: invalid length for current AVP")
+			}
 			continue
 		}
 
-		// Bounds check the AVP
-		if h.dataLen() > r.Len() {
-			return nil, errors.New("malformed AVP buffer: current AVP length exceeds buffer length")
-		}
-
 		if cursor, err = r.Seek(0, io.SeekCurrent); err != nil {
 			return nil, errors.New("malformed AVP buffer: unable to determine offset of current AVP")
 		}
@@ -775,7 +812,7 @@ func parseAVPBuffer(b []byte) (avps []avp, err error) {
 		avps = append(avps, avp{
 			header: h,
 			payload: avpPayload{
-				dataType: info.dataType,
+				dataType: dataType,
 				data:     b[cursor : cursor+int64(h.dataLen())],
 			},
 		})
@@ -818,6 +855,8 @@ func encodePayload(info *avpInfo, value interface{}) ([]byte, error) {
 
 	switch info.dataType {
 	case avpDataTypeEmpty:
+		// The AVP's presence conveys its meaning: any value is ignored
+		return []byte{}, nil
 	case avpDataTypeUint16:
 		_, ok = value.(uint16)
 	case avpDataTypeUint32:
@@ -882,6 +921,101 @@ func newAvp(vendorID avpVendorID, avpType avpType, value interface{}) (a *avp, e
 	}, nil
 }
 
+// hidingXor applies the RFC2661 Section 4.3 hiding algorithm to the
+// input buffer, returning the result.  The algorithm is symmetric: the
+// same operation is used for both hiding and unhiding, with the only
+// difference being the source of the chained intermediate values, which
+// are always derived from the hidden data.
+func hidingXor(typ avpType, secret, rv, in []byte, unhide bool) []byte {
+	out := make([]byte, len(in))
+
+	h := md5.New()
+	_ = binary.Write(h, binary.BigEndian, typ)
+	h.Write(secret)
+	h.Write(rv)
+	b := h.Sum(nil)
+
+	for i := 0; i < len(in); i += md5.Size {
+		end := i + md5.Size
+		if end > len(in) {
+			end = len(in)
+		}
+		for j := i; j < end; j++ {
+			out[j] = in[j] ^ b[j-i]
+		}
+		h.Reset()
+		h.Write(secret)
+		if unhide {
+			h.Write(in[i:end])
+		} else {
+			h.Write(out[i:end])
+		}
+		b = h.Sum(nil)
+	}
+	return out
+}
+
+// hideAvp returns a hidden copy of the AVP, obscured using the hiding
+// algorithm described by RFC2661 Section 4.3.
+func hideAvp(in *avp, secret, rv []byte) (*avp, error) {
+	if in.isHidden() {
+		return nil, fmt.Errorf("AVP %v is already hidden", in.getType())
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("cannot hide AVP without a shared secret")
+	}
+	if len(rv) == 0 {
+		return nil, errors.New("cannot hide AVP without a random vector")
+	}
+
+	// The hidden AVP subformat prefixes the original value with its length.
+	// We don't add any padding after the value.
+	subformat := make([]byte, 2+len(in.payload.data))
+	binary.BigEndian.PutUint16(subformat, uint16(len(in.payload.data)))
+	copy(subformat[2:], in.payload.data)
+
+	data := hidingXor(in.getType(), secret, rv, subformat, false)
+	return &avp{
+		header: *newAvpHeader(in.isMandatory(), true, uint(len(data)), in.vendorID(), in.getType()),
+		payload: avpPayload{
+			dataType: in.payload.dataType,
+			data:     data,
+		},
+	}, nil
+}
+
+// unhideAvp returns a cleartext copy of a hidden AVP, recovered using the
+// hiding algorithm described by RFC2661 Section 4.3.
+func unhideAvp(in *avp, secret, rv []byte) (*avp, error) {
+	if !in.isHidden() {
+		return nil, fmt.Errorf("AVP %v is not hidden", in.getType())
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("cannot unhide AVP %v without a shared secret", in.getType())
+	}
+	if len(rv) == 0 {
+		return nil, fmt.Errorf("cannot unhide AVP %v without a random vector", in.getType())
+	}
+	if len(in.payload.data) < 2 {
+		return nil, fmt.Errorf("hidden AVP %v payload too short", in.getType())
+	}
+
+	subformat := hidingXor(in.getType(), secret, rv, in.payload.data, true)
+	origLen := int(binary.BigEndian.Uint16(subformat))
+	if origLen > len(subformat)-2 {
+		return nil, fmt.Errorf("hidden AVP %v original length %v exceeds payload length %v",
+			in.getType(), origLen, len(subformat)-2)
+	}
+	data := subformat[2 : 2+origLen]
+	return &avp{
+		header: *newAvpHeader(in.isMandatory(), false, uint(len(data)), in.vendorID(), in.getType()),
+		payload: avpPayload{
+			dataType: in.payload.dataType,
+			data:     data,
+		},
+	}, nil
+}
+
 // rawData returns the data type for the AVP, along with the raw byte
 // slice for the data carried by the AVP.
 func (avp *avp) rawData() (dataType avpDataType, buffer []byte) {
@@ -894,8 +1028,8 @@ func (avp *avp) isDataType(dt avpDataType) bool {
 }
 
 func (p *avpPayload) toUint16() (out uint16, err error) {
-	if len(p.data) > 2 {
-		return 0, fmt.Errorf("AVP payload length %v exceeds expected length 2", len(p.data))
+	if len(p.data) != 2 {
+		return 0, fmt.Errorf("AVP payload length %v does not match expected length 2", len(p.data))
 	}
 	r := bytes.NewReader(p.data)
 	if err = binary.Read(r, binary.BigEndian, &out); err != nil {
@@ -905,8 +1039,8 @@ func (p *avpPayload) toUint16() (out uint16, err error) {
 }
 
 func (p *avpPayload) toUint32() (out uint32, err error) {
-	if len(p.data) > 4 {
-		return 0, fmt.Errorf("AVP payload length %v exceeds expected length 4", len(p.data))
+	if len(p.data) != 4 {
+		return 0, fmt.Errorf("AVP payload length %v does not match expected length 4", len(p.data))
 	}
 	r := bytes.NewReader(p.data)
 	if err = binary.Read(r, binary.BigEndian, &out); err != nil {
@@ -916,8 +1050,8 @@ func (p *avpPayload) toUint32() (out uint32, err error) {
 }
 
 func (p *avpPayload) toUint64() (out uint64, err error) {
-	if len(p.data) > 8 {
-		return 0, fmt.Errorf("AVP payload length %v exceeds expected length 8", len(p.data))
+	if len(p.data) != 8 {
+		return 0, fmt.Errorf("AVP payload length %v does not match expected length 8", len(p.data))
 	}
 	r := bytes.NewReader(p.data)
 	if err = binary.Read(r, binary.BigEndian, &out); err != nil {
@@ -934,6 +1068,15 @@ func (p *avpPayload) toResultCode() (out resultCode, err error) {
 	var resCode, errCode uint16
 	var errMsg string
 
+	// Ref: RFC2661 section 4.4.2.  The error code is optional, but must
+	// be present if an error message is included.
+	if len(p.data) < 2 {
+		return resultCode{}, fmt.Errorf("result code AVP payload length %v is less than minimum length 2", len(p.data))
+	}
+	if len(p.data) == 3 {
+		return resultCode{}, fmt.Errorf("result code AVP payload length %v truncates the error code", len(p.data))
+	}
+
 	r := bytes.NewReader(p.data)
 
 	if err = binary.Read(r, binary.BigEndian, &resCode); err != nil {
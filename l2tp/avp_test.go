@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -80,6 +81,34 @@ func TestParseAVPBufferGood(t *testing.T) {
 				},
 			},
 		},
+		{
+			in: []byte{
+				0x00, 0x0a, 0x01, 0xef, 0x00, 0x01, 0xde, 0xad, 0xbe, 0xef, // non-mandatory vendor AVP
+				0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06, // message type
+			},
+			want: []avp{
+				avp{
+					header:  avpHeader{FlagLen: 0x8008, VendorID: 0, AvpType: avpTypeMessage},
+					payload: avpPayload{dataType: avpDataTypeMsgID, data: []byte{0x00, 0x06}},
+				},
+			},
+		},
+		{
+			in: []byte{
+				0x80, 0x08, 0x01, 0xef, 0x00, 0x00, 0x00, 0x06, // mandatory vendor AVP
+				0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06, // message type
+			},
+			want: []avp{
+				avp{
+					header:  avpHeader{FlagLen: 0x8008, VendorID: 0x1ef, AvpType: 0},
+					payload: avpPayload{dataType: avpDataTypeUnrecognised, data: []byte{0x00, 0x06}},
+				},
+				avp{
+					header:  avpHeader{FlagLen: 0x8008, VendorID: 0, AvpType: avpTypeMessage},
+					payload: avpPayload{dataType: avpDataTypeMsgID, data: []byte{0x00, 0x06}},
+				},
+			},
+		},
 	}
 	for _, c := range cases {
 		got, err := parseAVPBuffer(c.in)
@@ -93,6 +122,50 @@ func TestParseAVPBufferGood(t *testing.T) {
 	}
 }
 
+func TestFindUnrecognisedMandatoryAvp(t *testing.T) {
+	cases := []struct {
+		name      string
+		in        []byte
+		wantFound bool
+	}{
+		{
+			name: "known AVPs only",
+			in: []byte{
+				0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06, // message type
+			},
+		},
+		{
+			name: "unrecognised non-mandatory AVP",
+			in: []byte{
+				0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06, // message type
+				0x00, 0x08, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01, // unrecognised IETF AVP
+			},
+		},
+		{
+			name: "unrecognised mandatory AVP",
+			in: []byte{
+				0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06, // message type
+				0x80, 0x08, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01, // unrecognised IETF AVP
+			},
+			wantFound: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			avps, err := parseAVPBuffer(c.in)
+			if err != nil {
+				t.Fatalf("parseAVPBuffer(%q): %v", c.in, err)
+			}
+			got := findUnrecognisedMandatoryAvp(avps)
+			if c.wantFound && (got == nil || got.getType() != 0x100) {
+				t.Errorf("expected unrecognised mandatory AVP, got %v", got)
+			} else if !c.wantFound && got != nil {
+				t.Errorf("unexpected unrecognised mandatory AVP %v", got.header)
+			}
+		})
+	}
+}
+
 func TestParseAVPBufferBad(t *testing.T) {
 	cases := []struct {
 		in []byte
@@ -104,7 +177,22 @@ func TestParseAVPBufferBad(t *testing.T) {
 			in: []byte{0x1, 0x2, 0x3, 0x4}, // short avp data
 		},
 		{
-			in: []byte{0x80, 0x08, 0x01, 0xef, 0x00, 0x00, 0x00, 0x06}, // mandatory vendor AVP
+			// avp length exceeds buffer length
+			in: []byte{0x80, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01},
+		},
+		{
+			// avp length less than avp header length
+			in: []byte{
+				0x00, 0x04, 0x00, 0x00, 0x01, 0x00,
+				0x00, 0x04, 0x00, 0x00, 0x01, 0x00,
+			},
+		},
+		{
+			// valid avp followed by a truncated avp header
+			in: []byte{
+				0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+				0x80, 0x08, 0x00, 0x00,
+			},
 		},
 	}
 	for _, c := range cases {
@@ -118,6 +206,61 @@ func TestParseAVPBufferBad(t *testing.T) {
 	}
 }
 
+func TestAVPDecodeTruncated(t *testing.T) {
+	cases := []struct {
+		name string
+		in   []byte
+	}{
+		{
+			name: "uint16 under-length",
+			in:   []byte{0x80, 0x07, 0x00, 0x00, 0x00, 0x09, 0x01}, // assigned tunnel ID
+		},
+		{
+			name: "uint16 over-length",
+			in:   []byte{0x80, 0x09, 0x00, 0x00, 0x00, 0x09, 0x01, 0x02, 0x03},
+		},
+		{
+			name: "uint32 under-length",
+			in:   []byte{0x80, 0x09, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03}, // framing cap
+		},
+		{
+			name: "uint64 under-length",
+			in: []byte{0x00, 0x0d, 0x00, 0x00, 0x00, 0x4a, // tx connect speed
+				0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07},
+		},
+		{
+			name: "result code under-length",
+			in:   []byte{0x80, 0x07, 0x00, 0x00, 0x00, 0x01, 0x01},
+		},
+		{
+			name: "result code truncated error code",
+			in:   []byte{0x80, 0x09, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x02},
+		},
+		{
+			name: "message type under-length",
+			in:   []byte{0x80, 0x07, 0x00, 0x00, 0x00, 0x00, 0x01},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			avps, err := parseAVPBuffer(c.in)
+			if err != nil {
+				t.Fatalf("parseAVPBuffer(%q) failed: %v", c.in, err)
+			}
+			if len(avps) != 1 {
+				t.Fatalf("parseAVPBuffer(%q): expected 1 AVP, got %d", c.in, len(avps))
+			}
+			_, err = avps[0].decode()
+			if err == nil {
+				t.Fatalf("decode(%q): expected error, but did not get one", c.in)
+			}
+			if !strings.Contains(err.Error(), "length") {
+				t.Errorf("decode(%q): expected error describing length, got %q", c.in, err)
+			}
+		})
+	}
+}
+
 type avpMetadata struct {
 	mandatory, hidden bool
 	typ               avpType
@@ -657,6 +800,83 @@ func TestFind(t *testing.T) {
 	}
 }
 
+func TestHideAvp(t *testing.T) {
+	secret := []byte("sesame")
+	rv := []byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x02, 0x03, 0x04}
+	cases := []struct {
+		typ   avpType
+		value interface{}
+	}{
+		{typ: avpTypeTunnelID, value: uint16(42)},
+		{typ: avpTypeCallSerialNumber, value: uint32(0x12345678)},
+		{typ: avpTypeHostName, value: "a.host.name.which.needs.more.than.one.md5.block"},
+		{typ: avpTypeChallenge, value: bytes.Repeat([]byte{0xa5}, 16)},
+	}
+	for _, c := range cases {
+		t.Run(c.typ.String(), func(t *testing.T) {
+			in, err := newAvp(vendorIDIetf, c.typ, c.value)
+			if err != nil {
+				t.Fatalf("newAvp(%v, %v): %v", c.typ, c.value, err)
+			}
+
+			hidden, err := hideAvp(in, secret, rv)
+			if err != nil {
+				t.Fatalf("hideAvp(%v): %v", in, err)
+			}
+			if !hidden.isHidden() || hidden.isMandatory() != in.isMandatory() {
+				t.Errorf("hideAvp(%v): bad header flags %v", in, hidden.header)
+			}
+			if hidden.totalLen() != in.totalLen()+2 {
+				t.Errorf("hideAvp(%v): expected length %v, got %v", in, in.totalLen()+2, hidden.totalLen())
+			}
+			if len(in.payload.data) > 0 && bytes.Contains(hidden.payload.data, in.payload.data) {
+				t.Errorf("hideAvp(%v): hidden payload contains cleartext", in)
+			}
+
+			out, err := unhideAvp(hidden, secret, rv)
+			if err != nil {
+				t.Fatalf("unhideAvp(%v): %v", hidden, err)
+			}
+			if !reflect.DeepEqual(in, out) {
+				t.Errorf("unhideAvp(): expected %v, got %v", in, out)
+			}
+		})
+	}
+}
+
+func TestUnhideAvpBad(t *testing.T) {
+	secret := []byte("sesame")
+	rv := []byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x02, 0x03, 0x04}
+
+	in, err := newAvp(vendorIDIetf, avpTypeSessionID, uint16(1234))
+	if err != nil {
+		t.Fatalf("newAvp(): %v", err)
+	}
+	hidden, err := hideAvp(in, secret, rv)
+	if err != nil {
+		t.Fatalf("hideAvp(%v): %v", in, err)
+	}
+
+	cases := []struct {
+		name   string
+		secret []byte
+		rv     []byte
+	}{
+		{name: "wrong secret", secret: []byte("open sesame"), rv: rv},
+		{name: "wrong random vector", secret: secret, rv: []byte{0x01, 0x02, 0x03, 0x04}},
+		{name: "no secret", secret: nil, rv: rv},
+		{name: "no random vector", secret: secret, rv: nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, err := unhideAvp(hidden, c.secret, c.rv)
+			if err == nil {
+				t.Errorf("unhideAvp() succeeded unexpectedly: %v", out)
+			}
+		})
+	}
+}
+
 func TestAvpTypeStringer(t *testing.T) {
 	for i := avpTypeMessage; i < avpTypeMax; i++ {
 		s := i.String()
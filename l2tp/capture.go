@@ -0,0 +1,158 @@
+package l2tp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Ref: https://wiki.wireshark.org/Development/LibpcapFileFormat
+const (
+	pcapMagic        = 0xa1b2c3d4
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+	pcapSnapLen      = 65535
+	// LINKTYPE_RAW: each packet begins with an IPv4 or IPv6 header
+	pcapLinkTypeRaw = 101
+
+	pcapHeaderLen       = 24
+	pcapRecordHeaderLen = 16
+)
+
+// pcapWriter writes control plane packets to w in pcap format.
+//
+// Since the tunnel socket only gives us access to the L2TP payload,
+// pcapWriter synthesises IP and UDP headers for each packet based
+// on the source and destination addresses of the packet.
+type pcapWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	hdr := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:6], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:8], pcapVersionMinor)
+	// hdr[8:16] are the timezone offset and timestamp accuracy, both zero
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], pcapLinkTypeRaw)
+
+	_, err := w.Write(hdr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write pcap header: %v", err)
+	}
+	return &pcapWriter{w: w}, nil
+}
+
+// writePacket writes a single control packet b sent from src to dst.
+func (pw *pcapWriter) writePacket(ts time.Time, src, dst unix.Sockaddr, b []byte) error {
+	frame, err := newCaptureFrame(src, dst, b)
+	if err != nil {
+		return err
+	}
+
+	rec := make([]byte, pcapRecordHeaderLen, pcapRecordHeaderLen+len(frame))
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(frame)))
+	rec = append(rec, frame...)
+
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	_, err = pw.w.Write(rec)
+	return err
+}
+
+// newCaptureFrame builds an IP packet carrying the L2TP control packet b.
+func newCaptureFrame(src, dst unix.Sockaddr, b []byte) ([]byte, error) {
+	switch s := src.(type) {
+	case *unix.SockaddrInet4:
+		if d, ok := dst.(*unix.SockaddrInet4); ok {
+			udp := newUDPHeader(s.Addr[:], d.Addr[:], s.Port, d.Port, b)
+			return newIPv4Header(s.Addr, d.Addr, unix.IPPROTO_UDP, append(udp, b...)), nil
+		}
+	case *unix.SockaddrInet6:
+		if d, ok := dst.(*unix.SockaddrInet6); ok {
+			udp := newUDPHeader(s.Addr[:], d.Addr[:], s.Port, d.Port, b)
+			return newIPv6Header(s.Addr, d.Addr, unix.IPPROTO_UDP, append(udp, b...)), nil
+		}
+	case *unix.SockaddrL2TPIP:
+		// The kernel adds and strips the zero session ID which prefixes
+		// L2TPv3 control messages in IP encapsulation, so restore it here.
+		// Ref: RFC3931 section 4.1.1.2
+		if d, ok := dst.(*unix.SockaddrL2TPIP); ok {
+			return newIPv4Header(s.Addr, d.Addr, unix.IPPROTO_L2TP, append(make([]byte, 4), b...)), nil
+		}
+	case *unix.SockaddrL2TPIP6:
+		if d, ok := dst.(*unix.SockaddrL2TPIP6); ok {
+			return newIPv6Header(s.Addr, d.Addr, unix.IPPROTO_L2TP, append(make([]byte, 4), b...)), nil
+		}
+	}
+	return nil, fmt.Errorf("unhandled address types %T and %T", src, dst)
+}
+
+func newIPv4Header(src, dst [4]byte, proto int, payload []byte) []byte {
+	hdr := make([]byte, 20, 20+len(payload))
+	hdr[0] = 0x45 // version 4, 5 word header
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(hdr)+len(payload)))
+	hdr[8] = 64 // TTL
+	hdr[9] = uint8(proto)
+	copy(hdr[12:16], src[:])
+	copy(hdr[16:20], dst[:])
+	binary.BigEndian.PutUint16(hdr[10:12], ^onesComplementSum(0, hdr))
+	return append(hdr, payload...)
+}
+
+func newIPv6Header(src, dst [16]byte, proto int, payload []byte) []byte {
+	hdr := make([]byte, 40, 40+len(payload))
+	hdr[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(hdr[4:6], uint16(len(payload)))
+	hdr[6] = uint8(proto)
+	hdr[7] = 64 // hop limit
+	copy(hdr[8:24], src[:])
+	copy(hdr[24:40], dst[:])
+	return append(hdr, payload...)
+}
+
+func newUDPHeader(src, dst []byte, sport, dport int, payload []byte) []byte {
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint16(hdr[0:2], uint16(sport))
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(dport))
+	binary.BigEndian.PutUint16(hdr[4:6], uint16(len(hdr)+len(payload)))
+
+	// The checksum covers a pseudo header of the IP addresses,
+	// protocol, and UDP length as well as the UDP header and payload.
+	// Ref: RFC768, RFC8200 section 8.1
+	sum := onesComplementSum(0, src)
+	sum = onesComplementSum(sum, dst)
+	sum = onesComplementSum(sum, []byte{0, unix.IPPROTO_UDP, hdr[4], hdr[5]})
+	sum = onesComplementSum(sum, hdr)
+	csum := ^onesComplementSum(sum, payload)
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(hdr[6:8], csum)
+	return hdr
+}
+
+// onesComplementSum adds the 16 bit words of b to sum using one's
+// complement arithmetic, as used by IP and UDP checksums.
+func onesComplementSum(sum uint16, b []byte) uint16 {
+	acc := uint32(sum)
+	for i := 0; i+1 < len(b); i += 2 {
+		acc += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		acc += uint32(b[len(b)-1]) << 8
+	}
+	for acc > 0xffff {
+		acc = (acc >> 16) + (acc & 0xffff)
+	}
+	return uint16(acc)
+}
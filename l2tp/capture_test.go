@@ -0,0 +1,207 @@
+package l2tp
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readPcapRecords returns the packet data of each record in a pcap file.
+func readPcapRecords(t *testing.T, b []byte) (records [][]byte) {
+	if len(b) < pcapHeaderLen {
+		t.Fatalf("short pcap file: %v bytes", len(b))
+	}
+	if binary.LittleEndian.Uint32(b[0:4]) != pcapMagic ||
+		binary.LittleEndian.Uint32(b[20:24]) != pcapLinkTypeRaw {
+		t.Fatalf("bad pcap header %x", b[:pcapHeaderLen])
+	}
+	b = b[pcapHeaderLen:]
+	for len(b) >= pcapRecordHeaderLen {
+		n := int(binary.LittleEndian.Uint32(b[8:12]))
+		if len(b) < pcapRecordHeaderLen+n {
+			// record is still being written
+			break
+		}
+		records = append(records, b[pcapRecordHeaderLen:pcapRecordHeaderLen+n])
+		b = b[pcapRecordHeaderLen+n:]
+	}
+	return
+}
+
+func TestCaptureFrame(t *testing.T) {
+	payload := []byte{0xc8, 0x02, 0x00, 0x0c, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+	cases := []struct {
+		name     string
+		src, dst unix.Sockaddr
+		hdrLen   int
+		proto    uint8
+	}{
+		{
+			name:   "UDP/IPv4",
+			src:    &unix.SockaddrInet4{Addr: [4]byte{192, 0, 2, 1}, Port: 1701},
+			dst:    &unix.SockaddrInet4{Addr: [4]byte{192, 0, 2, 2}, Port: 1702},
+			hdrLen: 28,
+			proto:  unix.IPPROTO_UDP,
+		},
+		{
+			name:   "UDP/IPv6",
+			src:    &unix.SockaddrInet6{Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}, Port: 1701},
+			dst:    &unix.SockaddrInet6{Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 2}, Port: 1702},
+			hdrLen: 48,
+			proto:  unix.IPPROTO_UDP,
+		},
+		{
+			name:   "IPv4",
+			src:    &unix.SockaddrL2TPIP{Addr: [4]byte{192, 0, 2, 1}},
+			dst:    &unix.SockaddrL2TPIP{Addr: [4]byte{192, 0, 2, 2}},
+			hdrLen: 24,
+			proto:  unix.IPPROTO_L2TP,
+		},
+		{
+			name:   "IPv6",
+			src:    &unix.SockaddrL2TPIP6{Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}},
+			dst:    &unix.SockaddrL2TPIP6{Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 2}},
+			hdrLen: 44,
+			proto:  unix.IPPROTO_L2TP,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			frame, err := newCaptureFrame(c.src, c.dst, payload)
+			if err != nil {
+				t.Fatalf("newCaptureFrame(): %v", err)
+			}
+			if len(frame) != c.hdrLen+len(payload) {
+				t.Fatalf("expected frame length %v, got %v", c.hdrLen+len(payload), len(frame))
+			}
+			if string(frame[c.hdrLen:]) != string(payload) {
+				t.Errorf("payload mismatch: %x", frame[c.hdrLen:])
+			}
+
+			var proto uint8
+			var ipHdr, src, dst []byte
+			switch frame[0] >> 4 {
+			case 4:
+				ipHdr, proto, src, dst = frame[:20], frame[9], frame[12:16], frame[16:20]
+				if onesComplementSum(0, ipHdr) != 0xffff {
+					t.Errorf("bad IPv4 header checksum")
+				}
+			case 6:
+				ipHdr, proto, src, dst = frame[:40], frame[6], frame[8:24], frame[24:40]
+			default:
+				t.Fatalf("bad IP version %v", frame[0]>>4)
+			}
+			if proto != c.proto {
+				t.Errorf("expected protocol %v, got %v", c.proto, proto)
+			}
+
+			if proto == unix.IPPROTO_UDP {
+				udp := frame[len(ipHdr):]
+				sum := onesComplementSum(0, src)
+				sum = onesComplementSum(sum, dst)
+				sum = onesComplementSum(sum, []byte{0, unix.IPPROTO_UDP, udp[4], udp[5]})
+				if onesComplementSum(sum, udp) != 0xffff {
+					t.Errorf("bad UDP checksum")
+				}
+			} else if binary.BigEndian.Uint32(frame[len(ipHdr):]) != 0 {
+				t.Errorf("expected zero session ID for IP encapsulated control packet")
+			}
+		})
+	}
+
+	_, err := newCaptureFrame(&unix.SockaddrInet4{}, &unix.SockaddrInet6{}, payload)
+	if err == nil {
+		t.Errorf("newCaptureFrame(): expected error for mismatched address families")
+	}
+}
+
+func TestControlPacketCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	// t1 sends a HELLO to t2, which acknowledges it: t2 captures
+	// both packets.
+	_, err = ctx.NewQuiescentTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion2,
+		Encap:        EncapTypeUDP,
+		TunnelID:     1,
+		PeerTunnelID: 2,
+		HelloTimeout: 500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewQuiescentTunnel(t1): %v", err)
+	}
+	t2, err := ctx.NewQuiescentTunnel("t2", &TunnelConfig{
+		Local:        "127.0.0.1:5000",
+		Peer:         "127.0.0.1:6000",
+		Version:      ProtocolVersion2,
+		Encap:        EncapTypeUDP,
+		TunnelID:     2,
+		PeerTunnelID: 1,
+		CaptureFile:  path,
+	})
+	if err != nil {
+		t.Fatalf("NewQuiescentTunnel(t2): %v", err)
+	}
+
+	var records [][]byte
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile(): %v", err)
+		}
+		records = readPcapRecords(t, b)
+		if len(records) >= 2 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t2.Close()
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 capture records, got %v", len(records))
+	}
+
+	for i, expect := range []struct {
+		sport, dport uint16
+		hello        bool
+	}{
+		{sport: 6000, dport: 5000, hello: true},
+		{sport: 5000, dport: 6000, hello: false},
+	} {
+		rec := records[i]
+		if !net.IP(rec[12:16]).Equal(net.IPv4(127, 0, 0, 1)) || !net.IP(rec[16:20]).Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("record %v: unexpected addresses %v -> %v", i, net.IP(rec[12:16]), net.IP(rec[16:20]))
+		}
+		sport, dport := binary.BigEndian.Uint16(rec[20:22]), binary.BigEndian.Uint16(rec[22:24])
+		if sport != expect.sport || dport != expect.dport {
+			t.Errorf("record %v: expected ports %v -> %v, got %v -> %v",
+				i, expect.sport, expect.dport, sport, dport)
+		}
+
+		msgs, err := parseMessageBuffer(rec[28:])
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("record %v: parseMessageBuffer(): %v, %v", i, msgs, err)
+		}
+		if expect.hello {
+			if msgs[0].getType() != avpMsgTypeHello {
+				t.Errorf("record %v: expected HELLO, got %v", i, msgs[0].getType())
+			}
+		} else if len(msgs[0].getAvps()) != 0 {
+			t.Errorf("record %v: expected ZLB, got %v", i, msgs[0].getType())
+		}
+	}
+}
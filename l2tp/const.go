@@ -1,7 +1,9 @@
 package l2tp
 
 import (
+	"fmt"
 	"github.com/katalix/go-l2tp/internal/nll2tp"
+	"strings"
 	"time"
 )
 
@@ -25,6 +27,9 @@ const (
 	v2TidSidMax = ControlConnID(^uint16(0))
 )
 
+// defaultUDPPort is the well-known L2TP UDP port per RFC2661 section 8.1.
+const defaultUDPPort = 1701
+
 // EncapType is the lower-level encapsulation to use for a tunnel
 type EncapType int
 
@@ -45,6 +50,32 @@ func (e EncapType) String() string {
 	panic("unhandled encap type")
 }
 
+// AddressFamily constrains the IP address family used by a tunnel.
+type AddressFamily int
+
+const (
+	// AddressFamilyAny allows a tunnel to use either IPv4 or IPv6.
+	// If a host name resolves to both IPv4 and IPv6 addresses, an
+	// IPv4 address is preferred.
+	AddressFamilyAny AddressFamily = iota
+	// AddressFamilyIPv4 restricts a tunnel to IPv4 addresses
+	AddressFamilyIPv4
+	// AddressFamilyIPv6 restricts a tunnel to IPv6 addresses
+	AddressFamilyIPv6
+)
+
+func (af AddressFamily) String() string {
+	switch af {
+	case AddressFamilyAny:
+		return "any"
+	case AddressFamilyIPv4:
+		return "IPv4"
+	case AddressFamilyIPv6:
+		return "IPv6"
+	}
+	return fmt.Sprintf("AddressFamily(%d)", int(af))
+}
+
 // FramingCapability describes the type of framing which a peer supports.
 // It should be specified as a bitwise OR of FramingCap* values.
 type FramingCapability uint32
@@ -56,6 +87,45 @@ const (
 	FramingCapAsync = 0x2
 )
 
+func (fc FramingCapability) String() string {
+	var caps []string
+	if fc&FramingCapSync != 0 {
+		caps = append(caps, "sync")
+	}
+	if fc&FramingCapAsync != 0 {
+		caps = append(caps, "async")
+	}
+	if len(caps) == 0 {
+		return "none"
+	}
+	return strings.Join(caps, "|")
+}
+
+// BearerCapability describes the type of bearer access which a peer supports.
+// It should be specified as a bitwise OR of BearerCap* values.
+type BearerCapability uint32
+
+const (
+	// BearerCapDigital indicates digital access is supported
+	BearerCapDigital = 0x1
+	// BearerCapAnalog indicates analog access is supported
+	BearerCapAnalog = 0x2
+)
+
+func (bc BearerCapability) String() string {
+	var caps []string
+	if bc&BearerCapDigital != 0 {
+		caps = append(caps, "digital")
+	}
+	if bc&BearerCapAnalog != 0 {
+		caps = append(caps, "analog")
+	}
+	if len(caps) == 0 {
+		return "none"
+	}
+	return strings.Join(caps, "|")
+}
+
 // PseudowireType is the session type for a given session.
 // RFC2661 is PPP-only; whereas RFC3931 supports multiple types.
 type PseudowireType int
@@ -76,6 +146,8 @@ const (
 type DebugFlags uint32
 
 const (
+	// DebugFlagsDebug enables verbose logging of tunnel and session state
+	DebugFlagsDebug = nll2tp.MsgDebug
 	// DebugFlagsControl enables logging of userspace/kernelspace API interactions
 	DebugFlagsControl = nll2tp.MsgControl
 	// DebugFlagsSeq enables logging of data sequence numbers if enabled for a given session
@@ -107,8 +179,233 @@ const (
 	// TunnelTypeStatic runs no control protocol, and instantiates the data plane
 	// only.
 	TunnelTypeStatic
+	// TunnelTypePassive runs the L2TPv2 (RFC2661) or L2TPv3 (RFC3931) control
+	// protocol as the responder, waiting for the peer to initiate the tunnel.
+	TunnelTypePassive
+)
+
+// UDPChecksumMode controls the use of UDP checksums for UDP-encapsulated
+// tunnels.
+type UDPChecksumMode int
+
+const (
+	// UDPChecksumDefault leaves the tunnel socket's default checksum
+	// behaviour unchanged.
+	UDPChecksumDefault UDPChecksumMode = iota
+	// UDPChecksumEnabled enables UDP checksums.
+	UDPChecksumEnabled
+	// UDPChecksumDisabled disables UDP checksums.  For IPv6 tunnels
+	// this means transmitting and accepting packets with a zero checksum
+	// as permitted by RFC6935.
+	UDPChecksumDisabled
+)
+
+// PMTUDiscMode controls path MTU discovery for a tunnel socket.
+type PMTUDiscMode int
+
+const (
+	// PMTUDiscDefault leaves the tunnel socket's default path MTU
+	// discovery behaviour unchanged.
+	PMTUDiscDefault PMTUDiscMode = iota
+	// PMTUDiscDont disables path MTU discovery: packets are sent without
+	// the IPv4 Don't Fragment bit set, and are fragmented locally if
+	// they exceed the interface MTU.
+	PMTUDiscDont
+	// PMTUDiscWant performs path MTU discovery, but fragments packets
+	// locally if they exceed the discovered path MTU.
+	PMTUDiscWant
+	// PMTUDiscDo performs path MTU discovery, and never fragments
+	// packets locally: packets exceeding the path MTU are dropped.
+	PMTUDiscDo
+)
+
+func (m PMTUDiscMode) String() string {
+	switch m {
+	case PMTUDiscDefault:
+		return "default"
+	case PMTUDiscDont:
+		return "dont"
+	case PMTUDiscWant:
+		return "want"
+	case PMTUDiscDo:
+		return "do"
+	}
+	panic("unhandled path MTU discovery mode")
+}
+
+// CallDirection specifies which side of an L2TPv2 session places the call.
+type CallDirection int
+
+const (
+	// CallDirectionIncoming establishes the session using the incoming call
+	// message exchange (ICRQ/ICRP/ICCN) as per RFC2661 section 5.1.
+	CallDirectionIncoming CallDirection = iota
+	// CallDirectionOutgoing establishes the session using the outgoing call
+	// message exchange (OCRQ/OCRP/OCCN) as per RFC2661 section 5.2.
+	CallDirectionOutgoing
+)
+
+func (d CallDirection) String() string {
+	switch d {
+	case CallDirectionIncoming:
+		return "incoming"
+	case CallDirectionOutgoing:
+		return "outgoing"
+	}
+	panic("unhandled call direction")
+}
+
+// IDAllocStrategy specifies how a Context allocates tunnel and session
+// IDs which are not specified by the tunnel or session configuration.
+type IDAllocStrategy int
+
+const (
+	// IDAllocRandom allocates random IDs, retrying a limited number of
+	// times if a generated ID is already in use.  Random IDs make it
+	// harder for an off-path attacker to guess the IDs of a tunnel or
+	// session, but allocation may fail before the ID space is full.
+	IDAllocRandom IDAllocStrategy = iota
+	// IDAllocSequential allocates the lowest ID which is not in use.
+	// Allocation is deterministic, and fails only once every ID is
+	// in use.
+	IDAllocSequential
+)
+
+func (s IDAllocStrategy) String() string {
+	switch s {
+	case IDAllocRandom:
+		return "random"
+	case IDAllocSequential:
+		return "sequential"
+	}
+	panic("unhandled ID allocation strategy")
+}
+
+// TunnelHealthState describes the health of a tunnel's control
+// connection, as reported by Tunnel.Health.
+type TunnelHealthState int
+
+const (
+	// TunnelHealthEstablishing indicates that the control connection
+	// handshake with the peer has not yet completed.
+	TunnelHealthEstablishing TunnelHealthState = iota
+	// TunnelHealthUp indicates that the tunnel is established and the
+	// peer is responsive.
+	TunnelHealthUp
+	// TunnelHealthDegraded indicates that the tunnel is established, but
+	// nothing has been heard from the peer for more than
+	// HealthDegradedIntervals hello intervals.  This implies that at
+	// least one HELLO message has gone unacknowledged.  Tunnels with
+	// hello messages disabled are never reported as degraded.
+	TunnelHealthDegraded
+	// TunnelHealthDown indicates that the tunnel has closed or its
+	// control connection has failed.
+	TunnelHealthDown
+)
+
+// HealthDegradedIntervals is the number of hello intervals without any
+// control message from the peer after which a tunnel is reported as
+// TunnelHealthDegraded.
+const HealthDegradedIntervals = 2
+
+func (s TunnelHealthState) String() string {
+	switch s {
+	case TunnelHealthEstablishing:
+		return "establishing"
+	case TunnelHealthUp:
+		return "up"
+	case TunnelHealthDegraded:
+		return "degraded"
+	case TunnelHealthDown:
+		return "down"
+	}
+	panic("unhandled tunnel health state")
+}
+
+// TunnelHealth reports the health of a tunnel's control connection.
+type TunnelHealth struct {
+	State TunnelHealthState
+	// LastRoundTrip is the time the peer last acknowledged a control
+	// message sent by the tunnel.  It is the zero time if no message has
+	// been acknowledged, and for static tunnels, which have no control
+	// connection.
+	LastRoundTrip time.Time
+}
+
+// ProxyAuthType identifies the authentication protocol used for proxy
+// authentication as per RFC2661 section 4.4.5.
+type ProxyAuthType uint16
+
+const (
+	// ProxyAuthTypeNone indicates that no proxy authentication
+	// information is provided.  This value is reserved by RFC2661,
+	// and no Proxy Authen Type AVP is sent.
+	ProxyAuthTypeNone ProxyAuthType = iota
+	// ProxyAuthTypeText indicates textual username/password exchange
+	ProxyAuthTypeText
+	// ProxyAuthTypeCHAP indicates PPP CHAP
+	ProxyAuthTypeCHAP
+	// ProxyAuthTypePAP indicates PPP PAP
+	ProxyAuthTypePAP
+	// ProxyAuthTypeNoAuth indicates that no authentication took place
+	ProxyAuthTypeNoAuth
+	// ProxyAuthTypeMSCHAPv1 indicates Microsoft CHAP version 1
+	ProxyAuthTypeMSCHAPv1
 )
 
+// ProxyLCP describes the PPP LCP negotiation and authentication a LAC
+// has performed with the PPP peer on behalf of the LNS.  It is sent
+// to the LNS in the ICCN message of an incoming call, allowing the LNS
+// to avoid renegotiating LCP and authentication, as per RFC2661
+// section 4.4.5.
+//
+// The data is typically obtained from the PPP implementation running
+// on the LAC, and is sent as supplied without interpretation.  Fields
+// left empty are not sent.
+type ProxyLCP struct {
+	// InitialRcvdConfreq, LastSentConfreq, and LastRcvdConfreq are
+	// the LCP CONFREQ option data first received from, last sent to,
+	// and last received from the PPP peer respectively.  Each begins
+	// with the first LCP option, omitting the CONFREQ header.
+	InitialRcvdConfreq, LastSentConfreq, LastRcvdConfreq []byte
+
+	// AuthType identifies the authentication protocol used.
+	AuthType ProxyAuthType
+
+	// AuthName is the name the PPP peer authenticated as.
+	AuthName string
+
+	// AuthChallenge is the challenge sent to the PPP peer for CHAP
+	// and MS-CHAPv1 authentication.
+	AuthChallenge []byte
+
+	// AuthID is the ID of the authentication exchange for CHAP and
+	// MS-CHAPv1 authentication.  It is sent only for those
+	// authentication types.
+	AuthID uint8
+
+	// AuthResponse is the PPP peer's response to the challenge for
+	// CHAP and MS-CHAPv1 authentication, or the password for PAP
+	// and textual authentication.
+	AuthResponse []byte
+}
+
+// ACCM holds the Asynchronous Control Character Maps for an async PPP
+// link, as carried by the ACCM AVP of an L2TPv2 Set-Link-Info message
+// per RFC2661 section 4.4.6.
+//
+// Bit n of each map, counting from the least significant bit, is set
+// if control character n must be escaped, as for the PPP
+// Async-Control-Character-Map LCP option of RFC1662.
+type ACCM struct {
+	// Send is the map the recipient should use for packets it sends
+	// to the PPP peer.
+	Send uint32
+	// Recv is the map the recipient should expect for packets it
+	// receives from the PPP peer.
+	Recv uint32
+}
+
 // TunnelConfig encapsulates tunnel configuration for a single
 // connection between two L2TP hosts.  Each tunnel may contain
 // multiple sessions.
@@ -119,17 +416,56 @@ const (
 type TunnelConfig struct {
 	// The local address that the tunnel should bind its socket to.
 	// This must be specified for static and quiescent tunnels.
-	// For dynamic tunnels this can be left blank and the kernel
-	// will autobind the socket when connecting to the peer.
+	// For dynamic tunnels this can be left blank.  UDP-encapsulation
+	// tunnels left blank bind to the wildcard address, while for
+	// IP-encapsulation tunnels left blank, the source address of
+	// the kernel's route to the peer is used where it can be determined.
+	// For UDP-encapsulation tunnels the address may omit the port, in
+	// which case LocalPort is used.  Ports have no meaning for
+	// IP-encapsulation tunnels, and an address including a port is
+	// rejected.
 	Local string
 
+	// LocalPort sets the local UDP port that the tunnel should bind
+	// its socket to if Local is blank or doesn't specify a port.
+	// It has no effect for IP-encapsulated tunnels.
+	// To have the kernel choose an ephemeral port, specify port 0
+	// in Local.
+	// The default is the L2TP port, 1701.  Only one tunnel may bind to
+	// a given local address and port unless ReusePort is set, so the
+	// creation of a second tunnel using the default fails with an
+	// AddressError.
+	LocalPort uint16
+
+	// PreferredSource pins the local IP address the tunnel sends from,
+	// for hosts with several addresses where the kernel's default source
+	// address selection doesn't pick the intended one.
+	// It must be a literal IPv4 or IPv6 address, without a port.
+	// The tunnel socket is bound to the preferred source if Local is
+	// blank, or if Local gives a wildcard address such as ":1701" or
+	// "[::]:1701" to set only the port.  It is an error to specify
+	// both a preferred source and a Local address naming a host.
+	PreferredSource string
+
 	// The address of the L2TP peer to connect to.
+	// For UDP-encapsulation tunnels the address may omit the port, in
+	// which case the L2TP port, 1701, is used.  Ports have no meaning
+	// for IP-encapsulation tunnels, and an address including a port is
+	// rejected.
 	Peer string
 
 	// The encapsulation type to be used by the tunnel instance.
 	// L2TPv2 tunnels support UDP encapsulation only.
 	Encap EncapType
 
+	// AddressFamily constrains the address family used when resolving
+	// the local and peer addresses.  This allows a tunnel to
+	// consistently use one family when a host name resolves to both
+	// IPv4 and IPv6 addresses, but only one family is routable.
+	// Literal addresses of the other family are rejected.
+	// By default either family may be used.
+	AddressFamily AddressFamily
+
 	// The version of the L2TP protocol to use for the tunnel.
 	Version ProtocolVersion
 
@@ -153,6 +489,16 @@ type TunnelConfig struct {
 	// this from the default value of 4.
 	WindowSize uint16
 
+	// StopAndWait, if set, limits the L2TP reliable transport algorithm
+	// to a single control message in flight at any one time.  Sequence
+	// numbers are maintained as normal, but no further message is sent
+	// until the previous message has been acknowledged.
+	// This is a compatibility option for peers which mishandle the
+	// control channel sliding window.  WindowSize must be zero or one
+	// if StopAndWait is set.
+	// By default the transport window is opened up to WindowSize.
+	StopAndWait bool
+
 	// The amount of time to wait on receipt of a StopCCN message to allow
 	// and retransmissions to be acknowledged.
 	// The default is 31s per RFC2661 section 5.7.
@@ -172,24 +518,227 @@ type TunnelConfig struct {
 	// By default a starting retry timeout of 1000ms is used.
 	RetryTimeout time.Duration
 
+	// The ack timeout specifies how long the reliable transport algorithm
+	// will wait before explicitly acknowledging a received control message.
+	// Most control messages are implicitly acknowledged by control protocol
+	// responses, so this is only relevant when the peer's messages have
+	// no immediate response.
+	// By default an ack timeout of 100ms is used.
+	AckTimeout time.Duration
+
 	// MaxRetries sets how many times a given control message may be
 	// retried before the transport considers the message transmission to
 	// have failed.
 	// It may be useful to tune this value on unreliable network connections
 	// to avoid suprious tunnel failure, or conversely to allow for quicker
 	// tunnel failure detection on reliable links.
+	// When retries are exhausted a ControlMessageRetransmitExhaustedEvent
+	// is raised and the tunnel is torn down.
 	// The default is 3 retries.
 	MaxRetries uint
 
+	// ControlReadTimeout, if set, limits how long the tunnel will wait
+	// to receive a control packet from the peer.  If no control packet
+	// is received within the timeout the tunnel is torn down.
+	// Since a quiet tunnel may legitimately go without control traffic,
+	// the timeout should be used together with HelloTimeout and set
+	// comfortably larger than it.
+	// ControlReadTimeout is not supported for static tunnels, which have
+	// no control plane.
+	// By default control packet reads do not time out.
+	ControlReadTimeout time.Duration
+
+	// ControlWriteTimeout, if set, limits how long the tunnel will wait
+	// to write a control packet to the tunnel socket.  A write which
+	// times out is treated as a failure to send the message.
+	// ControlWriteTimeout is not supported for static tunnels, which have
+	// no control plane.
+	// By default control packet writes do not time out.
+	ControlWriteTimeout time.Duration
+
+	// EstablishTimeout, if set, limits how long a dynamic tunnel may
+	// take to complete the control connection establishment message
+	// exchange with the peer.  If the exchange hasn't completed within
+	// the timeout, the tunnel is torn down and a TunnelDownEvent is
+	// raised with Error set to ErrTunnelEstablishTimeout.
+	// EstablishTimeout is not supported for static or quiescent tunnels,
+	// which have no establishment exchange.
+	// By default the tunnel waits for establishment until its control
+	// message retransmits are exhausted.
+	EstablishTimeout time.Duration
+
+	// Persist, if set, causes a dynamic tunnel which is torn down due
+	// to a failure to be automatically re-created by its Context,
+	// along with the sessions created on it using NewSession.
+	// A tunnel closed by the user, or by the peer clearing the control
+	// connection, is not re-created.
+	// Persist is supported for dynamic tunnels only.
+	Persist bool
+
+	// ReconnectMin and ReconnectMax bound the exponential backoff used
+	// between attempts to re-create a persistent tunnel.  The delay
+	// starts at ReconnectMin and doubles on each consecutive failed
+	// attempt, up to ReconnectMax.  A random jitter is applied to each
+	// delay to avoid many tunnels reconnecting in lockstep.
+	// The defaults are 1 second and 60 seconds respectively.
+	ReconnectMin, ReconnectMax time.Duration
+
+	// ResolveInterval, if set, causes the peer address of a persistent
+	// dynamic tunnel to be periodically re-resolved at the interval
+	// specified.  This allows a tunnel whose Peer is a host name to follow
+	// the peer to a new address.  If the peer address changes the tunnel
+	// is torn down with ErrPeerAddressChanged, and then re-created by its
+	// Context using the new address.
+	// The peer address is always re-resolved when a persistent tunnel is
+	// re-created, whether or not ResolveInterval is set.
+	// ResolveInterval requires Persist to be set.
+	ResolveInterval time.Duration
+
 	// HostName sets the host name the tunnel will advertise in the
 	// Host Name AVP per RFC2661.
 	// If unset the host's name will be queried and the returned value used.
 	HostName string
 
+	// RouterID sets the router ID the tunnel will advertise in the
+	// Router ID AVP of the SCCRQ or SCCRP message per RFC3931 section
+	// 5.4.3.  It is commonly set to an IPv4 address of the host.
+	// RouterID is supported for L2TPv3 tunnels only.
+	// By default the tunnel ID is advertised as the router ID.
+	RouterID uint32
+
 	// FramingCaps sets the framing capabilites the tunnel will advertise
 	// in the Framing Capabilites AVP per RFC2661.
 	// The default is to advertise both sync and async framing.
 	FramingCaps FramingCapability
+
+	// BearerCaps sets the bearer capabilities the tunnel will advertise
+	// in the Bearer Capabilities AVP per RFC2661.
+	// By default no Bearer Capabilities AVP is sent.
+	BearerCaps BearerCapability
+
+	// DebugFlags sets the kernel debug logging flags for the tunnel
+	// data plane instance.
+	// By default no kernel debug logging is enabled.
+	DebugFlags DebugFlags
+
+	// Secret sets the shared secret used for hiding AVPs per RFC2661
+	// section 4.3.  If set, sensitive AVPs in transmitted control
+	// messages are hidden, and hidden AVPs in received control messages
+	// can be decoded.
+	// AVP hiding is currently supported for L2TPv2 tunnels only.
+	// By default no AVPs are hidden.
+	Secret string
+
+	// UDPChecksum controls the use of UDP checksums for UDP-encapsulated
+	// tunnels.  It has no effect for IP-encapsulated tunnels.
+	// By default the tunnel socket's default behaviour is used.
+	UDPChecksum UDPChecksumMode
+
+	// PMTUDisc controls path MTU discovery for the tunnel socket using
+	// IP_MTU_DISCOVER or IPV6_MTU_DISCOVER.  Since the kernel data plane
+	// shares the tunnel socket, the setting applies to data packets as
+	// well as control packets.
+	// The path MTU discovered may be read using the tunnel's PathMTU
+	// method.
+	// PMTUDisc is not supported for static tunnels, which have no
+	// userspace socket.
+	// By default the tunnel socket's default behaviour is used, which
+	// is determined by the system's ip_no_pmtu_disc setting.
+	PMTUDisc PMTUDiscMode
+
+	// Device, if set, binds the tunnel socket to the named network
+	// interface using SO_BINDTODEVICE.  This is useful on multi-homed
+	// or VRF hosts to constrain the interface tunnel traffic uses.
+	// Since the kernel data plane shares the tunnel socket, data packets
+	// are bound to the device as well as control packets.
+	// Binding to a device requires CAP_NET_RAW on older kernels.
+	// Device is not supported for static tunnels, which have no
+	// userspace socket.
+	// By default the tunnel socket is not bound to a device.
+	Device string
+
+	// DeviceIndex, if set, binds the tunnel socket to the network
+	// interface with the given index using SO_BINDTOIFINDEX.  It is an
+	// alternative to Device for callers which identify interfaces by
+	// index, e.g. from netlink, and which may wish to avoid races with
+	// interface renames.  Device and DeviceIndex cannot both be set.
+	// Binding to an interface index requires Linux 5.0 or later, and
+	// CAP_NET_RAW on older kernels.
+	// DeviceIndex is not supported for static tunnels, which have no
+	// userspace socket.
+	// By default the tunnel socket is not bound to an interface index.
+	DeviceIndex int
+
+	// IPv6FlowLabel, if set, specifies the IPv6 flow label to use for
+	// packets sent by IPv6 tunnels.  A consistent flow label allows
+	// routers using ECMP to keep a tunnel's packets on a single path.
+	// Flow labels are 20 bits, and so must be in the range 1 - 0xfffff.
+	// The flow label is leased exclusively for the tunnel socket, and
+	// applies once the socket is connected to the peer.  Since the
+	// kernel data plane shares the tunnel socket, data packets use the
+	// flow label as well as control packets.
+	// IPv6FlowLabel is not supported for static tunnels, which have no
+	// userspace socket.
+	// By default no flow label is set.
+	IPv6FlowLabel uint32
+
+	// ReusePort, if set, allows the tunnel socket to bind to a local
+	// address and port which other sockets are already bound to, using
+	// SO_REUSEADDR and SO_REUSEPORT.  This allows multiple tunnels to
+	// use the well-known L2TP port 1701 as their local port.
+	// Since SO_REUSEPORT distributes datagrams between all the sockets
+	// bound to a port which are not connected to the sender, any
+	// process running with the same effective user ID may bind to the
+	// port and receive a share of the tunnel's traffic until the tunnel
+	// socket is connected to its peer.  It should be used only where
+	// other processes running as the same user are trusted.
+	// ReusePort is not supported for static tunnels, which have no
+	// userspace socket.
+	// By default the tunnel socket does not permit port reuse.
+	ReusePort bool
+
+	// SocketPriority, if set, specifies the SO_PRIORITY value for the
+	// tunnel socket, allowing traffic control to classify the tunnel's
+	// packets.  A priority matching a tc class ID, e.g. 0x10001 for
+	// class 1:1, classifies packets directly into that class.
+	// Since the kernel and userspace data planes share the tunnel socket,
+	// data packets use the priority as well as control packets.
+	// The priority must be in the range 0 - 0xffffffff, and values
+	// outside the range 0 - 6 require CAP_NET_ADMIN.
+	// SocketPriority is not supported for static tunnels, which have no
+	// userspace socket.
+	// By default the tunnel socket's default priority of 0 is used.
+	SocketPriority int
+
+	// CaptureFile, if set, names a file to which all control packets
+	// sent and received by the tunnel are written in pcap format.
+	// IP and UDP headers are synthesised for each packet from the
+	// tunnel addresses.  The file is truncated when the tunnel is created.
+	// CaptureFile is not supported for static tunnels, which have no
+	// control plane.
+	// By default control packets are not captured.
+	CaptureFile string
+
+	// VendorAVPs lists vendor-specific AVPs to include in the SCCRQ or
+	// SCCRP message sent by a dynamic tunnel.  Each AVP must have been
+	// registered using RegisterVendorAVP.
+	// VendorAVPs is supported for dynamic and passive tunnels only.
+	// By default no vendor AVPs are sent.
+	VendorAVPs []VendorAVP
+
+	// MaxSessions limits the number of sessions the tunnel may have at
+	// any one time.  Creating a session beyond the limit fails with
+	// ErrSessionLimitReached.  The limit also applies to incoming calls
+	// answered by a passive tunnel: calls beyond the limit are refused.
+	// By default the number of sessions is not limited.
+	MaxSessions int
+
+	// IgnoreDefaults, if set, prevents the default configuration set
+	// using Context.SetDefaultTunnelConfig being applied to the tunnel.
+	// This allows a tunnel to use the zero value of a field for which
+	// the Context has a non-zero default.
+	// By default the Context's default configuration is applied.
+	IgnoreDefaults bool
 }
 
 // SessionConfig encapsulates session configuration for a pseudowire
@@ -197,7 +746,8 @@ type TunnelConfig struct {
 type SessionConfig struct {
 	// SessionID specifies the local session ID of the session.
 	// Session IDs must be unique to the tunnel for L2TPv2, or unique to
-	// the peer for L2TPv3.
+	// the host for L2TPv3.  The Context rejects L2TPv3 session IDs which
+	// are in use by a session in any of its tunnels.
 	// The session ID must be specified for sessions in static or
 	// quiescent tunnels.
 	SessionID ControlConnID
@@ -214,12 +764,17 @@ type SessionConfig struct {
 	// SeqNum, if set, enables the transmission of sequence numbers with
 	// L2TP data messages.  Use of sequence numbers enables the data plane
 	// to reorder data packets to ensure they are delivered in sequence.
+	// For dynamic sessions sequence numbers are also enabled if the peer
+	// requires them during call setup, and the peer may change its
+	// requirement for an established session using a Set-Link-Info
+	// message, in which case the session data plane is modified in place.
 	// By default sequence numbers are not used.
 	SeqNum bool
 
 	// ReorderTimeout, if set, specifies the length of time to queue out
 	// of sequence data packets before discarding them.
-	// This parameter is not currently implemented and should not be used.
+	// The timeout is passed to the kernel with millisecond granularity,
+	// and the kernel's own timer resolution then applies.
 	ReorderTimeout time.Duration
 
 	// Cookie, if set, specifies the local L2TPv3 cookie for the session.
@@ -237,16 +792,75 @@ type SessionConfig struct {
 	// By default no peer cookie is set.
 	PeerCookie []byte
 
+	// CookieCheckInterval, if set, specifies how often to poll the
+	// session data plane statistics for received data packets discarded
+	// due to a cookie mismatch.  A SessionDataErrorEvent is raised when
+	// the number of discarded packets increases.
+	// CookieCheckInterval is not supported for L2TPv2 sessions.
+	// By default the statistics are not polled.
+	CookieCheckInterval time.Duration
+
 	// InterfaceName, if set, specifies the network interface name to be
 	// used for the session instance.
 	// Setting the interface name can be useful when you need to be certain
 	// of the interface name a given session will use.
 	// By default the Linux kernel autogenerates an interface name specific to
 	// the pseudowire type, e.g. "l2tpeth0", "ppp0".
+	// The name must be valid per ValidateInterfaceName, and must not be
+	// in use by an existing interface.
 	InterfaceName string
 
+	// MTU, if set, specifies the MTU of the session network interface.
+	// This parameter applies to PseudowireTypeEth only.
+	// By default the Linux kernel chooses an MTU based on the tunnel
+	// encapsulation overhead.
+	MTU int
+
+	// Bridge, if set, specifies the name of a bridge interface to which
+	// the session network interface is attached once it is created.
+	// The interface is detached from the bridge when the session is
+	// torn down.
+	// This parameter applies to PseudowireTypeEth only.
+	// By default the session interface is not attached to a bridge.
+	Bridge string
+
+	// AdminUp, if set, brings the session network interface
+	// administratively up once it has been created and configured.
+	// This parameter applies to PseudowireTypeEth only.
+	// By default the interface is left down.
+	AdminUp bool
+
+	// Address, if set, specifies an IP address and prefix length in
+	// CIDR notation, e.g. "192.0.2.1/24", to assign to the session
+	// network interface.  The address is removed along with the
+	// interface when the session is torn down.
+	// This parameter applies to PseudowireTypeEth only.
+	// By default no address is assigned.
+	Address string
+
+	// PeerAddress, if set, specifies the IP address of the remote end
+	// of a point-to-point link, in which case Address is assigned as the
+	// local end of the link and its prefix length applies to the peer
+	// address.  PeerAddress requires Address to be set, and must be of
+	// the same address family.
+	// This parameter applies to PseudowireTypeEth only.
+	PeerAddress string
+
+	// DrainTimeout, if set, specifies how long to allow packets queued
+	// on the session network interface to drain when the session is torn
+	// down.  The interface is brought down, the drain timeout allowed to
+	// elapse, and then the session data plane is deleted.  When a tunnel
+	// is torn down the interfaces of all its sessions are brought down
+	// together, so that the drain timeouts elapse concurrently.
+	// Draining requires a data plane implementing SessionDataPlaneDrainer.
+	// This parameter applies to PseudowireTypeEth only.
+	// By default the session data plane is deleted immediately.
+	DrainTimeout time.Duration
+
 	// L2SpecType specifies the L2TPv3 Layer 2 specific sublayer field to
 	// be used in data packet headers as per RFC3931 section 3.2.2.
+	// The length of the sublayer is derived from its type.
+	// L2SpecType is not supported for L2TPv2 sessions.
 	// By default no Layer 2 specific sublayer is used.
 	L2SpecType L2SpecType
 
@@ -257,4 +871,72 @@ type SessionConfig struct {
 	// PPPoEPeerMac specifies the MAC address of the PPPoE peer.
 	// This parameter applies to PseudowireTypePPPAC only.
 	PPPoEPeerMac [6]byte
+
+	// DebugFlags sets the kernel debug logging flags for the session
+	// data plane instance.
+	// By default no kernel debug logging is enabled.
+	DebugFlags DebugFlags
+
+	// CallDirection specifies whether a session in a dynamic L2TPv2
+	// tunnel is established as an incoming or an outgoing call.
+	// By default sessions are established as incoming calls.
+	CallDirection CallDirection
+
+	// CalledNumber specifies the number to be dialed by the peer for
+	// an outgoing call.  It is sent in the Called Number AVP of the OCRQ
+	// message, and applies to CallDirectionOutgoing only.
+	CalledNumber string
+
+	// BearerType, if set, specifies the bearer type of the call for a
+	// session in a dynamic L2TPv2 tunnel.  It is sent in the Bearer Type
+	// AVP of the ICRQ or OCRQ message, and should be specified as a
+	// bitwise OR of BearerCap* values.
+	// By default no Bearer Type AVP is sent for incoming calls, and
+	// outgoing calls permit both digital and analog bearers.
+	BearerType BearerCapability
+
+	// MinimumBPS and MaximumBPS specify the lowest and highest line
+	// speeds in bits per second acceptable for an outgoing call in an
+	// L2TPv2 tunnel.  They are sent in the Minimum BPS and Maximum BPS
+	// AVPs of the OCRQ message.
+	// By default any line speed is acceptable: MinimumBPS is zero, and
+	// a MaximumBPS of zero sends the largest possible value.
+	MinimumBPS uint32
+	MaximumBPS uint32
+
+	// FramingType, if set, specifies the framing type of the call for a
+	// session in a dynamic L2TPv2 tunnel.  It is sent in the Framing Type
+	// AVP of the OCRQ, OCCN and ICCN messages, and should be specified
+	// as a bitwise OR of FramingCap* values.
+	// By default both synchronous and asynchronous framing are reported.
+	FramingType FramingCapability
+
+	// PhysicalChannelID, if set, specifies the physical channel ID of the
+	// call for a session in a dynamic tunnel.  It is sent to the peer in
+	// the Physical Channel ID AVP of the ICRQ message.
+	// By default no Physical Channel ID AVP is sent.
+	PhysicalChannelID uint32
+
+	// RemoteEndID, if set, identifies the pseudowire to the peer for a
+	// session in a dynamic L2TPv3 tunnel.  It is sent to the peer in the
+	// Remote End ID AVP of the ICRQ message per RFC3931 section 5.4.4.
+	// RemoteEndID is supported for L2TPv3 sessions only.
+	// By default an empty Remote End ID AVP is sent.
+	RemoteEndID []byte
+
+	// TxConnectSpeed and RxConnectSpeed, if set, specify the transmit
+	// and receive connect speeds of the call in bits per second for a
+	// session in a dynamic tunnel.  They are sent to the peer in the
+	// connect speed AVPs of the ICCN message, and are commonly used
+	// for accounting.
+	// By default an L2TPv2 ICCN message reports a (Tx) Connect Speed
+	// of zero, and no other connect speed AVPs are sent.
+	TxConnectSpeed uint32
+	RxConnectSpeed uint32
+
+	// ProxyLCP, if set, provides proxy LCP and authentication
+	// information to be sent in the ICCN message of an incoming call
+	// in an L2TPv2 tunnel.  It applies to CallDirectionIncoming only.
+	// By default no proxy LCP or authentication information is sent.
+	ProxyLCP *ProxyLCP
 }
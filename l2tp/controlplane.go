@@ -1,37 +1,134 @@
 package l2tp
 
 import (
+	"encoding/binary"
 	"fmt"
 	"os"
 	"syscall"
+	"time"
+	"unsafe"
 
+	"github.com/mdlayher/netlink/nlenc"
 	"golang.org/x/sys/unix"
 )
 
+// IPv6 flow label definitions from linux/in6.h, which are not
+// provided by golang.org/x/sys/unix.
+const (
+	ipv6FlowInfo          = 11
+	ipv6FlowLabelMgr      = 32
+	ipv6FlowInfoSend      = 33
+	ipv6FlowLabelMask     = 0x000fffff
+	ipv6FlActionGet       = 0
+	ipv6FlShareExclusive  = 1
+	ipv6FlFlagCreate      = 1
+	sizeofIn6FlowlabelReq = 32
+)
+
 type controlPlane struct {
 	local, remote unix.Sockaddr
 	fd            int
 	file          *os.File
 	rc            syscall.RawConn
 	connected     bool
+	closed        bool
+	capture       *pcapWriter
+	captureFile   *os.File
+	flowLabel     uint32
+	pending       []*rawMsg
 }
 
 func (cp *controlPlane) recvFrom(p []byte) (n int, addr unix.Sockaddr, err error) {
+	if len(cp.pending) > 0 {
+		m := cp.pending[0]
+		cp.pending = cp.pending[1:]
+		n = copy(p, m.b)
+		cp.capturePacket(m.sa, nil, p[:n])
+		return n, m.sa, nil
+	}
 	cerr := cp.rc.Read(func(fd uintptr) bool {
 		n, addr, err = unix.Recvfrom(int(fd), p, unix.MSG_NOSIGNAL)
 		return err != unix.EAGAIN && err != unix.EWOULDBLOCK
 	})
+	// A deadline expiring is reported by the RawConn, leaving the
+	// last EAGAIN from the callback in err.
+	if cerr != nil {
+		return n, addr, cerr
+	}
 	if err != nil {
 		return n, addr, err
 	}
-	return n, addr, cerr
+	cp.capturePacket(addr, nil, p[:n])
+	return n, addr, nil
+}
+
+// unread queues a frame to be returned by recvFrom ahead of frames
+// read from the socket.  It must not be called concurrently with
+// recvFrom.
+func (cp *controlPlane) unread(m *rawMsg) {
+	cp.pending = append(cp.pending, m)
 }
 
 func (cp *controlPlane) write(b []byte) (n int, err error) {
 	if cp.connected {
-		return cp.file.Write(b)
+		n, err = cp.file.Write(b)
+	} else {
+		n, err = cp.writeTo(b, cp.remote)
+	}
+	if err == nil {
+		cp.capturePacket(nil, cp.remote, b)
+	}
+	return
+}
+
+// setReadDeadline sets the deadline for the next socket read.
+// The zero time means reads do not time out.
+func (cp *controlPlane) setReadDeadline(t time.Time) error {
+	return cp.file.SetReadDeadline(t)
+}
+
+// setWriteDeadline sets the deadline for the next socket write.
+// The zero time means writes do not time out.
+func (cp *controlPlane) setWriteDeadline(t time.Time) error {
+	return cp.file.SetWriteDeadline(t)
+}
+
+// startCapture writes all control packets subsequently sent or
+// received by the control plane to a pcap file at path.
+func (cp *controlPlane) startCapture(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open capture file: %v", err)
 	}
-	return cp.writeTo(b, cp.remote)
+	pw, err := newPcapWriter(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	cp.captureFile = file
+	cp.capture = pw
+	return nil
+}
+
+// capturePacket records a control packet if capture is enabled.
+// A nil source or destination address is the socket's local address.
+// Capture is a diagnostic aid, so failures are not reported.
+func (cp *controlPlane) capturePacket(src, dst unix.Sockaddr, b []byte) {
+	if cp.capture == nil {
+		return
+	}
+	if src == nil || dst == nil {
+		local, err := unix.Getsockname(cp.fd)
+		if err != nil {
+			return
+		}
+		if src == nil {
+			src = local
+		} else {
+			dst = local
+		}
+	}
+	cp.capture.writePacket(time.Now(), src, dst, b)
 }
 
 func (cp *controlPlane) writeTo(p []byte, addr unix.Sockaddr) (n int, err error) {
@@ -43,22 +140,31 @@ func (cp *controlPlane) sendto(p []byte, to unix.Sockaddr) (err error) {
 		err = unix.Sendto(int(fd), p, unix.MSG_NOSIGNAL, to)
 		return err != unix.EAGAIN && err != unix.EWOULDBLOCK
 	})
-	if err != nil {
-		return err
+	if cerr != nil {
+		return cerr
 	}
-	return cerr
+	return err
 }
 
 func (cp *controlPlane) close() (err error) {
-	if cp.file != nil {
+	if !cp.closed {
 		err = cp.file.Close()
-		cp.file = nil
+		cp.closed = true
+	}
+	if cp.captureFile != nil {
+		cp.captureFile.Close()
+		cp.captureFile = nil
 	}
 	return
 }
 
 func (cp *controlPlane) connect() error {
-	err := unix.Connect(cp.fd, cp.remote)
+	var err error
+	if cp.flowLabel != 0 {
+		err = connectWithFlowLabel(cp.fd, cp.remote, cp.flowLabel)
+	} else {
+		err = unix.Connect(cp.fd, cp.remote)
+	}
 	if err == nil {
 		cp.connected = true
 	}
@@ -74,6 +180,222 @@ func (cp *controlPlane) bind() error {
 	return unix.Bind(cp.fd, cp.local)
 }
 
+// setUDPChecksum configures UDP checksum use for a UDP tunnel socket.
+// It has no effect for IP-encapsulated tunnel sockets.
+func (cp *controlPlane) setUDPChecksum(mode UDPChecksumMode) error {
+	if mode == UDPChecksumDefault {
+		return nil
+	}
+
+	noCheck := 0
+	if mode == UDPChecksumDisabled {
+		noCheck = 1
+	}
+
+	switch cp.local.(type) {
+	case *unix.SockaddrInet4:
+		return unix.SetsockoptInt(cp.fd, unix.SOL_SOCKET, unix.SO_NO_CHECK, noCheck)
+	case *unix.SockaddrInet6:
+		err := unix.SetsockoptInt(cp.fd, unix.IPPROTO_UDP, unix.UDP_NO_CHECK6_TX, noCheck)
+		if err != nil {
+			return err
+		}
+		return unix.SetsockoptInt(cp.fd, unix.IPPROTO_UDP, unix.UDP_NO_CHECK6_RX, noCheck)
+	}
+	return nil
+}
+
+// setPMTUDisc configures path MTU discovery for the tunnel socket.
+// It has no effect if the mode is PMTUDiscDefault.
+func (cp *controlPlane) setPMTUDisc(mode PMTUDiscMode) error {
+	if mode == PMTUDiscDefault {
+		return nil
+	}
+
+	var v4, v6 int
+	switch mode {
+	case PMTUDiscDont:
+		v4, v6 = unix.IP_PMTUDISC_DONT, unix.IPV6_PMTUDISC_DONT
+	case PMTUDiscWant:
+		v4, v6 = unix.IP_PMTUDISC_WANT, unix.IPV6_PMTUDISC_WANT
+	case PMTUDiscDo:
+		v4, v6 = unix.IP_PMTUDISC_DO, unix.IPV6_PMTUDISC_DO
+	default:
+		return fmt.Errorf("unrecognised path MTU discovery mode %v", int(mode))
+	}
+
+	var err error
+	if sockaddrFamily(cp.local) == unix.AF_INET6 {
+		err = unix.SetsockoptInt(cp.fd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, v6)
+	} else {
+		err = unix.SetsockoptInt(cp.fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, v4)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set path MTU discovery mode %v: %v", mode, err)
+	}
+	return nil
+}
+
+// pathMTU returns the path MTU the kernel has discovered for the
+// tunnel socket's peer.  The socket must be connected.
+func (cp *controlPlane) pathMTU() (mtu int, err error) {
+	if !cp.connected {
+		return 0, fmt.Errorf("tunnel socket is not connected")
+	}
+	cerr := cp.rc.Control(func(fd uintptr) {
+		if sockaddrFamily(cp.local) == unix.AF_INET6 {
+			mtu, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU)
+		} else {
+			mtu, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU)
+		}
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read path MTU: %v", err)
+	}
+	return mtu, nil
+}
+
+// bindToDevice binds the tunnel socket to the named network interface.
+// It has no effect if the device name is empty.
+func (cp *controlPlane) bindToDevice(dev string) error {
+	if dev == "" {
+		return nil
+	}
+	err := unix.SetsockoptString(cp.fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, dev)
+	if err == unix.EPERM {
+		return fmt.Errorf("failed to bind to device %q: %v (CAP_NET_RAW is required)", dev, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to bind to device %q: %v", dev, err)
+	}
+	return nil
+}
+
+// bindToIfindex binds the tunnel socket to the network interface with
+// the given index.
+// It has no effect if the index is zero.
+func (cp *controlPlane) bindToIfindex(index int) error {
+	if index == 0 {
+		return nil
+	}
+	err := unix.SetsockoptInt(cp.fd, unix.SOL_SOCKET, unix.SO_BINDTOIFINDEX, index)
+	if err == unix.EPERM {
+		return fmt.Errorf("failed to bind to interface index %v: %v (CAP_NET_RAW is required)", index, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to bind to interface index %v: %v", index, err)
+	}
+	return nil
+}
+
+// setReusePort allows the tunnel socket to bind to a local address
+// and port already in use by other sockets, using SO_REUSEADDR and
+// SO_REUSEPORT.
+// It has no effect if enable is false.
+func (cp *controlPlane) setReusePort(enable bool) error {
+	if !enable {
+		return nil
+	}
+	err := unix.SetsockoptInt(cp.fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	if err != nil {
+		return fmt.Errorf("failed to set SO_REUSEADDR: %v", err)
+	}
+	err = unix.SetsockoptInt(cp.fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	if err != nil {
+		return fmt.Errorf("failed to set SO_REUSEPORT: %v", err)
+	}
+	return nil
+}
+
+// setPriority sets the SO_PRIORITY value for the tunnel socket.
+// It has no effect if the priority is zero.
+func (cp *controlPlane) setPriority(prio int) error {
+	if prio == 0 {
+		return nil
+	}
+	err := unix.SetsockoptInt(cp.fd, unix.SOL_SOCKET, unix.SO_PRIORITY, prio)
+	if err != nil {
+		return fmt.Errorf("failed to set SO_PRIORITY: %v", err)
+	}
+	return nil
+}
+
+// setIPv6FlowLabel leases an IPv6 flow label for the tunnel socket
+// and enables its use for transmitted packets.  Since the flow label
+// is set when the socket is connected, it is only applied once the
+// socket is connected to the peer.
+// It has no effect if the flow label is zero.
+func (cp *controlPlane) setIPv6FlowLabel(label uint32) error {
+	if label == 0 {
+		return nil
+	}
+	if label&^ipv6FlowLabelMask != 0 {
+		return fmt.Errorf("IPv6 flow label %#x out of range", label)
+	}
+
+	var dst [16]byte
+	switch sa := cp.remote.(type) {
+	case *unix.SockaddrInet6:
+		dst = sa.Addr
+	case *unix.SockaddrL2TPIP6:
+		dst = sa.Addr
+	default:
+		return fmt.Errorf("IPv6 flow label is supported for IPv6 tunnels only")
+	}
+
+	// struct in6_flowlabel_req
+	req := make([]byte, sizeofIn6FlowlabelReq)
+	copy(req[0:16], dst[:])
+	binary.BigEndian.PutUint32(req[16:20], label)
+	req[20] = ipv6FlActionGet
+	req[21] = ipv6FlShareExclusive
+	nlenc.PutUint16(req[22:24], ipv6FlFlagCreate)
+
+	err := unix.SetsockoptString(cp.fd, unix.IPPROTO_IPV6, ipv6FlowLabelMgr, string(req))
+	if err != nil {
+		return fmt.Errorf("failed to lease IPv6 flow label %#x: %v", label, err)
+	}
+	err = unix.SetsockoptInt(cp.fd, unix.IPPROTO_IPV6, ipv6FlowInfoSend, 1)
+	if err != nil {
+		return fmt.Errorf("failed to enable IPv6 flow label: %v", err)
+	}
+	cp.flowLabel = label
+	return nil
+}
+
+// connectWithFlowLabel connects an IPv6 socket, setting the flow label
+// in the peer address.  This is needed since unix.SockaddrInet6 and
+// unix.SockaddrL2TPIP6 have no flow info field.
+func connectWithFlowLabel(fd int, sa unix.Sockaddr, label uint32) error {
+	var b []byte
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet6:
+		// struct sockaddr_in6
+		b = make([]byte, unix.SizeofSockaddrInet6)
+		binary.BigEndian.PutUint16(b[2:4], uint16(sa.Port))
+		copy(b[8:24], sa.Addr[:])
+		nlenc.PutUint32(b[24:28], sa.ZoneId)
+	case *unix.SockaddrL2TPIP6:
+		// struct sockaddr_l2tpip6
+		b = make([]byte, unix.SizeofSockaddrL2TPIP6)
+		copy(b[8:24], sa.Addr[:])
+		nlenc.PutUint32(b[24:28], sa.ZoneId)
+		nlenc.PutUint32(b[28:32], sa.ConnId)
+	default:
+		return fmt.Errorf("IPv6 flow label is supported for IPv6 tunnels only")
+	}
+	nlenc.PutUint16(b[0:2], unix.AF_INET6)
+	binary.BigEndian.PutUint32(b[4:8], label&ipv6FlowLabelMask)
+
+	_, _, errno := unix.Syscall(unix.SYS_CONNECT, uintptr(fd),
+		uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
 func tunnelSocket(family, protocol int) (fd int, err error) {
 
 	fd, err = unix.Socket(family, unix.SOCK_DGRAM, protocol)
@@ -143,3 +465,74 @@ func newL2tpControlPlane(localAddr, remoteAddr unix.Sockaddr) (*controlPlane, er
 		connected: false,
 	}, nil
 }
+
+// newL2tpControlPlaneFromFD creates a control plane using a duplicate of
+// an existing tunnel socket, which must be a connected UDP or L2TP/IP
+// datagram socket.
+func newL2tpControlPlaneFromFD(fd int) (*controlPlane, error) {
+
+	sotype, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query socket type: %v", err)
+	}
+	if sotype != unix.SOCK_DGRAM {
+		return nil, fmt.Errorf("socket type %v is not SOCK_DGRAM", sotype)
+	}
+
+	family, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query socket family: %v", err)
+	}
+	if family != unix.AF_INET && family != unix.AF_INET6 {
+		return nil, fmt.Errorf("socket family %v is not AF_INET or AF_INET6", family)
+	}
+
+	protocol, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PROTOCOL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query socket protocol: %v", err)
+	}
+	if protocol != unix.IPPROTO_UDP && protocol != unix.IPPROTO_L2TP {
+		return nil, fmt.Errorf("socket protocol %v is not UDP or L2TP", protocol)
+	}
+
+	localAddr, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query socket local address: %v", err)
+	}
+
+	remoteAddr, err := unix.Getpeername(fd)
+	if err != nil {
+		if err == unix.ENOTCONN {
+			return nil, fmt.Errorf("socket is not connected")
+		}
+		return nil, fmt.Errorf("failed to query socket peer address: %v", err)
+	}
+
+	newfd, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("fcntl(F_DUPFD_CLOEXEC): %v", err)
+	}
+
+	// This also changes the mode of the caller's fd, since O_NONBLOCK
+	// applies to the open file description shared with the duplicate
+	if err = unix.SetNonblock(newfd, true); err != nil {
+		unix.Close(newfd)
+		return nil, fmt.Errorf("failed to set socket nonblocking: %v", err)
+	}
+
+	file := os.NewFile(uintptr(newfd), "l2tp")
+	sc, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &controlPlane{
+		local:     localAddr,
+		remote:    remoteAddr,
+		fd:        newfd,
+		file:      file,
+		rc:        sc,
+		connected: true,
+	}, nil
+}
@@ -0,0 +1,139 @@
+package l2tp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// cookieMonitor periodically polls the data plane statistics of an
+// L2TPv3 session, and raises a SessionDataErrorEvent when the number of
+// received data packets discarded due to a cookie mismatch increases.
+type cookieMonitor struct {
+	logger   log.Logger
+	parent   tunnel
+	s        session
+	ifname   string
+	interval time.Duration
+	discards uint64
+	stopChan chan interface{}
+	wg       sync.WaitGroup
+	// lock guards stopped and delivering, which allow stop to be
+	// called while the monitor is raising an event
+	lock       sync.Mutex
+	stopped    bool
+	delivering bool
+}
+
+// startCookieMonitor starts monitoring a session which has been brought
+// up.  It returns nil if the session configuration doesn't request
+// monitoring.
+func startCookieMonitor(logger log.Logger, parent tunnel, s session, ifname string) *cookieMonitor {
+	interval := s.getCfg().CookieCheckInterval
+	if interval <= 0 || parent.getCfg().Version != ProtocolVersion3 {
+		return nil
+	}
+	cm := &cookieMonitor{
+		logger:   logger,
+		parent:   parent,
+		s:        s,
+		ifname:   ifname,
+		interval: interval,
+		stopChan: make(chan interface{}),
+	}
+	cm.wg.Add(1)
+	go cm.run()
+	return cm
+}
+
+// stop stops monitoring the session, and blocks until the monitor
+// goroutine has exited.  It is safe to call on a nil monitor.
+//
+// If the monitor is raising a SessionDataErrorEvent, stop doesn't wait,
+// since an event handler may close the session in response: the
+// monitor goroutine exits once the event handlers have returned.
+func (cm *cookieMonitor) stop() {
+	if cm != nil {
+		cm.lock.Lock()
+		cm.stopped = true
+		delivering := cm.delivering
+		cm.lock.Unlock()
+
+		close(cm.stopChan)
+		if !delivering {
+			cm.wg.Wait()
+		}
+	}
+}
+
+func (cm *cookieMonitor) run() {
+	defer cm.wg.Done()
+
+	ticker := time.NewTicker(cm.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cm.stopChan:
+			return
+		case <-ticker.C:
+			cm.check()
+		}
+		// Prefer stopping to polling again, e.g. if an event handler
+		// closed the session
+		select {
+		case <-cm.stopChan:
+			return
+		default:
+		}
+	}
+}
+
+func (cm *cookieMonitor) check() {
+	stats, err := cm.s.GetStatistics()
+	if err != nil {
+		level.Warn(cm.logger).Log(
+			"message", "failed to poll session statistics",
+			"error", err)
+		return
+	}
+	// The count may go backwards if the data plane is re-created
+	if stats.RxCookieDiscards <= cm.discards {
+		cm.discards = stats.RxCookieDiscards
+		return
+	}
+
+	ev := &SessionDataErrorEvent{
+		TunnelName:          cm.parent.getName(),
+		Tunnel:              cm.parent,
+		TunnelConfig:        cm.parent.getCfg(),
+		SessionName:         cm.s.getName(),
+		Session:             cm.s,
+		SessionConfig:       cm.s.getCfg(),
+		InterfaceName:       cm.ifname,
+		RxCookieDiscards:    stats.RxCookieDiscards,
+		NewRxCookieDiscards: stats.RxCookieDiscards - cm.discards,
+	}
+	cm.discards = stats.RxCookieDiscards
+
+	level.Warn(cm.logger).Log(
+		"message", "data packets discarded due to cookie mismatch",
+		"rx_cookie_discards", ev.RxCookieDiscards,
+		"new_rx_cookie_discards", ev.NewRxCookieDiscards)
+
+	cm.lock.Lock()
+	if cm.stopped {
+		cm.lock.Unlock()
+		return
+	}
+	cm.delivering = true
+	cm.lock.Unlock()
+
+	cm.parent.handleUserEvent(ev)
+
+	cm.lock.Lock()
+	cm.delivering = false
+	cm.lock.Unlock()
+}
@@ -22,10 +22,11 @@ Currently package l2tp implements:
 
  * support for controlling the Linux L2TP data plane for L2TPv2 and
    L2TPv3 tunnels and sessions,
- * the L2TPv2 control plane for client/LAC mode.
+ * the L2TPv2 control plane for client/LAC mode,
+ * the L2TPv3 control plane for client/LAC mode, supporting incoming
+   calls only.
 
-In the future we plan to add support for the L2TPv3 control plane, and
-server/LNS mode.
+In the future we plan to add support for server/LNS mode.
 
 Usage
 
@@ -71,6 +72,18 @@ acknowledged using the L2TP reliable transport algorithm.  This slight extension
 allows for detection of tunnel failure in an otherwise static setup.
 
 The final tunnel type is the dynamic tunnel.  This runs the full L2TP control protocol.
+A dynamic tunnel may also be created as a passive tunnel, which waits for
+the peer to initiate the control connection rather than initiating it itself.
+A passive tunnel answers incoming calls placed by the peer.
+A TunnelListener creates passive tunnels for peers connecting to a single
+local address.
+
+Adopting tunnels
+
+A Context can take ownership of tunnel and session instances which are already
+present in the Linux kernel, for example those left behind by a previous process,
+without recreating them.  Context.ExportTunnels enumerates the kernel instances,
+and Context.AdoptTunnel adopts them.  Adopted tunnels behave as static tunnels.
 
 Configuration
 
@@ -0,0 +1,133 @@
+package l2tp
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTunnelNameExists is returned when creating a tunnel using a name
+	// which is already in use in the Context.
+	ErrTunnelNameExists = errors.New("already have tunnel")
+
+	// ErrTunnelIDExists is returned when creating a tunnel using a tunnel
+	// ID which is already in use in the Context.
+	ErrTunnelIDExists = errors.New("already have tunnel with TID")
+
+	// ErrSessionNameExists is returned when creating a session using a name
+	// which is already in use in the parent tunnel.
+	ErrSessionNameExists = errors.New("already have session")
+
+	// ErrSessionIDExists is returned when creating a session using a session
+	// ID which is already in use.  L2TPv2 session IDs must be unique to the
+	// parent tunnel, while L2TPv3 session IDs must be unique to the Context.
+	ErrSessionIDExists = errors.New("already have session with SID")
+
+	// ErrInvalidSessionConfig is returned when creating a session using
+	// a configuration which is not valid for the parent tunnel.
+	ErrInvalidSessionConfig = errors.New("invalid session config")
+
+	// ErrIDSpaceExhausted is returned when a tunnel or session ID could
+	// not be allocated because no free ID was found.
+	ErrIDSpaceExhausted = errors.New("ID space exhausted")
+
+	// ErrAddressFamilyMismatch is returned when creating a tunnel whose
+	// local and peer addresses are of different address families.
+	ErrAddressFamilyMismatch = errors.New("address family mismatch")
+
+	// ErrTunnelEstablishTimeout is reported in the TunnelDownEvent raised
+	// when a dynamic tunnel fails to establish within the timeout set by
+	// TunnelConfig.EstablishTimeout.
+	ErrTunnelEstablishTimeout = errors.New("tunnel establishment timed out")
+
+	// ErrPeerAddressChanged is reported in the TunnelDownEvent raised
+	// when a persistent dynamic tunnel is torn down in order to migrate
+	// to a new peer address, c.f. TunnelConfig.ResolveInterval.
+	ErrPeerAddressChanged = errors.New("peer address changed")
+
+	// ErrTunnelClosed is returned by Tunnel.WaitUp when the tunnel is
+	// closed, either by the user or by the peer clearing the control
+	// connection.
+	ErrTunnelClosed = errors.New("tunnel closed")
+
+	// ErrTunnelKilled is reported in the TunnelDownEvent raised when a
+	// dynamic tunnel is torn down by Context.CloseWithTimeout because it
+	// failed to close within the timeout.
+	ErrTunnelKilled = errors.New("tunnel killed")
+
+	// ErrListenerClosed is returned by TunnelListener.Accept when the
+	// listener is closed.
+	ErrListenerClosed = errors.New("listener closed")
+
+	// ErrTunnelLimitReached is returned when creating a tunnel would
+	// exceed the Context's limits on the number of tunnels, c.f.
+	// WithMaxTunnels and WithMaxTunnelsPerPeer.
+	ErrTunnelLimitReached = errors.New("tunnel limit reached")
+
+	// ErrSessionLimitReached is returned when creating a session would
+	// exceed the parent tunnel's limit on the number of sessions, c.f.
+	// TunnelConfig.MaxSessions.
+	ErrSessionLimitReached = errors.New("session limit reached")
+
+	// ErrAdoptionNotSupported is returned by Context.ExportTunnels and
+	// Context.AdoptTunnel when the Context's data plane cannot enumerate
+	// and adopt existing tunnel instances.
+	ErrAdoptionNotSupported = errors.New("data plane does not support tunnel adoption")
+
+	// ErrModifyNotSupported is returned by Session.Modify when the
+	// session's data plane does not implement SessionDataPlaneModifier.
+	ErrModifyNotSupported = errors.New("data plane does not support session modification")
+
+	// ErrDebugFlagsNotSupported is returned by Tunnel.SetDebugFlags when
+	// the tunnel's data plane does not implement TunnelDataPlaneDebugger.
+	ErrDebugFlagsNotSupported = errors.New("data plane does not support changing debug flags")
+)
+
+// StopCCNError is the TunnelDownEvent error when a tunnel is torn down
+// by a StopCCN message whose Result Code AVP indicates an error, rather
+// than a general request to clear the control connection.
+type StopCCNError struct {
+	// Local is true if the StopCCN was sent to the peer, and false if
+	// it was received from the peer.
+	Local bool
+	// ResultCode and ErrorCode are the codes from the Result Code AVP.
+	ResultCode, ErrorCode uint16
+	// Message is the optional error message from the Result Code AVP.
+	Message string
+}
+
+func (e *StopCCNError) Error() string {
+	rc := stopccnResultCodeToString(&resultCode{
+		result:  avpResultCode(e.ResultCode),
+		errCode: avpErrorCode(e.ErrorCode),
+		errMsg:  e.Message,
+	})
+	if e.Local {
+		return fmt.Sprintf("sent StopCCN: %s", rc)
+	}
+	return fmt.Sprintf("received StopCCN: %s", rc)
+}
+
+// AddressError is returned when a tunnel address cannot be resolved
+// or used.
+type AddressError struct {
+	// Address is the address string from the tunnel configuration.
+	Address string
+	// Local is true for the tunnel local address, and false for
+	// the tunnel peer address.
+	Local bool
+	// Err is the underlying cause of the error.
+	Err error
+}
+
+func (e *AddressError) Error() string {
+	if e.Local {
+		return fmt.Sprintf("local address %q: %v", e.Address, e.Err)
+	}
+	return fmt.Sprintf("remote address %q: %v", e.Address, e.Err)
+}
+
+// Unwrap returns the underlying cause of the error.
+func (e *AddressError) Unwrap() error {
+	return e.Err
+}
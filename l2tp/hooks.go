@@ -0,0 +1,133 @@
+package l2tp
+
+import (
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// DataPlaneHookInfo describes the tunnel or session instance a
+// DataPlaneHook is called for.
+//
+// The negotiated tunnel and session IDs are available from the
+// TunnelID, PeerTunnelID, SessionID, and PeerSessionID fields of the
+// tunnel and session configurations.
+type DataPlaneHookInfo struct {
+	TunnelName   string
+	Tunnel       Tunnel
+	TunnelConfig *TunnelConfig
+	// SessionName, Session, and SessionConfig are set for session
+	// hooks only.
+	SessionName   string
+	Session       Session
+	SessionConfig *SessionConfig
+	// InterfaceName is set for session hooks which are called while
+	// the session data plane is instantiated, i.e. PostDataPlaneUp and
+	// PreDataPlaneDown.
+	InterfaceName string
+}
+
+// DataPlaneHook is a function called at a point in the data plane
+// lifecycle of a tunnel or session instance.
+type DataPlaneHook func(info *DataPlaneHookInfo) error
+
+// DataPlaneHooks is a set of functions called by a Context at points in
+// the lifecycle of the tunnel and session data planes.
+//
+// Hooks are called synchronously from the goroutine creating or tearing
+// down the instance, so should complete promptly.  Any hook may be nil.
+type DataPlaneHooks struct {
+	// PreDataPlaneUp is called immediately before a data plane
+	// instance is created.  For dynamic tunnels and sessions this is
+	// once the control protocol has negotiated the instance's IDs.
+	PreDataPlaneUp DataPlaneHook
+	// PostDataPlaneUp is called immediately after a data plane
+	// instance has been created.
+	PostDataPlaneUp DataPlaneHook
+	// PreDataPlaneDown is called immediately before a data plane
+	// instance is torn down.
+	PreDataPlaneDown DataPlaneHook
+	// AbortOnError determines how errors returned by PreDataPlaneUp
+	// and PostDataPlaneUp are handled.  By default hook errors are
+	// logged and otherwise ignored.  If AbortOnError is set, a hook
+	// error also aborts creation of the tunnel or session.
+	//
+	// Errors returned by PreDataPlaneDown are always logged only.
+	AbortOnError bool
+}
+
+// WithDataPlaneHooks sets functions for the Context to call at points
+// in the lifecycle of the tunnel and session data planes it creates.
+//
+// This may be used to run custom logic keyed on the negotiated tunnel
+// and session IDs, e.g. to program firewall rules for a session.
+func WithDataPlaneHooks(hooks DataPlaneHooks) ContextOption {
+	return func(ctx *Context) {
+		ctx.hooks = hooks
+	}
+}
+
+// runHook calls a data plane hook, if set.  Hook errors are logged,
+// and returned only if the hooks are configured to abort on error.
+func (ctx *Context) runHook(logger log.Logger, name string, hook DataPlaneHook, info *DataPlaneHookInfo) error {
+	if hook == nil {
+		return nil
+	}
+	err := hook(info)
+	if err == nil {
+		return nil
+	}
+	level.Error(logger).Log(
+		"message", "data plane hook failed",
+		"hook", name,
+		"error", err)
+	if !ctx.hooks.AbortOnError {
+		return nil
+	}
+	return fmt.Errorf("%s hook failed: %v", name, err)
+}
+
+func (ctx *Context) runTunnelHook(name string, hook DataPlaneHook, t tunnel) error {
+	return ctx.runHook(t.getLogger(), name, hook, &DataPlaneHookInfo{
+		TunnelName:   t.getName(),
+		Tunnel:       t,
+		TunnelConfig: t.getCfg(),
+	})
+}
+
+func (ctx *Context) runSessionHook(name string, hook DataPlaneHook, logger log.Logger, parent tunnel, s session, ifname string) error {
+	return ctx.runHook(logger, name, hook, &DataPlaneHookInfo{
+		TunnelName:    parent.getName(),
+		Tunnel:        parent,
+		TunnelConfig:  parent.getCfg(),
+		SessionName:   s.getName(),
+		Session:       s,
+		SessionConfig: s.getCfg(),
+		InterfaceName: ifname,
+	})
+}
+
+func (ctx *Context) preTunnelUp(t tunnel) error {
+	return ctx.runTunnelHook("PreDataPlaneUp", ctx.hooks.PreDataPlaneUp, t)
+}
+
+func (ctx *Context) postTunnelUp(t tunnel) error {
+	return ctx.runTunnelHook("PostDataPlaneUp", ctx.hooks.PostDataPlaneUp, t)
+}
+
+func (ctx *Context) preTunnelDown(t tunnel) {
+	_ = ctx.runTunnelHook("PreDataPlaneDown", ctx.hooks.PreDataPlaneDown, t)
+}
+
+func (ctx *Context) preSessionUp(logger log.Logger, parent tunnel, s session) error {
+	return ctx.runSessionHook("PreDataPlaneUp", ctx.hooks.PreDataPlaneUp, logger, parent, s, "")
+}
+
+func (ctx *Context) postSessionUp(logger log.Logger, parent tunnel, s session, ifname string) error {
+	return ctx.runSessionHook("PostDataPlaneUp", ctx.hooks.PostDataPlaneUp, logger, parent, s, ifname)
+}
+
+func (ctx *Context) preSessionDown(logger log.Logger, parent tunnel, s session, ifname string) {
+	_ = ctx.runSessionHook("PreDataPlaneDown", ctx.hooks.PreDataPlaneDown, logger, parent, s, ifname)
+}
@@ -1,14 +1,22 @@
 package l2tp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"net"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"golang.org/x/sys/unix"
 )
 
@@ -24,6 +32,117 @@ type Context struct {
 	serialLock    sync.Mutex
 	eventHandlers []EventHandler
 	evtLock       sync.RWMutex
+	rng           *rand.Rand
+	rngLock       sync.Mutex
+	unsafeCtlMsgs bool
+	reconnects    map[string]*tunnelReconnect
+	reconnectLock sync.Mutex
+	reconnectWg   sync.WaitGroup
+	closed        bool
+	defaultCfg    *TunnelConfig
+	defaultLock   sync.Mutex
+	v3Sessions    map[ControlConnID]session
+	v3SessionLock sync.Mutex
+	createLimit   *rateLimiter
+	hooks         DataPlaneHooks
+	idAlloc       IDAllocStrategy
+	maxTunnels    int
+	maxPerPeer    int
+	tunnelPeers   map[ControlConnID]string
+}
+
+// ContextOption is a functional option for configuring a Context
+// created using NewContextWithOptions.
+type ContextOption func(ctx *Context)
+
+// WithRand sets the random source the Context uses for generating
+// tunnel IDs, session IDs, and call serial numbers.
+//
+// By default a Context uses a private source seeded from the current time.
+// Supplying a source with a fixed seed makes ID generation deterministic,
+// which may be useful for testing.
+//
+// The Context serialises its own use of the source, but the source must
+// not be used elsewhere concurrently.
+func WithRand(rng *rand.Rand) ContextOption {
+	return func(ctx *Context) {
+		ctx.rng = rng
+	}
+}
+
+// WithUnsafeControlMessages enables the ControlMessageWriter interface
+// for tunnels created by the Context.
+//
+// This option is intended for conformance testing and for reproducing
+// interoperability problems only.  It should never be used in production
+// code.
+func WithUnsafeControlMessages() ContextOption {
+	return func(ctx *Context) {
+		ctx.unsafeCtlMsgs = true
+	}
+}
+
+// WithCreationRateLimit limits the rate at which the Context creates
+// tunnel and session instances to n per the specified period.
+//
+// Calls to the tunnel constructors and to NewSession block as necessary
+// to keep to the rate limit, although up to n instances may be created
+// in a burst.  This may be used to avoid exhausting kernel resources
+// such as netlink socket buffers when bulk creating many instances.
+//
+// By default creation is not rate limited.  A non-positive n or period
+// disables rate limiting.
+func WithCreationRateLimit(n int, per time.Duration) ContextOption {
+	return func(ctx *Context) {
+		if n > 0 && per > 0 {
+			ctx.createLimit = newRateLimiter(n, per)
+		} else {
+			ctx.createLimit = nil
+		}
+	}
+}
+
+// WithIDAllocation sets the strategy the Context uses to allocate tunnel
+// and session IDs which are not specified by the tunnel or session
+// configuration.
+//
+// By default a Context uses IDAllocRandom.  IDAllocSequential may be
+// preferred where IDs must be predictable, e.g. for testing, or where
+// a large proportion of the ID space is in use, as is possible with the
+// 16-bit IDs of L2TPv2.
+func WithIDAllocation(strategy IDAllocStrategy) ContextOption {
+	return func(ctx *Context) {
+		ctx.idAlloc = strategy
+	}
+}
+
+// WithMaxTunnels limits the number of tunnels the Context may have at
+// any one time to n.  Creating a tunnel beyond the limit fails with
+// ErrTunnelLimitReached.
+//
+// By default the number of tunnels is not limited.  A non-positive n
+// disables the limit.
+func WithMaxTunnels(n int) ContextOption {
+	return func(ctx *Context) {
+		ctx.maxTunnels = n
+	}
+}
+
+// WithMaxTunnelsPerPeer limits the number of tunnels the Context may
+// have to any one peer IP address at any one time to n.  Tunnels to
+// different UDP ports on the same peer host count against the same
+// limit.  Creating a tunnel beyond the limit fails with
+// ErrTunnelLimitReached.
+//
+// This may be used to prevent a single client of a TunnelListener from
+// opening unbounded tunnels.
+//
+// By default the number of tunnels per peer is not limited.  A
+// non-positive n disables the limit.
+func WithMaxTunnelsPerPeer(n int) ContextOption {
+	return func(ctx *Context) {
+		ctx.maxPerPeer = n
+	}
 }
 
 // Tunnel is an interface representing an L2TP tunnel.
@@ -33,10 +152,72 @@ type Tunnel interface {
 	// The name provided must be unique in the parent tunnel.
 	NewSession(name string, cfg *SessionConfig) (Session, error)
 
+	// Name returns the name of the tunnel as provided on creation.
+	Name() string
+
+	// ListSessions returns a snapshot of the sessions currently
+	// instantiated in the tunnel, ordered by session name.
+	ListSessions() []Session
+
+	// FindSessionByName looks up a session in the tunnel by name.
+	FindSessionByName(name string) (Session, bool)
+
+	// SetDebugFlags modifies the kernel debug logging flags for the
+	// tunnel without tearing down the tunnel data plane.
+	// An error is returned if the tunnel data plane has not been
+	// established, and ErrDebugFlagsNotSupported is returned if the
+	// data plane doesn't support changing the flags.
+	SetDebugFlags(flags DebugFlags) error
+
+	// PathMTU returns the path MTU to the peer discovered by the
+	// kernel for the tunnel socket.
+	// An error is returned if the tunnel data plane has not been
+	// established, or for static tunnels, which have no userspace
+	// socket.
+	PathMTU() (int, error)
+
+	// WaitUp blocks until the tunnel is established, the tunnel goes
+	// down, or the context passed is done.
+	//
+	// WaitUp returns nil if the tunnel is established.  If the tunnel
+	// has gone down, the error returned is that reported by the
+	// TunnelDownEvent, or ErrTunnelClosed if that error is nil.  If the
+	// context is done first, the context's error is returned.
+	//
+	// Static and quiescent tunnels are established on creation, so
+	// WaitUp returns immediately for those tunnel types.
+	WaitUp(ctx context.Context) error
+
+	// Health reports the health of the tunnel's control connection,
+	// e.g. for use in liveness and readiness probes.
+	//
+	// Static tunnels have no control connection, so are always
+	// reported as up.
+	Health() TunnelHealth
+
+	// Statistics obtains statistics for the tunnel.  The data plane
+	// statistics are running totals for all the sessions instantiated
+	// in the tunnel, including sessions which have since been closed,
+	// and so never decrease over the lifetime of the tunnel.
+	Statistics() TunnelStatistics
+
 	// Close closes the tunnel, releasing allocated resources.
 	//
 	// Any sessions instantiated inside the tunnel are removed.
 	Close()
+
+	// CloseWithResult closes the tunnel as per Close, reporting the
+	// reason for closure to the peer.
+	//
+	// For dynamic tunnels the result code, error code, and message are
+	// sent to the peer in the Result Code AVP of the StopCCN message.
+	// The codes must be valid StopCCN result codes and general error
+	// codes per RFC2661 section 4.4.2 and RFC3931 section 5.4.2.  An
+	// error is returned, and the tunnel is left open, if they are not.
+	//
+	// Static and quiescent tunnels don't send StopCCN, so the codes are
+	// validated but otherwise unused.
+	CloseWithResult(result, errCode uint16, msg string) error
 }
 
 type tunnel interface {
@@ -44,21 +225,76 @@ type tunnel interface {
 	getName() string
 	getCfg() *TunnelConfig
 	getDP() DataPlane
+	getContext() *Context
+	getLocalAddress() unix.Sockaddr
 	getLogger() log.Logger
 	unlinkSession(s session)
+	retireSessionStatistics(s session)
 	handleUserEvent(event interface{})
+	kill()
 }
 
 // Session is an interface representing an L2TP session.
 type Session interface {
+	// Name returns the name of the session as provided on creation.
+	Name() string
+
+	// GetStatistics obtains data plane statistics for the session.
+	// An error is returned if the session data plane has not been
+	// established.
+	GetStatistics() (*SessionDataPlaneStatistics, error)
+
+	// Modify applies configuration changes to an established session
+	// without tearing down the session data plane.
+	// Only the SeqNum, ReorderTimeout, and DebugFlags fields of the
+	// configuration passed are applied: all other fields are ignored.
+	// An error is returned if the session data plane has not been
+	// established, and ErrModifyNotSupported is returned if the data
+	// plane doesn't support modification.
+	Modify(cfg *SessionConfig) error
+
+	// InterfaceIndex returns the index and name of the network
+	// interface created by the kernel for the session, e.g. "l2tpeth0".
+	// An error is returned if the session data plane has not been
+	// established, or if the data plane has no network interface.
+	InterfaceIndex() (int, string, error)
+
+	// DataMTU returns the largest payload the session can carry in a
+	// data packet without fragmentation, i.e. the tunnel's path MTU
+	// less the IP, UDP, L2TP header, cookie, and Layer 2 specific
+	// sublayer overhead.
+	// If the tunnel's path MTU is not available, e.g. for static
+	// tunnels, a path MTU of 1500 bytes is assumed.
+	DataMTU() int
+
+	// PPPMRU returns the largest PPP MRU the session can carry without
+	// fragmentation, i.e. DataMTU less the PPP address, control and
+	// protocol fields.  It is only meaningful for PPP pseudowires.
+	PPPMRU() int
+
 	// Close closes the session, releasing allocated resources.
 	Close()
 }
 
+// LinkInfoSender is implemented by sessions which can send link
+// information to the peer using the L2TPv2 Set-Link-Info (SLI) message,
+// namely dynamic L2TPv2 sessions.
+//
+// Per RFC2661 section 6.14, an LNS uses SLI to inform the LAC of the
+// ACCM negotiated by PPP, so that the LAC may apply it to the async PPP
+// link to the remote system.
+type LinkInfoSender interface {
+	// SendLinkInfo sends an SLI message carrying the ACCM to the peer.
+	// It blocks until the message has been acknowledged by the peer.
+	// An error is returned if the session is not established.
+	SendLinkInfo(accm *ACCM) error
+}
+
 type session interface {
 	Session
 	getName() string
 	getCfg() *SessionConfig
+	drainInterface() time.Duration
 	kill()
 }
 
@@ -99,9 +335,66 @@ type TunnelDataPlane interface {
 	Down() error
 }
 
+// TunnelDataPlaneDebugger is an optional interface implemented by tunnel
+// data planes which support changing the debug logging flags of an
+// existing tunnel.  Tunnel.SetDebugFlags returns
+// ErrDebugFlagsNotSupported for tunnels whose data plane doesn't
+// implement it.
+type TunnelDataPlaneDebugger interface {
+	// SetDebugFlags modifies the kernel debug logging flags of the
+	// tunnel data plane.
+	SetDebugFlags(flags DebugFlags) error
+}
+
+// setTunnelDataPlaneDebugFlags applies flags to a tunnel data plane
+// which implements TunnelDataPlaneDebugger.
+func setTunnelDataPlaneDebugFlags(dp TunnelDataPlane, flags DebugFlags) error {
+	d, ok := dp.(TunnelDataPlaneDebugger)
+	if !ok {
+		return ErrDebugFlagsNotSupported
+	}
+	return d.SetDebugFlags(flags)
+}
+
+// dataPacketHandler is implemented by tunnel data planes which handle
+// data packets in userspace.  Data packets received on the tunnel socket
+// are passed to handleDataPacket.
+type dataPacketHandler interface {
+	handleDataPacket(b []byte)
+}
+
 // SessionDataPlaneStatistics holds dataplane statistics for receipt and transmission.
 type SessionDataPlaneStatistics struct {
 	TxPackets, TxBytes, TxErrors, RxPackets, RxBytes, RxErrors uint64
+	// RxCookieDiscards is the number of received data packets discarded
+	// due to an L2TPv3 cookie mismatch.
+	RxCookieDiscards uint64
+}
+
+// add adds the statistics in other to s.
+func (s *SessionDataPlaneStatistics) add(other *SessionDataPlaneStatistics) {
+	s.TxPackets += other.TxPackets
+	s.TxBytes += other.TxBytes
+	s.TxErrors += other.TxErrors
+	s.RxPackets += other.RxPackets
+	s.RxBytes += other.RxBytes
+	s.RxErrors += other.RxErrors
+	s.RxCookieDiscards += other.RxCookieDiscards
+}
+
+// TunnelStatistics holds tunnel statistics, c.f. Tunnel.Statistics.
+type TunnelStatistics struct {
+	// Data is the sum of the data plane statistics of the sessions
+	// instantiated in the tunnel since it was created.  The statistics
+	// of a session are included from the time its data plane is
+	// established, and the final statistics of closed sessions are
+	// retained.
+	Data SessionDataPlaneStatistics
+	// ControlRetransmits is the number of control messages the tunnel
+	// has retransmitted because they were not acknowledged by the peer
+	// in time.  It is always zero for static tunnels, which have no
+	// control plane.
+	ControlRetransmits uint64
 }
 
 // SessionDataPlane is an interface representing a session data plane.
@@ -118,6 +411,38 @@ type SessionDataPlane interface {
 	Down() error
 }
 
+// SessionDataPlaneModifier is an optional interface implemented by
+// session data planes which support changing the parameters of an
+// existing session.  Session.Modify returns ErrModifyNotSupported for
+// sessions whose data plane doesn't implement it.
+type SessionDataPlaneModifier interface {
+	// Modify applies changes to the modifiable session parameters,
+	// as described by Session.Modify.
+	Modify(cfg *SessionConfig) error
+}
+
+// modifySessionDataPlane applies cfg to a session data plane which
+// implements SessionDataPlaneModifier.
+func modifySessionDataPlane(dp SessionDataPlane, cfg *SessionConfig) error {
+	m, ok := dp.(SessionDataPlaneModifier)
+	if !ok {
+		return ErrModifyNotSupported
+	}
+	return m.Modify(cfg)
+}
+
+// SessionDataPlaneDrainer is an optional interface implemented by
+// session data planes whose sessions have a network interface which may
+// be drained of queued packets before the session is torn down, c.f.
+// SessionConfig.DrainTimeout.  Sessions whose data plane doesn't
+// implement it are torn down without draining.
+type SessionDataPlaneDrainer interface {
+	// InterfaceDown administratively disables the session network
+	// interface, so that no further packets are queued to it.
+	// It is called prior to Down for sessions with a drain timeout.
+	InterfaceDown() error
+}
+
 // EventHandler is an interface for receiving L2TP-specific events.
 type EventHandler interface {
 	// HandleEvent is called when an event occurs.
@@ -131,6 +456,25 @@ type EventHandler interface {
 	HandleEvent(event interface{})
 }
 
+// EventHandlerFunc is an adapter allowing an ordinary function to be
+// used as an EventHandler.
+//
+// Since Go functions are not comparable, an EventHandlerFunc value cannot
+// be removed using UnregisterEventHandler.  To register a function handler
+// which may later be unregistered, register a pointer to the
+// EventHandlerFunc, and pass the same pointer to UnregisterEventHandler:
+//
+//	h := l2tp.EventHandlerFunc(func(event interface{}) { ... })
+//	ctx.RegisterEventHandler(&h)
+//	...
+//	ctx.UnregisterEventHandler(&h)
+type EventHandlerFunc func(event interface{})
+
+// HandleEvent calls f(event).
+func (f EventHandlerFunc) HandleEvent(event interface{}) {
+	f(event)
+}
+
 // TunnelUpEvent is passed to registered EventHandler instances when a
 // tunnel comes up.  In the case of static or quiescent tunnels, this occurs
 // immediately on instantiation of the tunnel.  For dynamic tunnels, this
@@ -141,6 +485,10 @@ type TunnelUpEvent struct {
 	Tunnel                    Tunnel
 	Config                    *TunnelConfig
 	LocalAddress, PeerAddress unix.Sockaddr
+	// PeerVendorAVPs lists the vendor-specific AVPs registered using
+	// RegisterVendorAVP which the peer sent in the SCCRQ or SCCRP
+	// message of a dynamic tunnel.
+	PeerVendorAVPs []VendorAVP
 }
 
 // TunnelDownEvent is passed to registered EventHandler instances when a
@@ -148,17 +496,51 @@ type TunnelUpEvent struct {
 // immediately on closure of the tunnel.  For dynamic tunnels, this
 // occurs on completion of the L2TP control protocol message exchange with
 // the peer.
+//
+// A dynamic tunnel which fails to establish within its configured
+// EstablishTimeout also raises a TunnelDownEvent, although no
+// TunnelUpEvent will have been raised for it.
 type TunnelDownEvent struct {
 	TunnelName                string
 	Tunnel                    Tunnel
 	Config                    *TunnelConfig
 	LocalAddress, PeerAddress unix.Sockaddr
+	// Error indicates why the tunnel was torn down.  It is nil if the
+	// tunnel was closed by the user, or by a StopCCN requesting that
+	// the control connection be cleared.  Otherwise it is a
+	// *StopCCNError if a StopCCN indicating an error was sent or
+	// received, ErrTunnelEstablishTimeout if the tunnel failed to
+	// establish in time, or the error which took down the tunnel's
+	// control message transport.
+	Error error
+	// ResultCode and ErrorCode are taken from the Result Code AVP of
+	// the StopCCN message received from the peer.  They are zero if no
+	// StopCCN was received.
+	ResultCode, ErrorCode uint16
+}
+
+// ControlMessageRetransmitExhaustedEvent is passed to registered EventHandler
+// instances when a control message sent by a dynamic or quiescent tunnel is
+// not acknowledged by the peer within the number of retransmits configured
+// by TunnelConfig.MaxRetries.  This indicates that the peer has stopped
+// responding, and the tunnel is torn down as a result.
+type ControlMessageRetransmitExhaustedEvent struct {
+	TunnelName string
+	Tunnel     Tunnel
+	Config     *TunnelConfig
+	// MessageType is the Message Type AVP value of the control message
+	// which was not acknowledged, as defined by RFC2661 and RFC3931.
+	MessageType uint16
 }
 
 // SessionUpEvent is passed to registered EventHandler instances when a session
 // comes up.  In the case of static or quiescent sessions, this occurs immediately
 // on instantiation of the session.  For dynamic sessions, this occurs on the
 // completion of the L2TP control protocol message exchange with the peer.
+//
+// The SessionConfig carried by the event reflects the session IDs in use for
+// the session, including any IDs allocated by the context or negotiated with
+// the peer.
 type SessionUpEvent struct {
 	TunnelName    string
 	Tunnel        Tunnel
@@ -167,12 +549,22 @@ type SessionUpEvent struct {
 	Session       Session
 	SessionConfig *SessionConfig
 	InterfaceName string
+	// PeerTxConnectSpeed and PeerRxConnectSpeed are the connect speeds
+	// in bits per second reported by the peer in the OCCN message of a
+	// dynamic L2TPv2 outgoing call, or the ICCN message of an incoming
+	// call answered by a passive tunnel.  They are zero otherwise.
+	PeerTxConnectSpeed uint32
+	PeerRxConnectSpeed uint32
+	// ProxyLCP is the proxy LCP and authentication information sent by
+	// the peer in the ICCN message of an incoming call answered by a
+	// passive tunnel.  It is nil if the peer sent none.
+	ProxyLCP *ProxyLCP
 }
 
 // SessionDownEvent is passed to registered EventHandler instances when a session
-// comes up.  In the case of static or quiescent sessions, this occurs immediately
-// on instantiation of the session.  For dynamic sessions, this occurs on the
-// completion of the L2TP control protocol message exchange with the peer.
+// goes down.  In the case of static or quiescent sessions, this occurs immediately
+// on closure of the session.  For dynamic sessions, this occurs on receipt or
+// transmission of a CDN message, or when the parent tunnel goes down.
 type SessionDownEvent struct {
 	TunnelName    string
 	Tunnel        Tunnel
@@ -184,6 +576,47 @@ type SessionDownEvent struct {
 	Result        string
 }
 
+// SessionLinkInfoEvent is passed to registered EventHandler instances
+// when a dynamic L2TPv2 session receives a Set-Link-Info message carrying
+// an ACCM from the peer.
+//
+// An LAC running async PPP links should apply the ACCM to the link,
+// e.g. by configuring the asyncmap of pppd.
+type SessionLinkInfoEvent struct {
+	TunnelName    string
+	Tunnel        Tunnel
+	TunnelConfig  *TunnelConfig
+	SessionName   string
+	Session       Session
+	SessionConfig *SessionConfig
+	ACCM          ACCM
+}
+
+// SessionDataErrorEvent is passed to registered EventHandler instances
+// when the data plane of an L2TPv3 session discards received data packets
+// due to a cookie mismatch.  This commonly indicates that the session
+// cookies are misconfigured.
+//
+// The session data plane statistics are polled for cookie mismatch
+// discards only if SessionConfig.CookieCheckInterval is set.
+// Event handlers may close the session in response to the event.
+type SessionDataErrorEvent struct {
+	TunnelName    string
+	Tunnel        Tunnel
+	TunnelConfig  *TunnelConfig
+	SessionName   string
+	Session       Session
+	SessionConfig *SessionConfig
+	InterfaceName string
+	// RxCookieDiscards is the total number of received data packets
+	// discarded due to a cookie mismatch.
+	RxCookieDiscards uint64
+	// NewRxCookieDiscards is the number of received data packets
+	// discarded due to a cookie mismatch since the statistics were
+	// last polled.
+	NewRxCookieDiscards uint64
+}
+
 // LinuxNetlinkDataPlane is a special sentinel value used to indicate
 // that the L2TP context should use the internal Linux kernel data plane
 // implementation.
@@ -210,25 +643,215 @@ var LinuxNetlinkDataPlane DataPlane = &nullDataPlane{}
 //
 // If a nil logger is passed, all logging is disabled.
 func NewContext(dataPlane DataPlane, logger log.Logger) (*Context, error) {
+	return NewContextWithOptions(dataPlane, logger)
+}
+
+// NewContextWithOptions creates a new L2TP context as per NewContext,
+// applying the provided options to the context.
+func NewContextWithOptions(dataPlane DataPlane, logger log.Logger, opts ...ContextOption) (*Context, error) {
 
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 
-	rand.Seed(time.Now().UnixNano())
+	ctx := &Context{
+		logger:        logger,
+		tunnelsByName: make(map[string]tunnel),
+		tunnelsByID:   make(map[ControlConnID]tunnel),
+		reconnects:    make(map[string]*tunnelReconnect),
+		v3Sessions:    make(map[ControlConnID]session),
+		tunnelPeers:   make(map[ControlConnID]string),
+	}
+
+	for _, opt := range opts {
+		opt(ctx)
+	}
+
+	if ctx.rng == nil {
+		ctx.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
 
 	dp, err := initDataPlane(dataPlane)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialise data plane: %v", err)
 	}
 
-	return &Context{
-		logger:        logger,
-		tunnelsByName: make(map[string]tunnel),
-		tunnelsByID:   make(map[ControlConnID]tunnel),
-		dp:            dp,
-		callSerial:    rand.Uint32(),
-	}, nil
+	ctx.dp = dp
+	ctx.callSerial = ctx.randUint32()
+
+	return ctx, nil
+}
+
+// SetDefaultTunnelConfig sets a configuration providing default values
+// for tunnels subsequently created by the Context.
+//
+// When a tunnel is created, each field of its configuration which is
+// left at its zero value takes the value of the corresponding field in
+// the default configuration.  Fields which are set in the tunnel's
+// configuration always take precedence over the defaults.
+//
+// Fields which identify or are specific to an individual tunnel cannot
+// be defaulted, and an error is returned if the default configuration
+// sets any of them.  These are Local, Peer, TunnelID, PeerTunnelID,
+// EstablishTimeout, Persist, ResolveInterval, IPv6FlowLabel,
+// CaptureFile and IgnoreDefaults.
+//
+// Since a zero value in a tunnel's configuration is replaced by any
+// default, a tunnel requiring the zero value of a field which has a
+// default (e.g. to disable HELLO messages where the default
+// configuration enables them) should set IgnoreDefaults in its
+// configuration.
+//
+// Passing a nil configuration clears the defaults.  Tunnels which
+// already exist are unaffected by changes to the defaults.
+func (ctx *Context) SetDefaultTunnelConfig(cfg *TunnelConfig) error {
+	var myCfg *TunnelConfig
+	if cfg != nil {
+		err := validateDefaultTunnelConfig(cfg)
+		if err != nil {
+			return err
+		}
+		dup := *cfg
+		myCfg = &dup
+	}
+	ctx.defaultLock.Lock()
+	defer ctx.defaultLock.Unlock()
+	ctx.defaultCfg = myCfg
+	return nil
+}
+
+// validateDefaultTunnelConfig rejects a default configuration which sets
+// fields specific to an individual tunnel.
+func validateDefaultTunnelConfig(cfg *TunnelConfig) error {
+	perTunnel := []struct {
+		name string
+		set  bool
+	}{
+		{"Local", cfg.Local != ""},
+		{"Peer", cfg.Peer != ""},
+		{"TunnelID", cfg.TunnelID != 0},
+		{"PeerTunnelID", cfg.PeerTunnelID != 0},
+		{"EstablishTimeout", cfg.EstablishTimeout != 0},
+		{"Persist", cfg.Persist},
+		{"ResolveInterval", cfg.ResolveInterval != 0},
+		{"IPv6FlowLabel", cfg.IPv6FlowLabel != 0},
+		{"CaptureFile", cfg.CaptureFile != ""},
+		{"IgnoreDefaults", cfg.IgnoreDefaults},
+	}
+	for _, f := range perTunnel {
+		if f.set {
+			return fmt.Errorf("%v cannot be set in the default tunnel config", f.name)
+		}
+	}
+	return nil
+}
+
+// applyDefaultTunnelConfig merges the Context's default configuration
+// into the zero-valued fields of cfg.
+func (ctx *Context) applyDefaultTunnelConfig(cfg *TunnelConfig) {
+	ctx.defaultLock.Lock()
+	defer ctx.defaultLock.Unlock()
+	if ctx.defaultCfg == nil || cfg.IgnoreDefaults {
+		return
+	}
+	mergeTunnelConfig(cfg, ctx.defaultCfg)
+}
+
+// mergeTunnelConfig sets each zero-valued field of cfg which may be
+// inherited to the value of the corresponding field of defaults.
+// New TunnelConfig fields must be added here explicitly if they are to
+// be inherited.
+func mergeTunnelConfig(cfg, defaults *TunnelConfig) {
+	if cfg.LocalPort == 0 {
+		cfg.LocalPort = defaults.LocalPort
+	}
+	if cfg.PreferredSource == "" {
+		cfg.PreferredSource = defaults.PreferredSource
+	}
+	if cfg.Encap == 0 {
+		cfg.Encap = defaults.Encap
+	}
+	if cfg.AddressFamily == 0 {
+		cfg.AddressFamily = defaults.AddressFamily
+	}
+	if cfg.Version == 0 {
+		cfg.Version = defaults.Version
+	}
+	if cfg.WindowSize == 0 {
+		cfg.WindowSize = defaults.WindowSize
+	}
+	if !cfg.StopAndWait {
+		cfg.StopAndWait = defaults.StopAndWait
+	}
+	if cfg.StopCCNTimeout == 0 {
+		cfg.StopCCNTimeout = defaults.StopCCNTimeout
+	}
+	if cfg.HelloTimeout == 0 {
+		cfg.HelloTimeout = defaults.HelloTimeout
+	}
+	if cfg.RetryTimeout == 0 {
+		cfg.RetryTimeout = defaults.RetryTimeout
+	}
+	if cfg.AckTimeout == 0 {
+		cfg.AckTimeout = defaults.AckTimeout
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaults.MaxRetries
+	}
+	if cfg.ControlReadTimeout == 0 {
+		cfg.ControlReadTimeout = defaults.ControlReadTimeout
+	}
+	if cfg.ControlWriteTimeout == 0 {
+		cfg.ControlWriteTimeout = defaults.ControlWriteTimeout
+	}
+	if cfg.ReconnectMin == 0 {
+		cfg.ReconnectMin = defaults.ReconnectMin
+	}
+	if cfg.ReconnectMax == 0 {
+		cfg.ReconnectMax = defaults.ReconnectMax
+	}
+	if cfg.HostName == "" {
+		cfg.HostName = defaults.HostName
+	}
+	if cfg.RouterID == 0 {
+		cfg.RouterID = defaults.RouterID
+	}
+	if cfg.FramingCaps == 0 {
+		cfg.FramingCaps = defaults.FramingCaps
+	}
+	if cfg.BearerCaps == 0 {
+		cfg.BearerCaps = defaults.BearerCaps
+	}
+	if cfg.DebugFlags == 0 {
+		cfg.DebugFlags = defaults.DebugFlags
+	}
+	if cfg.Secret == "" {
+		cfg.Secret = defaults.Secret
+	}
+	if cfg.UDPChecksum == 0 {
+		cfg.UDPChecksum = defaults.UDPChecksum
+	}
+	if cfg.PMTUDisc == 0 {
+		cfg.PMTUDisc = defaults.PMTUDisc
+	}
+	if cfg.Device == "" {
+		cfg.Device = defaults.Device
+	}
+	if cfg.DeviceIndex == 0 {
+		cfg.DeviceIndex = defaults.DeviceIndex
+	}
+	if !cfg.ReusePort {
+		cfg.ReusePort = defaults.ReusePort
+	}
+	if cfg.SocketPriority == 0 {
+		cfg.SocketPriority = defaults.SocketPriority
+	}
+	if len(cfg.VendorAVPs) == 0 {
+		cfg.VendorAVPs = defaults.VendorAVPs
+	}
+	if cfg.MaxSessions == 0 {
+		cfg.MaxSessions = defaults.MaxSessions
+	}
 }
 
 // NewDynamicTunnel creates a new dynamic L2TP.
@@ -239,21 +862,72 @@ func NewContext(dataPlane DataPlane, logger log.Logger) (*Context, error) {
 //
 // The name provided must be unique in the Context.
 //
+// If the configuration sets Persist, the Context will re-create the
+// tunnel if it fails.  Call Close on the tunnel to stop it being
+// re-created.
+//
 func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
 
-	var sal, sap unix.Sockaddr
+	// Must have configuration
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid nil config")
+	}
+
+	ctx.waitCreate()
+
+	t, err := ctx.newDynamicTunnel(name, TunnelTypeDynamic, cfg, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// NewPassiveTunnel creates a new passive L2TP tunnel.
+//
+// A passive tunnel runs a full RFC2661 (L2TPv2) or RFC3931 (L2TPv3)
+// tunnel instance as for a dynamic tunnel, but rather than initiating
+// the control connection it binds to the local address and waits for
+// the peer to send an SCCRQ, completing the handshake as the responder.
+// The peer's tunnel ID is taken from the SCCRQ.  This allows an LNS to
+// be implemented using the package.
+//
+// The name provided must be unique in the Context.
+//
+// The tunnel configuration must include the peer address, and only the
+// peer at that address may initiate the tunnel.  If the local address is
+// not set the tunnel binds to the wildcard address.
+//
+// Sessions may be created on the tunnel using NewSession once the tunnel
+// is up.  The tunnel also answers incoming calls placed by the peer,
+// creating a session named after its session ID, e.g. "session42".  A
+// SessionUpEvent is raised once the call is connected.
+func (ctx *Context) NewPassiveTunnel(name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
 
 	// Must have configuration
 	if cfg == nil {
 		return nil, fmt.Errorf("invalid nil config")
 	}
 
+	ctx.waitCreate()
+
+	t, err := ctx.newDynamicTunnel(name, TunnelTypePassive, cfg, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (ctx *Context) newDynamicTunnel(name string, tt TunnelType, cfg *TunnelConfig, sessions []persistedSession, sccrq *rawMsg) (tunl *dynamicTunnel, err error) {
+
+	var sal, sap unix.Sockaddr
+
 	// Duplicate the configuration so we don't modify the user's copy
 	myCfg := *cfg
+	ctx.applyDefaultTunnelConfig(&myCfg)
 
 	// Must not have name clashes
 	if _, ok := ctx.findTunnelByName(name); ok {
-		return nil, fmt.Errorf("already have tunnel %q", name)
+		return nil, fmt.Errorf("%w %q", ErrTunnelNameExists, name)
 	}
 
 	// Generate host name if unset
@@ -272,53 +946,42 @@ func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunne
 	}
 
 	// Sanity check the configuration
-	if myCfg.Version != ProtocolVersion3 && myCfg.Encap == EncapTypeIP {
-		return nil, fmt.Errorf("IP encapsulation only supported for L2TPv3 tunnels")
-	}
-	if myCfg.Version == ProtocolVersion2 {
-		if myCfg.TunnelID > 65535 {
-			return nil, fmt.Errorf("L2TPv2 connection ID %v out of range", myCfg.TunnelID)
-		}
-	}
-	if myCfg.PeerTunnelID != 0 {
-		return nil, fmt.Errorf("L2TPv2 peer connection ID cannot be specified for dynamic tunnels")
-	}
-	if myCfg.Peer == "" {
-		return nil, fmt.Errorf("must specify peer address for dynamic tunnel")
+	err = validateTunnelConfig(tt, &myCfg)
+	if err != nil {
+		return nil, err
 	}
 
 	// If the tunnel ID in the config is unset we must generate one.
 	// If the tunnel ID is set, we must check for collisions.
-	// TODO: there is a potential race here if dynamic tunnels are concurrently
-	// added -- an ID assigned here isn't actually reserved until the linkTunnel
-	// call below.
-	if myCfg.TunnelID != 0 {
-		// Must not have TID clashes
-		if _, ok := ctx.findTunnelByID(myCfg.TunnelID); ok {
-			return nil, fmt.Errorf("already have tunnel with TID %q", myCfg.TunnelID)
-		}
-	} else {
-		myCfg.TunnelID, err = ctx.allocTid(myCfg.Version)
-		if err != nil {
-			return nil, fmt.Errorf("failed to allocate a TID: %q", err)
-		}
+	// Either way the ID is reserved until the linkTunnel call below, so
+	// concurrently created tunnels can't be assigned the same ID.
+	myCfg.TunnelID, err = ctx.reserveTid(myCfg.TunnelID, myCfg.Version)
+	if err != nil {
+		return nil, err
 	}
+	defer ctx.releaseTidOnError(myCfg.TunnelID, &err)
 
 	// Initialise tunnel address structures
-	switch myCfg.Encap {
-	case EncapTypeUDP:
-		sal, sap, err = newUDPAddressPair(myCfg.Local, myCfg.Peer)
-	case EncapTypeIP:
-		sal, sap, err = newIPAddressPair(myCfg.Local, myCfg.TunnelID,
-			myCfg.Peer, myCfg.PeerTunnelID)
-	default:
-		err = fmt.Errorf("unrecognised encapsulation type %v", myCfg.Encap)
+	sal, sap, err = newTunnelAddressPair(&myCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise tunnel addresses: %w", err)
 	}
+
+	// Must not exceed the limit on tunnels to the peer
+	err = ctx.reserveTunnelPeer(myCfg.TunnelID, sap)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
+		return nil, err
 	}
 
-	t, err := newDynamicTunnel(name, ctx, sal, sap, &myCfg)
+	// Persistent tunnels are re-created from the user's configuration
+	// rather than the one modified for this tunnel instance
+	var persist *tunnelPersistence
+	if myCfg.Persist {
+		userCfg := *cfg
+		persist = &tunnelPersistence{cfg: &userCfg, sessions: sessions}
+	}
+
+	t, err := newDynamicTunnel(name, ctx, sal, sap, &myCfg, tt == TunnelTypePassive, sccrq, persist)
 	if err != nil {
 		return nil, err
 	}
@@ -351,57 +1014,43 @@ func (ctx *Context) NewQuiescentTunnel(name string, cfg *TunnelConfig) (tunl Tun
 		return nil, fmt.Errorf("invalid nil config")
 	}
 
+	ctx.waitCreate()
+
 	// Duplicate the configuration so we don't modify the user's copy
 	myCfg := *cfg
+	ctx.applyDefaultTunnelConfig(&myCfg)
 
 	// Must not have name clashes
 	if _, ok := ctx.findTunnelByName(name); ok {
-		return nil, fmt.Errorf("already have tunnel %q", name)
+		return nil, fmt.Errorf("%w %q", ErrTunnelNameExists, name)
 	}
 
 	// Sanity check the configuration
-	if myCfg.Version != ProtocolVersion3 && myCfg.Encap == EncapTypeIP {
-		return nil, fmt.Errorf("IP encapsulation only supported for L2TPv3 tunnels")
-	}
-	if myCfg.Version == ProtocolVersion2 {
-		if myCfg.TunnelID == 0 || myCfg.TunnelID > 65535 {
-			return nil, fmt.Errorf("L2TPv2 connection ID %v out of range", myCfg.TunnelID)
-		} else if myCfg.PeerTunnelID == 0 || myCfg.PeerTunnelID > 65535 {
-			return nil, fmt.Errorf("L2TPv2 peer connection ID %v out of range", myCfg.PeerTunnelID)
-		}
-	} else {
-		if myCfg.TunnelID == 0 || myCfg.PeerTunnelID == 0 {
-			return nil, fmt.Errorf("L2TPv3 tunnel IDs %v and %v must both be > 0",
-				myCfg.TunnelID, myCfg.PeerTunnelID)
-		}
-	}
-	if myCfg.Local == "" {
-		return nil, fmt.Errorf("must specify local address for quiescent tunnel")
-	}
-	if myCfg.Peer == "" {
-		return nil, fmt.Errorf("must specify peer address for quiescent tunnel")
+	err = validateTunnelConfig(TunnelTypeAcquiescent, &myCfg)
+	if err != nil {
+		return nil, err
 	}
 
 	// Must not have TID clashes
-	if _, ok := ctx.findTunnelByID(myCfg.TunnelID); ok {
-		return nil, fmt.Errorf("already have tunnel with TID %q", myCfg.TunnelID)
+	_, err = ctx.reserveTid(myCfg.TunnelID, myCfg.Version)
+	if err != nil {
+		return nil, err
 	}
+	defer ctx.releaseTidOnError(myCfg.TunnelID, &err)
 
 	// Initialise tunnel address structures
-	switch myCfg.Encap {
-	case EncapTypeUDP:
-		sal, sap, err = newUDPAddressPair(myCfg.Local, myCfg.Peer)
-	case EncapTypeIP:
-		sal, sap, err = newIPAddressPair(myCfg.Local, myCfg.TunnelID,
-			myCfg.Peer, myCfg.PeerTunnelID)
-	default:
-		err = fmt.Errorf("unrecognised encapsulation type %v", myCfg.Encap)
+	sal, sap, err = newTunnelAddressPair(&myCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise tunnel addresses: %w", err)
 	}
+
+	// Must not exceed the limit on tunnels to the peer
+	err = ctx.reserveTunnelPeer(myCfg.TunnelID, sap)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
+		return nil, err
 	}
 
-	t, err := newQuiescentTunnel(name, ctx, sal, sap, &myCfg)
+	t, err := newQuiescentTunnel(name, ctx, sal, sap, &myCfg, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -412,89 +1061,449 @@ func (ctx *Context) NewQuiescentTunnel(name string, cfg *TunnelConfig) (tunl Tun
 	return
 }
 
-// NewStaticTunnel creates a new static (unmanaged) L2TP tunnel.
-//
-// A static tunnel does not run any control protocol
-// and instead merely instantiates the data plane in the
-// kernel.  This is equivalent to the Linux 'ip l2tp'
-// command(s).
-//
-// Static L2TPv2 tunnels are not practically useful,
-// so NewStaticTunnel only supports creation of L2TPv3
-// unmanaged tunnel instances.
+// NewQuiescentTunnelFromFD creates a new quiescent L2TP tunnel as per
+// NewQuiescentTunnel, using an existing tunnel socket rather than
+// creating one.  This allows the tunnel socket to be created by another
+// process, e.g. for socket activation or privilege separation.
 //
-// The name provided must be unique in the Context.
+// The socket must be a UDP or L2TP/IP datagram socket which is already
+// bound and connected to the peer.  The tunnel's encapsulation and its
+// local and peer addresses are taken from the socket, so the Local,
+// LocalPort, Peer, and Encap fields of the configuration are ignored.
+// For L2TP/IP sockets the socket must be bound to the tunnel ID.
+// Since the socket is already bound and connected, the ReusePort and
+// IPv6FlowLabel options are not supported.
 //
-// The tunnel configuration must include local and peer addresses
-// and local and peer tunnel IDs.
-func (ctx *Context) NewStaticTunnel(name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
-
-	var sal, sap unix.Sockaddr
+// The tunnel uses a duplicate of fd, so the caller retains ownership
+// of fd and may close it once NewQuiescentTunnelFromFD returns.
+// The duplicate shares the file status flags of fd, and the tunnel
+// places the socket in non-blocking mode: if the caller continues to
+// use fd, blocking reads and writes on it will fail with EAGAIN.
+func (ctx *Context) NewQuiescentTunnelFromFD(name string, fd int, cfg *TunnelConfig) (tunl Tunnel, err error) {
 
 	// Must have configuration
 	if cfg == nil {
 		return nil, fmt.Errorf("invalid nil config")
 	}
 
+	ctx.waitCreate()
+
 	// Duplicate the configuration so we don't modify the user's copy
 	myCfg := *cfg
+	ctx.applyDefaultTunnelConfig(&myCfg)
 
 	// Must not have name clashes
 	if _, ok := ctx.findTunnelByName(name); ok {
-		return nil, fmt.Errorf("already have tunnel %q", name)
+		return nil, fmt.Errorf("%w %q", ErrTunnelNameExists, name)
 	}
 
-	// Sanity check  the configuration
-	if myCfg.Version != ProtocolVersion3 {
-		return nil, fmt.Errorf("static tunnels can be L2TPv3 only")
+	if myCfg.ReusePort {
+		return nil, fmt.Errorf("port reuse is not supported for an existing socket")
 	}
-	if myCfg.TunnelID == 0 || myCfg.PeerTunnelID == 0 {
-		return nil, fmt.Errorf("L2TPv3 tunnel IDs %v and %v must both be > 0",
-			myCfg.TunnelID, myCfg.PeerTunnelID)
-	}
-	if myCfg.Local == "" {
-		return nil, fmt.Errorf("must specify local address for static tunnel")
-	}
-	if myCfg.Peer == "" {
-		return nil, fmt.Errorf("must specify peer address for static tunnel")
+	if myCfg.IPv6FlowLabel != 0 {
+		return nil, fmt.Errorf("IPv6 flow label is not supported for an existing socket")
 	}
 
-	// Must not have TID clashes
-	if _, ok := ctx.findTunnelByID(myCfg.TunnelID); ok {
-		return nil, fmt.Errorf("already have tunnel with TID %q", myCfg.TunnelID)
+	cp, err := newL2tpControlPlaneFromFD(fd)
+	if err != nil {
+		return nil, fmt.Errorf("unsuitable tunnel socket: %v", err)
 	}
 
-	// Initialise tunnel address structures
-	switch myCfg.Encap {
-	case EncapTypeUDP:
-		sal, sap, err = newUDPAddressPair(myCfg.Local, myCfg.Peer)
-	case EncapTypeIP:
-		sal, sap, err = newIPAddressPair(myCfg.Local, myCfg.TunnelID,
-			myCfg.Peer, myCfg.PeerTunnelID)
-	default:
-		err = fmt.Errorf("unrecognised encapsulation type %v", myCfg.Encap)
+	// For IP encapsulation the socket's connection ID is used by the
+	// kernel to demultiplex received packets
+	myCfg.Encap = EncapTypeUDP
+	var connID uint32
+	switch sa := cp.local.(type) {
+	case *unix.SockaddrL2TPIP:
+		myCfg.Encap = EncapTypeIP
+		connID = sa.ConnId
+	case *unix.SockaddrL2TPIP6:
+		myCfg.Encap = EncapTypeIP
+		connID = sa.ConnId
 	}
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
+	if myCfg.Encap == EncapTypeIP && connID != uint32(myCfg.TunnelID) {
+		cp.close()
+		return nil, fmt.Errorf("unsuitable tunnel socket: bound to connection ID %v rather than tunnel ID %v",
+			connID, myCfg.TunnelID)
 	}
+	myCfg.Local = sockaddrString(cp.local)
+	myCfg.LocalPort = 0
+	myCfg.Peer = sockaddrString(cp.remote)
 
-	t, err := newStaticTunnel(name, ctx, sal, sap, &myCfg)
+	// Sanity check the configuration
+	err = validateTunnelConfig(TunnelTypeAcquiescent, &myCfg)
 	if err != nil {
+		cp.close()
 		return nil, err
 	}
 
-	ctx.linkTunnel(t)
+	// Must not have TID clashes
+	_, err = ctx.reserveTid(myCfg.TunnelID, myCfg.Version)
+	if err != nil {
+		cp.close()
+		return nil, err
+	}
+	defer ctx.releaseTidOnError(myCfg.TunnelID, &err)
+
+	// Must not exceed the limit on tunnels to the peer
+	err = ctx.reserveTunnelPeer(myCfg.TunnelID, cp.remote)
+	if err != nil {
+		cp.close()
+		return nil, err
+	}
+
+	t, err := newQuiescentTunnel(name, ctx, cp.local, cp.remote, &myCfg, cp)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.linkTunnel(t)
+	tunl = t
+
+	return
+}
+
+// NewStaticTunnel creates a new static (unmanaged) L2TP tunnel.
+//
+// A static tunnel does not run any control protocol
+// and instead merely instantiates the data plane in the
+// kernel.  This is equivalent to the Linux 'ip l2tp'
+// command(s).
+//
+// Static L2TPv2 tunnels are not practically useful,
+// so NewStaticTunnel only supports creation of L2TPv3
+// unmanaged tunnel instances.
+//
+// The name provided must be unique in the Context.
+//
+// The tunnel configuration must include local and peer addresses
+// and local and peer tunnel IDs.
+func (ctx *Context) NewStaticTunnel(name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
+
+	var sal, sap unix.Sockaddr
+
+	// Must have configuration
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid nil config")
+	}
+
+	ctx.waitCreate()
+
+	// Duplicate the configuration so we don't modify the user's copy
+	myCfg := *cfg
+	ctx.applyDefaultTunnelConfig(&myCfg)
+
+	// Must not have name clashes
+	if _, ok := ctx.findTunnelByName(name); ok {
+		return nil, fmt.Errorf("%w %q", ErrTunnelNameExists, name)
+	}
+
+	// Sanity check the configuration
+	err = validateTunnelConfig(TunnelTypeStatic, &myCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Must not have TID clashes
+	_, err = ctx.reserveTid(myCfg.TunnelID, myCfg.Version)
+	if err != nil {
+		return nil, err
+	}
+	defer ctx.releaseTidOnError(myCfg.TunnelID, &err)
+
+	// Initialise tunnel address structures
+	sal, sap, err = newTunnelAddressPair(&myCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise tunnel addresses: %w", err)
+	}
+
+	// Must not exceed the limit on tunnels to the peer
+	err = ctx.reserveTunnelPeer(myCfg.TunnelID, sap)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := newStaticTunnel(name, ctx, sal, sap, &myCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.linkTunnel(t)
 	tunl = t
 
 	return
 }
 
+// ValidateTunnelConfig checks whether cfg is a valid configuration for
+// a tunnel of type tt, without instantiating the tunnel.
+//
+// The checks made are those the tunnel creation functions make,
+// other than checks which depend on the tunnels already present in
+// a Context, such as name and tunnel ID clashes.
+func ValidateTunnelConfig(tt TunnelType, cfg *TunnelConfig) error {
+	if cfg == nil {
+		return fmt.Errorf("invalid nil config")
+	}
+	err := validateTunnelConfig(tt, cfg)
+	if err != nil {
+		return err
+	}
+	_, _, err = newTunnelAddressPair(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialise tunnel addresses: %w", err)
+	}
+	return nil
+}
+
+// ValidateSessionConfig checks whether scfg is a valid configuration for
+// a session in a tunnel of type tt using configuration tcfg, without
+// instantiating the session.
+//
+// As with ValidateTunnelConfig, checks which depend on the sessions
+// already present in a tunnel are not made.
+func ValidateSessionConfig(tt TunnelType, tcfg *TunnelConfig, scfg *SessionConfig) error {
+	if tcfg == nil || scfg == nil {
+		return fmt.Errorf("invalid nil config")
+	}
+	return validateSessionConfig(tcfg, scfg, tt != TunnelTypeDynamic && tt != TunnelTypePassive)
+}
+
+func validateTunnelConfig(tt TunnelType, cfg *TunnelConfig) error {
+	if cfg.AddressFamily < AddressFamilyAny || cfg.AddressFamily > AddressFamilyIPv6 {
+		return fmt.Errorf("unrecognised address family %v", cfg.AddressFamily)
+	}
+	if cfg.IPv6FlowLabel > ipv6FlowLabelMask {
+		return fmt.Errorf("IPv6 flow label %#x out of range", cfg.IPv6FlowLabel)
+	}
+	if cfg.DeviceIndex < 0 {
+		return fmt.Errorf("device index %v must not be negative", cfg.DeviceIndex)
+	}
+	if cfg.Device != "" && cfg.DeviceIndex != 0 {
+		return fmt.Errorf("cannot specify both device %q and device index %v",
+			cfg.Device, cfg.DeviceIndex)
+	}
+	if cfg.SocketPriority < 0 || int64(cfg.SocketPriority) > math.MaxUint32 {
+		return fmt.Errorf("socket priority %v out of range", cfg.SocketPriority)
+	}
+	if cfg.PreferredSource != "" {
+		if _, err := tunnelLocalAddress(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.MaxSessions < 0 {
+		return fmt.Errorf("maximum sessions %v must not be negative", cfg.MaxSessions)
+	}
+	if cfg.RouterID != 0 && cfg.Version != ProtocolVersion3 {
+		return fmt.Errorf("router ID is supported for L2TPv3 tunnels only")
+	}
+	if cfg.StopAndWait && cfg.WindowSize > 1 {
+		return fmt.Errorf("window size %v is incompatible with stop-and-wait", cfg.WindowSize)
+	}
+	if cfg.EstablishTimeout < 0 {
+		return fmt.Errorf("establish timeout %v must not be negative", cfg.EstablishTimeout)
+	}
+	if cfg.ControlReadTimeout < 0 || cfg.ControlWriteTimeout < 0 {
+		return fmt.Errorf("control read/write timeouts %v/%v must not be negative",
+			cfg.ControlReadTimeout, cfg.ControlWriteTimeout)
+	}
+	if cfg.ReconnectMin < 0 || cfg.ReconnectMax < 0 {
+		return fmt.Errorf("reconnect backoff %v..%v must not be negative",
+			cfg.ReconnectMin, cfg.ReconnectMax)
+	}
+	if cfg.ReconnectMin > 0 && cfg.ReconnectMax > 0 && cfg.ReconnectMin > cfg.ReconnectMax {
+		return fmt.Errorf("reconnect minimum %v exceeds maximum %v",
+			cfg.ReconnectMin, cfg.ReconnectMax)
+	}
+	if cfg.Persist && tt != TunnelTypeDynamic {
+		return fmt.Errorf("persist is supported for dynamic tunnels only")
+	}
+	if cfg.ResolveInterval < 0 {
+		return fmt.Errorf("resolve interval %v must not be negative", cfg.ResolveInterval)
+	}
+	if cfg.ResolveInterval > 0 && !cfg.Persist {
+		return fmt.Errorf("resolve interval requires persist to be set")
+	}
+	if len(cfg.VendorAVPs) > 0 && tt != TunnelTypeDynamic && tt != TunnelTypePassive {
+		return fmt.Errorf("vendor AVPs are supported for dynamic tunnels only")
+	}
+	for i := range cfg.VendorAVPs {
+		if _, err := cfg.VendorAVPs[i].toAvp(); err != nil {
+			return err
+		}
+	}
+	switch tt {
+	case TunnelTypeDynamic, TunnelTypePassive:
+		if cfg.Version != ProtocolVersion3 && cfg.Encap == EncapTypeIP {
+			return fmt.Errorf("IP encapsulation only supported for L2TPv3 tunnels")
+		}
+		if cfg.Version == ProtocolVersion2 {
+			if cfg.TunnelID > 65535 {
+				return fmt.Errorf("L2TPv2 connection ID %v out of range", cfg.TunnelID)
+			}
+		}
+		if cfg.PeerTunnelID != 0 {
+			return fmt.Errorf("peer connection ID cannot be specified for dynamic tunnels")
+		}
+		if cfg.Peer == "" {
+			return fmt.Errorf("must specify peer address for dynamic tunnel")
+		}
+	case TunnelTypeAcquiescent:
+		if cfg.Version != ProtocolVersion3 && cfg.Encap == EncapTypeIP {
+			return fmt.Errorf("IP encapsulation only supported for L2TPv3 tunnels")
+		}
+		if cfg.Version == ProtocolVersion2 {
+			if cfg.TunnelID == 0 || cfg.TunnelID > 65535 {
+				return fmt.Errorf("L2TPv2 connection ID %v out of range", cfg.TunnelID)
+			} else if cfg.PeerTunnelID == 0 || cfg.PeerTunnelID > 65535 {
+				return fmt.Errorf("L2TPv2 peer connection ID %v out of range", cfg.PeerTunnelID)
+			}
+		} else {
+			if cfg.TunnelID == 0 || cfg.PeerTunnelID == 0 {
+				return fmt.Errorf("L2TPv3 tunnel IDs %v and %v must both be > 0",
+					cfg.TunnelID, cfg.PeerTunnelID)
+			}
+		}
+		if cfg.Local == "" {
+			return fmt.Errorf("must specify local address for quiescent tunnel")
+		}
+		if cfg.Peer == "" {
+			return fmt.Errorf("must specify peer address for quiescent tunnel")
+		}
+		if cfg.EstablishTimeout != 0 {
+			return fmt.Errorf("establish timeout is not supported for quiescent tunnels")
+		}
+	case TunnelTypeStatic:
+		if cfg.Version != ProtocolVersion3 {
+			return fmt.Errorf("static tunnels can be L2TPv3 only")
+		}
+		if cfg.TunnelID == 0 || cfg.PeerTunnelID == 0 {
+			return fmt.Errorf("L2TPv3 tunnel IDs %v and %v must both be > 0",
+				cfg.TunnelID, cfg.PeerTunnelID)
+		}
+		if cfg.Local == "" {
+			return fmt.Errorf("must specify local address for static tunnel")
+		}
+		if cfg.Peer == "" {
+			return fmt.Errorf("must specify peer address for static tunnel")
+		}
+		if cfg.Device != "" || cfg.DeviceIndex != 0 {
+			return fmt.Errorf("binding to a device is not supported for static tunnels")
+		}
+		if cfg.IPv6FlowLabel != 0 {
+			return fmt.Errorf("IPv6 flow label is not supported for static tunnels")
+		}
+		if cfg.PMTUDisc != PMTUDiscDefault {
+			return fmt.Errorf("path MTU discovery mode is not supported for static tunnels")
+		}
+		if cfg.EstablishTimeout != 0 {
+			return fmt.Errorf("establish timeout is not supported for static tunnels")
+		}
+		if cfg.ControlReadTimeout != 0 || cfg.ControlWriteTimeout != 0 {
+			return fmt.Errorf("control read/write timeouts are not supported for static tunnels")
+		}
+		if cfg.ReusePort {
+			return fmt.Errorf("port reuse is not supported for static tunnels")
+		}
+		if cfg.SocketPriority != 0 {
+			return fmt.Errorf("socket priority is not supported for static tunnels")
+		}
+		if cfg.CaptureFile != "" {
+			return fmt.Errorf("control packet capture is not supported for static tunnels")
+		}
+	default:
+		return fmt.Errorf("unrecognised tunnel type %v", tt)
+	}
+	return nil
+}
+
+func newTunnelAddressPair(cfg *TunnelConfig) (sal, sap unix.Sockaddr, err error) {
+	local, err := tunnelLocalAddress(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch cfg.Encap {
+	case EncapTypeUDP:
+		return newUDPAddressPair(local, cfg.LocalPort, cfg.Peer, cfg.AddressFamily)
+	case EncapTypeIP:
+		return newIPAddressPair(local, cfg.TunnelID, cfg.Peer, cfg.PeerTunnelID, cfg.AddressFamily)
+	}
+	return nil, nil, fmt.Errorf("unrecognised encapsulation type %v", cfg.Encap)
+}
+
+// tunnelBindError returns the error to report when binding a tunnel
+// socket fails.  Tunnels default to the L2TP port, so a second tunnel
+// with the same local address fails to bind unless ReusePort is set:
+// in this case the error explains how to resolve the clash.
+func tunnelBindError(cfg *TunnelConfig, sal unix.Sockaddr, err error) error {
+	if !errors.Is(err, unix.EADDRINUSE) || cfg.ReusePort {
+		return err
+	}
+	return &AddressError{
+		Address: sockaddrString(sal),
+		Local:   true,
+		Err:     fmt.Errorf("%w: another socket is bound to this address, so specify a different local address or port, or set ReusePort", err),
+	}
+}
+
+// tunnelLocalAddress returns the local address a tunnel should bind to,
+// substituting the preferred source address where the configured local
+// address leaves the host unspecified.
+func tunnelLocalAddress(cfg *TunnelConfig) (string, error) {
+	if cfg.PreferredSource == "" {
+		return cfg.Local, nil
+	}
+
+	src := net.ParseIP(cfg.PreferredSource)
+	if src == nil {
+		return "", fmt.Errorf("preferred source %q is not an IP address", cfg.PreferredSource)
+	}
+	if src.IsUnspecified() {
+		return "", fmt.Errorf("preferred source %v must not be a wildcard address", src)
+	}
+	if (cfg.AddressFamily == AddressFamilyIPv4 && src.To4() == nil) ||
+		(cfg.AddressFamily == AddressFamilyIPv6 && src.To4() != nil) {
+		return "", fmt.Errorf("preferred source %v is not an %v address", src, cfg.AddressFamily)
+	}
+
+	if cfg.Local == "" {
+		return src.String(), nil
+	}
+
+	host, port, err := net.SplitHostPort(cfg.Local)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(cfg.Local, "["), "]"), ""
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return "", fmt.Errorf("cannot specify both preferred source %v and local address %q",
+			src, cfg.Local)
+	}
+	if port == "" {
+		return src.String(), nil
+	}
+	return net.JoinHostPort(src.String(), port), nil
+}
+
+// resolvePeerAddress resolves the peer address of a tunnel.
+func resolvePeerAddress(cfg *TunnelConfig) (unix.Sockaddr, error) {
+	switch cfg.Encap {
+	case EncapTypeUDP:
+		return newUDPTunnelAddress(udpAddressWithPort(cfg.Peer, defaultUDPPort), cfg.AddressFamily)
+	case EncapTypeIP:
+		return newIPTunnelAddress(cfg.Peer, 0, cfg.AddressFamily)
+	}
+	return nil, fmt.Errorf("unrecognised encapsulation type %v", cfg.Encap)
+}
+
 // RegisterEventHandler adds an event handler to the L2TP context.
 //
 // On return, the event handler may be called at any time.
 //
 // The event handler may be called from multiple go routines managed
 // by the L2TP context.
+//
+// RegisterEventHandler may be called from an event handler callback.
+// A handler registered during dispatch of an event is called for
+// subsequent events only.
 func (ctx *Context) RegisterEventHandler(handler EventHandler) {
 	ctx.evtLock.Lock()
 	defer ctx.evtLock.Unlock()
@@ -503,60 +1512,307 @@ func (ctx *Context) RegisterEventHandler(handler EventHandler) {
 
 // UnregisterEventHandler removes an event handler from the L2TP context.
 //
-// It must not be called from the context of an event handler callback.
+// UnregisterEventHandler may be called from an event handler callback,
+// including that of the handler being removed.
 //
 // On return the event handler will not be called on further L2TP events.
+// Events already being dispatched by other goroutines when the handler
+// is removed may still be passed to it.
+//
+// Handlers of uncomparable types, such as EventHandlerFunc values, cannot
+// be identified for removal and are ignored.  See EventHandlerFunc for how
+// to unregister a function handler.
 func (ctx *Context) UnregisterEventHandler(handler EventHandler) {
+	if handler == nil || !reflect.TypeOf(handler).Comparable() {
+		return
+	}
 	ctx.evtLock.Lock()
 	defer ctx.evtLock.Unlock()
 	for i, hdlr := range ctx.eventHandlers {
 		if hdlr == handler {
-			ctx.eventHandlers = append(ctx.eventHandlers[:], ctx.eventHandlers[i+1:]...)
+			// Build a new slice rather than modifying the existing one
+			// in place, since it may be being iterated by handleUserEvent.
+			handlers := make([]EventHandler, 0, len(ctx.eventHandlers)-1)
+			handlers = append(handlers, ctx.eventHandlers[:i]...)
+			ctx.eventHandlers = append(handlers, ctx.eventHandlers[i+1:]...)
 			break
 		}
 	}
 }
 
+// ListTunnels returns a snapshot of the tunnels currently instantiated
+// in the L2TP context, ordered by tunnel name.
+func (ctx *Context) ListTunnels() []Tunnel {
+	ctx.tlock.RLock()
+	defer ctx.tlock.RUnlock()
+	tunnels := make([]Tunnel, 0, len(ctx.tunnelsByName))
+	for _, tunl := range ctx.tunnelsByName {
+		tunnels = append(tunnels, tunl)
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].Name() < tunnels[j].Name()
+	})
+	return tunnels
+}
+
+// handleUserEvent passes an event to the registered event handlers.
+//
+// The handlers are called without holding evtLock so that they may
+// register and unregister handlers, and block, without stalling event
+// dispatch elsewhere.  This is safe since the handler slice is never
+// modified in place: RegisterEventHandler only appends beyond the length
+// of any snapshot, and UnregisterEventHandler replaces the slice.
 func (ctx *Context) handleUserEvent(event interface{}) {
 	ctx.evtLock.RLock()
-	defer ctx.evtLock.RUnlock()
-	for _, hdlr := range ctx.eventHandlers {
+	handlers := ctx.eventHandlers
+	ctx.evtLock.RUnlock()
+	for _, hdlr := range handlers {
 		hdlr.HandleEvent(event)
 	}
 }
 
 // Close tears down the context, including all the L2TP tunnels and sessions
 // running inside it.
+//
+// Tunnels are closed concurrently.  Close blocks until all tunnels have
+// been torn down: for dynamic tunnels this includes transmission of a
+// StopCCN message to the peer, which completes when the peer acknowledges
+// the message or when the reliable transport gives up retransmitting it.
+// Use Shutdown or CloseWithTimeout to bound the time spent waiting for
+// the peer.
 func (ctx *Context) Close() {
-	tunnels := []Tunnel{}
+	_ = ctx.Shutdown(context.Background())
+}
+
+// CloseWithTimeout tears down the context in the same way as Close, but
+// bounds the time spent closing each tunnel.
+//
+// Any tunnel which has not closed within the timeout is forcibly killed:
+// its data plane is torn down without waiting for the control protocol
+// exchange with the peer to complete.  CloseWithTimeout then waits up to
+// the timeout again for the killed tunnel to finish closing.  A timeout
+// of zero or less waits indefinitely, as for Close.
+func (ctx *Context) CloseWithTimeout(d time.Duration) {
+	var wg sync.WaitGroup
+	for _, tunl := range ctx.unlinkAllTunnels() {
+		wg.Add(1)
+		go func(tunl tunnel) {
+			defer wg.Done()
+			ctx.closeTunnelWithTimeout(tunl, d)
+		}(tunl)
+	}
+	wg.Wait()
+	ctx.dp.Close()
+}
+
+// Shutdown tears down the context in the same way as Close, but returns
+// early if the supplied context is cancelled or its deadline expires
+// before all tunnels have been torn down.
+//
+// In this case Shutdown returns the context's error, and the teardown of
+// the remaining tunnels continues in the background.  Dynamic tunnels will
+// still complete their StopCCN exchange or exhaust their retransmit
+// attempts, after which the data plane is closed.
+func (ctx *Context) Shutdown(shutdownCtx context.Context) error {
+	tunnels := ctx.unlinkAllTunnels()
+
+	done := make(chan interface{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, tunl := range tunnels {
+			wg.Add(1)
+			go func(tunl tunnel) {
+				defer wg.Done()
+				tunl.Close()
+			}(tunl)
+		}
+		wg.Wait()
+		ctx.dp.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-shutdownCtx.Done():
+		return shutdownCtx.Err()
+	}
+}
+
+// unlinkAllTunnels stops pending reconnects and removes all tunnels from
+// the context in preparation for closing them.
+func (ctx *Context) unlinkAllTunnels() []tunnel {
+	tunnels := []tunnel{}
+
+	ctx.stopReconnects()
 
 	ctx.tlock.Lock()
 	for name, tunl := range ctx.tunnelsByName {
 		tunnels = append(tunnels, tunl)
 		delete(ctx.tunnelsByName, name)
 		delete(ctx.tunnelsByID, tunl.getCfg().TunnelID)
+		delete(ctx.tunnelPeers, tunl.getCfg().TunnelID)
 	}
 	ctx.tlock.Unlock()
 
-	for _, tunl := range tunnels {
+	return tunnels
+}
+
+// closeTunnelWithTimeout closes a tunnel, killing it if the close
+// doesn't complete within the timeout.
+func (ctx *Context) closeTunnelWithTimeout(tunl tunnel, d time.Duration) {
+	if d <= 0 {
 		tunl.Close()
+		return
 	}
 
-	ctx.dp.Close()
+	done := make(chan interface{})
+	go func() {
+		tunl.Close()
+		close(done)
+	}()
+
+	timeout := time.NewTimer(d)
+	defer timeout.Stop()
+
+	select {
+	case <-done:
+	case <-timeout.C:
+		level.Warn(ctx.logger).Log(
+			"message", "tunnel close timed out, killing tunnel",
+			"tunnel_name", tunl.getName(),
+			"timeout", d)
+		tunl.kill()
+
+		// Killing the tunnel should unblock the close, which must
+		// complete before the Context data plane is closed
+		timeout.Reset(d)
+		select {
+		case <-done:
+		case <-timeout.C:
+			level.Error(ctx.logger).Log(
+				"message", "tunnel close timed out after killing tunnel",
+				"tunnel_name", tunl.getName(),
+				"timeout", d)
+		}
+	}
+}
 
+// randUint32 returns a random value from the context's random source.
+func (ctx *Context) randUint32() uint32 {
+	ctx.rngLock.Lock()
+	defer ctx.rngLock.Unlock()
+	return ctx.rng.Uint32()
 }
 
-func (ctx *Context) allocTid(version ProtocolVersion) (ControlConnID, error) {
+// allocID allocates a tunnel or session ID for which inUse returns false
+// using the context's ID allocation strategy.
+func (ctx *Context) allocID(kind string, version ProtocolVersion, inUse func(id ControlConnID) bool) (ControlConnID, error) {
+	if ctx.idAlloc == IDAllocSequential {
+		var max ControlConnID
+		switch version {
+		case ProtocolVersion2:
+			max = v2TidSidMax
+		case ProtocolVersion3:
+			max = ControlConnID(^uint32(0))
+		default:
+			return 0, fmt.Errorf("failed to allocate %s ID: unhandled version %v", kind, version)
+		}
+		// ID 0 is reserved in both RFC2661 and RFC3931
+		for id := ControlConnID(1); ; id++ {
+			if !inUse(id) {
+				return id, nil
+			}
+			if id == max {
+				return 0, ErrIDSpaceExhausted
+			}
+		}
+	}
 	for i := 0; i < 10; i++ {
-		id, err := generateControlConnID(version)
+		id, err := generateControlConnID(version, ctx.randUint32)
 		if err != nil {
-			return 0, fmt.Errorf("failed to generate tunnel ID: %v", err)
+			return 0, fmt.Errorf("failed to generate %s ID: %v", kind, err)
 		}
-		if _, ok := ctx.findTunnelByID(id); !ok {
+		if !inUse(id) {
 			return id, nil
 		}
 	}
-	return 0, fmt.Errorf("ID space exhausted")
+	return 0, ErrIDSpaceExhausted
+}
+
+// reserveTid reserves a tunnel ID for a tunnel being created, allocating
+// an ID if tid is zero.  The reservation is a nil entry in tunnelsByID,
+// which is replaced when the tunnel is linked.
+func (ctx *Context) reserveTid(tid ControlConnID, version ProtocolVersion) (ControlConnID, error) {
+	ctx.tlock.Lock()
+	defer ctx.tlock.Unlock()
+
+	if tid != 0 {
+		if _, ok := ctx.tunnelsByID[tid]; ok {
+			return 0, fmt.Errorf("%w %v", ErrTunnelIDExists, tid)
+		}
+	}
+	if ctx.maxTunnels > 0 && len(ctx.tunnelsByID) >= ctx.maxTunnels {
+		return 0, fmt.Errorf("%w: maximum of %v tunnels", ErrTunnelLimitReached, ctx.maxTunnels)
+	}
+	if tid == 0 {
+		var err error
+		tid, err = ctx.allocID("tunnel", version, func(id ControlConnID) bool {
+			_, ok := ctx.tunnelsByID[id]
+			return ok
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to allocate a TID: %w", err)
+		}
+		// Should not occur, c.f. generateControlConnID
+		if tid == 0 {
+			return 0, fmt.Errorf("allocated invalid TID %v", tid)
+		}
+	}
+
+	ctx.tunnelsByID[tid] = nil
+	return tid, nil
+}
+
+// reserveTunnelPeer records the peer address of a tunnel being created
+// using a tunnel ID reserved by reserveTid, enforcing the limit on the
+// number of tunnels per peer.
+func (ctx *Context) reserveTunnelPeer(tid ControlConnID, sap unix.Sockaddr) error {
+	if ctx.maxPerPeer <= 0 {
+		return nil
+	}
+
+	host := sockaddrHost(sap)
+
+	ctx.tlock.Lock()
+	defer ctx.tlock.Unlock()
+
+	var n int
+	for _, h := range ctx.tunnelPeers {
+		if h == host {
+			n++
+		}
+	}
+	if n >= ctx.maxPerPeer {
+		return fmt.Errorf("%w: maximum of %v tunnels to peer %v",
+			ErrTunnelLimitReached, ctx.maxPerPeer, host)
+	}
+	ctx.tunnelPeers[tid] = host
+	return nil
+}
+
+// releaseTidOnError releases a tunnel ID reserved by reserveTid if
+// *err is set, i.e. if the tunnel creation failed.
+func (ctx *Context) releaseTidOnError(tid ControlConnID, err *error) {
+	if *err == nil {
+		return
+	}
+	ctx.tlock.Lock()
+	defer ctx.tlock.Unlock()
+	if t, ok := ctx.tunnelsByID[tid]; ok && t == nil {
+		delete(ctx.tunnelsByID, tid)
+		delete(ctx.tunnelPeers, tid)
+	}
 }
 
 func (ctx *Context) linkTunnel(tunl tunnel) {
@@ -569,8 +1825,38 @@ func (ctx *Context) linkTunnel(tunl tunnel) {
 func (ctx *Context) unlinkTunnel(tunl tunnel) {
 	ctx.tlock.Lock()
 	defer ctx.tlock.Unlock()
-	delete(ctx.tunnelsByName, tunl.getName())
-	delete(ctx.tunnelsByID, tunl.getCfg().TunnelID)
+	// The tunnel may already have been replaced, e.g. by a persistent
+	// tunnel being re-created, so check it's still the one linked.
+	if t, ok := ctx.tunnelsByName[tunl.getName()]; ok && t == tunl {
+		delete(ctx.tunnelsByName, tunl.getName())
+	}
+	if t, ok := ctx.tunnelsByID[tunl.getCfg().TunnelID]; ok && t == tunl {
+		delete(ctx.tunnelsByID, tunl.getCfg().TunnelID)
+		delete(ctx.tunnelPeers, tunl.getCfg().TunnelID)
+	}
+}
+
+// L2TPv3 session IDs are unique to the host rather than to the tunnel,
+// so the context tracks the IDs of L2TPv3 sessions in all its tunnels.
+func (ctx *Context) linkV3Session(s session) {
+	ctx.v3SessionLock.Lock()
+	defer ctx.v3SessionLock.Unlock()
+	ctx.v3Sessions[s.getCfg().SessionID] = s
+}
+
+func (ctx *Context) unlinkV3Session(s session) {
+	ctx.v3SessionLock.Lock()
+	defer ctx.v3SessionLock.Unlock()
+	if ls, ok := ctx.v3Sessions[s.getCfg().SessionID]; ok && ls == s {
+		delete(ctx.v3Sessions, s.getCfg().SessionID)
+	}
+}
+
+func (ctx *Context) v3SessionIDInUse(id ControlConnID) bool {
+	ctx.v3SessionLock.Lock()
+	defer ctx.v3SessionLock.Unlock()
+	_, ok := ctx.v3Sessions[id]
+	return ok
 }
 
 func (ctx *Context) findTunnelByName(name string) (tunl tunnel, ok bool) {
@@ -587,6 +1873,14 @@ func (ctx *Context) findTunnelByID(tid ControlConnID) (tunl tunnel, ok bool) {
 	return
 }
 
+// waitCreate blocks until the creation rate limit, if any, permits
+// a new tunnel or session instance to be created.
+func (ctx *Context) waitCreate() {
+	if ctx.createLimit != nil {
+		ctx.createLimit.wait()
+	}
+}
+
 func (ctx *Context) allocCallSerial() uint32 {
 	ctx.serialLock.Lock()
 	defer ctx.serialLock.Unlock()
@@ -594,9 +1888,76 @@ func (ctx *Context) allocCallSerial() uint32 {
 	return ctx.callSerial
 }
 
-func newUDPTunnelAddress(address string) (unix.Sockaddr, error) {
+// zoneToIndex converts an IPv6 zone string, as used by net.UDPAddr, into
+// the interface index used by the unix IPv6 sockaddr types.
+// The zone may be either an interface name or a numeric index.
+// An empty zone maps to index zero.
+func zoneToIndex(zone string) (uint32, error) {
+	if zone == "" {
+		return 0, nil
+	}
+	if ifi, err := net.InterfaceByName(zone); err == nil {
+		return uint32(ifi.Index), nil
+	}
+	if idx, err := strconv.ParseUint(zone, 10, 32); err == nil {
+		return uint32(idx), nil
+	}
+	return 0, fmt.Errorf("failed to resolve IPv6 zone %q", zone)
+}
+
+// lookupIPAddr resolves host names for tunnel addresses.  It may be
+// replaced by tests.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// resolveUDPAddr resolves a host:port address string.  If the host is a
+// name rather than a literal address, the address chosen is constrained
+// to the specified family.
+func resolveUDPAddr(address string, family AddressFamily) (*net.UDPAddr, error) {
+	network := "udp"
+	switch family {
+	case AddressFamilyIPv4:
+		network = "udp4"
+	case AddressFamilyIPv6:
+		network = "udp6"
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" || net.ParseIP(strings.SplitN(host, "%", 2)[0]) != nil {
+		return net.ResolveUDPAddr(network, address)
+	}
 
-	u, err := net.ResolveUDPAddr("udp", address)
+	portnum, err := net.LookupPort(network, port)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := lookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prefer IPv4 addresses if either family is permitted
+	var first *net.IPAddr
+	for i, a := range addrs {
+		isIPv4 := a.IP.To4() != nil
+		if (family == AddressFamilyIPv4 && !isIPv4) || (family == AddressFamilyIPv6 && isIPv4) {
+			continue
+		}
+		if isIPv4 || family == AddressFamilyIPv6 {
+			return &net.UDPAddr{IP: a.IP, Port: portnum, Zone: a.Zone}, nil
+		}
+		if first == nil {
+			first = &addrs[i]
+		}
+	}
+	if first != nil {
+		return &net.UDPAddr{IP: first.IP, Port: portnum, Zone: first.Zone}, nil
+	}
+	return nil, fmt.Errorf("no %v address found for %v", family, host)
+}
+
+func newUDPTunnelAddress(address string, family AddressFamily) (unix.Sockaddr, error) {
+
+	u, err := resolveUDPAddr(address, family)
 	if err != nil {
 		return nil, fmt.Errorf("resolve %v: %v", address, err)
 	}
@@ -607,8 +1968,10 @@ func newUDPTunnelAddress(address string) (unix.Sockaddr, error) {
 			Addr: [4]byte{b[0], b[1], b[2], b[3]},
 		}, nil
 	} else if b := u.IP.To16(); b != nil {
-		// TODO: SockaddrInet6 has a uint32 ZoneId, while UDPAddr
-		// has a Zone string.  How to convert between the two?
+		zoneID, err := zoneToIndex(u.Zone)
+		if err != nil {
+			return nil, err
+		}
 		return &unix.SockaddrInet6{
 			Port: u.Port,
 			Addr: [16]byte{
@@ -617,34 +1980,63 @@ func newUDPTunnelAddress(address string) (unix.Sockaddr, error) {
 				b[8], b[9], b[10], b[11],
 				b[12], b[13], b[14], b[15],
 			},
-			// ZoneId
+			ZoneId: zoneID,
 		}, nil
 	}
 
 	return nil, fmt.Errorf("unhandled address family")
 }
 
-func newUDPAddressPair(local, remote string) (sal, sap unix.Sockaddr, err error) {
+// udpAddressWithPort returns the address string to resolve for a UDP
+// tunnel.  If the address doesn't include a port, port is added.
+func udpAddressWithPort(address string, port uint16) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
 
-	// We expect the peer address to always be set
-	sap, err = newUDPTunnelAddress(remote)
+// ipAddressHost returns the host to resolve for an IP tunnel address.
+// Ports have no meaning for IP encapsulation, so an address which
+// includes a port is rejected.
+func ipAddressHost(address string) (string, error) {
+	if _, port, err := net.SplitHostPort(address); err == nil {
+		return "", fmt.Errorf("port %v is not applicable to IP encapsulation", port)
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(address, "["), "]"), nil
+}
+
+func newUDPAddressPair(local string, localPort uint16, remote string, family AddressFamily) (sal, sap unix.Sockaddr, err error) {
+
+	// We expect the peer address to always be set.  If it doesn't
+	// include a port, the well-known L2TP port is assumed.
+	sap, err = newUDPTunnelAddress(udpAddressWithPort(remote, defaultUDPPort), family)
 	if err != nil {
-		return nil, nil, fmt.Errorf("remote address %q: %v", remote, err)
+		return nil, nil, &AddressError{Address: remote, Err: err}
+	}
+
+	if localPort == 0 {
+		localPort = defaultUDPPort
 	}
 
 	// The local address may not be set: in this case return
-	// a zero-value sockaddr appropriate to the peer address type
+	// a wildcard sockaddr appropriate to the peer address type
 	if local != "" {
-		sal, err = newUDPTunnelAddress(local)
+		sal, err = newUDPTunnelAddress(udpAddressWithPort(local, localPort), family)
 		if err != nil {
-			return nil, nil, fmt.Errorf("local address %q: %v", local, err)
+			return nil, nil, &AddressError{Address: local, Local: true, Err: err}
+		}
+		err = checkAddressFamilies(sal, sap, local, remote)
+		if err != nil {
+			return nil, nil, err
 		}
 	} else {
 		switch sap.(type) {
 		case *unix.SockaddrInet4:
-			sal = &unix.SockaddrInet4{}
+			sal = &unix.SockaddrInet4{Port: int(localPort)}
 		case *unix.SockaddrInet6:
-			sal = &unix.SockaddrInet6{}
+			sal = &unix.SockaddrInet6{Port: int(localPort)}
 		default:
 			// should not occur, c.f. newUDPTunnelAddress
 			return nil, nil, fmt.Errorf("unhanded address family")
@@ -653,9 +2045,14 @@ func newUDPAddressPair(local, remote string) (sal, sap unix.Sockaddr, err error)
 	return
 }
 
-func newIPTunnelAddress(address string, ccid ControlConnID) (unix.Sockaddr, error) {
+func newIPTunnelAddress(address string, ccid ControlConnID, family AddressFamily) (unix.Sockaddr, error) {
 
-	u, err := net.ResolveUDPAddr("udp", address)
+	host, err := ipAddressHost(address)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := resolveUDPAddr(net.JoinHostPort(host, "0"), family)
 	if err != nil {
 		return nil, fmt.Errorf("resolve %v: %v", address, err)
 	}
@@ -666,8 +2063,10 @@ func newIPTunnelAddress(address string, ccid ControlConnID) (unix.Sockaddr, erro
 			ConnId: uint32(ccid),
 		}, nil
 	} else if b := u.IP.To16(); b != nil {
-		// TODO: SockaddrInet6 has a uint32 ZoneId, while UDPAddr
-		// has a Zone string.  How to convert between the two?
+		zoneID, err := zoneToIndex(u.Zone)
+		if err != nil {
+			return nil, err
+		}
 		return &unix.SockaddrL2TPIP6{
 			Addr: [16]byte{
 				b[0], b[1], b[2], b[3],
@@ -675,7 +2074,7 @@ func newIPTunnelAddress(address string, ccid ControlConnID) (unix.Sockaddr, erro
 				b[8], b[9], b[10], b[11],
 				b[12], b[13], b[14], b[15],
 			},
-			// ZoneId
+			ZoneId: zoneID,
 			ConnId: uint32(ccid),
 		}, nil
 	}
@@ -683,26 +2082,47 @@ func newIPTunnelAddress(address string, ccid ControlConnID) (unix.Sockaddr, erro
 	return nil, fmt.Errorf("unhandled address family")
 }
 
-func newIPAddressPair(local string, ccid ControlConnID, remote string, pccid ControlConnID) (sal, sap unix.Sockaddr, err error) {
+func newIPAddressPair(local string, ccid ControlConnID, remote string, pccid ControlConnID, family AddressFamily) (sal, sap unix.Sockaddr, err error) {
 	// We expect the peer address to always be set
-	sap, err = newIPTunnelAddress(remote, pccid)
+	sap, err = newIPTunnelAddress(remote, pccid, family)
 	if err != nil {
-		return nil, nil, fmt.Errorf("remote address %q: %v", remote, err)
+		return nil, nil, &AddressError{Address: remote, Err: err}
 	}
 
-	// The local address may not be set: in this case return
-	// a zero-value sockaddr appropriate to the peer address type
+	// The local address may not be set: in this case use the source
+	// address of the kernel's route to the peer.  If the route lookup
+	// fails return a zero-value sockaddr appropriate to the peer address
+	// type.
 	if local != "" {
-		sal, err = newIPTunnelAddress(local, ccid)
+		sal, err = newIPTunnelAddress(local, ccid, family)
+		if err != nil {
+			return nil, nil, &AddressError{Address: local, Local: true, Err: err}
+		}
+		err = checkAddressFamilies(sal, sap, local, remote)
 		if err != nil {
-			return nil, nil, fmt.Errorf("local address %q: %v", local, err)
+			return nil, nil, err
 		}
 	} else {
-		switch sap.(type) {
+		switch sa := sap.(type) {
 		case *unix.SockaddrL2TPIP:
 			sal = &unix.SockaddrL2TPIP{}
+			if src, err := routeSourceLookup(net.IP(sa.Addr[:])); err == nil {
+				if b := src.To4(); b != nil {
+					sal = &unix.SockaddrL2TPIP{
+						Addr:   [4]byte{b[0], b[1], b[2], b[3]},
+						ConnId: uint32(ccid),
+					}
+				}
+			}
 		case *unix.SockaddrL2TPIP6:
 			sal = &unix.SockaddrL2TPIP6{}
+			if src, err := routeSourceLookup(net.IP(sa.Addr[:])); err == nil {
+				if b := src.To16(); b != nil && src.To4() == nil {
+					l6 := &unix.SockaddrL2TPIP6{ZoneId: sa.ZoneId, ConnId: uint32(ccid)}
+					copy(l6.Addr[:], b)
+					sal = l6
+				}
+			}
 		default:
 			// should not occur, c.f. newIPTunnelAddress
 			return nil, nil, fmt.Errorf("unhanded address family")
@@ -711,6 +2131,58 @@ func newIPAddressPair(local string, ccid ControlConnID, remote string, pccid Con
 	return
 }
 
+// sockaddrString returns the string representation of a tunnel
+// address, in the form accepted by the Local and Peer fields of
+// TunnelConfig.
+func sockaddrString(sa unix.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *unix.SockaddrInet6:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *unix.SockaddrL2TPIP:
+		return net.IP(sa.Addr[:]).String()
+	case *unix.SockaddrL2TPIP6:
+		return net.IP(sa.Addr[:]).String()
+	}
+	return ""
+}
+
+// sockaddrHost returns the IP address of a tunnel address as a string,
+// omitting any port.
+func sockaddrHost(sa unix.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(sa.Addr[:]).String()
+	case *unix.SockaddrInet6:
+		return net.IP(sa.Addr[:]).String()
+	}
+	return sockaddrString(sa)
+}
+
+func sockaddrFamily(sa unix.Sockaddr) int {
+	switch sa.(type) {
+	case *unix.SockaddrInet4, *unix.SockaddrL2TPIP:
+		return unix.AF_INET
+	case *unix.SockaddrInet6, *unix.SockaddrL2TPIP6:
+		return unix.AF_INET6
+	}
+	return unix.AF_UNSPEC
+}
+
+// checkAddressFamilies ensures that the resolved local and peer tunnel
+// addresses are of the same address family.
+func checkAddressFamilies(sal, sap unix.Sockaddr, local, remote string) error {
+	if sockaddrFamily(sal) != sockaddrFamily(sap) {
+		return &AddressError{
+			Address: local,
+			Local:   true,
+			Err:     fmt.Errorf("%w with peer address %q", ErrAddressFamilyMismatch, remote),
+		}
+	}
+	return nil
+}
+
 func initDataPlane(dp DataPlane) (DataPlane, error) {
 	if dp == nil {
 		return &nullDataPlane{}, nil
@@ -720,17 +2192,25 @@ func initDataPlane(dp DataPlane) (DataPlane, error) {
 	return dp, nil
 }
 
-func generateControlConnID(version ProtocolVersion) (ControlConnID, error) {
-	var id ControlConnID
-	switch version {
-	case ProtocolVersion2:
-		id = ControlConnID(uint16(rand.Uint32()))
-	case ProtocolVersion3:
-		id = ControlConnID(rand.Uint32())
-	default:
-		return 0, fmt.Errorf("unhandled version %v", version)
+// generateControlConnID returns a random, non-zero, control connection ID
+// appropriate for the protocol version, using randUint32 as the random source.
+// ID 0 is reserved in both RFC2661 and RFC3931, so is never returned.
+func generateControlConnID(version ProtocolVersion, randUint32 func() uint32) (ControlConnID, error) {
+	for i := 0; i < 10; i++ {
+		var id ControlConnID
+		switch version {
+		case ProtocolVersion2:
+			id = ControlConnID(uint16(randUint32()))
+		case ProtocolVersion3:
+			id = ControlConnID(randUint32())
+		default:
+			return 0, fmt.Errorf("unhandled version %v", version)
+		}
+		if id != 0 {
+			return id, nil
+		}
 	}
-	return id, nil
+	return 0, fmt.Errorf("failed to generate a non-zero ID")
 }
 
 // baseTunnel implements base functionality which all tunnel types will need
@@ -742,16 +2222,25 @@ type baseTunnel struct {
 	sessionLock    sync.RWMutex
 	sessionsByName map[string]session
 	sessionsByID   map[ControlConnID]session
+	statsLock      sync.Mutex
+	statsSessions  map[session]bool
+	closedStats    SessionDataPlaneStatistics
 }
 
+// newBaseTunnel tags the tunnel's log lines with the tunnel's identity,
+// so that log lines from the tunnel and its transport may be correlated.
 func newBaseTunnel(logger log.Logger, name string, parent *Context, config *TunnelConfig) *baseTunnel {
 	return &baseTunnel{
-		logger:         logger,
+		logger: log.With(logger,
+			"tunnel_name", name,
+			"tunnel_id", config.TunnelID,
+			"version", config.Version),
 		name:           name,
 		parent:         parent,
 		cfg:            config,
 		sessionsByName: make(map[string]session),
 		sessionsByID:   make(map[ControlConnID]session),
+		statsSessions:  make(map[session]bool),
 	}
 }
 
@@ -759,6 +2248,44 @@ func (bt *baseTunnel) getName() string {
 	return bt.name
 }
 
+func (bt *baseTunnel) Name() string {
+	return bt.name
+}
+
+func (bt *baseTunnel) ListSessions() []Session {
+	bt.sessionLock.RLock()
+	defer bt.sessionLock.RUnlock()
+	sessions := make([]Session, 0, len(bt.sessionsByName))
+	for _, s := range bt.sessionsByName {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Name() < sessions[j].Name()
+	})
+	return sessions
+}
+
+func (bt *baseTunnel) FindSessionByName(name string) (Session, bool) {
+	s, ok := bt.findSessionByName(name)
+	if !ok {
+		return nil, false
+	}
+	return s, true
+}
+
+// validateStopCCNResult checks that result and error codes are valid
+// for the Result Code AVP of a StopCCN message.
+func validateStopCCNResult(result, errCode uint16) error {
+	if avpResultCode(result) < avpStopCCNResultCodeClearConnection ||
+		avpResultCode(result) > avpStopCCNResultCodeChannelFSMError {
+		return fmt.Errorf("invalid StopCCN result code %v", result)
+	}
+	if avpErrorCode(errCode) > avpErrorCodeMBitShutdown {
+		return fmt.Errorf("invalid StopCCN error code %v", errCode)
+	}
+	return nil
+}
+
 func (bt *baseTunnel) getCfg() *TunnelConfig {
 	return bt.cfg
 }
@@ -767,6 +2294,10 @@ func (bt *baseTunnel) getDP() DataPlane {
 	return bt.parent.dp
 }
 
+func (bt *baseTunnel) getContext() *Context {
+	return bt.parent
+}
+
 func (bt *baseTunnel) getLogger() log.Logger {
 	return bt.logger
 }
@@ -776,6 +2307,13 @@ func (bt *baseTunnel) linkSession(s session) {
 	defer bt.sessionLock.Unlock()
 	bt.sessionsByName[s.getName()] = s
 	bt.sessionsByID[s.getCfg().SessionID] = s
+	if bt.cfg.Version == ProtocolVersion3 {
+		bt.parent.linkV3Session(s)
+	}
+
+	bt.statsLock.Lock()
+	bt.statsSessions[s] = true
+	bt.statsLock.Unlock()
 }
 
 func (bt *baseTunnel) unlinkSession(s session) {
@@ -783,6 +2321,42 @@ func (bt *baseTunnel) unlinkSession(s session) {
 	defer bt.sessionLock.Unlock()
 	delete(bt.sessionsByName, s.getName())
 	delete(bt.sessionsByID, s.getCfg().SessionID)
+	if bt.cfg.Version == ProtocolVersion3 {
+		bt.parent.unlinkV3Session(s)
+	}
+
+	bt.statsLock.Lock()
+	delete(bt.statsSessions, s)
+	bt.statsLock.Unlock()
+}
+
+// retireSessionStatistics adds the final data plane statistics of a
+// session which is about to be torn down to the tunnel's running totals.
+func (bt *baseTunnel) retireSessionStatistics(s session) {
+	bt.statsLock.Lock()
+	defer bt.statsLock.Unlock()
+	if !bt.statsSessions[s] {
+		return
+	}
+	delete(bt.statsSessions, s)
+	if stats, err := s.GetStatistics(); err == nil {
+		bt.closedStats.add(stats)
+	}
+}
+
+// dataStatistics returns the running totals of the data plane
+// statistics of the tunnel's sessions.  Sessions whose data plane is
+// not established are omitted.
+func (bt *baseTunnel) dataStatistics() SessionDataPlaneStatistics {
+	bt.statsLock.Lock()
+	defer bt.statsLock.Unlock()
+	total := bt.closedStats
+	for s := range bt.statsSessions {
+		if stats, err := s.GetStatistics(); err == nil {
+			total.add(stats)
+		}
+	}
+	return total
 }
 
 func (bt *baseTunnel) handleUserEvent(event interface{}) {
@@ -803,6 +2377,17 @@ func (bt *baseTunnel) findSessionByID(id ControlConnID) (s session, ok bool) {
 	return
 }
 
+// sessionIDInUse returns true if a session ID is already in use.
+// L2TPv2 session IDs are unique to the tunnel, while L2TPv3 session IDs
+// are unique to the host.
+func (bt *baseTunnel) sessionIDInUse(id ControlConnID) bool {
+	if bt.cfg.Version == ProtocolVersion3 {
+		return bt.parent.v3SessionIDInUse(id)
+	}
+	_, ok := bt.findSessionByID(id)
+	return ok
+}
+
 func (bt *baseTunnel) allSessions() (sessions []session) {
 	bt.sessionLock.RLock()
 	defer bt.sessionLock.RUnlock()
@@ -823,25 +2408,249 @@ func (bt *baseTunnel) closeAllSessions() {
 		sessions = append(sessions, s)
 		delete(bt.sessionsByName, name)
 		delete(bt.sessionsByID, s.getCfg().SessionID)
+		if bt.cfg.Version == ProtocolVersion3 {
+			bt.parent.unlinkV3Session(s)
+		}
 	}
 	bt.sessionLock.Unlock()
 
+	// Bring down all the session interfaces before killing any session,
+	// so that the sessions' drain timeouts elapse together rather than
+	// one after another
+	var drain time.Duration
+	for _, s := range sessions {
+		if d := s.drainInterface(); d > drain {
+			drain = d
+		}
+	}
+	time.Sleep(drain)
+
 	for _, s := range sessions {
 		s.kill()
 	}
 }
 
+// notifyTransportDown dispatches events describing why the tunnel
+// transport went down, where the reason is of interest to the user.
+func notifyTransportDown(tunl tunnel, xport *transport) {
+	var rerr *retransmitExhaustedError
+	if errors.As(xport.getDownErr(), &rerr) {
+		tunl.handleUserEvent(&ControlMessageRetransmitExhaustedEvent{
+			TunnelName:  tunl.getName(),
+			Tunnel:      tunl,
+			Config:      tunl.getCfg(),
+			MessageType: uint16(rerr.msgType),
+		})
+	}
+}
+
+// drainSessionDataPlane brings down the session interface ahead of the
+// session data plane being torn down, if the session has a drain timeout
+// and the data plane implements SessionDataPlaneDrainer.  It returns the
+// time to allow for queued packets to be flushed.
+func drainSessionDataPlane(cfg *SessionConfig, dp SessionDataPlane) (time.Duration, error) {
+	drainer, ok := dp.(SessionDataPlaneDrainer)
+	if !ok || cfg.DrainTimeout <= 0 {
+		return 0, nil
+	}
+	err := drainer.InterfaceDown()
+	if err != nil {
+		return 0, fmt.Errorf("failed to drain session interface: %v", err)
+	}
+	return cfg.DrainTimeout, nil
+}
+
+// downSessionDataPlane tears down a session data plane.  Unless the
+// session interface has already been drained, e.g. by the parent tunnel
+// closing all its sessions, the interface is drained first.
+func downSessionDataPlane(cfg *SessionConfig, dp SessionDataPlane, drained bool) error {
+	var drainErr error
+	if !drained {
+		var d time.Duration
+		d, drainErr = drainSessionDataPlane(cfg, dp)
+		time.Sleep(d)
+	}
+	err := dp.Down()
+	if err != nil {
+		return err
+	}
+	return drainErr
+}
+
+// validateSessionConfig checks a session configuration against the
+// configuration of its parent tunnel.  If requireIDs is set the session
+// and peer session IDs must both be specified.
+func validateSessionConfig(tcfg *TunnelConfig, scfg *SessionConfig, requireIDs bool) error {
+	if requireIDs {
+		if scfg.SessionID == 0 {
+			return fmt.Errorf("%w: session ID must be non-zero", ErrInvalidSessionConfig)
+		}
+		if scfg.PeerSessionID == 0 {
+			return fmt.Errorf("%w: peer session ID must be non-zero", ErrInvalidSessionConfig)
+		}
+	}
+	if scfg.InterfaceName != "" {
+		if err := ValidateInterfaceName(scfg.InterfaceName); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSessionConfig, err)
+		}
+	}
+	if scfg.MTU < 0 || scfg.MTU > 65535 {
+		return fmt.Errorf("%w: MTU %v out of range", ErrInvalidSessionConfig, scfg.MTU)
+	}
+	if scfg.Pseudowire != PseudowireTypeEth && (scfg.MTU != 0 || scfg.Bridge != "") {
+		return fmt.Errorf("%w: MTU and bridge are supported for Ethernet pseudowires only", ErrInvalidSessionConfig)
+	}
+	if scfg.Pseudowire != PseudowireTypeEth && (scfg.AdminUp || scfg.Address != "" || scfg.PeerAddress != "") {
+		return fmt.Errorf("%w: interface state and addressing are supported for Ethernet pseudowires only", ErrInvalidSessionConfig)
+	}
+	if err := validateSessionAddress(scfg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSessionConfig, err)
+	}
+	if scfg.CookieCheckInterval < 0 {
+		return fmt.Errorf("%w: cookie check interval must not be negative", ErrInvalidSessionConfig)
+	}
+	if scfg.DrainTimeout < 0 {
+		return fmt.Errorf("%w: drain timeout must not be negative", ErrInvalidSessionConfig)
+	}
+	if scfg.Pseudowire != PseudowireTypeEth && scfg.DrainTimeout != 0 {
+		return fmt.Errorf("%w: drain timeout is supported for Ethernet pseudowires only", ErrInvalidSessionConfig)
+	}
+	if scfg.L2SpecType != L2SpecTypeNone && scfg.L2SpecType != L2SpecTypeDefault {
+		return fmt.Errorf("%w: unsupported L2 specific sublayer type %v", ErrInvalidSessionConfig, scfg.L2SpecType)
+	}
+	if tcfg.Version == ProtocolVersion2 {
+		if scfg.L2SpecType != L2SpecTypeNone {
+			return fmt.Errorf("%w: L2 specific sublayer is not supported for L2TPv2 tunnels", ErrInvalidSessionConfig)
+		}
+		if scfg.Pseudowire == PseudowireTypeEth {
+			return fmt.Errorf("%w: Ethernet pseudowires are not supported for L2TPv2 tunnels", ErrInvalidSessionConfig)
+		}
+		if len(scfg.Cookie) > 0 || len(scfg.PeerCookie) > 0 || scfg.CookieCheckInterval != 0 {
+			return fmt.Errorf("%w: cookies are not supported for L2TPv2 tunnels", ErrInvalidSessionConfig)
+		}
+		if len(scfg.RemoteEndID) > 0 {
+			return fmt.Errorf("%w: remote end ID is not supported for L2TPv2 tunnels", ErrInvalidSessionConfig)
+		}
+	} else if scfg.ProxyLCP != nil {
+		return fmt.Errorf("%w: proxy LCP is supported for L2TPv2 tunnels only", ErrInvalidSessionConfig)
+	} else if scfg.BearerType != 0 {
+		return fmt.Errorf("%w: bearer type is supported for L2TPv2 tunnels only", ErrInvalidSessionConfig)
+	} else if scfg.FramingType != 0 {
+		return fmt.Errorf("%w: framing type is supported for L2TPv2 tunnels only", ErrInvalidSessionConfig)
+	} else if scfg.MinimumBPS != 0 || scfg.MaximumBPS != 0 {
+		return fmt.Errorf("%w: minimum and maximum BPS are supported for L2TPv2 tunnels only", ErrInvalidSessionConfig)
+	}
+	if scfg.BearerType&^(BearerCapDigital|BearerCapAnalog) != 0 {
+		return fmt.Errorf("%w: unrecognised bearer type %#x", ErrInvalidSessionConfig, uint32(scfg.BearerType))
+	}
+	if scfg.FramingType&^(FramingCapSync|FramingCapAsync) != 0 {
+		return fmt.Errorf("%w: unrecognised framing type %#x", ErrInvalidSessionConfig, uint32(scfg.FramingType))
+	}
+	if scfg.MaximumBPS != 0 && scfg.MinimumBPS > scfg.MaximumBPS {
+		return fmt.Errorf("%w: minimum BPS %v exceeds maximum BPS %v", ErrInvalidSessionConfig, scfg.MinimumBPS, scfg.MaximumBPS)
+	}
+	if scfg.ProxyLCP != nil && scfg.CallDirection != CallDirectionIncoming {
+		return fmt.Errorf("%w: proxy LCP is supported for incoming calls only", ErrInvalidSessionConfig)
+	}
+	return nil
+}
+
+// validateSessionAddress checks the interface addressing options of a
+// session config.
+func validateSessionAddress(scfg *SessionConfig) error {
+	if scfg.Address == "" {
+		if scfg.PeerAddress != "" {
+			return fmt.Errorf("peer address requires an address to be set")
+		}
+		return nil
+	}
+	ip, _, err := net.ParseCIDR(scfg.Address)
+	if err != nil {
+		return fmt.Errorf("bad address: %v", err)
+	}
+	if scfg.PeerAddress != "" {
+		peer := net.ParseIP(scfg.PeerAddress)
+		if peer == nil {
+			return fmt.Errorf("bad peer address %q", scfg.PeerAddress)
+		}
+		if (ip.To4() == nil) != (peer.To4() == nil) {
+			return fmt.Errorf("peer address %v does not match the address family of %v", scfg.PeerAddress, scfg.Address)
+		}
+	}
+	return nil
+}
+
 func (bt *baseTunnel) allocSid() (ControlConnID, error) {
-	for i := 0; i < 10; i++ {
-		id, err := generateControlConnID(bt.cfg.Version)
+	return bt.parent.allocID("session", bt.cfg.Version, bt.sessionIDInUse)
+}
+
+// reserveSid reserves a session ID for a session being created,
+// allocating an ID if sid is zero, subject to the tunnel's session limit.
+// The reservation is a nil entry in sessionsByID, and for L2TPv3 in the
+// Context's session IDs, which is replaced when the session is linked.
+func (bt *baseTunnel) reserveSid(sid ControlConnID) (ControlConnID, error) {
+	bt.sessionLock.Lock()
+	defer bt.sessionLock.Unlock()
+
+	inUse := func(id ControlConnID) bool {
+		_, ok := bt.sessionsByID[id]
+		return ok
+	}
+	if bt.cfg.Version == ProtocolVersion3 {
+		bt.parent.v3SessionLock.Lock()
+		defer bt.parent.v3SessionLock.Unlock()
+		inUse = func(id ControlConnID) bool {
+			_, ok := bt.parent.v3Sessions[id]
+			return ok
+		}
+	}
+
+	if sid != 0 && inUse(sid) {
+		return 0, fmt.Errorf("%w %v", ErrSessionIDExists, sid)
+	}
+	// The limit counts reservations as well as linked sessions
+	if bt.cfg.MaxSessions > 0 && len(bt.sessionsByID) >= bt.cfg.MaxSessions {
+		return 0, fmt.Errorf("%w: maximum of %v sessions", ErrSessionLimitReached, bt.cfg.MaxSessions)
+	}
+	if sid == 0 {
+		var err error
+		sid, err = bt.parent.allocID("session", bt.cfg.Version, inUse)
 		if err != nil {
-			return 0, fmt.Errorf("failed to generate session ID: %v", err)
+			return 0, fmt.Errorf("failed to allocate a SID: %w", err)
 		}
-		if _, ok := bt.findSessionByID(id); !ok {
-			return id, nil
+	}
+
+	bt.sessionsByID[sid] = nil
+	if bt.cfg.Version == ProtocolVersion3 {
+		bt.parent.v3Sessions[sid] = nil
+	}
+	return sid, nil
+}
+
+// releaseSidOnError releases a session ID reserved by reserveSid if
+// *err is set, i.e. if the session creation failed.
+func (bt *baseTunnel) releaseSidOnError(sid ControlConnID, err *error) {
+	if *err == nil {
+		return
+	}
+	bt.sessionLock.Lock()
+	defer bt.sessionLock.Unlock()
+	bt.releaseSid(sid)
+}
+
+// releaseSid releases a session ID reservation which has not been
+// replaced by a linked session.  It must be called with sessionLock held.
+func (bt *baseTunnel) releaseSid(sid ControlConnID) {
+	if s, ok := bt.sessionsByID[sid]; ok && s == nil {
+		delete(bt.sessionsByID, sid)
+	}
+	if bt.cfg.Version == ProtocolVersion3 {
+		bt.parent.v3SessionLock.Lock()
+		defer bt.parent.v3SessionLock.Unlock()
+		if s, ok := bt.parent.v3Sessions[sid]; ok && s == nil {
+			delete(bt.parent.v3Sessions, sid)
 		}
 	}
-	return 0, fmt.Errorf("ID space exhausted")
 }
 
 // baseSession implements base functionality which all session types will need
@@ -852,9 +2661,13 @@ type baseSession struct {
 	cfg    *SessionConfig
 }
 
+// newBaseSession tags the session's log lines with the session's identity
+// in addition to that of the parent tunnel.
 func newBaseSession(logger log.Logger, name string, parent tunnel, config *SessionConfig) *baseSession {
 	return &baseSession{
-		logger: logger,
+		logger: log.With(logger,
+			"session_name", name,
+			"session_id", config.SessionID),
 		name:   name,
 		parent: parent,
 		cfg:    config,
@@ -865,6 +2678,39 @@ func (bs *baseSession) getName() string {
 	return bs.name
 }
 
+func (bs *baseSession) Name() string {
+	return bs.name
+}
+
+func (bs *baseSession) DataMTU() int {
+	pmtu, err := bs.parent.PathMTU()
+	if err != nil {
+		pmtu = defaultPathMTU
+	}
+	ipv6 := sockaddrFamily(bs.parent.getLocalAddress()) == unix.AF_INET6
+	return dataMTU(pmtu, ipv6, bs.parent.getCfg(), bs.cfg)
+}
+
+func (bs *baseSession) PPPMRU() int {
+	return pppMRU(bs.DataMTU())
+}
+
 func (bs *baseSession) getCfg() *SessionConfig {
 	return bs.cfg
 }
+
+// modifiedCfg returns a copy of the session configuration updated with
+// the parameters from cfg which may be changed using Session.Modify.
+func (bs *baseSession) modifiedCfg(cfg *SessionConfig) *SessionConfig {
+	newCfg := *bs.cfg
+	applySessionModify(&newCfg, cfg)
+	return &newCfg
+}
+
+// applySessionModify copies the parameters which may be changed
+// using Session.Modify from src to dst.
+func applySessionModify(dst, src *SessionConfig) {
+	dst.SeqNum = src.SeqNum
+	dst.ReorderTimeout = src.ReorderTimeout
+	dst.DebugFlags = src.DebugFlags
+}
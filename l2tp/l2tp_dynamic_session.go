@@ -2,11 +2,13 @@ package l2tp
 
 import (
 	"fmt"
-	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"sync"
+	"time"
 )
 
+var _ LinkInfoSender = (*dynamicSession)(nil)
+
 type dynamicSession struct {
 	*baseSession
 	isClosed    bool
@@ -14,8 +16,14 @@ type dynamicSession struct {
 	callSerial  uint32
 	ifname      string
 	result      string
+	peerTxSpeed uint32
+	peerRxSpeed uint32
+	proxyLCP    *ProxyLCP
 	dt          *dynamicTunnel
 	dp          SessionDataPlane
+	drained     bool
+	dpLock      sync.Mutex
+	cookieMon   *cookieMonitor
 	wg          sync.WaitGroup
 	msgRxChan   chan controlMessage
 	eventChan   chan string
@@ -25,11 +33,92 @@ type dynamicSession struct {
 }
 
 func (ds *dynamicSession) Close() {
+	if ds.dt.persist != nil {
+		ds.dt.persist.forgetSession(ds.getName())
+	}
 	ds.parent.unlinkSession(ds)
 	close(ds.closeChan)
 	ds.wg.Wait()
 }
 
+func (ds *dynamicSession) GetStatistics() (*SessionDataPlaneStatistics, error) {
+	ds.dpLock.Lock()
+	defer ds.dpLock.Unlock()
+	if ds.dp == nil {
+		return nil, fmt.Errorf("session data plane not established")
+	}
+	return ds.dp.GetStatistics()
+}
+
+func (ds *dynamicSession) InterfaceIndex() (int, string, error) {
+	ds.dpLock.Lock()
+	defer ds.dpLock.Unlock()
+	if ds.dp == nil {
+		return 0, "", fmt.Errorf("session data plane not established")
+	}
+	return sessionInterfaceIndex(ds.dp)
+}
+
+func (ds *dynamicSession) SendLinkInfo(accm *ACCM) error {
+	if accm == nil {
+		return fmt.Errorf("invalid nil ACCM")
+	}
+	if ds.parent.getCfg().Version != ProtocolVersion2 {
+		return fmt.Errorf("link info is supported for L2TPv2 sessions only")
+	}
+
+	ds.dpLock.Lock()
+	established := ds.dp != nil
+	ds.dpLock.Unlock()
+	if !established {
+		return fmt.Errorf("session not established")
+	}
+
+	ds.dt.closingLock.Lock()
+	isClosing := ds.dt.isClosing
+	ds.dt.closingLock.Unlock()
+	if isClosing {
+		return fmt.Errorf("tunnel is closing")
+	}
+
+	msg, err := newV2Sli(ds.parent.getCfg().PeerTunnelID, ds.cfg, accm)
+	if err != nil {
+		return err
+	}
+	return ds.dt.sendMessage(msg)
+}
+
+func (ds *dynamicSession) Modify(cfg *SessionConfig) error {
+	if cfg == nil {
+		return fmt.Errorf("invalid nil config")
+	}
+	ds.dpLock.Lock()
+	defer ds.dpLock.Unlock()
+	if ds.dp == nil {
+		return fmt.Errorf("session data plane not established")
+	}
+	err := modifySessionDataPlane(ds.dp, ds.modifiedCfg(cfg))
+	if err != nil {
+		return err
+	}
+	applySessionModify(ds.cfg, cfg)
+	return nil
+}
+
+func (ds *dynamicSession) drainInterface() time.Duration {
+	ds.dpLock.Lock()
+	defer ds.dpLock.Unlock()
+	if ds.dp == nil || ds.drained {
+		return 0
+	}
+	ds.drained = true
+	d, err := drainSessionDataPlane(ds.cfg, ds.dp)
+	if err != nil {
+		level.Error(ds.logger).Log("message", "dataplane drain failed", "error", err)
+	}
+	return d
+}
+
 func (ds *dynamicSession) kill() {
 	ds.parent.unlinkSession(ds)
 	close(ds.killChan)
@@ -49,9 +138,9 @@ func (ds *dynamicSession) runSession() {
 
 	level.Info(ds.logger).Log(
 		"message", "new dynamic session",
-		"session_id", ds.cfg.SessionID,
 		"peer_session_id", ds.cfg.PeerSessionID,
-		"pseudowire", ds.cfg.Pseudowire)
+		"pseudowire", ds.cfg.Pseudowire,
+		"call_direction", ds.cfg.CallDirection)
 
 	for !ds.isClosed {
 		select {
@@ -93,13 +182,13 @@ func (ds *dynamicSession) handleEvent(ev string, args ...interface{}) {
 }
 
 // panics if expected arguments are not passed
-func fsmArgsToV2Msg(args []interface{}) (msg *v2ControlMessage) {
+func fsmArgsToMsg(args []interface{}) (msg controlMessage) {
 	if len(args) != 1 {
 		panic(fmt.Sprintf("unexpected argument count (wanted 1, got %v)", len(args)))
 	}
-	msg, ok := args[0].(*v2ControlMessage)
+	msg, ok := args[0].(controlMessage)
 	if !ok {
-		panic(fmt.Sprintf("first argument %T not *v2ControlMessage", args[0]))
+		panic(fmt.Sprintf("first argument %T not controlMessage", args[0]))
 	}
 	return
 }
@@ -126,7 +215,7 @@ func fsmArgsToCdnResult(args []interface{}) *resultCode {
 }
 
 func cdnResultCodeToString(rc *resultCode) string {
-	var resStr, errStr, errMsg string
+	var resStr, errMsg string
 
 	switch rc.result {
 	case avpCDNResultCodeReserved:
@@ -155,27 +244,6 @@ func cdnResultCodeToString(rc *resultCode) string {
 		resStr = "no appropriate framing detected"
 	}
 
-	switch rc.errCode {
-	case avpErrorCodeNoError:
-		errStr = "no general error"
-	case avpErrorCodeNoControlConnection:
-		errStr = "no control connection exists yet"
-	case avpErrorCodeBadLength:
-		errStr = "length is wrong"
-	case avpErrorCodeBadValue:
-		errStr = "field out of range or reserved field was non-zero"
-	case avpErrorCodeNoResource:
-		errStr = "insufficient resources to handle this operation now"
-	case avpErrorCodeInvalidSessionID:
-		errStr = "session ID invalid in this context"
-	case avpErrorCodeVendorSpecificError:
-		errStr = "generic vendor-specific error"
-	case avpErrorCodeTryAnother:
-		errStr = "try another LNS"
-	case avpErrorCodeMBitShutdown:
-		errStr = "shut down due to unknown AVP with the M bit set"
-	}
-
 	if rc.errMsg != "" {
 		errMsg = rc.errMsg
 	} else {
@@ -184,7 +252,7 @@ func cdnResultCodeToString(rc *resultCode) string {
 
 	return fmt.Sprintf("result %d (%s), error %d (%s), message '%s'",
 		rc.result, resStr,
-		rc.errCode, errStr,
+		rc.errCode, errorCodeToString(rc.errCode),
 		errMsg)
 }
 
@@ -204,11 +272,22 @@ func (ds *dynamicSession) handleMsg(msg controlMessage) {
 		}
 		ds.handleV2Msg(msg)
 		return
+	case ProtocolVersion3:
+		msg, ok := msg.(*v3ControlMessage)
+		if !ok {
+			// As above, this indicates a coding error
+			level.Error(ds.logger).Log(
+				"message", "couldn't cast L2TPv3 message as v3ControlMessage")
+			ds.fsmActClose(nil)
+			return
+		}
+		ds.handleV3Msg(msg)
+		return
 	}
 
 	level.Error(ds.logger).Log(
 		"message", "unhandled protocol version",
-		"version", msg.protocolVersion())
+		"message_version", msg.protocolVersion())
 }
 
 func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
@@ -224,6 +303,42 @@ func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
 		return
 	}
 
+	ds.dispatchMsg(msg)
+}
+
+func (ds *dynamicSession) handleV3Msg(msg *v3ControlMessage) {
+
+	// As for L2TPv2, drop mis-delivered messages
+	sid, err := findLocalSessionID(msg)
+	if err != nil || sid != ds.cfg.SessionID {
+		level.Error(ds.logger).Log(
+			"message", "received control message with the wrong remote session ID",
+			"expected", ds.cfg.SessionID,
+			"got", sid)
+		return
+	}
+
+	ds.dispatchMsg(msg)
+}
+
+// dispatchMsg validates a received control message and maps it to the
+// corresponding FSM event.
+func (ds *dynamicSession) dispatchMsg(msg controlMessage) {
+
+	// An unrecognised AVP with the mandatory bit set requires the
+	// session to be torn down.
+	if a := findUnrecognisedMandatoryAvp(msg.getAvps()); a != nil {
+		level.Error(ds.logger).Log(
+			"message", "unrecognised mandatory AVP",
+			"message_type", msg.getType(),
+			"avp", a.header)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeMBitShutdown,
+			fmt.Sprintf("unrecognised mandatory AVP %v in %v message", a.header, msg.getType()))
+		return
+	}
+
 	// Validate the message.  If validation fails drive shutdown via.
 	// the FSM to allow the error to be communicated to the peer.
 	err := msg.validate()
@@ -236,6 +351,7 @@ func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
 			avpCDNResultCodeGeneralError,
 			avpErrorCodeBadValue,
 			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
+		return
 	}
 
 	// Map the message to the appropriate event type.  If we haven't got
@@ -244,10 +360,14 @@ func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
 		m avpMsgType
 		e string
 	}{
+		{avpMsgTypeOcrq, "ocrq"},
+		{avpMsgTypeOcrp, "ocrp"},
+		{avpMsgTypeOccn, "occn"},
 		{avpMsgTypeIcrq, "icrq"},
 		{avpMsgTypeIcrp, "icrp"},
 		{avpMsgTypeIccn, "iccn"},
 		{avpMsgTypeCdn, "cdn"},
+		{avpMsgTypeSli, "sli"},
 	}
 
 	for _, em := range eventMap {
@@ -258,13 +378,14 @@ func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
 	}
 
 	level.Error(ds.logger).Log(
-		"message", "unhandled v2 control message",
+		"message", "unhandled control message",
+		"message_version", msg.protocolVersion(),
 		"message_type", msg.getType())
 
 	ds.handleEvent("close",
 		avpCDNResultCodeGeneralError,
 		avpErrorCodeBadValue,
-		fmt.Sprintf("unhandled v2 control message %v", msg.getType()))
+		fmt.Sprintf("unhandled %v control message %v", msg.protocolVersion(), msg.getType()))
 }
 
 func (ds *dynamicSession) sendMessage(msg controlMessage) {
@@ -289,7 +410,12 @@ func (ds *dynamicSession) fsmActSendIcrq(args []interface{}) {
 }
 
 func (ds *dynamicSession) sendIcrq() (err error) {
-	msg, err := newV2Icrq(ds.callSerial, ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	var msg controlMessage
+	if ds.parent.getCfg().Version == ProtocolVersion3 {
+		msg, err = newV3Icrq(ds.callSerial, ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	} else {
+		msg, err = newV2Icrq(ds.callSerial, ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	}
 	if err != nil {
 		return err
 	}
@@ -298,9 +424,9 @@ func (ds *dynamicSession) sendIcrq() (err error) {
 }
 
 func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
-	msg := fsmArgsToV2Msg(args)
+	msg := fsmArgsToMsg(args)
 
-	psid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeSessionID)
+	psid, err := findPeerSessionID(msg)
 	if err != nil {
 		// Shouldn't occur since session ID is mandatory
 		level.Error(ds.logger).Log(
@@ -313,22 +439,240 @@ func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
 		return
 	}
 
-	ds.cfg.PeerSessionID = ControlConnID(psid)
+	// Session ID 0 is reserved by the protocol
+	if psid == 0 {
+		level.Error(ds.logger).Log(
+			"message", "invalid peer session ID in ICRP",
+			"peer_session_id", psid)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeBadValue,
+			"invalid session ID 0 in ICRP message")
+		return
+	}
+
+	ds.cfg.PeerSessionID = psid
+
+	// An L2TPv3 peer advertises the cookie it will send in data packets
+	if msg.protocolVersion() == ProtocolVersion3 {
+		if cookie, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeAssignedCookie); err == nil {
+			// The peer cookie must be either 4 or 8 bytes long
+			if len(cookie) != 4 && len(cookie) != 8 {
+				level.Error(ds.logger).Log(
+					"message", "invalid assigned cookie length in ICRP",
+					"cookie_length", len(cookie))
+				ds.handleEvent("close",
+					avpCDNResultCodeGeneralError,
+					avpErrorCodeBadLength,
+					"invalid Assigned Cookie length in ICRP message")
+				return
+			}
+			ds.cfg.PeerCookie = cookie
+		}
+	}
+
+	// The peer may require data packets to be sequenced
+	if seq, ok := findSequencingRequest(msg); ok && seq {
+		ds.cfg.SeqNum = true
+	}
 
 	err = ds.sendIccn()
 	if err != nil {
 		level.Error(ds.logger).Log(
 			"message", "failed to send ICCN",
 			"error", err)
-		// TODO: CDN args
 		ds.fsmActClose(nil)
 		return
 	}
 
+	ds.establishDataPlane()
+}
+
+func (ds *dynamicSession) sendIccn() (err error) {
+	var msg controlMessage
+	if ds.parent.getCfg().Version == ProtocolVersion3 {
+		msg, err = newV3Iccn(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	} else {
+		msg, err = newV2Iccn(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	}
+	if err != nil {
+		return err
+	}
+	ds.sendMessage(msg)
+	return
+}
+
+func (ds *dynamicSession) fsmActSendOcrq(args []interface{}) {
+	err := ds.sendOcrq()
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to send OCRQ message",
+			"error", err)
+		ds.fsmActClose(nil)
+	}
+}
+
+func (ds *dynamicSession) sendOcrq() (err error) {
+	msg, err := newV2Ocrq(ds.callSerial, ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	if err != nil {
+		return err
+	}
+	ds.sendMessage(msg)
+	return
+}
+
+func (ds *dynamicSession) fsmActOnOcrp(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	psid, err := findPeerSessionID(msg)
+	if err != nil {
+		// Shouldn't occur since session ID is mandatory
+		level.Error(ds.logger).Log(
+			"message", "failed to parse peer session ID from OCRP",
+			"error", err)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeBadValue,
+			"no Assigned Session ID AVP in OCRP message")
+		return
+	}
+
+	ds.cfg.PeerSessionID = psid
+}
+
+func (ds *dynamicSession) fsmActOnOccn(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+	ds.peerTxSpeed, ds.peerRxSpeed = findConnectSpeeds(msg)
+	if seq, ok := findSequencingRequest(msg); ok && seq {
+		ds.cfg.SeqNum = true
+	}
+	ds.establishDataPlane()
+}
+
+func (ds *dynamicSession) fsmActSendIcrp(args []interface{}) {
+	var msg controlMessage
+	var err error
+	if ds.parent.getCfg().Version == ProtocolVersion3 {
+		msg, err = newV3Icrp(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	} else {
+		msg, err = newV2Icrp(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	}
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to send ICRP message",
+			"error", err)
+		ds.fsmActClose(nil)
+		return
+	}
+	ds.sendMessage(msg)
+}
+
+func (ds *dynamicSession) fsmActOnIccn(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	proxyLCP, err := findProxyLCP(msg)
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "bad proxy LCP in ICCN",
+			"error", err)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeBadValue,
+			fmt.Sprintf("bad proxy LCP in ICCN message: %v", err))
+		return
+	}
+	ds.proxyLCP = proxyLCP
+
+	ds.peerTxSpeed, ds.peerRxSpeed = findConnectSpeeds(msg)
+	if seq, ok := findSequencingRequest(msg); ok && seq {
+		ds.cfg.SeqNum = true
+	}
+	ds.establishDataPlane()
+}
+
+// fsmActOnSli handles a Set-Link-Info message received for an
+// established session.  Any ACCM carried by the message is passed to
+// the user.  If the message changes the peer's sequencing requirement
+// the session data plane is modified to match, rather than the session
+// being torn down and recreated.
+func (ds *dynamicSession) fsmActOnSli(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	accm, err := findACCM(msg)
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "bad ACCM in SLI",
+			"error", err)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeBadLength,
+			fmt.Sprintf("bad ACCM in SLI message: %v", err))
+		return
+	}
+	if accm != nil {
+		level.Info(ds.logger).Log(
+			"message", "peer set link info",
+			"send_accm", fmt.Sprintf("%08x", accm.Send),
+			"recv_accm", fmt.Sprintf("%08x", accm.Recv))
+		ds.parent.handleUserEvent(&SessionLinkInfoEvent{
+			TunnelName:    ds.parent.getName(),
+			Tunnel:        ds.parent,
+			TunnelConfig:  ds.parent.getCfg(),
+			SessionName:   ds.getName(),
+			Session:       ds,
+			SessionConfig: ds.cfg,
+			ACCM:          *accm,
+		})
+	}
+
+	seq, ok := findSequencingRequest(msg)
+	if !ok || seq == ds.cfg.SeqNum {
+		return
+	}
+
+	level.Info(ds.logger).Log(
+		"message", "peer changed sequencing requirement",
+		"seqnum", seq)
+
+	ds.dpLock.Lock()
+	err = fmt.Errorf("session data plane not established")
+	if ds.dp != nil {
+		newCfg := *ds.cfg
+		newCfg.SeqNum = seq
+		err = modifySessionDataPlane(ds.dp, &newCfg)
+		if err == nil {
+			ds.cfg.SeqNum = seq
+		}
+	}
+	ds.dpLock.Unlock()
+
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to modify data plane sequencing",
+			"error", err)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeVendorSpecificError,
+			fmt.Sprintf("failed to modify data plane sequencing: %v", err))
+	}
+}
+
+// establishDataPlane instantiates the session data plane once the control
+// plane call setup has completed, and notifies the user of the session
+// coming up.  On failure the session is torn down with a CDN.
+func (ds *dynamicSession) establishDataPlane() {
 	level.Info(ds.logger).Log("message", "control plane established")
 
-	// establish the data plane
-	ds.dp, err = ds.parent.getDP().NewSession(
+	err := ds.parent.getContext().preSessionUp(ds.logger, ds.parent, ds)
+	if err != nil {
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeVendorSpecificError,
+			fmt.Sprintf("failed to establish data plane: %v", err))
+		return
+	}
+
+	dp, err := ds.parent.getDP().NewSession(
 		ds.parent.getCfg().TunnelID,
 		ds.parent.getCfg().PeerTunnelID,
 		ds.cfg)
@@ -336,41 +680,55 @@ func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
 		level.Error(ds.logger).Log(
 			"message", "failed to establish data plane",
 			"error", err)
-		// TODO: CDN args
-		ds.fsmActClose(nil)
+		ds.handleEvent("close",
+			avpCDNResultCodeNoResources,
+			avpErrorCodeNoResource,
+			fmt.Sprintf("failed to establish data plane: %v", err))
 		return
 	}
 
-	ds.ifname, err = ds.dp.GetInterfaceName()
+	ds.dpLock.Lock()
+	ds.dp = dp
+	ds.dpLock.Unlock()
+
+	ds.ifname, err = dp.GetInterfaceName()
 	if err != nil {
 		level.Error(ds.logger).Log(
 			"message", "failed to retrieve session interface name",
 			"error", err)
-		// TODO: CDN args
-		ds.fsmActClose(nil)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeVendorSpecificError,
+			fmt.Sprintf("failed to retrieve session interface name: %v", err))
+		return
+	}
+
+	err = ds.parent.getContext().postSessionUp(ds.logger, ds.parent, ds, ds.ifname)
+	if err != nil {
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeVendorSpecificError,
+			fmt.Sprintf("failed to establish data plane: %v", err))
+		return
 	}
 
 	level.Info(ds.logger).Log("message", "data plane established")
 
 	ds.established = true
 	ds.parent.handleUserEvent(&SessionUpEvent{
-		TunnelName:    ds.parent.getName(),
-		Tunnel:        ds.parent,
-		TunnelConfig:  ds.parent.getCfg(),
-		SessionName:   ds.getName(),
-		Session:       ds,
-		SessionConfig: ds.cfg,
-		InterfaceName: ds.ifname,
+		TunnelName:         ds.parent.getName(),
+		Tunnel:             ds.parent,
+		TunnelConfig:       ds.parent.getCfg(),
+		SessionName:        ds.getName(),
+		Session:            ds,
+		SessionConfig:      ds.cfg,
+		InterfaceName:      ds.ifname,
+		PeerTxConnectSpeed: ds.peerTxSpeed,
+		PeerRxConnectSpeed: ds.peerRxSpeed,
+		ProxyLCP:           ds.proxyLCP,
 	})
-}
 
-func (ds *dynamicSession) sendIccn() (err error) {
-	msg, err := newV2Iccn(ds.parent.getCfg().PeerTunnelID, ds.cfg)
-	if err != nil {
-		return err
-	}
-	ds.sendMessage(msg)
-	return
+	ds.cookieMon = startCookieMonitor(ds.logger, ds.parent, ds, ds.ifname)
 }
 
 func (ds *dynamicSession) fsmActSendCdn(args []interface{}) {
@@ -383,7 +741,12 @@ func (ds *dynamicSession) fsmActSendCdn(args []interface{}) {
 }
 
 func (ds *dynamicSession) sendCdn(rc *resultCode) (err error) {
-	msg, err := newV2Cdn(ds.parent.getCfg().PeerTunnelID, rc, ds.cfg)
+	var msg controlMessage
+	if ds.parent.getCfg().Version == ProtocolVersion3 {
+		msg, err = newV3Cdn(ds.parent.getCfg().PeerTunnelID, rc, ds.cfg)
+	} else {
+		msg, err = newV2Cdn(ds.parent.getCfg().PeerTunnelID, rc, ds.cfg)
+	}
 	if err != nil {
 		return err
 	}
@@ -392,7 +755,7 @@ func (ds *dynamicSession) sendCdn(rc *resultCode) (err error) {
 }
 
 func (ds *dynamicSession) fsmActOnCdn(args []interface{}) {
-	msg := fsmArgsToV2Msg(args)
+	msg := fsmArgsToMsg(args)
 
 	rc, err := findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
 	if err == nil && ds.result == "" {
@@ -403,8 +766,20 @@ func (ds *dynamicSession) fsmActOnCdn(args []interface{}) {
 }
 
 func (ds *dynamicSession) fsmActClose(args []interface{}) {
-	if ds.dp != nil {
-		err := ds.dp.Down()
+	ds.cookieMon.stop()
+	ds.cookieMon = nil
+
+	ds.parent.retireSessionStatistics(ds)
+
+	ds.dpLock.Lock()
+	dp := ds.dp
+	drained := ds.drained
+	ds.dp = nil
+	ds.dpLock.Unlock()
+
+	if dp != nil {
+		ds.parent.getContext().preSessionDown(ds.logger, ds.parent, ds, ds.ifname)
+		err := downSessionDataPlane(ds.cfg, dp, drained)
 		if err != nil {
 			level.Error(ds.logger).Log("message", "dataplane down failed", "error", err)
 		}
@@ -429,12 +804,10 @@ func (ds *dynamicSession) fsmActClose(args []interface{}) {
 	ds.isClosed = true
 }
 
-// Create a new client/LAC mode session instance
-func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig) (ds *dynamicSession, err error) {
-
-	ds = &dynamicSession{
+func allocDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig) *dynamicSession {
+	return &dynamicSession{
 		baseSession: newBaseSession(
-			log.With(parent.getLogger(), "session_name", name),
+			parent.getLogger(),
 			name,
 			parent,
 			cfg),
@@ -445,23 +818,166 @@ func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *S
 		closeChan:  make(chan interface{}),
 		killChan:   make(chan interface{}),
 	}
+}
+
+// Create a new dynamic session instance, placing either an incoming
+// or an outgoing call depending on the session configuration
+func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig) (ds *dynamicSession, err error) {
+
+	ds = allocDynamicSession(serial, name, parent, cfg)
+
+	switch cfg.CallDirection {
+	case CallDirectionIncoming:
+		// Ref: RFC2661 section 7.4.1
+		ds.fsm = fsm{
+			current: "waittunnel",
+			table: []eventDesc{
+				{from: "waittunnel", events: []string{"tunnelopen"}, cb: ds.fsmActSendIcrq, to: "waitreply"},
+				{from: "waittunnel", events: []string{"close"}, cb: ds.fsmActClose, to: "dead"},
+
+				{from: "waitreply", events: []string{"icrp"}, cb: ds.fsmActOnIcrp, to: "established"},
+				{from: "waitreply", events: []string{"iccn"}, cb: ds.fsmActClose, to: "dead"},
+				{from: "waitreply", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+				{
+					from: "waitreply",
+					events: []string{
+						"ocrq",
+						"ocrp",
+						"occn",
+						"icrq",
+						"sli",
+						"close",
+					},
+					cb: ds.fsmActSendCdn,
+					to: "dead",
+				},
+
+				{from: "established", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+				{from: "established", events: []string{"sli"}, cb: ds.fsmActOnSli, to: "established"},
+				{
+					from: "established",
+					events: []string{
+						"ocrq",
+						"ocrp",
+						"occn",
+						"icrq",
+						"icrp",
+						"iccn",
+						"close",
+					},
+					cb: ds.fsmActSendCdn,
+					to: "dead",
+				},
+			},
+		}
+	case CallDirectionOutgoing:
+		// Ref: RFC2661 section 7.4.2
+		ds.fsm = fsm{
+			current: "waittunnel",
+			table: []eventDesc{
+				{from: "waittunnel", events: []string{"tunnelopen"}, cb: ds.fsmActSendOcrq, to: "waitreply"},
+				{from: "waittunnel", events: []string{"close"}, cb: ds.fsmActClose, to: "dead"},
+
+				{from: "waitreply", events: []string{"ocrp"}, cb: ds.fsmActOnOcrp, to: "waitconnect"},
+				{from: "waitreply", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+				{
+					from: "waitreply",
+					events: []string{
+						"ocrq",
+						"occn",
+						"icrq",
+						"icrp",
+						"iccn",
+						"sli",
+						"close",
+					},
+					cb: ds.fsmActSendCdn,
+					to: "dead",
+				},
+
+				{from: "waitconnect", events: []string{"occn"}, cb: ds.fsmActOnOccn, to: "established"},
+				{from: "waitconnect", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+				{
+					from: "waitconnect",
+					events: []string{
+						"ocrq",
+						"ocrp",
+						"icrq",
+						"icrp",
+						"iccn",
+						"sli",
+						"close",
+					},
+					cb: ds.fsmActSendCdn,
+					to: "dead",
+				},
+
+				{from: "established", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+				{from: "established", events: []string{"sli"}, cb: ds.fsmActOnSli, to: "established"},
+				{
+					from: "established",
+					events: []string{
+						"ocrq",
+						"ocrp",
+						"occn",
+						"icrq",
+						"icrp",
+						"iccn",
+						"close",
+					},
+					cb: ds.fsmActSendCdn,
+					to: "dead",
+				},
+			},
+		}
+	default:
+		return nil, fmt.Errorf("unrecognised call direction %v", int(cfg.CallDirection))
+	}
+
+	ds.wg.Add(1)
+	go ds.runSession()
 
-	// Ref: RFC2661 section 7.4.1
+	return
+}
+
+// Create a new dynamic session instance answering an incoming call
+// placed by the peer.  The call is answered once the session is started.
+func newAnsweringDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig) *dynamicSession {
+
+	ds := allocDynamicSession(serial, name, parent, cfg)
+
+	// Ref: RFC2661 section 7.4.1, as the LNS
 	ds.fsm = fsm{
 		current: "waittunnel",
 		table: []eventDesc{
-			{from: "waittunnel", events: []string{"tunnelopen"}, cb: ds.fsmActSendIcrq, to: "waitreply"},
+			{from: "waittunnel", events: []string{"tunnelopen"}, cb: ds.fsmActSendIcrp, to: "waitconnect"},
 			{from: "waittunnel", events: []string{"close"}, cb: ds.fsmActClose, to: "dead"},
 
-			{from: "waitreply", events: []string{"icrp"}, cb: ds.fsmActOnIcrp, to: "established"},
-			{from: "waitreply", events: []string{"iccn"}, cb: ds.fsmActClose, to: "dead"},
-			{from: "waitreply", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
-			{from: "waitreply", events: []string{"icrq", "close"}, cb: ds.fsmActSendCdn, to: "dead"},
+			{from: "waitconnect", events: []string{"iccn"}, cb: ds.fsmActOnIccn, to: "established"},
+			{from: "waitconnect", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{
+				from: "waitconnect",
+				events: []string{
+					"ocrq",
+					"ocrp",
+					"occn",
+					"icrq",
+					"icrp",
+					"sli",
+					"close",
+				},
+				cb: ds.fsmActSendCdn,
+				to: "dead",
+			},
 
 			{from: "established", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{from: "established", events: []string{"sli"}, cb: ds.fsmActOnSli, to: "established"},
 			{
 				from: "established",
 				events: []string{
+					"ocrq",
+					"ocrp",
+					"occn",
 					"icrq",
 					"icrp",
 					"iccn",
@@ -476,5 +992,5 @@ func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *S
 	ds.wg.Add(1)
 	go ds.runSession()
 
-	return
+	return ds
 }
@@ -6,8 +6,15 @@ package l2tp
 // These tests are using the null dataplane and hence don't require root.
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -99,13 +106,36 @@ type testLNS struct {
 	xport              *transport
 	tunnelEstablished  bool
 	sessionEstablished bool
+	stopccnReceived    bool
 	isShutdown         bool
+	// If set, the LNS tears down the session with a CDN after ICCN
+	sendCdnOnIccn bool
+	// If set, the LNS tears down the tunnel with a StopCCN after SCCCN
+	stopccnOnScccn *resultCode
+	// If set, the LNS tears down the tunnel with a StopCCN after ICCN
+	stopccnOnIccn *resultCode
+	// If set, AVPs appended to messages of the given type sent by the LNS
+	extraAvps map[avpMsgType][]avp
+	// If set, the LNS requires sequencing with an SLI after ICCN
+	sliSeqOnIccn bool
+	// If set, the LNS sends an SLI with the ACCM after ICCN
+	sliAccmOnIccn *ACCM
+	// ACCMs of SLI messages received from the LAC
+	sliChan chan *ACCM
+	// Result code of the StopCCN message received from the LAC
+	stopccnResult *resultCode
+	// Result codes of CDN messages received from the LAC
+	cdnChan chan *resultCode
+	// Called Number from the most recently received OCRQ
+	calledNumber string
+	// Call Serial Numbers of received ICRQ messages
+	callSerials []uint32
 }
 
 func newTestLNS(logger log.Logger, tcfg *TunnelConfig, scfg *SessionConfig) (*testLNS, error) {
 	myLogger := log.With(logger, "tunnel_name", "testLNS")
 
-	sal, sap, err := newUDPAddressPair(tcfg.Local, tcfg.Peer)
+	sal, sap, err := newUDPAddressPair(tcfg.Local, tcfg.LocalPort, tcfg.Peer, AddressFamilyAny)
 	if err != nil {
 		return nil, fmt.Errorf("newUDPAddressPair(%v, %v): %v", tcfg.Local, tcfg.Peer, err)
 	}
@@ -122,16 +152,19 @@ func newTestLNS(logger log.Logger, tcfg *TunnelConfig, scfg *SessionConfig) (*te
 
 	xcfg := defaulttransportConfig()
 	xcfg.Version = tcfg.Version
+	xcfg.Secret = []byte(tcfg.Secret)
 	xport, err := newTransport(myLogger, cp, xcfg)
 	if err != nil {
 		return nil, fmt.Errorf("newTransport(): %v", err)
 	}
 
 	lns := &testLNS{
-		logger: myLogger,
-		tcfg:   tcfg,
-		scfg:   scfg,
-		xport:  xport,
+		logger:  myLogger,
+		tcfg:    tcfg,
+		scfg:    scfg,
+		xport:   xport,
+		cdnChan: make(chan *resultCode, 1),
+		sliChan: make(chan *ACCM, 1),
 	}
 
 	return lns, nil
@@ -142,6 +175,61 @@ func (lns *testLNS) shutdown() {
 	lns.isShutdown = true
 }
 
+// sendStopccn tears down the tunnel with a StopCCN carrying the
+// result code specified
+func (lns *testLNS) sendStopccn(rc *resultCode) error {
+	rsp, err := newV2Stopccn(rc, lns.tcfg)
+	if err != nil {
+		return fmt.Errorf("failed to build StopCCN: %v", err)
+	}
+	err = lns.xport.send(rsp)
+	if err != nil {
+		return err
+	}
+	lns.isShutdown = true
+	return nil
+}
+
+// sendSli sends an SLI message carrying the ACCM, if set, and if seq
+// is set requiring the LAC to sequence data packets
+func (lns *testLNS) sendSli(accm *ACCM, seq bool) error {
+	var msg controlMessage
+	var err error
+	if lns.tcfg.Version == ProtocolVersion2 {
+		if accm == nil {
+			accm = &ACCM{Send: 0xffffffff, Recv: 0xffffffff}
+		}
+		var v2msg *v2ControlMessage
+		v2msg, err = newV2Sli(lns.tcfg.PeerTunnelID, lns.scfg, accm)
+		if err == nil && seq {
+			var a *avp
+			a, err = newAvp(vendorIDIetf, avpTypeSequencingRequired, nil)
+			if err == nil {
+				v2msg.appendAvp(a)
+			}
+		}
+		msg = v2msg
+	} else {
+		msg, err = buildV3Msg(lns.tcfg.PeerTunnelID, []avpIn{
+			{avpTypeMessage, avpMsgTypeSli},
+			{avpTypeLocalSessionID, uint32(lns.scfg.SessionID)},
+			{avpTypeRemoteSessionID, uint32(lns.scfg.PeerSessionID)},
+			{avpTypeDataSequencing, uint16(2)},
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to build SLI: %v", err)
+	}
+	return lns.xport.send(msg)
+}
+
+// appendExtraAvps adds any extra AVPs configured for the message's type
+func (lns *testLNS) appendExtraAvps(msg controlMessage) {
+	for i := range lns.extraAvps[msg.getType()] {
+		msg.appendAvp(&lns.extraAvps[msg.getType()][i])
+	}
+}
+
 func (lns *testLNS) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr) error {
 	level.Debug(lns.logger).Log(
 		"message", "receive control message",
@@ -160,11 +248,17 @@ func (lns *testLNS) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr) error
 		if err != nil {
 			return fmt.Errorf("failed to build SCCRP: %v", err)
 		}
+		lns.appendExtraAvps(rsp)
 		return lns.xport.send(rsp)
 	case avpMsgTypeScccn:
 		lns.tunnelEstablished = true
+		if lns.stopccnOnScccn != nil {
+			return lns.sendStopccn(lns.stopccnOnScccn)
+		}
 		return nil
 	case avpMsgTypeStopccn:
+		lns.stopccnReceived = true
+		lns.stopccnResult, _ = findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
 		// HACK: allow the transport to ack the stopccn.
 		// By closing the transport the transport recvChan will be
 		// closed, which will cause the run() function to return.
@@ -175,21 +269,154 @@ func (lns *testLNS) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr) error
 		return nil
 
 	// Session messages
+	case avpMsgTypeOcrq:
+		psid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeSessionID)
+		if err != nil {
+			return fmt.Errorf("no Session ID AVP in OCRQ")
+		}
+		lns.calledNumber, err = findStringAvp(msg.getAvps(), vendorIDIetf, avpTypeCalledNumber)
+		if err != nil {
+			return fmt.Errorf("no Called Number AVP in OCRQ")
+		}
+		lns.scfg.PeerSessionID = ControlConnID(psid)
+		rsp, err := newV2Ocrp(lns.tcfg.PeerTunnelID, lns.scfg)
+		if err != nil {
+			return fmt.Errorf("failed to build OCRP: %v", err)
+		}
+		err = lns.xport.send(rsp)
+		if err != nil {
+			return err
+		}
+		rsp, err = newV2Occn(lns.tcfg.PeerTunnelID, lns.scfg)
+		if err != nil {
+			return fmt.Errorf("failed to build OCCN: %v", err)
+		}
+		err = lns.xport.send(rsp)
+		if err != nil {
+			return err
+		}
+		lns.sessionEstablished = true
+		return nil
 	case avpMsgTypeIcrq:
 		psid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeSessionID)
 		if err != nil {
 			return fmt.Errorf("no Session ID AVP in ICRQ")
 		}
+		serial, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeCallSerialNumber)
+		if err != nil {
+			return fmt.Errorf("no Call Serial Number AVP in ICRQ")
+		}
+		lns.callSerials = append(lns.callSerials, serial)
 		lns.scfg.PeerSessionID = ControlConnID(psid)
 		rsp, err := newV2Icrp(lns.tcfg.PeerTunnelID, lns.scfg)
 		if err != nil {
 			return fmt.Errorf("failed to build ICRP: %v", err)
 		}
+		lns.appendExtraAvps(rsp)
+		return lns.xport.send(rsp)
+	case avpMsgTypeIccn:
+		lns.sessionEstablished = true
+		if lns.stopccnOnIccn != nil {
+			return lns.sendStopccn(lns.stopccnOnIccn)
+		}
+		if lns.sliSeqOnIccn || lns.sliAccmOnIccn != nil {
+			return lns.sendSli(lns.sliAccmOnIccn, lns.sliSeqOnIccn)
+		}
+		if lns.sendCdnOnIccn {
+			rsp, err := newV2Cdn(lns.tcfg.PeerTunnelID,
+				&resultCode{
+					result:  avpCDNResultCodeAdminDisconnect,
+					errCode: avpErrorCodeNoError,
+				},
+				lns.scfg)
+			if err != nil {
+				return fmt.Errorf("failed to build CDN: %v", err)
+			}
+			return lns.xport.send(rsp)
+		}
+		return nil
+	case avpMsgTypeCdn:
+		rc, err := findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
+		if err != nil {
+			return fmt.Errorf("no Result Code AVP in CDN")
+		}
+		select {
+		case lns.cdnChan <- rc:
+		default:
+		}
+		return nil
+	case avpMsgTypeSli:
+		accm, err := findACCM(msg)
+		if err != nil || accm == nil {
+			return fmt.Errorf("bad ACCM in SLI: %v", err)
+		}
+		select {
+		case lns.sliChan <- accm:
+		default:
+		}
+		return nil
+	}
+	return fmt.Errorf("message %v not handled", msg.getType())
+}
+
+func (lns *testLNS) handleV3Msg(msg *v3ControlMessage, from unix.Sockaddr) error {
+	level.Debug(lns.logger).Log(
+		"message", "receive control message",
+		"message_type", msg.getType())
+	switch msg.getType() {
+	// Tunnel messages
+	case avpMsgTypeSccrq:
+		ptid, err := findPeerTunnelID(msg)
+		if err != nil {
+			return fmt.Errorf("no Assigned Control Connection ID AVP in SCCRQ")
+		}
+		lns.xport.config.PeerControlConnID = ptid
+		lns.tcfg.PeerTunnelID = ptid
+		lns.xport.cp.connectTo(from)
+		rsp, err := newV3Sccrp(lns.tcfg)
+		if err != nil {
+			return fmt.Errorf("failed to build SCCRP: %v", err)
+		}
+		return lns.xport.send(rsp)
+	case avpMsgTypeScccn:
+		lns.tunnelEstablished = true
+		return nil
+	case avpMsgTypeStopccn:
+		lns.stopccnReceived = true
+		// HACK: allow the transport to ack the stopccn, c.f. handleV2Msg
+		time.Sleep(250 * time.Millisecond)
+		lns.isShutdown = true
+		return nil
+	case avpMsgTypeHello:
+		return nil
+
+	// Session messages
+	case avpMsgTypeIcrq:
+		psid, err := findPeerSessionID(msg)
+		if err != nil {
+			return fmt.Errorf("no Local Session ID AVP in ICRQ")
+		}
+		lns.scfg.PeerSessionID = psid
+		rsp, err := newV3Icrp(lns.tcfg.PeerTunnelID, lns.scfg)
+		if err != nil {
+			return fmt.Errorf("failed to build ICRP: %v", err)
+		}
 		return lns.xport.send(rsp)
 	case avpMsgTypeIccn:
 		lns.sessionEstablished = true
+		if lns.sliSeqOnIccn {
+			return lns.sendSli(nil, true)
+		}
 		return nil
 	case avpMsgTypeCdn:
+		rc, err := findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
+		if err != nil {
+			return fmt.Errorf("no Result Code AVP in CDN")
+		}
+		select {
+		case lns.cdnChan <- rc:
+		default:
+		}
 		return nil
 	}
 	return fmt.Errorf("message %v not handled", msg.getType())
@@ -206,11 +433,15 @@ func (lns *testLNS) run(timeout time.Duration) {
 			if !ok {
 				return
 			}
-			msg, ok := m.msg.(*v2ControlMessage)
-			if !ok {
-				panic("failed to cast received message as v2ControlMessage")
+			var err error
+			switch msg := m.msg.(type) {
+			case *v2ControlMessage:
+				err = lns.handleV2Msg(msg, m.from)
+			case *v3ControlMessage:
+				err = lns.handleV3Msg(msg, m.from)
+			default:
+				panic(fmt.Sprintf("unexpected received message type %T", m.msg))
 			}
-			err := lns.handleV2Msg(msg, m.from)
 			if err != nil {
 				lns.shutdown()
 				return
@@ -288,6 +519,78 @@ func TestDynamicClient(t *testing.T) {
 				SessionID:  5566,
 			},
 		},
+		{
+			name: "L2TPv2 UDP AF_INET (hidden AVPs, with session)",
+			localTunnelCfg: &TunnelConfig{
+				Local:          "127.0.0.1:6000",
+				Peer:           "localhost:5000",
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				Secret:         "sesame",
+			},
+			localSessionCfg: &SessionConfig{
+				Pseudowire: PseudowireTypePPP,
+			},
+			peerTunnelCfg: &TunnelConfig{
+				Local:          "localhost:5000",
+				Peer:           "127.0.0.1:6000",
+				Version:        ProtocolVersion2,
+				TunnelID:       4567,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				Secret:         "sesame",
+			},
+			peerSessionCfg: &SessionConfig{
+				Pseudowire: PseudowireTypePPP,
+				SessionID:  5566,
+			},
+		},
+		{
+			name: "L2TPv3 UDP AF_INET",
+			localTunnelCfg: &TunnelConfig{
+				Local:          "127.0.0.1:6000",
+				Peer:           "localhost:5000",
+				Version:        ProtocolVersion3,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			},
+			peerTunnelCfg: &TunnelConfig{
+				Local:          "localhost:5000",
+				Peer:           "127.0.0.1:6000",
+				Version:        ProtocolVersion3,
+				TunnelID:       0x12345678,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			},
+		},
+		{
+			name: "L2TPv3 UDP AF_INET (with session)",
+			localTunnelCfg: &TunnelConfig{
+				Local:          "127.0.0.1:6000",
+				Peer:           "localhost:5000",
+				Version:        ProtocolVersion3,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			},
+			localSessionCfg: &SessionConfig{
+				Pseudowire: PseudowireTypeEth,
+				Cookie:     []byte{0x01, 0x02, 0x03, 0x04},
+			},
+			peerTunnelCfg: &TunnelConfig{
+				Local:          "localhost:5000",
+				Peer:           "127.0.0.1:6000",
+				Version:        ProtocolVersion3,
+				TunnelID:       0x12345678,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			},
+			peerSessionCfg: &SessionConfig{
+				Pseudowire: PseudowireTypeEth,
+				SessionID:  0x55667788,
+				Cookie:     []byte{0x05, 0x06, 0x07, 0x08},
+			},
+		},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
@@ -360,3 +663,3037 @@ func TestDynamicClient(t *testing.T) {
 		})
 	}
 }
+
+func TestDynamicSessionSequencingChange(t *testing.T) {
+	cases := []struct {
+		name    string
+		version ProtocolVersion
+		tid     ControlConnID
+		sid     ControlConnID
+	}{
+		{name: "L2TPv2", version: ProtocolVersion2, tid: 4567, sid: 5566},
+		{name: "L2TPv3", version: ProtocolVersion3, tid: 0x0abcdef0, sid: 0x11223344},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lns, err := newTestLNS(logger,
+				&TunnelConfig{
+					Local:    "localhost:5000",
+					Peer:     "127.0.0.1:6000",
+					Version:  c.version,
+					TunnelID: 1234,
+					Encap:    EncapTypeUDP,
+				},
+				&SessionConfig{
+					Pseudowire: PseudowireTypePPP,
+					SessionID:  4321,
+				})
+			if err != nil {
+				t.Fatalf("newTestLNS: %v", err)
+			}
+			lns.sliSeqOnIccn = true
+
+			var lnsWg sync.WaitGroup
+			lnsWg.Add(1)
+			go func() {
+				lns.run(3 * time.Second)
+				lnsWg.Done()
+			}()
+
+			dp := NewMockDataPlane()
+			ctx, err := NewContext(dp, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+				Local:          "127.0.0.1:6000",
+				Peer:           "localhost:5000",
+				Version:        c.version,
+				TunnelID:       c.tid,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(): %v", err)
+			}
+
+			_, err = tunl.NewSession("s1", &SessionConfig{
+				Pseudowire: PseudowireTypePPP,
+				SessionID:  c.sid,
+			})
+			if err != nil {
+				t.Fatalf("NewSession(): %v", err)
+			}
+
+			// The session is created without sequencing, and then
+			// modified once the SLI is received
+			var created, modified *SessionConfig
+			deadline := time.Now().Add(5 * time.Second)
+			for modified == nil && time.Now().Before(deadline) {
+				for _, call := range dp.Calls() {
+					switch call.Op {
+					case MockOpNewSession:
+						created = call.SessionConfig
+					case MockOpSessionModify:
+						modified = call.SessionConfig
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			ctx.Close()
+			lnsWg.Wait()
+
+			if created == nil {
+				t.Fatalf("session data plane not created")
+			}
+			if created.SeqNum {
+				t.Errorf("session data plane created with sequencing enabled")
+			}
+			if modified == nil {
+				t.Fatalf("session data plane not modified")
+			}
+			if !modified.SeqNum {
+				t.Errorf("session data plane modified without enabling sequencing")
+			}
+			if modified.SessionID != c.sid || modified.PeerSessionID != 4321 {
+				t.Errorf("modified session IDs %v/%v, expected %v/%v",
+					modified.SessionID, modified.PeerSessionID, c.sid, 4321)
+			}
+		})
+	}
+}
+
+func TestDynamicV3AssignedIDs(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsTunnelCfg := &TunnelConfig{
+		Local:    "localhost:5000",
+		Peer:     "127.0.0.1:6000",
+		Version:  ProtocolVersion3,
+		TunnelID: 0x12345678,
+		Encap:    EncapTypeUDP,
+	}
+	lnsSessionCfg := &SessionConfig{
+		Pseudowire: PseudowireTypeEth,
+		SessionID:  0x55667788,
+		Cookie:     []byte{0x05, 0x06, 0x07, 0x08},
+	}
+	lns, err := newTestLNS(logger, lnsTunnelCfg, lnsSessionCfg)
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	dp := NewMockDataPlane()
+	ctx, err := NewContext(dp, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	upChan := make(chan *SessionUpEvent, 1)
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		if ev, ok := event.(*SessionUpEvent); ok {
+			upChan <- ev
+		}
+	}))
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "localhost:5000",
+		Version:        ProtocolVersion3,
+		TunnelID:       0x0abcdef0,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	_, err = tunl.NewSession("s1", &SessionConfig{
+		Pseudowire: PseudowireTypeEth,
+		SessionID:  0x11223344,
+		Cookie:     []byte{0x01, 0x02, 0x03, 0x04},
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	select {
+	case <-upChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for session up event")
+	}
+
+	ctx.Close()
+	lnsWg.Wait()
+
+	if lns.tcfg.PeerTunnelID != 0x0abcdef0 {
+		t.Errorf("LNS learned peer tunnel ID %#x, expected %#x", lns.tcfg.PeerTunnelID, 0x0abcdef0)
+	}
+	if lns.scfg.PeerSessionID != 0x11223344 {
+		t.Errorf("LNS learned peer session ID %#x, expected %#x", lns.scfg.PeerSessionID, 0x11223344)
+	}
+
+	// The IDs and cookie assigned by the peer must be passed to the
+	// data plane
+	var gotTunnel, gotSession bool
+	for _, call := range dp.Calls() {
+		switch call.Op {
+		case MockOpNewTunnel:
+			gotTunnel = true
+			if call.TunnelConfig.TunnelID != 0x0abcdef0 || call.TunnelConfig.PeerTunnelID != 0x12345678 {
+				t.Errorf("data plane tunnel IDs %#x/%#x, expected %#x/%#x",
+					call.TunnelConfig.TunnelID, call.TunnelConfig.PeerTunnelID, 0x0abcdef0, 0x12345678)
+			}
+		case MockOpNewSession:
+			gotSession = true
+			if call.TunnelID != 0x0abcdef0 || call.PeerTunnelID != 0x12345678 {
+				t.Errorf("data plane session tunnel IDs %#x/%#x, expected %#x/%#x",
+					call.TunnelID, call.PeerTunnelID, 0x0abcdef0, 0x12345678)
+			}
+			scfg := call.SessionConfig
+			if scfg.SessionID != 0x11223344 || scfg.PeerSessionID != 0x55667788 {
+				t.Errorf("data plane session IDs %#x/%#x, expected %#x/%#x",
+					scfg.SessionID, scfg.PeerSessionID, 0x11223344, 0x55667788)
+			}
+			if !bytes.Equal(scfg.PeerCookie, lnsSessionCfg.Cookie) {
+				t.Errorf("data plane peer cookie %v, expected %v", scfg.PeerCookie, lnsSessionCfg.Cookie)
+			}
+		}
+	}
+	if !gotTunnel || !gotSession {
+		t.Errorf("expected tunnel and session data plane instances, got %v", dp.Calls())
+	}
+}
+
+func TestDynamicV3PseudowireCaps(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:    "localhost:5000",
+			Peer:     "127.0.0.1:6000",
+			Version:  ProtocolVersion3,
+			TunnelID: 0x12345678,
+			Encap:    EncapTypeUDP,
+		},
+		nil)
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "localhost:5000",
+		Version:        ProtocolVersion3,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = tunl.WaitUp(waitCtx)
+	if err != nil {
+		t.Fatalf("WaitUp(): %v", err)
+	}
+
+	// The test LNS advertises PPP and Ethernet pseudowires only
+	_, err = tunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPPAC})
+	if !errors.Is(err, ErrInvalidSessionConfig) {
+		t.Errorf("NewSession() with unsupported pseudowire: expected %v, got %v", ErrInvalidSessionConfig, err)
+	}
+
+	ctx.Close()
+	lnsWg.Wait()
+}
+
+func TestDynamicOutgoingCall(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:          "localhost:5000",
+			Peer:           "127.0.0.1:6000",
+			Version:        ProtocolVersion2,
+			TunnelID:       4567,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		},
+		&SessionConfig{
+			Pseudowire:     PseudowireTypePPP,
+			SessionID:      5566,
+			TxConnectSpeed: 56000,
+		})
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+
+	// Close the tunnel once the session comes up
+	eventCounter := &testSessionEventCounterCloser{}
+	ctx.RegisterEventHandler(eventCounter)
+
+	upChan := make(chan *SessionUpEvent, 1)
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		if ev, ok := event.(*SessionUpEvent); ok {
+			upChan <- ev
+		}
+	}))
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "localhost:5000",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel: %v", err)
+	}
+
+	_, err = tunl.NewSession("s1", &SessionConfig{
+		Pseudowire:    PseudowireTypePPP,
+		CallDirection: CallDirectionOutgoing,
+		CalledNumber:  "5551234",
+	})
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+
+	lnsWg.Wait()
+	ctx.Close()
+	eventCounter.wait()
+
+	expectEvents := eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1}
+	if gotEvents := eventCounter.getEventCounts(); gotEvents != expectEvents {
+		t.Errorf("event listener: expected %v event, got %v", expectEvents, gotEvents)
+	}
+
+	if !lns.sessionEstablished {
+		t.Errorf("LNS didn't establish session")
+	}
+	if lns.calledNumber != "5551234" {
+		t.Errorf("expected OCRQ Called Number %q, got %q", "5551234", lns.calledNumber)
+	}
+
+	// The LAC reports its connect speed in the OCCN, and with no Rx
+	// Connect Speed AVP the receive speed is the same
+	select {
+	case ev := <-upChan:
+		if ev.PeerTxConnectSpeed != 56000 || ev.PeerRxConnectSpeed != 56000 {
+			t.Errorf("expected peer connect speeds 56000/56000, got %v/%v",
+				ev.PeerTxConnectSpeed, ev.PeerRxConnectSpeed)
+		}
+	default:
+		t.Errorf("no session up event")
+	}
+}
+
+// testSessionDownCloser closes the parent tunnel when a session goes down,
+// recording the result reported by the session down event.
+type testSessionDownCloser struct {
+	testEventCounter
+	result string
+	wg     sync.WaitGroup
+}
+
+func (sdc *testSessionDownCloser) HandleEvent(event interface{}) {
+	sdc.testEventCounter.HandleEvent(event)
+	if ev, ok := event.(*SessionDownEvent); ok {
+		sdc.result = ev.Result
+		t := ev.Tunnel
+		sdc.wg.Add(1)
+		go func() {
+			t.Close()
+			sdc.wg.Done()
+		}()
+	}
+}
+
+func TestDynamicSessionPeerCdn(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:          "localhost:5000",
+			Peer:           "127.0.0.1:6000",
+			Version:        ProtocolVersion2,
+			TunnelID:       4567,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		},
+		&SessionConfig{
+			Pseudowire: PseudowireTypePPP,
+			SessionID:  5566,
+		})
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+	lns.sendCdnOnIccn = true
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+
+	handler := &testSessionDownCloser{}
+	ctx.RegisterEventHandler(handler)
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "localhost:5000",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel: %v", err)
+	}
+
+	_, err = tunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+
+	lnsWg.Wait()
+	ctx.Close()
+	handler.wg.Wait()
+
+	expectEvents := eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1}
+	if gotEvents := handler.getEventCounts(); gotEvents != expectEvents {
+		t.Errorf("event listener: expected %v event, got %v", expectEvents, gotEvents)
+	}
+
+	if !strings.Contains(handler.result, "admin disconnect") {
+		t.Errorf("expected session down result to report the peer's CDN, got %q", handler.result)
+	}
+
+	if !lns.sessionEstablished {
+		t.Errorf("LNS didn't establish session")
+	}
+}
+
+// testFailingSessionDataPlane is a null data plane which fails session creation.
+type testFailingSessionDataPlane struct {
+	nullDataPlane
+}
+
+func (dp *testFailingSessionDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	return nil, fmt.Errorf("out of session data planes")
+}
+
+func TestDynamicSessionDataPlaneFailure(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:          "localhost:5000",
+			Peer:           "127.0.0.1:6000",
+			Version:        ProtocolVersion2,
+			TunnelID:       4567,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		},
+		&SessionConfig{
+			Pseudowire: PseudowireTypePPP,
+			SessionID:  5566,
+		})
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	ctx, err := NewContext(&testFailingSessionDataPlane{}, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+
+	eventCounter := &testEventCounter{}
+	ctx.RegisterEventHandler(eventCounter)
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "localhost:5000",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel: %v", err)
+	}
+
+	_, err = tunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+
+	select {
+	case rc := <-lns.cdnChan:
+		if rc.result != avpCDNResultCodeNoResources {
+			t.Errorf("expected CDN result %v, got %v", avpCDNResultCodeNoResources, rc.result)
+		}
+		if rc.errCode != avpErrorCodeNoResource {
+			t.Errorf("expected CDN error %v, got %v", avpErrorCodeNoResource, rc.errCode)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("LNS didn't receive CDN")
+	}
+
+	ctx.Close()
+	lnsWg.Wait()
+
+	expectEvents := eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 0, sessionDown: 0}
+	if gotEvents := eventCounter.getEventCounts(); gotEvents != expectEvents {
+		t.Errorf("event listener: expected %v event, got %v", expectEvents, gotEvents)
+	}
+}
+
+func TestUnrecognisedAvps(t *testing.T) {
+	newVendorAvp := func(mandatory bool) avp {
+		data := []byte{0xde, 0xad, 0xbe, 0xef}
+		return avp{
+			header:  *newAvpHeader(mandatory, false, uint(len(data)), 0x1ef, 1),
+			payload: avpPayload{dataType: avpDataTypeBytes, data: data},
+		}
+	}
+
+	cases := []struct {
+		name         string
+		extraAvps    map[avpMsgType][]avp
+		expectEvents eventCounters
+		// If set, the LAC is expected to tear down the tunnel
+		expectStopccn bool
+		// If set, the LAC is expected to tear down the session
+		expectCdn bool
+	}{
+		{
+			name: "non-mandatory AVPs are ignored",
+			extraAvps: map[avpMsgType][]avp{
+				avpMsgTypeSccrp: {newVendorAvp(false)},
+				avpMsgTypeIcrp:  {newVendorAvp(false)},
+			},
+			expectEvents: eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1},
+		},
+		{
+			name: "mandatory AVP in tunnel message",
+			extraAvps: map[avpMsgType][]avp{
+				avpMsgTypeSccrp: {newVendorAvp(true)},
+			},
+			expectEvents:  eventCounters{tunnelUp: 0, tunnelDown: 0, sessionUp: 0, sessionDown: 0},
+			expectStopccn: true,
+		},
+		{
+			name: "mandatory AVP in session message",
+			extraAvps: map[avpMsgType][]avp{
+				avpMsgTypeIcrp: {newVendorAvp(true)},
+			},
+			expectEvents: eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 0, sessionDown: 0},
+			expectCdn:    true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lns, err := newTestLNS(logger,
+				&TunnelConfig{
+					Local:          "localhost:5000",
+					Peer:           "127.0.0.1:6000",
+					Version:        ProtocolVersion2,
+					TunnelID:       4567,
+					Encap:          EncapTypeUDP,
+					StopCCNTimeout: 250 * time.Millisecond,
+				},
+				&SessionConfig{
+					Pseudowire: PseudowireTypePPP,
+					SessionID:  5566,
+				})
+			if err != nil {
+				t.Fatalf("newTestLNS: %v", err)
+			}
+			lns.extraAvps = c.extraAvps
+
+			var lnsWg sync.WaitGroup
+			lnsWg.Add(1)
+			go func() {
+				lns.run(3 * time.Second)
+				lnsWg.Done()
+			}()
+
+			ctx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+
+			eventCounter := &testEventCounter{}
+			ctx.RegisterEventHandler(eventCounter)
+
+			tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+				Local:          "127.0.0.1:6000",
+				Peer:           "localhost:5000",
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel: %v", err)
+			}
+
+			if c.expectStopccn {
+				// The tunnel is torn down by the LAC, which causes the
+				// LNS to exit once it has received the StopCCN.
+				lnsWg.Wait()
+				ctx.Close()
+				if !lns.stopccnReceived {
+					t.Fatalf("LNS didn't receive StopCCN")
+				}
+				if lns.stopccnResult == nil || lns.stopccnResult.errCode != avpErrorCodeMBitShutdown {
+					t.Errorf("expected StopCCN error %v, got %v", avpErrorCodeMBitShutdown, lns.stopccnResult)
+				}
+			} else {
+				_, err = tunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP})
+				if err != nil {
+					t.Fatalf("NewSession: %v", err)
+				}
+				if c.expectCdn {
+					select {
+					case rc := <-lns.cdnChan:
+						if rc.errCode != avpErrorCodeMBitShutdown {
+							t.Errorf("expected CDN error %v, got %v", avpErrorCodeMBitShutdown, rc.errCode)
+						}
+					case <-time.After(3 * time.Second):
+						t.Errorf("LNS didn't receive CDN")
+					}
+				} else {
+					err = tunl.WaitUp(context.Background())
+					if err != nil {
+						t.Fatalf("WaitUp: %v", err)
+					}
+					// Allow the session to come up before closing the context
+					time.Sleep(500 * time.Millisecond)
+				}
+				ctx.Close()
+				lnsWg.Wait()
+				if !c.expectCdn && !lns.sessionEstablished {
+					t.Errorf("LNS didn't establish session")
+				}
+			}
+
+			if gotEvents := eventCounter.getEventCounts(); gotEvents != c.expectEvents {
+				t.Errorf("event listener: expected %v event, got %v", c.expectEvents, gotEvents)
+			}
+		})
+	}
+}
+
+func TestDynamicTunnelVendorAVPs(t *testing.T) {
+	registerTestVendorAVP(t)
+
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+	peerAvps := []VendorAVP{
+		{VendorID: testVendorID, Type: testVendorAVPType, Mandatory: true, Value: testVendorInfo{Level: 7, Name: "lns"}},
+	}
+	a, err := peerAvps[0].toAvp()
+	if err != nil {
+		t.Fatalf("toAvp(): %v", err)
+	}
+
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:    "localhost:5000",
+			Peer:     "127.0.0.1:6000",
+			Version:  ProtocolVersion2,
+			TunnelID: 4567,
+			Encap:    EncapTypeUDP,
+		},
+		nil)
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+	lns.extraAvps = map[avpMsgType][]avp{avpMsgTypeSccrp: {*a}}
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	upChan := make(chan *TunnelUpEvent, 1)
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		if ev, ok := event.(*TunnelUpEvent); ok {
+			upChan <- ev
+		}
+	}))
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "localhost:5000",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+		VendorAVPs: []VendorAVP{
+			{VendorID: testVendorID, Type: testVendorAVPType, Value: testVendorInfo{Level: 1, Name: "lac"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	select {
+	case ev := <-upChan:
+		if !reflect.DeepEqual(ev.PeerVendorAVPs, peerAvps) {
+			t.Errorf("expected peer vendor AVPs %+v, got %+v", peerAvps, ev.PeerVendorAVPs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for tunnel up event")
+	}
+
+	tunl.Close()
+	lnsWg.Wait()
+}
+
+// testRandSource is a math/rand source which produces a predetermined
+// sequence of uint32 values from rand.Rand.Uint32, followed by zeros.
+type testRandSource struct {
+	values []uint32
+}
+
+func (src *testRandSource) Int63() int64 {
+	if len(src.values) == 0 {
+		return 0
+	}
+	v := src.values[0]
+	src.values = src.values[1:]
+	// rand.Rand.Uint32 uses the top 32 bits of the 63 bit value
+	return int64(v) << 31
+}
+
+func (src *testRandSource) Seed(seed int64) {}
+
+func TestGenerateControlConnID(t *testing.T) {
+	cases := []struct {
+		name    string
+		version ProtocolVersion
+		rng     []uint32
+		expect  ControlConnID
+		estr    string
+	}{
+		{
+			name:    "L2TPv2 retry on zero",
+			version: ProtocolVersion2,
+			rng:     []uint32{0, 0x10000, 0x1002a},
+			expect:  42,
+		},
+		{
+			name:    "L2TPv3 retry on zero",
+			version: ProtocolVersion3,
+			rng:     []uint32{0, 0, 0x1002a},
+			expect:  0x1002a,
+		},
+		{
+			name:    "L2TPv3 RNG stuck at zero",
+			version: ProtocolVersion3,
+			estr:    "failed to generate a non-zero ID",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// The first value is consumed by the context's call serial number
+			src := &testRandSource{values: append([]uint32{0}, c.rng...)}
+			ctx, err := NewContextWithOptions(nil, nil, WithRand(rand.New(src)))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			id, err := ctx.reserveTid(0, c.version)
+			if c.estr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.estr) {
+					t.Fatalf("reserveTid(%v): expected error containing %q, got %v", c.version, c.estr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reserveTid(%v): %v", c.version, err)
+			}
+			if id != c.expect {
+				t.Errorf("reserveTid(%v): expected %v, got %v", c.version, c.expect, id)
+			}
+		})
+	}
+}
+
+func TestContextWithRand(t *testing.T) {
+	newCtx := func(seed int64) *Context {
+		ctx, err := NewContextWithOptions(nil, nil, WithRand(rand.New(rand.NewSource(seed))))
+		if err != nil {
+			t.Fatalf("NewContextWithOptions(): %v", err)
+		}
+		return ctx
+	}
+
+	// Contexts with identically seeded sources generate identical IDs
+	ctx1, ctx2 := newCtx(42), newCtx(42)
+	defer ctx1.Close()
+	defer ctx2.Close()
+	for i := 0; i < 5; i++ {
+		id1, err := ctx1.reserveTid(0, ProtocolVersion3)
+		if err != nil {
+			t.Fatalf("reserveTid(): %v", err)
+		}
+		id2, err := ctx2.reserveTid(0, ProtocolVersion3)
+		if err != nil {
+			t.Fatalf("reserveTid(): %v", err)
+		}
+		if id1 != id2 {
+			t.Fatalf("expected identical IDs from identically seeded contexts, got %v and %v", id1, id2)
+		}
+	}
+
+	// Allocation retries on collision with an existing tunnel or session
+	src := &testRandSource{values: []uint32{0, 100, 100, 200, 300, 300, 400}}
+	ctx, err := NewContextWithOptions(nil, nil, WithRand(rand.New(src)))
+	if err != nil {
+		t.Fatalf("NewContextWithOptions(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     100,
+		PeerTunnelID: 1000,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+	_, err = tunl.NewSession("s1", &SessionConfig{
+		SessionID:     300,
+		PeerSessionID: 3000,
+		Pseudowire:    PseudowireTypeEth,
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	tid, err := ctx.reserveTid(0, ProtocolVersion3)
+	if err != nil || tid != 200 {
+		t.Errorf("reserveTid(): expected 200, got %v, %v", tid, err)
+	}
+
+	// Skip the remaining colliding tunnel ID in the sequence
+	ctx.randUint32()
+
+	sid, err := tunl.(*staticTunnel).allocSid()
+	if err != nil || sid != 400 {
+		t.Errorf("allocSid(): expected 400, got %v, %v", sid, err)
+	}
+}
+
+func TestDynamicSessionLinkInfo(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsAccm := ACCM{Send: 0x000a0000, Recv: 0x00000011}
+	lacAccm := ACCM{Send: 0x00000000, Recv: 0xffffffff}
+
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:    "localhost:5000",
+			Peer:     "127.0.0.1:6000",
+			Version:  ProtocolVersion2,
+			TunnelID: 1234,
+			Encap:    EncapTypeUDP,
+		},
+		&SessionConfig{
+			Pseudowire: PseudowireTypePPP,
+			SessionID:  4321,
+		})
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+	lns.sliAccmOnIccn = &lnsAccm
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	upChan := make(chan Session, 1)
+	linkChan := make(chan *SessionLinkInfoEvent, 1)
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		switch ev := event.(type) {
+		case *SessionUpEvent:
+			upChan <- ev.Session
+		case *SessionLinkInfoEvent:
+			linkChan <- ev
+		}
+	}))
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "localhost:5000",
+		Version:        ProtocolVersion2,
+		TunnelID:       4567,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	sess, err := tunl.NewSession("s1", &SessionConfig{
+		Pseudowire: PseudowireTypePPP,
+		SessionID:  5566,
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	sender, ok := sess.(LinkInfoSender)
+	if !ok {
+		t.Fatalf("dynamic session doesn't implement LinkInfoSender")
+	}
+
+	select {
+	case <-upChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for session up event")
+	}
+
+	// The ACCM sent by the LNS is passed to the user
+	select {
+	case ev := <-linkChan:
+		if ev.ACCM != lnsAccm {
+			t.Errorf("expected ACCM %+v, got %+v", lnsAccm, ev.ACCM)
+		}
+		if ev.SessionName != "s1" || ev.Session != sess {
+			t.Errorf("link info event for unexpected session %q", ev.SessionName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for session link info event")
+	}
+
+	// The ACCM sent by the user is received by the LNS
+	err = sender.SendLinkInfo(&lacAccm)
+	if err != nil {
+		t.Fatalf("SendLinkInfo(): %v", err)
+	}
+	select {
+	case got := <-lns.sliChan:
+		if *got != lacAccm {
+			t.Errorf("LNS received ACCM %+v, expected %+v", *got, lacAccm)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for LNS to receive SLI")
+	}
+
+	sess.Close()
+	err = sender.SendLinkInfo(&lacAccm)
+	if err == nil {
+		t.Errorf("SendLinkInfo() on closed session succeeded when we expected an error")
+	}
+
+	ctx.Close()
+	lnsWg.Wait()
+}
+
+func TestIDAllocation(t *testing.T) {
+	newCtx := func(strategy IDAllocStrategy, rng ...uint32) *Context {
+		opts := []ContextOption{WithIDAllocation(strategy)}
+		if rng != nil {
+			// The first value is consumed by the context's call serial number
+			src := &testRandSource{values: append([]uint32{0}, rng...)}
+			opts = append(opts, WithRand(rand.New(src)))
+		}
+		ctx, err := NewContextWithOptions(nil, nil, opts...)
+		if err != nil {
+			t.Fatalf("NewContextWithOptions(): %v", err)
+		}
+		return ctx
+	}
+	// useTids marks tunnel IDs lo..hi inclusive as in use
+	useTids := func(ctx *Context, lo, hi ControlConnID) {
+		for id := lo; id <= hi; id++ {
+			ctx.tunnelsByID[id] = nil
+		}
+	}
+
+	cases := []struct {
+		name     string
+		strategy IDAllocStrategy
+		rng      []uint32
+		version  ProtocolVersion
+		used     [][2]ControlConnID
+		expect   ControlConnID
+		err      error
+	}{
+		{
+			name:     "sequential first ID",
+			strategy: IDAllocSequential,
+			version:  ProtocolVersion3,
+			expect:   1,
+		},
+		{
+			name:     "sequential lowest free ID",
+			strategy: IDAllocSequential,
+			version:  ProtocolVersion3,
+			used:     [][2]ControlConnID{{1, 2}, {4, 10}},
+			expect:   3,
+		},
+		{
+			name:     "sequential L2TPv2 near exhaustion",
+			strategy: IDAllocSequential,
+			version:  ProtocolVersion2,
+			used:     [][2]ControlConnID{{1, 0xfffe}},
+			expect:   0xffff,
+		},
+		{
+			name:     "sequential L2TPv2 exhausted",
+			strategy: IDAllocSequential,
+			version:  ProtocolVersion2,
+			used:     [][2]ControlConnID{{1, 0xffff}},
+			err:      ErrIDSpaceExhausted,
+		},
+		{
+			name:     "sequential L2TPv2 ignores L2TPv3 IDs",
+			strategy: IDAllocSequential,
+			version:  ProtocolVersion2,
+			used:     [][2]ControlConnID{{0x10000, 0x10000}},
+			expect:   1,
+		},
+		{
+			name:     "random",
+			strategy: IDAllocRandom,
+			rng:      []uint32{1, 2, 3},
+			version:  ProtocolVersion3,
+			used:     [][2]ControlConnID{{1, 2}},
+			expect:   3,
+		},
+		{
+			name:     "random L2TPv2 near exhaustion",
+			strategy: IDAllocRandom,
+			rng:      []uint32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 0xffff},
+			version:  ProtocolVersion2,
+			used:     [][2]ControlConnID{{1, 0xfffe}},
+			err:      ErrIDSpaceExhausted,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := newCtx(c.strategy, c.rng...)
+			defer ctx.Close()
+			for _, u := range c.used {
+				useTids(ctx, u[0], u[1])
+			}
+			id, err := ctx.reserveTid(0, c.version)
+			if c.err != nil {
+				if !errors.Is(err, c.err) {
+					t.Fatalf("reserveTid(%v): expected error %q, got %v, %v", c.version, c.err, id, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reserveTid(%v): %v", c.version, err)
+			}
+			if id != c.expect {
+				t.Errorf("reserveTid(%v): expected %v, got %v", c.version, c.expect, id)
+			}
+		})
+	}
+
+	t.Run("sequential sessions", func(t *testing.T) {
+		ctx := newCtx(IDAllocSequential)
+		defer ctx.Close()
+
+		tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+			Local:        "127.0.0.1:6000",
+			Peer:         "127.0.0.1:5000",
+			Version:      ProtocolVersion3,
+			TunnelID:     1,
+			PeerTunnelID: 1000,
+			Encap:        EncapTypeUDP,
+		})
+		if err != nil {
+			t.Fatalf("NewStaticTunnel(): %v", err)
+		}
+		for _, sid := range []ControlConnID{1, 2, 4} {
+			_, err = tunl.NewSession(fmt.Sprintf("s%v", sid), &SessionConfig{
+				SessionID:     sid,
+				PeerSessionID: 1000 + sid,
+				Pseudowire:    PseudowireTypeEth,
+			})
+			if err != nil {
+				t.Fatalf("NewSession(): %v", err)
+			}
+		}
+
+		sid, err := tunl.(*staticTunnel).allocSid()
+		if err != nil || sid != 3 {
+			t.Errorf("allocSid(): expected 3, got %v, %v", sid, err)
+		}
+	})
+
+	t.Run("sequential L2TPv2 sessions exhausted", func(t *testing.T) {
+		ctx := newCtx(IDAllocSequential)
+		defer ctx.Close()
+
+		tunl, err := ctx.NewQuiescentTunnel("t1", &TunnelConfig{
+			Local:        "127.0.0.1:6000",
+			Peer:         "127.0.0.1:5000",
+			Version:      ProtocolVersion2,
+			TunnelID:     1,
+			PeerTunnelID: 1000,
+			Encap:        EncapTypeUDP,
+		})
+		if err != nil {
+			t.Fatalf("NewQuiescentTunnel(): %v", err)
+		}
+		qt := tunl.(*quiescentTunnel)
+		for id := ControlConnID(1); id < v2TidSidMax; id++ {
+			qt.sessionsByID[id] = nil
+		}
+
+		sid, err := qt.allocSid()
+		if err != nil || sid != v2TidSidMax {
+			t.Errorf("allocSid(): expected %v, got %v, %v", v2TidSidMax, sid, err)
+		}
+
+		qt.sessionsByID[v2TidSidMax] = nil
+		_, err = qt.allocSid()
+		if !errors.Is(err, ErrIDSpaceExhausted) {
+			t.Errorf("allocSid(): expected error %q, got %v", ErrIDSpaceExhausted, err)
+		}
+	})
+}
+
+type testTunnelUpNotifier struct {
+	upChan chan interface{}
+}
+
+func (tun *testTunnelUpNotifier) HandleEvent(event interface{}) {
+	if _, ok := event.(*TunnelUpEvent); ok {
+		close(tun.upChan)
+	}
+}
+
+func TestConcurrentDynamicTunnelIDs(t *testing.T) {
+	const ntunnels = 64
+
+	// Sequential allocation always picks the lowest free ID, so tunnels
+	// created concurrently would collide without the ID being reserved
+	ctx, err := NewContextWithOptions(nil, nil, WithIDAllocation(IDAllocSequential))
+	if err != nil {
+		t.Fatalf("NewContextWithOptions(): %v", err)
+	}
+	// The peer never responds, so don't wait on SCCRQ retransmits
+	defer ctx.CloseWithTimeout(100 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	start := make(chan interface{})
+	tunnels := make([]Tunnel, ntunnels)
+	errs := make([]error, ntunnels)
+	for i := 0; i < ntunnels; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			tunnels[i], errs[i] = ctx.NewDynamicTunnel(fmt.Sprintf("t%d", i), &TunnelConfig{
+				Local:          "127.0.0.1:0",
+				Peer:           "127.0.0.1:5000",
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	tids := make(map[ControlConnID]string)
+	for i, tunl := range tunnels {
+		if errs[i] != nil {
+			t.Fatalf("NewDynamicTunnel(t%d): %v", i, errs[i])
+		}
+		dt := tunl.(*dynamicTunnel)
+		tid := dt.getCfg().TunnelID
+		if other, ok := tids[tid]; ok {
+			t.Errorf("tunnel %v: tunnel ID %v already assigned to %v", dt.getName(), tid, other)
+		}
+		tids[tid] = dt.getName()
+		if linked, ok := ctx.findTunnelByID(tid); !ok || linked != tunl {
+			t.Errorf("tunnel %v: not linked by tunnel ID %v", dt.getName(), tid)
+		}
+	}
+}
+
+func TestConcurrentDynamicSessionIDs(t *testing.T) {
+	const nsessions = 64
+
+	// The peer never responds, so the tunnel remains establishing
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket(): %v", err)
+	}
+	defer peer.Close()
+
+	ctx, err := NewContextWithOptions(nil, nil, WithIDAllocation(IDAllocSequential))
+	if err != nil {
+		t.Fatalf("NewContextWithOptions(): %v", err)
+	}
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:0",
+		Peer:           peer.LocalAddr().String(),
+		Version:        ProtocolVersion3,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+	dt := tunl.(*dynamicTunnel)
+
+	// Sessions aren't linked until the tunnel is up, so sessions created
+	// concurrently would collide without the ID being reserved
+	var wg sync.WaitGroup
+	start := make(chan interface{})
+	for i := 0; i < nsessions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, _ = tunl.NewSession(fmt.Sprintf("s%d", i), &SessionConfig{
+				Pseudowire: PseudowireTypeEth,
+			})
+		}(i)
+	}
+	close(start)
+
+	reserved := func() int {
+		dt.sessionLock.RLock()
+		defer dt.sessionLock.RUnlock()
+		return len(dt.sessionsByID)
+	}
+	for deadline := time.Now().Add(5 * time.Second); reserved() < nsessions; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v session IDs reserved, got %v", nsessions, reserved())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for sid := ControlConnID(1); sid <= nsessions; sid++ {
+		if !ctx.v3SessionIDInUse(sid) {
+			t.Errorf("session ID %v not reserved", sid)
+		}
+	}
+
+	// A reserved ID may not be reused
+	_, err = tunl.NewSession("clash", &SessionConfig{
+		Pseudowire: PseudowireTypeEth,
+		SessionID:  1,
+	})
+	if !errors.Is(err, ErrSessionIDExists) {
+		t.Errorf("NewSession(clash): expected ErrSessionIDExists, got %v", err)
+	}
+
+	// The peer never responds, so don't wait on SCCRQ retransmits.
+	// Closing the tunnel closes the pending sessions, releasing their IDs.
+	ctx.CloseWithTimeout(100 * time.Millisecond)
+	wg.Wait()
+
+	if n := reserved(); n != 0 {
+		t.Errorf("expected no session IDs reserved after close, got %v", n)
+	}
+	for sid := ControlConnID(1); sid <= nsessions; sid++ {
+		if ctx.v3SessionIDInUse(sid) {
+			t.Errorf("session ID %v still reserved after close", sid)
+		}
+	}
+}
+
+func TestSessionIDReleasedOnError(t *testing.T) {
+	ctx, err := NewContext(&testFailingSessionDataPlane{}, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 1001,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	_, err = tunl.NewSession("s1", &SessionConfig{
+		Pseudowire:    PseudowireTypeEth,
+		SessionID:     10,
+		PeerSessionID: 20,
+	})
+	if err == nil {
+		t.Fatalf("NewSession(): expected data plane failure")
+	}
+	if ctx.v3SessionIDInUse(10) {
+		t.Errorf("session ID 10 still reserved after failed session creation")
+	}
+	if _, ok := tunl.(*staticTunnel).findSessionByID(10); ok {
+		t.Errorf("session ID 10 still reserved by tunnel after failed session creation")
+	}
+}
+
+func TestDynamicTunnelLocalPortInUse(t *testing.T) {
+	ctx, err := NewContext(NewMockDataPlane(), nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	// Occupy a port on the wildcard address, as a tunnel with no local
+	// address does
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer conn.Close()
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	_, err = ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		LocalPort: port,
+		Peer:      "127.0.0.1:5000",
+		Version:   ProtocolVersion2,
+		Encap:     EncapTypeUDP,
+	})
+	if err == nil {
+		t.Fatalf("NewDynamicTunnel(): expected error for a local port in use")
+	}
+	var addrErr *AddressError
+	if !errors.As(err, &addrErr) || !addrErr.Local {
+		t.Errorf("NewDynamicTunnel(): expected a local AddressError, got %v", err)
+	}
+	if !errors.Is(err, unix.EADDRINUSE) {
+		t.Errorf("NewDynamicTunnel(): expected EADDRINUSE, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "ReusePort") {
+		t.Errorf("NewDynamicTunnel(): expected error to suggest ReusePort, got %v", err)
+	}
+}
+
+func TestContextCloseStopCCN(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:          "localhost:5000",
+			Peer:           "127.0.0.1:6000",
+			Version:        ProtocolVersion2,
+			TunnelID:       4567,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		}, nil)
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+
+	notifier := &testTunnelUpNotifier{upChan: make(chan interface{})}
+	ctx.RegisterEventHandler(notifier)
+
+	_, err = ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "localhost:5000",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel: %v", err)
+	}
+
+	select {
+	case <-notifier.upChan:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("tunnel didn't come up")
+	}
+
+	// Close should block until the StopCCN has been acknowledged
+	ctx.Close()
+	lnsWg.Wait()
+
+	if !lns.stopccnReceived {
+		t.Errorf("LNS didn't receive StopCCN")
+	}
+}
+
+func TestTunnelCloseWithResult(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:          "localhost:5000",
+			Peer:           "127.0.0.1:6000",
+			Version:        ProtocolVersion2,
+			TunnelID:       4567,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		}, nil)
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	notifier := &testTunnelUpNotifier{upChan: make(chan interface{})}
+	ctx.RegisterEventHandler(notifier)
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "localhost:5000",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel: %v", err)
+	}
+
+	select {
+	case <-notifier.upChan:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("tunnel didn't come up")
+	}
+
+	// Invalid codes are rejected without closing the tunnel
+	for _, codes := range [][2]uint16{{0, 0}, {8, 0}, {2, 9}} {
+		if err := tunl.CloseWithResult(codes[0], codes[1], ""); err == nil {
+			t.Errorf("CloseWithResult(%v, %v): expected error", codes[0], codes[1])
+		}
+	}
+	if _, ok := ctx.findTunnelByName("t1"); !ok {
+		t.Fatalf("tunnel closed by CloseWithResult with invalid codes")
+	}
+
+	err = tunl.CloseWithResult(uint16(avpStopCCNResultCodeGeneralError),
+		uint16(avpErrorCodeVendorSpecificError), "admin shutdown")
+	if err != nil {
+		t.Fatalf("CloseWithResult(): %v", err)
+	}
+	lnsWg.Wait()
+
+	expect := &resultCode{
+		result:  avpStopCCNResultCodeGeneralError,
+		errCode: avpErrorCodeVendorSpecificError,
+		errMsg:  "admin shutdown",
+	}
+	if !reflect.DeepEqual(lns.stopccnResult, expect) {
+		t.Errorf("expected StopCCN result %v, got %v", expect, lns.stopccnResult)
+	}
+}
+
+func TestContextShutdownDeadline(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+
+	// Nothing is listening at the peer address, so the tunnel
+	// will retransmit its control messages until retries are exhausted.
+	_, err = ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:0",
+		Peer:         "127.0.0.1:5999",
+		Version:      ProtocolVersion2,
+		Encap:        EncapTypeUDP,
+		RetryTimeout: 250 * time.Millisecond,
+		MaxRetries:   2,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel: %v", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = ctx.Shutdown(shutdownCtx)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown: expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("Shutdown took %v, expected it to honour the deadline", elapsed)
+	}
+
+	if tunnels := ctx.ListTunnels(); len(tunnels) != 0 {
+		t.Errorf("expected no tunnels after shutdown, got %v", tunnels)
+	}
+}
+
+// testBlockingTunnel is a tunnel whose Close blocks until it is killed.
+type testBlockingTunnel struct {
+	tunnel
+	name     string
+	cfg      *TunnelConfig
+	killChan chan interface{}
+}
+
+func (bt *testBlockingTunnel) getName() string {
+	return bt.name
+}
+
+func (bt *testBlockingTunnel) getCfg() *TunnelConfig {
+	return bt.cfg
+}
+
+func (bt *testBlockingTunnel) Close() {
+	<-bt.killChan
+}
+
+func (bt *testBlockingTunnel) kill() {
+	close(bt.killChan)
+}
+
+func TestContextCloseWithTimeout(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+	dp := NewMockDataPlane()
+	ctx, err := NewContext(dp, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+
+	bt := &testBlockingTunnel{
+		name:     "t1",
+		cfg:      &TunnelConfig{TunnelID: 42},
+		killChan: make(chan interface{}),
+	}
+	ctx.linkTunnel(bt)
+
+	start := time.Now()
+	ctx.CloseWithTimeout(100 * time.Millisecond)
+	elapsed := time.Since(start)
+
+	select {
+	case <-bt.killChan:
+	default:
+		t.Errorf("tunnel wasn't killed")
+	}
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("CloseWithTimeout took %v, expected it to honour the timeout", elapsed)
+	}
+	if tunnels := ctx.ListTunnels(); len(tunnels) != 0 {
+		t.Errorf("expected no tunnels after close, got %v", tunnels)
+	}
+}
+
+func TestContextCloseWithTimeoutKillDynamic(t *testing.T) {
+	// The peer never responds, so the tunnel blocks sending the SCCRQ
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket(): %v", err)
+	}
+	defer peer.Close()
+
+	dp := NewMockDataPlane()
+	ctx, err := NewContext(dp, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:0",
+		Peer:           peer.LocalAddr().String(),
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+	dt := tunl.(*dynamicTunnel)
+
+	start := time.Now()
+	ctx.CloseWithTimeout(100 * time.Millisecond)
+	elapsed := time.Since(start)
+
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("CloseWithTimeout took %v, expected it to honour the timeout", elapsed)
+	}
+
+	// The tunnel must have finished closing before CloseWithTimeout
+	// returns, and before the data plane is closed
+	select {
+	case <-dt.doneChan:
+	default:
+		t.Errorf("tunnel goroutine still running after CloseWithTimeout")
+	}
+	calls := dp.Calls()
+	if len(calls) == 0 || calls[len(calls)-1].Op != MockOpClose {
+		t.Errorf("expected data plane to be closed last, got %v", calls)
+	}
+}
+
+func TestKillQuiescentTunnel(t *testing.T) {
+	dp := NewMockDataPlane()
+	ctx, err := NewContext(dp, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewQuiescentTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:0",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion2,
+		Encap:        EncapTypeUDP,
+		TunnelID:     1,
+		PeerTunnelID: 2,
+	})
+	if err != nil {
+		t.Fatalf("NewQuiescentTunnel(): %v", err)
+	}
+
+	countDown := func() (n int) {
+		for _, call := range dp.Calls() {
+			if call.Op == MockOpTunnelDown {
+				n++
+			}
+		}
+		return
+	}
+
+	qt := tunl.(*quiescentTunnel)
+	qt.kill()
+	if n := countDown(); n != 1 {
+		t.Errorf("expected tunnel data plane down on kill, got %v down calls", n)
+	}
+	if err := tunl.SetDebugFlags(0); err == nil {
+		t.Errorf("SetDebugFlags() succeeded after kill")
+	}
+
+	tunl.Close()
+	if n := countDown(); n != 1 {
+		t.Errorf("expected tunnel data plane down once, got %v down calls", n)
+	}
+}
+
+func TestRetransmitExhaustedEvent(t *testing.T) {
+	const maxRetries = 3
+
+	// The black hole peer receives control messages but never acks them
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5998})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peer.Close()
+
+	rxChan := make(chan int)
+	go func() {
+		var count int
+		b := make([]byte, 4096)
+		for {
+			_, err := peer.Read(b)
+			if err != nil {
+				rxChan <- count
+				return
+			}
+			count++
+		}
+	}()
+
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	evChan := make(chan *ControlMessageRetransmitExhaustedEvent, 1)
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		if ev, ok := event.(*ControlMessageRetransmitExhaustedEvent); ok {
+			evChan <- ev
+		}
+	}))
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:0",
+		Peer:         "127.0.0.1:5998",
+		Version:      ProtocolVersion2,
+		Encap:        EncapTypeUDP,
+		RetryTimeout: 50 * time.Millisecond,
+		MaxRetries:   maxRetries,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	select {
+	case ev := <-evChan:
+		if ev.TunnelName != "t1" || ev.Tunnel != tunl {
+			t.Errorf("unexpected event tunnel %v/%v", ev.TunnelName, ev.Tunnel)
+		}
+		if ev.MessageType != uint16(avpMsgTypeSccrq) {
+			t.Errorf("expected message type %v, got %v", uint16(avpMsgTypeSccrq), ev.MessageType)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for retransmit exhausted event")
+	}
+
+	peer.Close()
+	if count := <-rxChan; count != maxRetries {
+		t.Errorf("expected peer to receive %v SCCRQ transmissions, got %v", maxRetries, count)
+	}
+}
+
+func TestEstablishTimeout(t *testing.T) {
+	const establishTimeout = 200 * time.Millisecond
+
+	// The black hole peer receives control messages but never responds
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5997})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peer.Close()
+
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	evChan := make(chan *TunnelDownEvent, 1)
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		if ev, ok := event.(*TunnelDownEvent); ok {
+			evChan <- ev
+		}
+	}))
+
+	start := time.Now()
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:            "127.0.0.1:0",
+		Peer:             "127.0.0.1:5997",
+		Version:          ProtocolVersion2,
+		Encap:            EncapTypeUDP,
+		RetryTimeout:     time.Second,
+		MaxRetries:       10,
+		EstablishTimeout: establishTimeout,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	select {
+	case ev := <-evChan:
+		if elapsed := time.Since(start); elapsed < establishTimeout {
+			t.Errorf("tunnel torn down after %v, before establish timeout %v", elapsed, establishTimeout)
+		}
+		if ev.TunnelName != "t1" || ev.Tunnel != tunl {
+			t.Errorf("unexpected event tunnel %v/%v", ev.TunnelName, ev.Tunnel)
+		}
+		if !errors.Is(ev.Error, ErrTunnelEstablishTimeout) {
+			t.Errorf("expected error %q, got %v", ErrTunnelEstablishTimeout, ev.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for tunnel down event")
+	}
+
+	if tunnels := ctx.ListTunnels(); len(tunnels) != 0 {
+		t.Errorf("expected no tunnels after establish timeout, got %v", tunnels)
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	cases := []struct {
+		name        string
+		min, max    time.Duration
+		attempt     uint
+		rand        uint32
+		expectDelay time.Duration
+	}{
+		{name: "defaults first attempt", attempt: 0, rand: 0, expectDelay: 500 * time.Millisecond},
+		{name: "defaults backoff", attempt: 3, rand: 0, expectDelay: 4 * time.Second},
+		{name: "defaults capped", attempt: 100, rand: 0, expectDelay: 30 * time.Second},
+		{name: "jitter", min: time.Second, max: time.Minute, attempt: 1, rand: 1 << 31, expectDelay: 1500 * time.Millisecond},
+		{name: "minimum above default maximum", min: 2 * time.Minute, attempt: 2, rand: 0, expectDelay: time.Minute},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &TunnelConfig{ReconnectMin: c.min, ReconnectMax: c.max}
+			delay := reconnectDelay(cfg, c.attempt, func() uint32 { return c.rand })
+			if delay != c.expectDelay {
+				t.Errorf("expected delay %v, got %v", c.expectDelay, delay)
+			}
+		})
+	}
+}
+
+func TestTunnelReconnect(t *testing.T) {
+	const reconnectDelay = 500 * time.Millisecond
+
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsTunnelCfg := func() *TunnelConfig {
+		return &TunnelConfig{
+			Local:    "localhost:5000",
+			Peer:     "127.0.0.1:6000",
+			Version:  ProtocolVersion2,
+			TunnelID: 4567,
+			Encap:    EncapTypeUDP,
+		}
+	}
+	lnsSessionCfg := func() *SessionConfig {
+		return &SessionConfig{
+			Pseudowire: PseudowireTypePPP,
+			SessionID:  5566,
+		}
+	}
+
+	// The first LNS instance tears the tunnel down with an error once
+	// the session is established
+	lns, err := newTestLNS(logger, lnsTunnelCfg(), lnsSessionCfg())
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+	lns.stopccnOnIccn = &resultCode{
+		result:  avpStopCCNResultCodeGeneralError,
+		errCode: avpErrorCodeNoError,
+	}
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	downChan := make(chan *TunnelDownEvent, 10)
+	sessionUpChan := make(chan *SessionUpEvent, 10)
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		switch ev := event.(type) {
+		case *TunnelDownEvent:
+			downChan <- ev
+		case *SessionUpEvent:
+			sessionUpChan <- ev
+		}
+	}))
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "localhost:5000",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+		Persist:        true,
+		ReconnectMin:   reconnectDelay,
+		ReconnectMax:   reconnectDelay,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	_, err = tunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	lnsWg.Wait()
+
+	// The second LNS instance accepts the re-created tunnel and session
+	lns, err = newTestLNS(logger, lnsTunnelCfg(), lnsSessionCfg())
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+	lnsWg.Add(1)
+	go func() {
+		lns.run(5 * time.Second)
+		lnsWg.Done()
+	}()
+
+	select {
+	case ev := <-sessionUpChan:
+		if ev.Tunnel != tunl || ev.SessionName != "s1" {
+			t.Errorf("unexpected session up event %v/%v/%v", ev.TunnelName, ev.Tunnel, ev.SessionName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for session")
+	}
+
+	var downAt time.Time
+	select {
+	case ev := <-downChan:
+		downAt = time.Now()
+		var stopccnErr *StopCCNError
+		if ev.Tunnel != tunl || !errors.As(ev.Error, &stopccnErr) {
+			t.Fatalf("unexpected tunnel down event %v/%v", ev.Tunnel, ev.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for tunnel down event")
+	}
+
+	select {
+	case ev := <-sessionUpChan:
+		if elapsed := time.Since(downAt); elapsed < reconnectDelay/2 {
+			t.Errorf("tunnel re-created after %v, before backoff of at least %v", elapsed, reconnectDelay/2)
+		}
+		if ev.TunnelName != "t1" || ev.Tunnel == tunl || ev.SessionName != "s1" {
+			t.Errorf("unexpected session up event %v/%v/%v", ev.TunnelName, ev.Tunnel, ev.SessionName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for re-created session")
+	}
+
+	// Closing the context tears down the tunnel cleanly and prevents
+	// further reconnection
+	ctx.Close()
+	lnsWg.Wait()
+
+	if !lns.stopccnReceived {
+		t.Errorf("LNS didn't receive StopCCN")
+	}
+	if tunnels := ctx.ListTunnels(); len(tunnels) != 0 {
+		t.Errorf("expected no tunnels after context close, got %v", tunnels)
+	}
+	ctx.reconnectLock.Lock()
+	pending := len(ctx.reconnects)
+	ctx.reconnectLock.Unlock()
+	if pending != 0 {
+		t.Errorf("expected no pending reconnects after context close, got %v", pending)
+	}
+}
+
+func TestTunnelReconnectSetupFailure(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+
+	downChan := make(chan *TunnelDownEvent, 10)
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		if ev, ok := event.(*TunnelDownEvent); ok {
+			downChan <- ev
+		}
+	}))
+
+	// The peer never responds, so the tunnel fails to establish
+	_, err = ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:            "127.0.0.1:6100",
+		Peer:             "127.0.0.1:5100",
+		Version:          ProtocolVersion2,
+		Encap:            EncapTypeUDP,
+		StopCCNTimeout:   50 * time.Millisecond,
+		EstablishTimeout: 100 * time.Millisecond,
+		Persist:          true,
+		ReconnectMin:     20 * time.Millisecond,
+		ReconnectMax:     20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	select {
+	case <-downChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for tunnel down event")
+	}
+
+	// Take the tunnel's local address so that reconnect attempts fail
+	// to bind the tunnel socket
+	var conn net.PacketConn
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err = net.ListenPacket("udp4", "127.0.0.1:6100")
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failed to bind tunnel local address: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	defer conn.Close()
+
+	// Allow several reconnect attempts to fail
+	time.Sleep(200 * time.Millisecond)
+
+	closed := make(chan interface{})
+	go func() {
+		ctx.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for context close")
+	}
+
+	ctx.reconnectLock.Lock()
+	pending := len(ctx.reconnects)
+	ctx.reconnectLock.Unlock()
+	if pending != 0 {
+		t.Errorf("expected no pending reconnects after context close, got %v", pending)
+	}
+}
+
+func TestTunnelResolveInterval(t *testing.T) {
+	defer func(fn func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = fn }(lookupIPAddr)
+
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+	// The stub resolver returns the current address of the peer
+	var resolveLock sync.Mutex
+	peerIP := net.IPv4(127, 0, 0, 1)
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if host != "lns.example.com" {
+			return nil, fmt.Errorf("no such host %q", host)
+		}
+		resolveLock.Lock()
+		defer resolveLock.Unlock()
+		return []net.IPAddr{{IP: peerIP}}, nil
+	}
+
+	// Run an LNS at both the original and the new peer address
+	var lnsWg sync.WaitGroup
+	var lns []*testLNS
+	for _, local := range []string{"127.0.0.1:5000", "127.0.0.2:5000"} {
+		l, err := newTestLNS(logger,
+			&TunnelConfig{
+				Local:    local,
+				Peer:     "127.0.0.1:6000",
+				Version:  ProtocolVersion2,
+				TunnelID: 4567,
+				Encap:    EncapTypeUDP,
+			},
+			&SessionConfig{
+				Pseudowire: PseudowireTypePPP,
+				SessionID:  5566,
+			})
+		if err != nil {
+			t.Fatalf("newTestLNS: %v", err)
+		}
+		lns = append(lns, l)
+		lnsWg.Add(1)
+		go func() {
+			l.run(5 * time.Second)
+			lnsWg.Done()
+		}()
+	}
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	upChan := make(chan *TunnelUpEvent, 10)
+	downChan := make(chan *TunnelDownEvent, 10)
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		switch ev := event.(type) {
+		case *TunnelUpEvent:
+			upChan <- ev
+		case *TunnelDownEvent:
+			downChan <- ev
+		}
+	}))
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:           "127.0.0.1:6000",
+		Peer:            "lns.example.com:5000",
+		Version:         ProtocolVersion2,
+		Encap:           EncapTypeUDP,
+		StopCCNTimeout:  250 * time.Millisecond,
+		Persist:         true,
+		ReconnectMin:    20 * time.Millisecond,
+		ReconnectMax:    20 * time.Millisecond,
+		ResolveInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	select {
+	case ev := <-upChan:
+		if ev.Tunnel != tunl || sockaddrString(ev.PeerAddress) != "127.0.0.1:5000" {
+			t.Fatalf("unexpected tunnel up event %v/%v", ev.Tunnel, sockaddrString(ev.PeerAddress))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for tunnel up event")
+	}
+
+	// Move the peer: the tunnel should be torn down and re-created
+	// at the new address
+	resolveLock.Lock()
+	peerIP = net.IPv4(127, 0, 0, 2)
+	resolveLock.Unlock()
+
+	select {
+	case ev := <-downChan:
+		if ev.Tunnel != tunl || !errors.Is(ev.Error, ErrPeerAddressChanged) {
+			t.Fatalf("unexpected tunnel down event %v/%v", ev.Tunnel, ev.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for tunnel down event")
+	}
+
+	select {
+	case ev := <-upChan:
+		if ev.TunnelName != "t1" || ev.Tunnel == tunl || sockaddrString(ev.PeerAddress) != "127.0.0.2:5000" {
+			t.Fatalf("unexpected tunnel up event %v/%v/%v", ev.TunnelName, ev.Tunnel, sockaddrString(ev.PeerAddress))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for re-created tunnel")
+	}
+
+	ctx.Close()
+	lnsWg.Wait()
+
+	if !lns[0].stopccnReceived {
+		t.Errorf("original LNS didn't receive StopCCN")
+	}
+	if !lns[1].tunnelEstablished {
+		t.Errorf("tunnel not established with new LNS")
+	}
+}
+
+func TestTunnelDownEventError(t *testing.T) {
+	cases := []struct {
+		name        string
+		stopccn     *resultCode
+		expectErr   error
+		expectCodes [2]uint16
+	}{
+		{
+			name: "local close",
+		},
+		{
+			name: "peer clear connection",
+			stopccn: &resultCode{
+				result:  avpStopCCNResultCodeClearConnection,
+				errCode: avpErrorCodeNoError,
+			},
+			expectCodes: [2]uint16{1, 0},
+		},
+		{
+			name: "peer general error",
+			stopccn: &resultCode{
+				result:  avpStopCCNResultCodeGeneralError,
+				errCode: avpErrorCodeBadValue,
+				errMsg:  "test error",
+			},
+			expectErr: &StopCCNError{
+				ResultCode: 2,
+				ErrorCode:  3,
+				Message:    "test error",
+			},
+			expectCodes: [2]uint16{2, 3},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lns, err := newTestLNS(logger,
+				&TunnelConfig{
+					Local:    "localhost:5000",
+					Peer:     "127.0.0.1:6000",
+					Version:  ProtocolVersion2,
+					TunnelID: 4567,
+					Encap:    EncapTypeUDP,
+				},
+				nil)
+			if err != nil {
+				t.Fatalf("newTestLNS: %v", err)
+			}
+			lns.stopccnOnScccn = c.stopccn
+
+			var lnsWg sync.WaitGroup
+			lnsWg.Add(1)
+			go func() {
+				lns.run(3 * time.Second)
+				lnsWg.Done()
+			}()
+
+			ctx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			var closeWg sync.WaitGroup
+			evChan := make(chan *TunnelDownEvent, 1)
+			ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+				switch ev := event.(type) {
+				case *TunnelUpEvent:
+					if c.stopccn == nil {
+						closeWg.Add(1)
+						go func() {
+							ev.Tunnel.Close()
+							closeWg.Done()
+						}()
+					}
+				case *TunnelDownEvent:
+					evChan <- ev
+				}
+			}))
+
+			_, err = ctx.NewDynamicTunnel("t1", &TunnelConfig{
+				Local:          "127.0.0.1:6000",
+				Peer:           "localhost:5000",
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(): %v", err)
+			}
+
+			select {
+			case ev := <-evChan:
+				if !reflect.DeepEqual(ev.Error, c.expectErr) {
+					t.Errorf("expected error %v, got %v", c.expectErr, ev.Error)
+				}
+				if got := [2]uint16{ev.ResultCode, ev.ErrorCode}; got != c.expectCodes {
+					t.Errorf("expected result/error codes %v, got %v", c.expectCodes, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for tunnel down event")
+			}
+
+			closeWg.Wait()
+			lnsWg.Wait()
+		})
+	}
+}
+
+func TestWaitUp(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	t.Run("established", func(t *testing.T) {
+		lns, err := newTestLNS(logger,
+			&TunnelConfig{
+				Local:    "localhost:5000",
+				Peer:     "127.0.0.1:6000",
+				Version:  ProtocolVersion2,
+				TunnelID: 4567,
+				Encap:    EncapTypeUDP,
+			},
+			nil)
+		if err != nil {
+			t.Fatalf("newTestLNS: %v", err)
+		}
+
+		var lnsWg sync.WaitGroup
+		lnsWg.Add(1)
+		go func() {
+			lns.run(3 * time.Second)
+			lnsWg.Done()
+		}()
+
+		tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+			Local:          "127.0.0.1:6000",
+			Peer:           "localhost:5000",
+			Version:        ProtocolVersion2,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("NewDynamicTunnel(): %v", err)
+		}
+
+		waitCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = tunl.WaitUp(waitCtx)
+		if err != nil {
+			t.Errorf("WaitUp(): %v", err)
+		}
+
+		tunl.Close()
+		lnsWg.Wait()
+
+		if !lns.tunnelEstablished {
+			t.Errorf("LNS didn't establish the tunnel")
+		}
+
+		err = tunl.WaitUp(waitCtx)
+		if !errors.Is(err, ErrTunnelClosed) {
+			t.Errorf("WaitUp() after close: expected %v, got %v", ErrTunnelClosed, err)
+		}
+	})
+
+	t.Run("establish timeout", func(t *testing.T) {
+		// The black hole peer receives control messages but never responds
+		peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5996})
+		if err != nil {
+			t.Fatalf("ListenUDP(): %v", err)
+		}
+		defer peer.Close()
+
+		tunl, err := ctx.NewDynamicTunnel("t2", &TunnelConfig{
+			Local:            "127.0.0.1:0",
+			Peer:             "127.0.0.1:5996",
+			Version:          ProtocolVersion2,
+			Encap:            EncapTypeUDP,
+			EstablishTimeout: 200 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("NewDynamicTunnel(): %v", err)
+		}
+		defer tunl.Close()
+
+		// A context done before the tunnel is established
+		waitCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err = tunl.WaitUp(waitCtx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("WaitUp() with expired context: expected %v, got %v", context.DeadlineExceeded, err)
+		}
+
+		err = tunl.WaitUp(context.Background())
+		if !errors.Is(err, ErrTunnelEstablishTimeout) {
+			t.Errorf("WaitUp(): expected %v, got %v", ErrTunnelEstablishTimeout, err)
+		}
+	})
+}
+
+func TestTunnelHealth(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	t.Run("dynamic", func(t *testing.T) {
+		lns, err := newTestLNS(logger,
+			&TunnelConfig{
+				Local:    "localhost:5000",
+				Peer:     "127.0.0.1:6000",
+				Version:  ProtocolVersion2,
+				TunnelID: 4567,
+				Encap:    EncapTypeUDP,
+			},
+			nil)
+		if err != nil {
+			t.Fatalf("newTestLNS: %v", err)
+		}
+
+		var lnsWg sync.WaitGroup
+		lnsWg.Add(1)
+		go func() {
+			lns.run(3 * time.Second)
+			lnsWg.Done()
+		}()
+
+		tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+			Local:          "127.0.0.1:6000",
+			Peer:           "localhost:5000",
+			Version:        ProtocolVersion2,
+			Encap:          EncapTypeUDP,
+			HelloTimeout:   time.Second,
+			StopCCNTimeout: 250 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("NewDynamicTunnel(): %v", err)
+		}
+
+		waitCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = tunl.WaitUp(waitCtx)
+		if err != nil {
+			t.Fatalf("WaitUp(): %v", err)
+		}
+
+		// The LNS acks the SCCCN, completing a round trip
+		h := tunl.Health()
+		for i := 0; i < 100 && h.LastRoundTrip.IsZero(); i++ {
+			time.Sleep(10 * time.Millisecond)
+			h = tunl.Health()
+		}
+		if h.State != TunnelHealthUp {
+			t.Errorf("expected %v once established, got %v", TunnelHealthUp, h.State)
+		}
+		if h.LastRoundTrip.IsZero() {
+			t.Errorf("expected a round trip once established")
+		}
+
+		tunl.Close()
+		lnsWg.Wait()
+
+		if got := tunl.Health().State; got != TunnelHealthDown {
+			t.Errorf("expected %v after close, got %v", TunnelHealthDown, got)
+		}
+	})
+
+	t.Run("establishing", func(t *testing.T) {
+		// The black hole peer receives control messages but never responds
+		peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5996})
+		if err != nil {
+			t.Fatalf("ListenUDP(): %v", err)
+		}
+		defer peer.Close()
+
+		tunl, err := ctx.NewDynamicTunnel("t2", &TunnelConfig{
+			Local:          "127.0.0.1:0",
+			Peer:           "127.0.0.1:5996",
+			Version:        ProtocolVersion2,
+			Encap:          EncapTypeUDP,
+			RetryTimeout:   50 * time.Millisecond,
+			StopCCNTimeout: 250 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("NewDynamicTunnel(): %v", err)
+		}
+
+		h := tunl.Health()
+		if h.State != TunnelHealthEstablishing {
+			t.Errorf("expected %v, got %v", TunnelHealthEstablishing, h.State)
+		}
+		if !h.LastRoundTrip.IsZero() {
+			t.Errorf("expected no round trip, got %v", h.LastRoundTrip)
+		}
+
+		tunl.Close()
+		if got := tunl.Health().State; got != TunnelHealthDown {
+			t.Errorf("expected %v after close, got %v", TunnelHealthDown, got)
+		}
+	})
+
+	t.Run("static", func(t *testing.T) {
+		tunl, err := ctx.NewStaticTunnel("t3", &TunnelConfig{
+			Local:        "127.0.0.1:6000",
+			Peer:         "127.0.0.1:5000",
+			Version:      ProtocolVersion3,
+			TunnelID:     1,
+			PeerTunnelID: 10,
+			Encap:        EncapTypeUDP,
+		})
+		if err != nil {
+			t.Fatalf("NewStaticTunnel(): %v", err)
+		}
+		defer tunl.Close()
+
+		if got := tunl.Health().State; got != TunnelHealthUp {
+			t.Errorf("expected %v, got %v", TunnelHealthUp, got)
+		}
+	})
+}
+
+func TestCallSerialAllocation(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:          "localhost:5000",
+			Peer:           "127.0.0.1:6000",
+			Version:        ProtocolVersion2,
+			TunnelID:       4567,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		},
+		&SessionConfig{
+			Pseudowire: PseudowireTypePPP,
+			SessionID:  5566,
+		})
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	// The first value seeds the context's call serial number
+	src := &testRandSource{values: []uint32{41}}
+	ctx, err := NewContextWithOptions(nil, logger, WithRand(rand.New(src)))
+	if err != nil {
+		t.Fatalf("NewContextWithOptions(): %v", err)
+	}
+	defer ctx.Close()
+
+	upChan := make(chan *SessionUpEvent, 1)
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		if ev, ok := event.(*SessionUpEvent); ok {
+			upChan <- ev
+		}
+	}))
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "localhost:5000",
+		Version:        ProtocolVersion2,
+		TunnelID:       100,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		_, err = tunl.NewSession(fmt.Sprintf("s%d", i), &SessionConfig{
+			SessionID:  ControlConnID(i),
+			Pseudowire: PseudowireTypePPP,
+		})
+		if err != nil {
+			t.Fatalf("NewSession(): %v", err)
+		}
+		select {
+		case <-upChan:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for session up event")
+		}
+	}
+
+	ctx.Close()
+	lnsWg.Wait()
+
+	// Each session must be allocated a distinct call serial number
+	expect := []uint32{42, 43, 44}
+	if !reflect.DeepEqual(lns.callSerials, expect) {
+		t.Errorf("expected ICRQ call serial numbers %v, got %v", expect, lns.callSerials)
+	}
+}
+
+func TestDynamicDataPlaneHooks(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:          "localhost:5000",
+			Peer:           "127.0.0.1:6000",
+			Version:        ProtocolVersion2,
+			TunnelID:       4567,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		},
+		&SessionConfig{
+			Pseudowire: PseudowireTypePPP,
+			SessionID:  5566,
+		})
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	hr := &testHookRecorder{dp: NewMockDataPlane()}
+	ctx, err := NewContextWithOptions(hr.dp, logger, WithDataPlaneHooks(hr.hooks(true)))
+	if err != nil {
+		t.Fatalf("NewContextWithOptions(): %v", err)
+	}
+	defer ctx.Close()
+
+	upChan := make(chan *SessionUpEvent, 1)
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		if ev, ok := event.(*SessionUpEvent); ok {
+			upChan <- ev
+		}
+	}))
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "localhost:5000",
+		Version:        ProtocolVersion2,
+		TunnelID:       100,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	_, err = tunl.NewSession("s1", &SessionConfig{
+		SessionID:  1,
+		Pseudowire: PseudowireTypePPP,
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	select {
+	case <-upChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for session up event")
+	}
+
+	ctx.Close()
+	lnsWg.Wait()
+
+	// Hooks are passed the IDs negotiated with the peer
+	expect := []string{
+		"PreDataPlaneUp t1 100/4567",
+		"NewTunnel",
+		"PostDataPlaneUp t1 100/4567",
+		"PreDataPlaneUp t1/s1 100/4567 1/5566",
+		"NewSession",
+		"PostDataPlaneUp t1/s1 100/4567 1/5566",
+		"PreDataPlaneDown t1/s1 100/4567 1/5566",
+		"SessionDown",
+		"PreDataPlaneDown t1 100/4567",
+		"TunnelDown",
+		"Close",
+	}
+	if got := hr.getTrace(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected hook and data plane calls %q, got %q", expect, got)
+	}
+}
+
+func TestPassiveTunnel(t *testing.T) {
+	cases := []struct {
+		name    string
+		version ProtocolVersion
+	}{
+		{name: "L2TPv2", version: ProtocolVersion2},
+		{name: "L2TPv3", version: ProtocolVersion3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+			ctx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			upChan := make(chan *TunnelUpEvent, 10)
+			downChan := make(chan *TunnelDownEvent, 10)
+			ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+				switch ev := event.(type) {
+				case *TunnelUpEvent:
+					upChan <- ev
+				case *TunnelDownEvent:
+					downChan <- ev
+				}
+			}))
+
+			passive, err := ctx.NewPassiveTunnel("lns", &TunnelConfig{
+				Local:          "127.0.0.1:5000",
+				Peer:           "127.0.0.1:6000",
+				Version:        c.version,
+				TunnelID:       4567,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("NewPassiveTunnel(): %v", err)
+			}
+
+			active, err := ctx.NewDynamicTunnel("lac", &TunnelConfig{
+				Local:          "127.0.0.1:6000",
+				Peer:           "127.0.0.1:5000",
+				Version:        c.version,
+				TunnelID:       1234,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(): %v", err)
+			}
+
+			up := map[Tunnel]*TunnelUpEvent{}
+			for len(up) < 2 {
+				select {
+				case ev := <-upChan:
+					up[ev.Tunnel] = ev
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out waiting for tunnel up events")
+				}
+			}
+
+			if got := up[passive].Config.PeerTunnelID; got != 1234 {
+				t.Errorf("passive tunnel peer tunnel ID: got %v, want 1234", got)
+			}
+			if got := up[active].Config.PeerTunnelID; got != 4567 {
+				t.Errorf("active tunnel peer tunnel ID: got %v, want 4567", got)
+			}
+
+			// Closing the passive tunnel should tear down the active tunnel
+			passive.Close()
+
+			for activeDown := false; !activeDown; {
+				select {
+				case ev := <-downChan:
+					activeDown = ev.Tunnel == active
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out waiting for active tunnel down event")
+				}
+			}
+			active.Close()
+		})
+	}
+}
+
+func TestPassiveTunnelIncomingCall(t *testing.T) {
+	proxyLCP := &ProxyLCP{
+		InitialRcvdConfreq: []byte{0x01, 0x04, 0x05, 0xdc},
+		LastSentConfreq:    []byte{0x03, 0x05, 0xc2, 0x23, 0x05},
+		LastRcvdConfreq:    []byte{0x01, 0x04, 0x05, 0xdc},
+		AuthType:           ProxyAuthTypeCHAP,
+		AuthName:           "alice",
+		AuthChallenge:      []byte{0xde, 0xad, 0xbe, 0xef},
+		AuthID:             7,
+		AuthResponse:       []byte{0x01, 0x02, 0x03, 0x04},
+	}
+	cases := []struct {
+		name     string
+		version  ProtocolVersion
+		scfg     *SessionConfig
+		wantPw   PseudowireType
+		wantLCP  *ProxyLCP
+		wantTxCS uint32
+	}{
+		{
+			name:    "L2TPv2",
+			version: ProtocolVersion2,
+			scfg: &SessionConfig{
+				Pseudowire:     PseudowireTypePPP,
+				TxConnectSpeed: 100000000,
+				ProxyLCP:       proxyLCP,
+			},
+			wantPw:   PseudowireTypePPP,
+			wantLCP:  proxyLCP,
+			wantTxCS: 100000000,
+		},
+		{
+			name:    "L2TPv3",
+			version: ProtocolVersion3,
+			scfg: &SessionConfig{
+				Pseudowire: PseudowireTypeEth,
+				Cookie:     []byte{0x01, 0x02, 0x03, 0x04},
+			},
+			wantPw: PseudowireTypeEth,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			newCtx := func() (*Context, chan *SessionUpEvent) {
+				ctx, err := NewContext(NewMockDataPlane(), nil)
+				if err != nil {
+					t.Fatalf("NewContext(): %v", err)
+				}
+				upChan := make(chan *SessionUpEvent, 10)
+				ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+					if ev, ok := event.(*SessionUpEvent); ok {
+						upChan <- ev
+					}
+				}))
+				return ctx, upChan
+			}
+
+			lnsCtx, lnsUp := newCtx()
+			defer lnsCtx.Close()
+			lacCtx, lacUp := newCtx()
+			defer lacCtx.Close()
+
+			_, err := lnsCtx.NewPassiveTunnel("lns", &TunnelConfig{
+				Local:          "127.0.0.1:5020",
+				Peer:           "127.0.0.1:6020",
+				Version:        c.version,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				MaxSessions:    1,
+			})
+			if err != nil {
+				t.Fatalf("NewPassiveTunnel(): %v", err)
+			}
+
+			lac, err := lacCtx.NewDynamicTunnel("lac", &TunnelConfig{
+				Local:          "127.0.0.1:6020",
+				Peer:           "127.0.0.1:5020",
+				Version:        c.version,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(): %v", err)
+			}
+
+			_, err = lac.NewSession("s1", c.scfg)
+			if err != nil {
+				t.Fatalf("NewSession(s1): %v", err)
+			}
+
+			var lacEv, lnsEv *SessionUpEvent
+			for lacEv == nil || lnsEv == nil {
+				select {
+				case lacEv = <-lacUp:
+				case lnsEv = <-lnsUp:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out waiting for session up events")
+				}
+			}
+
+			if lnsEv.SessionName != fmt.Sprintf("session%v", lnsEv.SessionConfig.SessionID) {
+				t.Errorf("answered session name: got %q", lnsEv.SessionName)
+			}
+			if lnsEv.SessionConfig.PeerSessionID != lacEv.SessionConfig.SessionID {
+				t.Errorf("answered session peer session ID: got %v, want %v",
+					lnsEv.SessionConfig.PeerSessionID, lacEv.SessionConfig.SessionID)
+			}
+			if lacEv.SessionConfig.PeerSessionID != lnsEv.SessionConfig.SessionID {
+				t.Errorf("calling session peer session ID: got %v, want %v",
+					lacEv.SessionConfig.PeerSessionID, lnsEv.SessionConfig.SessionID)
+			}
+			if lnsEv.SessionConfig.Pseudowire != c.wantPw {
+				t.Errorf("answered session pseudowire: got %v, want %v", lnsEv.SessionConfig.Pseudowire, c.wantPw)
+			}
+			if !reflect.DeepEqual(lnsEv.SessionConfig.PeerCookie, c.scfg.Cookie) {
+				t.Errorf("answered session peer cookie: got %v, want %v", lnsEv.SessionConfig.PeerCookie, c.scfg.Cookie)
+			}
+			if !reflect.DeepEqual(lnsEv.ProxyLCP, c.wantLCP) {
+				t.Errorf("proxy LCP: got %+v, want %+v", lnsEv.ProxyLCP, c.wantLCP)
+			}
+			if lnsEv.PeerTxConnectSpeed != c.wantTxCS {
+				t.Errorf("peer tx connect speed: got %v, want %v", lnsEv.PeerTxConnectSpeed, c.wantTxCS)
+			}
+
+			// The LNS refuses calls beyond its session limit
+			s2, err := lac.NewSession("s2", c.scfg)
+			if err != nil {
+				t.Fatalf("NewSession(s2): %v", err)
+			}
+			ds := s2.(*dynamicSession)
+			closed := make(chan interface{})
+			go func() {
+				ds.wg.Wait()
+				close(closed)
+			}()
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("session s2 wasn't refused")
+			}
+			if !strings.Contains(ds.result, "temporary lack of resources") {
+				t.Errorf("session s2: expected refusal for lack of resources, got %q", ds.result)
+			}
+			select {
+			case ev := <-lnsUp:
+				t.Errorf("unexpected session up event for %v", ev.SessionName)
+			default:
+			}
+		})
+	}
+}
+
+func TestTunnelListener(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+
+	lnsUp := make(chan *TunnelUpEvent, 10)
+	lnsCtx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		if ev, ok := event.(*TunnelUpEvent); ok {
+			lnsUp <- ev
+		}
+	}))
+
+	l, err := lnsCtx.NewTunnelListener("lns", &TunnelConfig{
+		Local:          "127.0.0.1:5000",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewTunnelListener(): %v", err)
+	}
+	defer l.Close()
+
+	// Each client runs in its own Context, and all use the same
+	// tunnel ID, so the listener must demultiplex by peer address.
+	clientUp := make(chan *TunnelUpEvent, 10)
+	clients := []string{"127.0.0.1:6000", "127.0.0.1:6001", "127.0.0.1:6002"}
+	for i, local := range clients {
+		ctx, err := NewContext(nil, logger)
+		if err != nil {
+			t.Fatalf("NewContext(): %v", err)
+		}
+		defer ctx.Close()
+
+		ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+			if ev, ok := event.(*TunnelUpEvent); ok {
+				clientUp <- ev
+			}
+		}))
+
+		_, err = ctx.NewDynamicTunnel(fmt.Sprintf("lac%d", i), &TunnelConfig{
+			Local:          local,
+			Peer:           l.Addr(),
+			Version:        ProtocolVersion2,
+			TunnelID:       1234,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("NewDynamicTunnel(): %v", err)
+		}
+	}
+
+	accepted := map[string]Tunnel{}
+	for len(accepted) < len(clients) {
+		tunl, err := l.Accept()
+		if err != nil {
+			t.Fatalf("Accept(): %v", err)
+		}
+		accepted[tunl.(*dynamicTunnel).getName()] = tunl
+	}
+	for _, local := range clients {
+		if _, ok := accepted["lns/"+local]; !ok {
+			t.Errorf("no tunnel accepted for client %v", local)
+		}
+	}
+
+	tids := map[ControlConnID]bool{}
+	for i := 0; i < len(clients); i++ {
+		select {
+		case ev := <-lnsUp:
+			if ev.Config.PeerTunnelID != 1234 {
+				t.Errorf("tunnel %v: got peer tunnel ID %v, want 1234", ev.TunnelName, ev.Config.PeerTunnelID)
+			}
+			if tids[ev.Config.TunnelID] {
+				t.Errorf("tunnel %v: duplicate tunnel ID %v", ev.TunnelName, ev.Config.TunnelID)
+			}
+			tids[ev.Config.TunnelID] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for LNS tunnel up events")
+		}
+	}
+
+	for i := 0; i < len(clients); i++ {
+		select {
+		case ev := <-clientUp:
+			if !tids[ev.Config.PeerTunnelID] {
+				t.Errorf("tunnel %v: unexpected peer tunnel ID %v", ev.TunnelName, ev.Config.PeerTunnelID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for client tunnel up events")
+		}
+	}
+
+	l.Close()
+	if _, err := l.Accept(); !errors.Is(err, ErrListenerClosed) {
+		t.Errorf("Accept() after Close(): got %v, want %v", err, ErrListenerClosed)
+	}
+}
@@ -1,17 +1,19 @@
 package l2tp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
-	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"golang.org/x/sys/unix"
 )
 
 type sendMsg struct {
 	msg          controlMessage
+	raw          bool
 	completeChan chan error
 }
 
@@ -25,16 +27,106 @@ type dynamicTunnel struct {
 	closingLock sync.Mutex
 	isClosing   bool
 	established bool
+	estTimer    *time.Timer
+	downErr     error
+	peerResult  *resultCode
+	sentStopccn bool
+	persist     *tunnelPersistence
+	passive     bool
 	sal, sap    unix.Sockaddr
 	cp          *controlPlane
 	xport       *transport
 	dp          TunnelDataPlane
+	dpLock      sync.Mutex
 	closeChan   chan bool
+	closeResult *resultCode
+	doneChan    chan bool
+	upChan      chan bool
 	sendChan    chan *sendMsg
 	eventChan   chan *eventArgs
+	movedChan   chan unix.Sockaddr
 	wg          sync.WaitGroup
 	sessionTxWg sync.WaitGroup
 	fsm         fsm
+	peerVendor  []VendorAVP
+	peerPwCaps  []PseudowireType
+}
+
+func (dt *dynamicTunnel) SetDebugFlags(flags DebugFlags) error {
+	dt.dpLock.Lock()
+	defer dt.dpLock.Unlock()
+	if dt.dp == nil {
+		return fmt.Errorf("tunnel data plane not established")
+	}
+	err := setTunnelDataPlaneDebugFlags(dt.dp, flags)
+	if err != nil {
+		return err
+	}
+	dt.cfg.DebugFlags = flags
+	return nil
+}
+
+func (dt *dynamicTunnel) PathMTU() (int, error) {
+	dt.dpLock.Lock()
+	defer dt.dpLock.Unlock()
+	if dt.dp == nil {
+		return 0, fmt.Errorf("tunnel data plane not established")
+	}
+	return dt.cp.pathMTU()
+}
+
+func (dt *dynamicTunnel) getLocalAddress() unix.Sockaddr {
+	return dt.sal
+}
+
+func (dt *dynamicTunnel) WaitUp(ctx context.Context) error {
+	select {
+	case <-dt.upChan:
+	case <-dt.doneChan:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	// The tunnel may have gone down again since it came up.
+	// The tunnel goroutine has exited once doneChan is closed, so
+	// downErr may be read safely.
+	select {
+	case <-dt.doneChan:
+		if dt.downErr != nil {
+			return dt.downErr
+		}
+		return ErrTunnelClosed
+	default:
+		return nil
+	}
+}
+
+func (dt *dynamicTunnel) Health() TunnelHealth {
+	h := dt.xport.health(time.Now())
+	if h.State == TunnelHealthDown {
+		return h
+	}
+
+	dt.closingLock.Lock()
+	isClosing := dt.isClosing
+	dt.closingLock.Unlock()
+	if isClosing {
+		h.State = TunnelHealthDown
+		return h
+	}
+
+	select {
+	case <-dt.upChan:
+	default:
+		h.State = TunnelHealthEstablishing
+	}
+	return h
+}
+
+func (dt *dynamicTunnel) Statistics() TunnelStatistics {
+	return TunnelStatistics{
+		Data:               dt.dataStatistics(),
+		ControlRetransmits: dt.xport.getRetransmits(),
+	}
 }
 
 func (dt *dynamicTunnel) NewSession(name string, cfg *SessionConfig) (sess Session, err error) {
@@ -44,9 +136,23 @@ func (dt *dynamicTunnel) NewSession(name string, cfg *SessionConfig) (sess Sessi
 		return nil, fmt.Errorf("invalid nil config")
 	}
 
+	// Must have a valid configuration: the session IDs may be
+	// assigned dynamically so needn't be specified
+	err = validateSessionConfig(dt.cfg, cfg, false)
+	if err != nil {
+		return nil, err
+	}
+
+	dt.parent.waitCreate()
+
 	// Name clashes are not allowed
 	if _, ok := dt.findSessionByName(name); ok {
-		return nil, fmt.Errorf("already have session %q", name)
+		return nil, fmt.Errorf("%w %q", ErrSessionNameExists, name)
+	}
+
+	// Only incoming calls are implemented for L2TPv3
+	if dt.cfg.Version == ProtocolVersion3 && cfg.CallDirection == CallDirectionOutgoing {
+		return nil, fmt.Errorf("%w: outgoing calls are not supported for L2TPv3 tunnels", ErrInvalidSessionConfig)
 	}
 
 	dt.closingLock.Lock()
@@ -56,42 +162,109 @@ func (dt *dynamicTunnel) NewSession(name string, cfg *SessionConfig) (sess Sessi
 	}
 	dt.closingLock.Unlock()
 
+	// Once the tunnel is up the peer's pseudowire capabilities are
+	// known, and are not modified further
+	select {
+	case <-dt.upChan:
+		if !dt.peerSupportsPseudowire(cfg.Pseudowire) {
+			return nil, fmt.Errorf("%w: peer does not support pseudowire type %v",
+				ErrInvalidSessionConfig, cfg.Pseudowire)
+		}
+	default:
+	}
+
 	// Duplicate the configuration so we don't modify the user's copy
 	myCfg := *cfg
 
 	// If the session ID in the config is unset, we must generate one.
-	// If the session ID is set, we must check for collisions.
-	// TODO: there is a potential race here if sessions are concurrently
-	// added -- an ID assigned here isn't actually reserved until the linkSession
-	// call.
-	if myCfg.SessionID != 0 {
-		// Must not have session ID clashes
-		if _, ok := dt.findSessionByID(myCfg.SessionID); ok {
-			return nil, fmt.Errorf("already have session with SID %q", myCfg.SessionID)
-		}
-	} else {
-		myCfg.SessionID, err = dt.allocSid()
-		if err != nil {
-			return nil, fmt.Errorf("failed to allocate a SID: %q", err)
-		}
+	// If the session ID is set, we must check for collisions.  Either
+	// way the ID is reserved until the tunnel goroutine links the session,
+	// and counts towards the tunnel's session limit.
+	myCfg.SessionID, err = dt.reserveSid(myCfg.SessionID)
+	if err != nil {
+		return nil, err
 	}
+	defer dt.releaseSidOnError(myCfg.SessionID, &err)
 
 	s, err := newDynamicSession(dt.parent.allocCallSerial(), name, dt, &myCfg)
 	if err != nil {
 		return nil, err
 	}
 
-	dt.injectEvent("newsession", s)
+	// Record the session before handing it to the tunnel, since
+	// handling of the event is delayed while the tunnel is establishing
+	if dt.persist != nil {
+		userCfg := *cfg
+		dt.persist.recordSession(name, &userCfg)
+	}
+
+	// The tunnel may have gone down since we checked isClosing
+	err = dt.injectEvent("newsession", s)
+	if err != nil {
+		close(s.killChan)
+		s.wg.Wait()
+		return nil, err
+	}
 	sess = s
 
 	return
 }
 
 func (dt *dynamicTunnel) Close() {
+	dt.close(&resultCode{result: avpStopCCNResultCodeClearConnection})
+}
+
+func (dt *dynamicTunnel) CloseWithResult(result, errCode uint16, msg string) error {
+	if err := validateStopCCNResult(result, errCode); err != nil {
+		return err
+	}
+	dt.close(&resultCode{
+		result:  avpResultCode(result),
+		errCode: avpErrorCode(errCode),
+		errMsg:  msg,
+	})
+	return nil
+}
+
+func (dt *dynamicTunnel) close(rc *resultCode) {
 	if dt != nil {
 		dt.parent.unlinkTunnel(dt)
+		// closeResult is read by the tunnel goroutine once closeChan
+		// is closed
+		dt.closeResult = rc
 		close(dt.closeChan)
 		dt.wg.Wait()
+		// The tunnel may have failed before it was closed
+		if dt.persist != nil {
+			dt.parent.cancelReconnect(dt)
+		}
+	}
+}
+
+// kill forcibly tears down the tunnel data plane without waiting for the
+// control protocol exchange with the peer to complete.  Aborting the
+// transport causes the tunnel goroutine to close the tunnel.
+func (dt *dynamicTunnel) kill() {
+	if dt.xport != nil {
+		dt.xport.abort(ErrTunnelKilled)
+	}
+	dt.downDataPlane()
+}
+
+// downDataPlane tears down the tunnel data plane, unless it has already
+// been torn down.
+func (dt *dynamicTunnel) downDataPlane() {
+	dt.dpLock.Lock()
+	dp := dt.dp
+	dt.dp = nil
+	dt.dpLock.Unlock()
+
+	if dp != nil {
+		dt.parent.preTunnelDown(dt)
+		err := dp.Down()
+		if err != nil {
+			level.Error(dt.logger).Log("message", "dataplane down failed", "error", err)
+		}
 	}
 }
 
@@ -133,23 +306,63 @@ func (dt *dynamicTunnel) sendMessage(msg controlMessage) error {
 	return <-sm.completeChan
 }
 
+func (dt *dynamicTunnel) WriteControlMessage(msg *RawControlMessage) error {
+	if !dt.parent.unsafeCtlMsgs {
+		return fmt.Errorf("unsafe control messages are not enabled")
+	}
+
+	dt.closingLock.Lock()
+	isClosing := dt.isClosing
+	dt.closingLock.Unlock()
+	if isClosing {
+		return fmt.Errorf("tunnel is closing")
+	}
+
+	m, err := newRawControlMessage(dt.cfg.Version, dt.cfg.PeerTunnelID, msg)
+	if err != nil {
+		return err
+	}
+
+	sm := &sendMsg{
+		msg:          m,
+		raw:          true,
+		completeChan: make(chan error),
+	}
+	dt.sendChan <- sm
+	return <-sm.completeChan
+}
+
 func (dt *dynamicTunnel) runTunnel() {
 	defer dt.wg.Done()
+	defer close(dt.doneChan)
 
 	level.Info(dt.logger).Log(
 		"message", "new dynamic tunnel",
-		"version", dt.cfg.Version,
 		"encap", dt.cfg.Encap,
 		"local", dt.cfg.Local,
 		"peer", dt.cfg.Peer,
-		"tunnel_id", dt.cfg.TunnelID,
 		"peer_tunnel_id", dt.cfg.PeerTunnelID)
 
+	// Since the tunnel blocks pending acknowledgement of control
+	// messages, the establishment timeout aborts the transport rather
+	// than being handled by the event loop.  Aborting the transport
+	// fails any pending transmission and closes the receive channel,
+	// either of which causes the tunnel to close.
+	if dt.cfg.EstablishTimeout > 0 {
+		dt.estTimer = time.AfterFunc(dt.cfg.EstablishTimeout, func() {
+			level.Error(dt.logger).Log(
+				"message", "tunnel establishment timed out",
+				"timeout", dt.cfg.EstablishTimeout)
+			dt.xport.abort(ErrTunnelEstablishTimeout)
+		})
+	}
+
 	dt.handleEvent("open")
 	for {
 		select {
 		case <-dt.closeChan:
-			dt.handleEvent("close", avpStopCCNResultCodeClearConnection)
+			rc := dt.closeResult
+			dt.handleEvent("close", rc.result, rc.errCode, rc.errMsg)
 			return
 		case m, ok := <-dt.xport.recvChan:
 			if !ok {
@@ -163,6 +376,16 @@ func (dt *dynamicTunnel) runTunnel() {
 				return
 			}
 			dt.handleEvent(ea.event, ea.args...)
+		case sap := <-dt.movedChan:
+			level.Info(dt.logger).Log(
+				"message", "peer address changed",
+				"peer_address", sockaddrString(dt.sap),
+				"new_peer_address", sockaddrString(sap))
+			dt.downErr = ErrPeerAddressChanged
+			dt.handleEvent("close",
+				avpStopCCNResultCodeGeneralError,
+				avpErrorCodeNoError,
+				"peer address changed")
 		case sm, ok := <-dt.sendChan:
 			if !ok {
 				dt.fsmActClose(nil)
@@ -171,13 +394,50 @@ func (dt *dynamicTunnel) runTunnel() {
 			dt.sessionTxWg.Add(1)
 			go func() {
 				defer dt.sessionTxWg.Done()
-				err := dt.xport.send(sm.msg)
+				var err error
+				if sm.raw {
+					err = dt.xport.sendRaw(sm.msg)
+				} else {
+					err = dt.xport.send(sm.msg)
+				}
 				sm.completeChan <- err
 			}()
 		}
 	}
 }
 
+// runResolver periodically re-resolves the peer address, and notifies
+// the tunnel goroutine if the address has changed.
+func (dt *dynamicTunnel) runResolver() {
+	defer dt.wg.Done()
+
+	ticker := time.NewTicker(dt.cfg.ResolveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dt.doneChan:
+			return
+		case <-ticker.C:
+			sap, err := resolvePeerAddress(dt.cfg)
+			if err != nil {
+				level.Warn(dt.logger).Log(
+					"message", "failed to re-resolve peer address",
+					"error", err)
+				continue
+			}
+			if sockaddrString(sap) == sockaddrString(dt.sap) {
+				continue
+			}
+			select {
+			case dt.movedChan <- sap:
+			case <-dt.doneChan:
+			}
+			return
+		}
+	}
+}
+
 func (dt *dynamicTunnel) handleEvent(ev string, args ...interface{}) {
 	if ev != "" {
 		level.Debug(dt.logger).Log(
@@ -194,22 +454,27 @@ func (dt *dynamicTunnel) handleEvent(ev string, args ...interface{}) {
 	}
 }
 
-func (dt *dynamicTunnel) injectEvent(ev string, args ...interface{}) {
+func (dt *dynamicTunnel) injectEvent(ev string, args ...interface{}) error {
 	ea := eventArgs{event: ev}
 	for i := 0; i < len(args); i++ {
 		ea.args = append(ea.args, args[i])
 	}
-	dt.eventChan <- &ea
+	select {
+	case dt.eventChan <- &ea:
+		return nil
+	case <-dt.doneChan:
+		return fmt.Errorf("tunnel is closing")
+	}
 }
 
 // panics if expected arguments are not passed
-func fsmArgsToV2MsgFrom(args []interface{}) (msg *v2ControlMessage, from unix.Sockaddr) {
+func fsmArgsToMsgFrom(args []interface{}) (msg controlMessage, from unix.Sockaddr) {
 	if len(args) != 2 {
 		panic(fmt.Sprintf("unexpected argument count (wanted 2, got %v)", len(args)))
 	}
-	msg, ok := args[0].(*v2ControlMessage)
+	msg, ok := args[0].(controlMessage)
 	if !ok {
-		panic(fmt.Sprintf("first argument %T not *v2ControlMessage", args[0]))
+		panic(fmt.Sprintf("first argument %T not controlMessage", args[0]))
 	}
 	from, ok = args[1].(unix.Sockaddr)
 	if !ok {
@@ -251,6 +516,67 @@ func fsmArgsToStopccnResult(args []interface{}) *resultCode {
 	return &rc
 }
 
+// errorCodeToString describes the error codes used in the Result Code
+// AVP of StopCCN and CDN messages.
+func errorCodeToString(code avpErrorCode) string {
+	switch code {
+	case avpErrorCodeNoError:
+		return "no general error"
+	case avpErrorCodeNoControlConnection:
+		return "no control connection exists yet"
+	case avpErrorCodeBadLength:
+		return "length is wrong"
+	case avpErrorCodeBadValue:
+		return "field out of range or reserved field was non-zero"
+	case avpErrorCodeNoResource:
+		return "insufficient resources to handle this operation now"
+	case avpErrorCodeInvalidSessionID:
+		return "session ID invalid in this context"
+	case avpErrorCodeVendorSpecificError:
+		return "generic vendor-specific error"
+	case avpErrorCodeTryAnother:
+		return "try another LNS"
+	case avpErrorCodeMBitShutdown:
+		return "shut down due to unknown AVP with the M bit set"
+	}
+	return ""
+}
+
+// stopccnResultCodeToString describes the result code of a StopCCN message.
+func stopccnResultCodeToString(rc *resultCode) string {
+	var resStr, errMsg string
+
+	switch rc.result {
+	case avpStopCCNResultCodeReserved:
+		resStr = "reserved"
+	case avpStopCCNResultCodeClearConnection:
+		resStr = "general request to clear control connection"
+	case avpStopCCNResultCodeGeneralError:
+		resStr = "general error"
+	case avpStopCCNResultCodeChannelExists:
+		resStr = "control channel already exists"
+	case avpStopCCNResultCodeChannelNotAuthorized:
+		resStr = "requester is not authorized to establish a control channel"
+	case avpStopCCNResultCodeChannelProtocolVersionUnsupported:
+		resStr = "protocol version not supported"
+	case avpStopCCNResultCodeChannelShuttingDown:
+		resStr = "requester is being shut down"
+	case avpStopCCNResultCodeChannelFSMError:
+		resStr = "finite state machine error"
+	}
+
+	if rc.errMsg != "" {
+		errMsg = rc.errMsg
+	} else {
+		errMsg = "unset"
+	}
+
+	return fmt.Sprintf("result %d (%s), error %d (%s), message '%s'",
+		rc.result, resStr,
+		rc.errCode, errorCodeToString(rc.errCode),
+		errMsg)
+}
+
 func (dt *dynamicTunnel) handleMsg(m *recvMsg) {
 
 	// Initial validation: ignore a message with the wrong protocol version
@@ -276,15 +602,26 @@ func (dt *dynamicTunnel) handleMsg(m *recvMsg) {
 		}
 		dt.handleV2Msg(msg, m.from)
 		return
+	case ProtocolVersion3:
+		msg, ok := m.msg.(*v3ControlMessage)
+		if !ok {
+			// As above, this indicates a coding error
+			level.Error(dt.logger).Log(
+				"message", "couldn't cast L2TPv3 message as v3ControlMessage")
+			dt.fsmActClose(nil)
+			return
+		}
+		dt.handleV3Msg(msg, m.from)
+		return
 	}
 
 	level.Error(dt.logger).Log(
 		"message", "unhandled protocol version",
-		"version", m.msg.protocolVersion())
+		"message_version", m.msg.protocolVersion())
 
 	dt.handleEvent("close",
 		avpStopCCNResultCodeChannelProtocolVersionUnsupported,
-		avpErrorCode(ProtocolVersion2),
+		avpErrorCode(dt.cfg.Version),
 		fmt.Sprintf("unhandled protocol version %v", m.msg.protocolVersion()))
 }
 
@@ -292,8 +629,9 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 
 	// It's possible to have a message mis-delivered on our control
 	// socket.  Ignore these messages: ideally we'd redirect them
-	// but dropping them is a good compromise for now.
-	if msg.Tid() != uint16(dt.cfg.TunnelID) {
+	// but dropping them is a good compromise for now.  The SCCRQ
+	// starting a passive tunnel is addressed to TID 0.
+	if msg.Tid() != uint16(dt.cfg.TunnelID) && !dt.isPassiveSccrq(msg) {
 		level.Error(dt.logger).Log(
 			"message", "received control message with the wrong TID",
 			"expected", dt.cfg.TunnelID,
@@ -301,6 +639,50 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 		return
 	}
 
+	dt.dispatchMsg(msg, from)
+}
+
+func (dt *dynamicTunnel) handleV3Msg(msg *v3ControlMessage, from unix.Sockaddr) {
+
+	// As for L2TPv2, drop mis-delivered messages.  The peer addresses
+	// all messages including the SCCRP to the Assigned Control
+	// Connection ID we sent in the SCCRQ.
+	if msg.ControlConnectionID() != uint32(dt.cfg.TunnelID) && !dt.isPassiveSccrq(msg) {
+		level.Error(dt.logger).Log(
+			"message", "received control message with the wrong control connection ID",
+			"expected", dt.cfg.TunnelID,
+			"got", msg.ControlConnectionID())
+		return
+	}
+
+	dt.dispatchMsg(msg, from)
+}
+
+// isPassiveSccrq reports whether msg is an SCCRQ received by a passive
+// tunnel, which the peer addresses to control connection ID 0.
+func (dt *dynamicTunnel) isPassiveSccrq(msg controlMessage) bool {
+	return dt.passive && msg.getType() == avpMsgTypeSccrq
+}
+
+// dispatchMsg validates a received control message and maps it to the
+// corresponding FSM event.
+func (dt *dynamicTunnel) dispatchMsg(msg controlMessage, from unix.Sockaddr) {
+
+	// An unrecognised AVP with the mandatory bit set requires the tunnel
+	// to be torn down.  If the message is associated with a session, only
+	// the session is torn down, which is left to the session to handle.
+	if a := findUnrecognisedMandatoryAvp(msg.getAvps()); a != nil && !isSessionMsgType(msg.getType()) {
+		level.Error(dt.logger).Log(
+			"message", "unrecognised mandatory AVP",
+			"message_type", msg.getType(),
+			"avp", a.header)
+		dt.handleEvent("close",
+			avpStopCCNResultCodeGeneralError,
+			avpErrorCodeMBitShutdown,
+			fmt.Sprintf("unrecognised mandatory AVP %v in %v message", a.header, msg.getType()))
+		return
+	}
+
 	// Validate the message.  If validation fails drive shutdown via.
 	// the FSM to allow the error to be communicated to the peer.
 	err := msg.validate()
@@ -326,10 +708,14 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 		{avpMsgTypeScccn, "scccn"},
 		{avpMsgTypeStopccn, "stopccn"},
 		{avpMsgTypeHello, ""}, // fsm ignores empty events
+		{avpMsgTypeOcrq, "sessionmsg"},
+		{avpMsgTypeOcrp, "sessionmsg"},
+		{avpMsgTypeOccn, "sessionmsg"},
 		{avpMsgTypeIcrq, "sessionmsg"},
 		{avpMsgTypeIcrp, "sessionmsg"},
 		{avpMsgTypeIccn, "sessionmsg"},
 		{avpMsgTypeCdn, "sessionmsg"},
+		{avpMsgTypeSli, "sessionmsg"},
 	}
 
 	for _, em := range eventMap {
@@ -340,13 +726,26 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 	}
 
 	level.Error(dt.logger).Log(
-		"message", "unhandled v2 control message",
+		"message", "unhandled control message",
+		"message_version", msg.protocolVersion(),
 		"message_type", msg.getType())
 
 	dt.handleEvent("close",
 		avpStopCCNResultCodeGeneralError,
 		avpErrorCodeBadValue,
-		fmt.Sprintf("unhandled v2 control message %v", msg.getType()))
+		fmt.Sprintf("unhandled %v control message %v", msg.protocolVersion(), msg.getType()))
+}
+
+// isSessionMsgType returns true if messages of type t are associated
+// with a session rather than the tunnel as a whole.
+func isSessionMsgType(t avpMsgType) bool {
+	switch t {
+	case avpMsgTypeOcrq, avpMsgTypeOcrp, avpMsgTypeOccn,
+		avpMsgTypeIcrq, avpMsgTypeIcrp, avpMsgTypeIccn,
+		avpMsgTypeCdn, avpMsgTypeWen, avpMsgTypeSli:
+		return true
+	}
+	return false
 }
 
 func (dt *dynamicTunnel) fsmActSendSccrq(args []interface{}) {
@@ -359,19 +758,116 @@ func (dt *dynamicTunnel) fsmActSendSccrq(args []interface{}) {
 	}
 }
 
-func (dt *dynamicTunnel) sendSccrq() error {
-	msg, err := newV2Sccrq(dt.cfg)
+func (dt *dynamicTunnel) sendSccrq() (err error) {
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion3 {
+		msg, err = newV3Sccrq(dt.cfg)
+	} else {
+		msg, err = newV2Sccrq(dt.cfg)
+	}
+	if err != nil {
+		return err
+	}
+	err = appendVendorAvps(msg, dt.cfg.VendorAVPs)
 	if err != nil {
 		return err
 	}
 	return dt.xport.send(msg)
 }
 
+// recordPeerVendorAvps stores the registered vendor AVPs sent by the
+// peer in the SCCRQ or SCCRP for reporting in the TunnelUpEvent.
+// Undecodable AVPs aren't fatal to the tunnel.
+func (dt *dynamicTunnel) recordPeerVendorAvps(msg controlMessage) {
+	var err error
+	dt.peerVendor, err = findVendorAvps(msg.getAvps())
+	if err != nil {
+		level.Warn(dt.logger).Log(
+			"message", "failed to decode peer vendor AVPs",
+			"message_type", msg.getType(),
+			"error", err)
+	}
+}
+
+// checkPeerCapabilities compares the framing and bearer capabilities
+// advertised by the peer with our own, logging a warning if they have
+// nothing in common.  Mismatched capabilities aren't fatal to the tunnel,
+// but are likely to cause problems when establishing sessions.
+func (dt *dynamicTunnel) checkPeerCapabilities(msg controlMessage) {
+	fc, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeFramingCap)
+	if err == nil {
+		peerFramingCaps := FramingCapability(fc)
+		if dt.cfg.FramingCaps != 0 && dt.cfg.FramingCaps&peerFramingCaps == 0 {
+			level.Warn(dt.logger).Log(
+				"message", "no framing capabilities in common with peer",
+				"framing_caps", dt.cfg.FramingCaps,
+				"peer_framing_caps", peerFramingCaps)
+		}
+	}
+
+	bc, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeBearerCap)
+	if err == nil {
+		peerBearerCaps := BearerCapability(bc)
+		if dt.cfg.BearerCaps != 0 && dt.cfg.BearerCaps&peerBearerCaps == 0 {
+			level.Warn(dt.logger).Log(
+				"message", "no bearer capabilities in common with peer",
+				"bearer_caps", dt.cfg.BearerCaps,
+				"peer_bearer_caps", peerBearerCaps)
+		}
+	}
+}
+
+// recordPeerPseudowireCaps stores the pseudowire types advertised by
+// an L2TPv3 peer.  Sessions of other pseudowire types are rejected once
+// the tunnel is established.
+func (dt *dynamicTunnel) recordPeerPseudowireCaps(msg controlMessage) error {
+	b, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypePseudowireCaps)
+	if err != nil {
+		return fmt.Errorf("no Pseudowire Capabilities List AVP in %v", msg.getType())
+	}
+	caps, err := decodePseudowireCaps(b)
+	if err != nil {
+		return fmt.Errorf("failed to parse peer pseudowire capabilities: %v", err)
+	}
+	dt.peerPwCaps = caps
+	return nil
+}
+
+// peerSupportsPseudowire returns true if the peer advertised support
+// for a pseudowire type.  Pseudowire capabilities are exchanged by
+// L2TPv3 peers only, so all types are assumed supported for L2TPv2.
+func (dt *dynamicTunnel) peerSupportsPseudowire(pwtype PseudowireType) bool {
+	if dt.cfg.Version != ProtocolVersion3 {
+		return true
+	}
+	for _, c := range dt.peerPwCaps {
+		if c == pwtype {
+			return true
+		}
+	}
+	return false
+}
+
+// startSession places the call for a session once the tunnel is up, or
+// closes the session if the peer doesn't support its pseudowire type.
+func (dt *dynamicTunnel) startSession(ds *dynamicSession) {
+	if !dt.peerSupportsPseudowire(ds.cfg.Pseudowire) {
+		level.Error(dt.logger).Log(
+			"message", "peer does not support session pseudowire type",
+			"session_name", ds.getName(),
+			"pseudowire", ds.cfg.Pseudowire,
+			"peer_pseudowire_caps", fmt.Sprintf("%v", dt.peerPwCaps))
+		ds.kill()
+		return
+	}
+	ds.onTunnelUp()
+}
+
 func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 
-	msg, from := fsmArgsToV2MsgFrom(args)
+	msg, from := fsmArgsToMsgFrom(args)
 
-	ptid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeTunnelID)
+	ptid, err := findPeerTunnelID(msg)
 	if err != nil {
 		// Shouldn't occur since tunnel ID is mandatory
 		level.Error(dt.logger).Log(
@@ -381,10 +877,33 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 		return
 	}
 
+	// Tunnel ID 0 is reserved by the protocol
+	if ptid == 0 {
+		level.Error(dt.logger).Log(
+			"message", "invalid peer tunnel ID in SCCRP",
+			"peer_tunnel_id", ptid)
+		dt.handleEvent("close")
+		return
+	}
+
+	if dt.cfg.Version == ProtocolVersion3 {
+		err = dt.recordPeerPseudowireCaps(msg)
+		if err != nil {
+			level.Error(dt.logger).Log(
+				"message", "bad SCCRP",
+				"error", err)
+			dt.handleEvent("close")
+			return
+		}
+	} else {
+		dt.checkPeerCapabilities(msg)
+	}
+	dt.recordPeerVendorAvps(msg)
+
 	// Reconfigure transport and socket now we know the peer TID
 	// and the address being used for this tunnel
-	dt.xport.config.PeerControlConnID = ControlConnID(ptid)
-	dt.cfg.PeerTunnelID = ControlConnID(ptid)
+	dt.xport.config.PeerControlConnID = ptid
+	dt.cfg.PeerTunnelID = ptid
 	dt.cp.connectTo(from)
 
 	err = dt.sendScccn()
@@ -396,10 +915,98 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 		return
 	}
 
+	dt.establishDataPlane()
+}
+
+func (dt *dynamicTunnel) fsmActOnSccrq(args []interface{}) {
+
+	msg, _ := fsmArgsToMsgFrom(args)
+
+	ptid, err := findPeerTunnelID(msg)
+	if err != nil {
+		// Shouldn't occur since tunnel ID is mandatory
+		level.Error(dt.logger).Log(
+			"message", "failed to parse peer tunnel ID from SCCRQ",
+			"error", err)
+		dt.fsmActClose(nil)
+		return
+	}
+
+	// Tunnel ID 0 is reserved by the protocol
+	if ptid == 0 {
+		level.Error(dt.logger).Log(
+			"message", "invalid peer tunnel ID in SCCRQ",
+			"peer_tunnel_id", ptid)
+		dt.fsmActClose(nil)
+		return
+	}
+
+	if dt.cfg.Version == ProtocolVersion3 {
+		err = dt.recordPeerPseudowireCaps(msg)
+		if err != nil {
+			level.Error(dt.logger).Log(
+				"message", "bad SCCRQ",
+				"error", err)
+			dt.fsmActClose(nil)
+			return
+		}
+	} else {
+		dt.checkPeerCapabilities(msg)
+	}
+	dt.recordPeerVendorAvps(msg)
+
+	// Reconfigure transport now we know the peer TID.  The socket is
+	// already connected to the peer for a passive tunnel.
+	dt.xport.config.PeerControlConnID = ptid
+	dt.cfg.PeerTunnelID = ptid
+
+	err = dt.sendSccrp()
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "failed to send SCCRP",
+			"error", err)
+		dt.fsmActClose(nil)
+	}
+}
+
+func (dt *dynamicTunnel) sendSccrp() (err error) {
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion3 {
+		msg, err = newV3Sccrp(dt.cfg)
+	} else {
+		msg, err = newV2Sccrp(dt.cfg)
+	}
+	if err != nil {
+		return err
+	}
+	err = appendVendorAvps(msg, dt.cfg.VendorAVPs)
+	if err != nil {
+		return err
+	}
+	return dt.xport.send(msg)
+}
+
+func (dt *dynamicTunnel) fsmActOnScccn(args []interface{}) {
+	dt.establishDataPlane()
+}
+
+// establishDataPlane completes tunnel establishment once the control
+// connection three-way handshake is complete.
+func (dt *dynamicTunnel) establishDataPlane() {
+
 	level.Info(dt.logger).Log("message", "control plane established")
 
 	// establish the data plane
-	dt.dp, err = dt.parent.dp.NewTunnel(dt.cfg, dt.sal, dt.sap, dt.cp.fd)
+	err := dt.parent.preTunnelUp(dt)
+	if err != nil {
+		dt.handleEvent("close",
+			avpStopCCNResultCodeGeneralError,
+			avpErrorCodeVendorSpecificError,
+			fmt.Sprintf("failed to instantiate tunnel data plane: %v", err))
+		return
+	}
+
+	dp, err := dt.parent.dp.NewTunnel(dt.cfg, dt.sal, dt.sap, dt.cp.fd)
 	if err != nil {
 		level.Error(dt.logger).Log(
 			"message", "failed to establish data plane",
@@ -411,27 +1018,55 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 		return
 	}
 
+	dt.dpLock.Lock()
+	dt.dp = dp
+	dt.dpLock.Unlock()
+
+	if h, ok := dp.(dataPacketHandler); ok {
+		dt.xport.setDataHandler(h.handleDataPacket)
+	}
+
+	err = dt.parent.postTunnelUp(dt)
+	if err != nil {
+		dt.handleEvent("close",
+			avpStopCCNResultCodeGeneralError,
+			avpErrorCodeVendorSpecificError,
+			fmt.Sprintf("failed to instantiate tunnel data plane: %v", err))
+		return
+	}
+
 	level.Info(dt.logger).Log("message", "data plane established")
 
 	// inform sessions that we're up
 	for _, s := range dt.allSessions() {
 		if ds, ok := s.(*dynamicSession); ok {
-			ds.onTunnelUp()
+			dt.startSession(ds)
 		}
 	}
 
+	dt.stopEstablishTimer()
 	dt.established = true
+	close(dt.upChan)
+	if dt.persist != nil {
+		dt.parent.resetReconnect(dt.getName())
+	}
 	dt.parent.handleUserEvent(&TunnelUpEvent{
-		TunnelName:   dt.getName(),
-		Tunnel:       dt,
-		Config:       dt.cfg,
-		LocalAddress: dt.sal,
-		PeerAddress:  dt.sap,
+		TunnelName:     dt.getName(),
+		Tunnel:         dt,
+		Config:         dt.cfg,
+		LocalAddress:   dt.sal,
+		PeerAddress:    dt.sap,
+		PeerVendorAVPs: dt.peerVendor,
 	})
 }
 
-func (dt *dynamicTunnel) sendScccn() error {
-	msg, err := newV2Scccn(dt.cfg)
+func (dt *dynamicTunnel) sendScccn() (err error) {
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion3 {
+		msg, err = newV3Scccn(dt.cfg)
+	} else {
+		msg, err = newV2Scccn(dt.cfg)
+	}
 	if err != nil {
 		return err
 	}
@@ -440,14 +1075,36 @@ func (dt *dynamicTunnel) sendScccn() error {
 
 func (dt *dynamicTunnel) fsmActSendStopccn(args []interface{}) {
 
-	rc := fsmArgsToStopccnResult(args)
-	// Ignore tx error since we're going to close in any case
-	_ = dt.sendStopccn(rc)
+	// If the tunnel has already been closed, e.g. due to transport
+	// failure, the transport is no longer available to send the StopCCN.
+	dt.closingLock.Lock()
+	isClosing := dt.isClosing
+	dt.closingLock.Unlock()
+
+	if !isClosing {
+		rc := fsmArgsToStopccnResult(args)
+		if rc.result != avpStopCCNResultCodeClearConnection && dt.downErr == nil {
+			dt.downErr = &StopCCNError{
+				Local:      true,
+				ResultCode: uint16(rc.result),
+				ErrorCode:  uint16(rc.errCode),
+				Message:    rc.errMsg,
+			}
+		}
+		// Ignore tx error since we're going to close in any case
+		dt.sentStopccn = true
+		_ = dt.sendStopccn(rc)
+	}
 	dt.fsmActClose(args)
 }
 
-func (dt *dynamicTunnel) sendStopccn(rc *resultCode) error {
-	msg, err := newV2Stopccn(rc, dt.cfg)
+func (dt *dynamicTunnel) sendStopccn(rc *resultCode) (err error) {
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion3 {
+		msg, err = newV3Stopccn(rc, dt.cfg)
+	} else {
+		msg, err = newV2Stopccn(rc, dt.cfg)
+	}
 	if err != nil {
 		return err
 	}
@@ -460,6 +1117,22 @@ func (dt *dynamicTunnel) sendStopccn(rc *resultCode) error {
 // continue to drain the transport in order to allow messages to
 // be ACKed.
 func (dt *dynamicTunnel) fsmActOnStopccn(args []interface{}) {
+	msg, _ := fsmArgsToMsgFrom(args)
+	rc, err := findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
+	if err == nil {
+		level.Info(dt.logger).Log(
+			"message", "received StopCCN",
+			"result", stopccnResultCodeToString(rc))
+		dt.peerResult = rc
+		if rc.result != avpStopCCNResultCodeClearConnection && dt.downErr == nil {
+			dt.downErr = &StopCCNError{
+				ResultCode: uint16(rc.result),
+				ErrorCode:  uint16(rc.errCode),
+				Message:    rc.errMsg,
+			}
+		}
+	}
+
 	level.Debug(dt.logger).Log(
 		"message", "pending for stopccn retransmit period",
 		"timeout", dt.cfg.StopCCNTimeout)
@@ -469,37 +1142,193 @@ func (dt *dynamicTunnel) fsmActOnStopccn(args []interface{}) {
 		case <-timeout.C:
 			dt.fsmActClose(args)
 			return
-		case <-dt.xport.recvChan:
+		case _, ok := <-dt.xport.recvChan:
+			if !ok {
+				timeout.Stop()
+				dt.fsmActClose(args)
+				return
+			}
 		}
 	}
 }
 
 func (dt *dynamicTunnel) fsmActLinkSession(args []interface{}) {
 	ds := fsmArgsToSession(args)
-	dt.linkSession(ds)
+	dt.linkNewSession(ds)
 }
 
 func (dt *dynamicTunnel) fsmActStartSession(args []interface{}) {
 	ds := fsmArgsToSession(args)
-	dt.linkSession(ds)
-	ds.onTunnelUp()
+	if dt.linkNewSession(ds) {
+		dt.startSession(ds)
+	}
+}
+
+// linkNewSession links a session created by NewSession, replacing the
+// reservation of its session ID.  If the tunnel has closed since the
+// session was created the session is killed and its ID released instead.
+func (dt *dynamicTunnel) linkNewSession(ds *dynamicSession) bool {
+	dt.closingLock.Lock()
+	isClosing := dt.isClosing
+	if !isClosing {
+		dt.linkSession(ds)
+	}
+	dt.closingLock.Unlock()
+
+	if isClosing {
+		close(ds.killChan)
+		ds.wg.Wait()
+		dt.sessionLock.Lock()
+		dt.releaseSid(ds.cfg.SessionID)
+		dt.sessionLock.Unlock()
+		return false
+	}
+	return true
 }
 
 func (dt *dynamicTunnel) fsmActForwardSessionMsg(args []interface{}) {
 
-	msg, _ := fsmArgsToV2MsgFrom(args)
+	msg, _ := fsmArgsToMsgFrom(args)
 
-	if s, ok := dt.findSessionByID(ControlConnID(msg.Sid())); ok {
+	sid, err := findLocalSessionID(msg)
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "failed to parse session ID from session message",
+			"message_type", msg.getType(),
+			"error", err)
+		return
+	}
+
+	if s, ok := dt.findSessionByID(sid); ok {
 		if ds, ok := s.(*dynamicSession); ok {
 			ds.handleCtlMsg(msg)
 		}
+	} else if dt.passive && msg.getType() == avpMsgTypeIcrq {
+		dt.answerIncomingCall(msg)
 	} else {
-		// TODO: on receipt of ICRQ we'll end up here; to handle this
-		// we'd need to be able to create an LNS-mode session instance
 		level.Error(dt.logger).Log(
 			"message", "received session message for unknown session",
 			"message_type", msg.getType(),
-			"session ID", msg.Sid())
+			"session ID", sid)
+	}
+}
+
+// answerIncomingCall creates a session for an incoming call placed by
+// the peer of a passive tunnel.  The session is named after the session
+// ID assigned to it.  If the call can't be accepted it is refused with
+// a CDN.
+func (dt *dynamicTunnel) answerIncomingCall(icrq controlMessage) {
+
+	psid, err := findPeerSessionID(icrq)
+	if err != nil || psid == 0 {
+		level.Error(dt.logger).Log(
+			"message", "no valid peer session ID in ICRQ",
+			"error", err)
+		return
+	}
+
+	cfg := &SessionConfig{
+		PeerSessionID: psid,
+		Pseudowire:    PseudowireTypePPP,
+		CallDirection: CallDirectionIncoming,
+	}
+
+	refuse := func(result avpResultCode, errCode avpErrorCode, format string, args ...interface{}) {
+		errMsg := fmt.Sprintf(format, args...)
+		level.Error(dt.logger).Log(
+			"message", "refusing incoming call",
+			"peer_session_id", psid,
+			"error", errMsg)
+		dt.sendCallRefusal(cfg, &resultCode{result: result, errCode: errCode, errMsg: errMsg})
+	}
+
+	err = icrq.validate()
+	if err != nil {
+		refuse(avpCDNResultCodeGeneralError, avpErrorCodeBadValue, "bad ICRQ message: %v", err)
+		return
+	}
+
+	if dt.cfg.Version == ProtocolVersion3 {
+		pw, err := findUint16Avp(icrq.getAvps(), vendorIDIetf, avpTypePseudowireType)
+		if err != nil {
+			refuse(avpCDNResultCodeGeneralError, avpErrorCodeBadValue, "no Pseudowire Type AVP in ICRQ message")
+			return
+		}
+		cfg.Pseudowire = PseudowireType(pw)
+		supported := false
+		for _, pwtype := range v3PseudowireCaps {
+			supported = supported || pwtype == cfg.Pseudowire
+		}
+		if !supported {
+			refuse(avpCDNResultCodeNotAvailable, avpErrorCodeNoError, "unsupported pseudowire type %v", cfg.Pseudowire)
+			return
+		}
+		if cookie, err := findBytesAvp(icrq.getAvps(), vendorIDIetf, avpTypeAssignedCookie); err == nil {
+			if len(cookie) != 4 && len(cookie) != 8 {
+				refuse(avpCDNResultCodeGeneralError, avpErrorCodeBadLength, "invalid Assigned Cookie length in ICRQ message")
+				return
+			}
+			cfg.PeerCookie = cookie
+		}
+	}
+
+	if seq, ok := findSequencingRequest(icrq); ok && seq {
+		cfg.SeqNum = true
+	}
+
+	cfg.SessionID, err = dt.reserveSid(0)
+	if err != nil {
+		refuse(avpCDNResultCodeNoResources, avpErrorCodeNoResource, "%v", err)
+		return
+	}
+
+	name := fmt.Sprintf("session%v", cfg.SessionID)
+	if _, ok := dt.findSessionByName(name); ok {
+		err = fmt.Errorf("%w %q", ErrSessionNameExists, name)
+		dt.releaseSidOnError(cfg.SessionID, &err)
+		refuse(avpCDNResultCodeGeneralError, avpErrorCodeVendorSpecificError, "%v", err)
+		return
+	}
+
+	ds := newAnsweringDynamicSession(dt.parent.allocCallSerial(), name, dt, cfg)
+	if dt.linkNewSession(ds) {
+		ds.onTunnelUp()
+	}
+}
+
+// sendCallRefusal sends a CDN refusing an incoming call for which no
+// session exists.  The CDN is sent asynchronously to avoid blocking the
+// tunnel goroutine pending the peer's acknowledgement.
+func (dt *dynamicTunnel) sendCallRefusal(cfg *SessionConfig, rc *resultCode) {
+	var msg controlMessage
+	var err error
+	if dt.cfg.Version == ProtocolVersion3 {
+		msg, err = newV3Cdn(dt.cfg.PeerTunnelID, rc, cfg)
+	} else {
+		msg, err = newV2Cdn(dt.cfg.PeerTunnelID, rc, cfg)
+	}
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "failed to build CDN message",
+			"error", err)
+		return
+	}
+	dt.sessionTxWg.Add(1)
+	go func() {
+		defer dt.sessionTxWg.Done()
+		err := dt.xport.send(msg)
+		if err != nil {
+			level.Error(dt.logger).Log(
+				"message", "failed to send CDN message",
+				"error", err)
+		}
+	}()
+}
+
+func (dt *dynamicTunnel) stopEstablishTimer() {
+	if dt.estTimer != nil {
+		dt.estTimer.Stop()
+		dt.estTimer = nil
 	}
 }
 
@@ -518,56 +1347,84 @@ func (dt *dynamicTunnel) fsmActClose(args []interface{}) {
 
 		dt.isClosing = true
 
-		dt.closeAllSessions()
+		dt.stopEstablishTimer()
 
-		if dt.dp != nil {
-			err := dt.dp.Down()
-			if err != nil {
-				level.Error(dt.logger).Log("message", "dataplane down failed", "error", err)
-			}
+		var sessions []persistedSession
+		if dt.persist != nil {
+			sessions = dt.persist.freeze()
 		}
+
+		dt.closeAllSessions()
+
+		dt.downDataPlane()
 		if dt.xport != nil {
+			// If the transport went down before we closed it,
+			// that's the reason for the tunnel going down.  Failure
+			// to deliver our own StopCCN doesn't count.
+			if err := dt.xport.getDownErr(); err != nil && dt.downErr == nil && !dt.sentStopccn {
+				dt.downErr = err
+			}
 			dt.xport.close()
+			notifyTransportDown(dt, dt.xport)
 		}
 		if dt.cp != nil {
 			dt.cp.close()
 		}
 
-		if dt.established {
+		if dt.established || errors.Is(dt.downErr, ErrTunnelEstablishTimeout) {
 			dt.established = false
-			dt.parent.handleUserEvent(&TunnelDownEvent{
+			ev := &TunnelDownEvent{
 				TunnelName:   dt.getName(),
 				Tunnel:       dt,
 				Config:       dt.cfg,
 				LocalAddress: dt.sal,
 				PeerAddress:  dt.sap,
-			})
+				Error:        dt.downErr,
+			}
+			if dt.peerResult != nil {
+				ev.ResultCode = uint16(dt.peerResult.result)
+				ev.ErrorCode = uint16(dt.peerResult.errCode)
+			}
+			dt.parent.handleUserEvent(ev)
 		}
 
 		dt.parent.unlinkTunnel(dt)
 		level.Info(dt.logger).Log("message", "close")
+
+		// Persistent tunnels are re-created unless they were closed
+		// cleanly
+		if dt.persist != nil && dt.downErr != nil {
+			dt.parent.scheduleReconnect(dt, sessions)
+		}
 	}
 }
 
-// Create a new client/LAC mode tunnel instance running the full control protocol
-func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) (dt *dynamicTunnel, err error) {
+// Create a new tunnel instance running the full control protocol.
+// Passive tunnels wait on the peer to initiate the control connection.
+// If sccrq is set it is an SCCRQ already received by a TunnelListener on
+// behalf of the passive tunnel.
+func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig, passive bool, sccrq *rawMsg, persist *tunnelPersistence) (dt *dynamicTunnel, err error) {
 
-	// Currently only handle L2TPv2
-	if cfg.Version != ProtocolVersion2 {
-		return nil, fmt.Errorf("L2TPv3 dynamic tunnels are not (yet) supported")
+	if cfg.Version != ProtocolVersion2 && cfg.Version != ProtocolVersion3 {
+		return nil, fmt.Errorf("unsupported protocol version %v for dynamic tunnel", cfg.Version)
 	}
 
 	dt = &dynamicTunnel{
 		baseTunnel: newBaseTunnel(
-			log.With(parent.logger, "tunnel_name", name),
+			parent.logger,
 			name,
 			parent,
 			cfg),
+		persist:   persist,
+		passive:   passive,
 		sal:       sal,
 		sap:       sap,
 		closeChan: make(chan bool),
+		doneChan:  make(chan bool),
+		upChan:    make(chan bool),
 		sendChan:  make(chan *sendMsg),
 		eventChan: make(chan *eventArgs),
+		movedChan: make(chan unix.Sockaddr),
 	}
 
 	// Ref: RFC2661 section 7.2.1
@@ -610,29 +1467,140 @@ func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg
 				cb: dt.fsmActSendStopccn,
 				to: "dead",
 			},
+
+			// dead is for once the tunnel has closed, but sessions may
+			// still be pending from NewSession calls racing with the close
+			{from: "dead", events: []string{"newsession"}, cb: dt.fsmActLinkSession, to: "dead"},
 		},
 	}
 
+	// Ref: RFC2661 section 7.2.1, as the responder
+	if passive {
+		dt.fsm.table = append([]eventDesc{
+			// The passive tunnel FSM starts in the waitsccrq state rather
+			// than sending an sccrq
+			{from: "idle", events: []string{"open"}, cb: nil, to: "waitsccrq"},
+
+			// waitsccrq is for when we're waiting on the peer to initiate the tunnel
+			{from: "waitsccrq", events: []string{"sccrq"}, cb: dt.fsmActOnSccrq, to: "waitctlconn"},
+			{from: "waitsccrq", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
+			{from: "waitsccrq", events: []string{"newsession"}, cb: dt.fsmActLinkSession, to: "waitsccrq"},
+			{
+				from: "waitsccrq",
+				events: []string{
+					"sessionmsg",
+					"sccrp",
+					"scccn",
+				},
+				cb: nil,
+				to: "waitsccrq",
+			},
+			{from: "waitsccrq", events: []string{"close"}, cb: dt.fsmActClose, to: "dead"},
+
+			// waitctlconn is for when we've sent an sccrp to the peer and are waiting on the sccn
+			{from: "waitctlconn", events: []string{"scccn"}, cb: dt.fsmActOnScccn, to: "established"},
+			{from: "waitctlconn", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
+			{from: "waitctlconn", events: []string{"newsession"}, cb: dt.fsmActLinkSession, to: "waitctlconn"},
+			{from: "waitctlconn", events: []string{"sessionmsg"}, cb: nil, to: "waitctlconn"},
+			{
+				from: "waitctlconn",
+				events: []string{
+					"sccrq",
+					"sccrp",
+					"close",
+				},
+				cb: dt.fsmActSendStopccn,
+				to: "dead",
+			},
+		}, dt.fsm.table[1:]...)
+	}
+
 	dt.cp, err = newL2tpControlPlane(sal, sap)
 	if err != nil {
 		dt.Close()
 		return nil, err
 	}
 
-	err = dt.cp.bind()
+	err = dt.cp.setUDPChecksum(dt.cfg.UDPChecksum)
+	if err != nil {
+		dt.Close()
+		return nil, fmt.Errorf("failed to configure UDP checksum: %v", err)
+	}
+
+	err = dt.cp.setPMTUDisc(dt.cfg.PMTUDisc)
+	if err != nil {
+		dt.Close()
+		return nil, err
+	}
+
+	err = dt.cp.bindToDevice(dt.cfg.Device)
+	if err != nil {
+		dt.Close()
+		return nil, err
+	}
+
+	err = dt.cp.bindToIfindex(dt.cfg.DeviceIndex)
+	if err != nil {
+		dt.Close()
+		return nil, err
+	}
+
+	err = dt.cp.setIPv6FlowLabel(dt.cfg.IPv6FlowLabel)
 	if err != nil {
 		dt.Close()
 		return nil, err
 	}
 
+	err = dt.cp.setReusePort(dt.cfg.ReusePort)
+	if err != nil {
+		dt.Close()
+		return nil, err
+	}
+
+	err = dt.cp.setPriority(dt.cfg.SocketPriority)
+	if err != nil {
+		dt.Close()
+		return nil, err
+	}
+
+	if dt.cfg.CaptureFile != "" {
+		err = dt.cp.startCapture(dt.cfg.CaptureFile)
+		if err != nil {
+			dt.Close()
+			return nil, err
+		}
+	}
+
+	err = dt.cp.bind()
+	if err != nil {
+		dt.Close()
+		return nil, tunnelBindError(dt.cfg, dt.cp.local, err)
+	}
+
+	// A passive tunnel accepts the SCCRQ from the configured peer only
+	if passive {
+		err = dt.cp.connect()
+		if err != nil {
+			dt.Close()
+			return nil, err
+		}
+		if sccrq != nil {
+			dt.cp.unread(sccrq)
+		}
+	}
+
 	dt.xport, err = newTransport(dt.logger, dt.cp, transportConfig{
 		HelloTimeout:      dt.cfg.HelloTimeout,
 		TxWindowSize:      dt.cfg.WindowSize,
+		StopAndWait:       dt.cfg.StopAndWait,
 		MaxRetries:        dt.cfg.MaxRetries,
 		RetryTimeout:      dt.cfg.RetryTimeout,
-		AckTimeout:        time.Millisecond * 100,
+		AckTimeout:        dt.cfg.AckTimeout,
 		Version:           dt.cfg.Version,
 		PeerControlConnID: dt.cfg.PeerTunnelID,
+		Secret:            []byte(dt.cfg.Secret),
+		ReadTimeout:       dt.cfg.ControlReadTimeout,
+		WriteTimeout:      dt.cfg.ControlWriteTimeout,
 	})
 	if err != nil {
 		dt.Close()
@@ -642,5 +1610,10 @@ func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg
 	dt.wg.Add(1)
 	go dt.runTunnel()
 
+	if dt.cfg.ResolveInterval > 0 {
+		dt.wg.Add(1)
+		go dt.runResolver()
+	}
+
 	return
 }
@@ -1,11 +1,11 @@
 package l2tp
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
 
-	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"golang.org/x/sys/unix"
 )
@@ -15,28 +15,45 @@ type quiescentTunnel struct {
 	sal, sap  unix.Sockaddr
 	cp        *controlPlane
 	xport     *transport
+	dpLock    sync.Mutex
 	dp        TunnelDataPlane
 	closeChan chan bool
+	closeOnce sync.Once
 	wg        sync.WaitGroup
+
+	closingLock sync.Mutex
+	isClosing   bool
 }
 
-func (qt *quiescentTunnel) NewSession(name string, cfg *SessionConfig) (Session, error) {
+func (qt *quiescentTunnel) NewSession(name string, cfg *SessionConfig) (sess Session, err error) {
 
 	// Must have configuration
 	if cfg == nil {
 		return nil, fmt.Errorf("invalid nil config")
 	}
 
+	// Must have a valid configuration, including a non-zero
+	// session ID and peer session ID
+	err = validateSessionConfig(qt.cfg, cfg, true)
+	if err != nil {
+		return nil, err
+	}
+
+	qt.parent.waitCreate()
+
 	// Duplicate the configuration so we don't modify the user's copy
 	myCfg := *cfg
 
 	if _, ok := qt.findSessionByName(name); ok {
-		return nil, fmt.Errorf("already have session %q", name)
+		return nil, fmt.Errorf("%w %q", ErrSessionNameExists, name)
 	}
 
-	if _, ok := qt.findSessionByID(cfg.SessionID); ok {
-		return nil, fmt.Errorf("already have session %q", cfg.SessionID)
+	// Must not have session ID clashes, or exceed the tunnel's session limit
+	_, err = qt.reserveSid(cfg.SessionID)
+	if err != nil {
+		return nil, err
 	}
+	defer qt.releaseSidOnError(cfg.SessionID, &err)
 
 	s, err := newStaticSession(name, qt, &myCfg)
 	if err != nil {
@@ -48,32 +65,139 @@ func (qt *quiescentTunnel) NewSession(name string, cfg *SessionConfig) (Session,
 	return s, nil
 }
 
+func (qt *quiescentTunnel) CloseWithResult(result, errCode uint16, msg string) error {
+	if err := validateStopCCNResult(result, errCode); err != nil {
+		return err
+	}
+	qt.Close()
+	return nil
+}
+
 func (qt *quiescentTunnel) Close() {
 	if qt != nil {
+		qt.closingLock.Lock()
+		qt.isClosing = true
+		qt.closingLock.Unlock()
+
 		close(qt.closeChan)
 		qt.wg.Wait()
 		qt.close()
 	}
 }
 
-func (qt *quiescentTunnel) close() {
-	if qt != nil {
-		qt.baseTunnel.closeAllSessions()
+// kill aborts the tunnel transport, failing any pending transmission,
+// and tears down the tunnel data plane.
+func (qt *quiescentTunnel) kill() {
+	if qt.xport != nil {
+		qt.xport.abort(ErrTunnelKilled)
+	}
+	qt.downDataPlane()
+}
 
-		if qt.xport != nil {
-			qt.xport.close()
-		}
-		if qt.cp != nil {
-			qt.cp.close()
-		}
-		if qt.dp != nil {
-			err := qt.dp.Down()
+// downDataPlane tears down the tunnel data plane, unless it has already
+// been torn down.
+func (qt *quiescentTunnel) downDataPlane() {
+	qt.dpLock.Lock()
+	dp := qt.dp
+	qt.dp = nil
+	qt.dpLock.Unlock()
+
+	if dp != nil {
+		qt.parent.preTunnelDown(qt)
+		err := dp.Down()
+		if err != nil {
 			level.Error(qt.logger).Log("message", "dataplane down failed", "error", err)
 		}
+	}
+}
+
+func (qt *quiescentTunnel) SetDebugFlags(flags DebugFlags) error {
+	qt.dpLock.Lock()
+	defer qt.dpLock.Unlock()
+	if qt.dp == nil {
+		return fmt.Errorf("tunnel data plane not established")
+	}
+	err := setTunnelDataPlaneDebugFlags(qt.dp, flags)
+	if err != nil {
+		return err
+	}
+	qt.cfg.DebugFlags = flags
+	return nil
+}
+
+func (qt *quiescentTunnel) WaitUp(ctx context.Context) error {
+	qt.closingLock.Lock()
+	defer qt.closingLock.Unlock()
+	if qt.isClosing {
+		return ErrTunnelClosed
+	}
+	return nil
+}
+
+func (qt *quiescentTunnel) Health() TunnelHealth {
+	h := qt.xport.health(time.Now())
+	qt.closingLock.Lock()
+	defer qt.closingLock.Unlock()
+	if qt.isClosing {
+		h.State = TunnelHealthDown
+	}
+	return h
+}
+
+func (qt *quiescentTunnel) Statistics() TunnelStatistics {
+	return TunnelStatistics{
+		Data:               qt.dataStatistics(),
+		ControlRetransmits: qt.xport.getRetransmits(),
+	}
+}
+
+func (qt *quiescentTunnel) PathMTU() (int, error) {
+	return qt.cp.pathMTU()
+}
+
+func (qt *quiescentTunnel) getLocalAddress() unix.Sockaddr {
+	return qt.sal
+}
 
-		qt.parent.unlinkTunnel(qt)
+func (qt *quiescentTunnel) WriteControlMessage(msg *RawControlMessage) error {
+	if !qt.parent.unsafeCtlMsgs {
+		return fmt.Errorf("unsafe control messages are not enabled")
+	}
+
+	qt.closingLock.Lock()
+	isClosing := qt.isClosing
+	qt.closingLock.Unlock()
+	if isClosing {
+		return fmt.Errorf("tunnel is closing")
+	}
 
-		level.Info(qt.logger).Log("message", "close")
+	m, err := newRawControlMessage(qt.cfg.Version, qt.cfg.PeerTunnelID, msg)
+	if err != nil {
+		return err
+	}
+	return qt.xport.sendRaw(m)
+}
+
+// close tears down the tunnel.  It is called both by Close and by the
+// transport reader if the transport fails, so it runs only once.
+func (qt *quiescentTunnel) close() {
+	if qt != nil {
+		qt.closeOnce.Do(func() {
+			qt.baseTunnel.closeAllSessions()
+
+			if qt.xport != nil {
+				qt.xport.close()
+				notifyTransportDown(qt, qt.xport)
+			}
+			if qt.cp != nil {
+				qt.cp.close()
+			}
+			qt.downDataPlane()
+
+			qt.parent.unlinkTunnel(qt)
+
+			level.Info(qt.logger).Log("message", "close")
+		})
 	}
 }
 
@@ -95,10 +219,10 @@ func (qt *quiescentTunnel) xportReader() {
 	}
 }
 
-func newQuiescentTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) (qt *quiescentTunnel, err error) {
+func newQuiescentTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig, cp *controlPlane) (qt *quiescentTunnel, err error) {
 	qt = &quiescentTunnel{
 		baseTunnel: newBaseTunnel(
-			log.With(parent.logger, "tunnel_name", name),
+			parent.logger,
 			name,
 			parent,
 			cfg),
@@ -107,21 +231,83 @@ func newQuiescentTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cf
 		closeChan: make(chan bool),
 	}
 
-	// Initialise the control plane.
+	// Initialise the control plane, unless the caller has supplied one
+	// using an existing socket.
 	// We bind/connect immediately since we're not runnning most of the control protocol.
-	qt.cp, err = newL2tpControlPlane(sal, sap)
+	if cp == nil {
+		cp, err = newL2tpControlPlane(sal, sap)
+		if err != nil {
+			qt.Close()
+			return nil, err
+		}
+	}
+	qt.cp = cp
+
+	err = qt.cp.setUDPChecksum(qt.cfg.UDPChecksum)
+	if err != nil {
+		qt.Close()
+		return nil, fmt.Errorf("failed to configure UDP checksum: %v", err)
+	}
+
+	err = qt.cp.setPMTUDisc(qt.cfg.PMTUDisc)
 	if err != nil {
 		qt.Close()
 		return nil, err
 	}
 
-	err = qt.cp.bind()
+	err = qt.cp.bindToDevice(qt.cfg.Device)
 	if err != nil {
 		qt.Close()
 		return nil, err
 	}
 
-	err = qt.cp.connect()
+	err = qt.cp.bindToIfindex(qt.cfg.DeviceIndex)
+	if err != nil {
+		qt.Close()
+		return nil, err
+	}
+
+	err = qt.cp.setIPv6FlowLabel(qt.cfg.IPv6FlowLabel)
+	if err != nil {
+		qt.Close()
+		return nil, err
+	}
+
+	err = qt.cp.setReusePort(qt.cfg.ReusePort)
+	if err != nil {
+		qt.Close()
+		return nil, err
+	}
+
+	err = qt.cp.setPriority(qt.cfg.SocketPriority)
+	if err != nil {
+		qt.Close()
+		return nil, err
+	}
+
+	if qt.cfg.CaptureFile != "" {
+		err = qt.cp.startCapture(qt.cfg.CaptureFile)
+		if err != nil {
+			qt.Close()
+			return nil, err
+		}
+	}
+
+	if !qt.cp.connected {
+		err = qt.cp.bind()
+		if err != nil {
+			qt.Close()
+			return nil, tunnelBindError(qt.cfg, qt.cp.local, err)
+		}
+
+		err = qt.cp.connect()
+		if err != nil {
+			qt.Close()
+			return nil, err
+		}
+	}
+
+	err = parent.preTunnelUp(qt)
 	if err != nil {
 		qt.Close()
 		return nil, err
@@ -133,30 +319,42 @@ func newQuiescentTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cf
 		return nil, err
 	}
 
+	err = parent.postTunnelUp(qt)
+	if err != nil {
+		qt.Close()
+		return nil, err
+	}
+
 	qt.xport, err = newTransport(qt.logger, qt.cp, transportConfig{
 		HelloTimeout:      qt.cfg.HelloTimeout,
 		TxWindowSize:      qt.cfg.WindowSize,
+		StopAndWait:       qt.cfg.StopAndWait,
 		MaxRetries:        qt.cfg.MaxRetries,
 		RetryTimeout:      qt.cfg.RetryTimeout,
-		AckTimeout:        time.Millisecond * 100,
+		AckTimeout:        qt.cfg.AckTimeout,
 		Version:           qt.cfg.Version,
 		PeerControlConnID: qt.cfg.PeerTunnelID,
+		Secret:            []byte(qt.cfg.Secret),
+		ReadTimeout:       qt.cfg.ControlReadTimeout,
+		WriteTimeout:      qt.cfg.ControlWriteTimeout,
 	})
 	if err != nil {
 		qt.Close()
 		return nil, err
 	}
 
+	if h, ok := qt.dp.(dataPacketHandler); ok {
+		qt.xport.setDataHandler(h.handleDataPacket)
+	}
+
 	qt.wg.Add(1)
 	go qt.xportReader()
 
 	level.Info(qt.logger).Log(
 		"message", "new quiescent tunnel",
-		"version", qt.cfg.Version,
 		"encap", qt.cfg.Encap,
 		"local", qt.cfg.Local,
 		"peer", qt.cfg.Peer,
-		"tunnel_id", qt.cfg.TunnelID,
 		"peer_tunnel_id", qt.cfg.PeerTunnelID)
 
 	return
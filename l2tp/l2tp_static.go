@@ -1,47 +1,57 @@
 package l2tp
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
-	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"golang.org/x/sys/unix"
 )
 
 type staticTunnel struct {
 	*baseTunnel
-	dp TunnelDataPlane
+	sal    unix.Sockaddr
+	dpLock sync.Mutex
+	dp     TunnelDataPlane
 }
 
 type staticSession struct {
 	*baseSession
-	dp     SessionDataPlane
-	ifname string
+	dp        SessionDataPlane
+	drained   bool
+	ifname    string
+	cookieMon *cookieMonitor
 }
 
-func (st *staticTunnel) NewSession(name string, cfg *SessionConfig) (Session, error) {
+func (st *staticTunnel) NewSession(name string, cfg *SessionConfig) (sess Session, err error) {
 
 	// Must have configuration
 	if cfg == nil {
 		return nil, fmt.Errorf("invalid nil config")
 	}
 
-	// Must have a non-zero session ID and peer session ID
-	if cfg.SessionID == 0 {
-		return nil, fmt.Errorf("session ID must be non-zero")
-	}
-	if cfg.PeerSessionID == 0 {
-		return nil, fmt.Errorf("peer session ID must be non-zero")
+	// Must have a valid configuration, including a non-zero
+	// session ID and peer session ID
+	err = validateSessionConfig(st.cfg, cfg, true)
+	if err != nil {
+		return nil, err
 	}
 
+	st.parent.waitCreate()
+
 	// Clashes of name or session ID are not allowed
 	if _, ok := st.findSessionByName(name); ok {
-		return nil, fmt.Errorf("already have session %q", name)
+		return nil, fmt.Errorf("%w %q", ErrSessionNameExists, name)
 	}
 
-	if _, ok := st.findSessionByID(cfg.SessionID); ok {
-		return nil, fmt.Errorf("already have session %q", cfg.SessionID)
+	// Must not have session ID clashes, or exceed the tunnel's session limit
+	_, err = st.reserveSid(cfg.SessionID)
+	if err != nil {
+		return nil, err
 	}
+	defer st.releaseSidOnError(cfg.SessionID, &err)
 
 	// Duplicate the configuration so we don't modify the user's copy
 	myCfg := *cfg
@@ -55,31 +65,97 @@ func (st *staticTunnel) NewSession(name string, cfg *SessionConfig) (Session, er
 	return s, nil
 }
 
+func (st *staticTunnel) SetDebugFlags(flags DebugFlags) error {
+	st.dpLock.Lock()
+	defer st.dpLock.Unlock()
+	if st.dp == nil {
+		return fmt.Errorf("tunnel data plane not established")
+	}
+	err := setTunnelDataPlaneDebugFlags(st.dp, flags)
+	if err != nil {
+		return err
+	}
+	st.cfg.DebugFlags = flags
+	return nil
+}
+
+func (st *staticTunnel) getLocalAddress() unix.Sockaddr {
+	return st.sal
+}
+
+func (st *staticTunnel) WaitUp(ctx context.Context) error {
+	return nil
+}
+
+func (st *staticTunnel) Health() TunnelHealth {
+	return TunnelHealth{State: TunnelHealthUp}
+}
+
+func (st *staticTunnel) Statistics() TunnelStatistics {
+	return TunnelStatistics{Data: st.dataStatistics()}
+}
+
+func (st *staticTunnel) PathMTU() (int, error) {
+	return 0, fmt.Errorf("path MTU is not available for static tunnels")
+}
+
+func (st *staticTunnel) CloseWithResult(result, errCode uint16, msg string) error {
+	if err := validateStopCCNResult(result, errCode); err != nil {
+		return err
+	}
+	st.Close()
+	return nil
+}
+
 func (st *staticTunnel) Close() {
 	if st != nil {
 
 		st.baseTunnel.closeAllSessions()
-
-		if st.dp != nil {
-			err := st.dp.Down()
-			if err != nil {
-				level.Error(st.logger).Log("message", "dataplane down failed", "error", err)
-			}
-		}
-
+		st.downDataPlane()
 		st.parent.unlinkTunnel(st)
 
 		level.Info(st.logger).Log("message", "close")
 	}
 }
 
+// kill tears down the tunnel data plane.  Static tunnels have no control
+// protocol exchange to wait for, so kill only unblocks a Close which is
+// stuck tearing down the session data plane.
+func (st *staticTunnel) kill() {
+	st.downDataPlane()
+}
+
+// downDataPlane tears down the tunnel data plane, unless it has already
+// been torn down.
+func (st *staticTunnel) downDataPlane() {
+	st.dpLock.Lock()
+	dp := st.dp
+	st.dp = nil
+	st.dpLock.Unlock()
+
+	if dp != nil {
+		st.parent.preTunnelDown(st)
+		err := dp.Down()
+		if err != nil {
+			level.Error(st.logger).Log("message", "dataplane down failed", "error", err)
+		}
+	}
+}
+
 func newStaticTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) (st *staticTunnel, err error) {
 	st = &staticTunnel{
 		baseTunnel: newBaseTunnel(
-			log.With(parent.logger, "tunnel_name", name),
+			parent.logger,
 			name,
 			parent,
 			cfg),
+		sal: sal,
+	}
+
+	err = parent.preTunnelUp(st)
+	if err != nil {
+		st.Close()
+		return nil, err
 	}
 
 	st.dp, err = parent.dp.NewTunnel(st.cfg, sal, sap, -1)
@@ -88,13 +164,17 @@ func newStaticTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *
 		return nil, err
 	}
 
+	err = parent.postTunnelUp(st)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+
 	level.Info(st.logger).Log(
 		"message", "new static tunnel",
-		"version", cfg.Version,
 		"encap", cfg.Encap,
 		"local", cfg.Local,
 		"peer", cfg.Peer,
-		"tunnel_id", cfg.TunnelID,
 		"peer_tunnel_id", cfg.PeerTunnelID)
 
 	return
@@ -107,12 +187,17 @@ func newStaticSession(name string, parent tunnel, cfg *SessionConfig) (ss *stati
 
 	ss = &staticSession{
 		baseSession: newBaseSession(
-			log.With(parent.getLogger(), "session_name", name),
+			parent.getLogger(),
 			name,
 			parent,
 			cfg),
 	}
 
+	err = parent.getContext().preSessionUp(ss.logger, parent, ss)
+	if err != nil {
+		return nil, err
+	}
+
 	ss.dp, err = parent.getDP().NewSession(tid, ptid, ss.cfg)
 	if err != nil {
 		return nil, err
@@ -124,9 +209,15 @@ func newStaticSession(name string, parent tunnel, cfg *SessionConfig) (ss *stati
 		return nil, err
 	}
 
+	err = parent.getContext().postSessionUp(ss.logger, parent, ss, ss.ifname)
+	if err != nil {
+		parent.getContext().preSessionDown(ss.logger, parent, ss, ss.ifname)
+		ss.dp.Down()
+		return nil, err
+	}
+
 	level.Info(ss.logger).Log(
 		"message", "new static session",
-		"session_id", ss.cfg.SessionID,
 		"peer_session_id", ss.cfg.PeerSessionID,
 		"pseudowire", ss.cfg.Pseudowire)
 
@@ -140,12 +231,20 @@ func newStaticSession(name string, parent tunnel, cfg *SessionConfig) (ss *stati
 		InterfaceName: ss.ifname,
 	})
 
+	ss.cookieMon = startCookieMonitor(ss.logger, ss.parent, ss, ss.ifname)
+
 	return
 }
 
 func (ss *staticSession) Close() {
+	ss.cookieMon.stop()
+	ss.cookieMon = nil
+
+	ss.parent.retireSessionStatistics(ss)
+
 	if ss.dp != nil {
-		err := ss.dp.Down()
+		ss.parent.getContext().preSessionDown(ss.logger, ss.parent, ss, ss.ifname)
+		err := downSessionDataPlane(ss.cfg, ss.dp, ss.drained)
 		if err != nil {
 			level.Error(ss.logger).Log("message", "dataplane down failed", "error", err)
 		}
@@ -165,6 +264,38 @@ func (ss *staticSession) Close() {
 	level.Info(ss.logger).Log("message", "close")
 }
 
+func (ss *staticSession) GetStatistics() (*SessionDataPlaneStatistics, error) {
+	return ss.dp.GetStatistics()
+}
+
+func (ss *staticSession) InterfaceIndex() (int, string, error) {
+	return sessionInterfaceIndex(ss.dp)
+}
+
+func (ss *staticSession) Modify(cfg *SessionConfig) error {
+	if cfg == nil {
+		return fmt.Errorf("invalid nil config")
+	}
+	err := modifySessionDataPlane(ss.dp, ss.modifiedCfg(cfg))
+	if err != nil {
+		return err
+	}
+	applySessionModify(ss.cfg, cfg)
+	return nil
+}
+
+func (ss *staticSession) drainInterface() time.Duration {
+	if ss.dp == nil || ss.drained {
+		return 0
+	}
+	ss.drained = true
+	d, err := drainSessionDataPlane(ss.cfg, ss.dp)
+	if err != nil {
+		level.Error(ss.logger).Log("message", "dataplane drain failed", "error", err)
+	}
+	return d
+}
+
 func (ss *staticSession) kill() {
 	ss.Close()
 }
@@ -0,0 +1,2584 @@
+package l2tp
+
+// Static and quiescent tunnel tests using the null dataplane.
+// Tests requiring root permissions are implemented in l2tp_test.go.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katalix/go-l2tp/internal/nll2tp"
+	"golang.org/x/sys/unix"
+)
+
+type testSessionEventRecorder struct {
+	testEventCounter
+	up   []*SessionUpEvent
+	down []*SessionDownEvent
+}
+
+func (ser *testSessionEventRecorder) HandleEvent(event interface{}) {
+	ser.testEventCounter.HandleEvent(event)
+	switch ev := event.(type) {
+	case *SessionUpEvent:
+		ser.up = append(ser.up, ev)
+	case *SessionDownEvent:
+		ser.down = append(ser.down, ev)
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+	cases := []struct {
+		name string
+		tcfg *TunnelConfig
+		scfg *SessionConfig
+		mkfn func(ctx *Context, name string, cfg *TunnelConfig) (Tunnel, error)
+	}{
+		{
+			name: "static",
+			tcfg: &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "127.0.0.1:5000",
+				Version:      ProtocolVersion3,
+				TunnelID:     62719,
+				PeerTunnelID: 23451,
+				Encap:        EncapTypeUDP,
+			},
+			scfg: &SessionConfig{
+				SessionID:     1234,
+				PeerSessionID: 4567,
+				Pseudowire:    PseudowireTypeEth,
+			},
+			mkfn: (*Context).NewStaticTunnel,
+		},
+		{
+			name: "quiescent",
+			tcfg: &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "127.0.0.1:5000",
+				Version:      ProtocolVersion2,
+				TunnelID:     62719,
+				PeerTunnelID: 23451,
+				Encap:        EncapTypeUDP,
+			},
+			scfg: &SessionConfig{
+				SessionID:     1234,
+				PeerSessionID: 4567,
+				Pseudowire:    PseudowireTypePPP,
+			},
+			mkfn: (*Context).NewQuiescentTunnel,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, err := NewContext(nil, nil)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			recorder := &testSessionEventRecorder{}
+			ctx.RegisterEventHandler(recorder)
+
+			tunl, err := c.mkfn(ctx, "t1", c.tcfg)
+			if err != nil {
+				t.Fatalf("create tunnel: %v", err)
+			}
+
+			sess, err := tunl.NewSession("s1", c.scfg)
+			if err != nil {
+				t.Fatalf("NewSession(%q, %v): %v", "s1", c.scfg, err)
+			}
+
+			sess.Close()
+			tunl.Close()
+
+			expect := eventCounters{tunnelUp: 0, tunnelDown: 0, sessionUp: 1, sessionDown: 1}
+			got := recorder.getEventCounts()
+			if expect != got {
+				t.Fatalf("expected %v events, got %v", expect, got)
+			}
+
+			up, down := recorder.up[0], recorder.down[0]
+			if up.TunnelName != "t1" || up.SessionName != "s1" || up.Session != sess {
+				t.Errorf("bad session up event: %+v", up)
+			}
+			if up.SessionConfig.SessionID != c.scfg.SessionID ||
+				up.SessionConfig.PeerSessionID != c.scfg.PeerSessionID {
+				t.Errorf("session up event IDs %v/%v, expected %v/%v",
+					up.SessionConfig.SessionID, up.SessionConfig.PeerSessionID,
+					c.scfg.SessionID, c.scfg.PeerSessionID)
+			}
+			if down.TunnelName != "t1" || down.SessionName != "s1" || down.Session != sess {
+				t.Errorf("bad session down event: %+v", down)
+			}
+		})
+	}
+}
+
+func TestListTunnelsAndSessions(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	if tunnels := ctx.ListTunnels(); len(tunnels) != 0 {
+		t.Fatalf("expected no tunnels, got %v", tunnels)
+	}
+
+	tcfgs := map[string]*TunnelConfig{
+		"t2": {
+			Local:        "127.0.0.1:6000",
+			Peer:         "127.0.0.1:5000",
+			Version:      ProtocolVersion3,
+			TunnelID:     2,
+			PeerTunnelID: 20,
+			Encap:        EncapTypeUDP,
+		},
+		"t1": {
+			Local:        "127.0.0.1:6001",
+			Peer:         "127.0.0.1:5001",
+			Version:      ProtocolVersion3,
+			TunnelID:     1,
+			PeerTunnelID: 10,
+			Encap:        EncapTypeUDP,
+		},
+	}
+	for name, tcfg := range tcfgs {
+		_, err = ctx.NewStaticTunnel(name, tcfg)
+		if err != nil {
+			t.Fatalf("NewStaticTunnel(%q, %v): %v", name, tcfg, err)
+		}
+	}
+
+	tunnels := ctx.ListTunnels()
+	if len(tunnels) != 2 || tunnels[0].Name() != "t1" || tunnels[1].Name() != "t2" {
+		t.Fatalf("unexpected tunnel list %v", tunnels)
+	}
+
+	tunl := tunnels[0]
+	for i, name := range []string{"sb", "sa"} {
+		_, err = tunl.NewSession(name, &SessionConfig{
+			SessionID:     ControlConnID(100 + i),
+			PeerSessionID: ControlConnID(200 + i),
+			Pseudowire:    PseudowireTypeEth,
+		})
+		if err != nil {
+			t.Fatalf("NewSession(%q): %v", name, err)
+		}
+	}
+
+	sessions := tunl.ListSessions()
+	if len(sessions) != 2 || sessions[0].Name() != "sa" || sessions[1].Name() != "sb" {
+		t.Fatalf("unexpected session list %v", sessions)
+	}
+
+	s, ok := tunl.FindSessionByName("sb")
+	if !ok || s != sessions[1] {
+		t.Errorf("FindSessionByName(%q): got %v, %v", "sb", s, ok)
+	}
+	if _, ok = tunl.FindSessionByName("sc"); ok {
+		t.Errorf("FindSessionByName(%q): unexpectedly found session", "sc")
+	}
+
+	s.Close()
+	if sessions = tunl.ListSessions(); len(sessions) != 1 || sessions[0].Name() != "sa" {
+		t.Errorf("unexpected session list after close %v", sessions)
+	}
+
+	tunl.Close()
+	if tunnels = ctx.ListTunnels(); len(tunnels) != 1 || tunnels[0].Name() != "t2" {
+		t.Errorf("unexpected tunnel list after close %v", tunnels)
+	}
+}
+
+type testEventCallCounter struct {
+	calls int
+}
+
+func (tc *testEventCallCounter) HandleEvent(event interface{}) {
+	tc.calls++
+}
+
+func TestUnregisterEventHandler(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	handlers := []*testEventCallCounter{{}, {}, {}}
+	for _, h := range handlers {
+		ctx.RegisterEventHandler(h)
+	}
+
+	ctx.UnregisterEventHandler(handlers[1])
+	ctx.handleUserEvent(&TunnelUpEvent{})
+
+	for i, expect := range []int{1, 0, 1} {
+		if handlers[i].calls != expect {
+			t.Errorf("handler %v: expected %v calls, got %v", i, expect, handlers[i].calls)
+		}
+	}
+	if len(ctx.eventHandlers) != 2 {
+		t.Errorf("expected 2 registered handlers, got %v", len(ctx.eventHandlers))
+	}
+}
+
+// testSelfUnregisteringHandler unregisters itself, and registers a
+// follow-on handler, on receipt of its first event.
+type testSelfUnregisteringHandler struct {
+	ctx   *Context
+	next  *testEventCallCounter
+	calls int
+}
+
+func (h *testSelfUnregisteringHandler) HandleEvent(event interface{}) {
+	h.calls++
+	h.ctx.UnregisterEventHandler(h)
+	h.ctx.RegisterEventHandler(h.next)
+}
+
+func TestEventHandlerReentrancy(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	before := &testEventCallCounter{}
+	self := &testSelfUnregisteringHandler{ctx: ctx, next: &testEventCallCounter{}}
+	after := &testEventCallCounter{}
+	ctx.RegisterEventHandler(before)
+	ctx.RegisterEventHandler(self)
+	ctx.RegisterEventHandler(after)
+
+	// Dispatch would deadlock if the context's lock were held while
+	// calling handlers.
+	done := make(chan bool)
+	go func() {
+		ctx.handleUserEvent(&TunnelUpEvent{})
+		ctx.handleUserEvent(&TunnelUpEvent{})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("event dispatch blocked by handler calling into the context")
+	}
+
+	// Handlers following the self-unregistering handler still receive
+	// the event it unregistered during, and the handler it registered
+	// receives only subsequent events.
+	if before.calls != 2 || after.calls != 2 {
+		t.Errorf("expected 2 calls to other handlers, got %v and %v", before.calls, after.calls)
+	}
+	if self.calls != 1 {
+		t.Errorf("expected 1 call to self-unregistering handler, got %v", self.calls)
+	}
+	if self.next.calls != 1 {
+		t.Errorf("expected 1 call to handler registered during dispatch, got %v", self.next.calls)
+	}
+}
+
+func TestEventHandlerFunc(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	var byValue, byPointer int
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		byValue++
+	}))
+	h := EventHandlerFunc(func(event interface{}) {
+		byPointer++
+	})
+	ctx.RegisterEventHandler(&h)
+
+	ctx.handleUserEvent(&TunnelUpEvent{})
+	if byValue != 1 || byPointer != 1 {
+		t.Fatalf("expected 1 call to each handler, got %v and %v", byValue, byPointer)
+	}
+
+	// Unregistering a func value is ignored rather than panicking, while
+	// the pointer handler is removed
+	ctx.UnregisterEventHandler(EventHandlerFunc(func(event interface{}) {}))
+	ctx.UnregisterEventHandler(&h)
+
+	ctx.handleUserEvent(&TunnelUpEvent{})
+	if byValue != 2 || byPointer != 1 {
+		t.Errorf("expected 2 and 1 calls to handlers, got %v and %v", byValue, byPointer)
+	}
+}
+
+// testModifyDataPlane is a null data plane which records the tunnel
+// debug flags and the session configuration passed to modify calls.
+type testModifyDataPlane struct {
+	nullDataPlane
+	tdp *testModifyTunnelDataPlane
+	sdp *testModifySessionDataPlane
+}
+
+type testModifyTunnelDataPlane struct {
+	nullTunnelDataPlane
+	flags []DebugFlags
+}
+
+type testModifySessionDataPlane struct {
+	nullSessionDataPlane
+	modified *SessionConfig
+}
+
+func (dp *testModifyDataPlane) NewTunnel(tcfg *TunnelConfig, sal, sap unix.Sockaddr, fd int) (TunnelDataPlane, error) {
+	dp.tdp = &testModifyTunnelDataPlane{}
+	return dp.tdp, nil
+}
+
+func (tdp *testModifyTunnelDataPlane) SetDebugFlags(flags DebugFlags) error {
+	tdp.flags = append(tdp.flags, flags)
+	return nil
+}
+
+func (dp *testModifyDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	dp.sdp = &testModifySessionDataPlane{}
+	return dp.sdp, nil
+}
+
+func (sdp *testModifySessionDataPlane) Modify(cfg *SessionConfig) error {
+	sdp.modified = cfg
+	return nil
+}
+
+// testMinimalDataPlane is a null data plane whose tunnel and session
+// data planes implement only the methods of TunnelDataPlane and
+// SessionDataPlane, and none of the optional interfaces.
+type testMinimalDataPlane struct {
+	nullDataPlane
+}
+
+type testMinimalTunnelDataPlane struct{}
+
+type testMinimalSessionDataPlane struct{}
+
+func (dp *testMinimalDataPlane) NewTunnel(tcfg *TunnelConfig, sal, sap unix.Sockaddr, fd int) (TunnelDataPlane, error) {
+	return &testMinimalTunnelDataPlane{}, nil
+}
+
+func (tdp *testMinimalTunnelDataPlane) Down() error {
+	return nil
+}
+
+func (dp *testMinimalDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	return &testMinimalSessionDataPlane{}, nil
+}
+
+func (sdp *testMinimalSessionDataPlane) GetStatistics() (*SessionDataPlaneStatistics, error) {
+	return &SessionDataPlaneStatistics{}, nil
+}
+
+func (sdp *testMinimalSessionDataPlane) GetInterfaceName() (string, error) {
+	return "", nil
+}
+
+func (sdp *testMinimalSessionDataPlane) Down() error {
+	return nil
+}
+
+// testTeardownDataPlane is a null data plane which records the order
+// of session data plane teardown operations.
+type testTeardownDataPlane struct {
+	nullDataPlane
+	ops []string
+}
+
+type testTeardownSessionDataPlane struct {
+	nullSessionDataPlane
+	dp *testTeardownDataPlane
+}
+
+func (dp *testTeardownDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	return &testTeardownSessionDataPlane{dp: dp}, nil
+}
+
+func (sdp *testTeardownSessionDataPlane) InterfaceDown() error {
+	sdp.dp.ops = append(sdp.dp.ops, "interface down")
+	return nil
+}
+
+func (sdp *testTeardownSessionDataPlane) Down() error {
+	sdp.dp.ops = append(sdp.dp.ops, "down")
+	return nil
+}
+
+func TestSessionDrainTeardown(t *testing.T) {
+	cases := []struct {
+		name         string
+		drainTimeout time.Duration
+		expect       []string
+	}{
+		{
+			name:   "no drain",
+			expect: []string{"down"},
+		},
+		{
+			name:         "drain",
+			drainTimeout: 100 * time.Millisecond,
+			expect:       []string{"interface down", "down"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dp := &testTeardownDataPlane{}
+			ctx, err := NewContext(dp, nil)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "127.0.0.1:5000",
+				Version:      ProtocolVersion3,
+				TunnelID:     1,
+				PeerTunnelID: 10,
+				Encap:        EncapTypeUDP,
+			})
+			if err != nil {
+				t.Fatalf("NewStaticTunnel(): %v", err)
+			}
+			sess, err := tunl.NewSession("s1", &SessionConfig{
+				SessionID:     100,
+				PeerSessionID: 200,
+				Pseudowire:    PseudowireTypeEth,
+				DrainTimeout:  c.drainTimeout,
+			})
+			if err != nil {
+				t.Fatalf("NewSession(): %v", err)
+			}
+
+			start := time.Now()
+			sess.Close()
+			if elapsed := time.Since(start); elapsed < c.drainTimeout {
+				t.Errorf("expected teardown to take at least %v, took %v", c.drainTimeout, elapsed)
+			}
+			if !reflect.DeepEqual(dp.ops, c.expect) {
+				t.Errorf("expected data plane operations %v, got %v", c.expect, dp.ops)
+			}
+		})
+	}
+}
+
+func TestTunnelDrainTeardown(t *testing.T) {
+	const nsessions = 4
+	const drainTimeout = 200 * time.Millisecond
+
+	cases := []struct {
+		name       string
+		dp         DataPlane
+		drain      bool
+		interfaces int
+	}{
+		{
+			name:       "drain",
+			dp:         NewMockDataPlane(),
+			drain:      true,
+			interfaces: nsessions,
+		},
+		{
+			name: "no drainer",
+			dp:   &testMinimalDataPlane{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, err := NewContext(c.dp, nil)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "127.0.0.1:5000",
+				Version:      ProtocolVersion3,
+				TunnelID:     1,
+				PeerTunnelID: 10,
+				Encap:        EncapTypeUDP,
+			})
+			if err != nil {
+				t.Fatalf("NewStaticTunnel(): %v", err)
+			}
+			for i := 1; i <= nsessions; i++ {
+				_, err = tunl.NewSession(fmt.Sprintf("s%d", i), &SessionConfig{
+					SessionID:     ControlConnID(100 + i),
+					PeerSessionID: ControlConnID(200 + i),
+					Pseudowire:    PseudowireTypeEth,
+					DrainTimeout:  drainTimeout,
+				})
+				if err != nil {
+					t.Fatalf("NewSession(): %v", err)
+				}
+			}
+
+			start := time.Now()
+			tunl.Close()
+			elapsed := time.Since(start)
+			if c.drain && elapsed < drainTimeout {
+				t.Errorf("expected teardown to take at least %v, took %v", drainTimeout, elapsed)
+			}
+			if elapsed >= 2*drainTimeout {
+				t.Errorf("expected sessions to drain concurrently, teardown took %v", elapsed)
+			}
+
+			if mdp, ok := c.dp.(*MockDataPlane); ok {
+				interfaces := 0
+				for _, call := range mdp.Calls() {
+					if call.Op == MockOpSessionInterfaceDown {
+						interfaces++
+					}
+				}
+				if interfaces != c.interfaces {
+					t.Errorf("expected %v session interfaces down, got %v", c.interfaces, interfaces)
+				}
+			}
+		})
+	}
+}
+
+func TestTunnelStatistics(t *testing.T) {
+	dp := NewMockDataPlane()
+	ctx, err := NewContext(dp, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	sessions := []Session{}
+	for i := 1; i <= 2; i++ {
+		sid := ControlConnID(100 + i)
+		dp.SetSessionStatistics(sid, &SessionDataPlaneStatistics{
+			TxPackets: uint64(i),
+			TxBytes:   uint64(100 * i),
+			RxPackets: uint64(10 * i),
+			RxBytes:   uint64(1000 * i),
+		})
+		s, err := tunl.NewSession(fmt.Sprintf("s%d", i), &SessionConfig{
+			SessionID:     sid,
+			PeerSessionID: sid + 100,
+			Pseudowire:    PseudowireTypeEth,
+		})
+		if err != nil {
+			t.Fatalf("NewSession(): %v", err)
+		}
+		sessions = append(sessions, s)
+	}
+
+	expect := TunnelStatistics{
+		Data: SessionDataPlaneStatistics{
+			TxPackets: 3,
+			TxBytes:   300,
+			RxPackets: 30,
+			RxBytes:   3000,
+		},
+	}
+	if got := tunl.Statistics(); got != expect {
+		t.Errorf("expected statistics %+v, got %+v", expect, got)
+	}
+
+	// The statistics of closed sessions are retained in the totals
+	sessions[0].Close()
+	if got := tunl.Statistics(); got != expect {
+		t.Errorf("after closing session: expected statistics %+v, got %+v", expect, got)
+	}
+	tunl.Close()
+	if got := tunl.Statistics(); got != expect {
+		t.Errorf("after closing tunnel: expected statistics %+v, got %+v", expect, got)
+	}
+}
+
+func TestSessionModify(t *testing.T) {
+	dp := &testModifyDataPlane{}
+	ctx, err := NewContext(dp, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	scfg := &SessionConfig{
+		SessionID:     100,
+		PeerSessionID: 1000,
+		Pseudowire:    PseudowireTypeEth,
+		InterfaceName: "l2tpeth42",
+	}
+	sess, err := tunl.NewSession("s1", scfg)
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	err = sess.Modify(nil)
+	if err == nil {
+		t.Errorf("Modify(nil): expected error")
+	}
+
+	// Only sequencing, reorder timeout, and debug flags may be modified:
+	// other changes must be ignored.
+	err = sess.Modify(&SessionConfig{
+		SessionID:      200,
+		PeerSessionID:  2000,
+		Pseudowire:     PseudowireTypePPP,
+		InterfaceName:  "l2tpeth99",
+		SeqNum:         true,
+		ReorderTimeout: 250 * time.Millisecond,
+		DebugFlags:     DebugFlagsSeq,
+	})
+	if err != nil {
+		t.Fatalf("Modify(): %v", err)
+	}
+
+	expect := *scfg
+	expect.SeqNum = true
+	expect.ReorderTimeout = 250 * time.Millisecond
+	expect.DebugFlags = DebugFlagsSeq
+
+	if dp.sdp.modified == nil {
+		t.Fatalf("session data plane wasn't modified")
+	}
+	if !reflect.DeepEqual(*dp.sdp.modified, expect) {
+		t.Errorf("data plane modify: expected %+v, got %+v", expect, *dp.sdp.modified)
+	}
+	if got := sess.(*staticSession).cfg; !reflect.DeepEqual(*got, expect) {
+		t.Errorf("session config: expected %+v, got %+v", expect, *got)
+	}
+}
+
+func TestSessionModifyNotSupported(t *testing.T) {
+	ctx, err := NewContext(&testMinimalDataPlane{}, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	sess, err := tunl.NewSession("s1", &SessionConfig{
+		SessionID:     100,
+		PeerSessionID: 1000,
+		Pseudowire:    PseudowireTypeEth,
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	err = sess.Modify(&SessionConfig{SeqNum: true})
+	if !errors.Is(err, ErrModifyNotSupported) {
+		t.Errorf("Modify(): expected %v, got %v", ErrModifyNotSupported, err)
+	}
+	if sess.(*staticSession).cfg.SeqNum {
+		t.Errorf("session config modified despite data plane failure")
+	}
+}
+
+func TestTunnelSetDebugFlags(t *testing.T) {
+	cases := []struct {
+		name string
+		tcfg *TunnelConfig
+		mkfn func(ctx *Context, name string, cfg *TunnelConfig) (Tunnel, error)
+	}{
+		{
+			name: "static",
+			tcfg: &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "127.0.0.1:5000",
+				Version:      ProtocolVersion3,
+				TunnelID:     1,
+				PeerTunnelID: 10,
+				Encap:        EncapTypeUDP,
+			},
+			mkfn: (*Context).NewStaticTunnel,
+		},
+		{
+			name: "quiescent",
+			tcfg: &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "127.0.0.1:5000",
+				Version:      ProtocolVersion2,
+				TunnelID:     1,
+				PeerTunnelID: 10,
+				Encap:        EncapTypeUDP,
+			},
+			mkfn: (*Context).NewQuiescentTunnel,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dp := &testModifyDataPlane{}
+			ctx, err := NewContext(dp, nil)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			tunl, err := c.mkfn(ctx, "t1", c.tcfg)
+			if err != nil {
+				t.Fatalf("create tunnel: %v", err)
+			}
+
+			// Turn on verbose logging, then turn it off again
+			expect := []DebugFlags{DebugFlagsControl | DebugFlagsDebug, 0}
+			for _, flags := range expect {
+				err = tunl.SetDebugFlags(flags)
+				if err != nil {
+					t.Fatalf("SetDebugFlags(%v): %v", flags, err)
+				}
+			}
+
+			if !reflect.DeepEqual(dp.tdp.flags, expect) {
+				t.Errorf("expected data plane debug flags %v, got %v", expect, dp.tdp.flags)
+			}
+			if c.tcfg.DebugFlags != 0 {
+				t.Errorf("user's tunnel config was modified")
+			}
+		})
+	}
+}
+
+func TestTunnelSetDebugFlagsNotSupported(t *testing.T) {
+	ctx, err := NewContext(&testMinimalDataPlane{}, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	err = tunl.SetDebugFlags(DebugFlagsControl)
+	if !errors.Is(err, ErrDebugFlagsNotSupported) {
+		t.Errorf("SetDebugFlags(): expected %v, got %v", ErrDebugFlagsNotSupported, err)
+	}
+	if tunl.(*staticTunnel).cfg.DebugFlags != 0 {
+		t.Errorf("tunnel config modified despite data plane failure")
+	}
+}
+
+func TestSessionIDScope(t *testing.T) {
+	// The first value is consumed by the context's call serial number,
+	// following values are used for session ID allocation.
+	src := &testRandSource{values: []uint32{0, 42, 43}}
+	ctx, err := NewContextWithOptions(nil, nil, WithRand(rand.New(src)))
+	if err != nil {
+		t.Fatalf("NewContextWithOptions(): %v", err)
+	}
+	defer ctx.Close()
+
+	v3cfg := func(tid ControlConnID) *TunnelConfig {
+		return &TunnelConfig{
+			Local:        "127.0.0.1:6000",
+			Peer:         "127.0.0.1:5000",
+			Version:      ProtocolVersion3,
+			TunnelID:     tid,
+			PeerTunnelID: tid * 10,
+			Encap:        EncapTypeUDP,
+		}
+	}
+	v3scfg := &SessionConfig{SessionID: 42, PeerSessionID: 4200, Pseudowire: PseudowireTypeEth}
+
+	t1, err := ctx.NewStaticTunnel("t1", v3cfg(1))
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+	t2, err := ctx.NewStaticTunnel("t2", v3cfg(2))
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+	s1, err := t1.NewSession("s1", v3scfg)
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	// L2TPv3 session IDs must be unique across all tunnels
+	_, err = t2.NewSession("s1", v3scfg)
+	if !errors.Is(err, ErrSessionIDExists) {
+		t.Errorf("NewSession() with session ID in use in another tunnel: expected %v, got %v",
+			ErrSessionIDExists, err)
+	}
+	sid, err := t2.(*staticTunnel).allocSid()
+	if err != nil {
+		t.Fatalf("allocSid(): %v", err)
+	}
+	if sid != 43 {
+		t.Errorf("allocSid(): expected session ID 43, got %v", sid)
+	}
+
+	// Once the session is closed its ID may be reused
+	s1.Close()
+	if _, err = t2.NewSession("s1", v3scfg); err != nil {
+		t.Errorf("NewSession() with session ID freed by another tunnel: %v", err)
+	}
+
+	// L2TPv2 session IDs need only be unique within the tunnel
+	v2scfg := &SessionConfig{SessionID: 42, PeerSessionID: 4200, Pseudowire: PseudowireTypePPP}
+	for i, local := range []string{"127.0.0.1:6001", "127.0.0.1:6002"} {
+		tunl, err := ctx.NewQuiescentTunnel(fmt.Sprintf("v2t%d", i), &TunnelConfig{
+			Local:        local,
+			Peer:         "127.0.0.1:5000",
+			Version:      ProtocolVersion2,
+			TunnelID:     ControlConnID(10 + i),
+			PeerTunnelID: 100,
+			Encap:        EncapTypeUDP,
+		})
+		if err != nil {
+			t.Fatalf("NewQuiescentTunnel(): %v", err)
+		}
+		if _, err = tunl.NewSession("s1", v2scfg); err != nil {
+			t.Errorf("NewSession() in L2TPv2 tunnel %d: %v", i, err)
+		}
+	}
+}
+
+// testLogRecorder is a log.Logger which records each log line as a map
+// of key to value.
+type testLogRecorder struct {
+	lock  sync.Mutex
+	lines []map[string]interface{}
+}
+
+func (lr *testLogRecorder) Log(keyvals ...interface{}) error {
+	line := make(map[string]interface{})
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		line[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+	lr.lines = append(lr.lines, line)
+	return nil
+}
+
+func (lr *testLogRecorder) find(message string) map[string]interface{} {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+	for _, line := range lr.lines {
+		if line["message"] == message {
+			return line
+		}
+	}
+	return nil
+}
+
+func TestLogContext(t *testing.T) {
+	lr := &testLogRecorder{}
+	ctx, err := NewContext(nil, lr)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewQuiescentTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewQuiescentTunnel(): %v", err)
+	}
+	_, err = tunl.NewSession("s1", &SessionConfig{
+		SessionID:     100,
+		PeerSessionID: 1000,
+		Pseudowire:    PseudowireTypeEth,
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	tunl.Close()
+
+	tunnelKeys := map[string]interface{}{
+		"tunnel_name": "t1",
+		"tunnel_id":   ControlConnID(1),
+		"version":     ProtocolVersion3,
+	}
+	sessionKeys := map[string]interface{}{
+		"session_name": "s1",
+		"session_id":   ControlConnID(100),
+	}
+	check := func(message string, keys ...map[string]interface{}) {
+		line := lr.find(message)
+		if line == nil {
+			t.Errorf("no log line with message %q", message)
+			return
+		}
+		for _, kv := range keys {
+			for k, v := range kv {
+				if fmt.Sprint(line[k]) != fmt.Sprint(v) {
+					t.Errorf("log line %q: expected %v=%v, got %v", message, k, v, line[k])
+				}
+			}
+		}
+	}
+	check("new quiescent tunnel", tunnelKeys)
+	check("new static session", tunnelKeys, sessionKeys)
+	if line := lr.find("new quiescent tunnel"); line != nil {
+		if _, ok := line["session_name"]; ok {
+			t.Errorf("tunnel log line tagged with session name")
+		}
+	}
+}
+
+func TestCreationErrors(t *testing.T) {
+	// The first value is consumed by the context's call serial number,
+	// following values always collide with the static tunnel ID.
+	src := &testRandSource{values: []uint32{0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}}
+	ctx, err := NewContextWithOptions(nil, nil, WithRand(rand.New(src)))
+	if err != nil {
+		t.Fatalf("NewContextWithOptions(): %v", err)
+	}
+	defer ctx.Close()
+
+	tcfg := &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        EncapTypeUDP,
+	}
+	tunl, err := ctx.NewStaticTunnel("t1", tcfg)
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	scfg := &SessionConfig{
+		SessionID:     100,
+		PeerSessionID: 1000,
+		Pseudowire:    PseudowireTypeEth,
+	}
+	_, err = tunl.NewSession("s1", scfg)
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	badAddr := *tcfg
+	badAddr.TunnelID = 2
+	badAddr.Peer = "not-an-address"
+
+	cases := []struct {
+		name   string
+		create func() error
+		expect error
+	}{
+		{
+			name: "tunnel name exists",
+			create: func() error {
+				cfg := *tcfg
+				cfg.TunnelID = 2
+				_, err := ctx.NewStaticTunnel("t1", &cfg)
+				return err
+			},
+			expect: ErrTunnelNameExists,
+		},
+		{
+			name: "tunnel ID exists",
+			create: func() error {
+				_, err := ctx.NewQuiescentTunnel("t2", tcfg)
+				return err
+			},
+			expect: ErrTunnelIDExists,
+		},
+		{
+			name: "tunnel ID space exhausted",
+			create: func() error {
+				_, err := ctx.NewDynamicTunnel("t2", &TunnelConfig{
+					Peer:    "127.0.0.1:5000",
+					Version: ProtocolVersion3,
+					Encap:   EncapTypeUDP,
+				})
+				return err
+			},
+			expect: ErrIDSpaceExhausted,
+		},
+		{
+			name: "session name exists",
+			create: func() error {
+				cfg := *scfg
+				cfg.SessionID = 200
+				_, err := tunl.NewSession("s1", &cfg)
+				return err
+			},
+			expect: ErrSessionNameExists,
+		},
+		{
+			name: "session ID exists",
+			create: func() error {
+				_, err := tunl.NewSession("s2", scfg)
+				return err
+			},
+			expect: ErrSessionIDExists,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.create()
+			if !errors.Is(err, c.expect) {
+				t.Errorf("expected error %q, got %v", c.expect, err)
+			}
+		})
+	}
+
+	t.Run("bad address", func(t *testing.T) {
+		_, err := ctx.NewStaticTunnel("t2", &badAddr)
+		var addrErr *AddressError
+		if !errors.As(err, &addrErr) {
+			t.Fatalf("expected AddressError, got %v", err)
+		}
+		if addrErr.Address != badAddr.Peer || addrErr.Local || addrErr.Err == nil {
+			t.Errorf("unexpected AddressError %+v", addrErr)
+		}
+	})
+}
+
+func TestNewSessionValidation(t *testing.T) {
+	v2cfg := &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion2,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        EncapTypeUDP,
+	}
+	v3cfg := &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        EncapTypeUDP,
+	}
+	// No peer is running, so avoid waiting long for retransmission to
+	// give up when the dynamic tunnel is closed.
+	dynv2cfg := &TunnelConfig{
+		Local:        "127.0.0.1:0",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion2,
+		Encap:        EncapTypeUDP,
+		RetryTimeout: 50 * time.Millisecond,
+		MaxRetries:   1,
+	}
+
+	cases := []struct {
+		name   string
+		tcfg   *TunnelConfig
+		mkfn   func(ctx *Context, name string, cfg *TunnelConfig) (Tunnel, error)
+		scfg   *SessionConfig
+		expect error
+	}{
+		{
+			name:   "quiescent L2TPv2 Ethernet pseudowire",
+			tcfg:   v2cfg,
+			mkfn:   (*Context).NewQuiescentTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypeEth},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "dynamic L2TPv2 Ethernet pseudowire",
+			tcfg:   dynv2cfg,
+			mkfn:   (*Context).NewDynamicTunnel,
+			scfg:   &SessionConfig{Pseudowire: PseudowireTypeEth},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "quiescent L2TPv2 cookie",
+			tcfg:   v2cfg,
+			mkfn:   (*Context).NewQuiescentTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypePPP, Cookie: []byte{1, 2, 3, 4}},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "dynamic L2TPv2 peer cookie",
+			tcfg:   dynv2cfg,
+			mkfn:   (*Context).NewDynamicTunnel,
+			scfg:   &SessionConfig{Pseudowire: PseudowireTypePPP, PeerCookie: []byte{1, 2, 3, 4}},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "quiescent L2TPv2 cookie check interval",
+			tcfg:   v2cfg,
+			mkfn:   (*Context).NewQuiescentTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypePPP, CookieCheckInterval: time.Second},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "quiescent L2TPv2 PPP pseudowire bridge",
+			tcfg:   v2cfg,
+			mkfn:   (*Context).NewQuiescentTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypePPP, Bridge: "br0"},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "quiescent L2TPv2 PPP pseudowire drain timeout",
+			tcfg:   v2cfg,
+			mkfn:   (*Context).NewQuiescentTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypePPP, DrainTimeout: time.Second},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "quiescent L2TPv2 L2 specific sublayer",
+			tcfg:   v2cfg,
+			mkfn:   (*Context).NewQuiescentTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypePPP, L2SpecType: L2SpecTypeDefault},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "quiescent PPP admin up",
+			tcfg:   v2cfg,
+			mkfn:   (*Context).NewQuiescentTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypePPP, AdminUp: true},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "static bad address",
+			tcfg:   v3cfg,
+			mkfn:   (*Context).NewStaticTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypeEth, Address: "192.0.2.1"},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "static peer address without address",
+			tcfg:   v3cfg,
+			mkfn:   (*Context).NewStaticTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypeEth, PeerAddress: "192.0.2.2"},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "static mismatched peer address family",
+			tcfg:   v3cfg,
+			mkfn:   (*Context).NewStaticTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypeEth, Address: "192.0.2.1/32", PeerAddress: "2001:db8::2"},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "static L2TPv3 bearer type",
+			tcfg:   v3cfg,
+			mkfn:   (*Context).NewStaticTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypeEth, BearerType: BearerCapDigital},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "static L2TPv3 framing type",
+			tcfg:   v3cfg,
+			mkfn:   (*Context).NewStaticTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypeEth, FramingType: FramingCapSync},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "static L2TPv3 maximum BPS",
+			tcfg:   v3cfg,
+			mkfn:   (*Context).NewStaticTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypeEth, MaximumBPS: 64000},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "quiescent L2TPv2 remote end ID",
+			tcfg:   v2cfg,
+			mkfn:   (*Context).NewQuiescentTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypePPP, RemoteEndID: []byte("pw1")},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "quiescent unknown bearer type",
+			tcfg:   v2cfg,
+			mkfn:   (*Context).NewQuiescentTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypePPP, BearerType: 0x4},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "quiescent unknown framing type",
+			tcfg:   v2cfg,
+			mkfn:   (*Context).NewQuiescentTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypePPP, FramingType: 0x4},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "quiescent minimum BPS exceeds maximum",
+			tcfg:   v2cfg,
+			mkfn:   (*Context).NewQuiescentTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypePPP, MinimumBPS: 64000, MaximumBPS: 9600},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "static unknown L2 specific sublayer",
+			tcfg:   v3cfg,
+			mkfn:   (*Context).NewStaticTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypeEth, L2SpecType: L2SpecTypeDefault + 1},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "static MTU out of range",
+			tcfg:   v3cfg,
+			mkfn:   (*Context).NewStaticTunnel,
+			scfg:   &SessionConfig{SessionID: 100, PeerSessionID: 1000, Pseudowire: PseudowireTypeEth, MTU: 65536},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "static zero session ID",
+			tcfg:   v3cfg,
+			mkfn:   (*Context).NewStaticTunnel,
+			scfg:   &SessionConfig{PeerSessionID: 1000, Pseudowire: PseudowireTypeEth},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "static zero peer session ID",
+			tcfg:   v3cfg,
+			mkfn:   (*Context).NewStaticTunnel,
+			scfg:   &SessionConfig{SessionID: 100, Pseudowire: PseudowireTypeEth},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "quiescent zero session ID",
+			tcfg:   v2cfg,
+			mkfn:   (*Context).NewQuiescentTunnel,
+			scfg:   &SessionConfig{PeerSessionID: 1000, Pseudowire: PseudowireTypePPP},
+			expect: ErrInvalidSessionConfig,
+		},
+		{
+			name:   "static duplicate session ID",
+			tcfg:   v3cfg,
+			mkfn:   (*Context).NewStaticTunnel,
+			scfg:   &SessionConfig{SessionID: 42, PeerSessionID: 1000, Pseudowire: PseudowireTypeEth},
+			expect: ErrSessionIDExists,
+		},
+		{
+			name:   "quiescent duplicate session ID",
+			tcfg:   v2cfg,
+			mkfn:   (*Context).NewQuiescentTunnel,
+			scfg:   &SessionConfig{SessionID: 42, PeerSessionID: 1000, Pseudowire: PseudowireTypePPP},
+			expect: ErrSessionIDExists,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dp := &testModifyDataPlane{}
+			ctx, err := NewContext(dp, nil)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			tunl, err := c.mkfn(ctx, "t1", c.tcfg)
+			if err != nil {
+				t.Fatalf("create tunnel: %v", err)
+			}
+
+			// Create a session for the duplicate ID checks
+			if c.tcfg != dynv2cfg {
+				pw := PseudowireType(PseudowireTypeEth)
+				if c.tcfg.Version == ProtocolVersion2 {
+					pw = PseudowireTypePPP
+				}
+				_, err = tunl.NewSession("s0", &SessionConfig{SessionID: 42, PeerSessionID: 4200, Pseudowire: pw})
+				if err != nil {
+					t.Fatalf("NewSession(): %v", err)
+				}
+				dp.sdp = nil
+			}
+
+			_, err = tunl.NewSession("s1", c.scfg)
+			if !errors.Is(err, c.expect) {
+				t.Fatalf("NewSession(%+v): expected error %q, got %v", c.scfg, c.expect, err)
+			}
+			if dp.sdp != nil {
+				t.Errorf("NewSession(%+v): data plane was created", c.scfg)
+			}
+		})
+	}
+}
+
+func TestMockDataPlane(t *testing.T) {
+	cases := []struct {
+		name   string
+		mkfn   func(ctx *Context, name string, cfg *TunnelConfig) (Tunnel, error)
+		static bool
+	}{
+		{
+			name:   "static",
+			mkfn:   (*Context).NewStaticTunnel,
+			static: true,
+		},
+		{
+			name: "quiescent",
+			mkfn: (*Context).NewQuiescentTunnel,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dp := NewMockDataPlane()
+			ctx, err := NewContext(dp, nil)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+
+			tcfg := &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "127.0.0.1:5000",
+				Version:      ProtocolVersion3,
+				TunnelID:     1,
+				PeerTunnelID: 10,
+				Encap:        EncapTypeUDP,
+			}
+			tunl, err := c.mkfn(ctx, "t1", tcfg)
+			if err != nil {
+				t.Fatalf("%s tunnel: %v", c.name, err)
+			}
+			scfg := &SessionConfig{
+				SessionID:     100,
+				PeerSessionID: 200,
+				Pseudowire:    PseudowireTypeEth,
+				InterfaceName: "l2tpeth42",
+			}
+			sess, err := tunl.NewSession("s1", scfg)
+			if err != nil {
+				t.Fatalf("NewSession(): %v", err)
+			}
+			if _, err := sess.GetStatistics(); err != nil {
+				t.Errorf("GetStatistics(): %v", err)
+			}
+
+			sess.Close()
+			tunl.Close()
+			ctx.Close()
+
+			calls := dp.Calls()
+			expectOps := []MockDataPlaneOp{
+				MockOpNewTunnel,
+				MockOpNewSession,
+				MockOpSessionDown,
+				MockOpTunnelDown,
+				MockOpClose,
+			}
+			if len(calls) != len(expectOps) {
+				t.Fatalf("expected %d calls, got %d: %+v", len(expectOps), len(calls), calls)
+			}
+			for i, op := range expectOps {
+				if calls[i].Op != op {
+					t.Errorf("call %d: expected %v, got %v", i, op, calls[i].Op)
+				}
+			}
+
+			if !reflect.DeepEqual(calls[0].TunnelConfig, tcfg) {
+				t.Errorf("NewTunnel: expected config %+v, got %+v", tcfg, calls[0].TunnelConfig)
+			}
+			if c.static && calls[0].Fd >= 0 {
+				t.Errorf("NewTunnel: expected no socket for static tunnel, got fd %d", calls[0].Fd)
+			} else if !c.static && calls[0].Fd < 0 {
+				t.Errorf("NewTunnel: expected socket for %s tunnel, got fd %d", c.name, calls[0].Fd)
+			}
+			if sal, ok := calls[0].LocalAddress.(*unix.SockaddrInet4); !ok || sal.Port != 6000 {
+				t.Errorf("NewTunnel: unexpected local address %+v", calls[0].LocalAddress)
+			}
+			if sap, ok := calls[0].PeerAddress.(*unix.SockaddrInet4); !ok || sap.Port != 5000 {
+				t.Errorf("NewTunnel: unexpected peer address %+v", calls[0].PeerAddress)
+			}
+
+			for _, i := range []int{1, 2} {
+				if calls[i].TunnelID != 1 || calls[i].PeerTunnelID != 10 {
+					t.Errorf("%v: expected tunnel IDs 1/10, got %v/%v",
+						calls[i].Op, calls[i].TunnelID, calls[i].PeerTunnelID)
+				}
+				if !reflect.DeepEqual(calls[i].SessionConfig, scfg) {
+					t.Errorf("%v: expected config %+v, got %+v", calls[i].Op, scfg, calls[i].SessionConfig)
+				}
+			}
+
+			dp.Reset()
+			if n := len(dp.Calls()); n != 0 {
+				t.Errorf("expected no calls after Reset(), got %d", n)
+			}
+		})
+	}
+}
+
+func TestUserspaceDataPlane(t *testing.T) {
+	cases := []struct {
+		name         string
+		tcfg         *TunnelConfig
+		scfg         *SessionConfig
+		txHdr, rxHdr []byte
+	}{
+		{
+			name: "L2TPv2",
+			tcfg: &TunnelConfig{
+				Version:      ProtocolVersion2,
+				TunnelID:     1,
+				PeerTunnelID: 10,
+			},
+			scfg: &SessionConfig{
+				SessionID:     100,
+				PeerSessionID: 200,
+				Pseudowire:    PseudowireTypePPP,
+			},
+			txHdr: []byte{0x00, 0x02, 0x00, 0x0a, 0x00, 0xc8},
+			rxHdr: []byte{0x00, 0x02, 0x00, 0x01, 0x00, 0x64},
+		},
+		{
+			name: "L2TPv2 seqnum",
+			tcfg: &TunnelConfig{
+				Version:      ProtocolVersion2,
+				TunnelID:     1,
+				PeerTunnelID: 10,
+			},
+			scfg: &SessionConfig{
+				SessionID:     100,
+				PeerSessionID: 200,
+				Pseudowire:    PseudowireTypePPP,
+				SeqNum:        true,
+			},
+			txHdr: []byte{0x08, 0x02, 0x00, 0x0a, 0x00, 0xc8, 0x00, 0x00, 0x00, 0x00},
+			// length and offset fields present, length covers the payload
+			rxHdr: []byte{0x4a, 0x02, 0x00, 0x18, 0x00, 0x01, 0x00, 0x64, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xff},
+		},
+		{
+			name: "L2TPv3",
+			tcfg: &TunnelConfig{
+				Version:      ProtocolVersion3,
+				TunnelID:     1,
+				PeerTunnelID: 10,
+			},
+			scfg: &SessionConfig{
+				SessionID:     100,
+				PeerSessionID: 200,
+				Pseudowire:    PseudowireTypeEth,
+			},
+			txHdr: []byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc8},
+			rxHdr: []byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x64},
+		},
+		{
+			name: "L2TPv3 cookies and sublayer",
+			tcfg: &TunnelConfig{
+				Version:      ProtocolVersion3,
+				TunnelID:     1,
+				PeerTunnelID: 10,
+			},
+			scfg: &SessionConfig{
+				SessionID:     100,
+				PeerSessionID: 200,
+				Pseudowire:    PseudowireTypeEth,
+				SeqNum:        true,
+				Cookie:        []byte{0x01, 0x02, 0x03, 0x04},
+				PeerCookie:    []byte{0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11},
+				L2SpecType:    L2SpecTypeDefault,
+			},
+			txHdr: []byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc8,
+				0x01, 0x02, 0x03, 0x04,
+				0x40, 0x00, 0x00, 0x00},
+			rxHdr: []byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x64,
+				0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11,
+				0x40, 0x00, 0x00, 0x00},
+		},
+	}
+	frame := []byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x02, 0x03, 0x04}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000})
+			if err != nil {
+				t.Fatalf("ListenUDP(): %v", err)
+			}
+			defer peer.Close()
+
+			dp := NewUserspaceDataPlane()
+			ctx, err := NewContext(dp, nil)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			c.tcfg.Local = "127.0.0.1:6000"
+			c.tcfg.Peer = "127.0.0.1:5000"
+			c.tcfg.Encap = EncapTypeUDP
+			tunl, err := ctx.NewQuiescentTunnel("t1", c.tcfg)
+			if err != nil {
+				t.Fatalf("NewQuiescentTunnel(): %v", err)
+			}
+			sess, err := tunl.NewSession("s1", c.scfg)
+			if err != nil {
+				t.Fatalf("NewSession(): %v", err)
+			}
+
+			conn, err := dp.SessionConn(c.tcfg.TunnelID, c.scfg.SessionID)
+			if err != nil {
+				t.Fatalf("SessionConn(): %v", err)
+			}
+
+			// Transmit a frame and check the peer receives the expected header
+			if n, err := conn.Write(frame); err != nil || n != len(frame) {
+				t.Fatalf("Write(): %v, %v", n, err)
+			}
+			peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 1500)
+			n, from, err := peer.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatalf("peer ReadFromUDP(): %v", err)
+			}
+			expect := append(append([]byte{}, c.txHdr...), frame...)
+			if !bytes.Equal(buf[:n], expect) {
+				t.Errorf("peer received %x, expected %x", buf[:n], expect)
+			}
+
+			// Send a frame from the peer and check the header is stripped
+			_, err = peer.WriteToUDP(append(append([]byte{}, c.rxHdr...), frame...), from)
+			if err != nil {
+				t.Fatalf("peer WriteToUDP(): %v", err)
+			}
+			n, err = conn.Read(buf)
+			if err != nil {
+				t.Fatalf("Read(): %v", err)
+			}
+			if !bytes.Equal(buf[:n], frame) {
+				t.Errorf("Read() returned %x, expected %x", buf[:n], frame)
+			}
+
+			stats, err := sess.GetStatistics()
+			if err != nil {
+				t.Fatalf("GetStatistics(): %v", err)
+			}
+			expectStats := SessionDataPlaneStatistics{
+				TxPackets: 1,
+				TxBytes:   uint64(len(frame)),
+				RxPackets: 1,
+				RxBytes:   uint64(len(frame)),
+			}
+			if *stats != expectStats {
+				t.Errorf("expected statistics %+v, got %+v", expectStats, *stats)
+			}
+
+			// Closing the session closes the connection
+			sess.Close()
+			if _, err := conn.Read(buf); err != io.EOF {
+				t.Errorf("Read() after session close: expected io.EOF, got %v", err)
+			}
+			if _, err := dp.SessionConn(c.tcfg.TunnelID, c.scfg.SessionID); err == nil {
+				t.Errorf("SessionConn() succeeded after session close")
+			}
+			tunl.Close()
+		})
+	}
+}
+
+func TestUserspaceDataPlaneBadTunnel(t *testing.T) {
+	dp := NewUserspaceDataPlane()
+	ctx, err := NewContext(dp, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	_, err = ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        EncapTypeUDP,
+	})
+	if err == nil {
+		t.Errorf("NewStaticTunnel() succeeded with userspace data plane")
+	}
+}
+
+func TestAddressFamilyMismatch(t *testing.T) {
+	cases := []struct {
+		name        string
+		local, peer string
+		encap       EncapType
+	}{
+		{"UDP IPv4 local, IPv6 peer", "127.0.0.1:6000", "[::1]:5000", EncapTypeUDP},
+		{"UDP IPv6 local, IPv4 peer", "[::1]:6000", "127.0.0.1:5000", EncapTypeUDP},
+		{"UDP IPv4 local without port, IPv6 peer", "127.0.0.1", "[::1]:5000", EncapTypeUDP},
+		{"IP IPv4 local, IPv6 peer", "127.0.0.1", "::1", EncapTypeIP},
+		{"IP IPv6 local, IPv4 peer", "::1", "127.0.0.1", EncapTypeIP},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, _, err := newTunnelAddressPair(&TunnelConfig{
+				Local:        c.local,
+				Peer:         c.peer,
+				Encap:        c.encap,
+				TunnelID:     1,
+				PeerTunnelID: 10,
+			})
+			if !errors.Is(err, ErrAddressFamilyMismatch) {
+				t.Fatalf("expected %q, got %v", ErrAddressFamilyMismatch, err)
+			}
+			var addrErr *AddressError
+			if !errors.As(err, &addrErr) || !addrErr.Local || addrErr.Address != c.local {
+				t.Errorf("unexpected error %+v", err)
+			}
+			for _, addr := range []string{c.local, c.peer} {
+				if !strings.Contains(err.Error(), addr) {
+					t.Errorf("error %q doesn't name address %q", err, addr)
+				}
+			}
+		})
+	}
+
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+	_, err = ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "[::1]:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        EncapTypeUDP,
+	})
+	if !errors.Is(err, ErrAddressFamilyMismatch) {
+		t.Errorf("NewStaticTunnel(): expected %q, got %v", ErrAddressFamilyMismatch, err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	var slept []time.Duration
+
+	rl := newRateLimiter(2, 100*time.Millisecond)
+	rl.last = now
+	rl.now = func() time.Time { return now }
+	rl.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	// The initial burst is admitted immediately, subsequent callers are
+	// paced at one per 50ms
+	for i := 0; i < 4; i++ {
+		rl.wait()
+	}
+	expect := []time.Duration{50 * time.Millisecond, 100 * time.Millisecond}
+	if !reflect.DeepEqual(slept, expect) {
+		t.Errorf("expected waits %v, got %v", expect, slept)
+	}
+
+	// Once the reservations are honoured and the bucket refills, the
+	// burst is available again
+	slept = nil
+	now = now.Add(200 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		rl.wait()
+	}
+	expect = []time.Duration{50 * time.Millisecond}
+	if !reflect.DeepEqual(slept, expect) {
+		t.Errorf("expected waits %v, got %v", expect, slept)
+	}
+}
+
+func TestCreationRateLimit(t *testing.T) {
+	ctx, err := NewContextWithOptions(nil, nil, WithCreationRateLimit(2, 100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewContextWithOptions(): %v", err)
+	}
+	defer ctx.Close()
+
+	start := time.Now()
+	tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 1001,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+	for i := 1; i <= 5; i++ {
+		_, err = tunl.NewSession(fmt.Sprintf("s%d", i), &SessionConfig{
+			SessionID:     ControlConnID(i),
+			PeerSessionID: ControlConnID(1000 + i),
+			Pseudowire:    PseudowireTypeEth,
+		})
+		if err != nil {
+			t.Fatalf("NewSession(): %v", err)
+		}
+	}
+
+	// Six instances at a burst of two and a rate of one per 50ms
+	// must take at least 200ms to create
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected creation to be paced to at least 200ms, took %v", elapsed)
+	}
+}
+
+func TestSessionInterfaceIndex(t *testing.T) {
+	defer func(fn func(string) (int, error)) { linkIndexLookup = fn }(linkIndexLookup)
+
+	linkIndexLookup = func(name string) (int, error) {
+		if name == "l2tpeth7" {
+			return 42, nil
+		}
+		return 0, fmt.Errorf("no such interface")
+	}
+
+	for _, c := range []struct {
+		name   string
+		dp     DataPlane
+		ifname string
+		expect int
+	}{
+		{name: "mock data plane", dp: NewMockDataPlane(), ifname: "l2tpeth7", expect: 42},
+		{name: "missing interface", dp: NewMockDataPlane(), ifname: "l2tpeth8"},
+		{name: "null data plane", dp: nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, err := NewContext(c.dp, nil)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "127.0.0.1:5000",
+				Version:      ProtocolVersion3,
+				TunnelID:     1,
+				PeerTunnelID: 1001,
+				Encap:        EncapTypeUDP,
+			})
+			if err != nil {
+				t.Fatalf("NewStaticTunnel(): %v", err)
+			}
+			sess, err := tunl.NewSession("s1", &SessionConfig{
+				SessionID:     1,
+				PeerSessionID: 1001,
+				Pseudowire:    PseudowireTypeEth,
+				InterfaceName: c.ifname,
+			})
+			if err != nil {
+				t.Fatalf("NewSession(): %v", err)
+			}
+
+			ifindex, ifname, err := sess.InterfaceIndex()
+			if c.expect == 0 {
+				if err == nil {
+					t.Errorf("InterfaceIndex(): expected error, got %v, %v", ifindex, ifname)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("InterfaceIndex(): %v", err)
+			}
+			if ifindex != c.expect || ifname != c.ifname {
+				t.Errorf("InterfaceIndex(): expected %v, %v, got %v, %v", c.expect, c.ifname, ifindex, ifname)
+			}
+		})
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	defer func(fn func() bool) { netlinkAvailable = fn }(netlinkAvailable)
+
+	for _, nl := range []bool{false, true} {
+		netlinkAvailable = func() bool { return nl }
+		caps := Capabilities()
+
+		expect := []string{DataPlaneNull, DataPlaneUserspace}
+		if nl {
+			expect = append(expect, DataPlaneNetlink)
+		}
+		if !reflect.DeepEqual(caps.DataPlanes, expect) {
+			t.Errorf("netlink available %v: expected data planes %v, got %v", nl, expect, caps.DataPlanes)
+		}
+		if !reflect.DeepEqual(caps.ProtocolVersions, []ProtocolVersion{ProtocolVersion2, ProtocolVersion3}) {
+			t.Errorf("unexpected protocol versions %v", caps.ProtocolVersions)
+		}
+		if !reflect.DeepEqual(caps.EncapTypes, []EncapType{EncapTypeUDP, EncapTypeIP}) {
+			t.Errorf("unexpected encap types %v", caps.EncapTypes)
+		}
+	}
+
+	// The null data plane is always usable
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(nil): %v", err)
+	}
+	ctx.Close()
+
+	if Version() == "" {
+		t.Errorf("Version() returned an empty string")
+	}
+}
+
+// testHookRecorder records data plane hook calls interleaved with the
+// operations of a mock data plane.
+type testHookRecorder struct {
+	lock  sync.Mutex
+	dp    *MockDataPlane
+	seen  int
+	trace []string
+	// fail maps a hook call, as "<hook> <tunnel>[/<session>]", to
+	// the error it returns
+	fail map[string]error
+}
+
+func (hr *testHookRecorder) syncCalls() {
+	calls := hr.dp.Calls()
+	for _, c := range calls[hr.seen:] {
+		hr.trace = append(hr.trace, string(c.Op))
+	}
+	hr.seen = len(calls)
+}
+
+func (hr *testHookRecorder) hook(stage string) DataPlaneHook {
+	return func(info *DataPlaneHookInfo) error {
+		hr.lock.Lock()
+		defer hr.lock.Unlock()
+		hr.syncCalls()
+		name := info.TunnelName
+		entry := []string{stage, "", fmt.Sprintf("%v/%v", info.TunnelConfig.TunnelID, info.TunnelConfig.PeerTunnelID)}
+		if info.Session != nil {
+			name += "/" + info.SessionName
+			entry = append(entry, fmt.Sprintf("%v/%v", info.SessionConfig.SessionID, info.SessionConfig.PeerSessionID))
+			if info.InterfaceName != "" {
+				entry = append(entry, info.InterfaceName)
+			}
+		}
+		entry[1] = name
+		hr.trace = append(hr.trace, strings.Join(entry, " "))
+		return hr.fail[stage+" "+name]
+	}
+}
+
+func (hr *testHookRecorder) hooks(abort bool) DataPlaneHooks {
+	return DataPlaneHooks{
+		PreDataPlaneUp:   hr.hook("PreDataPlaneUp"),
+		PostDataPlaneUp:  hr.hook("PostDataPlaneUp"),
+		PreDataPlaneDown: hr.hook("PreDataPlaneDown"),
+		AbortOnError:     abort,
+	}
+}
+
+func (hr *testHookRecorder) getTrace() []string {
+	hr.lock.Lock()
+	defer hr.lock.Unlock()
+	hr.syncCalls()
+	return append([]string(nil), hr.trace...)
+}
+
+func TestDataPlaneHooks(t *testing.T) {
+	cases := []struct {
+		name string
+		mkfn func(ctx *Context, name string, cfg *TunnelConfig) (Tunnel, error)
+	}{
+		{
+			name: "static",
+			mkfn: (*Context).NewStaticTunnel,
+		},
+		{
+			name: "quiescent",
+			mkfn: (*Context).NewQuiescentTunnel,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hr := &testHookRecorder{dp: NewMockDataPlane()}
+			ctx, err := NewContextWithOptions(hr.dp, nil, WithDataPlaneHooks(hr.hooks(false)))
+			if err != nil {
+				t.Fatalf("NewContextWithOptions(): %v", err)
+			}
+			defer ctx.Close()
+
+			tunl, err := c.mkfn(ctx, "t1", &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "127.0.0.1:5000",
+				Version:      ProtocolVersion3,
+				TunnelID:     1,
+				PeerTunnelID: 10,
+				Encap:        EncapTypeUDP,
+			})
+			if err != nil {
+				t.Fatalf("%s tunnel: %v", c.name, err)
+			}
+			_, err = tunl.NewSession("s1", &SessionConfig{
+				SessionID:     100,
+				PeerSessionID: 200,
+				Pseudowire:    PseudowireTypeEth,
+				InterfaceName: "l2tpeth42",
+			})
+			if err != nil {
+				t.Fatalf("NewSession(): %v", err)
+			}
+			tunl.Close()
+
+			expect := []string{
+				"PreDataPlaneUp t1 1/10",
+				"NewTunnel",
+				"PostDataPlaneUp t1 1/10",
+				"PreDataPlaneUp t1/s1 1/10 100/200",
+				"NewSession",
+				"PostDataPlaneUp t1/s1 1/10 100/200 l2tpeth42",
+				"PreDataPlaneDown t1/s1 1/10 100/200 l2tpeth42",
+				"SessionDown",
+				"PreDataPlaneDown t1 1/10",
+				"TunnelDown",
+			}
+			if got := hr.getTrace(); !reflect.DeepEqual(got, expect) {
+				t.Errorf("expected hook and data plane calls %q, got %q", expect, got)
+			}
+		})
+	}
+}
+
+func TestDataPlaneHookErrors(t *testing.T) {
+	hookErr := errors.New("hook failed")
+	cases := []struct {
+		name          string
+		fail          string
+		abort         bool
+		expectTunnel  bool
+		expectSession bool
+		expect        []string
+	}{
+		{
+			name:          "error ignored",
+			fail:          "PreDataPlaneUp t1/s1",
+			expectTunnel:  true,
+			expectSession: true,
+			expect: []string{
+				"PreDataPlaneUp t1 1/10",
+				"NewTunnel",
+				"PostDataPlaneUp t1 1/10",
+				"PreDataPlaneUp t1/s1 1/10 100/200",
+				"NewSession",
+				"PostDataPlaneUp t1/s1 1/10 100/200 l2tpeth42",
+			},
+		},
+		{
+			name:   "tunnel pre up abort",
+			fail:   "PreDataPlaneUp t1",
+			abort:  true,
+			expect: []string{"PreDataPlaneUp t1 1/10"},
+		},
+		{
+			name:  "tunnel post up abort",
+			fail:  "PostDataPlaneUp t1",
+			abort: true,
+			expect: []string{
+				"PreDataPlaneUp t1 1/10",
+				"NewTunnel",
+				"PostDataPlaneUp t1 1/10",
+				"PreDataPlaneDown t1 1/10",
+				"TunnelDown",
+			},
+		},
+		{
+			name:         "session pre up abort",
+			fail:         "PreDataPlaneUp t1/s1",
+			abort:        true,
+			expectTunnel: true,
+			expect: []string{
+				"PreDataPlaneUp t1 1/10",
+				"NewTunnel",
+				"PostDataPlaneUp t1 1/10",
+				"PreDataPlaneUp t1/s1 1/10 100/200",
+			},
+		},
+		{
+			name:         "session post up abort",
+			fail:         "PostDataPlaneUp t1/s1",
+			abort:        true,
+			expectTunnel: true,
+			expect: []string{
+				"PreDataPlaneUp t1 1/10",
+				"NewTunnel",
+				"PostDataPlaneUp t1 1/10",
+				"PreDataPlaneUp t1/s1 1/10 100/200",
+				"NewSession",
+				"PostDataPlaneUp t1/s1 1/10 100/200 l2tpeth42",
+				"PreDataPlaneDown t1/s1 1/10 100/200 l2tpeth42",
+				"SessionDown",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hr := &testHookRecorder{
+				dp:   NewMockDataPlane(),
+				fail: map[string]error{c.fail: hookErr},
+			}
+			ctx, err := NewContextWithOptions(hr.dp, nil, WithDataPlaneHooks(hr.hooks(c.abort)))
+			if err != nil {
+				t.Fatalf("NewContextWithOptions(): %v", err)
+			}
+			defer ctx.Close()
+
+			tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "127.0.0.1:5000",
+				Version:      ProtocolVersion3,
+				TunnelID:     1,
+				PeerTunnelID: 10,
+				Encap:        EncapTypeUDP,
+			})
+			if c.expectTunnel != (err == nil) {
+				t.Fatalf("NewStaticTunnel(): expected success %v, got error %v", c.expectTunnel, err)
+			}
+			if tunl != nil {
+				_, err = tunl.NewSession("s1", &SessionConfig{
+					SessionID:     100,
+					PeerSessionID: 200,
+					Pseudowire:    PseudowireTypeEth,
+					InterfaceName: "l2tpeth42",
+				})
+				if c.expectSession != (err == nil) {
+					t.Fatalf("NewSession(): expected success %v, got error %v", c.expectSession, err)
+				}
+			}
+
+			if got := hr.getTrace(); !reflect.DeepEqual(got, c.expect) {
+				t.Errorf("expected hook and data plane calls %q, got %q", c.expect, got)
+			}
+		})
+	}
+}
+
+func TestSessionDataMTU(t *testing.T) {
+	ctx, err := NewContext(NewMockDataPlane(), nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	sess, err := tunl.NewSession("s1", &SessionConfig{
+		SessionID:     100,
+		PeerSessionID: 200,
+		Pseudowire:    PseudowireTypeEth,
+		Cookie:        []byte{1, 2, 3, 4},
+		PeerCookie:    []byte{5, 6, 7, 8},
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	// Static tunnels have no path MTU, so the default is assumed
+	if got, want := sess.DataMTU(), 1500-20-8-8-4; got != want {
+		t.Errorf("DataMTU(): got %v, want %v", got, want)
+	}
+	if got, want := sess.PPPMRU(), 1500-20-8-8-4-4; got != want {
+		t.Errorf("PPPMRU(): got %v, want %v", got, want)
+	}
+}
+
+func TestSessionCookieMismatch(t *testing.T) {
+	dp := NewMockDataPlane()
+	ctx, err := NewContext(dp, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	evChan := make(chan *SessionDataErrorEvent, 4)
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		if ev, ok := event.(*SessionDataErrorEvent); ok {
+			evChan <- ev
+		}
+	}))
+
+	tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	sess, err := tunl.NewSession("s1", &SessionConfig{
+		SessionID:           100,
+		PeerSessionID:       200,
+		Pseudowire:          PseudowireTypeEth,
+		Cookie:              []byte{1, 2, 3, 4},
+		PeerCookie:          []byte{5, 6, 7, 8},
+		CookieCheckInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	// No event is raised while nothing is discarded
+	select {
+	case ev := <-evChan:
+		t.Fatalf("unexpected data error event %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for _, c := range []struct{ total, increase uint64 }{{3, 3}, {5, 2}} {
+		dp.SetSessionStatistics(100, &SessionDataPlaneStatistics{RxCookieDiscards: c.total})
+		select {
+		case ev := <-evChan:
+			if ev.SessionName != "s1" || ev.Session != sess {
+				t.Errorf("data error event for unexpected session %q", ev.SessionName)
+			}
+			if ev.RxCookieDiscards != c.total || ev.NewRxCookieDiscards != c.increase {
+				t.Errorf("expected %v/%v cookie discards, got %v/%v",
+					c.total, c.increase, ev.RxCookieDiscards, ev.NewRxCookieDiscards)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for data error event")
+		}
+	}
+
+	// The event isn't repeated unless the count increases again
+	select {
+	case ev := <-evChan:
+		t.Errorf("unexpected data error event %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sess.Close()
+}
+
+func TestSessionCookieMismatchClose(t *testing.T) {
+	dp := NewMockDataPlane()
+	ctx, err := NewContext(dp, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	// Closing the session from the event handler must not deadlock
+	// waiting for the cookie monitor raising the event
+	closed := make(chan interface{})
+	ctx.RegisterEventHandler(EventHandlerFunc(func(event interface{}) {
+		if ev, ok := event.(*SessionDataErrorEvent); ok {
+			ev.Session.Close()
+			close(closed)
+		}
+	}))
+
+	tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	_, err = tunl.NewSession("s1", &SessionConfig{
+		SessionID:           100,
+		PeerSessionID:       200,
+		Pseudowire:          PseudowireTypeEth,
+		Cookie:              []byte{1, 2, 3, 4},
+		PeerCookie:          []byte{5, 6, 7, 8},
+		CookieCheckInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	dp.SetSessionStatistics(100, &SessionDataPlaneStatistics{RxCookieDiscards: 1})
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out closing session from data error event")
+	}
+	if sessions := tunl.ListSessions(); len(sessions) != 0 {
+		t.Errorf("expected session to be closed, got %v", sessions)
+	}
+}
+
+func TestAdoptTunnels(t *testing.T) {
+	// Tunnel and session information as reported by a netlink dump
+	tunnels := []*nll2tp.TunnelInfo{
+		{
+			Tid:        1,
+			Ptid:       10,
+			Version:    ProtocolVersion3,
+			Encap:      EncapTypeUDP,
+			DebugFlags: nll2tp.MsgControl,
+			UDPCsum:    true,
+			LocalAddr:  []byte{127, 0, 0, 1},
+			PeerAddr:   []byte{127, 0, 0, 2},
+			LocalPort:  6000,
+			PeerPort:   5000,
+		},
+		{
+			Tid:       2,
+			Ptid:      20,
+			Version:   ProtocolVersion3,
+			Encap:     EncapTypeIP,
+			LocalAddr: []byte{127, 0, 0, 1},
+			PeerAddr:  []byte{127, 0, 0, 3},
+		},
+	}
+	sessions := []*nll2tp.SessionInfo{
+		{
+			Tid:            1,
+			Ptid:           10,
+			Sid:            100,
+			Psid:           200,
+			PseudowireType: nll2tp.PwtypeEth,
+			IfName:         "l2tpeth0",
+			LocalCookie:    []byte{1, 2, 3, 4},
+			SendSeq:        true,
+			RecvSeq:        true,
+			ReorderTimeout: 250,
+		},
+		{
+			Tid:            1,
+			Ptid:           10,
+			Sid:            101,
+			Psid:           201,
+			PseudowireType: nll2tp.PwtypeEth,
+			IfName:         "l2tpeth1",
+		},
+		// Sessions whose tunnel is missing from the dump are ignored
+		{
+			Tid:            3,
+			Ptid:           30,
+			Sid:            102,
+			Psid:           202,
+			PseudowireType: nll2tp.PwtypeEth,
+		},
+	}
+
+	states := tunnelStatesFromNl(tunnels, sessions)
+	expect := []*TunnelState{
+		{
+			Name: "tunnel1",
+			Config: &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "127.0.0.2:5000",
+				Encap:        EncapTypeUDP,
+				Version:      ProtocolVersion3,
+				TunnelID:     1,
+				PeerTunnelID: 10,
+				DebugFlags:   DebugFlagsControl,
+				UDPChecksum:  UDPChecksumEnabled,
+			},
+			Sessions: []*SessionState{
+				{
+					Name: "session100",
+					Config: &SessionConfig{
+						SessionID:      100,
+						PeerSessionID:  200,
+						Pseudowire:     PseudowireTypeEth,
+						SeqNum:         true,
+						ReorderTimeout: 250 * time.Millisecond,
+						Cookie:         []byte{1, 2, 3, 4},
+						InterfaceName:  "l2tpeth0",
+					},
+				},
+				{
+					Name: "session101",
+					Config: &SessionConfig{
+						SessionID:     101,
+						PeerSessionID: 201,
+						Pseudowire:    PseudowireTypeEth,
+						InterfaceName: "l2tpeth1",
+					},
+				},
+			},
+		},
+		{
+			Name: "tunnel2",
+			Config: &TunnelConfig{
+				Local:        "127.0.0.1",
+				Peer:         "127.0.0.3",
+				Encap:        EncapTypeIP,
+				Version:      ProtocolVersion3,
+				TunnelID:     2,
+				PeerTunnelID: 20,
+			},
+			Sessions: []*SessionState{},
+		},
+	}
+	if !reflect.DeepEqual(states, expect) {
+		t.Fatalf("expected tunnel state %+v, got %+v", expect, states)
+	}
+
+	dp := NewMockDataPlane()
+	dp.SetTunnelState(states)
+	ctx, err := NewContext(dp, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	rec := &testSessionEventRecorder{}
+	ctx.RegisterEventHandler(rec)
+
+	exported, err := ctx.ExportTunnels()
+	if err != nil {
+		t.Fatalf("ExportTunnels(): %v", err)
+	}
+	if len(exported) != 2 {
+		t.Fatalf("expected 2 tunnels to adopt, got %v", len(exported))
+	}
+	for _, state := range exported {
+		if _, err := ctx.AdoptTunnel(state); err != nil {
+			t.Fatalf("AdoptTunnel(%v): %v", state.Name, err)
+		}
+	}
+
+	// The data plane instances are adopted rather than recreated
+	expectOps := []MockDataPlaneOp{
+		MockOpAdoptTunnel,
+		MockOpAdoptSession,
+		MockOpAdoptSession,
+		MockOpAdoptTunnel,
+	}
+	calls := dp.Calls()
+	if len(calls) != len(expectOps) {
+		t.Fatalf("expected %d calls, got %d: %+v", len(expectOps), len(calls), calls)
+	}
+	for i, op := range expectOps {
+		if calls[i].Op != op {
+			t.Errorf("call %d: expected %v, got %v", i, op, calls[i].Op)
+		}
+	}
+
+	var names []string
+	for _, tunl := range ctx.ListTunnels() {
+		names = append(names, tunl.Name())
+		for _, s := range tunl.ListSessions() {
+			names = append(names, tunl.Name()+"/"+s.Name())
+		}
+	}
+	expectNames := []string{"tunnel1", "tunnel1/session100", "tunnel1/session101", "tunnel2"}
+	if !reflect.DeepEqual(names, expectNames) {
+		t.Errorf("expected instances %v, got %v", expectNames, names)
+	}
+	if len(rec.up) != 2 || rec.up[0].InterfaceName != "l2tpeth0" || rec.up[1].InterfaceName != "l2tpeth1" {
+		t.Errorf("expected session up events for l2tpeth0 and l2tpeth1, got %+v", rec.up)
+	}
+
+	// Adopted tunnels are no longer exported, and can't be adopted twice
+	exported, err = ctx.ExportTunnels()
+	if err != nil {
+		t.Fatalf("ExportTunnels(): %v", err)
+	}
+	if len(exported) != 0 {
+		t.Errorf("expected no tunnels to adopt, got %v", len(exported))
+	}
+	state := *states[1]
+	state.Name = "tunnel2bis"
+	if _, err := ctx.AdoptTunnel(&state); !errors.Is(err, ErrTunnelIDExists) {
+		t.Errorf("AdoptTunnel(): expected %v, got %v", ErrTunnelIDExists, err)
+	}
+
+	// Closing an adopted tunnel tears down its data plane
+	dp.Reset()
+	tunl, _ := ctx.findTunnelByName("tunnel1")
+	tunl.Close()
+	expectOps = []MockDataPlaneOp{
+		MockOpSessionDown,
+		MockOpSessionDown,
+		MockOpTunnelDown,
+	}
+	calls = dp.Calls()
+	if len(calls) != len(expectOps) {
+		t.Fatalf("expected %d calls, got %d: %+v", len(expectOps), len(calls), calls)
+	}
+	for i, op := range expectOps {
+		if calls[i].Op != op {
+			t.Errorf("call %d: expected %v, got %v", i, op, calls[i].Op)
+		}
+	}
+}
+
+func TestAdoptTunnelErrors(t *testing.T) {
+	tcfg := &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.2:5000",
+		Encap:        EncapTypeUDP,
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 10,
+	}
+	scfg := &SessionConfig{
+		SessionID:     100,
+		PeerSessionID: 200,
+		Pseudowire:    PseudowireTypeEth,
+	}
+
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	if _, err := ctx.ExportTunnels(); !errors.Is(err, ErrAdoptionNotSupported) {
+		t.Errorf("ExportTunnels(): expected %v, got %v", ErrAdoptionNotSupported, err)
+	}
+	if _, err := ctx.AdoptTunnel(&TunnelState{Name: "t1", Config: tcfg}); !errors.Is(err, ErrAdoptionNotSupported) {
+		t.Errorf("AdoptTunnel(): expected %v, got %v", ErrAdoptionNotSupported, err)
+	}
+	ctx.Close()
+
+	dp := NewMockDataPlane()
+	ctx, err = NewContext(dp, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	// An L2TPv3 session ID clash with a session in another tunnel
+	// causes adoption to fail without touching the data plane
+	tunl, err := ctx.NewStaticTunnel("t0", &TunnelConfig{
+		Local:        "127.0.0.1:6001",
+		Peer:         "127.0.0.2:5001",
+		Encap:        EncapTypeUDP,
+		Version:      ProtocolVersion3,
+		TunnelID:     2,
+		PeerTunnelID: 20,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+	if _, err := tunl.NewSession("s0", scfg); err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	dp.Reset()
+
+	cases := []struct {
+		name      string
+		state     *TunnelState
+		expectErr error
+	}{
+		{
+			name:  "nil config",
+			state: &TunnelState{Name: "t1"},
+		},
+		{
+			name:  "no tunnel ID",
+			state: &TunnelState{Name: "t1", Config: &TunnelConfig{Version: ProtocolVersion3, PeerTunnelID: 10}},
+		},
+		{
+			name: "duplicate session names",
+			state: &TunnelState{
+				Name:   "t1",
+				Config: tcfg,
+				Sessions: []*SessionState{
+					{Name: "s1", Config: &SessionConfig{SessionID: 101, PeerSessionID: 201, Pseudowire: PseudowireTypeEth}},
+					{Name: "s1", Config: &SessionConfig{SessionID: 102, PeerSessionID: 202, Pseudowire: PseudowireTypeEth}},
+				},
+			},
+			expectErr: ErrSessionNameExists,
+		},
+		{
+			name:      "tunnel name clash",
+			state:     &TunnelState{Name: "t0", Config: tcfg},
+			expectErr: ErrTunnelNameExists,
+		},
+		{
+			name: "session ID clash",
+			state: &TunnelState{
+				Name:   "t1",
+				Config: tcfg,
+				Sessions: []*SessionState{
+					{Name: "s1", Config: &SessionConfig{SessionID: 101, PeerSessionID: 201, Pseudowire: PseudowireTypeEth}},
+					{Name: "s2", Config: scfg},
+				},
+			},
+			expectErr: ErrSessionIDExists,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := ctx.AdoptTunnel(c.state)
+			if err == nil {
+				t.Fatalf("AdoptTunnel(): expected error")
+			}
+			if c.expectErr != nil && !errors.Is(err, c.expectErr) {
+				t.Errorf("AdoptTunnel(): expected %v, got %v", c.expectErr, err)
+			}
+			if _, ok := ctx.findTunnelByName("t1"); ok {
+				t.Errorf("failed adoption left tunnel linked")
+			}
+			for _, call := range dp.Calls() {
+				if call.Op != MockOpAdoptTunnel && call.Op != MockOpAdoptSession {
+					t.Errorf("failed adoption touched the data plane: %v", call.Op)
+				}
+			}
+		})
+	}
+
+	// The tunnel ID and session IDs are released on failure
+	if _, err := ctx.AdoptTunnel(&TunnelState{Name: "t1", Config: tcfg}); err != nil {
+		t.Fatalf("AdoptTunnel(): %v", err)
+	}
+	if !ctx.v3SessionIDInUse(100) || ctx.v3SessionIDInUse(101) {
+		t.Errorf("expected only session ID 100 in use after failed adoption")
+	}
+}
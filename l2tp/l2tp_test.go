@@ -2,15 +2,26 @@ package l2tp
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/internal/nll2tp"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
 )
 
 // Must be called with root permissions
@@ -23,8 +34,8 @@ func testQuiescentTunnels(t *testing.T) {
 		{
 			name: "reject L2TPv2 IP encap",
 			cfg: TunnelConfig{
-				Local:        "127.0.0.1:6000",
-				Peer:         "localhost:5000",
+				Local:        "127.0.0.1",
+				Peer:         "localhost",
 				Version:      ProtocolVersion2,
 				TunnelID:     1,
 				PeerTunnelID: 1001,
@@ -102,8 +113,8 @@ func testQuiescentTunnels(t *testing.T) {
 		{
 			name: "L2TPv3 IP AF_INET",
 			cfg: TunnelConfig{
-				Local:        "127.0.0.1:6000",
-				Peer:         "localhost:5000",
+				Local:        "127.0.0.1",
+				Peer:         "localhost",
 				Version:      ProtocolVersion3,
 				TunnelID:     5,
 				PeerTunnelID: 1005,
@@ -113,8 +124,8 @@ func testQuiescentTunnels(t *testing.T) {
 		{
 			name: "L2TPv3 IP AF_INET6",
 			cfg: TunnelConfig{
-				Local:        "[::1]:6000",
-				Peer:         "[::1]:5000",
+				Local:        "::1",
+				Peer:         "[::1]",
 				Version:      ProtocolVersion3,
 				TunnelID:     6,
 				PeerTunnelID: 1006,
@@ -163,8 +174,8 @@ func testQuiescentSessions(t *testing.T) {
 		{
 			name: "L2TPv3 Eth Session",
 			tcfg: TunnelConfig{
-				Local:        "127.0.0.1:6000",
-				Peer:         "localhost:5000",
+				Local:        "127.0.0.1",
+				Peer:         "localhost",
 				TunnelID:     5003,
 				PeerTunnelID: 6003,
 				Encap:        EncapTypeIP,
@@ -252,8 +263,8 @@ func testStaticTunnels(t *testing.T) {
 		{
 			name: "L2TPv3 IP AF_INET",
 			cfg: TunnelConfig{
-				Local:        "127.0.0.1:6000",
-				Peer:         "localhost:5000",
+				Local:        "127.0.0.1",
+				Peer:         "localhost",
 				TunnelID:     5003,
 				PeerTunnelID: 6003,
 				Encap:        EncapTypeIP,
@@ -263,8 +274,8 @@ func testStaticTunnels(t *testing.T) {
 		{
 			name: "L2TPv3 IP AF_INET6",
 			cfg: TunnelConfig{
-				Local:        "[::1]:6000",
-				Peer:         "[::1]:5000",
+				Local:        "::1",
+				Peer:         "[::1]",
 				TunnelID:     5004,
 				PeerTunnelID: 6004,
 				Encap:        EncapTypeIP,
@@ -313,8 +324,8 @@ func testStaticSessions(t *testing.T) {
 		{
 			name: "L2TPv3 Eth Session",
 			tcfg: TunnelConfig{
-				Local:        "127.0.0.1:6000",
-				Peer:         "localhost:5000",
+				Local:        "127.0.0.1",
+				Peer:         "localhost",
 				TunnelID:     5003,
 				PeerTunnelID: 6003,
 				Encap:        EncapTypeIP,
@@ -328,6 +339,41 @@ func testStaticSessions(t *testing.T) {
 				//InterfaceName: "l2tpeth42",
 			},
 		},
+		{
+			name: "L2TPv3 Eth Session IP AF_INET6 with cookies",
+			tcfg: TunnelConfig{
+				Local:        "::1",
+				Peer:         "[::1]",
+				TunnelID:     5004,
+				PeerTunnelID: 6004,
+				Encap:        EncapTypeIP,
+				Version:      ProtocolVersion3,
+			},
+			scfg: SessionConfig{
+				SessionID:     500005,
+				PeerSessionID: 500006,
+				Pseudowire:    PseudowireTypeEth,
+				Cookie:        []byte{0x01, 0x02, 0x03, 0x04},
+				PeerCookie:    []byte{0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c},
+			},
+		},
+		{
+			name: "L2TPv3 Eth Session UDP AF_INET",
+			tcfg: TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "localhost:5000",
+				TunnelID:     5001,
+				PeerTunnelID: 6001,
+				Encap:        EncapTypeUDP,
+				Version:      ProtocolVersion3,
+			},
+			scfg: SessionConfig{
+				SessionID:     500007,
+				PeerSessionID: 500008,
+				Pseudowire:    PseudowireTypeEth,
+				SeqNum:        true,
+			},
+		},
 	}
 
 	for _, c := range cases {
@@ -346,7 +392,7 @@ func testStaticSessions(t *testing.T) {
 				t.Fatalf("NewStaticTunnel(%v): %v", c.tcfg, err)
 			}
 
-			_, err = tunl.NewSession("s1", &c.scfg)
+			sess, err := tunl.NewSession("s1", &c.scfg)
 			if err != nil {
 				t.Fatalf("NewSession(%v): %v", c.scfg, err)
 			}
@@ -355,10 +401,93 @@ func testStaticSessions(t *testing.T) {
 			if err != nil {
 				t.Fatalf("NewSession(%v): failed to validate: %v", c.scfg, err)
 			}
+
+			// The kernel must have created the pseudowire interface
+			_, ifname, err := sess.InterfaceIndex()
+			if err != nil {
+				t.Fatalf("InterfaceIndex(): %v", err)
+			}
+			if !strings.HasPrefix(ifname, "l2tpeth") {
+				t.Errorf("expected l2tpeth interface, got %q", ifname)
+			}
 		})
 	}
 }
 
+func testSessionModify(t *testing.T) {
+	tcfg := TunnelConfig{
+		Local:        "127.0.0.1",
+		Peer:         "localhost",
+		TunnelID:     5004,
+		PeerTunnelID: 6004,
+		Encap:        EncapTypeIP,
+		Version:      ProtocolVersion3,
+	}
+	scfg := SessionConfig{
+		SessionID:     500003,
+		PeerSessionID: 500004,
+		Pseudowire:    PseudowireTypeEth,
+	}
+
+	ctx, err := NewContext(
+		LinuxNetlinkDataPlane,
+		level.NewFilter(log.NewLogfmtLogger(os.Stderr),
+			level.AllowDebug(), level.AllowInfo()))
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewStaticTunnel("t1", &tcfg)
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(%v): %v", tcfg, err)
+	}
+
+	sess, err := tunl.NewSession("s1", &scfg)
+	if err != nil {
+		t.Fatalf("NewSession(%v): %v", scfg, err)
+	}
+
+	for _, seqnum := range []bool{true, false} {
+		err = sess.Modify(&SessionConfig{SeqNum: seqnum})
+		if err != nil {
+			t.Fatalf("Modify(SeqNum: %v): %v", seqnum, err)
+		}
+	}
+}
+
+func testTunnelSetDebugFlags(t *testing.T) {
+	tcfg := TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "localhost:5000",
+		TunnelID:     5005,
+		PeerTunnelID: 6005,
+		Encap:        EncapTypeUDP,
+		Version:      ProtocolVersion3,
+	}
+
+	ctx, err := NewContext(
+		LinuxNetlinkDataPlane,
+		level.NewFilter(log.NewLogfmtLogger(os.Stderr),
+			level.AllowDebug(), level.AllowInfo()))
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewStaticTunnel("t1", &tcfg)
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(%v): %v", tcfg, err)
+	}
+
+	for _, flags := range []DebugFlags{DebugFlagsControl | DebugFlagsDebug, 0} {
+		err = tunl.SetDebugFlags(flags)
+		if err != nil {
+			t.Fatalf("SetDebugFlags(%v): %v", flags, err)
+		}
+	}
+}
+
 func TestRequiresRoot(t *testing.T) {
 
 	// These tests need root permissions, so verify we have those first of all
@@ -390,6 +519,14 @@ func TestRequiresRoot(t *testing.T) {
 			name:   "StaticSessions",
 			testFn: testStaticSessions,
 		},
+		{
+			name:   "SessionModify",
+			testFn: testSessionModify,
+		},
+		{
+			name:   "TunnelSetDebugFlags",
+			testFn: testTunnelSetDebugFlags,
+		},
 	}
 
 	for _, sub := range tests {
@@ -397,110 +534,2268 @@ func TestRequiresRoot(t *testing.T) {
 	}
 }
 
-func ipL2tpShowTunnel(tid uint32) (out string, err error) {
-	var tidStr string
-	var tidArgStr string
-	var sout bytes.Buffer
-
-	if tid > 0 {
-		tidArgStr = "tunnel_id"
-		tidStr = fmt.Sprintf("%d", tid)
+func TestIPv6Zone(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
 	}
 
-	cmd := exec.Command("sudo", "ip", "l2tp", "show", "tunnel", tidArgStr, tidStr)
-	cmd.Stdout = &sout
+	cases := []struct {
+		address string
+		zoneID  uint32
+		estr    string
+	}{
+		{address: "[fe80::1%lo]:9000", zoneID: uint32(lo.Index)},
+		{address: fmt.Sprintf("[fe80::1%%%d]:9000", lo.Index), zoneID: uint32(lo.Index)},
+		{address: "[fe80::1]:9000", zoneID: 0},
+		{address: "[fe80::1%nosuchinterface0]:9000", estr: "failed to resolve IPv6 zone"},
+	}
+	for _, c := range cases {
+		t.Run(c.address, func(t *testing.T) {
+			udp, err := newUDPTunnelAddress(c.address, AddressFamilyAny)
+			if c.estr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.estr) {
+					t.Fatalf("newUDPTunnelAddress(%q): expected error containing %q, got %v",
+						c.address, c.estr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newUDPTunnelAddress(%q): %v", c.address, err)
+			}
+			sa6, ok := udp.(*unix.SockaddrInet6)
+			if !ok {
+				t.Fatalf("newUDPTunnelAddress(%q): expected SockaddrInet6, got %T", c.address, udp)
+			}
+			if sa6.ZoneId != c.zoneID || sa6.Port != 9000 {
+				t.Errorf("newUDPTunnelAddress(%q): got zone %v port %v, expected zone %v port 9000",
+					c.address, sa6.ZoneId, sa6.Port, c.zoneID)
+			}
 
-	err = cmd.Run()
-	if err != nil {
-		return "", err
+			// IP encapsulation has no ports
+			ipAddress := strings.TrimSuffix(c.address, ":9000")
+			ip, err := newIPTunnelAddress(ipAddress, 42, AddressFamilyAny)
+			if err != nil {
+				t.Fatalf("newIPTunnelAddress(%q): %v", ipAddress, err)
+			}
+			l2tpip6, ok := ip.(*unix.SockaddrL2TPIP6)
+			if !ok {
+				t.Fatalf("newIPTunnelAddress(%q): expected SockaddrL2TPIP6, got %T", ipAddress, ip)
+			}
+			if l2tpip6.ZoneId != c.zoneID || l2tpip6.ConnId != 42 {
+				t.Errorf("newIPTunnelAddress(%q): got zone %v conn ID %v, expected zone %v conn ID 42",
+					ipAddress, l2tpip6.ZoneId, l2tpip6.ConnId, c.zoneID)
+			}
+		})
 	}
+}
 
-	fmt.Println(sout.String())
+func TestUDPChecksumSockopt(t *testing.T) {
+	cases := []struct {
+		name        string
+		local, peer string
+		mode        UDPChecksumMode
+		level, opt  int
+		expect      int
+	}{
+		{
+			name:  "IPv4 disabled",
+			local: "127.0.0.1:0", peer: "127.0.0.1:5000",
+			mode:  UDPChecksumDisabled,
+			level: unix.SOL_SOCKET, opt: unix.SO_NO_CHECK,
+			expect: 1,
+		},
+		{
+			name:  "IPv4 enabled",
+			local: "127.0.0.1:0", peer: "127.0.0.1:5000",
+			mode:  UDPChecksumEnabled,
+			level: unix.SOL_SOCKET, opt: unix.SO_NO_CHECK,
+			expect: 0,
+		},
+		{
+			name:  "IPv6 disabled tx",
+			local: "[::1]:0", peer: "[::1]:5000",
+			mode:  UDPChecksumDisabled,
+			level: unix.IPPROTO_UDP, opt: unix.UDP_NO_CHECK6_TX,
+			expect: 1,
+		},
+		{
+			name:  "IPv6 disabled rx",
+			local: "[::1]:0", peer: "[::1]:5000",
+			mode:  UDPChecksumDisabled,
+			level: unix.IPPROTO_UDP, opt: unix.UDP_NO_CHECK6_RX,
+			expect: 1,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sal, sap, err := newUDPAddressPair(c.local, 0, c.peer, AddressFamilyAny)
+			if err != nil {
+				t.Fatalf("newUDPAddressPair(%v, %v): %v", c.local, c.peer, err)
+			}
+			cp, err := newL2tpControlPlane(sal, sap)
+			if err != nil {
+				t.Skipf("newL2tpControlPlane(%v, %v): %v", sal, sap, err)
+			}
+			defer cp.close()
 
-	return sout.String(), nil
+			err = cp.setUDPChecksum(c.mode)
+			if err != nil {
+				t.Fatalf("setUDPChecksum(%v): %v", c.mode, err)
+			}
+			got, err := unix.GetsockoptInt(cp.fd, c.level, c.opt)
+			if err != nil {
+				t.Fatalf("GetsockoptInt(): %v", err)
+			}
+			if got != c.expect {
+				t.Errorf("expected sockopt value %v, got %v", c.expect, got)
+			}
+		})
+	}
 }
 
-func ipL2tpShowSession(tid, sid uint32) (out string, err error) {
-	var tidStr string
-	var tidArgStr string
-	var sidStr string
-	var sidArgStr string
-	var sout bytes.Buffer
-
-	if tid > 0 {
-		tidArgStr = "tunnel_id"
-		tidStr = fmt.Sprintf("%d", tid)
+func TestPMTUDiscSockopt(t *testing.T) {
+	cases := []struct {
+		name        string
+		local, peer string
+		mode        PMTUDiscMode
+		level, opt  int
+		expect      int
+	}{
+		{
+			name:  "IPv4 dont",
+			local: "127.0.0.1:0", peer: "127.0.0.1:5000",
+			mode:  PMTUDiscDont,
+			level: unix.IPPROTO_IP, opt: unix.IP_MTU_DISCOVER,
+			expect: unix.IP_PMTUDISC_DONT,
+		},
+		{
+			name:  "IPv4 want",
+			local: "127.0.0.1:0", peer: "127.0.0.1:5000",
+			mode:  PMTUDiscWant,
+			level: unix.IPPROTO_IP, opt: unix.IP_MTU_DISCOVER,
+			expect: unix.IP_PMTUDISC_WANT,
+		},
+		{
+			name:  "IPv4 do",
+			local: "127.0.0.1:0", peer: "127.0.0.1:5000",
+			mode:  PMTUDiscDo,
+			level: unix.IPPROTO_IP, opt: unix.IP_MTU_DISCOVER,
+			expect: unix.IP_PMTUDISC_DO,
+		},
+		{
+			name:  "IPv6 dont",
+			local: "[::1]:0", peer: "[::1]:5000",
+			mode:  PMTUDiscDont,
+			level: unix.IPPROTO_IPV6, opt: unix.IPV6_MTU_DISCOVER,
+			expect: unix.IPV6_PMTUDISC_DONT,
+		},
+		{
+			name:  "IPv6 do",
+			local: "[::1]:0", peer: "[::1]:5000",
+			mode:  PMTUDiscDo,
+			level: unix.IPPROTO_IPV6, opt: unix.IPV6_MTU_DISCOVER,
+			expect: unix.IPV6_PMTUDISC_DO,
+		},
 	}
-	if sid > 0 {
-		sidArgStr = "session_id"
-		sidStr = fmt.Sprintf("%d", sid)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sal, sap, err := newUDPAddressPair(c.local, 0, c.peer, AddressFamilyAny)
+			if err != nil {
+				t.Fatalf("newUDPAddressPair(%v, %v): %v", c.local, c.peer, err)
+			}
+			cp, err := newL2tpControlPlane(sal, sap)
+			if err != nil {
+				t.Skipf("newL2tpControlPlane(%v, %v): %v", sal, sap, err)
+			}
+			defer cp.close()
+
+			err = cp.setPMTUDisc(c.mode)
+			if err != nil {
+				t.Fatalf("setPMTUDisc(%v): %v", c.mode, err)
+			}
+			got, err := unix.GetsockoptInt(cp.fd, c.level, c.opt)
+			if err != nil {
+				t.Fatalf("GetsockoptInt(): %v", err)
+			}
+			if got != c.expect {
+				t.Errorf("expected sockopt value %v, got %v", c.expect, got)
+			}
+
+			_, err = cp.pathMTU()
+			if err == nil {
+				t.Errorf("pathMTU() on unconnected socket succeeded when we expected an error")
+			}
+
+			err = cp.bind()
+			if err != nil {
+				t.Fatalf("bind(): %v", err)
+			}
+			err = cp.connect()
+			if err != nil {
+				t.Fatalf("connect(): %v", err)
+			}
+			// The loopback MTU is far larger than any realistic path
+			// MTU, but must at least meet the IPv6 minimum
+			mtu, err := cp.pathMTU()
+			if err != nil {
+				t.Fatalf("pathMTU(): %v", err)
+			}
+			if mtu < 1280 {
+				t.Errorf("pathMTU(): unexpected MTU %v", mtu)
+			}
+		})
 	}
+}
 
-	cmd := exec.Command("sudo", "ip", "l2tp", "show", "session", tidArgStr, tidStr, sidArgStr, sidStr)
-	cmd.Stdout = &sout
+func TestBindToDeviceSockopt(t *testing.T) {
+	sal, sap, err := newUDPAddressPair("127.0.0.1:0", 0, "127.0.0.1:5000", AddressFamilyAny)
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(%v, %v): %v", sal, sap, err)
+	}
+	defer cp.close()
 
-	err = cmd.Run()
+	err = cp.bindToDevice("lo")
 	if err != nil {
-		return "", err
+		if strings.Contains(err.Error(), "CAP_NET_RAW") {
+			t.Skipf("bindToDevice(): %v", err)
+		}
+		t.Fatalf("bindToDevice(): %v", err)
 	}
 
-	fmt.Println(sout.String())
+	got, err := unix.GetsockoptString(cp.fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	if err != nil {
+		t.Fatalf("GetsockoptString(): %v", err)
+	}
+	if got != "lo" {
+		t.Errorf("expected socket bound to %q, got %q", "lo", got)
+	}
 
-	return sout.String(), nil
+	err = cp.bindToDevice("nosuchdev0")
+	if err == nil {
+		t.Errorf("expected error binding to nonexistent device")
+	}
 }
 
-func validateIPL2tpTunnelOut(out string, tid, ptid uint32, encap EncapType) error {
-	expect := []string{
-		fmt.Sprintf("Tunnel %v,", tid),
-		fmt.Sprintf("encap %v", encap),
-		fmt.Sprintf("Peer tunnel %v", ptid),
+func TestBindToIfindexSockopt(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("InterfaceByName(): %v", err)
 	}
-	for _, e := range expect {
-		if !strings.Contains(out, e) {
-			return fmt.Errorf("failed to locate expected substring %q in output %q", e, out)
+
+	sal, sap, err := newUDPAddressPair("127.0.0.1:0", 0, "127.0.0.1:5000", AddressFamilyAny)
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(%v, %v): %v", sal, sap, err)
+	}
+	defer cp.close()
+
+	err = cp.bindToIfindex(lo.Index)
+	if err != nil {
+		if strings.Contains(err.Error(), "CAP_NET_RAW") {
+			t.Skipf("bindToIfindex(): %v", err)
 		}
+		t.Fatalf("bindToIfindex(): %v", err)
+	}
+
+	got, err := unix.GetsockoptInt(cp.fd, unix.SOL_SOCKET, unix.SO_BINDTOIFINDEX)
+	if err != nil {
+		t.Fatalf("GetsockoptInt(): %v", err)
+	}
+	if got != lo.Index {
+		t.Errorf("expected socket bound to interface index %v, got %v", lo.Index, got)
 	}
-	return nil
 }
 
-func validateIPL2tpSessionOut(out string, tid, sid, ptid, psid uint32, ifnam string) error {
-	expect := []string{
-		fmt.Sprintf("Session %v in", sid),
-		fmt.Sprintf("in tunnel %v", tid),
-		fmt.Sprintf("Peer session %v,", psid),
-		fmt.Sprintf(", tunnel %v", ptid),
+func TestReusePort(t *testing.T) {
+	bindControlPlane := func(local string, reuse bool) (*controlPlane, error) {
+		sal, sap, err := newUDPAddressPair(local, 0, "127.0.0.1:5000", AddressFamilyAny)
+		if err != nil {
+			return nil, fmt.Errorf("newUDPAddressPair(): %v", err)
+		}
+		cp, err := newL2tpControlPlane(sal, sap)
+		if err != nil {
+			return nil, fmt.Errorf("newL2tpControlPlane(): %v", err)
+		}
+		err = cp.setReusePort(reuse)
+		if err != nil {
+			cp.close()
+			return nil, fmt.Errorf("setReusePort(): %v", err)
+		}
+		err = cp.bind()
+		if err != nil {
+			cp.close()
+			return nil, fmt.Errorf("bind(): %v", err)
+		}
+		return cp, nil
 	}
 
-	if ifnam != "" {
-		expect = append(expect, fmt.Sprintf("interface name: %v", ifnam))
+	cp1, err := bindControlPlane("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatalf("first socket: %v", err)
+	}
+	defer cp1.close()
+	sa, err := unix.Getsockname(cp1.fd)
+	if err != nil {
+		t.Fatalf("Getsockname(): %v", err)
 	}
+	local := fmt.Sprintf("127.0.0.1:%d", sa.(*unix.SockaddrInet4).Port)
 
-	for _, e := range expect {
-		if !strings.Contains(out, e) {
-			return fmt.Errorf("failed to locate expected substring %q in output %q", e, out)
-		}
+	cp2, err := bindControlPlane(local, true)
+	if err != nil {
+		t.Fatalf("second socket with port reuse: %v", err)
+	}
+	defer cp2.close()
+
+	cp3, err := bindControlPlane(local, false)
+	if err == nil {
+		cp3.close()
+		t.Errorf("third socket without port reuse: bind succeeded when we expected an error")
 	}
-	return nil
 }
 
-func checkSession(tcfg *TunnelConfig, scfg *SessionConfig) error {
-	tid := uint32(tcfg.TunnelID)
-	sid := uint32(scfg.SessionID)
-	ptid := uint32(tcfg.PeerTunnelID)
-	psid := uint32(scfg.PeerSessionID)
-	out, err := ipL2tpShowSession(tid, sid)
+func TestSocketPrioritySockopt(t *testing.T) {
+	sal, sap, err := newUDPAddressPair("127.0.0.1:0", 0, "127.0.0.1:5000", AddressFamilyAny)
 	if err != nil {
-		return fmt.Errorf("ip l2tp couldn't show session %v/%v: %v", tid, sid, err)
+		t.Fatalf("newUDPAddressPair(): %v", err)
 	}
-	return validateIPL2tpSessionOut(out, tid, sid, ptid, psid, scfg.InterfaceName)
-}
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(%v, %v): %v", sal, sap, err)
+	}
+	defer cp.close()
 
-func checkTunnel(cfg *TunnelConfig) error {
-	tid := uint32(cfg.TunnelID)
-	ptid := uint32(cfg.PeerTunnelID)
-	out, err := ipL2tpShowTunnel(tid)
+	// Priorities 0 - 6 don't require CAP_NET_ADMIN
+	err = cp.setPriority(5)
 	if err != nil {
-		return fmt.Errorf("ip l2tp couldn't show tunnel %v: %v", tid, err)
+		t.Fatalf("setPriority(): %v", err)
 	}
-	return validateIPL2tpTunnelOut(out, tid, ptid, cfg.Encap)
+
+	got, err := unix.GetsockoptInt(cp.fd, unix.SOL_SOCKET, unix.SO_PRIORITY)
+	if err != nil {
+		t.Fatalf("GetsockoptInt(): %v", err)
+	}
+	if got != 5 {
+		t.Errorf("expected socket priority 5, got %v", got)
+	}
+}
+
+func TestIPv6FlowLabelSockopt(t *testing.T) {
+	const label = 0xabcde
+
+	// The receiving socket requests the flow info of received packets
+	rfd, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
+	if err != nil {
+		t.Fatalf("socket(): %v", err)
+	}
+	defer unix.Close(rfd)
+	err = unix.Bind(rfd, &unix.SockaddrInet6{Addr: [16]byte{15: 1}})
+	if err != nil {
+		t.Skipf("bind(): IPv6 loopback unavailable: %v", err)
+	}
+	err = unix.SetsockoptInt(rfd, unix.IPPROTO_IPV6, ipv6FlowInfo, 1)
+	if err != nil {
+		t.Fatalf("SetsockoptInt(IPV6_FLOWINFO): %v", err)
+	}
+	err = unix.SetsockoptTimeval(rfd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 2})
+	if err != nil {
+		t.Fatalf("SetsockoptTimeval(SO_RCVTIMEO): %v", err)
+	}
+	rsa, err := unix.Getsockname(rfd)
+	if err != nil {
+		t.Fatalf("Getsockname(): %v", err)
+	}
+	peer := fmt.Sprintf("[::1]:%d", rsa.(*unix.SockaddrInet6).Port)
+
+	sal, sap, err := newUDPAddressPair("[::1]:0", 0, peer, AddressFamilyAny)
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(%v, %v): %v", sal, sap, err)
+	}
+	defer cp.close()
+
+	err = cp.setIPv6FlowLabel(ipv6FlowLabelMask + 1)
+	if err == nil {
+		t.Errorf("setIPv6FlowLabel(): expected error for out of range label")
+	}
+
+	err = cp.setIPv6FlowLabel(label)
+	if err != nil {
+		t.Fatalf("setIPv6FlowLabel(): %v", err)
+	}
+	got, err := unix.GetsockoptInt(cp.fd, unix.IPPROTO_IPV6, ipv6FlowInfoSend)
+	if err != nil {
+		t.Fatalf("GetsockoptInt(IPV6_FLOWINFO_SEND): %v", err)
+	}
+	if got != 1 {
+		t.Errorf("expected IPV6_FLOWINFO_SEND 1, got %v", got)
+	}
+
+	err = cp.bind()
+	if err != nil {
+		t.Fatalf("bind(): %v", err)
+	}
+	err = cp.connect()
+	if err != nil {
+		t.Fatalf("connect(): %v", err)
+	}
+	_, err = cp.write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("write(): %v", err)
+	}
+
+	b := make([]byte, 64)
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, err := unix.Recvmsg(rfd, b, oob, 0)
+	if err != nil {
+		t.Fatalf("Recvmsg(): %v", err)
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		t.Fatalf("ParseSocketControlMessage(): %v", err)
+	}
+	var found bool
+	for _, m := range cmsgs {
+		if m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == ipv6FlowInfo && len(m.Data) >= 4 {
+			found = true
+			if fl := binary.BigEndian.Uint32(m.Data) & ipv6FlowLabelMask; fl != label {
+				t.Errorf("expected flow label %#x, got %#x", label, fl)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no flow info received")
+	}
+
+	// Flow labels are for IPv6 only
+	sal, sap, err = newUDPAddressPair("127.0.0.1:0", 0, "127.0.0.1:5000", AddressFamilyAny)
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	cp4, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(%v, %v): %v", sal, sap, err)
+	}
+	defer cp4.close()
+	err = cp4.setIPv6FlowLabel(label)
+	if err == nil {
+		t.Errorf("setIPv6FlowLabel(): expected error for IPv4 socket")
+	}
+}
+
+func TestWriteControlMessage(t *testing.T) {
+	tcfg := &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion2,
+		Encap:        EncapTypeUDP,
+		TunnelID:     21,
+		PeerTunnelID: 42,
+	}
+	msg := &RawControlMessage{
+		SessionID: 7,
+		AVPs: []RawAVP{
+			{Mandatory: true, Value: []byte{0x00, 0x06}},
+			{VendorID: 9, Type: 99, Value: []byte{0xde, 0xad}},
+		},
+	}
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peer.Close()
+
+	t.Run("disabled", func(t *testing.T) {
+		ctx, err := NewContext(nil, nil)
+		if err != nil {
+			t.Fatalf("NewContext(): %v", err)
+		}
+		defer ctx.Close()
+
+		tunl, err := ctx.NewQuiescentTunnel("t1", tcfg)
+		if err != nil {
+			t.Fatalf("NewQuiescentTunnel(): %v", err)
+		}
+
+		w, ok := tunl.(ControlMessageWriter)
+		if !ok {
+			t.Fatalf("quiescent tunnel doesn't implement ControlMessageWriter")
+		}
+		err = w.WriteControlMessage(msg)
+		if err == nil {
+			t.Errorf("expected WriteControlMessage to fail without WithUnsafeControlMessages")
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		ctx, err := NewContextWithOptions(nil, nil, WithUnsafeControlMessages())
+		if err != nil {
+			t.Fatalf("NewContextWithOptions(): %v", err)
+		}
+
+		tunl, err := ctx.NewQuiescentTunnel("t1", tcfg)
+		if err != nil {
+			t.Fatalf("NewQuiescentTunnel(): %v", err)
+		}
+
+		// The peer doesn't ack the message, so the write won't complete
+		// until the tunnel is closed.
+		errChan := make(chan error)
+		go func() {
+			errChan <- tunl.(ControlMessageWriter).WriteControlMessage(msg)
+		}()
+
+		want := []byte{
+			0xc8, 0x02, 0x00, 0x1c, 0x00, 0x2a, 0x00, 0x07, 0x00, 0x00, 0x00, 0x00,
+			0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06,
+			0x00, 0x08, 0x00, 0x09, 0x00, 0x63, 0xde, 0xad,
+		}
+		got := make([]byte, 1024)
+		peer.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := peer.Read(got)
+		if err != nil {
+			t.Errorf("peer Read(): %v", err)
+		} else if !bytes.Equal(got[:n], want) {
+			t.Errorf("expected peer to receive %x, got %x", want, got[:n])
+		}
+
+		ctx.Close()
+		if err = <-errChan; err == nil {
+			t.Errorf("expected unacked WriteControlMessage to fail on tunnel close")
+		}
+	})
+}
+
+func ipL2tpShowTunnel(tid uint32) (out string, err error) {
+	var tidStr string
+	var tidArgStr string
+	var sout bytes.Buffer
+
+	if tid > 0 {
+		tidArgStr = "tunnel_id"
+		tidStr = fmt.Sprintf("%d", tid)
+	}
+
+	cmd := exec.Command("sudo", "ip", "l2tp", "show", "tunnel", tidArgStr, tidStr)
+	cmd.Stdout = &sout
+
+	err = cmd.Run()
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Println(sout.String())
+
+	return sout.String(), nil
+}
+
+func ipL2tpShowSession(tid, sid uint32) (out string, err error) {
+	var tidStr string
+	var tidArgStr string
+	var sidStr string
+	var sidArgStr string
+	var sout bytes.Buffer
+
+	if tid > 0 {
+		tidArgStr = "tunnel_id"
+		tidStr = fmt.Sprintf("%d", tid)
+	}
+	if sid > 0 {
+		sidArgStr = "session_id"
+		sidStr = fmt.Sprintf("%d", sid)
+	}
+
+	cmd := exec.Command("sudo", "ip", "l2tp", "show", "session", tidArgStr, tidStr, sidArgStr, sidStr)
+	cmd.Stdout = &sout
+
+	err = cmd.Run()
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Println(sout.String())
+
+	return sout.String(), nil
+}
+
+func validateIPL2tpTunnelOut(out string, tid, ptid uint32, encap EncapType) error {
+	expect := []string{
+		fmt.Sprintf("Tunnel %v,", tid),
+		fmt.Sprintf("encap %v", encap),
+		fmt.Sprintf("Peer tunnel %v", ptid),
+	}
+	for _, e := range expect {
+		if !strings.Contains(out, e) {
+			return fmt.Errorf("failed to locate expected substring %q in output %q", e, out)
+		}
+	}
+	return nil
+}
+
+func validateIPL2tpSessionOut(out string, tid, sid, ptid, psid uint32, ifnam string) error {
+	expect := []string{
+		fmt.Sprintf("Session %v in", sid),
+		fmt.Sprintf("in tunnel %v", tid),
+		fmt.Sprintf("Peer session %v,", psid),
+		fmt.Sprintf(", tunnel %v", ptid),
+	}
+
+	if ifnam != "" {
+		expect = append(expect, fmt.Sprintf("interface name: %v", ifnam))
+	}
+
+	for _, e := range expect {
+		if !strings.Contains(out, e) {
+			return fmt.Errorf("failed to locate expected substring %q in output %q", e, out)
+		}
+	}
+	return nil
+}
+
+func checkSession(tcfg *TunnelConfig, scfg *SessionConfig) error {
+	tid := uint32(tcfg.TunnelID)
+	sid := uint32(scfg.SessionID)
+	ptid := uint32(tcfg.PeerTunnelID)
+	psid := uint32(scfg.PeerSessionID)
+	out, err := ipL2tpShowSession(tid, sid)
+	if err != nil {
+		return fmt.Errorf("ip l2tp couldn't show session %v/%v: %v", tid, sid, err)
+	}
+	return validateIPL2tpSessionOut(out, tid, sid, ptid, psid, scfg.InterfaceName)
+}
+
+func checkTunnel(cfg *TunnelConfig) error {
+	tid := uint32(cfg.TunnelID)
+	ptid := uint32(cfg.PeerTunnelID)
+	out, err := ipL2tpShowTunnel(tid)
+	if err != nil {
+		return fmt.Errorf("ip l2tp couldn't show tunnel %v: %v", tid, err)
+	}
+	return validateIPL2tpTunnelOut(out, tid, ptid, cfg.Encap)
+}
+
+func TestIPAddressPairLocalAutoselect(t *testing.T) {
+	defer func(fn func(net.IP) (net.IP, error)) { routeSourceLookup = fn }(routeSourceLookup)
+
+	cases := []struct {
+		name   string
+		peer   string
+		lookup func(dst net.IP) (net.IP, error)
+		expect unix.Sockaddr
+	}{
+		{
+			name: "IPv4 route",
+			peer: "198.51.100.1",
+			lookup: func(dst net.IP) (net.IP, error) {
+				return net.ParseIP("192.0.2.1"), nil
+			},
+			expect: &unix.SockaddrL2TPIP{Addr: [4]byte{192, 0, 2, 1}, ConnId: 42},
+		},
+		{
+			name: "IPv4 no route",
+			peer: "198.51.100.1",
+			lookup: func(dst net.IP) (net.IP, error) {
+				return nil, fmt.Errorf("network unreachable")
+			},
+			expect: &unix.SockaddrL2TPIP{},
+		},
+		{
+			name: "IPv6 route",
+			peer: "2001:db8::1",
+			lookup: func(dst net.IP) (net.IP, error) {
+				return net.ParseIP("2001:db8::2"), nil
+			},
+			expect: &unix.SockaddrL2TPIP6{
+				Addr:   [16]byte{0x20, 0x01, 0x0d, 0xb8, 14: 0x00, 15: 0x02},
+				ConnId: 42,
+			},
+		},
+		{
+			name: "IPv6 no route",
+			peer: "2001:db8::1",
+			lookup: func(dst net.IP) (net.IP, error) {
+				return nil, fmt.Errorf("network unreachable")
+			},
+			expect: &unix.SockaddrL2TPIP6{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var dst net.IP
+			routeSourceLookup = func(ip net.IP) (net.IP, error) {
+				dst = ip
+				return c.lookup(ip)
+			}
+
+			sal, sap, err := newIPAddressPair("", 42, c.peer, 24, AddressFamilyAny)
+			if err != nil {
+				t.Fatalf("newIPAddressPair(%q): %v", c.peer, err)
+			}
+
+			peer, err := newIPTunnelAddress(c.peer, 24, AddressFamilyAny)
+			if err != nil {
+				t.Fatalf("newIPTunnelAddress(%q): %v", c.peer, err)
+			}
+			if !reflect.DeepEqual(sap, peer) {
+				t.Errorf("expected peer address %v, got %v", peer, sap)
+			}
+			if ip := net.ParseIP(c.peer); !ip.Equal(dst) {
+				t.Errorf("expected route lookup for %v, got %v", ip, dst)
+			}
+			if !reflect.DeepEqual(sal, c.expect) {
+				t.Errorf("expected local address %v, got %v", c.expect, sal)
+			}
+		})
+	}
+}
+
+func TestUDPAddressPairLocalPort(t *testing.T) {
+	cases := []struct {
+		name      string
+		local     string
+		localPort uint16
+		peer      string
+		expect    unix.Sockaddr
+		expectErr bool
+	}{
+		{
+			name:   "IPv4 ip only",
+			local:  "127.0.0.1",
+			peer:   "127.0.0.1:5000",
+			expect: &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 1701},
+		},
+		{
+			name:      "IPv4 ip only with port override",
+			local:     "127.0.0.1",
+			localPort: 6000,
+			peer:      "127.0.0.1:5000",
+			expect:    &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 6000},
+		},
+		{
+			name:      "IPv4 ip:port",
+			local:     "127.0.0.1:6001",
+			localPort: 6000,
+			peer:      "127.0.0.1:5000",
+			expect:    &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 6001},
+		},
+		{
+			name:   "IPv4 ephemeral port",
+			local:  "127.0.0.1:0",
+			peer:   "127.0.0.1:5000",
+			expect: &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}},
+		},
+		{
+			name:   "IPv4 empty",
+			peer:   "127.0.0.1:5000",
+			expect: &unix.SockaddrInet4{Port: 1701},
+		},
+		{
+			name:      "IPv4 empty with port override",
+			localPort: 6000,
+			peer:      "127.0.0.1:5000",
+			expect:    &unix.SockaddrInet4{Port: 6000},
+		},
+		{
+			name:   "IPv6 ip only",
+			local:  "::1",
+			peer:   "[::1]:5000",
+			expect: &unix.SockaddrInet6{Addr: [16]byte{15: 1}, Port: 1701},
+		},
+		{
+			name:   "IPv6 bracketed ip only",
+			local:  "[::1]",
+			peer:   "[::1]:5000",
+			expect: &unix.SockaddrInet6{Addr: [16]byte{15: 1}, Port: 1701},
+		},
+		{
+			name:   "IPv6 ip:port",
+			local:  "[::1]:6001",
+			peer:   "[::1]:5000",
+			expect: &unix.SockaddrInet6{Addr: [16]byte{15: 1}, Port: 6001},
+		},
+		{
+			name:   "IPv6 empty",
+			peer:   "[::1]:5000",
+			expect: &unix.SockaddrInet6{Port: 1701},
+		},
+		{
+			name:      "port out of range",
+			local:     "127.0.0.1:65536",
+			peer:      "127.0.0.1:5000",
+			expectErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sal, _, err := newUDPAddressPair(c.local, c.localPort, c.peer, AddressFamilyAny)
+			if c.expectErr {
+				if err == nil {
+					t.Fatalf("newUDPAddressPair(%q): expected error, got local address %v", c.local, sal)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newUDPAddressPair(%q): %v", c.local, err)
+			}
+			if !reflect.DeepEqual(sal, c.expect) {
+				t.Errorf("expected local address %v, got %v", c.expect, sal)
+			}
+		})
+	}
+}
+
+func TestAddressPairPorts(t *testing.T) {
+	cases := []struct {
+		name        string
+		encap       EncapType
+		local, peer string
+		expectLocal unix.Sockaddr
+		expectPeer  unix.Sockaddr
+		expectErr   bool
+	}{
+		{
+			name:        "UDP port present",
+			encap:       EncapTypeUDP,
+			local:       "127.0.0.1:6000",
+			peer:        "127.0.0.1:5000",
+			expectLocal: &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 6000},
+			expectPeer:  &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 5000},
+		},
+		{
+			name:        "UDP port absent",
+			encap:       EncapTypeUDP,
+			local:       "127.0.0.1",
+			peer:        "127.0.0.1",
+			expectLocal: &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 1701},
+			expectPeer:  &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 1701},
+		},
+		{
+			name:        "UDP IPv6 port absent",
+			encap:       EncapTypeUDP,
+			peer:        "[::1]",
+			expectLocal: &unix.SockaddrInet6{Port: 1701},
+			expectPeer:  &unix.SockaddrInet6{Addr: [16]byte{15: 1}, Port: 1701},
+		},
+		{
+			name:        "IP port absent",
+			encap:       EncapTypeIP,
+			local:       "127.0.0.1",
+			peer:        "127.0.0.1",
+			expectLocal: &unix.SockaddrL2TPIP{Addr: [4]byte{127, 0, 0, 1}, ConnId: 42},
+			expectPeer:  &unix.SockaddrL2TPIP{Addr: [4]byte{127, 0, 0, 1}, ConnId: 24},
+		},
+		{
+			name:        "IP IPv6 port absent",
+			encap:       EncapTypeIP,
+			local:       "[::1]",
+			peer:        "::1",
+			expectLocal: &unix.SockaddrL2TPIP6{Addr: [16]byte{15: 1}, ConnId: 42},
+			expectPeer:  &unix.SockaddrL2TPIP6{Addr: [16]byte{15: 1}, ConnId: 24},
+		},
+		{
+			name:      "IP peer port present",
+			encap:     EncapTypeIP,
+			local:     "127.0.0.1",
+			peer:      "127.0.0.1:1701",
+			expectErr: true,
+		},
+		{
+			name:      "IP local port present",
+			encap:     EncapTypeIP,
+			local:     "[::1]:1701",
+			peer:      "::1",
+			expectErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var sal, sap unix.Sockaddr
+			var err error
+			if c.encap == EncapTypeUDP {
+				sal, sap, err = newUDPAddressPair(c.local, 0, c.peer, AddressFamilyAny)
+			} else {
+				sal, sap, err = newIPAddressPair(c.local, 42, c.peer, 24, AddressFamilyAny)
+			}
+			if c.expectErr {
+				var addrErr *AddressError
+				if !errors.As(err, &addrErr) {
+					t.Fatalf("expected *AddressError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("address pair %q/%q: %v", c.local, c.peer, err)
+			}
+			if !reflect.DeepEqual(sal, c.expectLocal) {
+				t.Errorf("expected local address %v, got %v", c.expectLocal, sal)
+			}
+			if !reflect.DeepEqual(sap, c.expectPeer) {
+				t.Errorf("expected peer address %v, got %v", c.expectPeer, sap)
+			}
+		})
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	defer func(fn func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = fn }(lookupIPAddr)
+
+	// Resolve test names without relying on the host's DNS configuration
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "dualstack.test":
+			return []net.IPAddr{{IP: net.IPv6loopback}, {IP: net.IPv4(127, 0, 0, 1)}}, nil
+		case "ipv4only.test":
+			return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+		case "ipv6only.test":
+			return []net.IPAddr{{IP: net.IPv6loopback}}, nil
+		}
+		return nil, fmt.Errorf("no such host %v", host)
+	}
+
+	ipv4 := &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 5000}
+	ipv6 := &unix.SockaddrInet6{Addr: [16]byte{15: 1}, Port: 5000}
+	cases := []struct {
+		name   string
+		peer   string
+		family AddressFamily
+		expect unix.Sockaddr
+	}{
+		{"dual stack any", "dualstack.test:5000", AddressFamilyAny, ipv4},
+		{"dual stack IPv4", "dualstack.test:5000", AddressFamilyIPv4, ipv4},
+		{"dual stack IPv6", "dualstack.test:5000", AddressFamilyIPv6, ipv6},
+		{"IPv6 only any", "ipv6only.test:5000", AddressFamilyAny, ipv6},
+		{"IPv4 only IPv6", "ipv4only.test:5000", AddressFamilyIPv6, nil},
+		{"IPv6 only IPv4", "ipv6only.test:5000", AddressFamilyIPv4, nil},
+		{"IPv4 literal IPv6", "127.0.0.1:5000", AddressFamilyIPv6, nil},
+		{"IPv6 literal IPv6", "[::1]:5000", AddressFamilyIPv6, ipv6},
+		{"IPv6 literal IPv4", "[::1]:5000", AddressFamilyIPv4, nil},
+		{"unknown host", "nosuchhost.test:5000", AddressFamilyAny, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, sap, err := newUDPAddressPair("", 0, c.peer, c.family)
+			if c.expect == nil {
+				if err == nil {
+					t.Fatalf("newUDPAddressPair(%q, %v): expected error, got peer address %v", c.peer, c.family, sap)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newUDPAddressPair(%q, %v): %v", c.peer, c.family, err)
+			}
+			if !reflect.DeepEqual(sap, c.expect) {
+				t.Errorf("expected peer address %v, got %v", c.expect, sap)
+			}
+		})
+	}
+
+	if err := validateTunnelConfig(TunnelTypeDynamic, &TunnelConfig{AddressFamily: AddressFamilyIPv6 + 1}); err == nil {
+		t.Errorf("validateTunnelConfig(): expected error for unrecognised address family")
+	}
+}
+
+func TestConfigureEthInterface(t *testing.T) {
+	defer func(fn func(string) (int, error)) { linkIndexLookup = fn }(linkIndexLookup)
+	defer func(fn func(netlink.Message) error) { linkExecute = fn }(linkExecute)
+
+	linkIndexLookup = func(name string) (int, error) {
+		switch name {
+		case "l2tpeth0":
+			return 7, nil
+		case "br0":
+			return 3, nil
+		}
+		return 0, fmt.Errorf("no such interface")
+	}
+
+	type linkSetRequest struct {
+		ifindex       int32
+		flags, change uint32
+		attrs         map[uint16]uint32
+	}
+	var requests []linkSetRequest
+	linkExecute = func(m netlink.Message) error {
+		if m.Header.Type != unix.RTM_SETLINK {
+			return fmt.Errorf("unexpected message type %v", m.Header.Type)
+		}
+		if m.Header.Flags != netlink.Request|netlink.Acknowledge {
+			return fmt.Errorf("unexpected message flags %v", m.Header.Flags)
+		}
+		if len(m.Data) < sizeofIfInfoMsg {
+			return fmt.Errorf("short message")
+		}
+		req := linkSetRequest{
+			ifindex: nlenc.Int32(m.Data[4:8]),
+			flags:   nlenc.Uint32(m.Data[8:12]),
+			change:  nlenc.Uint32(m.Data[12:16]),
+			attrs:   make(map[uint16]uint32),
+		}
+		ad, err := netlink.NewAttributeDecoder(m.Data[sizeofIfInfoMsg:])
+		if err != nil {
+			return err
+		}
+		for ad.Next() {
+			req.attrs[ad.Type()] = ad.Uint32()
+		}
+		requests = append(requests, req)
+		return ad.Err()
+	}
+
+	cases := []struct {
+		name      string
+		ifname    string
+		scfg      *SessionConfig
+		expect    []linkSetRequest
+		expectErr bool
+	}{
+		{
+			name:   "no options",
+			ifname: "l2tpeth0",
+			scfg:   &SessionConfig{},
+		},
+		{
+			name:   "MTU",
+			ifname: "l2tpeth0",
+			scfg:   &SessionConfig{MTU: 1400},
+			expect: []linkSetRequest{
+				{ifindex: 7, attrs: map[uint16]uint32{unix.IFLA_MTU: 1400}},
+			},
+		},
+		{
+			name:   "MTU and bridge",
+			ifname: "l2tpeth0",
+			scfg:   &SessionConfig{MTU: 1400, Bridge: "br0"},
+			expect: []linkSetRequest{
+				{ifindex: 7, attrs: map[uint16]uint32{unix.IFLA_MTU: 1400}},
+				{ifindex: 7, attrs: map[uint16]uint32{unix.IFLA_MASTER: 3}},
+			},
+		},
+		{
+			name:   "admin up",
+			ifname: "l2tpeth0",
+			scfg:   &SessionConfig{MTU: 1400, AdminUp: true},
+			expect: []linkSetRequest{
+				{ifindex: 7, attrs: map[uint16]uint32{unix.IFLA_MTU: 1400}},
+				{ifindex: 7, flags: unix.IFF_UP, change: unix.IFF_UP, attrs: map[uint16]uint32{}},
+			},
+		},
+		{
+			name:      "bad bridge",
+			ifname:    "l2tpeth0",
+			scfg:      &SessionConfig{Bridge: "br1"},
+			expectErr: true,
+		},
+		{
+			name:      "bad interface",
+			ifname:    "l2tpeth1",
+			scfg:      &SessionConfig{MTU: 1400},
+			expectErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			requests = nil
+			err := configureEthInterface(c.ifname, c.scfg)
+			if c.expectErr {
+				if err == nil {
+					t.Fatalf("configureEthInterface(): expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("configureEthInterface(): %v", err)
+			}
+			if !reflect.DeepEqual(requests, c.expect) {
+				t.Errorf("expected requests %v, got %v", c.expect, requests)
+			}
+		})
+	}
+
+	// Detaching from the bridge sets a zero master index
+	requests = nil
+	err := linkSetMaster("l2tpeth0", "")
+	if err != nil {
+		t.Fatalf("linkSetMaster(): %v", err)
+	}
+	expect := []linkSetRequest{{ifindex: 7, attrs: map[uint16]uint32{unix.IFLA_MASTER: 0}}}
+	if !reflect.DeepEqual(requests, expect) {
+		t.Errorf("expected requests %v, got %v", expect, requests)
+	}
+
+	// Setting the interface down clears IFF_UP
+	requests = nil
+	err = linkSetDown("l2tpeth0")
+	if err != nil {
+		t.Fatalf("linkSetDown(): %v", err)
+	}
+	expect = []linkSetRequest{{ifindex: 7, flags: 0, change: unix.IFF_UP, attrs: map[uint16]uint32{}}}
+	if !reflect.DeepEqual(requests, expect) {
+		t.Errorf("expected requests %v, got %v", expect, requests)
+	}
+}
+
+func TestConfigureEthInterfaceAddress(t *testing.T) {
+	defer func(fn func(string) (int, error)) { linkIndexLookup = fn }(linkIndexLookup)
+	defer func(fn func(netlink.Message) error) { linkExecute = fn }(linkExecute)
+
+	linkIndexLookup = func(name string) (int, error) {
+		if name == "l2tpeth0" {
+			return 7, nil
+		}
+		return 0, fmt.Errorf("no such interface")
+	}
+
+	type addrAddRequest struct {
+		family, prefixLen uint8
+		ifindex           uint32
+		local, address    net.IP
+	}
+	var requests []interface{}
+	linkExecute = func(m netlink.Message) error {
+		switch m.Header.Type {
+		case unix.RTM_SETLINK:
+			requests = append(requests, "setlink")
+			return nil
+		case unix.RTM_NEWADDR:
+		default:
+			return fmt.Errorf("unexpected message type %v", m.Header.Type)
+		}
+		expectFlags := netlink.Request | netlink.Acknowledge | netlink.Create | netlink.Excl
+		if m.Header.Flags != expectFlags {
+			return fmt.Errorf("unexpected message flags %v", m.Header.Flags)
+		}
+		if len(m.Data) < sizeofIfAddrMsg {
+			return fmt.Errorf("short message")
+		}
+		req := addrAddRequest{
+			family:    m.Data[0],
+			prefixLen: m.Data[1],
+			ifindex:   nlenc.Uint32(m.Data[4:8]),
+		}
+		ad, err := netlink.NewAttributeDecoder(m.Data[sizeofIfAddrMsg:])
+		if err != nil {
+			return err
+		}
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.IFA_LOCAL:
+				req.local = net.IP(ad.Bytes())
+			case unix.IFA_ADDRESS:
+				req.address = net.IP(ad.Bytes())
+			}
+		}
+		requests = append(requests, req)
+		return ad.Err()
+	}
+
+	cases := []struct {
+		name      string
+		scfg      *SessionConfig
+		expect    []interface{}
+		expectErr bool
+	}{
+		{
+			name: "IPv4 address",
+			scfg: &SessionConfig{Address: "192.0.2.1/24"},
+			expect: []interface{}{
+				addrAddRequest{
+					family:    unix.AF_INET,
+					prefixLen: 24,
+					ifindex:   7,
+					local:     net.IP{192, 0, 2, 1},
+					address:   net.IP{192, 0, 2, 1},
+				},
+			},
+		},
+		{
+			name: "IPv4 point-to-point address and admin up",
+			scfg: &SessionConfig{Address: "192.0.2.1/32", PeerAddress: "192.0.2.2", AdminUp: true},
+			expect: []interface{}{
+				addrAddRequest{
+					family:    unix.AF_INET,
+					prefixLen: 32,
+					ifindex:   7,
+					local:     net.IP{192, 0, 2, 1},
+					address:   net.IP{192, 0, 2, 2},
+				},
+				"setlink",
+			},
+		},
+		{
+			name: "IPv6 address",
+			scfg: &SessionConfig{Address: "2001:db8::1/64"},
+			expect: []interface{}{
+				addrAddRequest{
+					family:    unix.AF_INET6,
+					prefixLen: 64,
+					ifindex:   7,
+					local:     net.ParseIP("2001:db8::1"),
+					address:   net.ParseIP("2001:db8::1"),
+				},
+			},
+		},
+		{
+			name:      "mismatched peer address family",
+			scfg:      &SessionConfig{Address: "192.0.2.1/32", PeerAddress: "2001:db8::2"},
+			expectErr: true,
+		},
+		{
+			name:      "bad address",
+			scfg:      &SessionConfig{Address: "192.0.2.1"},
+			expectErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			requests = nil
+			err := configureEthInterface("l2tpeth0", c.scfg)
+			if c.expectErr {
+				if err == nil {
+					t.Fatalf("configureEthInterface(): expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("configureEthInterface(): %v", err)
+			}
+			if !reflect.DeepEqual(requests, c.expect) {
+				t.Errorf("expected requests %v, got %v", c.expect, requests)
+			}
+		})
+	}
+}
+
+func TestValidateInterfaceName(t *testing.T) {
+	cases := []struct {
+		name      string
+		ifname    string
+		expectErr bool
+	}{
+		{name: "valid", ifname: "l2tpeth42"},
+		{name: "maximum length", ifname: "l2tpeth01234567"},
+		{name: "template", ifname: "l2tpeth%d"},
+		{name: "empty", ifname: "", expectErr: true},
+		{name: "too long", ifname: "l2tpeth012345678", expectErr: true},
+		{name: "reserved", ifname: "..", expectErr: true},
+		{name: "slash", ifname: "l2tp/eth0", expectErr: true},
+		{name: "colon", ifname: "l2tpeth0:1", expectErr: true},
+		{name: "space", ifname: "l2tp eth0", expectErr: true},
+		{name: "control character", ifname: "l2tp\teth0", expectErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := ValidateInterfaceName(c.ifname)
+			if c.expectErr && err == nil {
+				t.Errorf("ValidateInterfaceName(%q) succeeded, expected error", c.ifname)
+			} else if !c.expectErr && err != nil {
+				t.Errorf("ValidateInterfaceName(%q): %v", c.ifname, err)
+			}
+		})
+	}
+
+	err := ValidateSessionConfig(TunnelTypeDynamic,
+		&TunnelConfig{Version: ProtocolVersion3},
+		&SessionConfig{Pseudowire: PseudowireTypeEth, InterfaceName: "l2tpeth012345678"})
+	if !errors.Is(err, ErrInvalidSessionConfig) {
+		t.Errorf("expected %v for over-long interface name, got %v", ErrInvalidSessionConfig, err)
+	}
+}
+
+func TestCheckInterfaceNameFree(t *testing.T) {
+	defer func(fn func(string) (int, error)) { linkIndexLookup = fn }(linkIndexLookup)
+
+	linkIndexLookup = func(name string) (int, error) {
+		if name == "l2tpeth0" {
+			return 7, nil
+		}
+		return 0, fmt.Errorf("no such interface")
+	}
+
+	if err := checkInterfaceNameFree("l2tpeth0"); err == nil {
+		t.Errorf("expected error for existing interface name")
+	}
+	for _, name := range []string{"", "l2tpeth1", "l2tpeth%d"} {
+		if err := checkInterfaceNameFree(name); err != nil {
+			t.Errorf("checkInterfaceNameFree(%q): %v", name, err)
+		}
+	}
+}
+
+func TestValidateTunnelConfig(t *testing.T) {
+	cases := []struct {
+		name      string
+		tt        TunnelType
+		cfg       *TunnelConfig
+		expectErr bool
+	}{
+		{
+			name: "dynamic L2TPv2",
+			tt:   TunnelTypeDynamic,
+			cfg:  &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP},
+		},
+		{
+			name:      "dynamic L2TPv2 IP encap",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeIP},
+			expectErr: true,
+		},
+		{
+			name: "passive L2TPv3",
+			tt:   TunnelTypePassive,
+			cfg:  &TunnelConfig{Peer: "127.0.0.1", Version: ProtocolVersion3, Encap: EncapTypeIP},
+		},
+		{
+			name:      "passive L2TPv3 IP encap peer port",
+			tt:        TunnelTypePassive,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion3, Encap: EncapTypeIP},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic L2TPv2 router ID",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, RouterID: 42},
+			expectErr: true,
+		},
+		{
+			name: "dynamic L2TPv3 router ID",
+			tt:   TunnelTypeDynamic,
+			cfg:  &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion3, Encap: EncapTypeUDP, RouterID: 42},
+		},
+		{
+			name:      "passive peer tunnel ID",
+			tt:        TunnelTypePassive,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, PeerTunnelID: 42},
+			expectErr: true,
+		},
+		{
+			name:      "passive persist",
+			tt:        TunnelTypePassive,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, Persist: true},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic peer tunnel ID",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, PeerTunnelID: 42},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic no peer",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Version: ProtocolVersion2, Encap: EncapTypeUDP},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic stop-and-wait window size",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, StopAndWait: true, WindowSize: 4},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic preferred source and local host",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Local: "127.0.0.1", PreferredSource: "127.0.0.2", Version: ProtocolVersion2, Encap: EncapTypeUDP},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic negative max sessions",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, MaxSessions: -1},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic bad peer address",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:99999", Version: ProtocolVersion2, Encap: EncapTypeUDP},
+			expectErr: true,
+		},
+		{
+			name: "quiescent L2TPv2",
+			tt:   TunnelTypeAcquiescent,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion2, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2},
+		},
+		{
+			name: "quiescent L2TPv2 ID out of range",
+			tt:   TunnelTypeAcquiescent,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion2, Encap: EncapTypeUDP, TunnelID: 65536, PeerTunnelID: 2},
+			expectErr: true,
+		},
+		{
+			name: "quiescent no local address",
+			tt:   TunnelTypeAcquiescent,
+			cfg: &TunnelConfig{Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion2, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2},
+			expectErr: true,
+		},
+		{
+			name: "static L2TPv3",
+			tt:   TunnelTypeStatic,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2},
+		},
+		{
+			name: "static L2TPv2",
+			tt:   TunnelTypeStatic,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion2, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2},
+			expectErr: true,
+		},
+		{
+			name: "static device",
+			tt:   TunnelTypeStatic,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2, Device: "eth0"},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic IPv6 flow label out of range",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "[::1]:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, IPv6FlowLabel: 0x100000},
+			expectErr: true,
+		},
+		{
+			name: "static IPv6 flow label",
+			tt:   TunnelTypeStatic,
+			cfg: &TunnelConfig{Local: "[::1]:6000", Peer: "[::1]:5000",
+				Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2, IPv6FlowLabel: 1},
+			expectErr: true,
+		},
+		{
+			name: "static path MTU discovery",
+			tt:   TunnelTypeStatic,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2, PMTUDisc: PMTUDiscDo},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic negative establish timeout",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, EstablishTimeout: -time.Second},
+			expectErr: true,
+		},
+		{
+			name: "quiescent establish timeout",
+			tt:   TunnelTypeAcquiescent,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2, EstablishTimeout: time.Second},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic negative control read timeout",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, ControlReadTimeout: -time.Second},
+			expectErr: true,
+		},
+		{
+			name: "static control write timeout",
+			tt:   TunnelTypeStatic,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2, ControlWriteTimeout: time.Second},
+			expectErr: true,
+		},
+		{
+			name: "static establish timeout",
+			tt:   TunnelTypeStatic,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2, EstablishTimeout: time.Second},
+			expectErr: true,
+		},
+		{
+			name: "static reuse port",
+			tt:   TunnelTypeStatic,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2, ReusePort: true},
+			expectErr: true,
+		},
+		{
+			name: "static device index",
+			tt:   TunnelTypeStatic,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2, DeviceIndex: 1},
+			expectErr: true,
+		},
+		{
+			name: "dynamic device index",
+			tt:   TunnelTypeDynamic,
+			cfg:  &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, DeviceIndex: 1},
+		},
+		{
+			name:      "dynamic negative device index",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, DeviceIndex: -1},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic device and device index",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, Device: "lo", DeviceIndex: 1},
+			expectErr: true,
+		},
+		{
+			name: "static socket priority",
+			tt:   TunnelTypeStatic,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2, SocketPriority: 5},
+			expectErr: true,
+		},
+		{
+			name: "dynamic socket priority",
+			tt:   TunnelTypeDynamic,
+			cfg:  &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, SocketPriority: 0x10001},
+		},
+		{
+			name:      "dynamic negative socket priority",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, SocketPriority: -1},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic persist",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, Persist: true, ReconnectMin: time.Second, ReconnectMax: time.Minute},
+			expectErr: false,
+		},
+		{
+			name:      "dynamic negative reconnect backoff",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, Persist: true, ReconnectMin: -time.Second},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic reconnect minimum exceeds maximum",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, Persist: true, ReconnectMin: time.Minute, ReconnectMax: time.Second},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic resolve interval",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, Persist: true, ResolveInterval: time.Minute},
+			expectErr: false,
+		},
+		{
+			name:      "dynamic negative resolve interval",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, Persist: true, ResolveInterval: -time.Minute},
+			expectErr: true,
+		},
+		{
+			name:      "dynamic resolve interval without persist",
+			tt:        TunnelTypeDynamic,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP, ResolveInterval: time.Minute},
+			expectErr: true,
+		},
+		{
+			name: "quiescent persist",
+			tt:   TunnelTypeAcquiescent,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2, Persist: true},
+			expectErr: true,
+		},
+		{
+			name: "static persist",
+			tt:   TunnelTypeStatic,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2, Persist: true},
+			expectErr: true,
+		},
+		{
+			name: "static bad encap",
+			tt:   TunnelTypeStatic,
+			cfg: &TunnelConfig{Local: "127.0.0.1:6000", Peer: "127.0.0.1:5000",
+				Version: ProtocolVersion3, Encap: 42, TunnelID: 1, PeerTunnelID: 2},
+			expectErr: true,
+		},
+		{
+			name:      "bad tunnel type",
+			tt:        42,
+			cfg:       &TunnelConfig{Peer: "127.0.0.1:1701", Version: ProtocolVersion2, Encap: EncapTypeUDP},
+			expectErr: true,
+		},
+		{
+			name:      "nil config",
+			tt:        TunnelTypeDynamic,
+			expectErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := ValidateTunnelConfig(c.tt, c.cfg)
+			if c.expectErr && err == nil {
+				t.Errorf("ValidateTunnelConfig(): expected error")
+			} else if !c.expectErr && err != nil {
+				t.Errorf("ValidateTunnelConfig(): %v", err)
+			}
+		})
+	}
+}
+
+func TestDefaultTunnelConfig(t *testing.T) {
+	defaults := &TunnelConfig{
+		Encap:        EncapTypeUDP,
+		Version:      ProtocolVersion3,
+		WindowSize:   16,
+		HelloTimeout: 5 * time.Second,
+		HostName:     "default.example.com",
+	}
+	cases := []struct {
+		name   string
+		cfg    TunnelConfig
+		expect func(cfg *TunnelConfig) error
+	}{
+		{
+			name: "zero fields take defaults",
+			cfg: TunnelConfig{
+				Local:        "127.0.0.1:0",
+				Peer:         "127.0.0.1:5000",
+				TunnelID:     1,
+				PeerTunnelID: 1001,
+			},
+			expect: func(cfg *TunnelConfig) error {
+				if cfg.Version != ProtocolVersion3 || cfg.WindowSize != 16 ||
+					cfg.HelloTimeout != 5*time.Second || cfg.HostName != "default.example.com" {
+					return fmt.Errorf("defaults not applied: %+v", cfg)
+				}
+				return nil
+			},
+		},
+		{
+			name: "explicit fields take precedence",
+			cfg: TunnelConfig{
+				Local:        "127.0.0.1:0",
+				Peer:         "127.0.0.1:5000",
+				Version:      ProtocolVersion2,
+				TunnelID:     2,
+				PeerTunnelID: 1002,
+				WindowSize:   8,
+			},
+			expect: func(cfg *TunnelConfig) error {
+				if cfg.Version != ProtocolVersion2 || cfg.WindowSize != 8 {
+					return fmt.Errorf("explicit values overridden: %+v", cfg)
+				}
+				if cfg.HelloTimeout != 5*time.Second {
+					return fmt.Errorf("default hello timeout not applied: %+v", cfg)
+				}
+				if cfg.TunnelID != 2 || cfg.PeerTunnelID != 1002 {
+					return fmt.Errorf("tunnel IDs modified: %+v", cfg)
+				}
+				return nil
+			},
+		},
+		{
+			name: "ignore defaults",
+			cfg: TunnelConfig{
+				Local:          "127.0.0.1:0",
+				Peer:           "127.0.0.1:5000",
+				Encap:          EncapTypeUDP,
+				Version:        ProtocolVersion2,
+				TunnelID:       3,
+				PeerTunnelID:   1003,
+				IgnoreDefaults: true,
+			},
+			expect: func(cfg *TunnelConfig) error {
+				if cfg.HelloTimeout != 0 || cfg.WindowSize != 0 || cfg.HostName != "" {
+					return fmt.Errorf("defaults applied: %+v", cfg)
+				}
+				return nil
+			},
+		},
+	}
+
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	err = ctx.SetDefaultTunnelConfig(defaults)
+	if err != nil {
+		t.Fatalf("SetDefaultTunnelConfig(): %v", err)
+	}
+	// Changes to the caller's copy must not affect the defaults
+	defaults.WindowSize = 32
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := c.cfg
+			tunl, err := ctx.NewQuiescentTunnel(c.name, &cfg)
+			if err != nil {
+				t.Fatalf("NewQuiescentTunnel(): %v", err)
+			}
+			defer tunl.Close()
+			if !reflect.DeepEqual(cfg, c.cfg) {
+				t.Errorf("caller's config modified: %+v", cfg)
+			}
+			if err := c.expect(tunl.(tunnel).getCfg()); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	// Clearing the defaults leaves new tunnels with their own config only
+	err = ctx.SetDefaultTunnelConfig(nil)
+	if err != nil {
+		t.Fatalf("SetDefaultTunnelConfig(nil): %v", err)
+	}
+	cfg := TunnelConfig{
+		Local:        "127.0.0.1:0",
+		Peer:         "127.0.0.1:5000",
+		Encap:        EncapTypeUDP,
+		Version:      ProtocolVersion2,
+		TunnelID:     4,
+		PeerTunnelID: 1004,
+	}
+	tunl, err := ctx.NewQuiescentTunnel("cleared", &cfg)
+	if err != nil {
+		t.Fatalf("NewQuiescentTunnel(): %v", err)
+	}
+	defer tunl.Close()
+	if tunl.(tunnel).getCfg().HelloTimeout != 0 {
+		t.Errorf("defaults applied after being cleared")
+	}
+}
+
+func TestDefaultTunnelConfigPerTunnelFields(t *testing.T) {
+	cases := []TunnelConfig{
+		{Local: "127.0.0.1:0"},
+		{Peer: "127.0.0.1:5000"},
+		{TunnelID: 99},
+		{PeerTunnelID: 99},
+		{EstablishTimeout: time.Second},
+		{Persist: true},
+		{ResolveInterval: time.Minute},
+		{IPv6FlowLabel: 42},
+		{CaptureFile: "/tmp/l2tp.pcap"},
+		{IgnoreDefaults: true},
+	}
+
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	for _, c := range cases {
+		c := c
+		err = ctx.SetDefaultTunnelConfig(&c)
+		if err == nil {
+			t.Errorf("SetDefaultTunnelConfig(%+v) succeeded, expected error", c)
+		}
+	}
+	if ctx.defaultCfg != nil {
+		t.Errorf("rejected default config was applied: %+v", ctx.defaultCfg)
+	}
+}
+
+func TestQuiescentTunnelFromFD(t *testing.T) {
+	cfg := &TunnelConfig{
+		Version:      ProtocolVersion2,
+		TunnelID:     1,
+		PeerTunnelID: 1001,
+	}
+
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	// A socketpair is not an L2TP tunnel socket
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatalf("Socketpair(): %v", err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	_, err = ctx.NewQuiescentTunnelFromFD("socketpair", fds[0], cfg)
+	if err == nil {
+		t.Errorf("NewQuiescentTunnelFromFD() with socketpair succeeded when we expected an error")
+	}
+
+	// The socket must be connected to the peer
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
+	if err != nil {
+		t.Fatalf("Socket(): %v", err)
+	}
+	defer unix.Close(fd)
+
+	err = unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("Bind(): %v", err)
+	}
+
+	_, err = ctx.NewQuiescentTunnelFromFD("unconnected", fd, cfg)
+	if err == nil {
+		t.Errorf("NewQuiescentTunnelFromFD() with unconnected socket succeeded when we expected an error")
+	}
+
+	err = unix.Connect(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 5000})
+	if err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+
+	tunl, err := ctx.NewQuiescentTunnelFromFD("connected", fd, cfg)
+	if err != nil {
+		t.Fatalf("NewQuiescentTunnelFromFD(): %v", err)
+	}
+
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		t.Fatalf("Getsockname(): %v", err)
+	}
+	local := fmt.Sprintf("127.0.0.1:%d", sa.(*unix.SockaddrInet4).Port)
+
+	tcfg := tunl.(tunnel).getCfg()
+	if tcfg.Local != local || tcfg.Peer != "127.0.0.1:5000" || tcfg.Encap != EncapTypeUDP {
+		t.Errorf("tunnel config not derived from socket: %+v", tcfg)
+	}
+
+	// Closing the tunnel must leave the caller's fd open
+	tunl.Close()
+	_, err = unix.Getsockname(fd)
+	if err != nil {
+		t.Errorf("Getsockname() after tunnel close: %v", err)
+	}
+}
+
+func TestSessionCfgToNlL2SpecType(t *testing.T) {
+	cases := []struct {
+		l2SpecType L2SpecType
+		expect     nll2tp.L2tpL2specType
+	}{
+		{l2SpecType: L2SpecTypeNone, expect: nll2tp.L2spectypeNone},
+		{l2SpecType: L2SpecTypeDefault, expect: nll2tp.L2spectypeDefault},
+	}
+	for _, c := range cases {
+		nlcfg, err := sessionCfgToNl(1, 2, &SessionConfig{L2SpecType: c.l2SpecType})
+		if err != nil {
+			t.Fatalf("sessionCfgToNl(): %v", err)
+		}
+		if nlcfg.L2SpecType != c.expect {
+			t.Errorf("L2SpecType %v: expected %v, got %v", c.l2SpecType, c.expect, nlcfg.L2SpecType)
+		}
+	}
+}
+
+func TestSessionCfgToNlReorderTimeout(t *testing.T) {
+	// The kernel expects L2TP_ATTR_RECV_TIMEOUT in milliseconds
+	cases := []struct {
+		timeout time.Duration
+		expect  uint64
+	}{
+		{timeout: 0, expect: 0},
+		{timeout: 1500 * time.Millisecond, expect: 1500},
+		{timeout: 2 * time.Second, expect: 2000},
+		{timeout: 10*time.Millisecond + 900*time.Microsecond, expect: 10},
+	}
+	for _, c := range cases {
+		nlcfg, err := sessionCfgToNl(1, 2, &SessionConfig{ReorderTimeout: c.timeout})
+		if err != nil {
+			t.Fatalf("sessionCfgToNl(): %v", err)
+		}
+		if nlcfg.ReorderTimeout != c.expect {
+			t.Errorf("reorder timeout %v: expected %v, got %v", c.timeout, c.expect, nlcfg.ReorderTimeout)
+		}
+	}
+}
+
+func TestDataMTU(t *testing.T) {
+	cases := []struct {
+		name string
+		ipv6 bool
+		tcfg *TunnelConfig
+		scfg *SessionConfig
+		want int
+	}{
+		{
+			name: "L2TPv2 UDP",
+			tcfg: &TunnelConfig{Version: ProtocolVersion2, Encap: EncapTypeUDP},
+			scfg: &SessionConfig{},
+			want: 1500 - 20 - 8 - 6,
+		},
+		{
+			name: "L2TPv2 UDP sequence numbers",
+			tcfg: &TunnelConfig{Version: ProtocolVersion2, Encap: EncapTypeUDP},
+			scfg: &SessionConfig{SeqNum: true},
+			want: 1500 - 20 - 8 - 10,
+		},
+		{
+			name: "L2TPv2 UDP IPv6",
+			ipv6: true,
+			tcfg: &TunnelConfig{Version: ProtocolVersion2, Encap: EncapTypeUDP},
+			scfg: &SessionConfig{},
+			want: 1500 - 40 - 8 - 6,
+		},
+		{
+			name: "L2TPv3 UDP",
+			tcfg: &TunnelConfig{Version: ProtocolVersion3, Encap: EncapTypeUDP},
+			scfg: &SessionConfig{},
+			want: 1500 - 20 - 8 - 8,
+		},
+		{
+			name: "L2TPv3 UDP cookie",
+			tcfg: &TunnelConfig{Version: ProtocolVersion3, Encap: EncapTypeUDP},
+			scfg: &SessionConfig{Cookie: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+			want: 1500 - 20 - 8 - 8 - 8,
+		},
+		{
+			name: "L2TPv3 UDP cookie default L2SpecType",
+			tcfg: &TunnelConfig{Version: ProtocolVersion3, Encap: EncapTypeUDP},
+			scfg: &SessionConfig{Cookie: []byte{1, 2, 3, 4}, L2SpecType: L2SpecTypeDefault},
+			want: 1500 - 20 - 8 - 8 - 4 - 4,
+		},
+		{
+			name: "L2TPv3 IP",
+			tcfg: &TunnelConfig{Version: ProtocolVersion3, Encap: EncapTypeIP},
+			scfg: &SessionConfig{},
+			want: 1500 - 20 - 4,
+		},
+		{
+			name: "L2TPv3 IP cookie",
+			tcfg: &TunnelConfig{Version: ProtocolVersion3, Encap: EncapTypeIP},
+			scfg: &SessionConfig{Cookie: []byte{1, 2, 3, 4}},
+			want: 1500 - 20 - 4 - 4,
+		},
+		{
+			name: "L2TPv3 IP IPv6 cookie default L2SpecType",
+			ipv6: true,
+			tcfg: &TunnelConfig{Version: ProtocolVersion3, Encap: EncapTypeIP},
+			scfg: &SessionConfig{Cookie: []byte{1, 2, 3, 4, 5, 6, 7, 8}, L2SpecType: L2SpecTypeDefault},
+			want: 1500 - 40 - 4 - 8 - 4,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := dataMTU(1500, c.ipv6, c.tcfg, c.scfg)
+			if got != c.want {
+				t.Errorf("dataMTU(): got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestTunnelLocalAddressPreferredSource(t *testing.T) {
+	cases := []struct {
+		name      string
+		cfg       TunnelConfig
+		expect    string
+		expectErr bool
+	}{
+		{
+			name:   "unset",
+			cfg:    TunnelConfig{Local: "192.0.2.1:1701"},
+			expect: "192.0.2.1:1701",
+		},
+		{
+			name:   "IPv4 no local",
+			cfg:    TunnelConfig{PreferredSource: "192.0.2.1"},
+			expect: "192.0.2.1",
+		},
+		{
+			name:   "IPv4 wildcard local",
+			cfg:    TunnelConfig{Local: "0.0.0.0:6000", PreferredSource: "192.0.2.1"},
+			expect: "192.0.2.1:6000",
+		},
+		{
+			name:   "IPv4 port only local",
+			cfg:    TunnelConfig{Local: ":6000", PreferredSource: "192.0.2.1"},
+			expect: "192.0.2.1:6000",
+		},
+		{
+			name:   "IPv6 no local",
+			cfg:    TunnelConfig{PreferredSource: "2001:db8::1"},
+			expect: "2001:db8::1",
+		},
+		{
+			name:   "IPv6 wildcard local",
+			cfg:    TunnelConfig{Local: "[::]:6000", PreferredSource: "2001:db8::1"},
+			expect: "[2001:db8::1]:6000",
+		},
+		{
+			name:      "local host",
+			cfg:       TunnelConfig{Local: "192.0.2.2", PreferredSource: "192.0.2.1"},
+			expectErr: true,
+		},
+		{
+			name:      "local host name",
+			cfg:       TunnelConfig{Local: "localhost:6000", PreferredSource: "192.0.2.1"},
+			expectErr: true,
+		},
+		{
+			name:      "not an address",
+			cfg:       TunnelConfig{PreferredSource: "localhost"},
+			expectErr: true,
+		},
+		{
+			name:      "with port",
+			cfg:       TunnelConfig{PreferredSource: "192.0.2.1:1701"},
+			expectErr: true,
+		},
+		{
+			name:      "wildcard",
+			cfg:       TunnelConfig{PreferredSource: "::"},
+			expectErr: true,
+		},
+		{
+			name:      "address family mismatch",
+			cfg:       TunnelConfig{PreferredSource: "192.0.2.1", AddressFamily: AddressFamilyIPv6},
+			expectErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := tunnelLocalAddress(&c.cfg)
+			if c.expectErr {
+				if err == nil {
+					t.Fatalf("tunnelLocalAddress(): expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tunnelLocalAddress(): %v", err)
+			}
+			if got != c.expect {
+				t.Errorf("expected local address %q, got %q", c.expect, got)
+			}
+		})
+	}
+}
+
+func TestPreferredSourceBind(t *testing.T) {
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peer.Close()
+
+	cfg := &TunnelConfig{
+		Encap:           EncapTypeUDP,
+		Local:           ":0",
+		Peer:            peer.LocalAddr().String(),
+		PreferredSource: "127.0.0.2",
+	}
+	sal, sap, err := newTunnelAddressPair(cfg)
+	if err != nil {
+		t.Fatalf("newTunnelAddressPair(): %v", err)
+	}
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(%v, %v): %v", sal, sap, err)
+	}
+	defer cp.close()
+
+	err = cp.bind()
+	if err != nil {
+		t.Fatalf("bind(): %v", err)
+	}
+	err = cp.connect()
+	if err != nil {
+		t.Fatalf("connect(): %v", err)
+	}
+	_, err = cp.write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("write(): %v", err)
+	}
+
+	err = peer.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("SetReadDeadline(): %v", err)
+	}
+	b := make([]byte, 64)
+	_, from, err := peer.ReadFromUDP(b)
+	if err != nil {
+		t.Fatalf("ReadFromUDP(): %v", err)
+	}
+	if !from.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Errorf("expected source address 127.0.0.2, got %v", from.IP)
+	}
+}
+
+func TestTunnelLimits(t *testing.T) {
+	newStatic := func(ctx *Context, name, peer string, tid ControlConnID) (Tunnel, error) {
+		return ctx.NewStaticTunnel(name, &TunnelConfig{
+			Local:        "127.0.0.1:6000",
+			Peer:         peer,
+			Version:      ProtocolVersion3,
+			TunnelID:     tid,
+			PeerTunnelID: tid,
+			Encap:        EncapTypeUDP,
+		})
+	}
+
+	t.Run("global", func(t *testing.T) {
+		ctx, err := NewContextWithOptions(nil, nil, WithMaxTunnels(2))
+		if err != nil {
+			t.Fatalf("NewContextWithOptions(): %v", err)
+		}
+		defer ctx.Close()
+
+		t1, err := newStatic(ctx, "t1", "127.0.0.1:5000", 1)
+		if err != nil {
+			t.Fatalf("newStatic(t1): %v", err)
+		}
+		_, err = newStatic(ctx, "t2", "127.0.0.2:5000", 2)
+		if err != nil {
+			t.Fatalf("newStatic(t2): %v", err)
+		}
+		_, err = newStatic(ctx, "t3", "127.0.0.3:5000", 3)
+		if !errors.Is(err, ErrTunnelLimitReached) {
+			t.Fatalf("newStatic(t3): expected %v, got %v", ErrTunnelLimitReached, err)
+		}
+
+		// The rejected tunnel must not hold its ID, and closing a tunnel
+		// makes room for another
+		t1.Close()
+		_, err = newStatic(ctx, "t3", "127.0.0.3:5000", 3)
+		if err != nil {
+			t.Fatalf("newStatic(t3) after closing t1: %v", err)
+		}
+	})
+
+	t.Run("per peer", func(t *testing.T) {
+		ctx, err := NewContextWithOptions(nil, nil, WithMaxTunnelsPerPeer(2))
+		if err != nil {
+			t.Fatalf("NewContextWithOptions(): %v", err)
+		}
+		defer ctx.Close()
+
+		// Tunnels to different ports of the same host share the limit
+		t1, err := newStatic(ctx, "t1", "127.0.0.1:5000", 1)
+		if err != nil {
+			t.Fatalf("newStatic(t1): %v", err)
+		}
+		_, err = newStatic(ctx, "t2", "127.0.0.1:5001", 2)
+		if err != nil {
+			t.Fatalf("newStatic(t2): %v", err)
+		}
+		_, err = newStatic(ctx, "t3", "127.0.0.1:5002", 3)
+		if !errors.Is(err, ErrTunnelLimitReached) {
+			t.Fatalf("newStatic(t3): expected %v, got %v", ErrTunnelLimitReached, err)
+		}
+		_, err = newStatic(ctx, "t4", "127.0.0.2:5000", 4)
+		if err != nil {
+			t.Fatalf("newStatic(t4) to a different peer: %v", err)
+		}
+
+		t1.Close()
+		_, err = newStatic(ctx, "t3", "127.0.0.1:5002", 3)
+		if err != nil {
+			t.Fatalf("newStatic(t3) after closing t1: %v", err)
+		}
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		ctx, err := NewContext(nil, nil)
+		if err != nil {
+			t.Fatalf("NewContext(): %v", err)
+		}
+		defer ctx.Close()
+
+		tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+			Local:        "127.0.0.1:6000",
+			Peer:         "127.0.0.1:5000",
+			Version:      ProtocolVersion3,
+			TunnelID:     1,
+			PeerTunnelID: 1,
+			Encap:        EncapTypeUDP,
+			MaxSessions:  2,
+		})
+		if err != nil {
+			t.Fatalf("NewStaticTunnel(): %v", err)
+		}
+		newSession := func(sid ControlConnID) (Session, error) {
+			return tunl.NewSession(fmt.Sprintf("s%v", sid), &SessionConfig{
+				SessionID:     sid,
+				PeerSessionID: sid,
+				Pseudowire:    PseudowireTypeEth,
+			})
+		}
+
+		s1, err := newSession(1)
+		if err != nil {
+			t.Fatalf("NewSession(s1): %v", err)
+		}
+		_, err = newSession(2)
+		if err != nil {
+			t.Fatalf("NewSession(s2): %v", err)
+		}
+		_, err = newSession(3)
+		if !errors.Is(err, ErrSessionLimitReached) {
+			t.Fatalf("NewSession(s3): expected %v, got %v", ErrSessionLimitReached, err)
+		}
+
+		s1.Close()
+		_, err = newSession(3)
+		if err != nil {
+			t.Fatalf("NewSession(s3) after closing s1: %v", err)
+		}
+	})
+
+	t.Run("concurrent sessions", func(t *testing.T) {
+		const maxSessions, nsessions = 4, 32
+
+		ctx, err := NewContext(nil, nil)
+		if err != nil {
+			t.Fatalf("NewContext(): %v", err)
+		}
+		defer ctx.Close()
+
+		tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+			Local:        "127.0.0.1:6000",
+			Peer:         "127.0.0.1:5000",
+			Version:      ProtocolVersion3,
+			TunnelID:     1,
+			PeerTunnelID: 1,
+			Encap:        EncapTypeUDP,
+			MaxSessions:  maxSessions,
+		})
+		if err != nil {
+			t.Fatalf("NewStaticTunnel(): %v", err)
+		}
+
+		var wg sync.WaitGroup
+		start := make(chan interface{})
+		errs := make([]error, nsessions)
+		for i := 0; i < nsessions; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				sid := ControlConnID(i + 1)
+				_, errs[i] = tunl.NewSession(fmt.Sprintf("s%v", sid), &SessionConfig{
+					SessionID:     sid,
+					PeerSessionID: sid,
+					Pseudowire:    PseudowireTypeEth,
+				})
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+
+		created := 0
+		for i, err := range errs {
+			if err == nil {
+				created++
+			} else if !errors.Is(err, ErrSessionLimitReached) {
+				t.Errorf("NewSession(s%v): expected %v, got %v", i+1, ErrSessionLimitReached, err)
+			}
+		}
+		if created != maxSessions {
+			t.Errorf("expected %v sessions created, got %v", maxSessions, created)
+		}
+	})
 }
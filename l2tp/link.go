@@ -0,0 +1,297 @@
+package l2tp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"unicode"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// linkIndexLookup and linkExecute are used to configure session
+// network interfaces.  They may be replaced in tests.
+var linkIndexLookup = netInterfaceIndex
+var linkExecute = netlinkLinkExecute
+
+// sizeofIfInfoMsg is the size of struct ifinfomsg from linux/rtnetlink.h
+const sizeofIfInfoMsg = 16
+
+// sizeofIfAddrMsg is the size of struct ifaddrmsg from linux/if_addr.h
+const sizeofIfAddrMsg = 8
+
+func netInterfaceIndex(name string) (int, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return ifi.Index, nil
+}
+
+// sessionInterfaceIndex looks up the index and name of the network
+// interface of a session data plane instance.
+func sessionInterfaceIndex(dp SessionDataPlane) (int, string, error) {
+	ifname, err := dp.GetInterfaceName()
+	if err != nil {
+		return 0, "", err
+	}
+	if ifname == "" {
+		return 0, "", fmt.Errorf("session has no network interface")
+	}
+	ifindex, err := linkIndexLookup(ifname)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to look up interface %v: %v", ifname, err)
+	}
+	return ifindex, ifname, nil
+}
+
+// ValidateInterfaceName checks whether name is acceptable to the kernel
+// as a network interface name.  Linux interface names must be shorter
+// than IFNAMSIZ, may not be "." or "..", and may not contain '/', ':',
+// whitespace, or non-printable characters.
+func ValidateInterfaceName(name string) error {
+	if name == "" {
+		return fmt.Errorf("interface name must not be empty")
+	}
+	if len(name) > unix.IFNAMSIZ-1 {
+		return fmt.Errorf("interface name %q is longer than %v characters", name, unix.IFNAMSIZ-1)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("interface name %q is reserved", name)
+	}
+	for _, c := range name {
+		if c == '/' || c == ':' || unicode.IsSpace(c) || !unicode.IsPrint(c) {
+			return fmt.Errorf("interface name %q contains invalid character %q", name, c)
+		}
+	}
+	return nil
+}
+
+// checkInterfaceNameFree returns an error if a network interface
+// called name already exists.  Names containing a '%' are templates
+// which the kernel completes with a free index, and so cannot collide.
+func checkInterfaceNameFree(name string) error {
+	if name == "" || strings.Contains(name, "%") {
+		return nil
+	}
+	if _, err := linkIndexLookup(name); err == nil {
+		return fmt.Errorf("interface %v already exists", name)
+	}
+	return nil
+}
+
+// netlinkLinkExecute sends an rtnetlink request and waits for the
+// kernel's acknowledgement.
+func netlinkLinkExecute(m netlink.Message) error {
+	c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	_, err = c.Execute(m)
+	return err
+}
+
+// newLinkSetMessage builds an RTM_SETLINK request applying attrs to the
+// interface with index ifindex.  The interface flags set in change are
+// set to their values in flags.
+func newLinkSetMessage(ifindex int, flags, change uint32, attrs []netlink.Attribute) (netlink.Message, error) {
+	ab, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	// struct ifinfomsg: the device type is left zeroed
+	hdr := make([]byte, sizeofIfInfoMsg)
+	hdr[0] = unix.AF_UNSPEC
+	nlenc.PutInt32(hdr[4:8], int32(ifindex))
+	nlenc.PutUint32(hdr[8:12], flags)
+	nlenc.PutUint32(hdr[12:16], change)
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_SETLINK,
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(hdr, ab...),
+	}, nil
+}
+
+func linkSet(ifname string, flags, change uint32, attrs []netlink.Attribute) error {
+	ifindex, err := linkIndexLookup(ifname)
+	if err != nil {
+		return fmt.Errorf("failed to look up interface %q: %v", ifname, err)
+	}
+	m, err := newLinkSetMessage(ifindex, flags, change, attrs)
+	if err != nil {
+		return err
+	}
+	return linkExecute(m)
+}
+
+// linkSetMTU sets the MTU of the named interface.
+func linkSetMTU(ifname string, mtu int) error {
+	err := linkSet(ifname, 0, 0, []netlink.Attribute{
+		{
+			Type: unix.IFLA_MTU,
+			Data: nlenc.Uint32Bytes(uint32(mtu)),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set %q MTU to %v: %v", ifname, mtu, err)
+	}
+	return nil
+}
+
+// linkSetUp administratively enables the named interface.
+func linkSetUp(ifname string) error {
+	err := linkSet(ifname, unix.IFF_UP, unix.IFF_UP, nil)
+	if err != nil {
+		return fmt.Errorf("failed to set %q up: %v", ifname, err)
+	}
+	return nil
+}
+
+// linkSetDown administratively disables the named interface.
+func linkSetDown(ifname string) error {
+	err := linkSet(ifname, 0, unix.IFF_UP, nil)
+	if err != nil {
+		return fmt.Errorf("failed to set %q down: %v", ifname, err)
+	}
+	return nil
+}
+
+// linkSetMaster enslaves the named interface to the named bridge.
+// If bridge is empty, the interface is detached from its master.
+func linkSetMaster(ifname, bridge string) error {
+	var master int
+	if bridge != "" {
+		var err error
+		master, err = linkIndexLookup(bridge)
+		if err != nil {
+			return fmt.Errorf("failed to look up bridge %q: %v", bridge, err)
+		}
+	}
+	err := linkSet(ifname, 0, 0, []netlink.Attribute{
+		{
+			Type: unix.IFLA_MASTER,
+			Data: nlenc.Uint32Bytes(uint32(master)),
+		},
+	})
+	if err != nil {
+		if bridge == "" {
+			return fmt.Errorf("failed to detach %q from bridge: %v", ifname, err)
+		}
+		return fmt.Errorf("failed to attach %q to bridge %q: %v", ifname, bridge, err)
+	}
+	return nil
+}
+
+// newAddrAddMessage builds an RTM_NEWADDR request adding the address
+// local to the interface with index ifindex.  If peer is non-nil, the
+// address is configured as the local end of a point-to-point link to peer.
+func newAddrAddMessage(ifindex int, local *net.IPNet, peer net.IP) (netlink.Message, error) {
+	family := unix.AF_INET
+	ip := local.IP.To4()
+	if ip == nil {
+		family = unix.AF_INET6
+		ip = local.IP.To16()
+	}
+	address := ip
+	if peer != nil {
+		address = peer.To4()
+		if family == unix.AF_INET6 {
+			address = peer.To16()
+		}
+		if address == nil {
+			return netlink.Message{}, fmt.Errorf("peer address %v does not match the address family of %v", peer, local)
+		}
+	}
+	prefixLen, _ := local.Mask.Size()
+
+	ab, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.IFA_LOCAL, Data: ip},
+		{Type: unix.IFA_ADDRESS, Data: address},
+	})
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	// struct ifaddrmsg: flags and scope are left zeroed
+	hdr := make([]byte, sizeofIfAddrMsg)
+	hdr[0] = uint8(family)
+	hdr[1] = uint8(prefixLen)
+	nlenc.PutUint32(hdr[4:8], uint32(ifindex))
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_NEWADDR,
+			Flags: netlink.Request | netlink.Acknowledge | netlink.Create | netlink.Excl,
+		},
+		Data: append(hdr, ab...),
+	}, nil
+}
+
+// addrAdd assigns the address in CIDR notation to the named interface,
+// optionally as the local end of a point-to-point link to peer.
+func addrAdd(ifname, address, peer string) error {
+	ip, ipnet, err := net.ParseCIDR(address)
+	if err != nil {
+		return fmt.Errorf("failed to parse address %q: %v", address, err)
+	}
+	ipnet.IP = ip
+	var peerIP net.IP
+	if peer != "" {
+		peerIP = net.ParseIP(peer)
+		if peerIP == nil {
+			return fmt.Errorf("failed to parse peer address %q", peer)
+		}
+	}
+	ifindex, err := linkIndexLookup(ifname)
+	if err != nil {
+		return fmt.Errorf("failed to look up interface %q: %v", ifname, err)
+	}
+	m, err := newAddrAddMessage(ifindex, ipnet, peerIP)
+	if err != nil {
+		return err
+	}
+	err = linkExecute(m)
+	if err != nil {
+		return fmt.Errorf("failed to add address %v to %q: %v", address, ifname, err)
+	}
+	return nil
+}
+
+// configureEthInterface applies the MTU, bridge, addressing, and
+// administrative state options of an Ethernet pseudowire session config
+// to the session interface.
+func configureEthInterface(ifname string, scfg *SessionConfig) error {
+	if scfg.MTU > 0 {
+		err := linkSetMTU(ifname, scfg.MTU)
+		if err != nil {
+			return err
+		}
+	}
+	if scfg.Bridge != "" {
+		err := linkSetMaster(ifname, scfg.Bridge)
+		if err != nil {
+			return err
+		}
+	}
+	if scfg.Address != "" {
+		err := addrAdd(ifname, scfg.Address, scfg.PeerAddress)
+		if err != nil {
+			return err
+		}
+	}
+	if scfg.AdminUp {
+		err := linkSetUp(ifname)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package l2tp
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+// TunnelListener accepts tunnels initiated by peers connecting to a
+// single local address, allowing an LNS to serve many peers on one UDP
+// port.
+//
+// For each new peer the listener creates a passive tunnel, as for
+// NewPassiveTunnel, which completes the control connection handshake
+// with the peer.  The tunnel's socket is bound to the listener's local
+// address and connected to the peer, so the kernel delivers subsequent
+// control packets from the peer to the tunnel rather than the listener.
+type TunnelListener struct {
+	logger     log.Logger
+	name       string
+	parent     *Context
+	cfg        *TunnelConfig
+	local      string
+	cp         *controlPlane
+	acceptChan chan Tunnel
+	closeChan  chan bool
+	closeOnce  sync.Once
+	wg         sync.WaitGroup
+}
+
+// NewTunnelListener creates a new tunnel listener bound to the local
+// address in the configuration.
+//
+// The configuration is used as a template for the passive tunnels the
+// listener creates.  It must specify the local address, and must not
+// specify the peer address or the tunnel ID: each tunnel's peer address
+// is that of the peer sending the SCCRQ, and each tunnel is allocated
+// a unique tunnel ID by the Context.  Only UDP encapsulation is
+// supported.
+//
+// Tunnels created by the listener are named by the listener name and
+// the peer address, e.g. "lns/192.0.2.1:1701", and must be retrieved
+// using Accept.
+//
+// The listener should be closed before the Context.
+func (ctx *Context) NewTunnelListener(name string, cfg *TunnelConfig) (l *TunnelListener, err error) {
+
+	// Must have configuration
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid nil config")
+	}
+
+	local, err := tunnelLocalAddress(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if local == "" {
+		return nil, fmt.Errorf("must specify local address for tunnel listener")
+	}
+	if cfg.Peer != "" {
+		return nil, fmt.Errorf("peer address cannot be specified for tunnel listener")
+	}
+	if cfg.TunnelID != 0 {
+		return nil, fmt.Errorf("tunnel ID cannot be specified for tunnel listener")
+	}
+	if cfg.Encap != EncapTypeUDP {
+		return nil, fmt.Errorf("only UDP encapsulation is supported for tunnel listeners")
+	}
+
+	port := cfg.LocalPort
+	if port == 0 {
+		port = defaultUDPPort
+	}
+	sal, err := newUDPTunnelAddress(udpAddressWithPort(local, port), cfg.AddressFamily)
+	if err != nil {
+		return nil, &AddressError{Address: local, Local: true, Err: err}
+	}
+
+	// Check the template as for the tunnels the listener creates
+	myCfg := *cfg
+	myCfg.Local = sockaddrString(sal)
+	myCfg.LocalPort = 0
+	myCfg.PreferredSource = ""
+	myCfg.ReusePort = true
+	trialCfg := myCfg
+	ctx.applyDefaultTunnelConfig(&trialCfg)
+	trialCfg.Peer = trialCfg.Local
+	err = validateTunnelConfig(TunnelTypePassive, &trialCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	l = &TunnelListener{
+		logger:     log.With(ctx.logger, "listener_name", name),
+		name:       name,
+		parent:     ctx,
+		cfg:        &myCfg,
+		local:      myCfg.Local,
+		acceptChan: make(chan Tunnel),
+		closeChan:  make(chan bool),
+	}
+
+	l.cp, err = newL2tpControlPlane(sal, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = l.cp.setReusePort(true)
+	if err != nil {
+		l.cp.close()
+		return nil, err
+	}
+
+	err = l.cp.setPriority(myCfg.SocketPriority)
+	if err != nil {
+		l.cp.close()
+		return nil, err
+	}
+
+	err = l.cp.bindToDevice(myCfg.Device)
+	if err != nil {
+		l.cp.close()
+		return nil, err
+	}
+
+	err = l.cp.bindToIfindex(myCfg.DeviceIndex)
+	if err != nil {
+		l.cp.close()
+		return nil, err
+	}
+
+	err = l.cp.bind()
+	if err != nil {
+		l.cp.close()
+		return nil, err
+	}
+
+	level.Info(l.logger).Log(
+		"message", "new tunnel listener",
+		"local", l.local,
+		"version", myCfg.Version)
+
+	l.wg.Add(1)
+	go l.run()
+
+	return l, nil
+}
+
+// Accept waits for a peer to initiate a tunnel, and returns the passive
+// tunnel created for it.  The tunnel may not yet be established: the
+// TunnelUpEvent is raised once the handshake completes.
+//
+// The listener does not create further tunnels until the previous
+// tunnel has been accepted.
+//
+// Accept returns ErrListenerClosed once the listener is closed.
+func (l *TunnelListener) Accept() (Tunnel, error) {
+	t, ok := <-l.acceptChan
+	if !ok {
+		return nil, ErrListenerClosed
+	}
+	return t, nil
+}
+
+// Addr returns the local address the listener is bound to.
+func (l *TunnelListener) Addr() string {
+	return l.local
+}
+
+// Close closes the listener.  Tunnels already accepted are unaffected.
+func (l *TunnelListener) Close() {
+	l.closeOnce.Do(func() {
+		close(l.closeChan)
+		l.cp.close()
+	})
+	l.wg.Wait()
+}
+
+func (l *TunnelListener) run() {
+	defer l.wg.Done()
+	defer close(l.acceptChan)
+
+	for {
+		b := make([]byte, 4096)
+		n, from, err := l.cp.recvFrom(b)
+		if err != nil {
+			select {
+			case <-l.closeChan:
+			default:
+				level.Error(l.logger).Log(
+					"message", "socket read failed",
+					"error", err)
+			}
+			return
+		}
+
+		t, err := l.newTunnel(b[:n], from)
+		if err != nil {
+			level.Error(l.logger).Log(
+				"message", "failed to create tunnel",
+				"peer", sockaddrString(from),
+				"error", err)
+			continue
+		}
+		if t == nil {
+			continue
+		}
+
+		select {
+		case l.acceptChan <- t:
+		case <-l.closeChan:
+			t.Close()
+			return
+		}
+	}
+}
+
+// newTunnel creates a passive tunnel for a frame received from a new
+// peer.  Frames other than an SCCRQ are ignored, as are SCCRQ messages
+// from peers which already have a tunnel: these may be retransmissions
+// which raced with the creation of the tunnel's socket.
+func (l *TunnelListener) newTunnel(b []byte, from unix.Sockaddr) (Tunnel, error) {
+
+	peer := sockaddrString(from)
+
+	if isDataPacket(b) {
+		level.Debug(l.logger).Log(
+			"message", "ignoring data packet",
+			"peer", peer)
+		return nil, nil
+	}
+
+	msgs, err := parseMessageBuffer(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse control message: %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].getType() != avpMsgTypeSccrq {
+		level.Debug(l.logger).Log(
+			"message", "ignoring control message other than SCCRQ",
+			"peer", peer)
+		return nil, nil
+	}
+
+	name := fmt.Sprintf("%s/%s", l.name, peer)
+	if _, ok := l.parent.findTunnelByName(name); ok {
+		level.Debug(l.logger).Log(
+			"message", "ignoring SCCRQ from peer with existing tunnel",
+			"peer", peer)
+		return nil, nil
+	}
+
+	cfg := *l.cfg
+	cfg.Peer = peer
+
+	l.parent.waitCreate()
+
+	t, err := l.parent.newDynamicTunnel(name, TunnelTypePassive, &cfg, nil, &rawMsg{b: b, sa: from})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,267 @@
+package l2tp
+
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ DataPlane = (*MockDataPlane)(nil)
+var _ TunnelDataPlane = (*mockTunnelDataPlane)(nil)
+var _ SessionDataPlane = (*mockSessionDataPlane)(nil)
+var _ adoptingDataPlane = (*MockDataPlane)(nil)
+
+// MockDataPlaneOp identifies an operation recorded by MockDataPlane.
+type MockDataPlaneOp string
+
+const (
+	// MockOpNewTunnel records a DataPlane.NewTunnel call.
+	MockOpNewTunnel MockDataPlaneOp = "NewTunnel"
+	// MockOpNewSession records a DataPlane.NewSession call.
+	MockOpNewSession MockDataPlaneOp = "NewSession"
+	// MockOpAdoptTunnel records the adoption of a tunnel data plane
+	// by Context.AdoptTunnel.
+	MockOpAdoptTunnel MockDataPlaneOp = "AdoptTunnel"
+	// MockOpAdoptSession records the adoption of a session data plane
+	// by Context.AdoptTunnel.
+	MockOpAdoptSession MockDataPlaneOp = "AdoptSession"
+	// MockOpClose records a DataPlane.Close call.
+	MockOpClose MockDataPlaneOp = "Close"
+	// MockOpTunnelSetDebugFlags records a TunnelDataPlaneDebugger.SetDebugFlags call.
+	MockOpTunnelSetDebugFlags MockDataPlaneOp = "TunnelSetDebugFlags"
+	// MockOpTunnelDown records a TunnelDataPlane.Down call.
+	MockOpTunnelDown MockDataPlaneOp = "TunnelDown"
+	// MockOpSessionModify records a SessionDataPlaneModifier.Modify call.
+	MockOpSessionModify MockDataPlaneOp = "SessionModify"
+	// MockOpSessionInterfaceDown records a SessionDataPlaneDrainer.InterfaceDown call.
+	MockOpSessionInterfaceDown MockDataPlaneOp = "SessionInterfaceDown"
+	// MockOpSessionDown records a SessionDataPlane.Down call.
+	MockOpSessionDown MockDataPlaneOp = "SessionDown"
+)
+
+// MockDataPlaneCall describes a single operation recorded by MockDataPlane.
+//
+// Fields which are not relevant to the operation are left at their
+// zero values.
+type MockDataPlaneCall struct {
+	// Op is the operation requested.
+	Op MockDataPlaneOp
+	// TunnelConfig is a copy of the configuration of the tunnel the
+	// operation applies to, as passed to NewTunnel.
+	TunnelConfig *TunnelConfig
+	// LocalAddress and PeerAddress are the tunnel addresses passed to
+	// NewTunnel.
+	LocalAddress, PeerAddress unix.Sockaddr
+	// Fd is the tunnel socket passed to NewTunnel, or -1 for static
+	// tunnels which have no socket.
+	Fd int
+	// TunnelID and PeerTunnelID are the tunnel IDs passed to NewSession.
+	TunnelID, PeerTunnelID ControlConnID
+	// SessionConfig is a copy of the configuration of the session the
+	// operation applies to.  For MockOpSessionModify it is a copy of
+	// the configuration passed to Modify.
+	SessionConfig *SessionConfig
+	// DebugFlags are the flags passed to SetDebugFlags.
+	DebugFlags DebugFlags
+}
+
+// MockDataPlane is a DataPlane which instantiates nothing in the
+// kernel, and instead records each data plane operation requested.
+//
+// MockDataPlane is intended for testing code which uses package l2tp,
+// allowing tunnel and session lifecycles to be observed without root
+// permissions.  It should not be used outside of tests.
+type MockDataPlane struct {
+	lock  sync.Mutex
+	calls []MockDataPlaneCall
+	stats map[ControlConnID]SessionDataPlaneStatistics
+	state []*TunnelState
+}
+
+type mockTunnelDataPlane struct {
+	dp  *MockDataPlane
+	cfg *TunnelConfig
+}
+
+type mockSessionDataPlane struct {
+	dp            *MockDataPlane
+	tid, ptid     ControlConnID
+	cfg           *SessionConfig
+	interfaceName string
+}
+
+// NewMockDataPlane returns a new MockDataPlane with no recorded calls.
+// Pass the MockDataPlane to NewContext to use it.
+func NewMockDataPlane() *MockDataPlane {
+	return &MockDataPlane{}
+}
+
+// Calls returns the operations recorded so far, in the order they
+// were requested.
+func (dp *MockDataPlane) Calls() []MockDataPlaneCall {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	return append([]MockDataPlaneCall{}, dp.calls...)
+}
+
+// Reset discards the operations recorded so far.
+func (dp *MockDataPlane) Reset() {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	dp.calls = nil
+}
+
+// SetSessionStatistics sets the statistics reported by the data plane
+// of the session with the specified local session ID.  By default all
+// statistics are zero.
+func (dp *MockDataPlane) SetSessionStatistics(sid ControlConnID, stats *SessionDataPlaneStatistics) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	if dp.stats == nil {
+		dp.stats = make(map[ControlConnID]SessionDataPlaneStatistics)
+	}
+	dp.stats[sid] = *stats
+}
+
+// SetTunnelState sets the tunnel and session instances which the data
+// plane reports as already present, for use in testing
+// Context.ExportTunnels and Context.AdoptTunnel.  By default no
+// instances are reported.
+func (dp *MockDataPlane) SetTunnelState(states []*TunnelState) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	dp.state = append([]*TunnelState{}, states...)
+}
+
+func (dp *MockDataPlane) record(call MockDataPlaneCall) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	dp.calls = append(dp.calls, call)
+}
+
+// NewTunnel records the creation of a tunnel data plane.
+func (dp *MockDataPlane) NewTunnel(tcfg *TunnelConfig, sal, sap unix.Sockaddr, fd int) (TunnelDataPlane, error) {
+	cfg := *tcfg
+	dp.record(MockDataPlaneCall{
+		Op:           MockOpNewTunnel,
+		TunnelConfig: &cfg,
+		LocalAddress: sal,
+		PeerAddress:  sap,
+		Fd:           fd,
+	})
+	return &mockTunnelDataPlane{dp: dp, cfg: &cfg}, nil
+}
+
+// NewSession records the creation of a session data plane.
+func (dp *MockDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	cfg := *scfg
+	dp.record(MockDataPlaneCall{
+		Op:            MockOpNewSession,
+		TunnelID:      tid,
+		PeerTunnelID:  ptid,
+		SessionConfig: &cfg,
+	})
+	return &mockSessionDataPlane{
+		dp:            dp,
+		tid:           tid,
+		ptid:          ptid,
+		cfg:           &cfg,
+		interfaceName: cfg.InterfaceName,
+	}, nil
+}
+
+func (dp *MockDataPlane) exportTunnels() ([]*TunnelState, error) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	return append([]*TunnelState{}, dp.state...), nil
+}
+
+func (dp *MockDataPlane) adoptTunnel(tcfg *TunnelConfig) (TunnelDataPlane, error) {
+	cfg := *tcfg
+	dp.record(MockDataPlaneCall{
+		Op:           MockOpAdoptTunnel,
+		TunnelConfig: &cfg,
+	})
+	return &mockTunnelDataPlane{dp: dp, cfg: &cfg}, nil
+}
+
+func (dp *MockDataPlane) adoptSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	cfg := *scfg
+	dp.record(MockDataPlaneCall{
+		Op:            MockOpAdoptSession,
+		TunnelID:      tid,
+		PeerTunnelID:  ptid,
+		SessionConfig: &cfg,
+	})
+	return &mockSessionDataPlane{
+		dp:            dp,
+		tid:           tid,
+		ptid:          ptid,
+		cfg:           &cfg,
+		interfaceName: cfg.InterfaceName,
+	}, nil
+}
+
+// Close records the closure of the data plane.
+func (dp *MockDataPlane) Close() {
+	dp.record(MockDataPlaneCall{Op: MockOpClose})
+}
+
+func (tdp *mockTunnelDataPlane) SetDebugFlags(flags DebugFlags) error {
+	tdp.dp.record(MockDataPlaneCall{
+		Op:           MockOpTunnelSetDebugFlags,
+		TunnelConfig: tdp.cfg,
+		DebugFlags:   flags,
+	})
+	return nil
+}
+
+func (tdp *mockTunnelDataPlane) Down() error {
+	tdp.dp.record(MockDataPlaneCall{
+		Op:           MockOpTunnelDown,
+		TunnelConfig: tdp.cfg,
+	})
+	return nil
+}
+
+func (sdp *mockSessionDataPlane) GetStatistics() (*SessionDataPlaneStatistics, error) {
+	sdp.dp.lock.Lock()
+	defer sdp.dp.lock.Unlock()
+	stats := sdp.dp.stats[sdp.cfg.SessionID]
+	return &stats, nil
+}
+
+func (sdp *mockSessionDataPlane) GetInterfaceName() (string, error) {
+	return sdp.interfaceName, nil
+}
+
+func (sdp *mockSessionDataPlane) Modify(cfg *SessionConfig) error {
+	mcfg := *cfg
+	sdp.dp.record(MockDataPlaneCall{
+		Op:            MockOpSessionModify,
+		TunnelID:      sdp.tid,
+		PeerTunnelID:  sdp.ptid,
+		SessionConfig: &mcfg,
+	})
+	return nil
+}
+
+func (sdp *mockSessionDataPlane) InterfaceDown() error {
+	sdp.dp.record(MockDataPlaneCall{
+		Op:            MockOpSessionInterfaceDown,
+		TunnelID:      sdp.tid,
+		PeerTunnelID:  sdp.ptid,
+		SessionConfig: sdp.cfg,
+	})
+	return nil
+}
+
+func (sdp *mockSessionDataPlane) Down() error {
+	sdp.dp.record(MockDataPlaneCall{
+		Op:            MockOpSessionDown,
+		TunnelID:      sdp.tid,
+		PeerTunnelID:  sdp.ptid,
+		SessionConfig: sdp.cfg,
+	})
+	return nil
+}
@@ -118,6 +118,41 @@ func v2HelloMsgSpec() *msgSpec {
 	return &spec
 }
 
+func v2OcrqMsgSpec() *msgSpec {
+	/* Ref: RFC2661 section 6.9 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeSessionID] = mustExist
+	spec.m[avpTypeCallSerialNumber] = mustExist
+	spec.m[avpTypeMinimumBps] = mustExist
+	spec.m[avpTypeMaximumBps] = mustExist
+	spec.m[avpTypeBearerType] = mustExist
+	spec.m[avpTypeFramingType] = mustExist
+	spec.m[avpTypeCalledNumber] = mustExist
+	spec.m[avpTypeSubAddress] = mayExist
+	return &spec
+}
+
+func v2OcrpMsgSpec() *msgSpec {
+	/* Ref: RFC2661 section 6.10 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeSessionID] = mustExist
+	spec.m[avpTypePhysicalChannelID] = mayExist
+	return &spec
+}
+
+func v2OccnMsgSpec() *msgSpec {
+	/* Ref: RFC2661 section 6.11 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeConnectSpeed] = mustExist
+	spec.m[avpTypeFramingType] = mustExist
+	spec.m[avpTypeRxConnectSpeed] = mayExist
+	spec.m[avpTypeSequencingRequired] = mayExist
+	return &spec
+}
+
 func v2IcrqMsgSpec() *msgSpec {
 	/* Ref: RFC2661 section 6.6 */
 	spec := msgSpec{make(map[avpType]avpSpec)}
@@ -170,6 +205,17 @@ func v2CdnMsgSpec() *msgSpec {
 	return &spec
 }
 
+func v2SliMsgSpec() *msgSpec {
+	/* Ref: RFC2661 section 6.14 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeAccm] = mustExist
+	// Not defined for SLI by RFC2661, but accepted to allow an LNS to
+	// require sequencing once the session is established.
+	spec.m[avpTypeSequencingRequired] = mayExist
+	return &spec
+}
+
 func getV2MsgSpec(t avpMsgType) (*msgSpec, error) {
 	switch t {
 	case avpMsgTypeSccrq:
@@ -182,6 +228,12 @@ func getV2MsgSpec(t avpMsgType) (*msgSpec, error) {
 		return v2StopccnMsgSpec(), nil
 	case avpMsgTypeHello:
 		return v2HelloMsgSpec(), nil
+	case avpMsgTypeOcrq:
+		return v2OcrqMsgSpec(), nil
+	case avpMsgTypeOcrp:
+		return v2OcrpMsgSpec(), nil
+	case avpMsgTypeOccn:
+		return v2OccnMsgSpec(), nil
 	case avpMsgTypeIcrq:
 		return v2IcrqMsgSpec(), nil
 	case avpMsgTypeIcrp:
@@ -190,6 +242,8 @@ func getV2MsgSpec(t avpMsgType) (*msgSpec, error) {
 		return v2IccnMsgSpec(), nil
 	case avpMsgTypeCdn:
 		return v2CdnMsgSpec(), nil
+	case avpMsgTypeSli:
+		return v2SliMsgSpec(), nil
 	}
 	return nil, fmt.Errorf("no specification for v2 message %v", t)
 }
@@ -203,10 +257,165 @@ func v3HelloMsgSpec() *msgSpec {
 	return &spec
 }
 
+func v3SccrqMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.1 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeHostName] = mustExist
+	spec.m[avpTypeRouterID] = mustExist
+	spec.m[avpTypeAssignedConnID] = mustExist
+	spec.m[avpTypePseudowireCaps] = mustExist
+
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeControlAuthNonce] = mayExist
+	spec.m[avpTypeRxWindowSize] = mayExist
+	spec.m[avpTypeTiebreaker] = mayExist
+	spec.m[avpTypeFirmwareRevision] = mayExist
+	spec.m[avpTypeVendorName] = mayExist
+	spec.m[avpTypePreferredLanguage] = mayExist
+	return &spec
+}
+
+func v3SccrpMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.2 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeHostName] = mustExist
+	spec.m[avpTypeRouterID] = mustExist
+	spec.m[avpTypeAssignedConnID] = mustExist
+	spec.m[avpTypePseudowireCaps] = mustExist
+
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeControlAuthNonce] = mayExist
+	spec.m[avpTypeRxWindowSize] = mayExist
+	spec.m[avpTypeFirmwareRevision] = mayExist
+	spec.m[avpTypeVendorName] = mayExist
+	spec.m[avpTypePreferredLanguage] = mayExist
+	return &spec
+}
+
+func v3ScccnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.3 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	return &spec
+}
+
+func v3StopccnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.4 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeResultCode] = mustExist
+	spec.m[avpTypeAssignedConnID] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	return &spec
+}
+
+func v3IcrqMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.6 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+	spec.m[avpTypeCallSerialNumber] = mustExist
+	spec.m[avpTypePseudowireType] = mustExist
+	spec.m[avpTypeRemoteEndID] = mustExist
+	spec.m[avpTypeCircuitStatus] = mustExist
+
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeAssignedCookie] = mayExist
+	spec.m[avpTypeL2specificSublayer] = mayExist
+	spec.m[avpTypeDataSequencing] = mayExist
+	spec.m[avpTypeTxConnectSpeedBps] = mayExist
+	spec.m[avpTypeRxConnectSpeedBps] = mayExist
+	spec.m[avpTypePhysicalChannelID] = mayExist
+	return &spec
+}
+
+func v3IcrpMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.7 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+	spec.m[avpTypeCircuitStatus] = mustExist
+
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeAssignedCookie] = mayExist
+	spec.m[avpTypeL2specificSublayer] = mayExist
+	spec.m[avpTypeDataSequencing] = mayExist
+	spec.m[avpTypeTxConnectSpeedBps] = mayExist
+	spec.m[avpTypeRxConnectSpeedBps] = mayExist
+	spec.m[avpTypePhysicalChannelID] = mayExist
+	return &spec
+}
+
+func v3IccnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.8 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeL2specificSublayer] = mayExist
+	spec.m[avpTypeDataSequencing] = mayExist
+	spec.m[avpTypeTxConnectSpeedBps] = mayExist
+	spec.m[avpTypeRxConnectSpeedBps] = mayExist
+	spec.m[avpTypeCircuitStatus] = mayExist
+	return &spec
+}
+
+func v3CdnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.11 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeResultCode] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeQ931CauseCode] = mayExist
+	return &spec
+}
+
+func v3SliMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.13 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeCircuitStatus] = mayExist
+	// Not defined for SLI by RFC3931, but accepted to allow the peer
+	// to change its sequencing requirement once the session is
+	// established.
+	spec.m[avpTypeDataSequencing] = mayExist
+	return &spec
+}
+
 func getV3MsgSpec(t avpMsgType) (*msgSpec, error) {
 	switch t {
+	case avpMsgTypeSccrq:
+		return v3SccrqMsgSpec(), nil
+	case avpMsgTypeSccrp:
+		return v3SccrpMsgSpec(), nil
+	case avpMsgTypeScccn:
+		return v3ScccnMsgSpec(), nil
+	case avpMsgTypeStopccn:
+		return v3StopccnMsgSpec(), nil
 	case avpMsgTypeHello:
 		return v3HelloMsgSpec(), nil
+	case avpMsgTypeIcrq:
+		return v3IcrqMsgSpec(), nil
+	case avpMsgTypeIcrp:
+		return v3IcrpMsgSpec(), nil
+	case avpMsgTypeIccn:
+		return v3IccnMsgSpec(), nil
+	case avpMsgTypeCdn:
+		return v3CdnMsgSpec(), nil
+	case avpMsgTypeSli:
+		return v3SliMsgSpec(), nil
 	}
 	return nil, fmt.Errorf("no specification for v3 message %v", t)
 }
@@ -231,6 +440,17 @@ func validateAvps(avps []avp, spec *msgSpec) error {
 	}
 
 	for _, avp := range avps {
+		// RFC2661 section 4.3 allows a Random Vector AVP to be present
+		// in any message to support AVP hiding.
+		if avp.getType() == avpTypeRandomVector {
+			continue
+		}
+		// Message specs describe IETF AVPs only.  Vendor AVPs which
+		// aren't recognised are handled on receipt according to their
+		// M bit, c.f. findUnrecognisedMandatoryAvp.
+		if avp.vendorID() != vendorIDIetf {
+			continue
+		}
 		as, ok := spec.hasAvp(avp.getType())
 		if !ok {
 			// RFC2661 section 4.1 says we MUST tear down the tunnel on receipt of
@@ -305,6 +525,9 @@ func bytesToV2CtlMsg(b []byte) (msg *v2ControlMessage, err error) {
 		if avps[0].getType() != avpTypeMessage {
 			return nil, errors.New("invalid L2TPv2 message: first AVP is not Message Type AVP")
 		}
+		if err = checkMsgTypeAvp(&avps[0]); err != nil {
+			return nil, fmt.Errorf("invalid L2TPv2 message: %v", err)
+		}
 	}
 
 	return &v2ControlMessage{
@@ -331,6 +554,9 @@ func bytesToV3CtlMsg(b []byte) (msg *v3ControlMessage, err error) {
 	if avps[0].getType() != avpTypeMessage {
 		return nil, errors.New("invalid L2TPv3 message: first AVP is not Message Type AVP")
 	}
+	if err = checkMsgTypeAvp(&avps[0]); err != nil {
+		return nil, fmt.Errorf("invalid L2TPv3 message: %v", err)
+	}
 
 	return &v3ControlMessage{
 		header: hdr,
@@ -338,6 +564,18 @@ func bytesToV3CtlMsg(b []byte) (msg *v3ControlMessage, err error) {
 	}, nil
 }
 
+// checkMsgTypeAvp checks that a received Message Type AVP can be decoded,
+// so that the message's getType method may be relied upon.
+func checkMsgTypeAvp(a *avp) error {
+	if a.isHidden() {
+		return errors.New("Message Type AVP is hidden")
+	}
+	if _, err := a.decodeMsgType(); err != nil {
+		return fmt.Errorf("failed to decode Message Type AVP: %v", err)
+	}
+	return nil
+}
+
 // controlMessage is an interface representing a generic L2TP
 // control message, providing access to the fields that are common
 // to both v2 and v3 versions of the protocol.
@@ -458,6 +696,59 @@ func (m *v2ControlMessage) toBytes() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// hideAvps hides the message AVPs of the types specified using the shared
+// secret and the random vector.  A Random Vector AVP is inserted ahead of
+// the first hidden AVP as required by RFC2661 section 4.3.
+func (m *v2ControlMessage) hideAvps(secret, rv []byte, types map[avpType]bool) error {
+	var avps []avp
+	var rvAdded bool
+	for i := range m.avps {
+		a := &m.avps[i]
+		if !types[a.getType()] || a.vendorID() != vendorIDIetf || a.isHidden() {
+			avps = append(avps, *a)
+			continue
+		}
+		if !rvAdded {
+			rva, err := newAvp(vendorIDIetf, avpTypeRandomVector, rv)
+			if err != nil {
+				return fmt.Errorf("failed to create AVP %v: %v", avpTypeRandomVector, err)
+			}
+			avps = append(avps, *rva)
+			rvAdded = true
+		}
+		ha, err := hideAvp(a, secret, rv)
+		if err != nil {
+			return err
+		}
+		avps = append(avps, *ha)
+	}
+	m.avps = avps
+	m.header.Common.Len = uint16(v2HeaderLen + avpsLengthBytes(avps))
+	return nil
+}
+
+// unhideAvps recovers the cleartext of any hidden AVPs in the message
+// using the shared secret and the most recent preceding Random Vector AVP.
+func (m *v2ControlMessage) unhideAvps(secret []byte) error {
+	var rv []byte
+	for i := range m.avps {
+		a := &m.avps[i]
+		if a.getType() == avpTypeRandomVector && a.vendorID() == vendorIDIetf {
+			_, rv = a.rawData()
+			continue
+		}
+		if !a.isHidden() {
+			continue
+		}
+		ua, err := unhideAvp(a, secret, rv)
+		if err != nil {
+			return err
+		}
+		m.avps[i] = *ua
+	}
+	return nil
+}
+
 func (m *v2ControlMessage) validate() error {
 	spec, err := getV2MsgSpec(m.getType())
 	if err != nil {
@@ -544,6 +835,80 @@ func (m *v3ControlMessage) validate() error {
 	return validateAvps(m.avps, spec)
 }
 
+// findPeerTunnelID returns the peer's tunnel ID from the Assigned Tunnel
+// ID AVP of an L2TPv2 message, or the Assigned Control Connection ID AVP
+// of an L2TPv3 message.
+func findPeerTunnelID(msg controlMessage) (ControlConnID, error) {
+	if msg.protocolVersion() == ProtocolVersion3 {
+		ccid, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeAssignedConnID)
+		return ControlConnID(ccid), err
+	}
+	tid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeTunnelID)
+	return ControlConnID(tid), err
+}
+
+// findLocalSessionID returns the ID of the local session a session
+// message is addressed to.  For L2TPv2 this is taken from the message
+// header, and for L2TPv3 from the Remote Session ID AVP.
+func findLocalSessionID(msg controlMessage) (ControlConnID, error) {
+	switch m := msg.(type) {
+	case *v2ControlMessage:
+		return ControlConnID(m.Sid()), nil
+	case *v3ControlMessage:
+		sid, err := findUint32Avp(m.getAvps(), vendorIDIetf, avpTypeRemoteSessionID)
+		return ControlConnID(sid), err
+	}
+	return 0, fmt.Errorf("unhandled protocol version %v", msg.protocolVersion())
+}
+
+// findPeerSessionID returns the peer's session ID from the Assigned
+// Session ID AVP of an L2TPv2 message, or the Local Session ID AVP of an
+// L2TPv3 message.
+func findPeerSessionID(msg controlMessage) (ControlConnID, error) {
+	if msg.protocolVersion() == ProtocolVersion3 {
+		sid, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeLocalSessionID)
+		return ControlConnID(sid), err
+	}
+	sid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeSessionID)
+	return ControlConnID(sid), err
+}
+
+// findConnectSpeeds returns the transmit and receive connect speeds from
+// the (Tx) Connect Speed and Rx Connect Speed AVPs of an L2TPv2 ICCN or
+// OCCN message.  Zero is returned for a speed which is not reported.
+// Per RFC2661, the absence of the Rx Connect Speed AVP indicates the
+// receive speed is the same as the transmit speed.
+func findConnectSpeeds(msg controlMessage) (tx, rx uint32) {
+	tx, _ = findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeConnectSpeed)
+	rx, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeRxConnectSpeed)
+	if err != nil {
+		rx = tx
+	}
+	return tx, rx
+}
+
+// findSequencingRequest returns whether the peer requires data packets
+// to be sequenced, from the Sequencing Required AVP of an L2TPv2 message
+// or the Data Sequencing AVP of an L2TPv3 message.  ok is false if the
+// message doesn't carry a sequencing requirement.
+// L2TPv2 has no means to withdraw the requirement: per RFC2661 section
+// 5.4 the LAC must send sequence numbers once the LNS requires them.
+func findSequencingRequest(msg controlMessage) (seq, ok bool) {
+	if msg.protocolVersion() == ProtocolVersion3 {
+		// A Data Sequencing value of zero indicates no sequencing
+		// is required
+		v, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeDataSequencing)
+		if err != nil {
+			return false, false
+		}
+		return v != 0, true
+	}
+	if _, err := findAvp(msg.getAvps(), vendorIDIetf, avpTypeSequencingRequired); err != nil {
+		return false, false
+	}
+	return true, true
+}
+
 // parseMessageBuffer takes a byte slice of L2TP control message data and
 // parses it into an array of controlMessage instances.
 func parseMessageBuffer(b []byte) (messages []controlMessage, err error) {
@@ -590,7 +955,7 @@ func parseMessageBuffer(b []byte) (messages []controlMessage, err error) {
 		}
 
 		// Step on to the next message in the buffer, if any
-		if _, err := r.Seek(int64(h.Len), io.SeekCurrent); err != nil {
+		if _, err := r.Seek(cursor+int64(h.Len), io.SeekStart); err != nil {
 			return nil, errors.New("malformed message buffer: invalid length for current message")
 		}
 	}
@@ -657,6 +1022,9 @@ func newV2Sccrq(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
 		{avpTypeFramingCap, uint32(cfg.FramingCaps)},
 		{avpTypeTunnelID, uint16(cfg.TunnelID)},
 	}
+	if cfg.BearerCaps != 0 {
+		in = append(in, avpIn{avpTypeBearerCap, uint32(cfg.BearerCaps)})
+	}
 	return buildV2Msg(0, 0, in)
 }
 
@@ -686,6 +1054,9 @@ func newV2Sccrp(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
 		{avpTypeHostName, cfg.HostName},
 		{avpTypeTunnelID, uint16(cfg.TunnelID)},
 	}
+	if cfg.BearerCaps != 0 {
+		in = append(in, avpIn{avpTypeBearerCap, uint32(cfg.BearerCaps)})
+	}
 	return buildV2Msg(cfg.PeerTunnelID, 0, in)
 }
 
@@ -736,6 +1107,92 @@ func newV2Hello(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
 	return buildV2Msg(cfg.PeerTunnelID, 0, in)
 }
 
+// newV2Ocrq builds a new OCRQ message
+func newV2Ocrq(callSerial uint32, ptid ControlConnID, scfg *SessionConfig) (msg *v2ControlMessage, err error) {
+	/* RFC2661 says we MUST include:
+
+	- Message Type
+	- Assigned Session ID
+	- Call Serial Number
+	- Minimum BPS
+	- Maximum BPS
+	- Bearer Type
+	- Framing Type
+	- Called Number
+
+	and we MAY include:
+
+	- Sub-Address
+
+	*/
+	bearerType := scfg.BearerType
+	if bearerType == 0 {
+		bearerType = BearerCapDigital | BearerCapAnalog
+	}
+	maximumBps := scfg.MaximumBPS
+	if maximumBps == 0 {
+		maximumBps = 0xffffffff
+	}
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeOcrq},
+		{avpTypeSessionID, uint16(scfg.SessionID)},
+		{avpTypeCallSerialNumber, callSerial},
+		{avpTypeMinimumBps, scfg.MinimumBPS},
+		{avpTypeMaximumBps, maximumBps},
+		{avpTypeBearerType, uint32(bearerType)},
+		{avpTypeFramingType, v2FramingType(scfg)},
+		{avpTypeCalledNumber, scfg.CalledNumber},
+	}
+	return buildV2Msg(ptid, 0, in)
+}
+
+// v2FramingType returns the Framing Type AVP value for a session,
+// defaulting to both synchronous and asynchronous framing.
+func v2FramingType(scfg *SessionConfig) uint32 {
+	if scfg.FramingType == 0 {
+		return uint32(FramingCapSync | FramingCapAsync)
+	}
+	return uint32(scfg.FramingType)
+}
+
+// newV2Ocrp builds a new OCRP message
+func newV2Ocrp(ptid ControlConnID, scfg *SessionConfig) (msg *v2ControlMessage, err error) {
+	/* RFC2661 says we MUST include
+
+	- Message Type
+	- Assigned Session ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeOcrp},
+		{avpTypeSessionID, uint16(scfg.SessionID)},
+	}
+	return buildV2Msg(ptid, scfg.PeerSessionID, in)
+}
+
+// newV2Occn builds a new OCCN message
+func newV2Occn(ptid ControlConnID, scfg *SessionConfig) (msg *v2ControlMessage, err error) {
+	/* RFC2661 says we MUST include:
+
+	- Message Type
+	- (Tx) Connect Speed
+	- Framing Type
+
+	and we MAY include:
+
+	- Rx Connect Speed
+	- Sequencing Required
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeOccn},
+		{avpTypeConnectSpeed, scfg.TxConnectSpeed},
+		{avpTypeFramingType, v2FramingType(scfg)},
+	}
+	if scfg.RxConnectSpeed != 0 {
+		in = append(in, avpIn{avpTypeRxConnectSpeed, scfg.RxConnectSpeed})
+	}
+	return buildV2Msg(ptid, scfg.PeerSessionID, in)
+}
+
 // newV2Icrq builds a new ICRQ message
 func newV2Icrq(callSerial uint32, ptid ControlConnID, scfg *SessionConfig) (msg *v2ControlMessage, err error) {
 	/* RFC2661 says we MUST include:
@@ -758,6 +1215,12 @@ func newV2Icrq(callSerial uint32, ptid ControlConnID, scfg *SessionConfig) (msg
 		{avpTypeSessionID, uint16(scfg.SessionID)},
 		{avpTypeCallSerialNumber, callSerial},
 	}
+	if scfg.BearerType != 0 {
+		in = append(in, avpIn{avpTypeBearerType, uint32(scfg.BearerType)})
+	}
+	if scfg.PhysicalChannelID != 0 {
+		in = append(in, avpIn{avpTypePhysicalChannelID, scfg.PhysicalChannelID})
+	}
 	return buildV2Msg(ptid, 0, in)
 }
 
@@ -799,8 +1262,138 @@ func newV2Iccn(ptid ControlConnID, scfg *SessionConfig) (msg *v2ControlMessage,
 	*/
 	in := []avpIn{
 		{avpTypeMessage, avpMsgTypeIccn},
-		{avpTypeConnectSpeed, uint32(0)},                               // TODO: config field?
-		{avpTypeFramingType, uint32(FramingCapSync | FramingCapAsync)}, // TODO: config field?
+		{avpTypeConnectSpeed, scfg.TxConnectSpeed},
+		{avpTypeFramingType, v2FramingType(scfg)},
+	}
+	if scfg.RxConnectSpeed != 0 {
+		in = append(in, avpIn{avpTypeRxConnectSpeed, scfg.RxConnectSpeed})
+	}
+	if scfg.ProxyLCP != nil {
+		in = append(in, proxyLCPAvps(scfg.ProxyLCP)...)
+	}
+	return buildV2Msg(ptid, scfg.PeerSessionID, in)
+}
+
+// proxyLCPAvps returns the Proxy LCP and Proxy Authentication AVPs
+// describing p.  Empty fields are omitted.
+func proxyLCPAvps(p *ProxyLCP) (in []avpIn) {
+	for _, i := range []avpIn{
+		{avpTypeInitialRcvdLcpConfreq, p.InitialRcvdConfreq},
+		{avpTypeLastSentLcpConfreq, p.LastSentConfreq},
+		{avpTypeLastRcvdLcpConfreq, p.LastRcvdConfreq},
+	} {
+		if len(i.data.([]byte)) > 0 {
+			in = append(in, i)
+		}
+	}
+	if p.AuthType != ProxyAuthTypeNone {
+		in = append(in, avpIn{avpTypeProxyAuthType, uint16(p.AuthType)})
+	}
+	if p.AuthName != "" {
+		in = append(in, avpIn{avpTypeProxyAuthName, p.AuthName})
+	}
+	if len(p.AuthChallenge) > 0 {
+		in = append(in, avpIn{avpTypeProxyAuthChallenge, p.AuthChallenge})
+	}
+	if p.AuthType == ProxyAuthTypeCHAP || p.AuthType == ProxyAuthTypeMSCHAPv1 {
+		// The first octet of the Proxy Authen ID AVP is reserved
+		in = append(in, avpIn{avpTypeProxyAuthID, []byte{0, p.AuthID}})
+	}
+	if len(p.AuthResponse) > 0 {
+		in = append(in, avpIn{avpTypeProxyAuthResponse, p.AuthResponse})
+	}
+	return
+}
+
+// findProxyLCP decodes the Proxy LCP and Proxy Authentication AVPs of
+// an ICCN message.  It returns nil if the message has none.
+func findProxyLCP(msg controlMessage) (*ProxyLCP, error) {
+	var p ProxyLCP
+	found := false
+	for _, a := range msg.getAvps() {
+		if a.vendorID() != vendorIDIetf {
+			continue
+		}
+		switch a.getType() {
+		case avpTypeInitialRcvdLcpConfreq:
+			p.InitialRcvdConfreq = a.payload.data
+		case avpTypeLastSentLcpConfreq:
+			p.LastSentConfreq = a.payload.data
+		case avpTypeLastRcvdLcpConfreq:
+			p.LastRcvdConfreq = a.payload.data
+		case avpTypeProxyAuthType:
+			v, err := a.decodeUint16Data()
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode proxy authen type: %v", err)
+			}
+			p.AuthType = ProxyAuthType(v)
+		case avpTypeProxyAuthName:
+			v, err := a.decodeStringData()
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode proxy authen name: %v", err)
+			}
+			p.AuthName = v
+		case avpTypeProxyAuthChallenge:
+			p.AuthChallenge = a.payload.data
+		case avpTypeProxyAuthID:
+			if len(a.payload.data) != 2 {
+				return nil, fmt.Errorf("proxy authen ID length %v is not 2", len(a.payload.data))
+			}
+			p.AuthID = a.payload.data[1]
+		case avpTypeProxyAuthResponse:
+			p.AuthResponse = a.payload.data
+		default:
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+// accmLen is the length of the ACCM AVP value: a reserved 16 bit field
+// followed by the send and receive maps.
+const accmLen = 10
+
+func encodeACCM(accm *ACCM) []byte {
+	b := make([]byte, accmLen)
+	binary.BigEndian.PutUint32(b[2:], accm.Send)
+	binary.BigEndian.PutUint32(b[6:], accm.Recv)
+	return b
+}
+
+func decodeACCM(b []byte) (*ACCM, error) {
+	if len(b) != accmLen {
+		return nil, fmt.Errorf("ACCM length %v is not %v", len(b), accmLen)
+	}
+	return &ACCM{
+		Send: binary.BigEndian.Uint32(b[2:]),
+		Recv: binary.BigEndian.Uint32(b[6:]),
+	}, nil
+}
+
+// findACCM decodes the ACCM AVP of an SLI message.  It returns nil if
+// the message has none.
+func findACCM(msg controlMessage) (*ACCM, error) {
+	b, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeAccm)
+	if err != nil {
+		return nil, nil
+	}
+	return decodeACCM(b)
+}
+
+// newV2Sli builds a new SLI message
+func newV2Sli(ptid ControlConnID, scfg *SessionConfig, accm *ACCM) (msg *v2ControlMessage, err error) {
+	/* RFC2661 says we MUST include:
+
+	- Message Type
+	- ACCM
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeSli},
+		{avpTypeAccm, encodeACCM(accm)},
 	}
 	return buildV2Msg(ptid, scfg.PeerSessionID, in)
 }
@@ -832,3 +1425,296 @@ func newV3ControlMessage(ccid ControlConnID, avps []avp) (msg *v3ControlMessage,
 		avps:   avps,
 	}, nil
 }
+
+func buildV3Msg(pccid ControlConnID, in []avpIn) (msg *v3ControlMessage, err error) {
+	msg, err = newV3ControlMessage(pccid, []avp{})
+	if err != nil {
+		return
+	}
+	for _, i := range in {
+		avp, err := newAvp(vendorIDIetf, i.typ, i.data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AVP %v: %v", i.typ, err)
+		}
+		msg.appendAvp(avp)
+	}
+	return
+}
+
+// v3PseudowireCaps lists the pseudowire types advertised in the
+// Pseudowire Capabilities List AVP.
+var v3PseudowireCaps = []PseudowireType{
+	PseudowireTypePPP,
+	PseudowireTypeEth,
+}
+
+// encodePseudowireCaps encodes a list of pseudowire types as the
+// payload of a Pseudowire Capabilities List AVP.
+func encodePseudowireCaps(pwtypes []PseudowireType) []byte {
+	b := make([]byte, 2*len(pwtypes))
+	for i, pwtype := range pwtypes {
+		binary.BigEndian.PutUint16(b[2*i:], uint16(pwtype))
+	}
+	return b
+}
+
+// decodePseudowireCaps decodes the payload of a Pseudowire
+// Capabilities List AVP.
+func decodePseudowireCaps(b []byte) ([]PseudowireType, error) {
+	if len(b)%2 != 0 {
+		return nil, fmt.Errorf("pseudowire capabilities list length %v is not a multiple of 2", len(b))
+	}
+	pwtypes := make([]PseudowireType, 0, len(b)/2)
+	for i := 0; i < len(b); i += 2 {
+		pwtypes = append(pwtypes, PseudowireType(binary.BigEndian.Uint16(b[i:])))
+	}
+	return pwtypes, nil
+}
+
+// Circuit Status AVP flags, ref: RFC3931 section 5.4.5
+const (
+	v3CircuitStatusActive uint16 = 0x1
+	v3CircuitStatusNew    uint16 = 0x2
+)
+
+// v3RouterID returns the router ID to advertise for a tunnel, which
+// defaults to the tunnel ID if the configuration doesn't specify one.
+func v3RouterID(cfg *TunnelConfig) uint32 {
+	if cfg.RouterID != 0 {
+		return cfg.RouterID
+	}
+	return uint32(cfg.TunnelID)
+}
+
+// newV3Sccrq builds a new SCCRQ message
+func newV3Sccrq(cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Host Name
+	- Router ID
+	- Assigned Control Connection ID
+	- Pseudowire Capabilities List
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Control Message Authentication Nonce
+	- Receive Window Size
+	- Tie Breaker
+	- Vendor Name
+	- Firmware Revision
+	- Preferred Language
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeSccrq},
+		{avpTypeHostName, cfg.HostName},
+		{avpTypeRouterID, v3RouterID(cfg)},
+		{avpTypeAssignedConnID, uint32(cfg.TunnelID)},
+		{avpTypePseudowireCaps, encodePseudowireCaps(v3PseudowireCaps)},
+	}
+	return buildV3Msg(0, in)
+}
+
+// newV3Sccrp builds a new SCCRP message
+func newV3Sccrp(cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Host Name
+	- Router ID
+	- Assigned Control Connection ID
+	- Pseudowire Capabilities List
+
+	and we MAY include:
+
+	- Random Vector
+	- Control Message Authentication Nonce
+	- Message Digest
+	- Receive Window Size
+	- Vendor Name
+	- Firmware Revision
+	- Preferred Language
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeSccrp},
+		{avpTypeHostName, cfg.HostName},
+		{avpTypeRouterID, v3RouterID(cfg)},
+		{avpTypeAssignedConnID, uint32(cfg.TunnelID)},
+		{avpTypePseudowireCaps, encodePseudowireCaps(v3PseudowireCaps)},
+	}
+	return buildV3Msg(cfg.PeerTunnelID, in)
+}
+
+// newV3Scccn builds a new SCCCN message
+func newV3Scccn(cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeScccn},
+	}
+	return buildV3Msg(cfg.PeerTunnelID, in)
+}
+
+// newV3Stopccn builds a new StopCCN message
+func newV3Stopccn(rc *resultCode, cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Result Code
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Assigned Control Connection ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeStopccn},
+		{avpTypeResultCode, rc},
+		{avpTypeAssignedConnID, uint32(cfg.TunnelID)},
+	}
+	return buildV3Msg(cfg.PeerTunnelID, in)
+}
+
+// newV3Icrq builds a new ICRQ message
+func newV3Icrq(callSerial uint32, ptid ControlConnID, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Local Session ID
+	- Remote Session ID
+	- Serial Number
+	- Pseudowire Type
+	- Remote End ID
+	- Circuit Status
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Assigned Cookie
+	- Session Tie Breaker
+	- L2-Specific Sublayer
+	- Data Sequencing
+	- Tx Connect Speed
+	- Rx Connect Speed
+	- Physical Channel ID
+	*/
+	remoteEndID := scfg.RemoteEndID
+	if remoteEndID == nil {
+		remoteEndID = []byte{}
+	}
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeIcrq},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(0)},
+		{avpTypeCallSerialNumber, callSerial},
+		{avpTypePseudowireType, uint16(scfg.Pseudowire)},
+		{avpTypeRemoteEndID, remoteEndID},
+		{avpTypeCircuitStatus, v3CircuitStatusActive | v3CircuitStatusNew},
+	}
+	if len(scfg.Cookie) > 0 {
+		in = append(in, avpIn{avpTypeAssignedCookie, scfg.Cookie})
+	}
+	if scfg.PhysicalChannelID != 0 {
+		in = append(in, avpIn{avpTypePhysicalChannelID, scfg.PhysicalChannelID})
+	}
+	return buildV3Msg(ptid, in)
+}
+
+// newV3Icrp builds a new ICRP message
+func newV3Icrp(ptid ControlConnID, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Local Session ID
+	- Remote Session ID
+	- Circuit Status
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Assigned Cookie
+	- L2-Specific Sublayer
+	- Data Sequencing
+	- Tx Connect Speed
+	- Rx Connect Speed
+	- Physical Channel ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeIcrp},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(scfg.PeerSessionID)},
+		{avpTypeCircuitStatus, v3CircuitStatusActive | v3CircuitStatusNew},
+	}
+	if len(scfg.Cookie) > 0 {
+		in = append(in, avpIn{avpTypeAssignedCookie, scfg.Cookie})
+	}
+	return buildV3Msg(ptid, in)
+}
+
+// newV3Iccn builds a new ICCN message
+func newV3Iccn(ptid ControlConnID, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Local Session ID
+	- Remote Session ID
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- L2-Specific Sublayer
+	- Data Sequencing
+	- Tx Connect Speed
+	- Rx Connect Speed
+	- Circuit Status
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeIccn},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(scfg.PeerSessionID)},
+	}
+	if scfg.TxConnectSpeed != 0 {
+		in = append(in, avpIn{avpTypeTxConnectSpeedBps, uint64(scfg.TxConnectSpeed)})
+	}
+	if scfg.RxConnectSpeed != 0 {
+		in = append(in, avpIn{avpTypeRxConnectSpeedBps, uint64(scfg.RxConnectSpeed)})
+	}
+	return buildV3Msg(ptid, in)
+}
+
+// newV3Cdn builds a new CDN message
+func newV3Cdn(ptid ControlConnID, rc *resultCode, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Result Code
+	- Local Session ID
+	- Remote Session ID
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Q.931 Cause Code
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeCdn},
+		{avpTypeResultCode, rc},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(scfg.PeerSessionID)},
+	}
+	return buildV3Msg(ptid, in)
+}
@@ -2,6 +2,11 @@ package l2tp
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -115,6 +120,33 @@ func TestParseMessageBuffer(t *testing.T) {
 	}
 }
 
+func TestParseMessageBufferMultiple(t *testing.T) {
+	// A ZLB ack followed by a HELLO in the same buffer
+	in := []byte{
+		0xc8, 0x02, 0x00, 0x0c, 0x00, 0x01, 0x00, 0x00,
+		0x00, 0x01, 0x00, 0x01,
+		0xc8, 0x02, 0x00, 0x14, 0x00, 0x01, 0x00, 0x00,
+		0x00, 0x02, 0x00, 0x01, 0x80, 0x08, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x06,
+	}
+	got, err := parseMessageBuffer(in)
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(%q) failed: %v", in, err)
+	}
+	want := []avpMsgType{avpMsgTypeAck, avpMsgTypeHello}
+	if len(got) != len(want) {
+		t.Fatalf("parseMessageBuffer(%q): got %v messages, want %v", in, len(got), len(want))
+	}
+	for i, msg := range got {
+		if msg.getType() != want[i] {
+			t.Errorf("message %d: got type %v, want %v", i, msg.getType(), want[i])
+		}
+		if msg.ns() != uint16(i+1) {
+			t.Errorf("message %d: got Ns %v, want %v", i, msg.ns(), i+1)
+		}
+	}
+}
+
 type msgTestAvpMetadata struct {
 	isMandatory, isHidden bool
 	avpType               avpType
@@ -261,3 +293,1442 @@ func TestV2TunnelBuildValidate(t *testing.T) {
 		}
 	}
 }
+
+func TestIcrqCallAVPs(t *testing.T) {
+	cases := []struct {
+		name        string
+		build       func(scfg *SessionConfig) (controlMessage, error)
+		scfg        SessionConfig
+		wantBearer  bool
+		wantChannel bool
+	}{
+		{
+			name: "L2TPv2 defaults",
+			build: func(scfg *SessionConfig) (controlMessage, error) {
+				return newV2Icrq(1234, 90, scfg)
+			},
+			scfg: SessionConfig{SessionID: 42},
+		},
+		{
+			name: "L2TPv2 bearer type and physical channel",
+			build: func(scfg *SessionConfig) (controlMessage, error) {
+				return newV2Icrq(1234, 90, scfg)
+			},
+			scfg:        SessionConfig{SessionID: 42, BearerType: BearerCapAnalog, PhysicalChannelID: 0xabcd},
+			wantBearer:  true,
+			wantChannel: true,
+		},
+		{
+			name: "L2TPv3 defaults",
+			build: func(scfg *SessionConfig) (controlMessage, error) {
+				return newV3Icrq(1234, 90, scfg)
+			},
+			scfg: SessionConfig{SessionID: 42, Pseudowire: PseudowireTypeEth},
+		},
+		{
+			name: "L2TPv3 physical channel",
+			build: func(scfg *SessionConfig) (controlMessage, error) {
+				return newV3Icrq(1234, 90, scfg)
+			},
+			scfg:        SessionConfig{SessionID: 42, Pseudowire: PseudowireTypeEth, PhysicalChannelID: 0xabcd},
+			wantChannel: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := c.build(&c.scfg)
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+			b, err := msg.toBytes()
+			if err != nil {
+				t.Fatalf("toBytes(): %v", err)
+			}
+			msgs, err := parseMessageBuffer(b)
+			if err != nil {
+				t.Fatalf("parseMessageBuffer(): %v", err)
+			}
+			if err = msgs[0].validate(); err != nil {
+				t.Fatalf("validate(): %v", err)
+			}
+			avps := msgs[0].getAvps()
+
+			if serial, err := findUint32Avp(avps, vendorIDIetf, avpTypeCallSerialNumber); err != nil || serial != 1234 {
+				t.Errorf("Call Serial Number: expected 1234, got %v (%v)", serial, err)
+			}
+
+			bearer, err := findUint32Avp(avps, vendorIDIetf, avpTypeBearerType)
+			if c.wantBearer {
+				if err != nil || BearerCapability(bearer) != c.scfg.BearerType {
+					t.Errorf("Bearer Type: expected %v, got %v (%v)", c.scfg.BearerType, bearer, err)
+				}
+			} else if err == nil {
+				t.Errorf("Bearer Type: unexpected AVP with value %v", bearer)
+			}
+
+			channel, err := findUint32Avp(avps, vendorIDIetf, avpTypePhysicalChannelID)
+			if c.wantChannel {
+				if err != nil || channel != c.scfg.PhysicalChannelID {
+					t.Errorf("Physical Channel ID: expected %v, got %v (%v)", c.scfg.PhysicalChannelID, channel, err)
+				}
+			} else if err == nil {
+				t.Errorf("Physical Channel ID: unexpected AVP with value %v", channel)
+			}
+		})
+	}
+}
+
+func TestConnectSpeedAVPs(t *testing.T) {
+	cases := []struct {
+		name           string
+		build          func(scfg *SessionConfig) (controlMessage, error)
+		scfg           SessionConfig
+		txType, rxType avpType
+		// expected AVP values, nil if the AVP should be absent
+		wantTx, wantRx interface{}
+		// expected speeds parsed from an L2TPv2 message
+		parseTx, parseRx uint32
+	}{
+		{
+			name: "L2TPv2 ICCN defaults",
+			build: func(scfg *SessionConfig) (controlMessage, error) {
+				return newV2Iccn(90, scfg)
+			},
+			txType: avpTypeConnectSpeed,
+			rxType: avpTypeRxConnectSpeed,
+			wantTx: uint32(0),
+		},
+		{
+			name: "L2TPv2 ICCN tx speed",
+			build: func(scfg *SessionConfig) (controlMessage, error) {
+				return newV2Iccn(90, scfg)
+			},
+			scfg:    SessionConfig{TxConnectSpeed: 64000},
+			txType:  avpTypeConnectSpeed,
+			rxType:  avpTypeRxConnectSpeed,
+			wantTx:  uint32(64000),
+			parseTx: 64000,
+			parseRx: 64000,
+		},
+		{
+			name: "L2TPv2 ICCN tx and rx speeds",
+			build: func(scfg *SessionConfig) (controlMessage, error) {
+				return newV2Iccn(90, scfg)
+			},
+			scfg:    SessionConfig{TxConnectSpeed: 0xfffffffe, RxConnectSpeed: 33600},
+			txType:  avpTypeConnectSpeed,
+			rxType:  avpTypeRxConnectSpeed,
+			wantTx:  uint32(0xfffffffe),
+			wantRx:  uint32(33600),
+			parseTx: 0xfffffffe,
+			parseRx: 33600,
+		},
+		{
+			name: "L2TPv2 OCCN tx and rx speeds",
+			build: func(scfg *SessionConfig) (controlMessage, error) {
+				return newV2Occn(90, scfg)
+			},
+			scfg:    SessionConfig{TxConnectSpeed: 56000, RxConnectSpeed: 33600},
+			txType:  avpTypeConnectSpeed,
+			rxType:  avpTypeRxConnectSpeed,
+			wantTx:  uint32(56000),
+			wantRx:  uint32(33600),
+			parseTx: 56000,
+			parseRx: 33600,
+		},
+		{
+			name: "L2TPv3 ICCN defaults",
+			build: func(scfg *SessionConfig) (controlMessage, error) {
+				return newV3Iccn(90, scfg)
+			},
+			scfg:   SessionConfig{SessionID: 42, PeerSessionID: 24},
+			txType: avpTypeTxConnectSpeedBps,
+			rxType: avpTypeRxConnectSpeedBps,
+		},
+		{
+			name: "L2TPv3 ICCN tx and rx speeds",
+			build: func(scfg *SessionConfig) (controlMessage, error) {
+				return newV3Iccn(90, scfg)
+			},
+			scfg:   SessionConfig{SessionID: 42, PeerSessionID: 24, TxConnectSpeed: 100000000, RxConnectSpeed: 10000000},
+			txType: avpTypeTxConnectSpeedBps,
+			rxType: avpTypeRxConnectSpeedBps,
+			wantTx: uint64(100000000),
+			wantRx: uint64(10000000),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := c.build(&c.scfg)
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+			b, err := msg.toBytes()
+			if err != nil {
+				t.Fatalf("toBytes(): %v", err)
+			}
+			msgs, err := parseMessageBuffer(b)
+			if err != nil {
+				t.Fatalf("parseMessageBuffer(): %v", err)
+			}
+			if err = msgs[0].validate(); err != nil {
+				t.Fatalf("validate(): %v", err)
+			}
+
+			for _, a := range []struct {
+				typ  avpType
+				want interface{}
+			}{
+				{c.txType, c.wantTx},
+				{c.rxType, c.wantRx},
+			} {
+				avp, err := findAvp(msgs[0].getAvps(), vendorIDIetf, a.typ)
+				if a.want == nil {
+					if err == nil {
+						t.Errorf("%v: unexpected AVP", a.typ)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%v: %v", a.typ, err)
+				}
+				got, err := avp.decode()
+				if err != nil {
+					t.Fatalf("%v: decode(): %v", a.typ, err)
+				}
+				if got != a.want {
+					t.Errorf("%v: expected %v, got %v", a.typ, a.want, got)
+				}
+			}
+
+			if msgs[0].protocolVersion() == ProtocolVersion2 {
+				tx, rx := findConnectSpeeds(msgs[0])
+				if tx != c.parseTx || rx != c.parseRx {
+					t.Errorf("findConnectSpeeds(): expected %v/%v, got %v/%v", c.parseTx, c.parseRx, tx, rx)
+				}
+			}
+		})
+	}
+}
+
+func TestV2OutgoingCallBuildValidate(t *testing.T) {
+	scfg := SessionConfig{
+		SessionID:     42,
+		PeerSessionID: 24,
+		CallDirection: CallDirectionOutgoing,
+		CalledNumber:  "01234567890",
+	}
+
+	ocrq, err := newV2Ocrq(1234, 90, &scfg)
+	if err != nil {
+		t.Fatalf("newV2Ocrq: %v", err)
+	}
+	err = ocrq.validate()
+	if err != nil {
+		t.Fatalf("OCRQ validation: %v", err)
+	}
+
+	expectTypes := []avpType{
+		avpTypeMessage,
+		avpTypeSessionID,
+		avpTypeCallSerialNumber,
+		avpTypeMinimumBps,
+		avpTypeMaximumBps,
+		avpTypeBearerType,
+		avpTypeFramingType,
+		avpTypeCalledNumber,
+	}
+	avps := ocrq.getAvps()
+	if len(avps) != len(expectTypes) {
+		t.Fatalf("OCRQ: expected %d AVPs, got %d", len(expectTypes), len(avps))
+	}
+	for i, typ := range expectTypes {
+		if avps[i].getType() != typ {
+			t.Errorf("OCRQ AVP %d: expected %v, got %v", i, typ, avps[i].getType())
+		}
+	}
+
+	if ocrq.Tid() != 90 || ocrq.Sid() != 0 {
+		t.Errorf("OCRQ header: expected tid 90, sid 0, got tid %v, sid %v", ocrq.Tid(), ocrq.Sid())
+	}
+	if sid, err := findUint16Avp(avps, vendorIDIetf, avpTypeSessionID); err != nil || sid != 42 {
+		t.Errorf("OCRQ Assigned Session ID: expected 42, got %v (%v)", sid, err)
+	}
+	if serial, err := findUint32Avp(avps, vendorIDIetf, avpTypeCallSerialNumber); err != nil || serial != 1234 {
+		t.Errorf("OCRQ Call Serial Number: expected 1234, got %v (%v)", serial, err)
+	}
+	if number, err := findStringAvp(avps, vendorIDIetf, avpTypeCalledNumber); err != nil || number != scfg.CalledNumber {
+		t.Errorf("OCRQ Called Number: expected %q, got %q (%v)", scfg.CalledNumber, number, err)
+	}
+	if bearer, err := findUint32Avp(avps, vendorIDIetf, avpTypeBearerType); err != nil || bearer != 0x3 {
+		t.Errorf("OCRQ Bearer Type: expected 0x3, got %v (%v)", bearer, err)
+	}
+	if bps, err := findUint32Avp(avps, vendorIDIetf, avpTypeMinimumBps); err != nil || bps != 0 {
+		t.Errorf("OCRQ Minimum BPS: expected 0, got %v (%v)", bps, err)
+	}
+	if bps, err := findUint32Avp(avps, vendorIDIetf, avpTypeMaximumBps); err != nil || bps != 0xffffffff {
+		t.Errorf("OCRQ Maximum BPS: expected 0xffffffff, got %v (%v)", bps, err)
+	}
+	if framing, err := findUint32Avp(avps, vendorIDIetf, avpTypeFramingType); err != nil || framing != 0x3 {
+		t.Errorf("OCRQ Framing Type: expected 0x3, got %v (%v)", framing, err)
+	}
+
+	scfg.BearerType = BearerCapDigital
+	scfg.MinimumBPS = 9600
+	scfg.MaximumBPS = 64000
+	scfg.FramingType = FramingCapSync
+	ocrq, err = newV2Ocrq(1234, 90, &scfg)
+	if err != nil {
+		t.Fatalf("newV2Ocrq: %v", err)
+	}
+	avps = ocrq.getAvps()
+	if bearer, err := findUint32Avp(avps, vendorIDIetf, avpTypeBearerType); err != nil || bearer != 0x1 {
+		t.Errorf("OCRQ Bearer Type: expected 0x1, got %v (%v)", bearer, err)
+	}
+	if bps, err := findUint32Avp(avps, vendorIDIetf, avpTypeMinimumBps); err != nil || bps != 9600 {
+		t.Errorf("OCRQ Minimum BPS: expected 9600, got %v (%v)", bps, err)
+	}
+	if bps, err := findUint32Avp(avps, vendorIDIetf, avpTypeMaximumBps); err != nil || bps != 64000 {
+		t.Errorf("OCRQ Maximum BPS: expected 64000, got %v (%v)", bps, err)
+	}
+	if framing, err := findUint32Avp(avps, vendorIDIetf, avpTypeFramingType); err != nil || framing != 0x1 {
+		t.Errorf("OCRQ Framing Type: expected 0x1, got %v (%v)", framing, err)
+	}
+
+	builders := []func(ControlConnID, *SessionConfig) (*v2ControlMessage, error){
+		newV2Ocrp,
+		newV2Occn,
+	}
+	for i, builder := range builders {
+		msg, err := builder(90, &scfg)
+		if err != nil {
+			t.Fatalf("builder %v: %v", i, err)
+		}
+		err = msg.validate()
+		if err != nil {
+			t.Fatalf("builder validation %v: %v", i, err)
+		}
+		if msg.Sid() != 24 {
+			t.Errorf("builder %v: expected sid 24, got %v", i, msg.Sid())
+		}
+	}
+
+	occn, err := newV2Occn(90, &scfg)
+	if err != nil {
+		t.Fatalf("newV2Occn: %v", err)
+	}
+	if framing, err := findUint32Avp(occn.getAvps(), vendorIDIetf, avpTypeFramingType); err != nil || framing != 0x1 {
+		t.Errorf("OCCN Framing Type: expected 0x1, got %v (%v)", framing, err)
+	}
+}
+
+func TestV2HiddenAvps(t *testing.T) {
+	secret := []byte("sesame")
+	rv := []byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x02, 0x03, 0x04}
+	tcfg := TunnelConfig{TunnelID: 42, PeerTunnelID: 90, HostName: "lac"}
+
+	msg, err := newV2Sccrq(&tcfg)
+	if err != nil {
+		t.Fatalf("newV2Sccrq(): %v", err)
+	}
+	err = msg.hideAvps(secret, rv, map[avpType]bool{avpTypeTunnelID: true})
+	if err != nil {
+		t.Fatalf("hideAvps(): %v", err)
+	}
+
+	b, err := msg.toBytes()
+	if err != nil {
+		t.Fatalf("toBytes(): %v", err)
+	}
+
+	// Parse and recover the message with the right secret
+	got, err := parseMessageBuffer(b)
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(%v): %v", b, err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("parseMessageBuffer(%v): wanted 1 message, got %d", b, len(got))
+	}
+	v2msg, ok := got[0].(*v2ControlMessage)
+	if !ok {
+		t.Fatalf("parseMessageBuffer(%v): expected v2 message, got %T", b, got[0])
+	}
+	if _, err = findUint16Avp(v2msg.getAvps(), vendorIDIetf, avpTypeTunnelID); err == nil {
+		t.Errorf("decoded hidden tunnel ID AVP without unhiding it")
+	}
+	if err = v2msg.unhideAvps(secret); err != nil {
+		t.Fatalf("unhideAvps(): %v", err)
+	}
+	if err = v2msg.validate(); err != nil {
+		t.Fatalf("validate(): %v", err)
+	}
+	tid, err := findUint16Avp(v2msg.getAvps(), vendorIDIetf, avpTypeTunnelID)
+	if err != nil {
+		t.Fatalf("findUint16Avp(%v): %v", avpTypeTunnelID, err)
+	}
+	if tid != uint16(tcfg.TunnelID) {
+		t.Errorf("expected tunnel ID %v, got %v", tcfg.TunnelID, tid)
+	}
+
+	// A wrong secret should fail
+	got, err = parseMessageBuffer(b)
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(%v): %v", b, err)
+	}
+	if err = got[0].(*v2ControlMessage).unhideAvps([]byte("open sesame")); err == nil {
+		t.Errorf("unhideAvps() succeeded unexpectedly with the wrong secret")
+	}
+}
+
+func TestNewRawControlMessage(t *testing.T) {
+	helloAvp := RawAVP{Mandatory: true, Value: []byte{0x00, 0x06}}
+
+	cases := []struct {
+		name    string
+		version ProtocolVersion
+		in      *RawControlMessage
+		want    []byte
+		estr    string
+	}{
+		{
+			name:    "L2TPv2 with malformed AVP",
+			version: ProtocolVersion2,
+			in: &RawControlMessage{
+				SessionID: 7,
+				AVPs: []RawAVP{
+					helloAvp,
+					// Assigned Tunnel ID with a bad length
+					{Mandatory: true, Type: 9, Value: []byte{0x01}},
+				},
+			},
+			want: []byte{
+				0xc8, 0x02, 0x00, 0x1b, 0x00, 0x2a, 0x00, 0x07, 0x00, 0x00, 0x00, 0x00,
+				0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06,
+				0x80, 0x07, 0x00, 0x00, 0x00, 0x09, 0x01,
+			},
+		},
+		{
+			name:    "L2TPv3 with vendor AVP",
+			version: ProtocolVersion3,
+			in: &RawControlMessage{
+				AVPs: []RawAVP{
+					helloAvp,
+					{VendorID: 9, Type: 99, Hidden: true, Value: []byte{0xde, 0xad}},
+				},
+			},
+			want: []byte{
+				0xc8, 0x03, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x2a, 0x00, 0x00, 0x00, 0x00,
+				0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06,
+				0x40, 0x08, 0x00, 0x09, 0x00, 0x63, 0xde, 0xad,
+			},
+		},
+		{
+			name:    "nil message",
+			version: ProtocolVersion2,
+			estr:    "invalid nil message",
+		},
+		{
+			name:    "no AVPs",
+			version: ProtocolVersion2,
+			in:      &RawControlMessage{},
+			estr:    "at least one AVP",
+		},
+		{
+			name:    "no Message Type AVP",
+			version: ProtocolVersion2,
+			in: &RawControlMessage{
+				AVPs: []RawAVP{{Mandatory: true, Type: 9, Value: []byte{0x00, 0x01}}},
+			},
+			estr: "first AVP must be a Message Type AVP",
+		},
+		{
+			name:    "bad Message Type AVP",
+			version: ProtocolVersion2,
+			in: &RawControlMessage{
+				AVPs: []RawAVP{{Mandatory: true, Value: []byte{0x06}}},
+			},
+			estr: "bad Message Type AVP",
+		},
+		{
+			name:    "AVP too long",
+			version: ProtocolVersion2,
+			in: &RawControlMessage{
+				AVPs: []RawAVP{helloAvp, {Type: 8, Value: make([]byte, 1024)}},
+			},
+			estr: "too long to encode",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := newRawControlMessage(c.version, 42, c.in)
+			if c.estr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.estr) {
+					t.Fatalf("expected error containing %q, got %v", c.estr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newRawControlMessage: %v", err)
+			}
+			got, err := msg.toBytes()
+			if err != nil {
+				t.Fatalf("toBytes(): %v", err)
+			}
+			if !bytes.Equal(got, c.want) {
+				t.Errorf("toBytes(): expected %x, got %x", c.want, got)
+			}
+		})
+	}
+}
+
+func TestParseRawControlMessages(t *testing.T) {
+	for _, version := range []ProtocolVersion{ProtocolVersion2, ProtocolVersion3} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			in := &RawControlMessage{
+				SessionID: 7,
+				AVPs: []RawAVP{
+					// ICRQ
+					{Mandatory: true, Value: []byte{0x00, 0x0a}},
+					// Assigned Session ID
+					{Mandatory: true, Type: 14, Value: []byte{0x12, 0x34}},
+					// Call Serial Number
+					{Mandatory: true, Type: 15, Value: []byte{0x00, 0x00, 0x00, 0x2a}},
+					// Vendor-specific string
+					{VendorID: 9, Type: 99, Mandatory: true, Hidden: true, Value: []byte("hello")},
+				},
+			}
+			msg, err := newRawControlMessage(version, 42, in)
+			if err != nil {
+				t.Fatalf("newRawControlMessage: %v", err)
+			}
+			b, err := msg.toBytes()
+			if err != nil {
+				t.Fatalf("toBytes(): %v", err)
+			}
+
+			got, err := ParseRawControlMessages(b)
+			if err != nil {
+				t.Fatalf("ParseRawControlMessages(): %v", err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("expected 1 message, got %d", len(got))
+			}
+			if !reflect.DeepEqual(got[0].AVPs, in.AVPs) {
+				t.Errorf("expected AVPs %v, got %v", in.AVPs, got[0].AVPs)
+			}
+			wantSid := ControlConnID(0)
+			if version == ProtocolVersion2 {
+				wantSid = 7
+			}
+			if got[0].SessionID != wantSid {
+				t.Errorf("expected session ID %v, got %v", wantSid, got[0].SessionID)
+			}
+
+			sid, ok := got[0].FindAVP(0, 14)
+			if !ok {
+				t.Fatalf("FindAVP() failed to find Assigned Session ID")
+			}
+			if v, err := sid.AsUint16(); err != nil || v != 0x1234 {
+				t.Errorf("AsUint16(): expected 0x1234, got %v, %v", v, err)
+			}
+			if _, err := sid.AsUint32(); err == nil {
+				t.Errorf("AsUint32() succeeded unexpectedly on a two octet value")
+			}
+
+			csn, ok := got[0].FindAVP(0, 15)
+			if !ok {
+				t.Fatalf("FindAVP() failed to find Call Serial Number")
+			}
+			if v, err := csn.AsUint32(); err != nil || v != 42 {
+				t.Errorf("AsUint32(): expected 42, got %v, %v", v, err)
+			}
+
+			vavp, ok := got[0].FindAVP(9, 99)
+			if !ok {
+				t.Fatalf("FindAVP() failed to find vendor AVP")
+			}
+			if !vavp.Hidden || vavp.AsString() != "hello" {
+				t.Errorf("expected hidden AVP with value hello, got %v", vavp)
+			}
+			if !bytes.Equal(vavp.AsBytes(), []byte("hello")) {
+				t.Errorf("AsBytes(): expected hello, got %q", vavp.AsBytes())
+			}
+
+			if _, ok := got[0].FindAVP(9, 14); ok {
+				t.Errorf("FindAVP() found AVP with the wrong vendor ID")
+			}
+		})
+	}
+}
+
+func TestParseRawControlMessagesMalformed(t *testing.T) {
+	// Header length exceeds the buffer
+	b := []byte{0xc8, 0x02, 0x00, 0x40, 0x00, 0x2a, 0x00, 0x07, 0x00, 0x00, 0x00, 0x00}
+	if _, err := ParseRawControlMessages(b); err == nil {
+		t.Errorf("ParseRawControlMessages() succeeded unexpectedly")
+	}
+
+	// Message Type AVP too long to decode
+	b = []byte{
+		0xc8, 0x02, 0x00, 0x16, 0x00, 0x2a, 0x00, 0x07, 0x00, 0x00, 0x00, 0x00,
+		0x80, 0x0a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+	}
+	if _, err := ParseRawControlMessages(b); err == nil {
+		t.Errorf("ParseRawControlMessages() with long Message Type AVP succeeded unexpectedly")
+	}
+}
+
+func TestV2CapabilitiesRoundTrip(t *testing.T) {
+	cases := []struct {
+		framing FramingCapability
+		bearer  BearerCapability
+	}{
+		{framing: FramingCapSync, bearer: 0},
+		{framing: FramingCapAsync, bearer: BearerCapDigital},
+		{framing: FramingCapSync | FramingCapAsync, bearer: BearerCapAnalog},
+		{framing: FramingCapSync | FramingCapAsync, bearer: BearerCapDigital | BearerCapAnalog},
+	}
+	builders := map[string]func(*TunnelConfig) (*v2ControlMessage, error){
+		"SCCRQ": newV2Sccrq,
+		"SCCRP": newV2Sccrp,
+	}
+	for _, c := range cases {
+		for name, builder := range builders {
+			t.Run(fmt.Sprintf("%v %v %v", name, c.framing, c.bearer), func(t *testing.T) {
+				msg, err := builder(&TunnelConfig{
+					HostName:    "test",
+					TunnelID:    42,
+					FramingCaps: c.framing,
+					BearerCaps:  c.bearer,
+				})
+				if err != nil {
+					t.Fatalf("build: %v", err)
+				}
+				err = msg.validate()
+				if err != nil {
+					t.Fatalf("validate: %v", err)
+				}
+				b, err := msg.toBytes()
+				if err != nil {
+					t.Fatalf("toBytes(): %v", err)
+				}
+				parsed, err := parseMessageBuffer(b)
+				if err != nil {
+					t.Fatalf("parseMessageBuffer(): %v", err)
+				}
+				avps := parsed[0].getAvps()
+
+				fc, err := findUint32Avp(avps, vendorIDIetf, avpTypeFramingCap)
+				if err != nil {
+					t.Fatalf("no Framing Capabilities AVP: %v", err)
+				}
+				if FramingCapability(fc) != c.framing {
+					t.Errorf("framing capabilities: expected %v, got %v", c.framing, FramingCapability(fc))
+				}
+
+				bc, err := findUint32Avp(avps, vendorIDIetf, avpTypeBearerCap)
+				if c.bearer == 0 {
+					if err == nil {
+						t.Errorf("unexpected Bearer Capabilities AVP %v", BearerCapability(bc))
+					}
+				} else if err != nil {
+					t.Errorf("no Bearer Capabilities AVP: %v", err)
+				} else if BearerCapability(bc) != c.bearer {
+					t.Errorf("bearer capabilities: expected %v, got %v", c.bearer, BearerCapability(bc))
+				}
+			})
+		}
+	}
+}
+
+func TestV2ProxyLCPRoundTrip(t *testing.T) {
+	cases := []struct {
+		name      string
+		proxy     *ProxyLCP
+		expectIDs bool
+	}{
+		{
+			name:  "none",
+			proxy: nil,
+		},
+		{
+			name: "lcp only",
+			proxy: &ProxyLCP{
+				InitialRcvdConfreq: []byte{0x01, 0x04, 0x05, 0xd4},
+				LastSentConfreq:    []byte{0x01, 0x04, 0x05, 0xdc, 0x05, 0x06, 0x12, 0x34, 0x56, 0x78},
+				LastRcvdConfreq:    []byte{0x01, 0x04, 0x05, 0xd4, 0x03, 0x04, 0xc0, 0x23},
+			},
+		},
+		{
+			name: "pap",
+			proxy: &ProxyLCP{
+				LastRcvdConfreq: []byte{0x01, 0x04, 0x05, 0xd4},
+				AuthType:        ProxyAuthTypePAP,
+				AuthName:        "user@example.com",
+				AuthResponse:    []byte("password"),
+			},
+		},
+		{
+			name: "chap",
+			proxy: &ProxyLCP{
+				LastSentConfreq: []byte{0x03, 0x05, 0xc2, 0x23, 0x05},
+				AuthType:        ProxyAuthTypeCHAP,
+				AuthName:        "user@example.com",
+				AuthChallenge:   []byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x02, 0x03, 0x04},
+				AuthID:          0x7f,
+				AuthResponse:    []byte{0x10, 0x32, 0x54, 0x76, 0x98, 0xba, 0xdc, 0xfe},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scfg := SessionConfig{
+				SessionID:     42,
+				PeerSessionID: 24,
+				ProxyLCP:      c.proxy,
+			}
+			msg, err := newV2Iccn(90, &scfg)
+			if err != nil {
+				t.Fatalf("newV2Iccn(): %v", err)
+			}
+			err = msg.validate()
+			if err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+
+			// The response AVP carries the password for PAP, so ensure
+			// it survives hiding
+			err = msg.hideAvps([]byte("secret"), []byte("0123456789abcdef"), v2HiddenAvpTypes)
+			if err != nil {
+				t.Fatalf("hideAvps(): %v", err)
+			}
+			b, err := msg.toBytes()
+			if err != nil {
+				t.Fatalf("toBytes(): %v", err)
+			}
+			parsed, err := parseMessageBuffer(b)
+			if err != nil {
+				t.Fatalf("parseMessageBuffer(): %v", err)
+			}
+			v2msg := parsed[0].(*v2ControlMessage)
+			if c.proxy != nil && len(c.proxy.AuthResponse) > 0 {
+				a, err := findAvp(v2msg.getAvps(), vendorIDIetf, avpTypeProxyAuthResponse)
+				if err != nil {
+					t.Fatalf("no Proxy Authen Response AVP: %v", err)
+				}
+				if !a.isHidden() {
+					t.Errorf("Proxy Authen Response AVP not hidden")
+				}
+			}
+			err = v2msg.unhideAvps([]byte("secret"))
+			if err != nil {
+				t.Fatalf("unhideAvps(): %v", err)
+			}
+
+			got, err := findProxyLCP(v2msg)
+			if err != nil {
+				t.Fatalf("findProxyLCP(): %v", err)
+			}
+			if !reflect.DeepEqual(got, c.proxy) {
+				t.Errorf("expected %+v, got %+v", c.proxy, got)
+			}
+		})
+	}
+}
+
+func TestV2ProxyAuthIDEncoding(t *testing.T) {
+	// The Proxy Authen ID AVP is sent for CHAP and MS-CHAPv1 only,
+	// with a reserved first octet per RFC2661 section 4.4.5
+	for _, authType := range []ProxyAuthType{ProxyAuthTypeText, ProxyAuthTypeCHAP, ProxyAuthTypePAP, ProxyAuthTypeMSCHAPv1} {
+		in := proxyLCPAvps(&ProxyLCP{AuthType: authType, AuthID: 0x42})
+		var id []byte
+		for _, i := range in {
+			if i.typ == avpTypeProxyAuthID {
+				id = i.data.([]byte)
+			}
+		}
+		expectID := authType == ProxyAuthTypeCHAP || authType == ProxyAuthTypeMSCHAPv1
+		if expectID && !bytes.Equal(id, []byte{0, 0x42}) {
+			t.Errorf("auth type %v: expected Proxy Authen ID [0 0x42], got %v", authType, id)
+		} else if !expectID && id != nil {
+			t.Errorf("auth type %v: unexpected Proxy Authen ID %v", authType, id)
+		}
+	}
+
+	msg, err := buildV2Msg(90, 24, []avpIn{
+		{avpTypeMessage, avpMsgTypeIccn},
+		{avpTypeProxyAuthID, []byte{0x42}},
+	})
+	if err != nil {
+		t.Fatalf("buildV2Msg(): %v", err)
+	}
+	_, err = findProxyLCP(msg)
+	if err == nil {
+		t.Errorf("findProxyLCP() with short Proxy Authen ID succeeded when we expected an error")
+	}
+}
+
+func TestV2SliRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		accm ACCM
+	}{
+		{name: "default", accm: ACCM{Send: 0xffffffff, Recv: 0xffffffff}},
+		{name: "none", accm: ACCM{}},
+		{name: "asymmetric", accm: ACCM{Send: 0x000a0000, Recv: 0x00000011}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scfg := SessionConfig{
+				SessionID:     42,
+				PeerSessionID: 24,
+			}
+			msg, err := newV2Sli(90, &scfg, &c.accm)
+			if err != nil {
+				t.Fatalf("newV2Sli(): %v", err)
+			}
+			err = msg.validate()
+			if err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			b, err := msg.toBytes()
+			if err != nil {
+				t.Fatalf("toBytes(): %v", err)
+			}
+			parsed, err := parseMessageBuffer(b)
+			if err != nil {
+				t.Fatalf("parseMessageBuffer(): %v", err)
+			}
+			v2msg := parsed[0].(*v2ControlMessage)
+			if v2msg.getType() != avpMsgTypeSli {
+				t.Fatalf("expected message type %v, got %v", avpMsgTypeSli, v2msg.getType())
+			}
+			if v2msg.Tid() != 90 || v2msg.Sid() != 24 {
+				t.Errorf("expected header IDs 90/24, got %v/%v", v2msg.Tid(), v2msg.Sid())
+			}
+			err = v2msg.validate()
+			if err != nil {
+				t.Fatalf("validate parsed message: %v", err)
+			}
+
+			got, err := findACCM(v2msg)
+			if err != nil {
+				t.Fatalf("findACCM(): %v", err)
+			}
+			if got == nil || *got != c.accm {
+				t.Errorf("expected %+v, got %+v", c.accm, got)
+			}
+		})
+	}
+}
+
+func TestACCMEncoding(t *testing.T) {
+	// Ref: RFC2661 section 4.4.6: a reserved 16 bit field followed by
+	// the send and receive maps
+	b := encodeACCM(&ACCM{Send: 0x01020304, Recv: 0xa0b0c0d0})
+	expect := []byte{0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xa0, 0xb0, 0xc0, 0xd0}
+	if !bytes.Equal(b, expect) {
+		t.Errorf("encodeACCM(): expected %v, got %v", expect, b)
+	}
+
+	for _, bad := range [][]byte{nil, expect[:9], append(expect, 0)} {
+		_, err := decodeACCM(bad)
+		if err == nil {
+			t.Errorf("decodeACCM(%v) succeeded when we expected an error", bad)
+		}
+	}
+
+	// An SLI without the mandatory ACCM AVP fails validation
+	msg, err := buildV2Msg(90, 24, []avpIn{
+		{avpTypeMessage, avpMsgTypeSli},
+	})
+	if err != nil {
+		t.Fatalf("buildV2Msg(): %v", err)
+	}
+	if msg.validate() == nil {
+		t.Errorf("validate() of SLI without ACCM succeeded when we expected an error")
+	}
+	got, err := findACCM(msg)
+	if err != nil || got != nil {
+		t.Errorf("findACCM(): expected nil, nil, got %v, %v", got, err)
+	}
+
+	// A malformed ACCM AVP is reported
+	msg, err = buildV2Msg(90, 24, []avpIn{
+		{avpTypeMessage, avpMsgTypeSli},
+		{avpTypeAccm, []byte{0x00, 0x00, 0xff}},
+	})
+	if err != nil {
+		t.Fatalf("buildV2Msg(): %v", err)
+	}
+	_, err = findACCM(msg)
+	if err == nil {
+		t.Errorf("findACCM() with short ACCM succeeded when we expected an error")
+	}
+}
+
+// v3RoundTrip encodes a message, parses the result, and validates the
+// parsed message
+func v3RoundTrip(t *testing.T, msg *v3ControlMessage) *v3ControlMessage {
+	t.Helper()
+	err := msg.validate()
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	b, err := msg.toBytes()
+	if err != nil {
+		t.Fatalf("toBytes(): %v", err)
+	}
+	parsed, err := parseMessageBuffer(b)
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(): %v", err)
+	}
+	if len(parsed) != 1 {
+		t.Fatalf("parseMessageBuffer(): wanted 1 message, got %d", len(parsed))
+	}
+	v3msg, ok := parsed[0].(*v3ControlMessage)
+	if !ok {
+		t.Fatalf("parseMessageBuffer(): expected v3 message, got %T", parsed[0])
+	}
+	err = v3msg.validate()
+	if err != nil {
+		t.Fatalf("validate parsed message: %v", err)
+	}
+	return v3msg
+}
+
+func TestV3TunnelMsgRoundTrip(t *testing.T) {
+	tcfg := &TunnelConfig{
+		Version:      ProtocolVersion3,
+		HostName:     "test",
+		TunnelID:     0x12345678,
+		PeerTunnelID: 0x9abcdef0,
+	}
+	cases := []struct {
+		name       string
+		build      func() (*v3ControlMessage, error)
+		expectType avpMsgType
+		expectCcid uint32
+		expectPtid ControlConnID
+	}{
+		{
+			name:       "SCCRQ",
+			build:      func() (*v3ControlMessage, error) { return newV3Sccrq(tcfg) },
+			expectType: avpMsgTypeSccrq,
+			expectCcid: 0,
+			expectPtid: 0x12345678,
+		},
+		{
+			name:       "SCCRP",
+			build:      func() (*v3ControlMessage, error) { return newV3Sccrp(tcfg) },
+			expectType: avpMsgTypeSccrp,
+			expectCcid: 0x9abcdef0,
+			expectPtid: 0x12345678,
+		},
+		{
+			name:       "SCCCN",
+			build:      func() (*v3ControlMessage, error) { return newV3Scccn(tcfg) },
+			expectType: avpMsgTypeScccn,
+			expectCcid: 0x9abcdef0,
+		},
+		{
+			name: "StopCCN",
+			build: func() (*v3ControlMessage, error) {
+				return newV3Stopccn(&resultCode{result: avpStopCCNResultCodeClearConnection}, tcfg)
+			},
+			expectType: avpMsgTypeStopccn,
+			expectCcid: 0x9abcdef0,
+			expectPtid: 0x12345678,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := c.build()
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+			got := v3RoundTrip(t, msg)
+			if got.getType() != c.expectType {
+				t.Errorf("expected message type %v, got %v", c.expectType, got.getType())
+			}
+			if got.ControlConnectionID() != c.expectCcid {
+				t.Errorf("expected control connection ID %#x, got %#x", c.expectCcid, got.ControlConnectionID())
+			}
+			ptid, err := findPeerTunnelID(got)
+			if c.expectPtid == 0 {
+				if err == nil {
+					t.Errorf("unexpected Assigned Control Connection ID AVP %#x", ptid)
+				}
+			} else if err != nil {
+				t.Errorf("findPeerTunnelID(): %v", err)
+			} else if ptid != c.expectPtid {
+				t.Errorf("expected assigned control connection ID %#x, got %#x", c.expectPtid, ptid)
+			}
+			if c.expectType == avpMsgTypeSccrq || c.expectType == avpMsgTypeSccrp {
+				b, err := findBytesAvp(got.getAvps(), vendorIDIetf, avpTypePseudowireCaps)
+				if err != nil {
+					t.Fatalf("no Pseudowire Capabilities List AVP: %v", err)
+				}
+				caps, err := decodePseudowireCaps(b)
+				if err != nil {
+					t.Fatalf("decodePseudowireCaps(): %v", err)
+				}
+				if !reflect.DeepEqual(caps, v3PseudowireCaps) {
+					t.Errorf("expected pseudowire capabilities %v, got %v", v3PseudowireCaps, caps)
+				}
+			}
+		})
+	}
+}
+
+func TestV3SessionMsgRoundTrip(t *testing.T) {
+	const ptid = ControlConnID(0x9abcdef0)
+	scfg := &SessionConfig{
+		Pseudowire:    PseudowireTypeEth,
+		SessionID:     0x11223344,
+		PeerSessionID: 0x55667788,
+		Cookie:        []byte{0xde, 0xad, 0xbe, 0xef},
+	}
+	cases := []struct {
+		name         string
+		build        func() (*v3ControlMessage, error)
+		expectType   avpMsgType
+		expectLocal  ControlConnID
+		expectRemote ControlConnID
+		expectCookie []byte
+	}{
+		{
+			name:         "ICRQ",
+			build:        func() (*v3ControlMessage, error) { return newV3Icrq(42, ptid, scfg) },
+			expectType:   avpMsgTypeIcrq,
+			expectLocal:  0x11223344,
+			expectRemote: 0,
+			expectCookie: scfg.Cookie,
+		},
+		{
+			name:         "ICRP",
+			build:        func() (*v3ControlMessage, error) { return newV3Icrp(ptid, scfg) },
+			expectType:   avpMsgTypeIcrp,
+			expectLocal:  0x11223344,
+			expectRemote: 0x55667788,
+			expectCookie: scfg.Cookie,
+		},
+		{
+			name:         "ICCN",
+			build:        func() (*v3ControlMessage, error) { return newV3Iccn(ptid, scfg) },
+			expectType:   avpMsgTypeIccn,
+			expectLocal:  0x11223344,
+			expectRemote: 0x55667788,
+		},
+		{
+			name: "CDN",
+			build: func() (*v3ControlMessage, error) {
+				return newV3Cdn(ptid, &resultCode{result: avpCDNResultCodeAdminDisconnect}, scfg)
+			},
+			expectType:   avpMsgTypeCdn,
+			expectLocal:  0x11223344,
+			expectRemote: 0x55667788,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := c.build()
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+			got := v3RoundTrip(t, msg)
+			if got.getType() != c.expectType {
+				t.Errorf("expected message type %v, got %v", c.expectType, got.getType())
+			}
+			if got.ControlConnectionID() != uint32(ptid) {
+				t.Errorf("expected control connection ID %#x, got %#x", ptid, got.ControlConnectionID())
+			}
+			// The sender's Local Session ID is the receiver's peer session
+			// ID, and vice versa for the Remote Session ID
+			psid, err := findPeerSessionID(got)
+			if err != nil || psid != c.expectLocal {
+				t.Errorf("expected local session ID %#x, got %#x (%v)", c.expectLocal, psid, err)
+			}
+			sid, err := findLocalSessionID(got)
+			if err != nil || sid != c.expectRemote {
+				t.Errorf("expected remote session ID %#x, got %#x (%v)", c.expectRemote, sid, err)
+			}
+			cookie, err := findBytesAvp(got.getAvps(), vendorIDIetf, avpTypeAssignedCookie)
+			if c.expectCookie == nil {
+				if err == nil {
+					t.Errorf("unexpected Assigned Cookie AVP %v", cookie)
+				}
+			} else if !bytes.Equal(cookie, c.expectCookie) {
+				t.Errorf("expected cookie %v, got %v (%v)", c.expectCookie, cookie, err)
+			}
+		})
+	}
+}
+
+func TestV3RouterID(t *testing.T) {
+	cases := []struct {
+		name   string
+		cfg    TunnelConfig
+		expect uint32
+	}{
+		{
+			name:   "default",
+			cfg:    TunnelConfig{Version: ProtocolVersion3, TunnelID: 42},
+			expect: 42,
+		},
+		{
+			name:   "configured",
+			cfg:    TunnelConfig{Version: ProtocolVersion3, TunnelID: 42, RouterID: 0xc0a80001},
+			expect: 0xc0a80001,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			builders := []func(cfg *TunnelConfig) (*v3ControlMessage, error){newV3Sccrq, newV3Sccrp}
+			for _, build := range builders {
+				msg, err := build(&c.cfg)
+				if err != nil {
+					t.Fatalf("build: %v", err)
+				}
+				got := v3RoundTrip(t, msg)
+				id, err := findUint32Avp(got.getAvps(), vendorIDIetf, avpTypeRouterID)
+				if err != nil {
+					t.Fatalf("%v: no Router ID AVP: %v", got.getType(), err)
+				}
+				if id != c.expect {
+					t.Errorf("%v: expected router ID %#x, got %#x", got.getType(), c.expect, id)
+				}
+			}
+		})
+	}
+}
+
+func TestV3RemoteEndID(t *testing.T) {
+	cases := []struct {
+		name   string
+		id     []byte
+		expect []byte
+	}{
+		{
+			name:   "default",
+			expect: []byte{},
+		},
+		{
+			name:   "configured",
+			id:     []byte("pw-0042"),
+			expect: []byte("pw-0042"),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := newV3Icrq(1, 24, &SessionConfig{
+				Pseudowire:  PseudowireTypeEth,
+				SessionID:   10,
+				RemoteEndID: c.id,
+			})
+			if err != nil {
+				t.Fatalf("newV3Icrq(): %v", err)
+			}
+			got := v3RoundTrip(t, msg)
+			id, err := findBytesAvp(got.getAvps(), vendorIDIetf, avpTypeRemoteEndID)
+			if err != nil {
+				t.Fatalf("no Remote End ID AVP: %v", err)
+			}
+			if !bytes.Equal(id, c.expect) {
+				t.Errorf("expected remote end ID %q, got %q", c.expect, id)
+			}
+		})
+	}
+}
+
+func TestPseudowireCapsEncoding(t *testing.T) {
+	// Ref: RFC3931 section 5.4.3: a list of 16 bit pseudowire types
+	b := encodePseudowireCaps([]PseudowireType{PseudowireTypePPP, PseudowireTypeEth})
+	expect := []byte{0x00, 0x07, 0x00, 0x05}
+	if !bytes.Equal(b, expect) {
+		t.Errorf("encodePseudowireCaps(): expected %v, got %v", expect, b)
+	}
+
+	caps, err := decodePseudowireCaps(b)
+	if err != nil {
+		t.Fatalf("decodePseudowireCaps(): %v", err)
+	}
+	if !reflect.DeepEqual(caps, []PseudowireType{PseudowireTypePPP, PseudowireTypeEth}) {
+		t.Errorf("decodePseudowireCaps(): expected %v, got %v", []PseudowireType{PseudowireTypePPP, PseudowireTypeEth}, caps)
+	}
+
+	caps, err = decodePseudowireCaps(nil)
+	if err != nil || len(caps) != 0 {
+		t.Errorf("decodePseudowireCaps(nil): expected empty list, got %v, %v", caps, err)
+	}
+
+	_, err = decodePseudowireCaps(expect[:3])
+	if err == nil {
+		t.Errorf("decodePseudowireCaps(%v) succeeded when we expected an error", expect[:3])
+	}
+}
+
+func TestCapabilityStringer(t *testing.T) {
+	cases := []struct {
+		in   fmt.Stringer
+		want string
+	}{
+		{FramingCapability(0), "none"},
+		{FramingCapability(FramingCapSync), "sync"},
+		{FramingCapability(FramingCapSync | FramingCapAsync), "sync|async"},
+		{BearerCapability(0), "none"},
+		{BearerCapability(BearerCapAnalog), "analog"},
+		{BearerCapability(BearerCapDigital | BearerCapAnalog), "digital|analog"},
+	}
+	for _, c := range cases {
+		if got := c.in.String(); got != c.want {
+			t.Errorf("expected %q, got %q", c.want, got)
+		}
+	}
+}
+
+func FuzzParseControlMessage(f *testing.F) {
+	tcfg := &TunnelConfig{
+		Version:      ProtocolVersion2,
+		TunnelID:     42,
+		PeerTunnelID: 24,
+		HostName:     "fuzz.local",
+		FramingCaps:  FramingCapSync | FramingCapAsync,
+		WindowSize:   4,
+	}
+	scfg := &SessionConfig{SessionID: 1, PeerSessionID: 2, Pseudowire: PseudowireTypePPP}
+	v3cfg := *tcfg
+	v3cfg.Version = ProtocolVersion3
+	v3scfg := *scfg
+	v3scfg.Pseudowire = PseudowireTypeEth
+
+	seeds := []func() (controlMessage, error){
+		func() (controlMessage, error) { return newV2Sccrq(tcfg) },
+		func() (controlMessage, error) { return newV2Hello(tcfg) },
+		func() (controlMessage, error) {
+			return newV2Stopccn(&resultCode{avpStopCCNResultCodeGeneralError, avpErrorCodeNoError, "fuzz"}, tcfg)
+		},
+		func() (controlMessage, error) { return newV2Icrq(1, 24, scfg) },
+		func() (controlMessage, error) { return newV3Sccrq(&v3cfg) },
+		func() (controlMessage, error) { return newV3Icrq(1, 24, &v3scfg) },
+	}
+	for _, mk := range seeds {
+		msg, err := mk()
+		if err != nil {
+			f.Fatalf("failed to build seed message: %v", err)
+		}
+		b, err := msg.toBytes()
+		if err != nil {
+			f.Fatalf("failed to encode seed message: %v", err)
+		}
+		f.Add(b)
+	}
+	// A v2 ZLB ack
+	f.Add([]byte{0xc8, 0x02, 0x00, 0x0c, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msgs, err := parseMessageBuffer(b)
+		if err != nil {
+			if msgs != nil {
+				t.Errorf("parseMessageBuffer() returned messages with error %v", err)
+			}
+			return
+		}
+		for _, msg := range msgs {
+			_ = msg.getType()
+			_ = msg.validate()
+			for i := range msg.getAvps() {
+				a := &msg.getAvps()[i]
+				_, _ = a.decode()
+				if a.isHidden() {
+					_, _ = unhideAvp(a, []byte("secret"), []byte{1, 2, 3, 4})
+				}
+			}
+			_, _ = findPeerTunnelID(msg)
+			_, _ = findLocalSessionID(msg)
+			_, _ = msg.toBytes()
+		}
+	})
+}
+
+// testVendorID and testVendorAVPType identify a fake vendor AVP carrying
+// a testVendorInfo value.
+const (
+	testVendorID      = 0xfde8
+	testVendorAVPType = 7
+)
+
+type testVendorInfo struct {
+	Level uint16
+	Name  string
+}
+
+var registerTestVendorAVPOnce sync.Once
+
+// registerTestVendorAVP registers the fake vendor AVP.  The registry is
+// global, so registration is done once for all tests.
+func registerTestVendorAVP(t *testing.T) {
+	registerTestVendorAVPOnce.Do(func() {
+		err := RegisterVendorAVP(testVendorID, testVendorAVPType, VendorAVPCodec{
+			Encode: func(v interface{}) ([]byte, error) {
+				info, ok := v.(testVendorInfo)
+				if !ok {
+					return nil, fmt.Errorf("unexpected value type %T", v)
+				}
+				b := make([]byte, 2, 2+len(info.Name))
+				binary.BigEndian.PutUint16(b, info.Level)
+				return append(b, info.Name...), nil
+			},
+			Decode: func(b []byte) (interface{}, error) {
+				if len(b) < 2 {
+					return nil, fmt.Errorf("value length %d too short", len(b))
+				}
+				return testVendorInfo{Level: binary.BigEndian.Uint16(b), Name: string(b[2:])}, nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("RegisterVendorAVP(): %v", err)
+		}
+	})
+}
+
+func TestRegisterVendorAVP(t *testing.T) {
+	registerTestVendorAVP(t)
+
+	codec := VendorAVPCodec{
+		Encode: func(v interface{}) ([]byte, error) { return nil, nil },
+		Decode: func(b []byte) (interface{}, error) { return nil, nil },
+	}
+	cases := []struct {
+		name     string
+		vendorID uint16
+		avpType  uint16
+		codec    VendorAVPCodec
+		estr     string
+	}{
+		{"IETF", vendorIDIetf, 200, codec, "IETF vendor ID"},
+		{"incomplete codec", testVendorID, 200, VendorAVPCodec{Encode: codec.Encode}, "must implement Encode and Decode"},
+		{"duplicate", testVendorID, testVendorAVPType, codec, "already registered"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := RegisterVendorAVP(c.vendorID, c.avpType, c.codec)
+			if err == nil || !strings.Contains(err.Error(), c.estr) {
+				t.Errorf("expected error containing %q, got %v", c.estr, err)
+			}
+		})
+	}
+}
+
+func TestVendorAVPRoundTrip(t *testing.T) {
+	registerTestVendorAVP(t)
+
+	want := testVendorInfo{Level: 3, Name: "gold"}
+	cfg := &TunnelConfig{
+		TunnelID:    42,
+		HostName:    "lac",
+		FramingCaps: FramingCapSync,
+		VendorAVPs: []VendorAVP{
+			{VendorID: testVendorID, Type: testVendorAVPType, Mandatory: true, Value: want},
+		},
+	}
+
+	msg, err := newV2Sccrq(cfg)
+	if err != nil {
+		t.Fatalf("newV2Sccrq(): %v", err)
+	}
+	err = appendVendorAvps(msg, cfg.VendorAVPs)
+	if err != nil {
+		t.Fatalf("appendVendorAvps(): %v", err)
+	}
+	err = msg.validate()
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	b, err := msg.toBytes()
+	if err != nil {
+		t.Fatalf("toBytes(): %v", err)
+	}
+
+	// A registered mandatory AVP is recognised, so doesn't require the
+	// tunnel to be torn down.
+	parsed, err := parseMessageBuffer(b)
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(): %v", err)
+	}
+	if a := findUnrecognisedMandatoryAvp(parsed[0].getAvps()); a != nil {
+		t.Errorf("registered AVP reported as unrecognised: %v", a)
+	}
+	got, err := findVendorAvps(parsed[0].getAvps())
+	if err != nil {
+		t.Fatalf("findVendorAvps(): %v", err)
+	}
+	if !reflect.DeepEqual(got, cfg.VendorAVPs) {
+		t.Errorf("findVendorAvps(): expected %+v, got %+v", cfg.VendorAVPs, got)
+	}
+
+	raw, err := ParseRawControlMessages(b)
+	if err != nil {
+		t.Fatalf("ParseRawControlMessages(): %v", err)
+	}
+	ra, ok := raw[0].FindAVP(testVendorID, testVendorAVPType)
+	if !ok {
+		t.Fatalf("FindAVP(): vendor AVP not found")
+	}
+	v, err := ra.Decode()
+	if err != nil {
+		t.Fatalf("Decode(): %v", err)
+	}
+	if info, ok := v.(testVendorInfo); !ok || info != want {
+		t.Errorf("Decode(): expected %+v, got %+v", want, v)
+	}
+
+	// IETF and unregistered AVPs can't be decoded
+	ra, _ = raw[0].FindAVP(vendorIDIetf, uint16(avpTypeHostName))
+	if _, err = ra.Decode(); err == nil {
+		t.Errorf("Decode() of IETF AVP succeeded")
+	}
+}
+
+func TestVendorAVPConfig(t *testing.T) {
+	registerTestVendorAVP(t)
+
+	cases := []struct {
+		name string
+		tt   TunnelType
+		avps []VendorAVP
+		estr string
+	}{
+		{
+			name: "unregistered",
+			tt:   TunnelTypeDynamic,
+			avps: []VendorAVP{{VendorID: testVendorID, Type: testVendorAVPType + 1}},
+			estr: "no codec registered",
+		},
+		{
+			name: "bad value",
+			tt:   TunnelTypeDynamic,
+			avps: []VendorAVP{{VendorID: testVendorID, Type: testVendorAVPType, Value: "gold"}},
+			estr: "unexpected value type string",
+		},
+		{
+			name: "quiescent tunnel",
+			tt:   TunnelTypeAcquiescent,
+			avps: []VendorAVP{{VendorID: testVendorID, Type: testVendorAVPType, Value: testVendorInfo{}}},
+			estr: "supported for dynamic tunnels only",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateTunnelConfig(c.tt, &TunnelConfig{
+				Version:    ProtocolVersion2,
+				Encap:      EncapTypeUDP,
+				Peer:       "127.0.0.1:5000",
+				VendorAVPs: c.avps,
+			})
+			if err == nil || !strings.Contains(err.Error(), c.estr) {
+				t.Errorf("expected error containing %q, got %v", c.estr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package l2tp
+
+// defaultPathMTU is the path MTU assumed when the tunnel's path MTU is
+// not available.
+const defaultPathMTU = 1500
+
+// Data packet overheads, in bytes.
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+	// Ref: RFC2661 section 3.1.  The kernel omits the optional Length,
+	// Offset Size, and Offset Pad fields.
+	v2DataHeaderLen    = 6
+	v2DataHeaderSeqLen = 4
+	// Ref: RFC3931 section 4.1.2.1 and section 4.1.1.
+	v3UDPDataHeaderLen = 8
+	v3IPDataHeaderLen  = 4
+	// Ref: RFC4719 section 3.2.
+	v3DefaultL2SpecLen = 4
+	// Ref: RFC1661 section 2 and RFC1662 section 3.1.  PPP frames
+	// carried over L2TP include the address and control fields.
+	pppHeaderLen = 4
+)
+
+// dataMTU computes the largest payload a session can carry in a data
+// packet without fragmentation given the tunnel's path MTU.
+func dataMTU(pathMTU int, ipv6 bool, tcfg *TunnelConfig, scfg *SessionConfig) int {
+	overhead := ipv4HeaderLen
+	if ipv6 {
+		overhead = ipv6HeaderLen
+	}
+
+	if tcfg.Encap == EncapTypeUDP {
+		overhead += udpHeaderLen
+	}
+
+	if tcfg.Version == ProtocolVersion2 {
+		overhead += v2DataHeaderLen
+		if scfg.SeqNum {
+			overhead += v2DataHeaderSeqLen
+		}
+	} else {
+		if tcfg.Encap == EncapTypeUDP {
+			overhead += v3UDPDataHeaderLen
+		} else {
+			overhead += v3IPDataHeaderLen
+		}
+		overhead += len(scfg.Cookie)
+		if scfg.L2SpecType == L2SpecTypeDefault {
+			overhead += v3DefaultL2SpecLen
+		}
+	}
+
+	if pathMTU <= overhead {
+		return 0
+	}
+	return pathMTU - overhead
+}
+
+// pppMRU computes the largest PPP MRU which fits in a data packet
+// carrying dataMTU bytes of payload.
+func pppMRU(dataMTU int) int {
+	if dataMTU <= pppHeaderLen {
+		return 0
+	}
+	return dataMTU - pppHeaderLen
+}
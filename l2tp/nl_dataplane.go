@@ -2,6 +2,9 @@ package l2tp
 
 import (
 	"fmt"
+	"net"
+	"strconv"
+	"time"
 
 	"github.com/katalix/go-l2tp/internal/nll2tp"
 	"golang.org/x/sys/unix"
@@ -10,6 +13,7 @@ import (
 var _ DataPlane = (*nlDataPlane)(nil)
 var _ TunnelDataPlane = (*nlTunnelDataPlane)(nil)
 var _ SessionDataPlane = (*nlSessionDataPlane)(nil)
+var _ adoptingDataPlane = (*nlDataPlane)(nil)
 
 type nlDataPlane struct {
 	nlconn *nll2tp.Conn
@@ -24,6 +28,7 @@ type nlSessionDataPlane struct {
 	f             *nlDataPlane
 	cfg           *nll2tp.SessionConfig
 	interfaceName string
+	bridge        string
 }
 
 func sockaddrAddrPort(sa unix.Sockaddr) (addr []byte, port uint16, err error) {
@@ -41,13 +46,17 @@ func sockaddrAddrPort(sa unix.Sockaddr) (addr []byte, port uint16, err error) {
 }
 
 func tunnelCfgToNl(cfg *TunnelConfig) (*nll2tp.TunnelConfig, error) {
-	// TODO: facilitate kernel level debug
+	// The kernel ignores the IPv4 checksum attribute for IPv6 tunnels,
+	// and vice versa, so there's no need to check the address family here.
 	return &nll2tp.TunnelConfig{
-		Tid:        nll2tp.L2tpTunnelID(cfg.TunnelID),
-		Ptid:       nll2tp.L2tpTunnelID(cfg.PeerTunnelID),
-		Version:    nll2tp.L2tpProtocolVersion(cfg.Version),
-		Encap:      nll2tp.L2tpEncapType(cfg.Encap),
-		DebugFlags: nll2tp.L2tpDebugFlags(0)}, nil
+		Tid:            nll2tp.L2tpTunnelID(cfg.TunnelID),
+		Ptid:           nll2tp.L2tpTunnelID(cfg.PeerTunnelID),
+		Version:        nll2tp.L2tpProtocolVersion(cfg.Version),
+		Encap:          nll2tp.L2tpEncapType(cfg.Encap),
+		DebugFlags:     nll2tp.L2tpDebugFlags(cfg.DebugFlags),
+		UDPCsum:        cfg.UDPChecksum == UDPChecksumEnabled,
+		UDPZeroCsum6Tx: cfg.UDPChecksum == UDPChecksumDisabled,
+		UDPZeroCsum6Rx: cfg.UDPChecksum == UDPChecksumDisabled}, nil
 }
 
 func sessionCfgToNl(tid, ptid ControlConnID, cfg *SessionConfig) (*nll2tp.SessionConfig, error) {
@@ -60,7 +69,6 @@ func sessionCfgToNl(tid, ptid ControlConnID, cfg *SessionConfig) (*nll2tp.Sessio
 		pwtype = nll2tp.PwtypePpp
 	}
 
-	// TODO: facilitate kernel level debug
 	// TODO: IsLNS defaulting to false allows the peer to decide,
 	// not sure whether this is a good idea or not really.
 	return &nll2tp.SessionConfig{
@@ -77,7 +85,7 @@ func sessionCfgToNl(tid, ptid ControlConnID, cfg *SessionConfig) (*nll2tp.Sessio
 		PeerCookie:     cfg.PeerCookie,
 		IfName:         cfg.InterfaceName,
 		L2SpecType:     nll2tp.L2tpL2specType(cfg.L2SpecType),
-		DebugFlags:     nll2tp.L2tpDebugFlags(0),
+		DebugFlags:     nll2tp.L2tpDebugFlags(cfg.DebugFlags),
 	}, nil
 }
 
@@ -121,11 +129,146 @@ func (dpf *nlDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig)
 		return nil, fmt.Errorf("failed to convert session config for netlink use: %v", err)
 	}
 
+	// The kernel's error for a name collision is an opaque EEXIST
+	err = checkInterfaceNameFree(scfg.InterfaceName)
+	if err != nil {
+		return nil, err
+	}
+
 	err = dpf.nlconn.CreateSession(nlcfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to instantiate session via. netlink: %v", err)
 	}
-	return &nlSessionDataPlane{f: dpf, cfg: nlcfg}, nil
+	sdp := &nlSessionDataPlane{f: dpf, cfg: nlcfg}
+
+	if scfg.Pseudowire == PseudowireTypeEth &&
+		(scfg.MTU > 0 || scfg.Bridge != "" || scfg.Address != "" || scfg.AdminUp) {
+		err = sdp.configureInterface(scfg)
+		if err != nil {
+			_ = dpf.nlconn.DeleteSession(nlcfg)
+			return nil, err
+		}
+	}
+	return sdp, nil
+}
+
+// configureInterface applies the interface options of an Ethernet
+// pseudowire session to the interface created by the kernel.
+func (sdp *nlSessionDataPlane) configureInterface(scfg *SessionConfig) error {
+	ifname, err := sdp.GetInterfaceName()
+	if err != nil {
+		return fmt.Errorf("failed to obtain session interface name: %v", err)
+	}
+	err = configureEthInterface(ifname, scfg)
+	if err != nil {
+		return err
+	}
+	sdp.bridge = scfg.Bridge
+	return nil
+}
+
+func (dpf *nlDataPlane) exportTunnels() ([]*TunnelState, error) {
+	tunnels, err := dpf.nlconn.DumpTunnels()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump tunnels via. netlink: %v", err)
+	}
+	sessions, err := dpf.nlconn.DumpSessions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump sessions via. netlink: %v", err)
+	}
+	return tunnelStatesFromNl(tunnels, sessions), nil
+}
+
+func (dpf *nlDataPlane) adoptTunnel(tcfg *TunnelConfig) (TunnelDataPlane, error) {
+	nlcfg, err := tunnelCfgToNl(tcfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert tunnel config for netlink use: %v", err)
+	}
+	return &nlTunnelDataPlane{f: dpf, cfg: nlcfg}, nil
+}
+
+func (dpf *nlDataPlane) adoptSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	nlcfg, err := sessionCfgToNl(tid, ptid, scfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert session config for netlink use: %v", err)
+	}
+	return &nlSessionDataPlane{f: dpf, cfg: nlcfg, interfaceName: scfg.InterfaceName}, nil
+}
+
+// tunnelStatesFromNl converts the results of netlink tunnel and session
+// dumps to tunnel state, grouping each session with its parent tunnel.
+// Sessions whose tunnel is missing from the tunnel dump are ignored.
+func tunnelStatesFromNl(tunnels []*nll2tp.TunnelInfo, sessions []*nll2tp.SessionInfo) []*TunnelState {
+	states := []*TunnelState{}
+	byID := make(map[nll2tp.L2tpTunnelID]*TunnelState)
+	for _, info := range tunnels {
+		state := &TunnelState{
+			Name:     fmt.Sprintf("tunnel%v", info.Tid),
+			Config:   tunnelInfoToCfg(info),
+			Sessions: []*SessionState{},
+		}
+		states = append(states, state)
+		byID[info.Tid] = state
+	}
+	for _, info := range sessions {
+		state, ok := byID[info.Tid]
+		if !ok {
+			continue
+		}
+		state.Sessions = append(state.Sessions, &SessionState{
+			Name:   fmt.Sprintf("session%v", info.Sid),
+			Config: sessionInfoToCfg(info),
+		})
+	}
+	return states
+}
+
+func tunnelInfoToCfg(info *nll2tp.TunnelInfo) *TunnelConfig {
+	cfg := &TunnelConfig{
+		TunnelID:     ControlConnID(info.Tid),
+		PeerTunnelID: ControlConnID(info.Ptid),
+		Version:      ProtocolVersion(info.Version),
+		Encap:        EncapType(info.Encap),
+		DebugFlags:   DebugFlags(info.DebugFlags),
+	}
+	if info.UDPCsum {
+		cfg.UDPChecksum = UDPChecksumEnabled
+	} else if info.UDPZeroCsum6Tx {
+		cfg.UDPChecksum = UDPChecksumDisabled
+	}
+	cfg.Local = nlAddressString(cfg.Encap, info.LocalAddr, info.LocalPort)
+	cfg.Peer = nlAddressString(cfg.Encap, info.PeerAddr, info.PeerPort)
+	return cfg
+}
+
+// nlAddressString returns a tunnel address reported by the kernel in
+// the form accepted by the Local and Peer fields of TunnelConfig.
+func nlAddressString(encap EncapType, addr []byte, port uint16) string {
+	if len(addr) != net.IPv4len && len(addr) != net.IPv6len {
+		return ""
+	}
+	ip := net.IP(addr).String()
+	if encap == EncapTypeUDP {
+		return net.JoinHostPort(ip, strconv.Itoa(int(port)))
+	}
+	return ip
+}
+
+// sessionInfoToCfg converts session information reported by the kernel
+// to a session configuration.  The kernel doesn't report the Layer 2
+// specific sublayer type, which is left unset.
+func sessionInfoToCfg(info *nll2tp.SessionInfo) *SessionConfig {
+	return &SessionConfig{
+		SessionID:      ControlConnID(info.Sid),
+		PeerSessionID:  ControlConnID(info.Psid),
+		Pseudowire:     PseudowireType(info.PseudowireType),
+		SeqNum:         info.SendSeq,
+		ReorderTimeout: time.Duration(info.ReorderTimeout) * time.Millisecond,
+		Cookie:         info.LocalCookie,
+		PeerCookie:     info.PeerCookie,
+		InterfaceName:  info.IfName,
+		DebugFlags:     DebugFlags(info.DebugFlags),
+	}
 }
 
 func (dpf *nlDataPlane) Close() {
@@ -139,6 +282,17 @@ func (tdp *nlTunnelDataPlane) Down() error {
 	return tdp.f.nlconn.DeleteTunnel(tdp.cfg)
 }
 
+func (tdp *nlTunnelDataPlane) SetDebugFlags(flags DebugFlags) error {
+	nlcfg := *tdp.cfg
+	nlcfg.DebugFlags = nll2tp.L2tpDebugFlags(flags)
+	err := tdp.f.nlconn.ModifyTunnel(&nlcfg)
+	if err != nil {
+		return err
+	}
+	tdp.cfg = &nlcfg
+	return nil
+}
+
 func (sdp *nlSessionDataPlane) GetStatistics() (*SessionDataPlaneStatistics, error) {
 	info, err := sdp.f.nlconn.GetSessionInfo(sdp.cfg)
 	if err != nil {
@@ -151,6 +305,8 @@ func (sdp *nlSessionDataPlane) GetStatistics() (*SessionDataPlaneStatistics, err
 		RxPackets: info.Statistics.RxPacketCount,
 		RxBytes:   info.Statistics.RxBytes,
 		RxErrors:  info.Statistics.RxErrorCount,
+
+		RxCookieDiscards: info.Statistics.RxCookieDiscardCount,
 	}, nil
 }
 
@@ -165,8 +321,38 @@ func (sdp *nlSessionDataPlane) GetInterfaceName() (string, error) {
 	return sdp.interfaceName, nil
 }
 
+func (sdp *nlSessionDataPlane) Modify(cfg *SessionConfig) error {
+	nlcfg := *sdp.cfg
+	nlcfg.SendSeq = cfg.SeqNum
+	nlcfg.RecvSeq = cfg.SeqNum
+	nlcfg.ReorderTimeout = uint64(cfg.ReorderTimeout.Milliseconds())
+	nlcfg.DebugFlags = nll2tp.L2tpDebugFlags(cfg.DebugFlags)
+
+	err := sdp.f.nlconn.ModifySession(&nlcfg)
+	if err != nil {
+		return err
+	}
+	sdp.cfg = &nlcfg
+	return nil
+}
+
+func (sdp *nlSessionDataPlane) InterfaceDown() error {
+	ifname, err := sdp.GetInterfaceName()
+	if err != nil {
+		return err
+	}
+	return linkSetDown(ifname)
+}
+
 func (sdp *nlSessionDataPlane) Down() error {
-	return sdp.f.nlconn.DeleteSession(sdp.cfg)
+	var err error
+	if sdp.bridge != "" {
+		err = linkSetMaster(sdp.interfaceName, "")
+	}
+	if derr := sdp.f.nlconn.DeleteSession(sdp.cfg); derr != nil {
+		return derr
+	}
+	return err
 }
 
 func newNetlinkDataPlane() (DataPlane, error) {
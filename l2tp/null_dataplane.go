@@ -28,6 +28,10 @@ func (ndp *nullDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfi
 func (ndp *nullDataPlane) Close() {
 }
 
+func (tdp *nullTunnelDataPlane) SetDebugFlags(flags DebugFlags) error {
+	return nil
+}
+
 func (tdp *nullTunnelDataPlane) Down() error {
 	return nil
 }
@@ -36,6 +40,10 @@ func (sdp *nullSessionDataPlane) GetStatistics() (*SessionDataPlaneStatistics, e
 	return &SessionDataPlaneStatistics{}, nil
 }
 
+func (sdp *nullSessionDataPlane) Modify(cfg *SessionConfig) error {
+	return nil
+}
+
 func (sdp *nullSessionDataPlane) GetInterfaceName() (string, error) {
 	return "", nil
 }
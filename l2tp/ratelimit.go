@@ -0,0 +1,61 @@
+package l2tp
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket used to pace the creation of tunnel
+// and session instances.
+//
+// The bucket holds up to burst tokens, and is refilled at a rate of one
+// token per interval.  Callers which find the bucket empty reserve a
+// token in advance and sleep until it becomes available, so concurrent
+// callers are admitted in turn at the configured rate.
+type rateLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	burst    float64
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+	sleep    func(time.Duration)
+}
+
+func newRateLimiter(n int, per time.Duration) *rateLimiter {
+	return &rateLimiter{
+		interval: per / time.Duration(n),
+		burst:    float64(n),
+		tokens:   float64(n),
+		last:     time.Now(),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// reserve takes a token from the bucket, returning the time the caller
+// must wait for the token to become available.
+func (rl *rateLimiter) reserve() time.Duration {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := rl.now()
+	rl.tokens += float64(now.Sub(rl.last)) / float64(rl.interval)
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+
+	rl.tokens--
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens * float64(rl.interval))
+}
+
+// wait blocks until the caller is permitted to proceed.
+func (rl *rateLimiter) wait() {
+	if d := rl.reserve(); d > 0 {
+		rl.sleep(d)
+	}
+}
@@ -0,0 +1,169 @@
+package l2tp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+var _ ControlMessageWriter = (*dynamicTunnel)(nil)
+var _ ControlMessageWriter = (*quiescentTunnel)(nil)
+
+// RawAVP describes a single attribute value pair for transmission using
+// ControlMessageWriter.
+//
+// The AVP is encoded exactly as described: no checks are made on the
+// vendor ID, type, flags, or value.  In particular, AVPs flagged as hidden
+// are not obscured using the tunnel secret: the value is sent as supplied.
+type RawAVP struct {
+	VendorID  uint16
+	Type      uint16
+	Mandatory bool
+	Hidden    bool
+	Value     []byte
+}
+
+// RawControlMessage describes a control message for transmission using
+// ControlMessageWriter.
+type RawControlMessage struct {
+	// SessionID is the session ID to set in the L2TPv2 control message
+	// header.  It is ignored for L2TPv3 tunnels.
+	SessionID ControlConnID
+
+	// AVPs lists the AVPs of the message in transmission order.
+	// The first AVP must be a valid Message Type AVP, since the
+	// transport uses it to track the message.
+	// Subsequent AVPs may be malformed in any way.
+	AVPs []RawAVP
+}
+
+// ParseRawControlMessages parses a buffer of L2TP control message data,
+// as received from the network, into a slice of RawControlMessage.
+//
+// The AVPs of each message are returned exactly as they appear on the
+// wire.  In particular, the values of hidden AVPs are not recovered using
+// the tunnel secret, and no validation of the message AVPs is performed.
+// Unrecognised AVPs which are not flagged as mandatory are discarded as
+// required by RFC2661 section 4.1.
+func ParseRawControlMessages(b []byte) ([]RawControlMessage, error) {
+	msgs, err := parseMessageBuffer(b)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]RawControlMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		var rm RawControlMessage
+		if v2msg, ok := msg.(*v2ControlMessage); ok {
+			rm.SessionID = ControlConnID(v2msg.Sid())
+		}
+		for i := range msg.getAvps() {
+			a := &msg.getAvps()[i]
+			rm.AVPs = append(rm.AVPs, RawAVP{
+				VendorID:  uint16(a.vendorID()),
+				Type:      uint16(a.getType()),
+				Mandatory: a.isMandatory(),
+				Hidden:    a.isHidden(),
+				Value:     a.payload.data,
+			})
+		}
+		out = append(out, rm)
+	}
+	return out, nil
+}
+
+// FindAVP returns the first AVP in the message matching the specified
+// vendor ID and type.  The boolean return is false if no such AVP exists.
+func (m *RawControlMessage) FindAVP(vendorID, avpType uint16) (RawAVP, bool) {
+	for _, a := range m.AVPs {
+		if a.VendorID == vendorID && a.Type == avpType {
+			return a, true
+		}
+	}
+	return RawAVP{}, false
+}
+
+// AsUint16 returns the AVP value as a big-endian 16 bit unsigned integer.
+// An error is returned if the value is not exactly two octets long.
+func (a *RawAVP) AsUint16() (uint16, error) {
+	if len(a.Value) != 2 {
+		return 0, fmt.Errorf("AVP value length %d is not 2", len(a.Value))
+	}
+	return binary.BigEndian.Uint16(a.Value), nil
+}
+
+// AsUint32 returns the AVP value as a big-endian 32 bit unsigned integer.
+// An error is returned if the value is not exactly four octets long.
+func (a *RawAVP) AsUint32() (uint32, error) {
+	if len(a.Value) != 4 {
+		return 0, fmt.Errorf("AVP value length %d is not 4", len(a.Value))
+	}
+	return binary.BigEndian.Uint32(a.Value), nil
+}
+
+// AsString returns the AVP value as a string.
+func (a *RawAVP) AsString() string {
+	return string(a.Value)
+}
+
+// AsBytes returns a copy of the AVP value.
+func (a *RawAVP) AsBytes() []byte {
+	return append([]byte(nil), a.Value...)
+}
+
+// ControlMessageWriter is implemented by tunnels which run the L2TP
+// reliable transport, namely dynamic and quiescent tunnels.
+//
+// It allows arbitrary control messages to be sent to the peer, bypassing
+// both the tunnel and session state machines and control message
+// validation.  This is intended to support conformance testing and the
+// reproduction of interoperability problems, and is disabled unless the
+// parent Context was created using the WithUnsafeControlMessages option.
+//
+// WriteControlMessage blocks until the message has been acknowledged by
+// the peer, or the transport has given up retransmitting it.
+// It must not be called concurrently with the tunnel's Close method.
+type ControlMessageWriter interface {
+	WriteControlMessage(msg *RawControlMessage) error
+}
+
+func newRawControlMessage(version ProtocolVersion, ptid ControlConnID, in *RawControlMessage) (controlMessage, error) {
+	if in == nil {
+		return nil, fmt.Errorf("invalid nil message")
+	}
+	if len(in.AVPs) == 0 {
+		return nil, fmt.Errorf("message must contain at least one AVP")
+	}
+
+	var avps []avp
+	for i, ra := range in.AVPs {
+		if len(ra.Value)+avpHeaderLen > 0x3ff {
+			return nil, fmt.Errorf("AVP %d value length %d too long to encode", i, len(ra.Value))
+		}
+		a := avp{
+			header: *newAvpHeader(ra.Mandatory, ra.Hidden, uint(len(ra.Value)),
+				avpVendorID(ra.VendorID), avpType(ra.Type)),
+			payload: avpPayload{
+				dataType: avpDataTypeBytes,
+				data:     ra.Value,
+			},
+		}
+		if info, err := getAVPInfo(a.getType(), a.vendorID()); err == nil {
+			a.payload.dataType = info.dataType
+		}
+		avps = append(avps, a)
+	}
+
+	if avps[0].vendorID() != vendorIDIetf || avps[0].getType() != avpTypeMessage {
+		return nil, fmt.Errorf("first AVP must be a Message Type AVP")
+	}
+	if _, err := avps[0].decodeMsgType(); err != nil {
+		return nil, fmt.Errorf("bad Message Type AVP: %v", err)
+	}
+
+	switch version {
+	case ProtocolVersion2:
+		return newV2ControlMessage(ptid, in.SessionID, avps)
+	case ProtocolVersion3:
+		return newV3ControlMessage(ptid, avps)
+	}
+	return nil, fmt.Errorf("unhandled protocol version %v", version)
+}
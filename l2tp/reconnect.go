@@ -0,0 +1,264 @@
+package l2tp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	defaultReconnectMin = 1 * time.Second
+	defaultReconnectMax = 60 * time.Second
+)
+
+// persistedSession records the user's configuration for a session
+// in a persistent tunnel, so that it can be re-created along with
+// the tunnel.
+type persistedSession struct {
+	name string
+	cfg  *SessionConfig
+}
+
+// tunnelPersistence tracks the state required to re-create a
+// persistent dynamic tunnel.
+type tunnelPersistence struct {
+	cfg      *TunnelConfig
+	lock     sync.Mutex
+	sessions []persistedSession
+	frozen   bool
+}
+
+// tunnelReconnect tracks a pending attempt to re-create a persistent
+// tunnel.  It persists across failed attempts in order to compute the
+// backoff, and is discarded once the tunnel is re-established.
+type tunnelReconnect struct {
+	from     *dynamicTunnel
+	attempts uint
+	timer    *time.Timer
+}
+
+// reconnectDelay computes the backoff before a reconnect attempt.
+// The delay doubles with each attempt from the configured minimum up to
+// the configured maximum, and is jittered to between half and all of
+// that value.
+func reconnectDelay(cfg *TunnelConfig, attempt uint, randUint32 func() uint32) time.Duration {
+	min := cfg.ReconnectMin
+	if min == 0 {
+		min = defaultReconnectMin
+	}
+	max := cfg.ReconnectMax
+	if max == 0 {
+		max = defaultReconnectMax
+	}
+	if max < min {
+		max = min
+	}
+
+	delay := min
+	for i := uint(0); i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	half := delay / 2
+	return half + time.Duration(float64(delay-half)*float64(randUint32())/(1<<32))
+}
+
+func (tp *tunnelPersistence) recordSession(name string, cfg *SessionConfig) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	for i := range tp.sessions {
+		if tp.sessions[i].name == name {
+			tp.sessions[i].cfg = cfg
+			return
+		}
+	}
+	tp.sessions = append(tp.sessions, persistedSession{name: name, cfg: cfg})
+}
+
+func (tp *tunnelPersistence) forgetSession(name string) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	if tp.frozen {
+		return
+	}
+	for i := range tp.sessions {
+		if tp.sessions[i].name == name {
+			tp.sessions = append(tp.sessions[:i], tp.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// freeze prevents further changes to the recorded sessions, which
+// would otherwise be forgotten as the tunnel closes them on teardown.
+func (tp *tunnelPersistence) freeze() []persistedSession {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	tp.frozen = true
+	return append([]persistedSession{}, tp.sessions...)
+}
+
+// scheduleReconnect arranges for a failed persistent tunnel to be
+// re-created after a backoff.
+func (ctx *Context) scheduleReconnect(dt *dynamicTunnel, sessions []persistedSession) {
+	ctx.reconnectLock.Lock()
+	defer ctx.reconnectLock.Unlock()
+
+	if ctx.closed {
+		return
+	}
+
+	r, ok := ctx.reconnects[dt.getName()]
+	if !ok {
+		r = &tunnelReconnect{}
+		ctx.reconnects[dt.getName()] = r
+	}
+	ctx.armReconnect(r, dt, sessions)
+}
+
+// armReconnect starts the backoff timer for a reconnect attempt.
+// It must be called with reconnectLock held.
+func (ctx *Context) armReconnect(r *tunnelReconnect, dt *dynamicTunnel, sessions []persistedSession) {
+	name := dt.getName()
+	cfg := dt.persist.cfg
+
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+
+	delay := reconnectDelay(cfg, r.attempts, ctx.randUint32)
+	r.from = dt
+	r.attempts++
+	r.timer = time.AfterFunc(delay, func() {
+		ctx.reconnectTunnel(name, cfg, sessions, r)
+	})
+
+	level.Info(ctx.logger).Log(
+		"message", "scheduled tunnel reconnect",
+		"tunnel_name", name,
+		"attempt", r.attempts,
+		"delay", delay)
+}
+
+// reconnectTunnel re-creates a persistent tunnel and its sessions.
+//
+// reconnectLock is not held while the tunnel is created, since tearing
+// down a tunnel which fails during setup takes the lock to cancel its
+// reconnect.  Instead the attempt is tracked by reconnectWg, so that
+// closing the Context waits for it to complete.
+func (ctx *Context) reconnectTunnel(name string, cfg *TunnelConfig, sessions []persistedSession, r *tunnelReconnect) {
+	ctx.reconnectLock.Lock()
+	if ctx.closed || ctx.reconnects[name] != r {
+		ctx.reconnectLock.Unlock()
+		return
+	}
+	ctx.reconnectWg.Add(1)
+	defer ctx.reconnectWg.Done()
+	from, attempts := r.from, r.attempts
+	ctx.reconnectLock.Unlock()
+
+	dt, err := ctx.newDynamicTunnel(name, TunnelTypeDynamic, cfg, sessions, nil)
+
+	ctx.reconnectLock.Lock()
+	// The reconnect may have been cancelled while the tunnel was being
+	// created.  If the Context is closing it closes the new tunnel along
+	// with the others, otherwise the user closed the failed tunnel.
+	current := !ctx.closed && ctx.reconnects[name] == r
+	if err != nil {
+		if errors.Is(err, ErrTunnelNameExists) {
+			// The user has created a new tunnel in place of the failed one
+			if current {
+				delete(ctx.reconnects, name)
+			}
+			ctx.reconnectLock.Unlock()
+			level.Info(ctx.logger).Log(
+				"message", "abandoned tunnel reconnect",
+				"tunnel_name", name,
+				"error", err)
+			return
+		}
+		// There's no new tunnel instance, so retry on behalf of the
+		// failed one.
+		if current {
+			ctx.armReconnect(r, from, sessions)
+		}
+		ctx.reconnectLock.Unlock()
+		level.Error(ctx.logger).Log(
+			"message", "failed to reconnect tunnel",
+			"tunnel_name", name,
+			"error", err)
+		return
+	}
+	if current {
+		r.from = dt
+	}
+	closing := ctx.closed
+	ctx.reconnectLock.Unlock()
+
+	if !current {
+		if !closing {
+			dt.Close()
+		}
+		return
+	}
+
+	level.Info(ctx.logger).Log(
+		"message", "reconnecting tunnel",
+		"tunnel_name", name,
+		"attempt", attempts)
+
+	for _, ps := range sessions {
+		_, err := dt.NewSession(ps.name, ps.cfg)
+		if err != nil {
+			level.Error(ctx.logger).Log(
+				"message", "failed to re-create session",
+				"tunnel_name", name,
+				"session_name", ps.name,
+				"error", err)
+		}
+	}
+}
+
+// resetReconnect discards the reconnect state for a tunnel once it is
+// successfully established.
+func (ctx *Context) resetReconnect(name string) {
+	ctx.reconnectLock.Lock()
+	defer ctx.reconnectLock.Unlock()
+	delete(ctx.reconnects, name)
+}
+
+// cancelReconnect stops any pending reconnect scheduled on the failure
+// of the tunnel instance specified.
+func (ctx *Context) cancelReconnect(dt *dynamicTunnel) {
+	ctx.reconnectLock.Lock()
+	defer ctx.reconnectLock.Unlock()
+	if r, ok := ctx.reconnects[dt.getName()]; ok && r.from == dt {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		delete(ctx.reconnects, dt.getName())
+	}
+}
+
+// stopReconnects cancels all pending reconnects and prevents further
+// reconnects from being scheduled.  It waits for any reconnect attempt
+// in progress to complete, so that the tunnel it creates is linked to
+// the Context before the Context's tunnels are closed.
+func (ctx *Context) stopReconnects() {
+	ctx.reconnectLock.Lock()
+	ctx.closed = true
+	for name, r := range ctx.reconnects {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		delete(ctx.reconnects, name)
+	}
+	ctx.reconnectLock.Unlock()
+
+	ctx.reconnectWg.Wait()
+}
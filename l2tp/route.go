@@ -0,0 +1,82 @@
+package l2tp
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// routeSourceLookup returns the source address the kernel would use
+// to send packets to dst.  It may be replaced in tests.
+var routeSourceLookup = netlinkRouteSource
+
+// sizeofRtMsg is the size of struct rtmsg from linux/rtnetlink.h
+const sizeofRtMsg = 12
+
+// netlinkRouteSource queries the kernel routing table using an
+// RTM_GETROUTE request, and returns the preferred source address
+// of the route to dst.
+func netlinkRouteSource(dst net.IP) (net.IP, error) {
+	family, addrLen := unix.AF_INET6, net.IPv6len
+	if ip4 := dst.To4(); ip4 != nil {
+		dst = ip4
+		family, addrLen = unix.AF_INET, net.IPv4len
+	}
+
+	attr, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{
+			Type: unix.RTA_DST,
+			Data: dst,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// struct rtmsg: only the family and destination length are needed
+	// for a route lookup, the remaining fields are left zeroed.
+	hdr := make([]byte, sizeofRtMsg)
+	hdr[0] = uint8(family)
+	hdr[1] = uint8(addrLen * 8)
+
+	c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	msgs, err := c.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_GETROUTE,
+			Flags: netlink.Request,
+		},
+		Data: append(hdr, attr...),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWROUTE || len(m.Data) < sizeofRtMsg {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(m.Data[sizeofRtMsg:])
+		if err != nil {
+			return nil, err
+		}
+		for ad.Next() {
+			if ad.Type() == unix.RTA_PREFSRC {
+				if b := ad.Bytes(); len(b) == addrLen {
+					return net.IP(b), nil
+				}
+			}
+		}
+		if err := ad.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("no source address for route to %v", dst)
+}
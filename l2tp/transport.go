@@ -1,9 +1,10 @@
 package l2tp
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
-	"strings"
+	"os"
 	"sync"
 	"time"
 
@@ -69,6 +70,9 @@ type transportConfig struct {
 	// Maximum number of messages we will send to the peer without having
 	// received an acknowledgement.
 	TxWindowSize uint16
+	// If set, only one message may be in flight at any one time,
+	// regardless of TxWindowSize.
+	StopAndWait bool
 	// Maximum number of retransmits of an unacknowledged control packet.
 	MaxRetries uint
 	// Duration to wait before first packet retransmit.
@@ -84,8 +88,42 @@ type transportConfig struct {
 	Version ProtocolVersion
 	// Peer control connection ID to use for transport-generated messages
 	PeerControlConnID ControlConnID
+	// Shared secret for AVP hiding.  If set, L2TPv2 messages sent by the
+	// transport have the AVPs listed in v2HiddenAvpTypes hidden.
+	// Received hidden AVPs cannot be decoded unless the secret is set.
+	Secret []byte
+	// Maximum duration to wait for a control packet from the peer.
+	// If no packet is received within this time the transport goes down.
+	// This should exceed HelloTimeout to allow for quiet tunnels.
+	// If set to 0, reads do not time out.
+	ReadTimeout time.Duration
+	// Maximum duration to wait for a control packet to be written to
+	// the socket.  If set to 0, writes do not time out.
+	WriteTimeout time.Duration
 }
 
+// v2HiddenAvpTypes lists the AVPs which are hidden in transmitted L2TPv2
+// messages when a shared secret is configured.
+var v2HiddenAvpTypes = map[avpType]bool{
+	avpTypeTunnelID:         true,
+	avpTypeSessionID:        true,
+	avpTypeCallSerialNumber: true,
+	// The response carries the password for PAP and textual proxy
+	// authentication, per RFC2661 section 4.4.5
+	avpTypeProxyAuthResponse: true,
+}
+
+// v2RandomVectorLen is the length of the random vector generated for
+// AVP hiding.
+const v2RandomVectorLen = 16
+
+// recvWindowSize is the number of out of sequence control messages the
+// transport will queue awaiting in-order delivery.  We don't send a Receive
+// Window Size AVP, so the peer will assume the default value of 4 and
+// shouldn't send any message outside this window.
+// Ref: RFC2661 section 4.4.3, RFC3931 section 5.4.3
+const recvWindowSize = 4
+
 // transport represents the RFC2661/RFC3931
 // reliable transport algorithm state.
 type transport struct {
@@ -103,6 +141,30 @@ type transport struct {
 	txQueue, ackQueue    []*xmitMsg
 	senderWg             sync.WaitGroup
 	receiverWg           sync.WaitGroup
+	recvErr              error
+	downErr              error
+	downLock             sync.Mutex
+	abortChan            chan interface{}
+	abortErr             error
+	abortOnce            sync.Once
+	dataHandler          func(b []byte)
+	dataLock             sync.Mutex
+	healthLock           sync.Mutex
+	lastAck              time.Time
+	lastActivity         time.Time
+	retransmits          uint64
+}
+
+// retransmitExhaustedError is the transport down error when a control
+// message is not acknowledged by the peer within the maximum number of
+// retransmits.
+type retransmitExhaustedError struct {
+	msgType avpMsgType
+	retries uint
+}
+
+func (e *retransmitExhaustedError) Error() string {
+	return fmt.Sprintf("transmit of %s failed after %d retry attempts", e.msgType, e.retries)
 }
 
 // Increment transport sequence number by one avoiding overflow
@@ -195,6 +257,14 @@ func (s *slowStartState) msgIsStale(msg controlMessage) bool {
 	return seqCompare(msg.ns(), s.nr) == -1
 }
 
+// A message with ns value in the range [nr, nr + receive window) may be
+// queued for delivery.
+func (s *slowStartState) msgIsInRecvWindow(msg controlMessage) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return seqCompare(msg.ns(), s.nr) >= 0 && msg.ns()-s.nr < recvWindowSize
+}
+
 func (s *slowStartState) getSequenceNumbers() (ns, nr uint16) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -227,7 +297,9 @@ func newTimer(duration time.Duration) *time.Timer {
 }
 
 func sanitiseConfig(cfg *transportConfig) {
-	if cfg.TxWindowSize == 0 || cfg.TxWindowSize > 65535 {
+	if cfg.StopAndWait {
+		cfg.TxWindowSize = 1
+	} else if cfg.TxWindowSize == 0 || cfg.TxWindowSize > 65535 {
 		cfg.TxWindowSize = defaulttransportConfig().TxWindowSize
 	}
 	if cfg.RetryTimeout == 0 {
@@ -242,6 +314,12 @@ func sanitiseConfig(cfg *transportConfig) {
 }
 
 func (xport *transport) rawRecv() (buffer []byte, from unix.Sockaddr, err error) {
+	if xport.config.ReadTimeout > 0 {
+		err = xport.cp.setReadDeadline(time.Now().Add(xport.config.ReadTimeout))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	buffer = make([]byte, 4096)
 	n, from, err := xport.cp.recvFrom(buffer)
 	if err != nil {
@@ -255,6 +333,8 @@ func (xport *transport) receiver() {
 	for {
 		buffer, from, err := xport.rawRecv()
 		if err != nil {
+			// recvErr is read by the sender once nrChan is closed
+			xport.recvErr = err
 			close(xport.nrChan)
 			level.Error(xport.logger).Log(
 				"message", "socket read failed",
@@ -266,21 +346,25 @@ func (xport *transport) receiver() {
 			"message", "socket recv",
 			"length", len(buffer))
 
+		// Data packets are received here only if the kernel isn't
+		// handling the tunnel's data traffic.
+		if isDataPacket(buffer) {
+			xport.handleDataPacket(buffer)
+			continue
+		}
+
 		// Parse the received frame into control messages, perform early
 		// sequence number validation.
 		messages, err := xport.recvFrame(&rawMsg{b: buffer, sa: from})
 		if err != nil {
-			// Early packet handling can fail for a variety of reasons.
-			// The most important of these is if a peer sends a mandatory
-			// AVP that we don't recognise: this MUST cause the tunnel to fail
-			// per the RFCs.  Anything else we just log for information.
+			// Early packet handling can fail for a variety of reasons,
+			// all of which we just log for information.  Unrecognised
+			// mandatory AVPs don't cause parsing to fail: messages
+			// carrying them are delivered so that the tunnel or session
+			// concerned can be torn down as the RFCs require.
 			level.Error(xport.logger).Log(
 				"message", "frame receive failed",
 				"error", err)
-			if strings.Contains("failed to parse mandatory AVP", err.Error()) {
-				close(xport.nrChan)
-				return
-			}
 		}
 
 		// Add received messages to the rx queue.  Pass the nr values of the received
@@ -289,8 +373,9 @@ func (xport *transport) receiver() {
 		rxNr := []nrInd{}
 
 		for _, msg := range messages {
-			xport.rxQueue = append(xport.rxQueue, &recvMsg{msg: msg, from: from})
-			rxNr = append(rxNr, nrInd{msgType: msg.getType(), nr: msg.nr()})
+			if xport.queueRxMessage(&recvMsg{msg: msg, from: from}) {
+				rxNr = append(rxNr, nrInd{msgType: msg.getType(), nr: msg.nr()})
+			}
 		}
 
 		xport.nrChan <- rxNr
@@ -298,6 +383,33 @@ func (xport *transport) receiver() {
 	}
 }
 
+// setDataHandler registers a function to be called with each data
+// packet received on the transport socket.
+func (xport *transport) setDataHandler(handler func(b []byte)) {
+	xport.dataLock.Lock()
+	defer xport.dataLock.Unlock()
+	xport.dataHandler = handler
+}
+
+func (xport *transport) handleDataPacket(b []byte) {
+	xport.dataLock.Lock()
+	handler := xport.dataHandler
+	xport.dataLock.Unlock()
+	if handler == nil {
+		level.Debug(xport.logger).Log(
+			"message", "dropping data packet",
+			"length", len(b))
+		return
+	}
+	handler(b)
+}
+
+// isDataPacket returns true if the frame is an L2TP data packet, which
+// is indicated by the T bit of the header being clear.
+func isDataPacket(b []byte) bool {
+	return len(b) > 0 && b[0]&0x80 == 0
+}
+
 func (xport *transport) sender() {
 	for {
 		select {
@@ -323,7 +435,12 @@ func (xport *transport) sender() {
 		case rxNr, ok := <-xport.nrChan:
 
 			if !ok {
-				xport.down(errors.New("receive path error"))
+				if errors.Is(xport.recvErr, os.ErrDeadlineExceeded) {
+					xport.down(fmt.Errorf("no control packet received within %v: %w",
+						xport.config.ReadTimeout, xport.recvErr))
+				} else {
+					xport.down(errors.New("receive path error"))
+				}
 				return
 			}
 
@@ -351,6 +468,9 @@ func (xport *transport) sender() {
 
 			// The fact we've seen any traffic at all means we should reset the hello timer
 			xport.resetHelloTimer()
+			xport.healthLock.Lock()
+			xport.lastActivity = time.Now()
+			xport.healthLock.Unlock()
 
 		// Message retry request due to timeout waiting for an ack
 		case xmitMsg, ok := <-xport.retryChan:
@@ -368,12 +488,19 @@ func (xport *transport) sender() {
 			if !xmitMsg.isComplete {
 				err := xport.retransmitMessage(xmitMsg)
 				if err != nil {
-					xmitMsg.txComplete(err)
+					// Take the transport down before completing the
+					// message so the sender sees the down error.
 					xport.down(err)
+					xmitMsg.txComplete(err)
 					return
 				}
 			}
 
+		// Transport aborted by user code
+		case <-xport.abortChan:
+			xport.down(xport.abortErr)
+			return
+
 		// Timer fired for sending a hello message
 		case <-xport.helloTimer.C:
 			if !xport.helloInFlight {
@@ -402,6 +529,14 @@ func (xport *transport) recvFrame(rawMsg *rawMsg) (messages []controlMessage, er
 		return nil, err
 	}
 
+	for _, msg := range messages {
+		if v2msg, ok := msg.(*v2ControlMessage); ok {
+			if err = v2msg.unhideAvps(xport.config.Secret); err != nil {
+				return nil, fmt.Errorf("failed to unhide %v AVPs: %v", msg.getType(), err)
+			}
+		}
+	}
+
 	ns, nr := xport.slowStart.getSequenceNumbers()
 	for _, msg := range messages {
 		// Sanity check the packet sequence number: return an error if it's not OK
@@ -414,10 +549,53 @@ func (xport *transport) recvFrame(rawMsg *rawMsg) (messages []controlMessage, er
 	return messages, nil
 }
 
+// queueRxMessage adds a received message to the rx queue for in-sequence
+// delivery.  Ack messages are not queued since they only serve to update
+// the ack queue.  Duplicates of messages which have already been delivered
+// or queued are not queued, to avoid processing a message twice: they are
+// acked via. the ack timer.  Messages beyond the receive window are dropped,
+// in which case queueRxMessage returns false.
+func (xport *transport) queueRxMessage(m *recvMsg) bool {
+	if m.msg.getType() == avpMsgTypeAck {
+		return true
+	}
+
+	if xport.slowStart.msgIsStale(m.msg) {
+		level.Debug(xport.logger).Log(
+			"message", "dropping duplicate message",
+			"message_type", m.msg.getType(),
+			"ns", m.msg.ns())
+		return true
+	}
+
+	if !xport.slowStart.msgIsInRecvWindow(m.msg) {
+		_, nr := xport.slowStart.getSequenceNumbers()
+		level.Info(xport.logger).Log(
+			"message", "dropping message outside receive window",
+			"message_type", m.msg.getType(),
+			"ns", m.msg.ns(),
+			"transport_nr", nr)
+		return false
+	}
+
+	for _, q := range xport.rxQueue {
+		if q.msg.ns() == m.msg.ns() {
+			level.Debug(xport.logger).Log(
+				"message", "dropping duplicate queued message",
+				"message_type", m.msg.getType(),
+				"ns", m.msg.ns())
+			return true
+		}
+	}
+
+	xport.rxQueue = append(xport.rxQueue, m)
+	return true
+}
+
 // Find the next message which can be handled (either stale or in-sequence)
 func (xport *transport) dequeueRxMessage() *recvMsg {
 	for i := 0; i < len(xport.rxQueue); i++ {
-		m := xport.rxQueue[0]
+		m := xport.rxQueue[i]
 		if xport.slowStart.msgIsInSequence(m.msg) || xport.slowStart.msgIsStale(m.msg) {
 			xport.rxQueue = append(xport.rxQueue[:i], xport.rxQueue[i+1:]...)
 			return m
@@ -472,9 +650,16 @@ func (xport *transport) sendMessage1(msg controlMessage, isRetransmit bool) erro
 
 	// Render as a byte slice and send.
 	b, err := msg.toBytes()
-	if err == nil {
-		_, err = xport.cp.write(b)
+	if err != nil {
+		return err
+	}
+	if xport.config.WriteTimeout > 0 {
+		err = xport.cp.setWriteDeadline(time.Now().Add(xport.config.WriteTimeout))
+		if err != nil {
+			return err
+		}
 	}
+	_, err = xport.cp.write(b)
 	return err
 }
 
@@ -502,12 +687,17 @@ func (xport *transport) sendMessage(msg *xmitMsg) error {
 func (xport *transport) retransmitMessage(msg *xmitMsg) error {
 	msg.nretries++
 	if msg.nretries >= xport.config.MaxRetries {
-		return fmt.Errorf("transmit of %s failed after %d retry attempts",
-			msg.msg.getType(), xport.config.MaxRetries)
+		return &retransmitExhaustedError{
+			msgType: msg.msg.getType(),
+			retries: xport.config.MaxRetries,
+		}
 	}
 	err := xport.sendMessage(msg)
 	if err == nil {
 		xport.slowStart.onRetransmit()
+		xport.healthLock.Lock()
+		xport.retransmits++
+		xport.healthLock.Unlock()
 	}
 	return err
 }
@@ -548,6 +738,13 @@ func (xport *transport) processAckQueue(nr uint16) (found bool) {
 			found = true
 		}
 	}
+	if found {
+		now := time.Now()
+		xport.healthLock.Lock()
+		xport.lastAck = now
+		xport.lastActivity = now
+		xport.healthLock.Unlock()
+	}
 	return
 }
 
@@ -578,6 +775,13 @@ func (xport *transport) closeReceiver() {
 
 func (xport *transport) down(err error) {
 
+	// Record the first error which took the transport down
+	xport.downLock.Lock()
+	if xport.downErr == nil {
+		xport.downErr = err
+	}
+	xport.downLock.Unlock()
+
 	// Shut down the receiver
 	xport.closeReceiver()
 
@@ -643,11 +847,14 @@ func (xport *transport) sendHelloMessage() error {
 		return fmt.Errorf("failed to build hello message: %v", err)
 	}
 
-	return xport.sendMessage(&xmitMsg{
+	// The HELLO is queued like any other message so that it is subject
+	// to the transmit window, and is completed once the peer acks it.
+	xport.txQueue = append(xport.txQueue, &xmitMsg{
 		xport:      xport,
 		msg:        msg,
 		onComplete: helloSendComplete,
 	})
+	return xport.processTxQueue()
 }
 
 func helloSendComplete(m *xmitMsg, err error) {
@@ -718,11 +925,16 @@ func newTransport(logger log.Logger, cp *controlPlane, cfg transportConfig) (xpo
 		retryChan:  make(chan *xmitMsg),
 		recvChan:   make(chan *recvMsg),
 		nrChan:     make(chan []nrInd),
+		abortChan:  make(chan interface{}),
 		rxQueue:    []*recvMsg{},
 		txQueue:    []*xmitMsg{},
 		ackQueue:   []*xmitMsg{},
 	}
 
+	// The peer is given a grace period from creation of the transport
+	// before the transport is considered degraded.
+	xport.lastActivity = time.Now()
+
 	xport.resetHelloTimer()
 
 	xport.senderWg.Add(1)
@@ -758,6 +970,22 @@ func (xport *transport) send(msg controlMessage) error {
 	if err != nil {
 		return fmt.Errorf("failed to validate message: %v", err)
 	}
+	if v2msg, ok := msg.(*v2ControlMessage); ok && len(xport.config.Secret) > 0 {
+		rv := make([]byte, v2RandomVectorLen)
+		if _, err = rand.Read(rv); err != nil {
+			return fmt.Errorf("failed to generate random vector: %v", err)
+		}
+		if err = v2msg.hideAvps(xport.config.Secret, rv, v2HiddenAvpTypes); err != nil {
+			return fmt.Errorf("failed to hide AVPs: %v", err)
+		}
+	}
+	return xport.sendRaw(msg)
+}
+
+// sendRaw sends a control message using the reliable transport without
+// validating the message or hiding AVPs.
+// The caller will block until the message has been acked by the peer.
+func (xport *transport) sendRaw(msg controlMessage) error {
 	cm := xmitMsg{
 		xport:        xport,
 		msg:          msg,
@@ -765,8 +993,7 @@ func (xport *transport) send(msg controlMessage) error {
 		onComplete:   sendComplete,
 	}
 	xport.sendChan <- &cm
-	err = <-cm.completeChan
-	return err
+	return <-cm.completeChan
 }
 
 func sendComplete(m *xmitMsg, err error) {
@@ -785,6 +1012,54 @@ func (xport *transport) recv() (msg controlMessage, from unix.Sockaddr, err erro
 	return m.msg, m.from, nil
 }
 
+// getDownErr returns the error which caused the transport to go down,
+// or nil if the transport is up.
+func (xport *transport) getDownErr() error {
+	xport.downLock.Lock()
+	defer xport.downLock.Unlock()
+	return xport.downErr
+}
+
+// health reports the health of the transport at the specified time.
+// The transport is degraded if nothing has been received from the peer
+// for HealthDegradedIntervals hello intervals.  Since the transport sends
+// a HELLO once the peer has been silent for a hello interval, this means
+// that at least one HELLO has not been acknowledged.
+func (xport *transport) health(now time.Time) TunnelHealth {
+	xport.healthLock.Lock()
+	h := TunnelHealth{State: TunnelHealthUp, LastRoundTrip: xport.lastAck}
+	lastActivity := xport.lastActivity
+	xport.healthLock.Unlock()
+
+	if xport.getDownErr() != nil {
+		h.State = TunnelHealthDown
+	} else if hello := xport.config.HelloTimeout; hello > 0 {
+		if now.Sub(lastActivity) > HealthDegradedIntervals*hello {
+			h.State = TunnelHealthDegraded
+		}
+	}
+	return h
+}
+
+// getRetransmits returns the number of control messages retransmitted
+// by the transport.
+func (xport *transport) getRetransmits() uint64 {
+	xport.healthLock.Lock()
+	defer xport.healthLock.Unlock()
+	return xport.retransmits
+}
+
+// abort takes the transport down with the specified error.  Messages
+// pending transmission are completed with the error.  Unlike close,
+// abort may be called concurrently with send, and more than once.
+// The transport must still be closed using close.
+func (xport *transport) abort(err error) {
+	xport.abortOnce.Do(func() {
+		xport.abortErr = err
+		close(xport.abortChan)
+	})
+}
+
 // close closes the transport.
 func (xport *transport) close() {
 	close(xport.sendChan)
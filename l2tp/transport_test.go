@@ -1,8 +1,11 @@
 package l2tp
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -57,6 +60,31 @@ func TestSeqNumCompare(t *testing.T) {
 	}
 }
 
+func TestMsgIsInRecvWindow(t *testing.T) {
+	cases := []struct {
+		nr, ns uint16
+		want   bool
+	}{
+		{nr: 10, ns: 10, want: true},
+		{nr: 10, ns: 13, want: true},
+		{nr: 10, ns: 14, want: false},
+		{nr: 10, ns: 9, want: false},
+		{nr: 65534, ns: 1, want: true},
+		{nr: 65534, ns: 2, want: false},
+	}
+	for _, c := range cases {
+		msg, err := newV2ControlMessage(1, 0, []avp{})
+		if err != nil {
+			t.Fatalf("newV2ControlMessage(): %v", err)
+		}
+		msg.setTransportSeqNum(c.ns, 0)
+		ss := slowStartState{nr: c.nr}
+		if got := ss.msgIsInRecvWindow(msg); got != c.want {
+			t.Errorf("msgIsInRecvWindow(ns %v) with nr %v = %v, want %v", c.ns, c.nr, got, c.want)
+		}
+	}
+}
+
 func checkWindowOpen(ss *slowStartState, t *testing.T) {
 	if !ss.canSend() {
 		t.Fatalf("transport window is closed when we expect it to be open")
@@ -182,9 +210,9 @@ func transportTestnewTransport(testCfg *transportSendRecvTestInfo) (xport *trans
 
 	switch testCfg.encap {
 	case EncapTypeUDP:
-		sal, sap, err = newUDPAddressPair(testCfg.local, testCfg.peer)
+		sal, sap, err = newUDPAddressPair(testCfg.local, 0, testCfg.peer, AddressFamilyAny)
 	case EncapTypeIP:
-		sal, sap, err = newIPAddressPair(testCfg.local, testCfg.tid, testCfg.peer, testCfg.xcfg.PeerControlConnID)
+		sal, sap, err = newIPAddressPair(testCfg.local, testCfg.tid, testCfg.peer, testCfg.xcfg.PeerControlConnID, AddressFamilyAny)
 	default:
 		err = fmt.Errorf("unhandled encap type %v", testCfg.encap)
 	}
@@ -321,9 +349,9 @@ func TestBasicSendReceive(t *testing.T) {
 			receiver: testBasicSendRecvHelloReceiver,
 		},
 		{
-			local: "127.0.0.1:9000",
+			local: "127.0.0.1",
 			tid:   42,
-			peer:  "127.0.0.1:9001",
+			peer:  "127.0.0.1",
 			encap: EncapTypeIP,
 			xcfg: transportConfig{
 				Version:           ProtocolVersion3,
@@ -334,9 +362,9 @@ func TestBasicSendReceive(t *testing.T) {
 			receiver: testBasicSendRecvHelloReceiver,
 		},
 		{
-			local: "[::1]:9000",
+			local: "::1",
 			tid:   42,
-			peer:  "[::1]:9001",
+			peer:  "::1",
 			encap: EncapTypeIP,
 			xcfg: transportConfig{
 				Version:           ProtocolVersion3,
@@ -386,3 +414,556 @@ func TestBasicSendReceive(t *testing.T) {
 			})
 	}
 }
+
+func TestRecvDuplicateAndOutOfWindow(t *testing.T) {
+	xport, err := transportTestnewTransport(&transportSendRecvTestInfo{
+		local: "127.0.0.1:9100",
+		peer:  "127.0.0.1:9101",
+		encap: EncapTypeUDP,
+		xcfg: transportConfig{
+			Version:           ProtocolVersion2,
+			PeerControlConnID: 42,
+			AckTimeout:        20 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatalf("transportTestnewTransport(): %v", err)
+	}
+	defer xport.close()
+
+	peer, err := net.DialUDP("udp",
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9101},
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9100})
+	if err != nil {
+		t.Fatalf("DialUDP(): %v", err)
+	}
+	defer peer.Close()
+
+	sendHello := func(ns uint16) {
+		cfg := xport.getConfig()
+		msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+		if err != nil {
+			t.Fatalf("failed to build HELLO: %v", err)
+		}
+		msg.setTransportSeqNum(ns, 0)
+		b, err := msg.toBytes()
+		if err != nil {
+			t.Fatalf("failed to encode HELLO: %v", err)
+		}
+		_, err = peer.Write(b)
+		if err != nil {
+			t.Fatalf("failed to send HELLO: %v", err)
+		}
+	}
+
+	expectRecv := func(ns uint16) {
+		select {
+		case m, ok := <-xport.recvChan:
+			if !ok {
+				t.Fatalf("transport down waiting for ns %v", ns)
+			}
+			if m.msg.ns() != ns {
+				t.Fatalf("expected message with ns %v, got %v", ns, m.msg.ns())
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for message with ns %v", ns)
+		}
+	}
+
+	expectNoRecv := func() {
+		select {
+		case m := <-xport.recvChan:
+			t.Fatalf("unexpected message delivered: %v ns %v", m.msg.getType(), m.msg.ns())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// expectAck waits for the transport to ack messages up to nr
+	expectAck := func(nr uint16) {
+		b := make([]byte, 4096)
+		for {
+			err := peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if err != nil {
+				t.Fatalf("SetReadDeadline(): %v", err)
+			}
+			n, err := peer.Read(b)
+			if err != nil {
+				t.Fatalf("failed waiting for ack of nr %v: %v", nr, err)
+			}
+			msgs, err := parseMessageBuffer(b[:n])
+			if err != nil {
+				t.Fatalf("parseMessageBuffer(): %v", err)
+			}
+			if len(msgs) == 1 && msgs[0].nr() == nr {
+				return
+			}
+		}
+	}
+
+	// In-sequence message is delivered
+	sendHello(0)
+	expectRecv(0)
+	expectAck(1)
+
+	// A duplicate of a delivered message is acked but not redelivered
+	sendHello(0)
+	expectNoRecv()
+	expectAck(1)
+
+	// A message beyond the receive window is dropped
+	sendHello(1 + recvWindowSize)
+	expectNoRecv()
+
+	// Out of sequence messages are queued once, and delivered in order
+	sendHello(2)
+	sendHello(2)
+	expectNoRecv()
+	sendHello(1)
+	expectRecv(1)
+	expectRecv(2)
+	expectNoRecv()
+	expectAck(3)
+}
+
+func TestReadTimeout(t *testing.T) {
+	readTimeout := 200 * time.Millisecond
+	xport, err := transportTestnewTransport(&transportSendRecvTestInfo{
+		local: "127.0.0.1:9102",
+		peer:  "127.0.0.1:9103",
+		encap: EncapTypeUDP,
+		xcfg: transportConfig{
+			Version:           ProtocolVersion2,
+			PeerControlConnID: 42,
+			ReadTimeout:       readTimeout,
+		},
+	})
+	if err != nil {
+		t.Fatalf("transportTestnewTransport(): %v", err)
+	}
+	defer xport.close()
+
+	start := time.Now()
+	select {
+	case _, ok := <-xport.recvChan:
+		if ok {
+			t.Fatalf("unexpected message received with no peer")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("transport still up after read timeout %v", readTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < readTimeout {
+		t.Errorf("transport down after %v, before read timeout %v", elapsed, readTimeout)
+	}
+
+	// The receive path closing is reported to the sender, which then
+	// records the down error.
+	var downErr error
+	for i := 0; i < 50 && downErr == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		downErr = xport.getDownErr()
+	}
+	if !errors.Is(downErr, os.ErrDeadlineExceeded) {
+		t.Errorf("expected transport down error %v, got %v", os.ErrDeadlineExceeded, downErr)
+	}
+}
+
+func TestAckQueueWraparound(t *testing.T) {
+	xport := &transport{
+		logger: log.NewNopLogger(),
+		config: transportConfig{TxWindowSize: 4},
+		slowStart: slowStartState{
+			ns:     2,
+			cwnd:   4,
+			thresh: 4,
+		},
+	}
+
+	// Queue messages straddling the sequence number wrap, as though
+	// they've been sent and the window is now closed.
+	var completed []uint16
+	for _, ns := range []uint16{65534, 65535, 0, 1} {
+		msg, err := newV2ControlMessage(1, 0, []avp{})
+		if err != nil {
+			t.Fatalf("newV2ControlMessage(): %v", err)
+		}
+		msg.setTransportSeqNum(ns, 0)
+		xport.ackQueue = append(xport.ackQueue, &xmitMsg{
+			xport: xport,
+			msg:   msg,
+			onComplete: func(m *xmitMsg, err error) {
+				completed = append(completed, m.msg.ns())
+			},
+		})
+		xport.slowStart.onSend()
+	}
+	if xport.slowStart.canSend() {
+		t.Fatalf("window open with %v messages in flight", len(xport.ackQueue))
+	}
+
+	cases := []struct {
+		nr             uint16
+		expectFound    bool
+		expectAcked    []uint16
+		expectInFlight uint16
+	}{
+		// A stale nr from before the wrap acks nothing
+		{nr: 65534, expectFound: false, expectAcked: nil, expectInFlight: 4},
+		// An nr before the wrap acks only the messages preceding it
+		{nr: 65535, expectFound: true, expectAcked: []uint16{65534}, expectInFlight: 3},
+		// An nr after the wrap acks messages either side of it
+		{nr: 1, expectFound: true, expectAcked: []uint16{65534, 65535, 0}, expectInFlight: 1},
+		{nr: 2, expectFound: true, expectAcked: []uint16{65534, 65535, 0, 1}, expectInFlight: 0},
+	}
+	for _, c := range cases {
+		found := xport.processAckQueue(c.nr)
+		if found != c.expectFound {
+			t.Errorf("processAckQueue(%v): expected %v, got %v", c.nr, c.expectFound, found)
+		}
+		if !reflect.DeepEqual(completed, c.expectAcked) {
+			t.Errorf("processAckQueue(%v): expected acked %v, got %v", c.nr, c.expectAcked, completed)
+		}
+		if xport.slowStart.ntx != c.expectInFlight {
+			t.Errorf("processAckQueue(%v): expected %v in flight, got %v", c.nr, c.expectInFlight, xport.slowStart.ntx)
+		}
+		if c.expectInFlight < xport.slowStart.cwnd && !xport.slowStart.canSend() {
+			t.Errorf("processAckQueue(%v): window closed with %v in flight", c.nr, xport.slowStart.ntx)
+		}
+	}
+}
+
+func TestSendReceiveWraparound(t *testing.T) {
+	const nmsgs = 8
+	const initialSeq = 65532
+
+	tx, err := transportTestnewTransport(&transportSendRecvTestInfo{
+		local: "127.0.0.1:9104",
+		peer:  "127.0.0.1:9105",
+		encap: EncapTypeUDP,
+		xcfg: transportConfig{
+			Version:           ProtocolVersion2,
+			PeerControlConnID: 42,
+			TxWindowSize:      4,
+			MaxRetries:        3,
+			RetryTimeout:      250 * time.Millisecond,
+			AckTimeout:        20 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatalf("transportTestnewTransport(): %v", err)
+	}
+	defer tx.close()
+
+	rx, err := transportTestnewTransport(&transportSendRecvTestInfo{
+		local: "127.0.0.1:9105",
+		peer:  "127.0.0.1:9104",
+		encap: EncapTypeUDP,
+		xcfg: transportConfig{
+			Version:           ProtocolVersion2,
+			PeerControlConnID: 42,
+			TxWindowSize:      4,
+			MaxRetries:        3,
+			RetryTimeout:      250 * time.Millisecond,
+			AckTimeout:        20 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatalf("transportTestnewTransport(): %v", err)
+	}
+	defer rx.close()
+
+	// Start both ends just short of the sequence number wrap
+	tx.slowStart.lock.Lock()
+	tx.slowStart.ns = initialSeq
+	tx.slowStart.lock.Unlock()
+	rx.slowStart.lock.Lock()
+	rx.slowStart.nr = initialSeq
+	rx.slowStart.lock.Unlock()
+
+	// Send enough messages concurrently that the send window straddles
+	// the wrap: each send blocks until the message is acked.
+	cfg := tx.getConfig()
+	errChan := make(chan error, nmsgs)
+	for i := 0; i < nmsgs; i++ {
+		go func() {
+			msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+			if err == nil {
+				err = tx.send(msg)
+			}
+			errChan <- err
+		}()
+	}
+
+	expectNs := uint16(initialSeq)
+	for i := 0; i < nmsgs; i++ {
+		select {
+		case m, ok := <-rx.recvChan:
+			if !ok {
+				t.Fatalf("receiver transport down waiting for ns %v", expectNs)
+			}
+			if m.msg.ns() != expectNs {
+				t.Fatalf("expected message with ns %v, got %v", expectNs, m.msg.ns())
+			}
+			expectNs = seqIncrement(expectNs)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for message with ns %v", expectNs)
+		}
+	}
+
+	for i := 0; i < nmsgs; i++ {
+		select {
+		case err := <-errChan:
+			if err != nil {
+				t.Fatalf("send failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for send completion")
+		}
+	}
+
+	tx.slowStart.lock.Lock()
+	ns, ntx := tx.slowStart.ns, tx.slowStart.ntx
+	tx.slowStart.lock.Unlock()
+	if ns != expectNs {
+		t.Errorf("expected sender ns %v, got %v", expectNs, ns)
+	}
+	if ntx != 0 {
+		t.Errorf("expected no messages in flight, got %v", ntx)
+	}
+}
+
+func TestStopAndWait(t *testing.T) {
+	const nmsgs = 3
+
+	xport, err := transportTestnewTransport(&transportSendRecvTestInfo{
+		local: "127.0.0.1:9110",
+		peer:  "127.0.0.1:9111",
+		encap: EncapTypeUDP,
+		xcfg: transportConfig{
+			Version:           ProtocolVersion2,
+			PeerControlConnID: 42,
+			TxWindowSize:      4,
+			StopAndWait:       true,
+			RetryTimeout:      time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatalf("transportTestnewTransport(): %v", err)
+	}
+	defer xport.close()
+
+	if got := xport.getConfig().TxWindowSize; got != 1 {
+		t.Errorf("expected stop-and-wait window size 1, got %v", got)
+	}
+
+	peer, err := net.DialUDP("udp",
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9111},
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9110})
+	if err != nil {
+		t.Fatalf("DialUDP(): %v", err)
+	}
+	defer peer.Close()
+
+	// Drain the peer's acknowledging HELLOs so the transport doesn't block
+	go func() {
+		for {
+			if _, _, err := xport.recv(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Queue several messages at once: each send blocks until acked
+	cfg := xport.getConfig()
+	for i := 0; i < nmsgs; i++ {
+		go func() {
+			msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+			if err == nil {
+				_ = xport.send(msg)
+			}
+		}()
+	}
+
+	// recvAll returns the sequence numbers of the non-ZLB messages received
+	// by the peer within the timeout
+	recvAll := func(timeout time.Duration) []uint16 {
+		var got []uint16
+		b := make([]byte, 4096)
+		deadline := time.Now().Add(timeout)
+		for {
+			err := peer.SetReadDeadline(deadline)
+			if err != nil {
+				t.Fatalf("SetReadDeadline(): %v", err)
+			}
+			n, err := peer.Read(b)
+			if err != nil {
+				return got
+			}
+			msgs, err := parseMessageBuffer(b[:n])
+			if err != nil {
+				t.Fatalf("parseMessageBuffer(): %v", err)
+			}
+			for _, msg := range msgs {
+				if msg.getType() != avpMsgTypeAck {
+					got = append(got, msg.ns())
+				}
+			}
+		}
+	}
+
+	for ns := uint16(0); ns < nmsgs; ns++ {
+		got := recvAll(250 * time.Millisecond)
+		if !reflect.DeepEqual(got, []uint16{ns}) {
+			t.Fatalf("expected only message ns %v in flight, got %v", ns, got)
+		}
+
+		xport.slowStart.lock.Lock()
+		ntx, cwnd := xport.slowStart.ntx, xport.slowStart.cwnd
+		xport.slowStart.lock.Unlock()
+		if ntx != 1 || cwnd != 1 {
+			t.Fatalf("expected 1 message in flight with window 1, got %v with window %v", ntx, cwnd)
+		}
+
+		// Acknowledge the message in flight, allowing the next to be sent
+		msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+		if err != nil {
+			t.Fatalf("failed to build HELLO: %v", err)
+		}
+		msg.setTransportSeqNum(ns, seqIncrement(ns))
+		b, err := msg.toBytes()
+		if err != nil {
+			t.Fatalf("failed to encode HELLO: %v", err)
+		}
+		_, err = peer.Write(b)
+		if err != nil {
+			t.Fatalf("failed to send HELLO: %v", err)
+		}
+	}
+}
+
+func TestTransportHealth(t *testing.T) {
+	helloTimeout := 100 * time.Millisecond
+
+	waitHealth := func(xport *transport, state TunnelHealthState) TunnelHealth {
+		var h TunnelHealth
+		for i := 0; i < 200; i++ {
+			h = xport.health(time.Now())
+			if h.State == state {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return h
+	}
+
+	t.Run("Responsive peer", func(t *testing.T) {
+		info := &transportSendRecvTestInfo{
+			local: "127.0.0.1:9106",
+			peer:  "127.0.0.1:9107",
+			encap: EncapTypeUDP,
+			tid:   42,
+			xcfg: transportConfig{
+				Version:           ProtocolVersion2,
+				PeerControlConnID: 90,
+				HelloTimeout:      helloTimeout,
+			},
+		}
+		xport, err := transportTestnewTransport(info)
+		if err != nil {
+			t.Fatalf("transportTestnewTransport(): %v", err)
+		}
+		defer xport.close()
+
+		peerInfo := flipTestInfo(info)
+		peerInfo.xcfg.HelloTimeout = 0
+		peer, err := transportTestnewTransport(peerInfo)
+		if err != nil {
+			t.Fatalf("transportTestnewTransport(): %v", err)
+		}
+		defer peer.close()
+		go func() {
+			for {
+				if _, _, err := peer.recv(); err != nil {
+					return
+				}
+			}
+		}()
+
+		h := xport.health(time.Now())
+		if h.State != TunnelHealthUp || !h.LastRoundTrip.IsZero() {
+			t.Fatalf("expected new transport to be up with no round trip, got %v, %v", h.State, h.LastRoundTrip)
+		}
+
+		// The transport sends a HELLO after a hello interval, which
+		// the peer acknowledges.
+		for i := 0; i < 200 && h.LastRoundTrip.IsZero(); i++ {
+			time.Sleep(10 * time.Millisecond)
+			h = xport.health(time.Now())
+		}
+		if h.LastRoundTrip.IsZero() {
+			t.Fatalf("no HELLO acknowledged by peer")
+		}
+		if h.State != TunnelHealthUp {
+			t.Errorf("expected %v after round trip, got %v", TunnelHealthUp, h.State)
+		}
+		if n := xport.getRetransmits(); n != 0 {
+			t.Errorf("expected no retransmits to a responsive peer, got %v", n)
+		}
+
+		// Had the peer gone quiet, the transport would be degraded
+		// once sufficient hello intervals have elapsed.
+		later := time.Now().Add((HealthDegradedIntervals + 1) * helloTimeout)
+		if got := xport.health(later).State; got != TunnelHealthDegraded {
+			t.Errorf("expected %v at %v, got %v", TunnelHealthDegraded, later, got)
+		}
+
+		xport.abort(errors.New("test abort"))
+		h = waitHealth(xport, TunnelHealthDown)
+		if h.State != TunnelHealthDown {
+			t.Errorf("expected %v after abort, got %v", TunnelHealthDown, h.State)
+		}
+	})
+
+	t.Run("Silent peer", func(t *testing.T) {
+		// The peer socket receives but never acknowledges messages.
+		sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9109})
+		if err != nil {
+			t.Fatalf("net.ListenUDP(): %v", err)
+		}
+		defer sink.Close()
+
+		xport, err := transportTestnewTransport(&transportSendRecvTestInfo{
+			local: "127.0.0.1:9108",
+			peer:  "127.0.0.1:9109",
+			encap: EncapTypeUDP,
+			xcfg: transportConfig{
+				Version:           ProtocolVersion2,
+				PeerControlConnID: 90,
+				HelloTimeout:      helloTimeout,
+				MaxRetries:        10,
+			},
+		})
+		if err != nil {
+			t.Fatalf("transportTestnewTransport(): %v", err)
+		}
+		defer xport.close()
+
+		if got := xport.health(time.Now()).State; got != TunnelHealthUp {
+			t.Fatalf("expected new transport to be %v, got %v", TunnelHealthUp, got)
+		}
+		h := waitHealth(xport, TunnelHealthDegraded)
+		if h.State != TunnelHealthDegraded {
+			t.Errorf("expected %v with unacknowledged HELLO, got %v", TunnelHealthDegraded, h.State)
+		}
+		if !h.LastRoundTrip.IsZero() {
+			t.Errorf("expected no round trip, got %v", h.LastRoundTrip)
+		}
+
+		// The unacknowledged HELLO is retransmitted
+		for i := 0; i < 300 && xport.getRetransmits() == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if xport.getRetransmits() == 0 {
+			t.Errorf("expected unacknowledged HELLO to be retransmitted")
+		}
+	})
+}
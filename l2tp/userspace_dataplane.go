@@ -0,0 +1,436 @@
+package l2tp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ DataPlane = (*UserspaceDataPlane)(nil)
+var _ TunnelDataPlane = (*userspaceTunnelDataPlane)(nil)
+var _ SessionDataPlane = (*userspaceSessionDataPlane)(nil)
+var _ io.ReadWriteCloser = (*userspaceSessionDataPlane)(nil)
+
+// L2TP data header flags per RFC2661 section 3.1 and RFC3931 section 4.1.2.1
+const (
+	dataHeaderFlagType   = 0x8000
+	dataHeaderFlagLength = 0x4000
+	dataHeaderFlagSeq    = 0x0800
+	dataHeaderFlagOffset = 0x0200
+	dataHeaderVerMask    = 0x000f
+)
+
+// RFC3931 section 4.6 default L2-Specific Sublayer
+const (
+	l2SpecDefaultLen     = 4
+	l2SpecDefaultFlagSeq = 0x40000000
+	l2SpecDefaultSeqMask = 0x00ffffff
+)
+
+// userspaceSessionRxQueueLen is the number of received data packets
+// queued for each session before further packets are dropped.
+const userspaceSessionRxQueueLen = 64
+
+// UserspaceDataPlane is a DataPlane which handles session data packets
+// in userspace rather than instantiating tunnels and sessions in the kernel.
+//
+// Each session's data traffic is presented as an io.ReadWriteCloser,
+// obtained using SessionConn.  Reads return the payload of data packets
+// received for the session with the L2TP data header removed, while
+// writes send the frame written with an L2TP data header added.  This
+// allows pseudowire traffic to be forwarded in userspace, and data flow
+// to be tested without root permissions.
+//
+// UserspaceDataPlane supports dynamic and quiescent tunnels using UDP
+// encapsulation.  Static tunnels have no userspace socket, and the kernel
+// doesn't pass data packets for IP-encapsulated tunnels to userspace,
+// so neither can be used with UserspaceDataPlane.
+type UserspaceDataPlane struct {
+	lock    sync.Mutex
+	tunnels map[ControlConnID]*userspaceTunnelDataPlane
+}
+
+type userspaceTunnelDataPlane struct {
+	dp       *UserspaceDataPlane
+	cfg      *TunnelConfig
+	file     *os.File
+	lock     sync.Mutex
+	sessions map[ControlConnID]*userspaceSessionDataPlane
+}
+
+type userspaceSessionDataPlane struct {
+	tdp       *userspaceTunnelDataPlane
+	ptid      ControlConnID
+	lock      sync.Mutex
+	cfg       *SessionConfig
+	ns        uint32
+	stats     SessionDataPlaneStatistics
+	rxChan    chan []byte
+	closeChan chan interface{}
+	closeOnce sync.Once
+}
+
+// NewUserspaceDataPlane returns a new UserspaceDataPlane.
+// Pass the UserspaceDataPlane to NewContext to use it.
+func NewUserspaceDataPlane() *UserspaceDataPlane {
+	return &UserspaceDataPlane{
+		tunnels: make(map[ControlConnID]*userspaceTunnelDataPlane),
+	}
+}
+
+// SessionConn returns the data connection of the session with the
+// specified local tunnel and session IDs.  The session's data plane
+// must have been established: this is the case once the SessionUpEvent
+// for the session has been delivered.
+//
+// Each Read returns a single frame.  If the buffer passed to Read is
+// too small for the frame, the frame is truncated.  Reads block until
+// a frame is received, or until the connection is closed, following
+// which io.EOF is returned.
+//
+// Closing the connection does not close the session.  When the session
+// is closed its connection is closed too.
+func (dp *UserspaceDataPlane) SessionConn(tunnelID, sessionID ControlConnID) (io.ReadWriteCloser, error) {
+	dp.lock.Lock()
+	tdp, ok := dp.tunnels[tunnelID]
+	dp.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no data plane for tunnel ID %d", tunnelID)
+	}
+	sdp, ok := tdp.getSession(sessionID)
+	if !ok {
+		return nil, fmt.Errorf("no data plane for session ID %d in tunnel ID %d", sessionID, tunnelID)
+	}
+	return sdp, nil
+}
+
+// NewTunnel creates a tunnel data plane using the tunnel socket.
+// Data packets received on the socket are passed to the tunnel data
+// plane by the tunnel's control plane.
+func (dp *UserspaceDataPlane) NewTunnel(tcfg *TunnelConfig, sal, sap unix.Sockaddr, fd int) (TunnelDataPlane, error) {
+	if fd < 0 {
+		return nil, fmt.Errorf("userspace data plane requires a tunnel socket")
+	}
+	if tcfg.Encap != EncapTypeUDP {
+		return nil, fmt.Errorf("userspace data plane supports UDP encapsulation only")
+	}
+
+	// Duplicate the socket so that the data plane's lifetime is
+	// independent of the control plane's.  The duplicate shares the
+	// original's non-blocking mode, so os.NewFile registers it with the
+	// runtime poller.
+	dupfd, err := unix.Dup(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to duplicate tunnel socket: %v", err)
+	}
+
+	tcfgCopy := *tcfg
+	tdp := &userspaceTunnelDataPlane{
+		dp:       dp,
+		cfg:      &tcfgCopy,
+		file:     os.NewFile(uintptr(dupfd), "l2tp-data"),
+		sessions: make(map[ControlConnID]*userspaceSessionDataPlane),
+	}
+
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	if _, ok := dp.tunnels[tcfg.TunnelID]; ok {
+		tdp.file.Close()
+		return nil, fmt.Errorf("already have data plane for tunnel ID %d", tcfg.TunnelID)
+	}
+	dp.tunnels[tcfg.TunnelID] = tdp
+	return tdp, nil
+}
+
+// NewSession creates a session data plane in the parent tunnel's
+// data plane.
+func (dp *UserspaceDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	dp.lock.Lock()
+	tdp, ok := dp.tunnels[tid]
+	dp.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no data plane for tunnel ID %d", tid)
+	}
+
+	scfgCopy := *scfg
+	sdp := &userspaceSessionDataPlane{
+		tdp:       tdp,
+		ptid:      ptid,
+		cfg:       &scfgCopy,
+		rxChan:    make(chan []byte, userspaceSessionRxQueueLen),
+		closeChan: make(chan interface{}),
+	}
+
+	tdp.lock.Lock()
+	defer tdp.lock.Unlock()
+	if _, ok := tdp.sessions[scfg.SessionID]; ok {
+		return nil, fmt.Errorf("already have data plane for session ID %d in tunnel ID %d",
+			scfg.SessionID, tid)
+	}
+	tdp.sessions[scfg.SessionID] = sdp
+	return sdp, nil
+}
+
+// Close is called by Context.Close.  UserspaceDataPlane requires no
+// cleanup since tunnel and session data planes are torn down by their
+// owners.
+func (dp *UserspaceDataPlane) Close() {
+}
+
+func (tdp *userspaceTunnelDataPlane) getSession(sid ControlConnID) (*userspaceSessionDataPlane, bool) {
+	tdp.lock.Lock()
+	defer tdp.lock.Unlock()
+	sdp, ok := tdp.sessions[sid]
+	return sdp, ok
+}
+
+func (tdp *userspaceTunnelDataPlane) unlinkSession(sid ControlConnID) {
+	tdp.lock.Lock()
+	defer tdp.lock.Unlock()
+	delete(tdp.sessions, sid)
+}
+
+// handleDataPacket demultiplexes a data packet received on the tunnel
+// socket to the session it is addressed to.
+func (tdp *userspaceTunnelDataPlane) handleDataPacket(b []byte) {
+	sid, err := dataPacketSessionID(tdp.cfg.Version, b)
+	if err != nil {
+		return
+	}
+	sdp, ok := tdp.getSession(sid)
+	if !ok {
+		return
+	}
+	sdp.receive(b)
+}
+
+func (tdp *userspaceTunnelDataPlane) SetDebugFlags(flags DebugFlags) error {
+	return nil
+}
+
+func (tdp *userspaceTunnelDataPlane) Down() error {
+	tdp.dp.lock.Lock()
+	delete(tdp.dp.tunnels, tdp.cfg.TunnelID)
+	tdp.dp.lock.Unlock()
+
+	tdp.lock.Lock()
+	sessions := tdp.sessions
+	tdp.sessions = make(map[ControlConnID]*userspaceSessionDataPlane)
+	tdp.lock.Unlock()
+
+	for _, sdp := range sessions {
+		sdp.Close()
+	}
+	return tdp.file.Close()
+}
+
+func (sdp *userspaceSessionDataPlane) receive(b []byte) {
+	sdp.lock.Lock()
+	defer sdp.lock.Unlock()
+	payload, err := parseDataPacket(sdp.tdp.cfg.Version, sdp.cfg, b)
+	if err != nil {
+		sdp.stats.RxErrors++
+		return
+	}
+	select {
+	case <-sdp.closeChan:
+		sdp.stats.RxErrors++
+	case sdp.rxChan <- payload:
+		sdp.stats.RxPackets++
+		sdp.stats.RxBytes += uint64(len(payload))
+	default:
+		sdp.stats.RxErrors++
+	}
+}
+
+// Read reads a single data frame received for the session.
+func (sdp *userspaceSessionDataPlane) Read(p []byte) (n int, err error) {
+	select {
+	case <-sdp.closeChan:
+		return 0, io.EOF
+	case payload := <-sdp.rxChan:
+		return copy(p, payload), nil
+	}
+}
+
+// Write sends p as a data frame for the session.
+func (sdp *userspaceSessionDataPlane) Write(p []byte) (n int, err error) {
+	select {
+	case <-sdp.closeChan:
+		return 0, os.ErrClosed
+	default:
+	}
+
+	sdp.lock.Lock()
+	hdr := buildDataHeader(sdp.tdp.cfg.Version, sdp.tdp.cfg.PeerTunnelID, sdp.cfg, sdp.ns)
+	if sdp.cfg.SeqNum {
+		sdp.ns++
+	}
+	sdp.lock.Unlock()
+
+	_, err = sdp.tdp.file.Write(append(hdr, p...))
+
+	sdp.lock.Lock()
+	defer sdp.lock.Unlock()
+	if err != nil {
+		sdp.stats.TxErrors++
+		return 0, err
+	}
+	sdp.stats.TxPackets++
+	sdp.stats.TxBytes += uint64(len(p))
+	return len(p), nil
+}
+
+// Close closes the session's data connection.
+func (sdp *userspaceSessionDataPlane) Close() error {
+	sdp.closeOnce.Do(func() {
+		close(sdp.closeChan)
+	})
+	return nil
+}
+
+func (sdp *userspaceSessionDataPlane) GetStatistics() (*SessionDataPlaneStatistics, error) {
+	sdp.lock.Lock()
+	defer sdp.lock.Unlock()
+	stats := sdp.stats
+	return &stats, nil
+}
+
+func (sdp *userspaceSessionDataPlane) Modify(cfg *SessionConfig) error {
+	sdp.lock.Lock()
+	defer sdp.lock.Unlock()
+	applySessionModify(sdp.cfg, cfg)
+	return nil
+}
+
+func (sdp *userspaceSessionDataPlane) GetInterfaceName() (string, error) {
+	return "", nil
+}
+
+func (sdp *userspaceSessionDataPlane) Down() error {
+	sdp.tdp.unlinkSession(sdp.cfg.SessionID)
+	return sdp.Close()
+}
+
+// buildDataHeader returns the L2TP data header for a data packet sent
+// by a session.  For L2TPv2 the header is per RFC2661 section 3.1, while
+// for L2TPv3 the header is the UDP encapsulation header of RFC3931
+// section 4.1.2.1 followed by the session header of section 4.1.
+func buildDataHeader(version ProtocolVersion, ptid ControlConnID, cfg *SessionConfig, ns uint32) []byte {
+	buf := new(bytes.Buffer)
+	if version == ProtocolVersion2 {
+		flags := uint16(ProtocolVersion2)
+		if cfg.SeqNum {
+			flags |= dataHeaderFlagSeq
+		}
+		binary.Write(buf, binary.BigEndian, flags)
+		binary.Write(buf, binary.BigEndian, uint16(ptid))
+		binary.Write(buf, binary.BigEndian, uint16(cfg.PeerSessionID))
+		if cfg.SeqNum {
+			binary.Write(buf, binary.BigEndian, uint16(ns))
+			binary.Write(buf, binary.BigEndian, uint16(0))
+		}
+		return buf.Bytes()
+	}
+
+	binary.Write(buf, binary.BigEndian, uint16(ProtocolVersion3))
+	binary.Write(buf, binary.BigEndian, uint16(0))
+	binary.Write(buf, binary.BigEndian, uint32(cfg.PeerSessionID))
+	buf.Write(cfg.Cookie)
+	if cfg.L2SpecType == L2SpecTypeDefault {
+		var l2spec uint32
+		if cfg.SeqNum {
+			l2spec = l2SpecDefaultFlagSeq | (ns & l2SpecDefaultSeqMask)
+		}
+		binary.Write(buf, binary.BigEndian, l2spec)
+	}
+	return buf.Bytes()
+}
+
+// dataPacketSessionID returns the session ID from the header of a
+// received data packet.
+func dataPacketSessionID(version ProtocolVersion, b []byte) (ControlConnID, error) {
+	if len(b) < 2 {
+		return 0, errors.New("data packet too short")
+	}
+	flags := binary.BigEndian.Uint16(b)
+	if flags&dataHeaderFlagType != 0 {
+		return 0, errors.New("not a data packet")
+	}
+	if ProtocolVersion(flags&dataHeaderVerMask) != version {
+		return 0, fmt.Errorf("data packet version %d doesn't match tunnel version %v",
+			flags&dataHeaderVerMask, version)
+	}
+
+	if version == ProtocolVersion2 {
+		off := 4
+		if flags&dataHeaderFlagLength != 0 {
+			off += 2
+		}
+		if len(b) < off+2 {
+			return 0, errors.New("data packet too short")
+		}
+		return ControlConnID(binary.BigEndian.Uint16(b[off:])), nil
+	}
+
+	if len(b) < 8 {
+		return 0, errors.New("data packet too short")
+	}
+	return ControlConnID(binary.BigEndian.Uint32(b[4:])), nil
+}
+
+// parseDataPacket validates the header of a data packet received for a
+// session, and returns the packet payload.
+func parseDataPacket(version ProtocolVersion, cfg *SessionConfig, b []byte) ([]byte, error) {
+	flags := binary.BigEndian.Uint16(b)
+
+	if version == ProtocolVersion2 {
+		off := 6
+		if flags&dataHeaderFlagLength != 0 {
+			if len(b) < 8 {
+				return nil, errors.New("data packet too short")
+			}
+			length := int(binary.BigEndian.Uint16(b[2:]))
+			if length > len(b) {
+				return nil, fmt.Errorf("data packet length %d exceeds buffer bounds of %d", length, len(b))
+			}
+			b = b[:length]
+			off += 2
+		}
+		if flags&dataHeaderFlagSeq != 0 {
+			off += 4
+		}
+		if flags&dataHeaderFlagOffset != 0 {
+			if len(b) < off+2 {
+				return nil, errors.New("data packet too short")
+			}
+			off += 2 + int(binary.BigEndian.Uint16(b[off:]))
+		}
+		if len(b) < off {
+			return nil, errors.New("data packet too short")
+		}
+		return b[off:], nil
+	}
+
+	off := 8
+	if len(b) < off+len(cfg.PeerCookie) {
+		return nil, errors.New("data packet too short")
+	}
+	if !bytes.Equal(b[off:off+len(cfg.PeerCookie)], cfg.PeerCookie) {
+		return nil, errors.New("data packet cookie mismatch")
+	}
+	off += len(cfg.PeerCookie)
+	if cfg.L2SpecType == L2SpecTypeDefault {
+		off += l2SpecDefaultLen
+	}
+	if len(b) < off {
+		return nil, errors.New("data packet too short")
+	}
+	return b[off:], nil
+}
@@ -0,0 +1,156 @@
+package l2tp
+
+import (
+	"fmt"
+	"sync"
+)
+
+// VendorAVPCodec converts the value of a vendor-specific AVP between its
+// wire format and a Go type chosen by the application.
+type VendorAVPCodec struct {
+	// Encode converts a value to the AVP's wire format.  It should
+	// return an error if the value is not of the expected type.
+	Encode func(value interface{}) ([]byte, error)
+	// Decode converts the AVP's wire format to a value.  It should
+	// return an error if the data is malformed.
+	Decode func(b []byte) (interface{}, error)
+}
+
+// VendorAVP is a vendor-specific AVP whose value is converted to and
+// from its wire format by the VendorAVPCodec registered for the vendor
+// ID and type using RegisterVendorAVP.
+type VendorAVP struct {
+	VendorID  uint16
+	Type      uint16
+	Mandatory bool
+	Value     interface{}
+}
+
+type vendorAVPKey struct {
+	vendorID avpVendorID
+	avpType  avpType
+}
+
+var vendorAVPRegistry = struct {
+	sync.RWMutex
+	codecs map[vendorAVPKey]VendorAVPCodec
+}{
+	codecs: make(map[vendorAVPKey]VendorAVPCodec),
+}
+
+// RegisterVendorAVP registers a codec for the vendor-specific AVP with
+// the specified vendor ID and type, e.g. a Cisco AVP with vendor ID 9.
+//
+// Once registered the AVP is recognised by all tunnels: it is retained
+// when parsing received control messages rather than being discarded or,
+// if flagged as mandatory, causing the tunnel or session to be torn down.
+// Registered AVPs received from the peer during tunnel establishment are
+// reported by TunnelUpEvent, and may be sent to the peer by setting
+// TunnelConfig.VendorAVPs.  RawAVP.Decode decodes a registered AVP
+// returned by ParseRawControlMessages.
+//
+// AVPs are typically registered during program initialisation.
+// An error is returned if the vendor ID is the IETF vendor ID 0, if the
+// AVP is already registered, or if the codec is incomplete.
+func RegisterVendorAVP(vendorID, attrType uint16, codec VendorAVPCodec) error {
+	if vendorID == vendorIDIetf {
+		return fmt.Errorf("cannot register AVP with IETF vendor ID %v", vendorID)
+	}
+	if codec.Encode == nil || codec.Decode == nil {
+		return fmt.Errorf("vendor AVP codec must implement Encode and Decode")
+	}
+
+	key := vendorAVPKey{avpVendorID(vendorID), avpType(attrType)}
+
+	vendorAVPRegistry.Lock()
+	defer vendorAVPRegistry.Unlock()
+	if _, ok := vendorAVPRegistry.codecs[key]; ok {
+		return fmt.Errorf("vendor %v AVP %v is already registered", vendorID, attrType)
+	}
+	vendorAVPRegistry.codecs[key] = codec
+	return nil
+}
+
+func lookupVendorAVP(vendorID avpVendorID, t avpType) (VendorAVPCodec, bool) {
+	vendorAVPRegistry.RLock()
+	defer vendorAVPRegistry.RUnlock()
+	codec, ok := vendorAVPRegistry.codecs[vendorAVPKey{vendorID, t}]
+	return codec, ok
+}
+
+// Decode decodes the value of an AVP using the codec registered for
+// its vendor ID and type.  An error is returned if no codec is
+// registered, or if the AVP is hidden.
+func (a *RawAVP) Decode() (interface{}, error) {
+	codec, ok := lookupVendorAVP(avpVendorID(a.VendorID), avpType(a.Type))
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for vendor %v AVP %v", a.VendorID, a.Type)
+	}
+	if a.Hidden {
+		return nil, fmt.Errorf("cannot decode hidden vendor %v AVP %v", a.VendorID, a.Type)
+	}
+	return codec.Decode(a.Value)
+}
+
+// toAvp encodes a vendor AVP using its registered codec.
+func (va *VendorAVP) toAvp() (*avp, error) {
+	codec, ok := lookupVendorAVP(avpVendorID(va.VendorID), avpType(va.Type))
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for vendor %v AVP %v", va.VendorID, va.Type)
+	}
+	b, err := codec.Encode(va.Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode vendor %v AVP %v: %v", va.VendorID, va.Type, err)
+	}
+	if len(b)+avpHeaderLen > 0x3ff {
+		return nil, fmt.Errorf("vendor %v AVP %v value length %d too long to encode",
+			va.VendorID, va.Type, len(b))
+	}
+	return &avp{
+		header: *newAvpHeader(va.Mandatory, false, uint(len(b)),
+			avpVendorID(va.VendorID), avpType(va.Type)),
+		payload: avpPayload{
+			dataType: avpDataTypeBytes,
+			data:     b,
+		},
+	}, nil
+}
+
+// appendVendorAvps encodes vendor AVPs and appends them to a message.
+func appendVendorAvps(msg controlMessage, vas []VendorAVP) error {
+	for i := range vas {
+		a, err := vas[i].toAvp()
+		if err != nil {
+			return err
+		}
+		msg.appendAvp(a)
+	}
+	return nil
+}
+
+// findVendorAvps decodes the registered vendor AVPs in a message.
+func findVendorAvps(avps []avp) ([]VendorAVP, error) {
+	var out []VendorAVP
+	for i := range avps {
+		a := &avps[i]
+		if a.vendorID() == vendorIDIetf {
+			continue
+		}
+		codec, ok := lookupVendorAVP(a.vendorID(), a.getType())
+		if !ok {
+			continue
+		}
+		v, err := codec.Decode(a.payload.data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode vendor %v AVP %v: %v",
+				uint16(a.vendorID()), uint16(a.getType()), err)
+		}
+		out = append(out, VendorAVP{
+			VendorID:  uint16(a.vendorID()),
+			Type:      uint16(a.getType()),
+			Mandatory: a.isMandatory(),
+			Value:     v,
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,87 @@
+package l2tp
+
+import (
+	"runtime/debug"
+
+	"github.com/katalix/go-l2tp/internal/nll2tp"
+)
+
+const modulePath = "github.com/katalix/go-l2tp"
+
+// Data plane names reported by Capabilities.
+const (
+	// DataPlaneNull is the data plane used by a Context created with a
+	// nil DataPlane.  It is always available.
+	DataPlaneNull = "null"
+	// DataPlaneUserspace is the data plane implemented by
+	// UserspaceDataPlane.  It is always available.
+	DataPlaneUserspace = "userspace"
+	// DataPlaneNetlink is the Linux kernel data plane used by a Context
+	// created with LinuxNetlinkDataPlane.  It is available only if the
+	// kernel L2TP subsystem can be reached.
+	DataPlaneNetlink = "netlink"
+)
+
+// CapabilitySet describes the features supported by the package.
+type CapabilitySet struct {
+	// DataPlanes lists the names of the data planes available,
+	// as DataPlane* values.
+	DataPlanes []string
+	// ProtocolVersions lists the L2TP protocol versions supported.
+	ProtocolVersions []ProtocolVersion
+	// EncapTypes lists the tunnel encapsulation types supported.
+	EncapTypes []EncapType
+}
+
+// netlinkAvailable reports whether the kernel L2TP subsystem can be
+// reached.  It may be replaced in tests.
+var netlinkAvailable = func() bool {
+	c, err := nll2tp.Dial()
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+// Version returns the version of the go-l2tp module built into the
+// running binary, as recorded in the binary's build information.
+//
+// "(devel)" is returned if the binary was built from a go-l2tp source
+// tree rather than a tagged module version, and "unknown" is returned
+// if no build information is available.
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			if dep.Replace != nil && dep.Replace.Version != "" {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// Capabilities returns the features supported by the package.
+//
+// Availability of the Linux kernel data plane is determined by
+// attempting to connect to the kernel L2TP subsystem, which requires
+// the kernel L2TP modules to be loaded.
+func Capabilities() *CapabilitySet {
+	caps := &CapabilitySet{
+		DataPlanes:       []string{DataPlaneNull, DataPlaneUserspace},
+		ProtocolVersions: []ProtocolVersion{ProtocolVersion2, ProtocolVersion3},
+		EncapTypes:       []EncapType{EncapTypeUDP, EncapTypeIP},
+	}
+	if netlinkAvailable() {
+		caps.DataPlanes = append(caps.DataPlanes, DataPlaneNetlink)
+	}
+	return caps
+}